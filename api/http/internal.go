@@ -16,11 +16,14 @@ package http
 
 import (
 	"net/http"
+	"strings"
 
 	"github.com/mendersoftware/iot-manager/app"
 	"github.com/mendersoftware/iot-manager/client"
+	"github.com/mendersoftware/iot-manager/model"
 
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 	"github.com/mendersoftware/go-lib-micro/identity"
 	"github.com/mendersoftware/go-lib-micro/rest.utils"
 	"github.com/pkg/errors"
@@ -29,6 +32,18 @@ import (
 const (
 	ParamTenantID = "tenant_id"
 	ParamDeviceID = "device_id"
+
+	ParamIntegrationID = "integration_id"
+	ParamRevision      = "revision"
+	ParamJobID         = "job_id"
+	ParamModuleID      = "module_id"
+	ParamMethodName    = "method_name"
+	ParamConfigID      = "configuration_id"
+
+	QueryDevices = "devices"
+	QueryType    = "type"
+	QueryStatus  = "status"
+	QueryAsync   = "async"
 )
 
 type InternalHandler APIHandler
@@ -38,7 +53,8 @@ type InternalHandler APIHandler
 //       500 - internal server error
 func (h *InternalHandler) ProvisionDevice(c *gin.Context) {
 	var device struct {
-		ID string `json:"device_id"`
+		ID         string `json:"device_id"`
+		DeviceType string `json:"device_type"`
 	}
 	tenantID := c.Param(ParamTenantID)
 	if err := c.ShouldBindJSON(&device); err != nil {
@@ -55,9 +71,9 @@ func (h *InternalHandler) ProvisionDevice(c *gin.Context) {
 		Subject: device.ID,
 		Tenant:  tenantID,
 	})
-	err := h.app.ProvisionDevice(ctx, device.ID)
+	err := h.app.ProvisionDevice(ctx, device.ID, device.DeviceType)
 	switch cause := errors.Cause(err); cause {
-	case nil, app.ErrNoConnectionString:
+	case nil, app.ErrNoIntegrations, app.ErrNoConnectionString, app.ErrNoCredentials:
 		c.Status(http.StatusNoContent)
 	case app.ErrDeviceAlreadyExists:
 		rest.RenderError(c, http.StatusConflict, cause)
@@ -76,7 +92,7 @@ func (h *InternalHandler) DecomissionDevice(c *gin.Context) {
 	})
 	err := h.app.DeleteIOTHubDevice(ctx, deviceID)
 	switch errors.Cause(err) {
-	case nil, app.ErrNoConnectionString:
+	case nil, app.ErrNoIntegrations, app.ErrNoConnectionString, app.ErrNoCredentials:
 		c.Status(http.StatusNoContent)
 	default:
 		rest.RenderError(c, http.StatusInternalServerError, err)
@@ -98,7 +114,13 @@ type BulkItem struct {
 }
 
 const (
-	maxBulkItems = 100
+	defaultMaxBulkItems = 100
+	// defaultMaxBulkJobItems is the default maximum number of devices
+	// of a bulk request run as a job.
+	defaultMaxBulkJobItems = 10000
+	// defaultMaxBulkDecommissionItems is larger as the devices are deleted
+	// from the hub in batches.
+	defaultMaxBulkDecommissionItems = 10000
 )
 
 // PUT /tenants/:tenant_id/bulk/devices/status
@@ -113,11 +135,7 @@ func (h *InternalHandler) BulkSetDeviceStatus(c *gin.Context) {
 			errors.Wrap(err, "invalid request body"),
 		)
 		return
-	} else if len(schema.DeviceIDs) > maxBulkItems {
-		rest.RenderError(c,
-			http.StatusBadRequest,
-			errors.New("too many bulk items: max 100 items per request"),
-		)
+	} else if !h.checkBulkItems(c, len(schema.DeviceIDs), h.maxBulkItems) {
 		return
 	}
 	ctx := identity.WithContext(
@@ -126,27 +144,387 @@ func (h *InternalHandler) BulkSetDeviceStatus(c *gin.Context) {
 			Tenant: c.Param("tenant_id"),
 		},
 	)
+	errs, err := h.app.SetDevicesStatus(ctx, schema.DeviceIDs, schema.Status)
+	if err != nil {
+		rest.RenderError(c, http.StatusInternalServerError, err)
+		return
+	}
 	res := BulkResult{
 		Error: false,
 		Items: make([]BulkItem, len(schema.DeviceIDs)),
 	}
-	for i, id := range schema.DeviceIDs {
+	for i, err := range errs {
 		res.Items[i].Parameters = map[string]interface{}{
 			"device_id": schema.DeviceIDs[i],
 		}
-		err := h.app.SetDeviceStatus(ctx, id, schema.Status)
 		if err != nil {
 			res.Error = true
-			if e, ok := errors.Cause(err).(client.HTTPError); ok {
-				res.Items[i].Status = e.Code
-				res.Items[i].Description = e.Error()
-			} else {
-				res.Items[i].Status = http.StatusInternalServerError
-				res.Items[i].Description = err.Error()
-			}
+			res.Items[i].setError(err)
 		} else {
 			res.Items[i].Status = http.StatusOK
 		}
 	}
 	c.JSON(http.StatusOK, res)
 }
+
+// checkBulkItems renders an error and returns false if the request has more
+// than maxItems items.
+func (h *InternalHandler) checkBulkItems(c *gin.Context, n, maxItems int) bool {
+	if n > maxItems {
+		rest.RenderError(c,
+			http.StatusBadRequest,
+			errors.Errorf("too many bulk items: max %d items per request", maxItems),
+		)
+		return false
+	}
+	return true
+}
+
+// setError sets the status of the item from the error of the operation.
+func (item *BulkItem) setError(err error) {
+	if e, ok := errors.Cause(err).(client.HTTPError); ok {
+		item.Status = e.Code
+		item.Description = e.Error()
+	} else {
+		item.Status = http.StatusInternalServerError
+		item.Description = err.Error()
+	}
+}
+
+// POST /tenants/:tenant_id/bulk/devices
+// code: 200 - the result of every device provisioning
+//       202 - device provisioning job started (?async=true)
+//       400 - malformed request body
+//       500 - internal server error
+func (h *InternalHandler) BulkProvisionDevices(c *gin.Context) {
+	var schema struct {
+		DeviceIDs []string `json:"device_ids"`
+	}
+	async := c.Query(QueryAsync) == "true"
+	maxItems := h.maxBulkItems
+	if async {
+		maxItems = h.maxBulkJobItems
+	}
+	if err := c.ShouldBindJSON(&schema); err != nil {
+		rest.RenderError(c,
+			http.StatusBadRequest,
+			errors.Wrap(err, "malformed request body"),
+		)
+		return
+	} else if !h.checkBulkItems(c, len(schema.DeviceIDs), maxItems) {
+		return
+	}
+	for _, id := range schema.DeviceIDs {
+		if id == "" {
+			rest.RenderError(c, http.StatusBadRequest, errors.New("missing device ID"))
+			return
+		}
+	}
+	tenantID := c.Param(ParamTenantID)
+	ctx := identity.WithContext(c.Request.Context(), &identity.Identity{
+		Tenant: tenantID,
+	})
+	if async {
+		job, err := h.app.ScheduleDeviceProvisioning(ctx, schema.DeviceIDs)
+		if err != nil {
+			rest.RenderError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.Header("Location", APIURLInternal+strings.NewReplacer(
+			":"+ParamTenantID, tenantID,
+			":"+ParamJobID, job.ID.String(),
+		).Replace(APIURLTenantJob))
+		c.JSON(http.StatusAccepted, job)
+		return
+	}
+	errs, err := h.app.ProvisionDevices(ctx, schema.DeviceIDs)
+	if err != nil {
+		rest.RenderError(c, http.StatusInternalServerError, err)
+		return
+	}
+	res := BulkResult{
+		Error: false,
+		Items: make([]BulkItem, len(schema.DeviceIDs)),
+	}
+	for i, err := range errs {
+		res.Items[i].Parameters = map[string]interface{}{
+			"device_id": schema.DeviceIDs[i],
+		}
+		switch cause := errors.Cause(err); cause {
+		case nil, app.ErrNoIntegrations, app.ErrNoConnectionString, app.ErrNoCredentials:
+			res.Items[i].Status = http.StatusNoContent
+		case app.ErrDeviceAlreadyExists:
+			res.Error = true
+			res.Items[i].Status = http.StatusConflict
+			res.Items[i].Description = cause.Error()
+		default:
+			res.Error = true
+			res.Items[i].setError(err)
+		}
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+// DELETE /tenants/:tenant_id/bulk/devices
+// code: 200 - the result of every device decommissioning
+//       400 - malformed request body
+//       500 - internal server error
+func (h *InternalHandler) BulkDecommissionDevices(c *gin.Context) {
+	var schema struct {
+		DeviceIDs []string `json:"device_ids"`
+	}
+	if err := c.ShouldBindJSON(&schema); err != nil {
+		rest.RenderError(c,
+			http.StatusBadRequest,
+			errors.Wrap(err, "malformed request body"),
+		)
+		return
+	} else if !h.checkBulkItems(c, len(schema.DeviceIDs), h.maxBulkDecommissionItems) {
+		return
+	}
+	ctx := identity.WithContext(c.Request.Context(), &identity.Identity{
+		Tenant: c.Param(ParamTenantID),
+	})
+	errs, err := h.app.DecommissionDevices(ctx, schema.DeviceIDs)
+	if err != nil {
+		rest.RenderError(c, http.StatusInternalServerError, err)
+		return
+	}
+	res := BulkResult{
+		Error: false,
+		Items: make([]BulkItem, len(schema.DeviceIDs)),
+	}
+	for i, err := range errs {
+		res.Items[i].Parameters = map[string]interface{}{
+			"device_id": schema.DeviceIDs[i],
+		}
+		switch errors.Cause(err) {
+		case nil, app.ErrNoIntegrations, app.ErrNoConnectionString, app.ErrNoCredentials:
+			res.Items[i].Status = http.StatusNoContent
+		default:
+			res.Error = true
+			res.Items[i].setError(err)
+		}
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+// bindKeyRotation parses the key rotation request body, the phase is
+// required.
+func bindKeyRotation(c *gin.Context) (model.KeyRotation, bool) {
+	var rotation model.KeyRotation
+	if err := c.ShouldBindJSON(&rotation); err != nil {
+		rest.RenderError(c,
+			http.StatusBadRequest,
+			errors.Wrap(err, "malformed request body"),
+		)
+		return rotation, false
+	}
+	return rotation, true
+}
+
+// keyRotationErrorCode returns the status code for key rotation errors that
+// are not internal errors.
+func keyRotationErrorCode(err error) (int, bool) {
+	switch cause := errors.Cause(err); cause {
+	case app.ErrNoIntegrations,
+		app.ErrKeyRotationNotSupported,
+		app.ErrDeviceModified:
+		return http.StatusConflict, true
+	default:
+		if htErr, ok := cause.(client.HTTPError); ok {
+			if htErr.Code == http.StatusNotFound {
+				return http.StatusNotFound, true
+			}
+			return http.StatusBadGateway, true
+		}
+	}
+	return http.StatusInternalServerError, false
+}
+
+func renderKeyRotationError(c *gin.Context, err error) bool {
+	code, ok := keyRotationErrorCode(err)
+	if !ok {
+		return false
+	}
+	if htErr, isHTTPErr := errors.Cause(err).(client.HTTPError); isHTTPErr {
+		renderProviderError(c, code, htErr)
+	} else {
+		rest.RenderError(c, code, errors.Cause(err))
+	}
+	return true
+}
+
+// POST /tenants/:tenant_id/devices/:device_id/rotate-keys
+// code: 204 - device keys rotated
+//       409 - the device keys cannot be rotated
+//       500 - internal server error
+func (h *InternalHandler) RotateDeviceKeys(c *gin.Context) {
+	rotation, ok := bindKeyRotation(c)
+	if !ok {
+		return
+	}
+	deviceID := c.Param(ParamDeviceID)
+	ctx := identity.WithContext(c.Request.Context(), &identity.Identity{
+		Subject: deviceID,
+		Tenant:  c.Param(ParamTenantID),
+	})
+	err := h.app.RotateDeviceKeys(ctx, deviceID, rotation.Phase)
+	if err != nil {
+		if !renderKeyRotationError(c, err) {
+			rest.RenderError(c, http.StatusInternalServerError, err)
+		}
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// POST /tenants/:tenant_id/rotate-keys
+// code: 202 - key rotation started
+//       409 - the tenant has no integrations supporting key rotation
+//       500 - internal server error
+func (h *InternalHandler) RotateTenantKeys(c *gin.Context) {
+	rotation, ok := bindKeyRotation(c)
+	if !ok {
+		return
+	}
+	ctx := identity.WithContext(c.Request.Context(), &identity.Identity{
+		Tenant: c.Param(ParamTenantID),
+	})
+	job, err := h.app.RotateTenantKeys(ctx, rotation.Phase)
+	if err != nil {
+		if !renderKeyRotationError(c, err) {
+			rest.RenderError(c, http.StatusInternalServerError, err)
+		}
+		return
+	}
+	c.Header("Location", APIURLInternal+strings.NewReplacer(
+		":"+ParamTenantID, c.Param(ParamTenantID),
+		":"+ParamJobID, job.ID.String(),
+	).Replace(APIURLTenantJob))
+	c.JSON(http.StatusAccepted, job)
+}
+
+// DELETE /tenants/:tenant_id
+// code: 202 - tenant deletion started
+//       400 - invalid devices action
+//       500 - internal server error
+func (h *InternalHandler) DeleteTenant(c *gin.Context) {
+	action := model.TenantDevicesAction(c.DefaultQuery(
+		QueryDevices, string(model.TenantDevicesKeep),
+	))
+	if err := action.Validate(); err != nil {
+		rest.RenderError(c,
+			http.StatusBadRequest,
+			errors.Wrap(err, "invalid query parameter "+QueryDevices),
+		)
+		return
+	}
+	tenantID := c.Param(ParamTenantID)
+	ctx := identity.WithContext(c.Request.Context(), &identity.Identity{
+		Tenant: tenantID,
+	})
+	job, err := h.app.DeleteTenant(ctx, action)
+	if err != nil {
+		rest.RenderError(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.Header("Location", APIURLInternal+strings.NewReplacer(
+		":"+ParamTenantID, tenantID,
+		":"+ParamJobID, job.ID.String(),
+	).Replace(APIURLTenantJob))
+	c.JSON(http.StatusAccepted, job)
+}
+
+// bindJobsQuery parses the paging parameters and the filter of a job
+// listing, it renders an error and returns false if they are invalid.
+func bindJobsQuery(c *gin.Context) (fltr model.JobFilter, page, perPage int64, ok bool) {
+	page, perPage, err := rest.ParsePagingParameters(c.Request)
+	if err != nil {
+		rest.RenderError(c, http.StatusBadRequest, err)
+		return fltr, 0, 0, false
+	}
+	fltr.Type = model.JobType(c.Query(QueryType))
+	if fltr.Type != "" {
+		if err = fltr.Type.Validate(); err != nil {
+			rest.RenderError(c,
+				http.StatusBadRequest,
+				errors.Wrap(err, "invalid query parameter "+QueryType),
+			)
+			return fltr, 0, 0, false
+		}
+	}
+	fltr.Status = model.JobStatus(c.Query(QueryStatus))
+	if fltr.Status != "" {
+		if err = fltr.Status.Validate(); err != nil {
+			rest.RenderError(c,
+				http.StatusBadRequest,
+				errors.Wrap(err, "invalid query parameter "+QueryStatus),
+			)
+			return fltr, 0, 0, false
+		}
+	}
+	return fltr, page, perPage, true
+}
+
+// renderJobsPage renders a page of jobs, retrieved with a limit of
+// perPage+1 to tell whether a next page exists.
+func renderJobsPage(c *gin.Context, jobs []model.Job, page, perPage int64) {
+	hasNext := int64(len(jobs)) > perPage
+	if hasNext {
+		jobs = jobs[:perPage]
+	}
+	links, _ := rest.MakePagingHeaders(c.Request, rest.NewPagingHints().
+		SetPage(page).
+		SetPerPage(perPage).
+		SetHasNext(hasNext),
+	)
+	for _, link := range links {
+		c.Writer.Header().Add(HdrKeyLink, link)
+	}
+	c.JSON(http.StatusOK, jobs)
+}
+
+// GET /tenants/:tenant_id/jobs
+// code: 200 - jobs of the tenant, most recent first
+//       400 - invalid query parameters
+//       500 - internal server error
+func (h *InternalHandler) GetJobs(c *gin.Context) {
+	fltr, page, perPage, ok := bindJobsQuery(c)
+	if !ok {
+		return
+	}
+	ctx := identity.WithContext(c.Request.Context(), &identity.Identity{
+		Tenant: c.Param(ParamTenantID),
+	})
+	jobs, err := h.app.GetJobs(ctx, fltr, (page-1)*perPage, perPage+1)
+	if err != nil {
+		rest.RenderError(c, http.StatusInternalServerError, err)
+		return
+	}
+	renderJobsPage(c, jobs, page, perPage)
+}
+
+// GET /tenants/:tenant_id/jobs/:job_id
+// code: 200 - job status
+//       404 - job not found
+//       500 - internal server error
+func (h *InternalHandler) GetJob(c *gin.Context) {
+	jobID, err := uuid.Parse(c.Param(ParamJobID))
+	if err != nil {
+		rest.RenderError(c, http.StatusNotFound, app.ErrJobNotFound)
+		return
+	}
+	ctx := identity.WithContext(c.Request.Context(), &identity.Identity{
+		Tenant: c.Param(ParamTenantID),
+	})
+	job, err := h.app.GetJob(ctx, jobID)
+	switch errors.Cause(err) {
+	case nil:
+		c.JSON(http.StatusOK, job)
+	case app.ErrJobNotFound:
+		rest.RenderError(c, http.StatusNotFound, err)
+	default:
+		rest.RenderError(c, http.StatusInternalServerError, err)
+	}
+}
@@ -30,6 +30,7 @@ import (
 	"github.com/mendersoftware/iot-manager/app"
 	mapp "github.com/mendersoftware/iot-manager/app/mocks"
 	"github.com/mendersoftware/iot-manager/client"
+	"github.com/mendersoftware/iot-manager/model"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 )
@@ -46,7 +47,8 @@ func validateTenantIDCtx(tenantID string) interface{} {
 func TestProvisionDevice(t *testing.T) {
 	t.Parallel()
 	type intrnlDevice struct {
-		ID string `json:"device_id"`
+		ID         string `json:"device_id"`
+		DeviceType string `json:"device_type,omitempty"`
 	}
 	type testCase struct {
 		Name string
@@ -63,14 +65,15 @@ func TestProvisionDevice(t *testing.T) {
 
 		TenantID: "123456789012345678901234",
 		Body: intrnlDevice{
-			ID: "b8ea97f2-1c2b-492c-84ce-7a90170291b9",
+			ID:         "b8ea97f2-1c2b-492c-84ce-7a90170291b9",
+			DeviceType: "raspberrypi4",
 		},
 		App: func(t *testing.T, self *testCase) *mapp.App {
 			mock := new(mapp.App)
 			device := self.Body.(intrnlDevice)
 			mock.On("ProvisionDevice",
 				validateTenantIDCtx(self.TenantID),
-				device.ID).
+				device.ID, device.DeviceType).
 				Return(nil)
 			return mock
 		},
@@ -88,11 +91,47 @@ func TestProvisionDevice(t *testing.T) {
 			device := self.Body.(intrnlDevice)
 			mock.On("ProvisionDevice",
 				validateTenantIDCtx(self.TenantID),
-				device.ID).
+				device.ID, device.DeviceType).
 				Return(app.ErrNoConnectionString)
 			return mock
 		},
 
+		StatusCode: http.StatusNoContent,
+	}, {
+		Name: "ok/noop aws",
+
+		TenantID: "123456789012345678901234",
+		Body: intrnlDevice{
+			ID: "b8ea97f2-1c2b-492c-84ce-7a90170291b9",
+		},
+		App: func(t *testing.T, self *testCase) *mapp.App {
+			mock := new(mapp.App)
+			device := self.Body.(intrnlDevice)
+			mock.On("ProvisionDevice",
+				validateTenantIDCtx(self.TenantID),
+				device.ID, device.DeviceType).
+				Return(app.ErrNoCredentials)
+			return mock
+		},
+
+		StatusCode: http.StatusNoContent,
+	}, {
+		Name: "ok/no integrations",
+
+		TenantID: "123456789012345678901234",
+		Body: intrnlDevice{
+			ID: "b8ea97f2-1c2b-492c-84ce-7a90170291b9",
+		},
+		App: func(t *testing.T, self *testCase) *mapp.App {
+			mock := new(mapp.App)
+			device := self.Body.(intrnlDevice)
+			mock.On("ProvisionDevice",
+				validateTenantIDCtx(self.TenantID),
+				device.ID, device.DeviceType).
+				Return(app.ErrNoIntegrations)
+			return mock
+		},
+
 		StatusCode: http.StatusNoContent,
 	}, {
 		Name: "error/malformed body",
@@ -128,7 +167,7 @@ func TestProvisionDevice(t *testing.T) {
 			device := self.Body.(intrnlDevice)
 			mock.On("ProvisionDevice",
 				validateTenantIDCtx(self.TenantID),
-				device.ID).
+				device.ID, device.DeviceType).
 				Return(errors.New("internal error"))
 			return mock
 		},
@@ -271,10 +310,16 @@ func TestDecommissionDevice(t *testing.T) {
 
 func TestBulkSetDeviceStatus(t *testing.T) {
 	t.Parallel()
+	deviceIDs := []string{
+		"960700f7-d563-4a31-94e6-a075fe6566bc",
+		"3fd916c1-6a5a-423c-b7da-739bf21c7779",
+		"1cb050b9-c20c-4807-bdbd-bc5650617198",
+	}
 	type testCase struct {
 		Name string
 
 		TenantID string
+		Config   *Config
 		ReqBody  interface{}
 		App      func(t *testing.T, self *testCase) *mapp.App
 
@@ -286,23 +331,18 @@ func TestBulkSetDeviceStatus(t *testing.T) {
 
 		TenantID: "123456789012345678901234",
 		ReqBody: map[string]interface{}{
-			"device_ids": []string{
-				"960700f7-d563-4a31-94e6-a075fe6566bc",
-				"3fd916c1-6a5a-423c-b7da-739bf21c7779",
-				"1cb050b9-c20c-4807-bdbd-bc5650617198",
-			},
-			"status": "enabled",
+			"device_ids": deviceIDs,
+			"status":     "enabled",
 		},
 		App: func(t *testing.T, self *testCase) *mapp.App {
 			var result BulkResult
 			mockApp := new(mapp.App)
-			req := self.ReqBody.(map[string]interface{})
-			for _, id := range req["device_ids"].([]string) {
-				mockApp.On("SetDeviceStatus",
-					contextMatcher,
-					id,
-					app.Status(app.StatusEnabled),
-				).Return(nil)
+			mockApp.On("SetDevicesStatus",
+				validateTenantIDCtx(self.TenantID),
+				deviceIDs,
+				app.Status(app.StatusEnabled),
+			).Return(make([]error, len(deviceIDs)), nil)
+			for _, id := range deviceIDs {
 				result.Items = append(result.Items, BulkItem{
 					Status: http.StatusOK,
 					Parameters: map[string]interface{}{
@@ -324,6 +364,11 @@ func TestBulkSetDeviceStatus(t *testing.T) {
 		},
 		App: func(t *testing.T, self *testCase) *mapp.App {
 			mockApp := new(mapp.App)
+			mockApp.On("SetDevicesStatus",
+				validateTenantIDCtx(self.TenantID),
+				[]string{},
+				app.Status(app.StatusEnabled),
+			).Return([]error{}, nil)
 			return mockApp
 		},
 		Response:   BulkResult{Items: []BulkItem{}},
@@ -333,58 +378,88 @@ func TestBulkSetDeviceStatus(t *testing.T) {
 
 		TenantID: "123456789012345678901234",
 		ReqBody: map[string]interface{}{
-			"device_ids": []string{
-				"960700f7-d563-4a31-94e6-a075fe6566bc",
-				"3fd916c1-6a5a-423c-b7da-739bf21c7779",
-				"1cb050b9-c20c-4807-bdbd-bc5650617198",
-			},
-			"status": "enabled",
+			"device_ids": deviceIDs,
+			"status":     "enabled",
 		},
 		App: func(t *testing.T, self *testCase) *mapp.App {
-			var result BulkResult
 			mockApp := new(mapp.App)
-			req := self.ReqBody.(map[string]interface{})
-			deviceIDs := req["device_ids"].([]string)
-			mockApp.On("SetDeviceStatus",
-				contextMatcher,
-				deviceIDs[0],
-				app.Status(app.StatusEnabled),
-			).Return(nil).Once()
-			result.Items = append(result.Items, BulkItem{
-				Status: http.StatusOK,
-				Parameters: map[string]interface{}{
-					"device_id": deviceIDs[0],
-				},
-			})
-			mockApp.On("SetDeviceStatus",
-				contextMatcher,
-				deviceIDs[1],
-				app.Status(app.StatusEnabled),
-			).Return(errors.New("internal error")).Once()
-			result.Items = append(result.Items, BulkItem{
-				Status:      http.StatusInternalServerError,
-				Description: "internal error",
-				Parameters: map[string]interface{}{
-					"device_id": deviceIDs[1],
-				},
-			})
-			mockApp.On("SetDeviceStatus",
-				contextMatcher,
-				deviceIDs[2],
+			mockApp.On("SetDevicesStatus",
+				validateTenantIDCtx(self.TenantID),
+				deviceIDs,
 				app.Status(app.StatusEnabled),
-			).Return(client.HTTPError{http.StatusConflict}).Once()
-			result.Items = append(result.Items, BulkItem{
-				Status:      http.StatusConflict,
-				Description: client.HTTPError{http.StatusConflict}.Error(),
-				Parameters: map[string]interface{}{
-					"device_id": deviceIDs[2],
+			).Return([]error{
+				nil,
+				errors.New("internal error"),
+				client.HTTPError{
+					Code:       http.StatusForbidden,
+					Service:    "iothub",
+					ErrorCode:  "IotHubQuotaExceeded",
+					Message:    "Total number of messages on IotHub exceeded the allocated quota.",
+					TrackingID: "1b7a9bd3ff4e4b5e-G:8",
 				},
-			})
-			result.Error = true
-			self.Response = result
+			}, nil)
+			self.Response = BulkResult{
+				Error: true,
+				Items: []BulkItem{{
+					Status: http.StatusOK,
+					Parameters: map[string]interface{}{
+						"device_id": deviceIDs[0],
+					},
+				}, {
+					Status:      http.StatusInternalServerError,
+					Description: "internal error",
+					Parameters: map[string]interface{}{
+						"device_id": deviceIDs[1],
+					},
+				}, {
+					Status: http.StatusForbidden,
+					Description: "iothub: unexpected status code from API: 403: " +
+						"IotHubQuotaExceeded: Total number of messages on IotHub " +
+						"exceeded the allocated quota. (tracking ID: 1b7a9bd3ff4e4b5e-G:8)",
+					Parameters: map[string]interface{}{
+						"device_id": deviceIDs[2],
+					},
+				}},
+			}
 			return mockApp
 		},
 		StatusCode: http.StatusOK,
+	}, {
+		Name: "error: too many bulk items",
+
+		TenantID: "123456789012345678901234",
+		Config:   NewConfig().SetMaxBulkItems(2),
+		ReqBody: map[string]interface{}{
+			"device_ids": deviceIDs,
+			"status":     "enabled",
+		},
+		App: func(t *testing.T, self *testCase) *mapp.App {
+			return new(mapp.App)
+		},
+		StatusCode: http.StatusBadRequest,
+		Response: regexp.MustCompile(
+			`{"error":\s?"too many bulk items: max 2 items per request",` +
+				`\s?"request_id":\s?"test"}`,
+		),
+	}, {
+		Name: "error: internal error",
+
+		TenantID: "123456789012345678901234",
+		ReqBody: map[string]interface{}{
+			"device_ids": deviceIDs,
+			"status":     "enabled",
+		},
+		App: func(t *testing.T, self *testCase) *mapp.App {
+			mockApp := new(mapp.App)
+			mockApp.On("SetDevicesStatus",
+				validateTenantIDCtx(self.TenantID),
+				deviceIDs,
+				app.Status(app.StatusEnabled),
+			).Return(nil, errors.New("internal error"))
+			return mockApp
+		},
+		StatusCode: http.StatusInternalServerError,
+		Response:   regexp.MustCompile(`{"error":\s?"internal error",\s?"request_id":\s?"test"}`),
 	}, {
 		Name: "error: invalid request body",
 
@@ -405,7 +480,7 @@ func TestBulkSetDeviceStatus(t *testing.T) {
 			app := tc.App(t, &tc)
 			defer app.AssertExpectations(t)
 			w := httptest.NewRecorder()
-			handler := NewRouter(app)
+			handler := NewRouter(app, tc.Config)
 			repl := strings.NewReplacer(":tenant_id", tc.TenantID)
 			var b []byte
 			switch t := tc.ReqBody.(type) {
@@ -440,3 +515,1015 @@ func TestBulkSetDeviceStatus(t *testing.T) {
 		})
 	}
 }
+
+func TestBulkProvisionDevices(t *testing.T) {
+	t.Parallel()
+	const tenantID = "123456789012345678901234"
+	deviceIDs := []string{
+		"960700f7-d563-4a31-94e6-a075fe6566bc",
+		"3fd916c1-6a5a-423c-b7da-739bf21c7779",
+		"1cb050b9-c20c-4807-bdbd-bc5650617198",
+		"5e1b3b6e-0c1f-4b8a-9a53-0f1c0c4f9b2d",
+	}
+	job := model.NewJob(tenantID, model.JobTypeProvisionDevices, nil)
+	type testCase struct {
+		Name string
+
+		Query   string
+		ReqBody interface{}
+		App     func(t *testing.T, self *testCase) *mapp.App
+
+		StatusCode int
+		Response   interface{}
+	}
+	testCases := []testCase{{
+		Name: "ok",
+
+		ReqBody: map[string]interface{}{
+			"device_ids": deviceIDs[:2],
+		},
+		App: func(t *testing.T, self *testCase) *mapp.App {
+			mockApp := new(mapp.App)
+			mockApp.On("ProvisionDevices",
+				validateTenantIDCtx(tenantID),
+				deviceIDs[:2],
+			).Return([]error{nil, app.ErrNoIntegrations}, nil)
+			return mockApp
+		},
+		StatusCode: http.StatusOK,
+		Response: BulkResult{Items: []BulkItem{{
+			Status:     http.StatusNoContent,
+			Parameters: map[string]interface{}{"device_id": deviceIDs[0]},
+		}, {
+			Status:     http.StatusNoContent,
+			Parameters: map[string]interface{}{"device_id": deviceIDs[1]},
+		}}},
+	}, {
+		Name: "error, partial result",
+
+		ReqBody: map[string]interface{}{
+			"device_ids": deviceIDs,
+		},
+		App: func(t *testing.T, self *testCase) *mapp.App {
+			mockApp := new(mapp.App)
+			mockApp.On("ProvisionDevices",
+				validateTenantIDCtx(tenantID),
+				deviceIDs,
+			).Return([]error{
+				nil,
+				&app.IntegrationError{Err: app.ErrDeviceAlreadyExists},
+				errors.New("internal error"),
+				client.HTTPError{
+					Code:    http.StatusForbidden,
+					Service: "iothub",
+				},
+			}, nil)
+			return mockApp
+		},
+		StatusCode: http.StatusOK,
+		Response: BulkResult{Error: true, Items: []BulkItem{{
+			Status:     http.StatusNoContent,
+			Parameters: map[string]interface{}{"device_id": deviceIDs[0]},
+		}, {
+			Status:      http.StatusConflict,
+			Description: app.ErrDeviceAlreadyExists.Error(),
+			Parameters:  map[string]interface{}{"device_id": deviceIDs[1]},
+		}, {
+			Status:      http.StatusInternalServerError,
+			Description: "internal error",
+			Parameters:  map[string]interface{}{"device_id": deviceIDs[2]},
+		}, {
+			Status:      http.StatusForbidden,
+			Description: "iothub: unexpected status code from API: 403",
+			Parameters:  map[string]interface{}{"device_id": deviceIDs[3]},
+		}}},
+	}, {
+		Name: "ok, async",
+
+		Query: "?async=true",
+		ReqBody: map[string]interface{}{
+			"device_ids": deviceIDs,
+		},
+		App: func(t *testing.T, self *testCase) *mapp.App {
+			mockApp := new(mapp.App)
+			mockApp.On("ScheduleDeviceProvisioning",
+				validateTenantIDCtx(tenantID),
+				deviceIDs,
+			).Return(&job, nil)
+			return mockApp
+		},
+		StatusCode: http.StatusAccepted,
+		Response:   job,
+	}, {
+		Name: "error, async internal error",
+
+		Query: "?async=true",
+		ReqBody: map[string]interface{}{
+			"device_ids": deviceIDs,
+		},
+		App: func(t *testing.T, self *testCase) *mapp.App {
+			mockApp := new(mapp.App)
+			mockApp.On("ScheduleDeviceProvisioning",
+				validateTenantIDCtx(tenantID),
+				deviceIDs,
+			).Return(nil, errors.New("internal error"))
+			return mockApp
+		},
+		StatusCode: http.StatusInternalServerError,
+		Response: regexp.MustCompile(
+			`{"error":\s?"internal error",\s?"request_id":\s?"test"}`,
+		),
+	}, {
+		Name: "error, too many async devices",
+
+		Query: "?async=true",
+		ReqBody: map[string]interface{}{
+			"device_ids": make([]string, defaultMaxBulkJobItems+1),
+		},
+		App: func(t *testing.T, self *testCase) *mapp.App {
+			return new(mapp.App)
+		},
+		StatusCode: http.StatusBadRequest,
+		Response: regexp.MustCompile(
+			`{"error":\s?"too many bulk items.*",\s?"request_id":\s?"test"}`,
+		),
+	}, {
+		Name: "error, too many devices",
+
+		ReqBody: map[string]interface{}{
+			"device_ids": make([]string, defaultMaxBulkItems+1),
+		},
+		App: func(t *testing.T, self *testCase) *mapp.App {
+			return new(mapp.App)
+		},
+		StatusCode: http.StatusBadRequest,
+		Response: regexp.MustCompile(
+			`{"error":\s?"too many bulk items.*",\s?"request_id":\s?"test"}`,
+		),
+	}, {
+		Name: "error, missing device ID",
+
+		ReqBody: map[string]interface{}{
+			"device_ids": []string{deviceIDs[0], ""},
+		},
+		App: func(t *testing.T, self *testCase) *mapp.App {
+			return new(mapp.App)
+		},
+		StatusCode: http.StatusBadRequest,
+		Response: regexp.MustCompile(
+			`{"error":\s?"missing device ID",\s?"request_id":\s?"test"}`,
+		),
+	}, {
+		Name: "error, malformed request body",
+
+		ReqBody: []byte("rawr"),
+		App: func(t *testing.T, self *testCase) *mapp.App {
+			return new(mapp.App)
+		},
+		StatusCode: http.StatusBadRequest,
+		Response: regexp.MustCompile(
+			`{"error":\s?"malformed request body.*",\s?"request_id":\s?"test"}`,
+		),
+	}, {
+		Name: "error, internal error",
+
+		ReqBody: map[string]interface{}{
+			"device_ids": deviceIDs,
+		},
+		App: func(t *testing.T, self *testCase) *mapp.App {
+			mockApp := new(mapp.App)
+			mockApp.On("ProvisionDevices",
+				validateTenantIDCtx(tenantID),
+				deviceIDs,
+			).Return(nil, errors.New("internal error"))
+			return mockApp
+		},
+		StatusCode: http.StatusInternalServerError,
+		Response: regexp.MustCompile(
+			`{"error":\s?"internal error",\s?"request_id":\s?"test"}`,
+		),
+	}}
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+
+			app := tc.App(t, &tc)
+			defer app.AssertExpectations(t)
+			w := httptest.NewRecorder()
+			handler := NewRouter(app)
+			repl := strings.NewReplacer(":tenant_id", tenantID)
+			var b []byte
+			switch t := tc.ReqBody.(type) {
+			case []byte:
+				b = t
+			default:
+				b, _ = json.Marshal(tc.ReqBody)
+			}
+			req, _ := http.NewRequest(
+				http.MethodPost,
+				"http://localhost"+
+					APIURLInternal+
+					repl.Replace(APIURLTenantBulkDevices)+tc.Query,
+				bytes.NewReader(b),
+			)
+			req.Header.Set("X-Men-Requestid", "test")
+
+			handler.ServeHTTP(w, req)
+
+			assert.Equal(t, tc.StatusCode, w.Code)
+			switch res := tc.Response.(type) {
+			case *regexp.Regexp:
+				assert.Regexp(t, res, w.Body.String())
+			default:
+				b, _ := json.Marshal(res)
+				assert.JSONEq(t, string(b), w.Body.String())
+			}
+		})
+	}
+}
+
+func TestBulkDecommissionDevices(t *testing.T) {
+	t.Parallel()
+	const tenantID = "123456789012345678901234"
+	deviceIDs := []string{
+		"960700f7-d563-4a31-94e6-a075fe6566bc",
+		"3fd916c1-6a5a-423c-b7da-739bf21c7779",
+		"1cb050b9-c20c-4807-bdbd-bc5650617198",
+	}
+	type testCase struct {
+		Name string
+
+		Config  *Config
+		ReqBody interface{}
+		App     func(t *testing.T, self *testCase) *mapp.App
+
+		StatusCode int
+		Response   interface{}
+	}
+	testCases := []testCase{{
+		Name: "ok",
+
+		ReqBody: map[string]interface{}{
+			"device_ids": deviceIDs[:2],
+		},
+		App: func(t *testing.T, self *testCase) *mapp.App {
+			mockApp := new(mapp.App)
+			mockApp.On("DecommissionDevices",
+				validateTenantIDCtx(tenantID),
+				deviceIDs[:2],
+			).Return([]error{nil, app.ErrNoIntegrations}, nil)
+			return mockApp
+		},
+		StatusCode: http.StatusOK,
+		Response: BulkResult{Items: []BulkItem{{
+			Status:     http.StatusNoContent,
+			Parameters: map[string]interface{}{"device_id": deviceIDs[0]},
+		}, {
+			Status:     http.StatusNoContent,
+			Parameters: map[string]interface{}{"device_id": deviceIDs[1]},
+		}}},
+	}, {
+		Name: "error, partial result",
+
+		ReqBody: map[string]interface{}{
+			"device_ids": deviceIDs,
+		},
+		App: func(t *testing.T, self *testCase) *mapp.App {
+			mockApp := new(mapp.App)
+			mockApp.On("DecommissionDevices",
+				validateTenantIDCtx(tenantID),
+				deviceIDs,
+			).Return([]error{
+				nil,
+				errors.New("internal error"),
+				client.HTTPError{
+					Code:    http.StatusForbidden,
+					Service: "iothub",
+				},
+			}, nil)
+			return mockApp
+		},
+		StatusCode: http.StatusOK,
+		Response: BulkResult{Error: true, Items: []BulkItem{{
+			Status:     http.StatusNoContent,
+			Parameters: map[string]interface{}{"device_id": deviceIDs[0]},
+		}, {
+			Status:      http.StatusInternalServerError,
+			Description: "internal error",
+			Parameters:  map[string]interface{}{"device_id": deviceIDs[1]},
+		}, {
+			Status:      http.StatusForbidden,
+			Description: "iothub: unexpected status code from API: 403",
+			Parameters:  map[string]interface{}{"device_id": deviceIDs[2]},
+		}}},
+	}, {
+		Name: "error, too many devices",
+
+		ReqBody: map[string]interface{}{
+			"device_ids": make([]string, defaultMaxBulkDecommissionItems+1),
+		},
+		App: func(t *testing.T, self *testCase) *mapp.App {
+			return new(mapp.App)
+		},
+		StatusCode: http.StatusBadRequest,
+		Response: regexp.MustCompile(
+			`{"error":\s?"too many bulk items.*",\s?"request_id":\s?"test"}`,
+		),
+	}, {
+		Name: "error, too many devices for configured limit",
+
+		Config: NewConfig().SetMaxBulkDecommissionItems(2),
+		ReqBody: map[string]interface{}{
+			"device_ids": deviceIDs,
+		},
+		App: func(t *testing.T, self *testCase) *mapp.App {
+			return new(mapp.App)
+		},
+		StatusCode: http.StatusBadRequest,
+		Response: regexp.MustCompile(
+			`{"error":\s?"too many bulk items.*",\s?"request_id":\s?"test"}`,
+		),
+	}, {
+		Name: "error, malformed request body",
+
+		ReqBody: []byte("rawr"),
+		App: func(t *testing.T, self *testCase) *mapp.App {
+			return new(mapp.App)
+		},
+		StatusCode: http.StatusBadRequest,
+		Response: regexp.MustCompile(
+			`{"error":\s?"malformed request body.*",\s?"request_id":\s?"test"}`,
+		),
+	}, {
+		Name: "error, internal error",
+
+		ReqBody: map[string]interface{}{
+			"device_ids": deviceIDs,
+		},
+		App: func(t *testing.T, self *testCase) *mapp.App {
+			mockApp := new(mapp.App)
+			mockApp.On("DecommissionDevices",
+				validateTenantIDCtx(tenantID),
+				deviceIDs,
+			).Return(nil, errors.New("internal error"))
+			return mockApp
+		},
+		StatusCode: http.StatusInternalServerError,
+		Response: regexp.MustCompile(
+			`{"error":\s?"internal error",\s?"request_id":\s?"test"}`,
+		),
+	}}
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+
+			app := tc.App(t, &tc)
+			defer app.AssertExpectations(t)
+			w := httptest.NewRecorder()
+			handler := NewRouter(app, tc.Config)
+			repl := strings.NewReplacer(":tenant_id", tenantID)
+			var b []byte
+			switch t := tc.ReqBody.(type) {
+			case []byte:
+				b = t
+			default:
+				b, _ = json.Marshal(tc.ReqBody)
+			}
+			req, _ := http.NewRequest(
+				http.MethodDelete,
+				"http://localhost"+
+					APIURLInternal+
+					repl.Replace(APIURLTenantBulkDevices),
+				bytes.NewReader(b),
+			)
+			req.Header.Set("X-Men-Requestid", "test")
+
+			handler.ServeHTTP(w, req)
+
+			assert.Equal(t, tc.StatusCode, w.Code)
+			switch res := tc.Response.(type) {
+			case *regexp.Regexp:
+				assert.Regexp(t, res, w.Body.String())
+			default:
+				b, _ := json.Marshal(res)
+				assert.JSONEq(t, string(b), w.Body.String())
+			}
+		})
+	}
+}
+
+func TestRotateDeviceKeys(t *testing.T) {
+	t.Parallel()
+	type testCase struct {
+		Name string
+
+		TenantID string
+		DeviceID string
+		Body     interface{}
+		App      func(*testing.T, *testCase) *mapp.App
+
+		StatusCode int
+		Error      error
+	}
+	testCases := []testCase{{
+		Name: "ok",
+
+		TenantID: "123456789012345678901234",
+		DeviceID: "a8d77d55-ebaa-4ace-b9d4-a2bb581d87f8",
+		Body:     map[string]string{"phase": "all"},
+
+		App: func(t *testing.T, self *testCase) *mapp.App {
+			mock := new(mapp.App)
+			mock.On("RotateDeviceKeys",
+				validateTenantIDCtx(self.TenantID),
+				self.DeviceID,
+				model.KeyRotationPhaseAll).
+				Return(nil)
+			return mock
+		},
+
+		StatusCode: http.StatusNoContent,
+	}, {
+		Name: "ok/promote",
+
+		TenantID: "123456789012345678901234",
+		DeviceID: "a8d77d55-ebaa-4ace-b9d4-a2bb581d87f8",
+		Body:     map[string]string{"phase": "promote"},
+
+		App: func(t *testing.T, self *testCase) *mapp.App {
+			mock := new(mapp.App)
+			mock.On("RotateDeviceKeys",
+				validateTenantIDCtx(self.TenantID),
+				self.DeviceID,
+				model.KeyRotationPhasePromote).
+				Return(nil)
+			return mock
+		},
+
+		StatusCode: http.StatusNoContent,
+	}, {
+		Name: "error/invalid phase",
+
+		TenantID: "123456789012345678901234",
+		DeviceID: "a8d77d55-ebaa-4ace-b9d4-a2bb581d87f8",
+		Body:     map[string]string{"phase": "demote"},
+
+		App: func(t *testing.T, self *testCase) *mapp.App {
+			return new(mapp.App)
+		},
+
+		StatusCode: http.StatusBadRequest,
+		Error:      errors.New("malformed request body: phase: must be a valid value"),
+	}, {
+		Name: "error/missing phase",
+
+		TenantID: "123456789012345678901234",
+		DeviceID: "a8d77d55-ebaa-4ace-b9d4-a2bb581d87f8",
+		Body:     map[string]string{},
+
+		App: func(t *testing.T, self *testCase) *mapp.App {
+			return new(mapp.App)
+		},
+
+		StatusCode: http.StatusBadRequest,
+		Error:      errors.New("malformed request body: phase: cannot be blank"),
+	}, {
+		Name: "error/not supported",
+
+		TenantID: "123456789012345678901234",
+		DeviceID: "a8d77d55-ebaa-4ace-b9d4-a2bb581d87f8",
+		Body:     map[string]string{"phase": "all"},
+
+		App: func(t *testing.T, self *testCase) *mapp.App {
+			mock := new(mapp.App)
+			mock.On("RotateDeviceKeys",
+				validateTenantIDCtx(self.TenantID),
+				self.DeviceID,
+				model.KeyRotationPhaseAll).
+				Return(app.ErrKeyRotationNotSupported)
+			return mock
+		},
+
+		StatusCode: http.StatusConflict,
+		Error:      app.ErrKeyRotationNotSupported,
+	}, {
+		Name: "error/device not found in IoT Hub",
+
+		TenantID: "123456789012345678901234",
+		DeviceID: "a8d77d55-ebaa-4ace-b9d4-a2bb581d87f8",
+		Body:     map[string]string{"phase": "all"},
+
+		App: func(t *testing.T, self *testCase) *mapp.App {
+			mock := new(mapp.App)
+			mock.On("RotateDeviceKeys",
+				validateTenantIDCtx(self.TenantID),
+				self.DeviceID,
+				model.KeyRotationPhaseAll).
+				Return(&app.IntegrationError{
+					Err: client.HTTPError{
+						Code:      http.StatusNotFound,
+						Service:   "iothub",
+						ErrorCode: "DeviceNotFound",
+					},
+				})
+			return mock
+		},
+
+		StatusCode: http.StatusNotFound,
+		Error:      errors.New("DeviceNotFound"),
+	}, {
+		Name: "error/internal failure",
+
+		TenantID: "123456789012345678901234",
+		DeviceID: "a8d77d55-ebaa-4ace-b9d4-a2bb581d87f8",
+		Body:     map[string]string{"phase": "all"},
+
+		App: func(t *testing.T, self *testCase) *mapp.App {
+			mock := new(mapp.App)
+			mock.On("RotateDeviceKeys",
+				validateTenantIDCtx(self.TenantID),
+				self.DeviceID,
+				model.KeyRotationPhaseAll).
+				Return(errors.New("internal error"))
+			return mock
+		},
+
+		StatusCode: http.StatusInternalServerError,
+		Error:      errors.New("internal error"),
+	}}
+
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			app := tc.App(t, &tc)
+			defer app.AssertExpectations(t)
+			w := httptest.NewRecorder()
+			handler := NewRouter(app)
+
+			repl := strings.NewReplacer(
+				":tenant_id", tc.TenantID,
+				":device_id", tc.DeviceID,
+			)
+			var body []byte
+			if tc.Body != nil {
+				body, _ = json.Marshal(tc.Body)
+			}
+			req, _ := http.NewRequest(http.MethodPost,
+				"http://localhost"+
+					APIURLInternal+
+					repl.Replace(APIURLTenantDeviceKeys),
+				bytes.NewReader(body),
+			)
+
+			handler.ServeHTTP(w, req)
+
+			assert.Equal(t, tc.StatusCode, w.Code)
+			if tc.Error != nil {
+				var err rest.Error
+				_ = json.Unmarshal(w.Body.Bytes(), &err)
+				assert.Regexp(t, tc.Error.Error(), err.Error())
+			} else {
+				assert.Empty(t, w.Body.Bytes())
+			}
+		})
+	}
+}
+
+func TestRotateTenantKeys(t *testing.T) {
+	t.Parallel()
+	job := model.NewJob("123456789012345678901234", model.JobTypeRotateKeys, nil)
+	type testCase struct {
+		Name string
+
+		TenantID string
+		Body     interface{}
+		App      func(*testing.T, *testCase) *mapp.App
+
+		StatusCode int
+		Error      error
+	}
+	testCases := []testCase{{
+		Name: "ok",
+
+		TenantID: "123456789012345678901234",
+		Body:     map[string]string{"phase": "all"},
+
+		App: func(t *testing.T, self *testCase) *mapp.App {
+			mock := new(mapp.App)
+			mock.On("RotateTenantKeys",
+				validateTenantIDCtx(self.TenantID),
+				model.KeyRotationPhaseAll).
+				Return(&job, nil)
+			return mock
+		},
+
+		StatusCode: http.StatusAccepted,
+	}, {
+		Name: "error/no integrations",
+
+		TenantID: "123456789012345678901234",
+		Body:     map[string]string{"phase": "all"},
+
+		App: func(t *testing.T, self *testCase) *mapp.App {
+			mock := new(mapp.App)
+			mock.On("RotateTenantKeys",
+				validateTenantIDCtx(self.TenantID),
+				model.KeyRotationPhaseAll).
+				Return(nil, app.ErrKeyRotationNotSupported)
+			return mock
+		},
+
+		StatusCode: http.StatusConflict,
+		Error:      app.ErrKeyRotationNotSupported,
+	}, {
+		Name: "error/missing request body",
+
+		TenantID: "123456789012345678901234",
+
+		App: func(t *testing.T, self *testCase) *mapp.App {
+			return new(mapp.App)
+		},
+
+		StatusCode: http.StatusBadRequest,
+		Error:      errors.New("malformed request body"),
+	}}
+
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			app := tc.App(t, &tc)
+			defer app.AssertExpectations(t)
+			w := httptest.NewRecorder()
+			handler := NewRouter(app)
+
+			var body []byte
+			if tc.Body != nil {
+				body, _ = json.Marshal(tc.Body)
+			}
+			req, _ := http.NewRequest(http.MethodPost,
+				"http://localhost"+
+					APIURLInternal+
+					strings.Replace(APIURLTenantKeys, ":tenant_id", tc.TenantID, 1),
+				bytes.NewReader(body),
+			)
+
+			handler.ServeHTTP(w, req)
+
+			assert.Equal(t, tc.StatusCode, w.Code)
+			if tc.Error != nil {
+				var err rest.Error
+				_ = json.Unmarshal(w.Body.Bytes(), &err)
+				assert.Regexp(t, tc.Error.Error(), err.Error())
+			} else {
+				var actual model.Job
+				_ = json.Unmarshal(w.Body.Bytes(), &actual)
+				assert.Equal(t, job.ID, actual.ID)
+				assert.Equal(t,
+					APIURLInternal+"/tenants/"+tc.TenantID+"/jobs/"+job.ID.String(),
+					w.Header().Get("Location"),
+				)
+			}
+		})
+	}
+}
+
+func TestDeleteTenant(t *testing.T) {
+	t.Parallel()
+	job := model.NewJob("123456789012345678901234", model.JobTypeDeleteTenant, nil)
+	type testCase struct {
+		Name string
+
+		TenantID string
+		Query    string
+		App      func(*testing.T, *testCase) *mapp.App
+
+		StatusCode int
+		Error      error
+	}
+	testCases := []testCase{{
+		Name: "ok",
+
+		TenantID: "123456789012345678901234",
+
+		App: func(t *testing.T, self *testCase) *mapp.App {
+			mock := new(mapp.App)
+			mock.On("DeleteTenant",
+				validateTenantIDCtx(self.TenantID),
+				model.TenantDevicesKeep).
+				Return(&job, nil)
+			return mock
+		},
+
+		StatusCode: http.StatusAccepted,
+	}, {
+		Name: "ok, delete devices",
+
+		TenantID: "123456789012345678901234",
+		Query:    "?devices=delete",
+
+		App: func(t *testing.T, self *testCase) *mapp.App {
+			mock := new(mapp.App)
+			mock.On("DeleteTenant",
+				validateTenantIDCtx(self.TenantID),
+				model.TenantDevicesDelete).
+				Return(&job, nil)
+			return mock
+		},
+
+		StatusCode: http.StatusAccepted,
+	}, {
+		Name: "error/invalid devices action",
+
+		TenantID: "123456789012345678901234",
+		Query:    "?devices=explode",
+
+		App: func(t *testing.T, self *testCase) *mapp.App {
+			return new(mapp.App)
+		},
+
+		StatusCode: http.StatusBadRequest,
+		Error:      errors.New("invalid query parameter devices: must be a valid value"),
+	}, {
+		Name: "error/internal error",
+
+		TenantID: "123456789012345678901234",
+
+		App: func(t *testing.T, self *testCase) *mapp.App {
+			mock := new(mapp.App)
+			mock.On("DeleteTenant",
+				validateTenantIDCtx(self.TenantID),
+				model.TenantDevicesKeep).
+				Return(nil, errors.New("internal error"))
+			return mock
+		},
+
+		StatusCode: http.StatusInternalServerError,
+		Error:      errors.New("internal error"),
+	}}
+
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			app := tc.App(t, &tc)
+			defer app.AssertExpectations(t)
+			w := httptest.NewRecorder()
+			handler := NewRouter(app)
+
+			req, _ := http.NewRequest(http.MethodDelete,
+				"http://localhost"+
+					APIURLInternal+
+					strings.Replace(APIURLTenant, ":tenant_id", tc.TenantID, 1)+
+					tc.Query,
+				nil,
+			)
+
+			handler.ServeHTTP(w, req)
+
+			assert.Equal(t, tc.StatusCode, w.Code)
+			if tc.Error != nil {
+				var err rest.Error
+				_ = json.Unmarshal(w.Body.Bytes(), &err)
+				assert.Regexp(t, tc.Error.Error(), err.Error())
+			} else {
+				var actual model.Job
+				_ = json.Unmarshal(w.Body.Bytes(), &actual)
+				assert.Equal(t, job.ID, actual.ID)
+				assert.Equal(t,
+					APIURLInternal+"/tenants/"+tc.TenantID+"/jobs/"+job.ID.String(),
+					w.Header().Get("Location"),
+				)
+			}
+		})
+	}
+}
+
+func TestGetJobs(t *testing.T) {
+	t.Parallel()
+	jobs := []model.Job{
+		model.NewJob("123456789012345678901234", model.JobTypeDeleteTenant, nil),
+	}
+	type testCase struct {
+		Name string
+
+		TenantID string
+		Query    string
+		App      func(*testing.T, *testCase) *mapp.App
+
+		StatusCode int
+		Error      error
+	}
+	testCases := []testCase{{
+		Name: "ok",
+
+		TenantID: "123456789012345678901234",
+		Query:    "?type=delete_tenant&status=failed&per_page=10",
+
+		App: func(t *testing.T, self *testCase) *mapp.App {
+			mock := new(mapp.App)
+			mock.On("GetJobs",
+				validateTenantIDCtx(self.TenantID),
+				model.JobFilter{
+					Type:   model.JobTypeDeleteTenant,
+					Status: model.JobStatusFailed,
+				},
+				int64(0), int64(11)).
+				Return(jobs, nil)
+			return mock
+		},
+
+		StatusCode: http.StatusOK,
+	}, {
+		Name: "error/invalid job type",
+
+		TenantID: "123456789012345678901234",
+		Query:    "?type=explode",
+
+		App: func(t *testing.T, self *testCase) *mapp.App {
+			return new(mapp.App)
+		},
+
+		StatusCode: http.StatusBadRequest,
+		Error:      errors.New("invalid query parameter type: must be a valid value"),
+	}, {
+		Name: "error/invalid paging parameters",
+
+		TenantID: "123456789012345678901234",
+		Query:    "?per_page=-1",
+
+		App: func(t *testing.T, self *testCase) *mapp.App {
+			return new(mapp.App)
+		},
+
+		StatusCode: http.StatusBadRequest,
+		Error:      errors.New("invalid per_page query"),
+	}, {
+		Name: "error/internal error",
+
+		TenantID: "123456789012345678901234",
+
+		App: func(t *testing.T, self *testCase) *mapp.App {
+			mock := new(mapp.App)
+			mock.On("GetJobs",
+				validateTenantIDCtx(self.TenantID),
+				model.JobFilter{},
+				int64(0), int64(rest.PerPageDefault+1)).
+				Return(nil, errors.New("internal error"))
+			return mock
+		},
+
+		StatusCode: http.StatusInternalServerError,
+		Error:      errors.New("internal error"),
+	}}
+
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			app := tc.App(t, &tc)
+			defer app.AssertExpectations(t)
+			w := httptest.NewRecorder()
+			handler := NewRouter(app)
+
+			req, _ := http.NewRequest(http.MethodGet,
+				"http://localhost"+
+					APIURLInternal+
+					strings.Replace(APIURLTenantJobs, ":tenant_id", tc.TenantID, 1)+
+					tc.Query,
+				nil,
+			)
+
+			handler.ServeHTTP(w, req)
+
+			assert.Equal(t, tc.StatusCode, w.Code)
+			if tc.Error != nil {
+				var err rest.Error
+				_ = json.Unmarshal(w.Body.Bytes(), &err)
+				assert.Regexp(t, tc.Error.Error(), err.Error())
+			} else {
+				var actual []model.Job
+				_ = json.Unmarshal(w.Body.Bytes(), &actual)
+				if assert.Len(t, actual, len(jobs)) {
+					assert.Equal(t, jobs[0].ID, actual[0].ID)
+				}
+			}
+		})
+	}
+}
+
+func TestGetJob(t *testing.T) {
+	t.Parallel()
+	job := model.NewJob("123456789012345678901234", model.JobTypeDeleteTenant, nil)
+	type testCase struct {
+		Name string
+
+		TenantID string
+		JobID    string
+		App      func(*testing.T, *testCase) *mapp.App
+
+		StatusCode int
+		Error      error
+	}
+	testCases := []testCase{{
+		Name: "ok",
+
+		TenantID: "123456789012345678901234",
+		JobID:    job.ID.String(),
+
+		App: func(t *testing.T, self *testCase) *mapp.App {
+			mock := new(mapp.App)
+			mock.On("GetJob",
+				validateTenantIDCtx(self.TenantID),
+				job.ID).
+				Return(&job, nil)
+			return mock
+		},
+
+		StatusCode: http.StatusOK,
+	}, {
+		Name: "error/invalid job ID",
+
+		TenantID: "123456789012345678901234",
+		JobID:    "not-a-uuid",
+
+		App: func(t *testing.T, self *testCase) *mapp.App {
+			return new(mapp.App)
+		},
+
+		StatusCode: http.StatusNotFound,
+		Error:      app.ErrJobNotFound,
+	}, {
+		Name: "error/not found",
+
+		TenantID: "123456789012345678901234",
+		JobID:    job.ID.String(),
+
+		App: func(t *testing.T, self *testCase) *mapp.App {
+			mock := new(mapp.App)
+			mock.On("GetJob",
+				validateTenantIDCtx(self.TenantID),
+				job.ID).
+				Return(nil, app.ErrJobNotFound)
+			return mock
+		},
+
+		StatusCode: http.StatusNotFound,
+		Error:      app.ErrJobNotFound,
+	}, {
+		Name: "error/internal error",
+
+		TenantID: "123456789012345678901234",
+		JobID:    job.ID.String(),
+
+		App: func(t *testing.T, self *testCase) *mapp.App {
+			mock := new(mapp.App)
+			mock.On("GetJob",
+				validateTenantIDCtx(self.TenantID),
+				job.ID).
+				Return(nil, errors.New("internal error"))
+			return mock
+		},
+
+		StatusCode: http.StatusInternalServerError,
+		Error:      errors.New("internal error"),
+	}}
+
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			app := tc.App(t, &tc)
+			defer app.AssertExpectations(t)
+			w := httptest.NewRecorder()
+			handler := NewRouter(app)
+
+			req, _ := http.NewRequest(http.MethodGet,
+				"http://localhost"+
+					APIURLInternal+
+					strings.NewReplacer(
+						":tenant_id", tc.TenantID,
+						":job_id", tc.JobID,
+					).Replace(APIURLTenantJob),
+				nil,
+			)
+
+			handler.ServeHTTP(w, req)
+
+			assert.Equal(t, tc.StatusCode, w.Code)
+			if tc.Error != nil {
+				var err rest.Error
+				_ = json.Unmarshal(w.Body.Bytes(), &err)
+				assert.Regexp(t, tc.Error.Error(), err.Error())
+			} else {
+				var actual model.Job
+				_ = json.Unmarshal(w.Body.Bytes(), &actual)
+				assert.Equal(t, job.ID, actual.ID)
+				assert.Equal(t, job.Status, actual.Status)
+			}
+		})
+	}
+}
@@ -17,19 +17,28 @@ package http
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"io"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/google/uuid"
 	"github.com/pkg/errors"
 
 	"github.com/mendersoftware/go-lib-micro/identity"
+	"github.com/mendersoftware/go-lib-micro/requestid"
 	"github.com/mendersoftware/go-lib-micro/rest.utils"
 
+	"github.com/mendersoftware/iot-manager/app"
+	"github.com/mendersoftware/iot-manager/client"
+	"github.com/mendersoftware/iot-manager/client/iothub"
 	"github.com/mendersoftware/iot-manager/model"
 )
 
@@ -54,6 +63,17 @@ const (
 	HdrKeyAuthz       = "Authorization"
 	HdrKeyXFF         = "X-Forwarded-For"
 	HdrKeyMSRequestID = "X-Ms-Request-Id"
+	HdrKeyETag        = "ETag"
+	HdrKeyIfMatch     = "If-Match"
+	HdrKeyLink        = "Link"
+
+	QueryIntegrationID   = "integration_id"
+	QueryConnectionState = "connection_state"
+	QueryMender          = "mender"
+	QueryPerPage         = "per_page"
+	QueryPageToken       = "page_token"
+
+	defaultDevicesPerPage = 20
 )
 
 // Hop-by-hop headers (RFC2616 section 13.5.1)
@@ -81,8 +101,49 @@ var (
 		"user identity missing from authorization token",
 	)
 	ErrMissingConnectionString = errors.New("connection string is not configured")
+	ErrInvalidIntegrationID    = errors.New("invalid integration ID")
+	ErrInvalidRevision         = errors.New("invalid settings revision")
+	ErrInvalidPageToken        = errors.New("invalid page token")
+	ErrMissingIntegrations     = errors.New("integrations: cannot be blank")
+	ErrLegacySettings          = errors.New(
+		"connection_string cannot be combined with integrations",
+	)
 )
 
+// hubConnectionString returns the connection string of the IoT Hub
+// integration with the given ID or, if the ID is empty, of the first IoT Hub
+// integration including the device.
+func hubConnectionString(
+	settings model.Settings,
+	deviceID string,
+	integrationID string,
+) (*model.ConnectionString, error) {
+	var integrations []model.Integration
+	if integrationID != "" {
+		id, err := uuid.Parse(integrationID)
+		if err != nil {
+			return nil, ErrInvalidIntegrationID
+		}
+		integration := settings.Integration(id)
+		if integration == nil {
+			return nil, app.ErrIntegrationNotFound
+		}
+		integrations = []model.Integration{*integration}
+	} else {
+		integrations = settings.DeviceIntegrations(deviceID)
+	}
+	for _, integration := range integrations {
+		if integration.Provider == model.ProviderIoTCore {
+			continue
+		}
+		cs := integration.ConnectionString
+		if cs != nil && cs.Validate() == nil {
+			return cs, nil
+		}
+	}
+	return nil, ErrMissingConnectionString
+}
+
 // ManagementHandler is the namespace for management API handlers.
 type ManagementHandler APIHandler
 
@@ -90,23 +151,31 @@ func (h *ManagementHandler) proxyAzureRequest(c *gin.Context, dstPath string) {
 	req := c.Request
 	ctx := req.Context()
 	settings, err := h.app.GetSettings(ctx)
-	switch {
-	case err != nil:
+	if err != nil {
 		_ = c.Error(err)
 		rest.RenderError(c,
 			http.StatusInternalServerError,
 			errors.New(http.StatusText(http.StatusInternalServerError)),
 		)
 		return
-	case settings.ConnectionString == nil:
-		fallthrough
-	case settings.ConnectionString.Validate() != nil:
-		rest.RenderError(c, http.StatusConflict, ErrMissingConnectionString)
+	}
+	cs, err := hubConnectionString(settings,
+		c.Param("id"), c.Query(QueryIntegrationID),
+	)
+	switch err {
+	case nil:
+	case ErrInvalidIntegrationID:
+		rest.RenderError(c, http.StatusBadRequest, err)
+		return
+	case app.ErrIntegrationNotFound:
+		rest.RenderError(c, http.StatusNotFound, err)
 		return
 	default:
+		rest.RenderError(c, http.StatusConflict, err)
+		return
 	}
-	cs := settings.ConnectionString
 	q := c.Request.URL.Query()
+	q.Del(QueryIntegrationID)
 	q.Set("api-version", AzureAPIVersion)
 	req.URL.Scheme = "https"
 	req.URL.RawQuery = q.Encode()
@@ -147,6 +216,12 @@ func (h *ManagementHandler) proxyAzureRequest(c *gin.Context, dstPath string) {
 		return
 	}
 	defer rsp.Body.Close()
+	if rsp.StatusCode >= 400 {
+		renderProviderError(c, rsp.StatusCode,
+			client.NewHTTPError("iothub", rsp),
+		)
+		return
+	}
 	delHbHHeaders(rsp.Header)
 	delete(rsp.Header, HdrKeyMSRequestID)
 	rspHdrs := c.Writer.Header()
@@ -175,10 +250,7 @@ func (h *ManagementHandler) GetDeviceTwin(c *gin.Context) {
 
 // PATCH /device/:id/twin
 func (h *ManagementHandler) UpdateDeviceTwin(c *gin.Context) {
-	var schema struct {
-		Properties map[string]interface{} `json:"properties"`
-		Tags       map[string]interface{} `json:"tags,omitempty"`
-	}
+	var schema twinUpdateRequest
 	var azureSchema struct {
 		Properties struct {
 			Desired map[string]interface{} `json:"desired"`
@@ -201,6 +273,401 @@ func (h *ManagementHandler) UpdateDeviceTwin(c *gin.Context) {
 	h.proxyAzureRequest(c, AzureURIDeviceTwin.URI(c.Param("id")))
 }
 
+// moduleRequest is the request body of a module identity update.
+type moduleRequest struct {
+	ManagedBy string `json:"managed_by"`
+}
+
+// twinUpdateRequest is the request body of a twin update.
+type twinUpdateRequest struct {
+	Properties map[string]interface{} `json:"properties"`
+	Tags       map[string]interface{} `json:"tags,omitempty"`
+}
+
+// GET /devices/:id/modules/:module_id
+func (h *ManagementHandler) GetModule(c *gin.Context) {
+	if !userIdentity(c) {
+		return
+	}
+	integrationID, ok := bindIntegrationQuery(c)
+	if !ok {
+		return
+	}
+	module, err := h.app.GetDeviceModule(c.Request.Context(),
+		integrationID, c.Param("id"), c.Param(ParamModuleID),
+	)
+	if err != nil {
+		renderHubError(c, err, http.StatusNotFound)
+		return
+	}
+	c.JSON(http.StatusOK, module)
+}
+
+// PUT /devices/:id/modules/:module_id
+func (h *ManagementHandler) UpsertModule(c *gin.Context) {
+	if !userIdentity(c) {
+		return
+	}
+	integrationID, ok := bindIntegrationQuery(c)
+	if !ok {
+		return
+	}
+	var req moduleRequest
+	// The request body is optional, the module is created with keys
+	// generated by the IoT Hub.
+	if err := c.ShouldBindJSON(&req); err != nil && err != io.EOF {
+		rest.RenderError(c,
+			http.StatusBadRequest,
+			errors.Wrap(err, "malformed request body"),
+		)
+		return
+	}
+	module, err := h.app.UpsertDeviceModule(c.Request.Context(),
+		integrationID, c.Param("id"), c.Param(ParamModuleID),
+		&iothub.Module{
+			ETag:      strings.Trim(c.GetHeader(HdrKeyIfMatch), `"`),
+			ManagedBy: req.ManagedBy,
+		},
+	)
+	if err != nil {
+		renderHubError(c, err,
+			http.StatusBadRequest,
+			http.StatusNotFound,
+			http.StatusConflict,
+			http.StatusPreconditionFailed,
+		)
+		return
+	}
+	c.JSON(http.StatusOK, module)
+}
+
+// DELETE /devices/:id/modules/:module_id
+func (h *ManagementHandler) DeleteModule(c *gin.Context) {
+	if !userIdentity(c) {
+		return
+	}
+	integrationID, ok := bindIntegrationQuery(c)
+	if !ok {
+		return
+	}
+	err := h.app.DeleteDeviceModule(c.Request.Context(),
+		integrationID, c.Param("id"), c.Param(ParamModuleID),
+	)
+	if err != nil {
+		renderHubError(c, err, http.StatusNotFound)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// GET /devices/:id/modules/:module_id/twin
+func (h *ManagementHandler) GetModuleTwin(c *gin.Context) {
+	if !userIdentity(c) {
+		return
+	}
+	integrationID, ok := bindIntegrationQuery(c)
+	if !ok {
+		return
+	}
+	twin, err := h.app.GetDeviceModuleTwin(c.Request.Context(),
+		integrationID, c.Param("id"), c.Param(ParamModuleID),
+	)
+	if err != nil {
+		renderHubError(c, err, http.StatusNotFound)
+		return
+	}
+	c.JSON(http.StatusOK, twin)
+}
+
+// PATCH /devices/:id/modules/:module_id/twin
+// PUT /devices/:id/modules/:module_id/twin
+func (h *ManagementHandler) UpdateModuleTwin(c *gin.Context) {
+	if !userIdentity(c) {
+		return
+	}
+	integrationID, ok := bindIntegrationQuery(c)
+	if !ok {
+		return
+	}
+	var req twinUpdateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		rest.RenderError(c,
+			http.StatusBadRequest,
+			errors.Wrap(err, "malformed request body"),
+		)
+		return
+	}
+	err := h.app.UpdateDeviceModuleTwin(c.Request.Context(),
+		integrationID, c.Param("id"), c.Param(ParamModuleID),
+		&iothub.DeviceTwinUpdate{
+			Properties: iothub.UpdateProperties{Desired: req.Properties},
+			Tags:       req.Tags,
+			Replace:    c.Request.Method == http.MethodPut,
+		},
+	)
+	if err != nil {
+		renderHubError(c, err,
+			http.StatusBadRequest,
+			http.StatusNotFound,
+			http.StatusPreconditionFailed,
+		)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// bindDeviceTwinFilter parses the device listing filter, it renders an
+// error and returns false if the filter is invalid.
+func bindDeviceTwinFilter(c *gin.Context) (iothub.DeviceTwinFilter, bool) {
+	fltr := iothub.DeviceTwinFilter{
+		Status:          iothub.Status(c.Query(QueryStatus)),
+		ConnectionState: iothub.ConnectionState(c.Query(QueryConnectionState)),
+	}
+	if mender := c.Query(QueryMender); mender != "" {
+		isMender, err := strconv.ParseBool(mender)
+		if err != nil {
+			rest.RenderError(c,
+				http.StatusBadRequest,
+				errors.New("invalid query parameter "+QueryMender),
+			)
+			return fltr, false
+		}
+		fltr.Mender = &isMender
+	}
+	if err := fltr.Validate(); err != nil {
+		rest.RenderError(c,
+			http.StatusBadRequest,
+			errors.Wrap(err, "invalid query parameters"),
+		)
+		return fltr, false
+	}
+	return fltr, true
+}
+
+// devicesQuery holds the query parameters common to the device listings.
+type devicesQuery struct {
+	integrationID uuid.UUID
+	perPage       int
+	contToken     string
+}
+
+// bindDevicesQuery parses the integration ID and the paging parameters of
+// a device listing, it renders an error and returns false if they are
+// invalid.
+func bindDevicesQuery(c *gin.Context) (devicesQuery, bool) {
+	query := devicesQuery{}
+	var ok bool
+	query.integrationID, ok = bindIntegrationQuery(c)
+	if !ok {
+		return query, false
+	}
+	query.perPage, query.contToken, ok = bindContinuationQuery(c, iothub.MaxQueryPageSize)
+	return query, ok
+}
+
+// bindIntegrationQuery parses the optional integration ID query parameter,
+// it renders an error and returns false if it is invalid.
+func bindIntegrationQuery(c *gin.Context) (uuid.UUID, bool) {
+	id := c.Query(QueryIntegrationID)
+	if id == "" {
+		return uuid.Nil, true
+	}
+	integrationID, err := uuid.Parse(id)
+	if err != nil {
+		rest.RenderError(c, http.StatusBadRequest, ErrInvalidIntegrationID)
+		return uuid.Nil, false
+	}
+	return integrationID, true
+}
+
+// bindContinuationQuery parses the paging parameters of a listing paged with
+// IoT Hub continuation tokens, it renders an error and returns false if they
+// are invalid.
+func bindContinuationQuery(c *gin.Context, maxPerPage int) (int, string, bool) {
+	perPage := defaultDevicesPerPage
+	if s := c.Query(QueryPerPage); s != "" {
+		var err error
+		perPage, err = strconv.Atoi(s)
+		if err != nil || perPage < 1 || perPage > maxPerPage {
+			rest.RenderError(c,
+				http.StatusBadRequest,
+				errors.Errorf("invalid query parameter %s: must be between 1 and %d",
+					QueryPerPage, maxPerPage),
+			)
+			return perPage, "", false
+		}
+	}
+	// The page token is the IoT Hub continuation token, encoded so that it
+	// is safe to use in a query parameter.
+	contToken, err := base64.RawURLEncoding.DecodeString(c.Query(QueryPageToken))
+	if err != nil {
+		rest.RenderError(c, http.StatusBadRequest, ErrInvalidPageToken)
+		return perPage, "", false
+	}
+	return perPage, string(contToken), true
+}
+
+// setNextPageLink sets the link to the page starting at the continuation
+// token, if any.
+func setNextPageLink(c *gin.Context, perPage int, contToken string) {
+	if contToken == "" {
+		return
+	}
+	params := c.Request.URL.Query()
+	params.Set(QueryPageToken,
+		base64.RawURLEncoding.EncodeToString([]byte(contToken)),
+	)
+	params.Set(QueryPerPage, strconv.Itoa(perPage))
+	c.Header(HdrKeyLink,
+		"<"+c.Request.URL.Path+"?"+params.Encode()+`>; rel="next"`,
+	)
+}
+
+// renderHubError renders the error of an IoT Hub operation. The status codes
+// of the IoT Hub errors listed in passthrough are forwarded, other IoT Hub
+// errors are rendered as 502.
+func renderHubError(c *gin.Context, err error, passthrough ...int) {
+	switch cause := errors.Cause(err); cause {
+	case app.ErrIntegrationNotFound:
+		rest.RenderError(c, http.StatusNotFound, cause)
+	case app.ErrNoConnectionString:
+		rest.RenderError(c, http.StatusConflict, cause)
+	default:
+		if htErr, ok := cause.(client.HTTPError); ok {
+			code := http.StatusBadGateway
+			for _, passCode := range passthrough {
+				if htErr.Code == passCode {
+					code = passCode
+					break
+				}
+			}
+			renderProviderError(c, code, htErr)
+			return
+		}
+		_ = c.Error(err)
+		rest.RenderError(c,
+			http.StatusInternalServerError,
+			errors.New(http.StatusText(http.StatusInternalServerError)),
+		)
+	}
+}
+
+// queryDevices runs the device twin query and renders the page of the
+// result, with a link to the next page if any.
+func (h *ManagementHandler) queryDevices(
+	c *gin.Context,
+	query devicesQuery,
+	q *iothub.Query,
+) {
+	q.SetPageSize(query.perPage)
+	page, err := h.app.QueryDevices(c.Request.Context(),
+		query.integrationID, q, query.contToken,
+	)
+	if err != nil {
+		// IoT Hub responds with 400 if the continuation token is invalid.
+		renderHubError(c, err, http.StatusBadRequest)
+		return
+	}
+	setNextPageLink(c, query.perPage, page.ContinuationToken)
+	c.JSON(http.StatusOK, page.Items)
+}
+
+// GET /devices
+func (h *ManagementHandler) ListDevices(c *gin.Context) {
+	if !userIdentity(c) {
+		return
+	}
+	query, ok := bindDevicesQuery(c)
+	if !ok {
+		return
+	}
+	fltr, ok := bindDeviceTwinFilter(c)
+	if !ok {
+		return
+	}
+	h.queryDevices(c, query, fltr.Query())
+}
+
+// POST /devices/search
+func (h *ManagementHandler) SearchDevices(c *gin.Context) {
+	if !userIdentity(c) {
+		return
+	}
+	query, ok := bindDevicesQuery(c)
+	if !ok {
+		return
+	}
+	q := iothub.NewQuery()
+	if err := c.ShouldBindJSON(q); err != nil {
+		rest.RenderError(c,
+			http.StatusBadRequest,
+			errors.Wrap(err, "malformed request body"),
+		)
+		return
+	}
+	h.queryDevices(c, query, q)
+}
+
+// methodRequest is the request body of a direct method invocation, the
+// timeouts are in seconds.
+type methodRequest struct {
+	Payload         json.RawMessage `json:"payload"`
+	ResponseTimeout int             `json:"response_timeout"`
+	ConnectTimeout  int             `json:"connect_timeout"`
+}
+
+func (r methodRequest) Validate() error {
+	return validation.ValidateStruct(&r,
+		validation.Field(&r.ResponseTimeout,
+			validation.Min(iothub.MinMethodResponseTimeout),
+			validation.Max(iothub.MaxMethodTimeout),
+		),
+		validation.Field(&r.ConnectTimeout,
+			validation.Min(0),
+			validation.Max(iothub.MaxMethodTimeout),
+		),
+	)
+}
+
+// POST /devices/:id/methods/:method_name
+// POST /devices/:id/modules/:module_id/methods/:method_name
+func (h *ManagementHandler) InvokeDeviceMethod(c *gin.Context) {
+	if !userIdentity(c) {
+		return
+	}
+	integrationID, ok := bindIntegrationQuery(c)
+	if !ok {
+		return
+	}
+	var req methodRequest
+	// The request body is optional for methods without payload.
+	if err := c.ShouldBindJSON(&req); err != nil && err != io.EOF {
+		rest.RenderError(c,
+			http.StatusBadRequest,
+			errors.Wrap(err, "malformed request body"),
+		)
+		return
+	}
+	res, err := h.app.InvokeDeviceMethod(c.Request.Context(),
+		integrationID,
+		c.Param("id"),
+		c.Param(ParamModuleID),
+		&iothub.DirectMethod{
+			Name:            c.Param(ParamMethodName),
+			Payload:         req.Payload,
+			ResponseTimeout: req.ResponseTimeout,
+			ConnectTimeout:  req.ConnectTimeout,
+		},
+	)
+	if err != nil {
+		// The device does not exist or is offline, or it did not respond
+		// in time.
+		renderHubError(c, err, http.StatusNotFound, http.StatusGatewayTimeout)
+		return
+	}
+	c.JSON(http.StatusOK, res)
+}
+
 // GET /settings
 func (h *ManagementHandler) GetSettings(c *gin.Context) {
 	var (
@@ -221,7 +688,40 @@ func (h *ManagementHandler) GetSettings(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusOK, settings)
+	c.Header(HdrKeyETag, settingsETag(settings.Revision))
+	c.JSON(http.StatusOK, settings.Redacted())
+}
+
+// settingsETag returns the entity tag of a settings revision.
+func settingsETag(revision int) string {
+	return strconv.Quote(strconv.Itoa(revision))
+}
+
+// ifMatchRevision returns the settings revision required by the If-Match
+// header, or 0 if the request is unconditional. It returns false if the
+// header cannot match any revision.
+func ifMatchRevision(c *gin.Context) (int, bool) {
+	ifMatch := strings.TrimSpace(c.GetHeader(HdrKeyIfMatch))
+	if ifMatch == "" || ifMatch == "*" {
+		return 0, true
+	}
+	etag, err := strconv.Unquote(ifMatch)
+	if err != nil {
+		return 0, false
+	}
+	revision, err := strconv.Atoi(etag)
+	if err != nil || revision < 0 {
+		return 0, false
+	}
+	return revision, true
+}
+
+// settingsRequest lists the fields of the PUT /settings request body.
+// ConnectionString is the request body of the settings before integrations
+// existed, it replaces the connection string of the default integration.
+type settingsRequest struct {
+	Integrations     json.RawMessage `json:"integrations"`
+	ConnectionString json.RawMessage `json:"connection_string"`
 }
 
 // PUT /settings
@@ -236,20 +736,116 @@ func (h *ManagementHandler) SetSettings(c *gin.Context) {
 		return
 	}
 
-	settings := model.Settings{}
-	if err := c.ShouldBindJSON(&settings); err != nil {
+	body, err := c.GetRawData()
+	if err != nil {
+		rest.RenderError(c,
+			http.StatusBadRequest,
+			errors.Wrap(err, "malformed request body"),
+		)
+		return
+	}
+	var req settingsRequest
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.DisallowUnknownFields()
+	if err = dec.Decode(&req); err != nil {
 		rest.RenderError(c,
 			http.StatusBadRequest,
 			errors.Wrap(err, "malformed request body"),
 		)
 		return
 	}
+	revision, ok := ifMatchRevision(c)
+	if !ok {
+		rest.RenderError(c, http.StatusPreconditionFailed, app.ErrSettingsModified)
+		return
+	}
+
+	switch {
+	case req.ConnectionString != nil && req.Integrations != nil:
+		err = ErrLegacySettings
+	case req.ConnectionString != nil:
+		var cs *model.ConnectionString
+		cs, err = bindLegacyConnectionString(req.ConnectionString)
+		if err == nil {
+			err = h.app.SetDefaultConnectionString(ctx, cs, revision)
+			renderSetSettingsResult(c, err, revision)
+			return
+		}
+	case req.Integrations == nil:
+		err = ErrMissingIntegrations
+	default:
+		settings := model.SettingsUpdate{}
+		if err = binding.JSON.BindBody(body, &settings); err == nil {
+			settings.Revision = revision
+			err = h.app.SetSettings(ctx, model.Settings(settings))
+			renderSetSettingsResult(c, err, revision)
+			return
+		}
+	}
+	rest.RenderError(c,
+		http.StatusBadRequest,
+		errors.Wrap(err, "malformed request body"),
+	)
+}
+
+// bindLegacyConnectionString parses the connection string of the settings
+// request body before integrations existed, null or an empty string remove
+// the connection string.
+func bindLegacyConnectionString(raw json.RawMessage) (*model.ConnectionString, error) {
+	var connStr *string
+	if err := json.Unmarshal(raw, &connStr); err != nil {
+		return nil, err
+	} else if connStr == nil || *connStr == "" {
+		return nil, nil
+	}
+	cs, err := model.ParseConnectionString(*connStr)
+	if err != nil {
+		return nil, errors.Wrap(err, "connection string invalid")
+	} else if err = cs.Validate(); err != nil {
+		return nil, errors.Wrap(err, "connection string invalid")
+	}
+	return cs, nil
+}
+
+// renderSetSettingsResult renders the response to replacing the settings
+// with the required revision.
+func renderSetSettingsResult(c *gin.Context, err error, revision int) {
+	if err == nil {
+		c.Status(http.StatusNoContent)
+		return
+	}
+	if renderConnectionStringError(c, err) || renderValidationError(c, err) {
+		return
+	}
+	if errors.Cause(err) == app.ErrSettingsModified {
+		code := http.StatusConflict
+		if revision != 0 {
+			code = http.StatusPreconditionFailed
+		}
+		rest.RenderError(c, code, err)
+		return
+	}
+	_ = c.Error(err)
+	rest.RenderError(c,
+		http.StatusInternalServerError,
+		errors.New(http.StatusText(http.StatusInternalServerError)),
+	)
+}
 
-	// TODO verify that connectionstring has correct permissions
-	//      - service
-	//      - registry read/write
+// GET /settings/history
+func (h *ManagementHandler) GetSettingsHistory(c *gin.Context) {
+	if !userIdentity(c) {
+		return
+	}
+	page, perPage, err := rest.ParsePagingParameters(c.Request)
+	if err != nil {
+		rest.RenderError(c, http.StatusBadRequest, err)
+		return
+	}
 
-	err := h.app.SetSettings(ctx, settings)
+	history, err := h.app.GetSettingsHistory(c.Request.Context(),
+		(page-1)*perPage, perPage+1,
+	)
 	if err != nil {
 		_ = c.Error(err)
 		rest.RenderError(c,
@@ -258,5 +854,876 @@ func (h *ManagementHandler) SetSettings(c *gin.Context) {
 		)
 		return
 	}
+	hasNext := int64(len(history)) > perPage
+	if hasNext {
+		history = history[:perPage]
+	}
+	links, _ := rest.MakePagingHeaders(c.Request, rest.NewPagingHints().
+		SetPage(page).
+		SetPerPage(perPage).
+		SetHasNext(hasNext),
+	)
+	for _, link := range links {
+		c.Writer.Header().Add(HdrKeyLink, link)
+	}
+	res := make([]model.RedactedSettingsRevision, len(history))
+	for i, rev := range history {
+		res[i] = rev.Redacted()
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+// POST /settings/history/:revision/restore
+func (h *ManagementHandler) RestoreSettings(c *gin.Context) {
+	if !userIdentity(c) {
+		return
+	}
+	revision, err := strconv.Atoi(c.Param(ParamRevision))
+	if err != nil || revision < 1 {
+		rest.RenderError(c, http.StatusBadRequest, ErrInvalidRevision)
+		return
+	}
+	ifMatch, ok := ifMatchRevision(c)
+	if !ok {
+		rest.RenderError(c, http.StatusPreconditionFailed, app.ErrSettingsModified)
+		return
+	}
+
+	err = h.app.RestoreSettings(c.Request.Context(), revision, ifMatch)
+	if errors.Cause(err) == app.ErrSettingsRevisionNotFound {
+		rest.RenderError(c, http.StatusNotFound, err)
+		return
+	}
+	renderSetSettingsResult(c, err, ifMatch)
+}
+
+// userIdentity renders an error and returns false if the request is not
+// authenticated as a user.
+func userIdentity(c *gin.Context) bool {
+	id := identity.FromContext(c.Request.Context())
+	if id == nil || !id.IsUser {
+		rest.RenderError(c, http.StatusForbidden, ErrMissingUserAuthentication)
+		return false
+	}
+	return true
+}
+
+// tokenScopes returns the space separated scopes of the "scp" claim of the
+// request token. The token signature is verified by the API gateway.
+func tokenScopes(c *gin.Context) []string {
+	token, err := identity.ExtractJWTFromHeader(c.Request)
+	if err != nil {
+		return nil
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil
+	}
+	var claims struct {
+		Scope string `json:"scp"`
+	}
+	if err := json.Unmarshal(b, &claims); err != nil {
+		return nil
+	}
+	return strings.Fields(claims.Scope)
+}
+
+// integrationID parses the integration ID path parameter and renders an
+// error if it is not a valid UUID.
+func integrationID(c *gin.Context) (uuid.UUID, bool) {
+	id, err := uuid.Parse(c.Param(ParamIntegrationID))
+	if err != nil {
+		rest.RenderError(c, http.StatusBadRequest, ErrInvalidIntegrationID)
+		return uuid.Nil, false
+	}
+	return id, true
+}
+
+// ProviderError is the error response for errors reported by the IoT
+// provider. It extends the common error response with the provider's
+// error code and tracking ID.
+type ProviderError struct {
+	rest.Error
+	ErrorCode  string `json:"error_code,omitempty"`
+	TrackingID string `json:"tracking_id,omitempty"`
+}
+
+func renderProviderError(c *gin.Context, code int, err client.HTTPError) {
+	_ = c.Error(err)
+	c.JSON(code, ProviderError{
+		Error: rest.Error{
+			Err:       err.Error(),
+			RequestID: requestid.FromContext(c.Request.Context()),
+		},
+		ErrorCode:  err.ErrorCode,
+		TrackingID: err.TrackingID,
+	})
+}
+
+// ConnectionStringError is the error response for connection strings
+// failing the verification against the IoT Hub.
+type ConnectionStringError struct {
+	rest.Error
+	MissingPermissions []string `json:"missing_permissions,omitempty"`
+}
+
+// renderConnectionStringError renders a 400 response and returns true if
+// err is a connection string verification error.
+func renderConnectionStringError(c *gin.Context, err error) bool {
+	csErr, ok := errors.Cause(err).(*app.ConnectionStringError)
+	if !ok {
+		return false
+	}
+	_ = c.Error(err)
+	c.JSON(http.StatusBadRequest, ConnectionStringError{
+		Error: rest.Error{
+			Err:       err.Error(),
+			RequestID: requestid.FromContext(c.Request.Context()),
+		},
+		MissingPermissions: csErr.MissingPermissions,
+	})
+	return true
+}
+
+// renderValidationError renders a 400 response and returns true if the
+// request body is invalid after inheriting the stored secrets.
+func renderValidationError(c *gin.Context, err error) bool {
+	if _, ok := errors.Cause(err).(*app.ValidationError); !ok {
+		return false
+	}
+	rest.RenderError(c,
+		http.StatusBadRequest,
+		errors.Wrap(err, "malformed request body"),
+	)
+	return true
+}
+
+func renderIntegrationError(c *gin.Context, err error) {
+	if renderConnectionStringError(c, err) || renderValidationError(c, err) {
+		return
+	}
+	switch errors.Cause(err) {
+	case app.ErrIntegrationNotFound:
+		rest.RenderError(c, http.StatusNotFound, err)
+	case app.ErrRevealNotAllowed:
+		rest.RenderError(c, http.StatusForbidden, err)
+	case app.ErrIntegrationExists, app.ErrSettingsModified:
+		rest.RenderError(c, http.StatusConflict, err)
+	default:
+		_ = c.Error(err)
+		rest.RenderError(c,
+			http.StatusInternalServerError,
+			errors.New(http.StatusText(http.StatusInternalServerError)),
+		)
+	}
+}
+
+// GET /integrations
+func (h *ManagementHandler) GetIntegrations(c *gin.Context) {
+	if !userIdentity(c) {
+		return
+	}
+	integrations, err := h.app.GetIntegrations(c.Request.Context())
+	if err != nil {
+		renderIntegrationError(c, err)
+		return
+	}
+	redacted := make([]model.RedactedIntegration, len(integrations))
+	for i, integration := range integrations {
+		redacted[i] = integration.Redacted()
+	}
+	c.JSON(http.StatusOK, redacted)
+}
+
+// POST /integrations
+func (h *ManagementHandler) CreateIntegration(c *gin.Context) {
+	if !userIdentity(c) {
+		return
+	}
+	var integration model.Integration
+	if err := c.ShouldBindJSON(&integration); err != nil {
+		rest.RenderError(c,
+			http.StatusBadRequest,
+			errors.Wrap(err, "malformed request body"),
+		)
+		return
+	}
+	created, err := h.app.CreateIntegration(c.Request.Context(), integration)
+	if err != nil {
+		renderIntegrationError(c, err)
+		return
+	}
+	c.Header("Location",
+		APIURLManagement+APIURLIntegrations+"/"+created.ID.String(),
+	)
+	c.JSON(http.StatusCreated, created.Redacted())
+}
+
+// GET /integrations/:integration_id
+func (h *ManagementHandler) GetIntegration(c *gin.Context) {
+	if !userIdentity(c) {
+		return
+	}
+	id, ok := integrationID(c)
+	if !ok {
+		return
+	}
+	integration, err := h.app.GetIntegration(c.Request.Context(), id)
+	if err != nil {
+		renderIntegrationError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, integration.Redacted())
+}
+
+// GET /integrations/:integration_id/credentials
+func (h *ManagementHandler) RevealIntegration(c *gin.Context) {
+	if !userIdentity(c) {
+		return
+	}
+	id, ok := integrationID(c)
+	if !ok {
+		return
+	}
+	ctx := app.WithScopes(c.Request.Context(), tokenScopes(c))
+	integration, err := h.app.RevealIntegration(ctx, id)
+	if err != nil {
+		renderIntegrationError(c, err)
+		return
+	}
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, integration)
+}
+
+// PUT /integrations/:integration_id
+func (h *ManagementHandler) UpdateIntegration(c *gin.Context) {
+	if !userIdentity(c) {
+		return
+	}
+	id, ok := integrationID(c)
+	if !ok {
+		return
+	}
+	var integration model.IntegrationUpdate
+	if err := c.ShouldBindJSON(&integration); err != nil {
+		rest.RenderError(c,
+			http.StatusBadRequest,
+			errors.Wrap(err, "malformed request body"),
+		)
+		return
+	}
+	err := h.app.UpdateIntegration(c.Request.Context(),
+		id, model.Integration(integration),
+	)
+	if err != nil {
+		renderIntegrationError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// DELETE /integrations/:integration_id
+func (h *ManagementHandler) DeleteIntegration(c *gin.Context) {
+	if !userIdentity(c) {
+		return
+	}
+	id, ok := integrationID(c)
+	if !ok {
+		return
+	}
+	err := h.app.DeleteIntegration(c.Request.Context(), id)
+	if err != nil {
+		renderIntegrationError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// POST /devices/:id/rotate-keys
+func (h *ManagementHandler) RotateDeviceKeys(c *gin.Context) {
+	if !userIdentity(c) {
+		return
+	}
+	rotation, ok := bindKeyRotation(c)
+	if !ok {
+		return
+	}
+	err := h.app.RotateDeviceKeys(c.Request.Context(), c.Param("id"), rotation.Phase)
+	if err != nil {
+		if !renderKeyRotationError(c, err) {
+			_ = c.Error(err)
+			rest.RenderError(c,
+				http.StatusInternalServerError,
+				errors.New(http.StatusText(http.StatusInternalServerError)),
+			)
+		}
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// POST /rotate-keys
+func (h *ManagementHandler) RotateTenantKeys(c *gin.Context) {
+	if !userIdentity(c) {
+		return
+	}
+	rotation, ok := bindKeyRotation(c)
+	if !ok {
+		return
+	}
+	job, err := h.app.RotateTenantKeys(c.Request.Context(), rotation.Phase)
+	if err != nil {
+		if !renderKeyRotationError(c, err) {
+			_ = c.Error(err)
+			rest.RenderError(c,
+				http.StatusInternalServerError,
+				errors.New(http.StatusText(http.StatusInternalServerError)),
+			)
+		}
+		return
+	}
+	c.Header("Location", APIURLManagement+strings.Replace(
+		APIURLJob, ":"+ParamJobID, job.ID.String(), 1,
+	))
+	c.JSON(http.StatusAccepted, job)
+}
+
+// GET /jobs
+func (h *ManagementHandler) GetJobs(c *gin.Context) {
+	if !userIdentity(c) {
+		return
+	}
+	fltr, page, perPage, ok := bindJobsQuery(c)
+	if !ok {
+		return
+	}
+	jobs, err := h.app.GetJobs(c.Request.Context(), fltr, (page-1)*perPage, perPage+1)
+	if err != nil {
+		_ = c.Error(err)
+		rest.RenderError(c,
+			http.StatusInternalServerError,
+			errors.New(http.StatusText(http.StatusInternalServerError)),
+		)
+		return
+	}
+	renderJobsPage(c, jobs, page, perPage)
+}
+
+// GET /jobs/:job_id
+func (h *ManagementHandler) GetJob(c *gin.Context) {
+	if !userIdentity(c) {
+		return
+	}
+	jobID, err := uuid.Parse(c.Param(ParamJobID))
+	if err != nil {
+		rest.RenderError(c, http.StatusNotFound, app.ErrJobNotFound)
+		return
+	}
+	job, err := h.app.GetJob(c.Request.Context(), jobID)
+	switch errors.Cause(err) {
+	case nil:
+		c.JSON(http.StatusOK, job)
+	case app.ErrJobNotFound:
+		rest.RenderError(c, http.StatusNotFound, err)
+	default:
+		_ = c.Error(err)
+		rest.RenderError(c,
+			http.StatusInternalServerError,
+			errors.New(http.StatusText(http.StatusInternalServerError)),
+		)
+	}
+}
+
+// hubJobMethod is the direct method invoked by an IoT Hub job.
+type hubJobMethod struct {
+	Name string `json:"name"`
+	methodRequest
+}
+
+func (m hubJobMethod) Validate() error {
+	return validation.ValidateStruct(&m,
+		validation.Field(&m.Name, validation.Required),
+		validation.Field(&m.methodRequest),
+	)
+}
+
+// hubJobTwin is the twin patch applied by an IoT Hub job.
+type hubJobTwin struct {
+	Tags    map[string]interface{} `json:"tags,omitempty"`
+	Desired map[string]interface{} `json:"desired,omitempty"`
+}
+
+func (t hubJobTwin) Validate() error {
+	return validation.ValidateStruct(&t,
+		validation.Field(&t.Tags,
+			validation.When(len(t.Desired) == 0, validation.Required),
+		),
+	)
+}
+
+// hubJobRequest is the request body of an IoT Hub job, the job applies to
+// the devices matching all the conditions.
+type hubJobRequest struct {
+	Type             iothub.JobType     `json:"type"`
+	Where            []iothub.Condition `json:"where"`
+	Method           *hubJobMethod      `json:"method,omitempty"`
+	Twin             *hubJobTwin        `json:"twin,omitempty"`
+	StartTime        *time.Time         `json:"start_time,omitempty"`
+	MaxExecutionTime int                `json:"max_execution_time,omitempty"`
+}
+
+func (r hubJobRequest) Validate() error {
+	return validation.ValidateStruct(&r,
+		validation.Field(&r.Type, validation.Required),
+		validation.Field(&r.Where,
+			validation.Required,
+			validation.By(func(interface{}) error {
+				return iothub.NewQuery().And(r.Where...).Validate()
+			}),
+		),
+		validation.Field(&r.Method,
+			validation.When(r.Type == iothub.JobTypeDeviceMethod,
+				validation.Required,
+			).Else(validation.Nil),
+		),
+		validation.Field(&r.Twin,
+			validation.When(r.Type == iothub.JobTypeUpdateTwin,
+				validation.Required,
+			).Else(validation.Nil),
+		),
+		validation.Field(&r.MaxExecutionTime, validation.Min(0)),
+	)
+}
+
+// Job returns the IoT Hub job of the request.
+func (r hubJobRequest) Job() iothub.Job {
+	job := iothub.Job{
+		Type:             r.Type,
+		QueryCondition:   iothub.NewQuery().And(r.Where...).Condition(),
+		StartTime:        r.StartTime,
+		MaxExecutionTime: r.MaxExecutionTime,
+	}
+	if r.Method != nil {
+		job.CloudToDeviceMethod = &iothub.DirectMethod{
+			Name:            r.Method.Name,
+			Payload:         r.Method.Payload,
+			ResponseTimeout: r.Method.ResponseTimeout,
+			ConnectTimeout:  r.Method.ConnectTimeout,
+		}
+	}
+	if r.Twin != nil {
+		job.UpdateTwin = &iothub.JobTwin{Tags: r.Twin.Tags}
+		if len(r.Twin.Desired) > 0 {
+			job.UpdateTwin.Properties = &iothub.UpdateProperties{
+				Desired: r.Twin.Desired,
+			}
+		}
+	}
+	return job
+}
+
+// POST /integrations/:integration_id/jobs
+func (h *ManagementHandler) CreateHubJob(c *gin.Context) {
+	if !userIdentity(c) {
+		return
+	}
+	integrationID, ok := integrationID(c)
+	if !ok {
+		return
+	}
+	var req hubJobRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		rest.RenderError(c,
+			http.StatusBadRequest,
+			errors.Wrap(err, "malformed request body"),
+		)
+		return
+	}
+	job, err := h.app.ScheduleHubJob(c.Request.Context(), integrationID, req.Job())
+	if err != nil {
+		renderHubError(c, err, http.StatusBadRequest)
+		return
+	}
+	c.Header("Location", APIURLManagement+strings.NewReplacer(
+		":"+ParamIntegrationID, integrationID.String(),
+		":"+ParamJobID, job.JobID,
+	).Replace(APIURLIntegrationJob))
+	c.JSON(http.StatusCreated, job)
+}
+
+// GET /integrations/:integration_id/jobs
+func (h *ManagementHandler) GetHubJobs(c *gin.Context) {
+	if !userIdentity(c) {
+		return
+	}
+	integrationID, ok := integrationID(c)
+	if !ok {
+		return
+	}
+	perPage, contToken, ok := bindContinuationQuery(c, iothub.MaxJobsPageSize)
+	if !ok {
+		return
+	}
+	fltr := iothub.JobFilter{
+		Type:     iothub.JobType(c.Query(QueryType)),
+		Status:   iothub.JobStatus(c.Query(QueryStatus)),
+		PageSize: perPage,
+	}
+	if err := fltr.Validate(); err != nil {
+		rest.RenderError(c,
+			http.StatusBadRequest,
+			errors.Wrap(err, "invalid query parameters"),
+		)
+		return
+	}
+	page, err := h.app.QueryHubJobs(c.Request.Context(),
+		integrationID, fltr, contToken,
+	)
+	if err != nil {
+		// IoT Hub responds with 400 if the continuation token is invalid.
+		renderHubError(c, err, http.StatusBadRequest)
+		return
+	}
+	setNextPageLink(c, perPage, page.ContinuationToken)
+	c.JSON(http.StatusOK, page.Jobs)
+}
+
+// GET /integrations/:integration_id/jobs/:job_id
+func (h *ManagementHandler) GetHubJob(c *gin.Context) {
+	if !userIdentity(c) {
+		return
+	}
+	integrationID, ok := integrationID(c)
+	if !ok {
+		return
+	}
+	job, err := h.app.GetHubJob(c.Request.Context(),
+		integrationID, c.Param(ParamJobID),
+	)
+	if err != nil {
+		renderHubError(c, err, http.StatusNotFound)
+		return
+	}
+	c.JSON(http.StatusOK, job)
+}
+
+// POST /integrations/:integration_id/jobs/:job_id/cancel
+func (h *ManagementHandler) CancelHubJob(c *gin.Context) {
+	if !userIdentity(c) {
+		return
+	}
+	integrationID, ok := integrationID(c)
+	if !ok {
+		return
+	}
+	job, err := h.app.CancelHubJob(c.Request.Context(),
+		integrationID, c.Param(ParamJobID),
+	)
+	if err != nil {
+		renderHubError(c, err,
+			http.StatusBadRequest, http.StatusNotFound, http.StatusConflict,
+		)
+		return
+	}
+	c.JSON(http.StatusOK, job)
+}
+
+// hubConfigurationRequest is the request body of an IoT Hub configuration,
+// the configuration applies to the devices matching all the conditions.
+type hubConfigurationRequest struct {
+	Labels   map[string]string           `json:"labels,omitempty"`
+	Content  iothub.ConfigurationContent `json:"content"`
+	Where    []iothub.Condition          `json:"where"`
+	Priority int                         `json:"priority"`
+	// Metrics maps the metric names to the conditions of the devices the
+	// metric counts.
+	Metrics map[string][]iothub.Condition `json:"metrics,omitempty"`
+}
+
+var errInvalidMetricName = errors.New("invalid metric name")
+
+func validateHubMetrics(value interface{}) error {
+	metrics, _ := value.(map[string][]iothub.Condition)
+	for name, where := range metrics {
+		if name == "" {
+			return errInvalidMetricName
+		}
+		err := validation.Validate(where,
+			validation.Required,
+			validation.By(func(interface{}) error {
+				return iothub.NewQuery().And(where...).Validate()
+			}),
+		)
+		if err != nil {
+			return errors.Wrapf(err, "metric %q", name)
+		}
+	}
+	return nil
+}
+
+func (r hubConfigurationRequest) Validate() error {
+	return validation.ValidateStruct(&r,
+		validation.Field(&r.Content),
+		validation.Field(&r.Where,
+			validation.Required,
+			validation.By(func(interface{}) error {
+				return iothub.NewQuery().And(r.Where...).Validate()
+			}),
+		),
+		validation.Field(&r.Priority, validation.Min(0)),
+		validation.Field(&r.Metrics, validation.By(validateHubMetrics)),
+	)
+}
+
+// Configuration returns the IoT Hub configuration of the request.
+func (r hubConfigurationRequest) Configuration(id, etag string) iothub.Configuration {
+	config := iothub.Configuration{
+		ID:              id,
+		Labels:          r.Labels,
+		Content:         r.Content,
+		TargetCondition: iothub.NewQuery().And(r.Where...).Condition(),
+		Priority:        r.Priority,
+		ETag:            etag,
+	}
+	if len(r.Metrics) > 0 {
+		queries := make(map[string]string, len(r.Metrics))
+		for name, where := range r.Metrics {
+			queries[name] = iothub.NewQuery().
+				Fields(iothub.FieldDeviceID).
+				And(where...).
+				String()
+		}
+		config.Metrics = &iothub.ConfigurationMetrics{Queries: queries}
+	}
+	return config
+}
+
+// GET /integrations/:integration_id/configurations
+func (h *ManagementHandler) GetHubConfigurations(c *gin.Context) {
+	if !userIdentity(c) {
+		return
+	}
+	integrationID, ok := integrationID(c)
+	if !ok {
+		return
+	}
+	var top int
+	if s := c.Query(QueryPerPage); s != "" {
+		var err error
+		top, err = strconv.Atoi(s)
+		if err != nil || top < 1 || top > iothub.MaxConfigurationsCount {
+			rest.RenderError(c,
+				http.StatusBadRequest,
+				errors.Errorf("invalid query parameter %s: "+
+					"must be an integer between 1 and %d",
+					QueryPerPage, iothub.MaxConfigurationsCount),
+			)
+			return
+		}
+	}
+	configs, err := h.app.GetHubConfigurations(c.Request.Context(),
+		integrationID, top,
+	)
+	if err != nil {
+		renderHubError(c, err)
+		return
+	}
+	if configs == nil {
+		configs = []iothub.Configuration{}
+	}
+	c.JSON(http.StatusOK, configs)
+}
+
+// GET /integrations/:integration_id/configurations/:configuration_id
+func (h *ManagementHandler) GetHubConfiguration(c *gin.Context) {
+	if !userIdentity(c) {
+		return
+	}
+	integrationID, ok := integrationID(c)
+	if !ok {
+		return
+	}
+	config, err := h.app.GetHubConfiguration(c.Request.Context(),
+		integrationID, c.Param(ParamConfigID),
+	)
+	if err != nil {
+		renderHubError(c, err, http.StatusNotFound)
+		return
+	}
+	c.JSON(http.StatusOK, config)
+}
+
+// PUT /integrations/:integration_id/configurations/:configuration_id
+func (h *ManagementHandler) UpsertHubConfiguration(c *gin.Context) {
+	if !userIdentity(c) {
+		return
+	}
+	integrationID, ok := integrationID(c)
+	if !ok {
+		return
+	}
+	var req hubConfigurationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		rest.RenderError(c,
+			http.StatusBadRequest,
+			errors.Wrap(err, "malformed request body"),
+		)
+		return
+	}
+	config := req.Configuration(
+		c.Param(ParamConfigID),
+		strings.Trim(c.GetHeader(HdrKeyIfMatch), `"`),
+	)
+	if err := config.Validate(); err != nil {
+		rest.RenderError(c,
+			http.StatusBadRequest,
+			errors.Wrap(err, "invalid configuration"),
+		)
+		return
+	}
+	res, err := h.app.UpsertHubConfiguration(c.Request.Context(),
+		integrationID, config,
+	)
+	if err != nil {
+		// IoT Hub responds with 400 if the content of an existing
+		// configuration is modified.
+		renderHubError(c, err,
+			http.StatusBadRequest,
+			http.StatusConflict,
+			http.StatusPreconditionFailed,
+		)
+		return
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+// DELETE /integrations/:integration_id/configurations/:configuration_id
+func (h *ManagementHandler) DeleteHubConfiguration(c *gin.Context) {
+	if !userIdentity(c) {
+		return
+	}
+	integrationID, ok := integrationID(c)
+	if !ok {
+		return
+	}
+	err := h.app.DeleteHubConfiguration(c.Request.Context(),
+		integrationID,
+		c.Param(ParamConfigID),
+		strings.Trim(c.GetHeader(HdrKeyIfMatch), `"`),
+	)
+	if err != nil {
+		renderHubError(c, err,
+			http.StatusNotFound,
+			http.StatusPreconditionFailed,
+		)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// POST /devices/:id/apply-configuration
+func (h *ManagementHandler) ApplyDeviceConfiguration(c *gin.Context) {
+	if !userIdentity(c) {
+		return
+	}
+	integrationID, ok := bindIntegrationQuery(c)
+	if !ok {
+		return
+	}
+	var content iothub.ConfigurationContent
+	if err := c.ShouldBindJSON(&content); err != nil {
+		rest.RenderError(c,
+			http.StatusBadRequest,
+			errors.Wrap(err, "malformed request body"),
+		)
+		return
+	}
+	err := h.app.ApplyDeviceConfigurationContent(c.Request.Context(),
+		integrationID, c.Param("id"), content,
+	)
+	if err != nil {
+		renderHubError(c, err, http.StatusBadRequest, http.StatusNotFound)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// deviceParentRequest is the request body attaching a downstream device to
+// its parent IoT Edge device.
+type deviceParentRequest struct {
+	DeviceID        string `json:"device_id"`
+	GatewayHostName string `json:"gateway_hostname"`
+}
+
+func (r deviceParentRequest) Validate() error {
+	return validation.ValidateStruct(&r,
+		validation.Field(&r.DeviceID, validation.Required),
+		validation.Field(&r.GatewayHostName,
+			validation.Required,
+			validation.Length(1, 255),
+		),
+	)
+}
+
+// renderDeviceParentError renders the error returned when updating the
+// parent of a device.
+func renderDeviceParentError(c *gin.Context, err error) {
+	switch cause := errors.Cause(err); cause {
+	case app.ErrParentNotEdgeDevice,
+		app.ErrDownstreamAuthNotSupported,
+		app.ErrDeviceScopeModified:
+		rest.RenderError(c, http.StatusConflict, cause)
+	default:
+		renderHubError(c, err, http.StatusNotFound)
+	}
+}
+
+// PUT /devices/:id/parent
+func (h *ManagementHandler) SetDeviceParent(c *gin.Context) {
+	if !userIdentity(c) {
+		return
+	}
+	integrationID, ok := bindIntegrationQuery(c)
+	if !ok {
+		return
+	}
+	var parent deviceParentRequest
+	if err := c.ShouldBindJSON(&parent); err != nil {
+		rest.RenderError(c,
+			http.StatusBadRequest,
+			errors.Wrap(err, "malformed request body"),
+		)
+		return
+	}
+	err := h.app.SetDeviceParent(c.Request.Context(),
+		integrationID, c.Param("id"), parent.DeviceID, parent.GatewayHostName,
+	)
+	if err != nil {
+		renderDeviceParentError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// DELETE /devices/:id/parent
+func (h *ManagementHandler) DeleteDeviceParent(c *gin.Context) {
+	if !userIdentity(c) {
+		return
+	}
+	integrationID, ok := bindIntegrationQuery(c)
+	if !ok {
+		return
+	}
+	err := h.app.SetDeviceParent(c.Request.Context(),
+		integrationID, c.Param("id"), "", "",
+	)
+	if err != nil {
+		renderDeviceParentError(c, err)
+		return
+	}
 	c.Status(http.StatusNoContent)
 }
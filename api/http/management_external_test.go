@@ -92,9 +92,9 @@ func TestIOTHubExternal(t *testing.T) {
 	mockApp := new(mapp.App)
 	defer mockApp.AssertExpectations(t)
 	mockApp.On("GetSettings", mock.Anything).
-		Return(model.Settings{
+		Return(model.Settings{Integrations: []model.Integration{{
 			ConnectionString: externalCS,
-		}, nil)
+		}}}, nil)
 	handler := NewRouter(mockApp)
 	srv := httptest.NewServer(handler)
 	client := srv.Client()
@@ -42,15 +42,41 @@ const (
 	APIURLTenant            = APIURLTenants + "/:tenant_id"
 	APIURLTenantDevices     = APIURLTenant + "/devices"
 	APIURLTenantDevice      = APIURLTenantDevices + "/:device_id"
+	APIURLTenantDeviceKeys  = APIURLTenantDevice + "/rotate-keys"
+	APIURLTenantKeys        = APIURLTenant + "/rotate-keys"
 	APIURLTenantBulkDevices = APIURLTenant + "/bulk/devices"
 	APIURLTenantBulkStatus  = APIURLTenantBulkDevices + "/status"
+	APIURLTenantJobs        = APIURLTenant + "/jobs"
+	APIURLTenantJob         = APIURLTenantJobs + "/:" + ParamJobID
 
 	APIURLManagement = "/api/management/v1/iot-manager"
 
-	APIURLSettings      = "/settings"
-	APIURLDevice        = "/devices/:id"
-	APIURLDeviceTwin    = "/devices/:id/twin"
-	APIURLDeviceModules = "/devices/:id/modules"
+	APIURLSettings               = "/settings"
+	APIURLSettingsHistory        = APIURLSettings + "/history"
+	APIURLSettingsRestore        = APIURLSettingsHistory + "/:" + ParamRevision + "/restore"
+	APIURLIntegrations           = "/integrations"
+	APIURLIntegration            = APIURLIntegrations + "/:" + ParamIntegrationID
+	APIURLIntegrationCredentials = APIURLIntegration + "/credentials"
+	APIURLIntegrationJobs        = APIURLIntegration + "/jobs"
+	APIURLIntegrationJob         = APIURLIntegrationJobs + "/:" + ParamJobID
+	APIURLIntegrationJobCancel   = APIURLIntegrationJob + "/cancel"
+	APIURLIntegrationConfigs     = APIURLIntegration + "/configurations"
+	APIURLIntegrationConfig      = APIURLIntegrationConfigs + "/:" + ParamConfigID
+	APIURLDevices                = "/devices"
+	APIURLDevicesSearch          = APIURLDevices + "/search"
+	APIURLDevice                 = APIURLDevices + "/:id"
+	APIURLDeviceTwin             = "/devices/:id/twin"
+	APIURLDeviceModules          = "/devices/:id/modules"
+	APIURLDeviceKeys             = "/devices/:id/rotate-keys"
+	APIURLDeviceMethod           = APIURLDevice + "/methods/:" + ParamMethodName
+	APIURLDeviceModule           = APIURLDeviceModules + "/:" + ParamModuleID
+	APIURLDeviceModuleTwin       = APIURLDeviceModule + "/twin"
+	APIURLDeviceModuleMethod     = APIURLDeviceModule + "/methods/:" + ParamMethodName
+	APIURLDeviceApplyConfig      = APIURLDevice + "/apply-configuration"
+	APIURLDeviceParent           = APIURLDevice + "/parent"
+	APIURLKeys                   = "/rotate-keys"
+	APIURLJobs                   = "/jobs"
+	APIURLJob                    = APIURLJobs + "/:" + ParamJobID
 )
 
 const (
@@ -59,6 +85,15 @@ const (
 
 type Config struct {
 	Client *http.Client
+	// MaxBulkItems is the maximum number of devices accepted by the bulk
+	// provisioning and status endpoints.
+	MaxBulkItems int
+	// MaxBulkJobItems is the maximum number of devices accepted by the
+	// bulk endpoints running the request as a job.
+	MaxBulkJobItems int
+	// MaxBulkDecommissionItems is the maximum number of devices accepted
+	// by the bulk decommissioning endpoint.
+	MaxBulkDecommissionItems int
 }
 
 // NewConfig initializes a new empty config and optionally merges the
@@ -72,6 +107,15 @@ func NewConfig(configs ...*Config) *Config {
 		if conf.Client != nil {
 			config.Client = conf.Client
 		}
+		if conf.MaxBulkItems > 0 {
+			config.MaxBulkItems = conf.MaxBulkItems
+		}
+		if conf.MaxBulkJobItems > 0 {
+			config.MaxBulkJobItems = conf.MaxBulkJobItems
+		}
+		if conf.MaxBulkDecommissionItems > 0 {
+			config.MaxBulkDecommissionItems = conf.MaxBulkDecommissionItems
+		}
 	}
 	return config
 }
@@ -81,6 +125,21 @@ func (conf *Config) SetClient(client *http.Client) *Config {
 	return conf
 }
 
+func (conf *Config) SetMaxBulkItems(maxItems int) *Config {
+	conf.MaxBulkItems = maxItems
+	return conf
+}
+
+func (conf *Config) SetMaxBulkJobItems(maxItems int) *Config {
+	conf.MaxBulkJobItems = maxItems
+	return conf
+}
+
+func (conf *Config) SetMaxBulkDecommissionItems(maxItems int) *Config {
+	conf.MaxBulkDecommissionItems = maxItems
+	return conf
+}
+
 // NewRouter returns the gin router
 func NewRouter(
 	app app.App,
@@ -105,17 +164,59 @@ func NewRouter(
 
 	internalAPI.POST(APIURLTenantDevices, internal.ProvisionDevice)
 	internalAPI.DELETE(APIURLTenantDevice, internal.DecomissionDevice)
+	internalAPI.POST(APIURLTenantBulkDevices, internal.BulkProvisionDevices)
+	internalAPI.DELETE(APIURLTenantBulkDevices, internal.BulkDecommissionDevices)
 	internalAPI.PUT(APIURLTenantBulkStatus, internal.BulkSetDeviceStatus)
+	internalAPI.POST(APIURLTenantDeviceKeys, internal.RotateDeviceKeys)
+	internalAPI.POST(APIURLTenantKeys, internal.RotateTenantKeys)
+	internalAPI.DELETE(APIURLTenant, internal.DeleteTenant)
+	internalAPI.GET(APIURLTenantJobs, internal.GetJobs)
+	internalAPI.GET(APIURLTenantJob, internal.GetJob)
 
 	managementAPI := router.Group(APIURLManagement, identity.Middleware())
 	managementAPI.GET(APIURLSettings, management.GetSettings)
 	managementAPI.PUT(APIURLSettings, management.SetSettings)
-
+	managementAPI.GET(APIURLSettingsHistory, management.GetSettingsHistory)
+	managementAPI.POST(APIURLSettingsRestore, management.RestoreSettings)
+
+	managementAPI.GET(APIURLIntegrations, management.GetIntegrations)
+	managementAPI.POST(APIURLIntegrations, management.CreateIntegration)
+	managementAPI.GET(APIURLIntegration, management.GetIntegration)
+	managementAPI.PUT(APIURLIntegration, management.UpdateIntegration)
+	managementAPI.DELETE(APIURLIntegration, management.DeleteIntegration)
+	managementAPI.GET(APIURLIntegrationCredentials, management.RevealIntegration)
+	managementAPI.POST(APIURLIntegrationJobs, management.CreateHubJob)
+	managementAPI.GET(APIURLIntegrationJobs, management.GetHubJobs)
+	managementAPI.GET(APIURLIntegrationJob, management.GetHubJob)
+	managementAPI.POST(APIURLIntegrationJobCancel, management.CancelHubJob)
+	managementAPI.GET(APIURLIntegrationConfigs, management.GetHubConfigurations)
+	managementAPI.GET(APIURLIntegrationConfig, management.GetHubConfiguration)
+	managementAPI.PUT(APIURLIntegrationConfig, management.UpsertHubConfiguration)
+	managementAPI.DELETE(APIURLIntegrationConfig, management.DeleteHubConfiguration)
+
+	managementAPI.GET(APIURLDevices, management.ListDevices)
+	managementAPI.POST(APIURLDevicesSearch, management.SearchDevices)
 	managementAPI.GET(APIURLDeviceTwin, management.GetDeviceTwin)
 	managementAPI.PUT(APIURLDeviceTwin, management.UpdateDeviceTwin)
 	managementAPI.PATCH(APIURLDeviceTwin, management.UpdateDeviceTwin)
 	managementAPI.GET(APIURLDeviceModules, management.GetDeviceModules)
+	managementAPI.GET(APIURLDeviceModule, management.GetModule)
+	managementAPI.PUT(APIURLDeviceModule, management.UpsertModule)
+	managementAPI.DELETE(APIURLDeviceModule, management.DeleteModule)
+	managementAPI.GET(APIURLDeviceModuleTwin, management.GetModuleTwin)
+	managementAPI.PUT(APIURLDeviceModuleTwin, management.UpdateModuleTwin)
+	managementAPI.PATCH(APIURLDeviceModuleTwin, management.UpdateModuleTwin)
 	managementAPI.GET(APIURLDevice, management.GetDevice)
+	managementAPI.POST(APIURLDeviceKeys, management.RotateDeviceKeys)
+	managementAPI.POST(APIURLDeviceMethod, management.InvokeDeviceMethod)
+	managementAPI.POST(APIURLDeviceModuleMethod, management.InvokeDeviceMethod)
+	managementAPI.POST(APIURLDeviceApplyConfig, management.ApplyDeviceConfiguration)
+	managementAPI.PUT(APIURLDeviceParent, management.SetDeviceParent)
+	managementAPI.DELETE(APIURLDeviceParent, management.DeleteDeviceParent)
+	managementAPI.POST(APIURLKeys, management.RotateTenantKeys)
+
+	managementAPI.GET(APIURLJobs, management.GetJobs)
+	managementAPI.GET(APIURLJob, management.GetJob)
 
 	return router
 }
@@ -123,6 +224,10 @@ func NewRouter(
 type APIHandler struct {
 	*http.Client
 	app app.App
+
+	maxBulkItems             int
+	maxBulkJobItems          int
+	maxBulkDecommissionItems int
 }
 
 func NewAPIHandler(app app.App, config ...*Config) *APIHandler {
@@ -130,9 +235,22 @@ func NewAPIHandler(app app.App, config ...*Config) *APIHandler {
 	if conf.Client == nil {
 		conf.Client = new(http.Client)
 	}
+	if conf.MaxBulkItems == 0 {
+		conf.MaxBulkItems = defaultMaxBulkItems
+	}
+	if conf.MaxBulkJobItems == 0 {
+		conf.MaxBulkJobItems = defaultMaxBulkJobItems
+	}
+	if conf.MaxBulkDecommissionItems == 0 {
+		conf.MaxBulkDecommissionItems = defaultMaxBulkDecommissionItems
+	}
 	return &APIHandler{
 		Client: conf.Client,
 		app:    app,
+
+		maxBulkItems:             conf.MaxBulkItems,
+		maxBulkJobItems:          conf.MaxBulkJobItems,
+		maxBulkDecommissionItems: conf.MaxBulkDecommissionItems,
 	}
 }
 
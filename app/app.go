@@ -17,8 +17,16 @@ package app
 import (
 	"context"
 	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/mendersoftware/go-lib-micro/log"
 
 	"github.com/mendersoftware/iot-manager/client"
+	"github.com/mendersoftware/iot-manager/client/devauth"
+	"github.com/mendersoftware/iot-manager/client/dps"
+	"github.com/mendersoftware/iot-manager/client/iotcore"
 	"github.com/mendersoftware/iot-manager/client/iothub"
 	"github.com/mendersoftware/iot-manager/client/workflows"
 	"github.com/mendersoftware/iot-manager/model"
@@ -30,14 +38,27 @@ import (
 var (
 	ErrNoConnectionString = errors.New("no connection string configured for tenant")
 
+	ErrNoCredentials = errors.New("no AWS credentials configured for tenant")
+
 	ErrNoDeviceConnectionString = errors.New("device has no connection string")
 
 	ErrDeviceAlreadyExists = errors.New("device already exists")
+
+	ErrNoCertificateAuthority = errors.New(
+		"no certificate authority configured for tenant",
+	)
 )
 
 const (
-	confKeyPrimaryKey   = "$azure.primaryKey"
-	confKeySecondaryKey = "$azure.secondaryKey"
+	confKeyPrimaryKey       = "$azure.primaryKey"
+	confKeySecondaryKey     = "$azure.secondaryKey"
+	confKeyConnectionString = "$azure.connectionString"
+	confKeyCertificate      = "$azure.certificate"
+	confKeyPrivateKey       = "$azure.privateKey"
+)
+
+const (
+	deviceCertificateValidity = time.Hour * 24 * 365
 )
 
 type DeviceUpdate iothub.Device
@@ -56,9 +77,47 @@ type App interface {
 	HealthCheck(context.Context) error
 	GetSettings(context.Context) (model.Settings, error)
 	SetSettings(context.Context, model.Settings) error
+	SetDefaultConnectionString(ctx context.Context, cs *model.ConnectionString, revision int) error
+	GetSettingsHistory(ctx context.Context, skip, limit int64) ([]model.SettingsRevision, error)
+	RestoreSettings(ctx context.Context, revision, ifMatch int) error
+	GetIntegrations(context.Context) ([]model.Integration, error)
+	GetIntegration(ctx context.Context, integrationID uuid.UUID) (*model.Integration, error)
+	RevealIntegration(ctx context.Context, integrationID uuid.UUID) (*model.Integration, error)
+	CreateIntegration(context.Context, model.Integration) (*model.Integration, error)
+	UpdateIntegration(ctx context.Context, integrationID uuid.UUID, integration model.Integration) error
+	DeleteIntegration(ctx context.Context, integrationID uuid.UUID) error
 	SetDeviceStatus(context.Context, string, Status) error
-	ProvisionDevice(context.Context, string) error
+	SetDevicesStatus(ctx context.Context, deviceIDs []string, status Status) ([]error, error)
+	ProvisionDevice(ctx context.Context, deviceID, deviceType string) error
+	ProvisionDevices(ctx context.Context, deviceIDs []string) ([]error, error)
+	ScheduleDeviceProvisioning(ctx context.Context, deviceIDs []string) (*model.Job, error)
 	DeleteIOTHubDevice(context.Context, string) error
+	DecommissionDevices(ctx context.Context, deviceIDs []string) ([]error, error)
+	QueryDevices(ctx context.Context, integrationID uuid.UUID, q *iothub.Query, contToken string) (*iothub.QueryPage, error)
+	InvokeDeviceMethod(ctx context.Context, integrationID uuid.UUID, deviceID, moduleID string, method *iothub.DirectMethod) (*iothub.MethodResult, error)
+	GetDeviceModule(ctx context.Context, integrationID uuid.UUID, deviceID, moduleID string) (*iothub.Module, error)
+	UpsertDeviceModule(ctx context.Context, integrationID uuid.UUID, deviceID, moduleID string, module *iothub.Module) (*iothub.Module, error)
+	DeleteDeviceModule(ctx context.Context, integrationID uuid.UUID, deviceID, moduleID string) error
+	GetDeviceModuleTwin(ctx context.Context, integrationID uuid.UUID, deviceID, moduleID string) (*iothub.DeviceTwin, error)
+	UpdateDeviceModuleTwin(ctx context.Context, integrationID uuid.UUID, deviceID, moduleID string, update *iothub.DeviceTwinUpdate) error
+	ScheduleHubJob(ctx context.Context, integrationID uuid.UUID, job iothub.Job) (*iothub.Job, error)
+	GetHubJob(ctx context.Context, integrationID uuid.UUID, jobID string) (*iothub.Job, error)
+	CancelHubJob(ctx context.Context, integrationID uuid.UUID, jobID string) (*iothub.Job, error)
+	QueryHubJobs(ctx context.Context, integrationID uuid.UUID, fltr iothub.JobFilter, contToken string) (*iothub.JobsPage, error)
+	ApplyDeviceConfigurationContent(ctx context.Context, integrationID uuid.UUID, deviceID string, content iothub.ConfigurationContent) error
+	GetHubConfigurations(ctx context.Context, integrationID uuid.UUID, top int) ([]iothub.Configuration, error)
+	GetHubConfiguration(ctx context.Context, integrationID uuid.UUID, configID string) (*iothub.Configuration, error)
+	UpsertHubConfiguration(ctx context.Context, integrationID uuid.UUID, config iothub.Configuration) (*iothub.Configuration, error)
+	DeleteHubConfiguration(ctx context.Context, integrationID uuid.UUID, configID, etag string) error
+	SetDeviceParent(ctx context.Context, integrationID uuid.UUID, deviceID, parentID, gatewayHostName string) error
+	RotateDeviceKeys(ctx context.Context, deviceID string, phase model.KeyRotationPhase) error
+	RotateTenantKeys(ctx context.Context, phase model.KeyRotationPhase) (*model.Job, error)
+	ReconcileDevices(ctx context.Context, opts model.ReconcileOptions) ([]model.ReconcileReport, error)
+	ScheduleReconciliation(ctx context.Context, interval time.Duration, opts model.ReconcileOptions) (*model.Job, error)
+	DeleteTenant(ctx context.Context, action model.TenantDevicesAction) (*model.Job, error)
+	GetJob(ctx context.Context, jobID uuid.UUID) (*model.Job, error)
+	GetJobs(ctx context.Context, fltr model.JobFilter, skip, limit int64) ([]model.Job, error)
+	RunJobWorker(ctx context.Context, workerID string) error
 }
 
 // app is an app object
@@ -66,15 +125,135 @@ type app struct {
 	store store.DataStore
 	hub   iothub.Client
 	wf    workflows.Client
+	dps   dps.Client
+
+	iotcore iotcore.Client
+	devauth devauth.Client
+
+	skipVerify  bool
+	allowReveal bool
+
+	bulkConcurrency int
+}
+
+// Options configures the optional clients and the behavior of the app.
+type Options struct {
+	// DPS is the Device Provisioning Service client, required by the
+	// integrations provisioning devices through DPS.
+	DPS dps.Client
+	// IoTCore is the AWS IoT Core client, required by the IoT Core
+	// integrations.
+	IoTCore iotcore.Client
+	// DeviceAuth is the device authentication service client, required by
+	// the device reconciliation to recognize the devices known to Mender.
+	DeviceAuth devauth.Client
+
+	// VerifyConnectionString enables verifying the permissions of new
+	// connection strings against the IoT Hub before they are saved. The
+	// verification is enabled by default.
+	VerifyConnectionString *bool
+	// AllowCredentialsReveal allows users to retrieve the plain text
+	// secrets of the integrations. Revealing the secrets is not allowed by
+	// default.
+	AllowCredentialsReveal *bool
+	// BulkConcurrency is the maximum number of devices processed
+	// concurrently by the bulk operations that are not supported by the
+	// IoT Hub bulk registry API.
+	BulkConcurrency *int
+}
+
+// NewOptions initializes empty options and merges the options provided as
+// argument, later options take precedence.
+func NewOptions(opts ...*Options) *Options {
+	ret := new(Options)
+	for _, opt := range opts {
+		if opt == nil {
+			continue
+		}
+		if opt.DPS != nil {
+			ret.DPS = opt.DPS
+		}
+		if opt.IoTCore != nil {
+			ret.IoTCore = opt.IoTCore
+		}
+		if opt.DeviceAuth != nil {
+			ret.DeviceAuth = opt.DeviceAuth
+		}
+		if opt.VerifyConnectionString != nil {
+			ret.VerifyConnectionString = opt.VerifyConnectionString
+		}
+		if opt.AllowCredentialsReveal != nil {
+			ret.AllowCredentialsReveal = opt.AllowCredentialsReveal
+		}
+		if opt.BulkConcurrency != nil {
+			ret.BulkConcurrency = opt.BulkConcurrency
+		}
+	}
+	return ret
+}
+
+func (opts *Options) SetDPS(client dps.Client) *Options {
+	opts.DPS = client
+	return opts
+}
+
+func (opts *Options) SetIoTCore(client iotcore.Client) *Options {
+	opts.IoTCore = client
+	return opts
+}
+
+func (opts *Options) SetDeviceAuth(client devauth.Client) *Options {
+	opts.DeviceAuth = client
+	return opts
+}
+
+func (opts *Options) SetConnectionStringVerification(verify bool) *Options {
+	opts.VerifyConnectionString = &verify
+	return opts
+}
+
+func (opts *Options) SetCredentialsReveal(allow bool) *Options {
+	opts.AllowCredentialsReveal = &allow
+	return opts
+}
+
+func (opts *Options) SetBulkConcurrency(workers int) *Options {
+	opts.BulkConcurrency = &workers
+	return opts
 }
 
 // NewApp initialize a new iot-manager App
-func New(ds store.DataStore, hub iothub.Client, wf workflows.Client) App {
-	return &app{
+func New(
+	ds store.DataStore,
+	hub iothub.Client,
+	wf workflows.Client,
+	options ...*Options,
+) App {
+	opts := NewOptions(options...)
+	a := &app{
 		store: ds,
 		hub:   hub,
 		wf:    wf,
+		dps:   opts.DPS,
+
+		iotcore: opts.IoTCore,
+		devauth: opts.DeviceAuth,
+
+		bulkConcurrency: defaultBulkConcurrency,
+	}
+	if opts.VerifyConnectionString != nil {
+		a.skipVerify = !*opts.VerifyConnectionString
 	}
+	if opts.AllowCredentialsReveal != nil {
+		a.allowReveal = *opts.AllowCredentialsReveal
+	}
+	if opts.BulkConcurrency != nil {
+		a.bulkConcurrency = *opts.BulkConcurrency
+		if a.bulkConcurrency < 1 {
+			a.bulkConcurrency = 1
+		}
+	}
+	return a
 }
 
 // HealthCheck performs a health check and returns an error if it fails
@@ -86,98 +265,362 @@ func (a *app) GetSettings(ctx context.Context) (model.Settings, error) {
 	return a.store.GetSettings(ctx)
 }
 
+// SetSettings replaces the settings. The omitted secrets of existing
+// integrations are inherited from the stored settings. If settings.Revision
+// is set, the settings are only replaced if the stored settings are still
+// at that revision.
 func (a *app) SetSettings(ctx context.Context, settings model.Settings) error {
-	return a.store.SetSettings(ctx, settings)
+	current, err := a.GetSettings(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to retrieve settings")
+	}
+	if settings.Revision != 0 && settings.Revision != current.Revision {
+		return ErrSettingsModified
+	}
+	settings.Revision = current.Revision
+	now := time.Now()
+	for i := range settings.Integrations {
+		integration := &settings.Integrations[i]
+		if integration.ID == uuid.Nil {
+			integration.ID = uuid.New()
+		}
+		updateIntegration(integration, current.Integration(integration.ID), now)
+	}
+	if err = settings.Validate(); err != nil {
+		return &ValidationError{Err: err}
+	}
+	if !a.skipVerify {
+		err = a.verifyIntegrations(ctx, current, settings.Integrations...)
+		if err != nil {
+			return err
+		}
+	}
+	return a.storeSettings(ctx, settings)
 }
 
+// SetDeviceStatus updates the status of the device in every integration
+// that includes the device.
 func (a *app) SetDeviceStatus(ctx context.Context, deviceID string, status Status) error {
-	settings, err := a.GetSettings(ctx)
+	integrations, err := a.deviceIntegrations(ctx, deviceID)
 	if err != nil {
-		return errors.Wrap(err, "failed to retrieve settings")
+		return err
 	}
-	cs := settings.ConnectionString
-	if cs == nil {
-		return ErrNoConnectionString
+	err = fanOut(integrations, func(integration model.Integration) error {
+		if integration.Provider == model.ProviderIoTCore {
+			return a.setIoTCoreDeviceStatus(ctx, integration, deviceID, status)
+		}
+		return a.setIoTHubDeviceStatus(ctx, integration, deviceID, status)
+	})
+	if err != nil {
+		return err
 	}
+	statusStr := string(status)
+	err = a.store.UpsertDevice(ctx, deviceID, model.DeviceUpdate{
+		Status: &statusStr,
+	})
+	return errors.Wrap(err, "failed to update device record")
+}
+
+func (a *app) setIoTHubDeviceStatus(
+	ctx context.Context,
+	integration model.Integration,
+	deviceID string,
+	status Status,
+) error {
+	cs := integration.ConnectionString
 	dev, err := a.hub.GetDevice(ctx, cs, deviceID)
 	if err != nil {
 		return errors.Wrap(err, "failed to retrieve device from IoT Hub")
-	} else if dev.Status == iothub.Status(status) {
-		// We're done...
-		return nil
 	}
-
-	dev.Status = iothub.Status(status)
-	_, err = a.hub.UpsertDevice(ctx, cs, deviceID, dev)
-	return errors.Wrap(err, "failed to update IoT Hub device")
+	if dev.Status != iothub.Status(status) {
+		dev.Status = iothub.Status(status)
+		_, err = a.hub.UpsertDevice(ctx, cs, deviceID, dev)
+		if err != nil {
+			return errors.Wrap(err, "failed to update IoT Hub device")
+		}
+	}
+	return nil
 }
 
+// ProvisionDevice provisions the device to every integration that includes
+// the device. The device type, which may be empty, is matched by the
+// provisioning rules of the integrations.
 func (a *app) ProvisionDevice(
 	ctx context.Context,
-	deviceID string,
+	deviceID, deviceType string,
 ) error {
-	settings, err := a.GetSettings(ctx)
+	integrations, err := a.deviceIntegrations(ctx, deviceID)
 	if err != nil {
-		return errors.Wrap(err, "failed to retrieve settings")
+		return err
+	}
+
+	var (
+		state     = model.DeviceStateProvisioned
+		lastError string
+		update    = model.DeviceUpdate{
+			HubDeviceID: &deviceID,
+		}
+	)
+	if deviceType != "" {
+		update.DeviceType = &deviceType
 	}
-	cs := settings.ConnectionString
-	if cs == nil {
-		return ErrNoConnectionString
+	err = fanOut(integrations, func(integration model.Integration) error {
+		hostName, status, err := a.provisionIntegrationDevice(ctx,
+			integration, deviceID, deviceType,
+		)
+		if hostName != "" && update.HubHostName == nil {
+			update.HubHostName = &hostName
+		}
+		if status != "" && update.Status == nil {
+			update.Status = &status
+		}
+		return err
+	})
+	if err != nil {
+		state = model.DeviceStateProvisionFailed
+		lastError = err.Error()
+	}
+	update.State = &state
+	update.LastError = &lastError
+	errStore := a.store.UpsertDevice(ctx, deviceID, update)
+	if err != nil {
+		if errStore != nil {
+			log.FromContext(ctx).
+				Errorf("failed to record provisioning failure: %s", errStore)
+		}
+		return err
+	}
+	return errors.Wrap(errStore, "failed to update device record")
+}
+
+// provisionIntegrationDevice provisions the device to a single integration
+// and returns the hostname the device connects to and the device status.
+// The device type may be empty if it is unknown.
+func (a *app) provisionIntegrationDevice(
+	ctx context.Context,
+	integration model.Integration,
+	deviceID, deviceType string,
+) (hostName string, status string, err error) {
+	switch {
+	case integration.Provider == model.ProviderIoTCore:
+		var dev *iotcore.Device
+		dev, err = a.provisionIoTCoreDevice(ctx, integration, deviceID)
+		if dev != nil {
+			hostName = dev.Endpoint
+			status = string(dev.Status)
+		}
+	case integration.ProvisioningMode == model.ProvisioningModeDPS:
+		hostName = integration.ConnectionString.HostName
+		err = a.provisionDPSDevice(ctx, integration, deviceID, deviceType)
+	default:
+		hostName = integration.ConnectionString.HostName
+		var dev *iothub.Device
+		dev, err = a.provisionIoTHubDevice(ctx, integration, deviceID, deviceType)
+		if dev != nil {
+			status = string(dev.Status)
+		}
 	}
+	return hostName, status, err
+}
 
-	dev, err := a.hub.UpsertDevice(ctx, cs, deviceID)
+func (a *app) provisionIoTHubDevice(
+	ctx context.Context,
+	integration model.Integration,
+	deviceID, deviceType string,
+) (*iothub.Device, error) {
+	var (
+		cs         = integration.ConnectionString
+		deviceCert *model.DeviceCertificate
+		updates    []*iothub.Device
+	)
+	if integration.IsEdgeDevice(deviceID, deviceType) {
+		updates = append(updates, &iothub.Device{
+			DeviceCapabilities: &iothub.DeviceCapabilities{IOTEdge: true},
+		})
+	}
+	if integration.DeviceAuth == model.DeviceAuthX509 {
+		var (
+			auth *iothub.Auth
+			err  error
+		)
+		deviceCert, auth, err = issueIoTHubDeviceCertificate(integration, deviceID)
+		if err != nil {
+			return nil, err
+		}
+		updates = append(updates, &iothub.Device{
+			Auth: auth,
+		})
+	}
+	dev, err := a.hub.UpsertDevice(ctx, cs, deviceID, updates...)
 	if err != nil {
 		if htErr, ok := err.(client.HTTPError); ok {
 			switch htErr.Code {
 			case http.StatusUnauthorized:
-				return ErrNoConnectionString
+				return nil, ErrNoConnectionString
 			case http.StatusConflict:
-				return ErrDeviceAlreadyExists
+				return nil, ErrDeviceAlreadyExists
 			}
 		}
-		return errors.Wrap(err, "failed to update iothub devices")
+		return nil, errors.Wrap(err, "failed to update iothub devices")
 	}
+
+	err = a.submitIoTHubDeviceConfig(ctx, cs, dev, deviceCert)
+	if err != nil {
+		return dev, err
+	}
+	err = a.hub.UpdateDeviceTwin(ctx, cs, dev.DeviceID, &iothub.DeviceTwinUpdate{
+		Tags: map[string]interface{}{
+			tagMender: true,
+		},
+	})
+	return dev, errors.Wrap(err, "failed to tag provisioned iothub device")
+}
+
+// issueIoTHubDeviceCertificate issues the certificate of an IoT Hub device
+// authenticating with X.509 and returns the matching authentication.
+func issueIoTHubDeviceCertificate(
+	integration model.Integration,
+	deviceID string,
+) (*model.DeviceCertificate, *iothub.Auth, error) {
+	if integration.CertificateAuthority == nil {
+		return nil, nil, ErrNoCertificateAuthority
+	}
+	deviceCert, err := integration.CertificateAuthority.
+		IssueDeviceCertificate(deviceID, deviceCertificateValidity)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to issue device certificate")
+	}
+	return deviceCert, &iothub.Auth{
+		Type: iothub.AuthTypeSelfSigned,
+		// The secondary thumbprint is left for renewing the certificate,
+		// see rotateDeviceCertificate.
+		X509ThumbPrint: &iothub.X509ThumbPrint{
+			Primary: deviceCert.Thumbprint,
+		},
+	}, nil
+}
+
+// submitIoTHubDeviceConfig pushes the credentials of the IoT Hub device to
+// the device configuration.
+func (a *app) submitIoTHubDeviceConfig(
+	ctx context.Context,
+	cs *model.ConnectionString,
+	dev *iothub.Device,
+	deviceCert *model.DeviceCertificate,
+) error {
+	var (
+		config map[string]string
+		err    error
+	)
+	if deviceCert != nil {
+		devCS := &model.ConnectionString{
+			HostName: cs.HostName,
+			DeviceID: dev.DeviceID,
+			X509:     true,
+		}
+		config = map[string]string{
+			confKeyConnectionString: devCS.String(),
+			confKeyCertificate:      string(deviceCert.Certificate),
+			confKeyPrivateKey:       string(deviceCert.PrivateKey),
+		}
+	} else {
+		config, err = symmetricKeyConfig(cs, dev, "")
+		if err != nil {
+			return err
+		}
+	}
+	err = a.wf.ProvisionExternalDevice(ctx, dev.DeviceID, model.ProviderIoTHub, config)
+	return errors.Wrap(err, "failed to submit iothub authn to deviceconfig")
+}
+
+// symmetricKeyConfig returns the device configuration with the primary and
+// secondary connection strings of the device. Downstream devices connect
+// through the gateway hostname of their parent IoT Edge device, which is
+// empty for the other devices.
+func symmetricKeyConfig(
+	cs *model.ConnectionString,
+	dev *iothub.Device,
+	gatewayHostName string,
+) (map[string]string, error) {
 	if dev.Auth == nil || dev.Auth.SymmetricKey == nil {
-		return ErrNoDeviceConnectionString
+		return nil, ErrNoDeviceConnectionString
 	}
 	primKey := &model.ConnectionString{
-		Key:      dev.Auth.SymmetricKey.Primary,
-		DeviceID: dev.DeviceID,
-		HostName: cs.HostName,
+		Key:             dev.Auth.SymmetricKey.Primary,
+		DeviceID:        dev.DeviceID,
+		HostName:        cs.HostName,
+		GatewayHostName: gatewayHostName,
 	}
 	secKey := &model.ConnectionString{
-		Key:      dev.Auth.SymmetricKey.Secondary,
-		DeviceID: dev.DeviceID,
-		HostName: cs.HostName,
+		Key:             dev.Auth.SymmetricKey.Secondary,
+		DeviceID:        dev.DeviceID,
+		HostName:        cs.HostName,
+		GatewayHostName: gatewayHostName,
 	}
-
-	err = a.wf.ProvisionExternalDevice(ctx, dev.DeviceID, map[string]string{
+	return map[string]string{
 		confKeyPrimaryKey:   primKey.String(),
 		confKeySecondaryKey: secKey.String(),
-	})
-	if err != nil {
-		return errors.Wrap(err, "failed to submit iothub authn to deviceconfig")
-	}
-	err = a.hub.UpdateDeviceTwin(ctx, cs, dev.DeviceID, &iothub.DeviceTwinUpdate{
-		Tags: map[string]interface{}{
-			"mender": true,
-		},
-	})
-	return errors.Wrap(err, "failed to tag provisioned iothub device")
+	}, nil
 }
 
+// DeleteIOTHubDevice removes the device from every integration that
+// includes the device.
 func (a *app) DeleteIOTHubDevice(ctx context.Context, deviceID string) error {
-	settings, err := a.GetSettings(ctx)
+	integrations, err := a.deviceIntegrations(ctx, deviceID)
 	if err != nil {
-		return errors.Wrap(err, "failed to retrieve settings")
-	}
-	cs := settings.ConnectionString
-	if cs == nil {
-		return ErrNoConnectionString
+		return err
 	}
-	err = a.hub.DeleteDevice(ctx, cs, deviceID)
+	err = fanOut(integrations, func(integration model.Integration) error {
+		return a.deleteIntegrationDevice(ctx, integration, deviceID)
+	})
 	if err != nil {
-		return errors.Wrap(err, "failed to delete IoT Hub device")
+		state := model.DeviceStateDecommissionFailed
+		lastError := err.Error()
+		errStore := a.store.UpsertDevice(ctx, deviceID, model.DeviceUpdate{
+			State:     &state,
+			LastError: &lastError,
+		})
+		if errStore != nil {
+			log.FromContext(ctx).
+				Errorf("failed to record decommissioning failure: %s", errStore)
+		}
+		return err
 	}
-	return nil
+	err = a.store.DeleteDevice(ctx, deviceID)
+	return errors.Wrap(err, "failed to delete device record")
+}
+
+func (a *app) deleteIntegrationDevice(
+	ctx context.Context,
+	integration model.Integration,
+	deviceID string,
+) error {
+	if integration.Provider == model.ProviderIoTCore {
+		err := a.iotcore.DeleteDevice(ctx, integration.AWS, deviceID)
+		return errors.Wrap(err, "failed to delete IoT Core device")
+	}
+	return a.deleteIoTHubDevice(ctx, integration, deviceID)
+}
+
+func (a *app) deleteIoTHubDevice(
+	ctx context.Context,
+	integration model.Integration,
+	deviceID string,
+) error {
+	cs := integration.ConnectionString
+	var err error
+	if integration.ProvisioningMode == model.ProvisioningModeDPS {
+		err = a.deleteDPSEnrollment(ctx, integration, deviceID)
+		if err == nil {
+			err = a.hub.DeleteDevice(ctx, cs, deviceID)
+			// The device might never have registered with the hub.
+			if htErr, ok := err.(client.HTTPError); ok &&
+				htErr.Code == http.StatusNotFound {
+				err = nil
+			}
+		}
+	} else {
+		err = a.hub.DeleteDevice(ctx, cs, deviceID)
+	}
+	return errors.Wrap(err, "failed to delete IoT Hub device")
 }
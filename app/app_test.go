@@ -16,16 +16,29 @@ package app
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"errors"
+	"math/big"
+	"net/http"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 
+	"github.com/mendersoftware/iot-manager/client"
 	"github.com/mendersoftware/iot-manager/client/iothub"
 	miothub "github.com/mendersoftware/iot-manager/client/iothub/mocks"
 	mworkflows "github.com/mendersoftware/iot-manager/client/workflows/mocks"
 	"github.com/mendersoftware/iot-manager/model"
+	"github.com/mendersoftware/iot-manager/store"
 	storeMocks "github.com/mendersoftware/iot-manager/store/mocks"
 )
 
@@ -79,13 +92,13 @@ func TestGetSettings(t *testing.T) {
 		{
 			Name: "settings exist",
 
-			GetSettingsSettings: model.Settings{
+			GetSettingsSettings: model.Settings{Integrations: []model.Integration{{
 				ConnectionString: &model.ConnectionString{
 					HostName: "localhost",
 					Key:      []byte("secret"),
 					Name:     "foobar",
 				},
-			},
+			}}},
 		},
 		{
 			Name: "settings do not exists",
@@ -122,45 +135,289 @@ func TestGetSettings(t *testing.T) {
 }
 
 func TestSetSettings(t *testing.T) {
-	testCases := []struct {
+	t.Parallel()
+	cs := &model.ConnectionString{
+		HostName: "localhost",
+		Key:      []byte("secret"),
+		Name:     "foobar",
+	}
+	integrationID := uuid.New()
+	notFound := client.HTTPError{Code: http.StatusNotFound}
+	unauthorized := client.HTTPError{Code: http.StatusUnauthorized}
+	probeID := mock.MatchedBy(func(id string) bool {
+		return strings.HasPrefix(id, probeDeviceIDPrefix)
+	})
+	type testCase struct {
 		Name string
 
-		SetSettingsSettings model.Settings
-		SetSettingsError    error
-	}{
-		{
-			Name: "settings saved",
+		Settings   model.Settings
+		SkipVerify bool
 
-			SetSettingsSettings: model.Settings{
-				ConnectionString: &model.ConnectionString{
-					HostName: "localhost",
-					Key:      []byte("secret"),
-					Name:     "foobar",
-				},
-			},
+		Store func(t *testing.T, self *testCase) *storeMocks.DataStore
+		Hub   func(t *testing.T, self *testCase) *miothub.Client
+
+		Error error
+	}
+	testCases := []testCase{{
+		Name: "settings saved",
+
+		Settings: model.Settings{Integrations: []model.Integration{{
+			Name:             "hub",
+			ConnectionString: cs,
+		}}},
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			store := new(storeMocks.DataStore)
+			store.On("GetSettings", contextMatcher).
+				Return(model.Settings{}, nil).
+				On("SetSettings", contextMatcher, mock.AnythingOfType("model.Settings")).
+				Return(nil)
+			return store
 		},
-		{
-			Name: "settings saving error",
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			hub := new(miothub.Client)
+			hub.On("GetDevice", contextMatcher, cs, probeID).
+				Return(nil, notFound).
+				On("DeleteDevice", contextMatcher, cs, probeID).
+				Return(notFound).
+				On("InvokeDeviceMethod", contextMatcher, cs, probeID,
+					&iothub.DirectMethod{Name: probeMethodName}).
+				Return(nil, notFound)
+			return hub
+		},
+	}, {
+		Name: "settings saved, connection string unchanged",
 
-			SetSettingsError: errors.New("error setting the settings"),
+		Settings: model.Settings{Integrations: []model.Integration{{
+			Name:             "hub",
+			ConnectionString: cs,
+		}}},
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			store := new(storeMocks.DataStore)
+			store.On("GetSettings", contextMatcher).
+				Return(self.Settings, nil).
+				On("SetSettings", contextMatcher, mock.AnythingOfType("model.Settings")).
+				Return(nil)
+			return store
 		},
-	}
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			return new(miothub.Client)
+		},
+	}, {
+		Name: "settings saved, verification disabled",
+
+		SkipVerify: true,
+		Settings: model.Settings{Integrations: []model.Integration{{
+			Name:             "hub",
+			ConnectionString: cs,
+		}}},
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			store := new(storeMocks.DataStore)
+			store.On("GetSettings", contextMatcher).
+				Return(model.Settings{}, nil).
+				On("SetSettings", contextMatcher, mock.AnythingOfType("model.Settings")).
+				Return(nil)
+			return store
+		},
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			return new(miothub.Client)
+		},
+	}, {
+		Name: "settings saved, revision matches",
+
+		SkipVerify: true,
+		Settings: model.Settings{
+			Integrations: []model.Integration{{
+				Name:             "hub",
+				ConnectionString: cs,
+			}},
+			Revision: 3,
+		},
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			store := new(storeMocks.DataStore)
+			store.On("GetSettings", contextMatcher).
+				Return(model.Settings{Revision: 3}, nil).
+				On("SetSettings", contextMatcher,
+					mock.MatchedBy(func(settings model.Settings) bool {
+						return settings.Revision == 3
+					})).
+				Return(nil)
+			return store
+		},
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			return new(miothub.Client)
+		},
+	}, {
+		Name: "settings saved, stored secrets kept",
+
+		Settings: model.Settings{Integrations: []model.Integration{{
+			ID:   integrationID,
+			Name: "renamed hub",
+		}}},
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			created := time.Now().Add(-time.Hour)
+			store := new(storeMocks.DataStore)
+			store.On("GetSettings", contextMatcher).
+				Return(model.Settings{Integrations: []model.Integration{{
+					ID:               integrationID,
+					Name:             "hub",
+					ConnectionString: cs,
+					CreatedTS:        &created,
+					UpdatedTS:        &created,
+				}}}, nil).
+				On("SetSettings", contextMatcher,
+					mock.MatchedBy(func(settings model.Settings) bool {
+						integration := settings.Integrations[0]
+						return assert.Equal(t, "renamed hub", integration.Name) &&
+							assert.Equal(t, cs, integration.ConnectionString) &&
+							assert.Equal(t, &created, integration.CreatedTS) &&
+							assert.True(t, integration.UpdatedTS.After(created))
+					})).
+				Return(nil)
+			return store
+		},
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			return new(miothub.Client)
+		},
+	}, {
+		Name: "error/new integration without secrets",
+
+		Settings: model.Settings{Integrations: []model.Integration{{
+			Name: "hub",
+		}}},
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			store := new(storeMocks.DataStore)
+			store.On("GetSettings", contextMatcher).
+				Return(model.Settings{}, nil)
+			return store
+		},
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			return new(miothub.Client)
+		},
+		Error: errors.New(`integrations: \(0: \(connection_string: cannot be blank`),
+	}, {
+		Name: "error/missing permissions",
+
+		Settings: model.Settings{Integrations: []model.Integration{{
+			Name:             "hub",
+			ConnectionString: cs,
+		}}},
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			store := new(storeMocks.DataStore)
+			store.On("GetSettings", contextMatcher).
+				Return(model.Settings{}, nil)
+			return store
+		},
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			hub := new(miothub.Client)
+			hub.On("GetDevice", contextMatcher, cs, probeID).
+				Return(nil, notFound).
+				On("DeleteDevice", contextMatcher, cs, probeID).
+				Return(unauthorized).
+				On("InvokeDeviceMethod", contextMatcher, cs, probeID,
+					&iothub.DirectMethod{Name: probeMethodName}).
+				Return(nil, unauthorized)
+			return hub
+		},
+		Error: errors.New(`integration "hub": connection string is missing ` +
+			`permissions: RegistryWrite, ServiceConnect`),
+	}, {
+		Name: "error/verification failed",
+
+		Settings: model.Settings{Integrations: []model.Integration{{
+			Name:             "hub",
+			ConnectionString: cs,
+		}}},
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			store := new(storeMocks.DataStore)
+			store.On("GetSettings", contextMatcher).
+				Return(model.Settings{}, nil)
+			return store
+		},
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			hub := new(miothub.Client)
+			hub.On("GetDevice", contextMatcher, cs, probeID).
+				Return(nil, errors.New("no such host"))
+			return hub
+		},
+		Error: errors.New(`integration "hub": failed to verify connection ` +
+			`string: no such host`),
+	}, {
+		Name: "error/saving settings",
+
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			store := new(storeMocks.DataStore)
+			store.On("GetSettings", contextMatcher).
+				Return(model.Settings{}, nil).
+				On("SetSettings", contextMatcher, mock.AnythingOfType("model.Settings")).
+				Return(errors.New("error setting the settings"))
+			return store
+		},
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			return new(miothub.Client)
+		},
+		Error: errors.New("error setting the settings"),
+	}, {
+		Name: "error/revision mismatch",
+
+		Settings: model.Settings{
+			Integrations: []model.Integration{{
+				Name:             "hub",
+				ConnectionString: cs,
+			}},
+			Revision: 2,
+		},
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			store := new(storeMocks.DataStore)
+			store.On("GetSettings", contextMatcher).
+				Return(model.Settings{Revision: 3}, nil)
+			return store
+		},
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			return new(miothub.Client)
+		},
+		Error: ErrSettingsModified,
+	}, {
+		Name: "error/modified concurrently",
+
+		SkipVerify: true,
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			ds := new(storeMocks.DataStore)
+			ds.On("GetSettings", contextMatcher).
+				Return(model.Settings{Revision: 3}, nil).
+				On("SetSettings", contextMatcher, mock.AnythingOfType("model.Settings")).
+				Return(store.ErrRevisionConflict)
+			return ds
+		},
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			return new(miothub.Client)
+		},
+		Error: ErrSettingsModified,
+	}}
 	for i := range testCases {
 		tc := testCases[i]
 		t.Run(tc.Name, func(t *testing.T) {
-			store := &storeMocks.DataStore{}
-			store.On("SetSettings",
-				mock.MatchedBy(func(ctx context.Context) bool {
-					return true
-				}),
-				mock.AnythingOfType("model.Settings"),
-			).Return(tc.SetSettingsError)
-			app := New(store, nil, nil)
+			t.Parallel()
+			ds := tc.Store(t, &tc)
+			hub := tc.Hub(t, &tc)
+			defer ds.AssertExpectations(t)
+			defer hub.AssertExpectations(t)
 
-			ctx := context.Background()
-			err := app.SetSettings(ctx, tc.SetSettingsSettings)
-			if tc.SetSettingsError != nil {
-				assert.EqualError(t, err, tc.SetSettingsError.Error())
+			app := New(ds, hub, nil,
+				NewOptions().SetConnectionStringVerification(!tc.SkipVerify),
+			)
+
+			err := app.SetSettings(context.Background(), tc.Settings)
+			if tc.Error != nil {
+				if assert.Error(t, err) {
+					assert.Regexp(t, tc.Error.Error(), err.Error())
+				}
+				var csErr *ConnectionStringError
+				if errors.As(err, &csErr) && len(csErr.MissingPermissions) > 0 {
+					assert.Equal(t, []string{
+						PermissionRegistryWrite,
+						PermissionServiceConnect,
+					}, csErr.MissingPermissions)
+				}
 			} else {
 				assert.NoError(t, err)
 			}
@@ -173,8 +430,9 @@ func TestProvisionDevice(t *testing.T) {
 	type testCase struct {
 		Name string
 
-		ConnStr  *model.ConnectionString
-		DeviceID string
+		ConnStr    *model.ConnectionString
+		DeviceID   string
+		DeviceType string
 
 		Store func(t *testing.T, self *testCase) *storeMocks.DataStore
 		Hub   func(t *testing.T, self *testCase) *miothub.Client
@@ -195,9 +453,17 @@ func TestProvisionDevice(t *testing.T) {
 		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
 			store := new(storeMocks.DataStore)
 			store.On("GetSettings", contextMatcher).
-				Return(model.Settings{
+				Return(model.Settings{Integrations: []model.Integration{{
 					ConnectionString: self.ConnStr,
-				}, nil)
+				}}}, nil).
+				On("UpsertDevice", contextMatcher, self.DeviceID,
+					mock.MatchedBy(func(update model.DeviceUpdate) bool {
+						return *update.State == model.DeviceStateProvisioned &&
+							*update.HubDeviceID == self.DeviceID &&
+							*update.HubHostName == self.ConnStr.HostName &&
+							*update.LastError == ""
+					})).
+				Return(nil)
 			return store
 		},
 		Hub: func(t *testing.T, self *testCase) *miothub.Client {
@@ -235,12 +501,127 @@ func TestProvisionDevice(t *testing.T) {
 			wf.On("ProvisionExternalDevice",
 				contextMatcher,
 				self.DeviceID,
+				model.ProviderIoTHub,
 				map[string]string{
 					confKeyPrimaryKey:   primKey.String(),
 					confKeySecondaryKey: secKey.String(),
 				}).Return(nil)
 			return wf
 		},
+	}, {
+		Name: "ok/edge device",
+
+		ConnStr: &model.ConnectionString{
+			HostName: "localhost",
+			Key:      []byte("super secret"),
+			Name:     "my favorite string",
+		},
+		DeviceID:   "68ac6f41-c2e7-429f-a4bd-852fac9a5045",
+		DeviceType: "edge-gateway",
+
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			store := new(storeMocks.DataStore)
+			store.On("GetSettings", contextMatcher).
+				Return(model.Settings{Integrations: []model.Integration{{
+					ConnectionString: self.ConnStr,
+					ProvisioningRules: []model.ProvisioningRule{{
+						DeviceTypes: []string{"edge-gateway"},
+						IoTEdge:     true,
+					}},
+				}}}, nil).
+				On("UpsertDevice", contextMatcher, self.DeviceID,
+					mock.MatchedBy(func(update model.DeviceUpdate) bool {
+						return *update.State == model.DeviceStateProvisioned &&
+							*update.DeviceType == self.DeviceType
+					})).
+				Return(nil)
+			return store
+		},
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			hub := new(miothub.Client)
+			hub.On("UpsertDevice", contextMatcher, self.ConnStr, self.DeviceID,
+				&iothub.Device{
+					DeviceCapabilities: &iothub.DeviceCapabilities{IOTEdge: true},
+				}).
+				Return(&iothub.Device{
+					DeviceID: self.DeviceID,
+					DeviceCapabilities: &iothub.DeviceCapabilities{
+						IOTEdge: true,
+					},
+					Auth: &iothub.Auth{
+						Type: iothub.AuthTypeSymmetric,
+						SymmetricKey: &iothub.SymmetricKey{
+							Primary:   iothub.Key("key1"),
+							Secondary: iothub.Key("key2"),
+						},
+					},
+				}, nil).
+				On("UpdateDeviceTwin", contextMatcher, self.ConnStr, self.DeviceID,
+					mock.AnythingOfType("*iothub.DeviceTwinUpdate")).
+				Return(nil)
+			return hub
+		},
+		Wf: func(t *testing.T, self *testCase) *mworkflows.Client {
+			wf := new(mworkflows.Client)
+			wf.On("ProvisionExternalDevice",
+				contextMatcher,
+				self.DeviceID,
+				model.ProviderIoTHub,
+				mock.AnythingOfType("map[string]string")).
+				Return(nil)
+			return wf
+		},
+	}, {
+		Name: "error/failed to update device record",
+
+		ConnStr: &model.ConnectionString{
+			HostName: "localhost",
+			Key:      []byte("super secret"),
+			Name:     "my favorite string",
+		},
+		DeviceID: "68ac6f41-c2e7-429f-a4bd-852fac9a5045",
+
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			store := new(storeMocks.DataStore)
+			store.On("GetSettings", contextMatcher).
+				Return(model.Settings{Integrations: []model.Integration{{
+					ConnectionString: self.ConnStr,
+				}}}, nil).
+				On("UpsertDevice", contextMatcher, self.DeviceID,
+					mock.AnythingOfType("model.DeviceUpdate")).
+				Return(errors.New("store failure"))
+			return store
+		},
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			hub := new(miothub.Client)
+			hub.On("UpsertDevice", contextMatcher, self.ConnStr, self.DeviceID).
+				Return(&iothub.Device{
+					DeviceID: self.DeviceID,
+					Auth: &iothub.Auth{
+						Type: iothub.AuthTypeSymmetric,
+						SymmetricKey: &iothub.SymmetricKey{
+							Primary:   iothub.Key("key1"),
+							Secondary: iothub.Key("key2"),
+						},
+					},
+				}, nil).
+				On("UpdateDeviceTwin", contextMatcher, self.ConnStr, self.DeviceID,
+					mock.AnythingOfType("*iothub.DeviceTwinUpdate")).
+				Return(nil)
+			return hub
+		},
+		Wf: func(t *testing.T, self *testCase) *mworkflows.Client {
+			wf := new(mworkflows.Client)
+			wf.On("ProvisionExternalDevice",
+				contextMatcher,
+				self.DeviceID,
+				model.ProviderIoTHub,
+				mock.AnythingOfType("map[string]string")).
+				Return(nil)
+			return wf
+		},
+
+		Error: errors.New("failed to update device record: store failure"),
 	}, {
 		Name: "error/device does not have a connection string",
 
@@ -254,9 +635,16 @@ func TestProvisionDevice(t *testing.T) {
 		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
 			store := new(storeMocks.DataStore)
 			store.On("GetSettings", contextMatcher).
-				Return(model.Settings{
+				Return(model.Settings{Integrations: []model.Integration{{
 					ConnectionString: self.ConnStr,
-				}, nil)
+				}}}, nil).
+				On("UpsertDevice", contextMatcher, self.DeviceID,
+					mock.MatchedBy(func(update model.DeviceUpdate) bool {
+						return *update.State == model.DeviceStateProvisionFailed &&
+							strings.HasSuffix(*update.LastError,
+								ErrNoDeviceConnectionString.Error())
+					})).
+				Return(nil)
 			return store
 		},
 		Hub: func(t *testing.T, self *testCase) *miothub.Client {
@@ -288,9 +676,14 @@ func TestProvisionDevice(t *testing.T) {
 		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
 			store := new(storeMocks.DataStore)
 			store.On("GetSettings", contextMatcher).
-				Return(model.Settings{
+				Return(model.Settings{Integrations: []model.Integration{{
 					ConnectionString: self.ConnStr,
-				}, nil)
+				}}}, nil).
+				On("UpsertDevice", contextMatcher, self.DeviceID,
+					mock.MatchedBy(func(update model.DeviceUpdate) bool {
+						return *update.State == model.DeviceStateProvisionFailed
+					})).
+				Return(errors.New("store failure"))
 			return store
 		},
 		Hub: func(t *testing.T, self *testCase) *miothub.Client {
@@ -305,7 +698,7 @@ func TestProvisionDevice(t *testing.T) {
 
 		Error: errors.New("failed to update iothub devices: internal error"),
 	}, {
-		Name: "error/no connection string",
+		Name: "error/no integrations",
 
 		DeviceID: "68ac6f41-c2e7-429f-a4bd-852fac9a5045",
 
@@ -322,7 +715,7 @@ func TestProvisionDevice(t *testing.T) {
 			return new(mworkflows.Client)
 		},
 
-		Error: ErrNoConnectionString,
+		Error: ErrNoIntegrations,
 	}, {
 		Name: "error/getting settings",
 
@@ -356,7 +749,194 @@ func TestProvisionDevice(t *testing.T) {
 			defer wf.AssertExpectations(t)
 
 			app := New(ds, hub, wf)
-			err := app.ProvisionDevice(ctx, tc.DeviceID)
+			err := app.ProvisionDevice(ctx, tc.DeviceID, tc.DeviceType)
+
+			if tc.Error != nil {
+				if assert.Error(t, err) {
+					assert.Regexp(t, tc.Error.Error(), err.Error())
+				}
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func newTestCA(t *testing.T, isCA bool) *model.CertificateAuthority {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &model.CertificateAuthority{
+		Certificate: string(pem.EncodeToMemory(&pem.Block{
+			Type: "CERTIFICATE", Bytes: der,
+		})),
+		PrivateKey: string(pem.EncodeToMemory(&pem.Block{
+			Type: "PRIVATE KEY", Bytes: keyDER,
+		})),
+	}
+}
+
+func TestProvisionDeviceX509(t *testing.T) {
+	t.Parallel()
+	type testCase struct {
+		Name string
+
+		ConnStr  *model.ConnectionString
+		CA       *model.CertificateAuthority
+		DeviceID string
+
+		Hub func(t *testing.T, self *testCase) *miothub.Client
+		Wf  func(t *testing.T, self *testCase) *mworkflows.Client
+
+		Error error
+	}
+	testCases := []testCase{{
+		Name: "ok",
+
+		ConnStr: &model.ConnectionString{
+			HostName: "localhost",
+			Key:      []byte("super secret"),
+			Name:     "my favorite string",
+		},
+		CA:       newTestCA(t, true),
+		DeviceID: "68ac6f41-c2e7-429f-a4bd-852fac9a5045",
+
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			hub := new(miothub.Client)
+			hub.On("UpsertDevice", contextMatcher, self.ConnStr, self.DeviceID,
+				mock.MatchedBy(func(dev *iothub.Device) bool {
+					return dev.Auth != nil &&
+						dev.Auth.Type == iothub.AuthTypeSelfSigned &&
+						dev.Auth.X509ThumbPrint != nil &&
+						len(dev.Auth.X509ThumbPrint.Primary) == 64
+				})).
+				Return(&iothub.Device{
+					DeviceID: self.DeviceID,
+					Status:   iothub.StatusEnabled,
+				}, nil).
+				On("UpdateDeviceTwin", contextMatcher, self.ConnStr, self.DeviceID,
+					&iothub.DeviceTwinUpdate{
+						Tags: map[string]interface{}{"mender": true},
+					}).
+				Return(nil)
+			return hub
+		},
+		Wf: func(t *testing.T, self *testCase) *mworkflows.Client {
+			wf := new(mworkflows.Client)
+			block, _ := pem.Decode([]byte(self.CA.Certificate))
+			caCert, _ := x509.ParseCertificate(block.Bytes)
+			roots := x509.NewCertPool()
+			roots.AddCert(caCert)
+			wf.On("ProvisionExternalDevice",
+				contextMatcher,
+				self.DeviceID,
+				model.ProviderIoTHub,
+				mock.MatchedBy(func(config map[string]string) bool {
+					expectedCS := "HostName=localhost;DeviceId=" +
+						self.DeviceID + ";x509=true"
+					if !assert.Equal(t, expectedCS, config[confKeyConnectionString]) {
+						return false
+					}
+					block, _ := pem.Decode([]byte(config[confKeyCertificate]))
+					if !assert.NotNil(t, block) {
+						return false
+					}
+					cert, err := x509.ParseCertificate(block.Bytes)
+					if !assert.NoError(t, err) {
+						return false
+					}
+					_, err = cert.Verify(x509.VerifyOptions{
+						Roots: roots,
+						KeyUsages: []x509.ExtKeyUsage{
+							x509.ExtKeyUsageClientAuth,
+						},
+					})
+					return assert.NoError(t, err) &&
+						assert.Equal(t, self.DeviceID, cert.Subject.CommonName) &&
+						assert.Contains(t, config[confKeyPrivateKey], "PRIVATE KEY")
+				})).Return(nil)
+			return wf
+		},
+	}, {
+		Name: "error/invalid certificate authority",
+
+		ConnStr: &model.ConnectionString{
+			HostName: "localhost",
+			Key:      []byte("super secret"),
+			Name:     "my favorite string",
+		},
+		CA:       newTestCA(t, false),
+		DeviceID: "68ac6f41-c2e7-429f-a4bd-852fac9a5045",
+
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			return new(miothub.Client)
+		},
+		Wf: func(t *testing.T, self *testCase) *mworkflows.Client {
+			return new(mworkflows.Client)
+		},
+
+		Error: errors.New("failed to issue device certificate: " +
+			model.ErrCANotCA.Error()),
+	}, {
+		Name: "error/no certificate authority",
+
+		ConnStr: &model.ConnectionString{
+			HostName: "localhost",
+			Key:      []byte("super secret"),
+			Name:     "my favorite string",
+		},
+		DeviceID: "68ac6f41-c2e7-429f-a4bd-852fac9a5045",
+
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			return new(miothub.Client)
+		},
+		Wf: func(t *testing.T, self *testCase) *mworkflows.Client {
+			return new(mworkflows.Client)
+		},
+
+		Error: ErrNoCertificateAuthority,
+	}}
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			ctx := context.Background()
+			ds := new(storeMocks.DataStore)
+			ds.On("GetSettings", contextMatcher).
+				Return(model.Settings{Integrations: []model.Integration{{
+					ConnectionString:     tc.ConnStr,
+					DeviceAuth:           model.DeviceAuthX509,
+					CertificateAuthority: tc.CA,
+				}}}, nil).
+				On("UpsertDevice", contextMatcher, tc.DeviceID,
+					mock.AnythingOfType("model.DeviceUpdate")).
+				Return(nil)
+			hub := tc.Hub(t, &tc)
+			wf := tc.Wf(t, &tc)
+			defer ds.AssertExpectations(t)
+			defer hub.AssertExpectations(t)
+			defer wf.AssertExpectations(t)
+
+			app := New(ds, hub, wf)
+			err := app.ProvisionDevice(ctx, tc.DeviceID, "")
 
 			if tc.Error != nil {
 				if assert.Error(t, err) {
@@ -395,9 +975,11 @@ func TestDecommissionDevice(t *testing.T) {
 		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
 			store := new(storeMocks.DataStore)
 			store.On("GetSettings", contextMatcher).
-				Return(model.Settings{
+				Return(model.Settings{Integrations: []model.Integration{{
 					ConnectionString: self.ConnStr,
-				}, nil)
+				}}}, nil).
+				On("DeleteDevice", contextMatcher, self.DeviceID).
+				Return(nil)
 			return store
 		},
 		Hub: func(t *testing.T, self *testCase) *miothub.Client {
@@ -419,9 +1001,16 @@ func TestDecommissionDevice(t *testing.T) {
 		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
 			store := new(storeMocks.DataStore)
 			store.On("GetSettings", contextMatcher).
-				Return(model.Settings{
+				Return(model.Settings{Integrations: []model.Integration{{
 					ConnectionString: self.ConnStr,
-				}, nil)
+				}}}, nil).
+				On("UpsertDevice", contextMatcher, self.DeviceID,
+					mock.MatchedBy(func(update model.DeviceUpdate) bool {
+						return *update.State == model.DeviceStateDecommissionFailed &&
+							strings.HasSuffix(*update.LastError,
+								"failed to delete IoT Hub device: internal error")
+					})).
+				Return(nil)
 			return store
 		},
 		Hub: func(t *testing.T, self *testCase) *miothub.Client {
@@ -433,7 +1022,7 @@ func TestDecommissionDevice(t *testing.T) {
 
 		Error: errors.New("failed to delete IoT Hub device: internal error"),
 	}, {
-		Name: "error/no connection string",
+		Name: "error/no integrations",
 
 		DeviceID: "68ac6f41-c2e7-429f-a4bd-852fac9a5045",
 
@@ -447,7 +1036,7 @@ func TestDecommissionDevice(t *testing.T) {
 			return new(miothub.Client)
 		},
 
-		Error: ErrNoConnectionString,
+		Error: ErrNoIntegrations,
 	}, {
 		Name: "error/getting settings",
 
@@ -517,9 +1106,14 @@ func TestSetDeviceStatus(t *testing.T) {
 		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
 			store := new(storeMocks.DataStore)
 			store.On("GetSettings", contextMatcher).
-				Return(model.Settings{
+				Return(model.Settings{Integrations: []model.Integration{{
 					ConnectionString: self.ConnStr,
-				}, nil)
+				}}}, nil).
+				On("UpsertDevice", contextMatcher, self.DeviceID,
+					mock.MatchedBy(func(update model.DeviceUpdate) bool {
+						return *update.Status == string(self.Status)
+					})).
+				Return(nil)
 			return store
 		},
 		Hub: func(t *testing.T, self *testCase) *miothub.Client {
@@ -551,9 +1145,14 @@ func TestSetDeviceStatus(t *testing.T) {
 		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
 			store := new(storeMocks.DataStore)
 			store.On("GetSettings", contextMatcher).
-				Return(model.Settings{
+				Return(model.Settings{Integrations: []model.Integration{{
 					ConnectionString: self.ConnStr,
-				}, nil)
+				}}}, nil).
+				On("UpsertDevice", contextMatcher, self.DeviceID,
+					mock.MatchedBy(func(update model.DeviceUpdate) bool {
+						return *update.Status == string(self.Status)
+					})).
+				Return(nil)
 			return store
 		},
 		Hub: func(t *testing.T, self *testCase) *miothub.Client {
@@ -580,9 +1179,9 @@ func TestSetDeviceStatus(t *testing.T) {
 		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
 			store := new(storeMocks.DataStore)
 			store.On("GetSettings", contextMatcher).
-				Return(model.Settings{
+				Return(model.Settings{Integrations: []model.Integration{{
 					ConnectionString: self.ConnStr,
-				}, nil)
+				}}}, nil)
 			return store
 		},
 		Hub: func(t *testing.T, self *testCase) *miothub.Client {
@@ -616,9 +1215,9 @@ func TestSetDeviceStatus(t *testing.T) {
 		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
 			store := new(storeMocks.DataStore)
 			store.On("GetSettings", contextMatcher).
-				Return(model.Settings{
+				Return(model.Settings{Integrations: []model.Integration{{
 					ConnectionString: self.ConnStr,
-				}, nil)
+				}}}, nil)
 			return store
 		},
 		Hub: func(t *testing.T, self *testCase) *miothub.Client {
@@ -630,7 +1229,7 @@ func TestSetDeviceStatus(t *testing.T) {
 
 		Error: errors.New("failed to retrieve device from IoT Hub: internal error"),
 	}, {
-		Name: "error/no connection string",
+		Name: "error/no integrations",
 
 		DeviceID: "68ac6f41-c2e7-429f-a4bd-852fac9a5045",
 
@@ -645,7 +1244,7 @@ func TestSetDeviceStatus(t *testing.T) {
 			return new(miothub.Client)
 		},
 
-		Error: ErrNoConnectionString,
+		Error: ErrNoIntegrations,
 	}, {
 		Name: "error/getting settings",
 
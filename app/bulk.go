@@ -0,0 +1,608 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+
+	"github.com/google/uuid"
+
+	"github.com/mendersoftware/go-lib-micro/log"
+
+	"github.com/mendersoftware/iot-manager/client"
+	"github.com/mendersoftware/iot-manager/client/iothub"
+	"github.com/mendersoftware/iot-manager/model"
+
+	"github.com/pkg/errors"
+)
+
+// integrationBatch lists the devices, by index, included in an integration.
+type integrationBatch struct {
+	integration model.Integration
+	devices     []int
+}
+
+func (b *integrationBatch) deviceIDs(deviceIDs []string) []string {
+	ids := make([]string, len(b.devices))
+	for j, i := range b.devices {
+		ids[j] = deviceIDs[i]
+	}
+	return ids
+}
+
+// batchDeviceIntegrations groups the devices by the configured integrations
+// that include them. For devices without any such integration, the reason
+// is set in errs.
+func (a *app) batchDeviceIntegrations(
+	settings model.Settings,
+	deviceIDs []string,
+	errs []error,
+) []*integrationBatch {
+	var (
+		batches    []*integrationBatch
+		batchIndex = make(map[uuid.UUID]*integrationBatch)
+	)
+	for i, deviceID := range deviceIDs {
+		integrations, err := a.settingsDeviceIntegrations(settings, deviceID)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		for _, integration := range integrations {
+			b, ok := batchIndex[integration.ID]
+			if !ok {
+				b = &integrationBatch{integration: integration}
+				batchIndex[integration.ID] = b
+				batches = append(batches, b)
+			}
+			b.devices = append(b.devices, i)
+		}
+	}
+	return batches
+}
+
+// isBulkIntegration returns true if the devices of the integration are
+// managed with the IoT Hub bulk registry API.
+func isBulkIntegration(integration model.Integration) bool {
+	return integration.Provider != model.ProviderIoTCore &&
+		integration.ProvisioningMode != model.ProvisioningModeDPS
+}
+
+// forEachBulkBatch calls fn with the bounds of consecutive batches of at
+// most iothub.MaxBulkDevices out of n items.
+func forEachBulkBatch(n int, fn func(start, end int)) {
+	for start := 0; start < n; start += iothub.MaxBulkDevices {
+		end := start + iothub.MaxBulkDevices
+		if end > n {
+			end = n
+		}
+		fn(start, end)
+	}
+}
+
+const (
+	defaultBulkConcurrency = 10
+)
+
+// runConcurrently calls fn for every index in [0, n) with at most workers
+// calls running at the same time.
+func runConcurrently(n, workers int, fn func(i int)) {
+	if workers > n {
+		workers = n
+	}
+	var (
+		wg      sync.WaitGroup
+		indices = make(chan int)
+	)
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				fn(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		indices <- i
+	}
+	close(indices)
+	wg.Wait()
+}
+
+// deviceProvisioning collects the outcome of provisioning a device to its
+// integrations.
+type deviceProvisioning struct {
+	update model.DeviceUpdate
+	errs   IntegrationErrors
+}
+
+func (p *deviceProvisioning) record(
+	integration model.Integration,
+	hostName, status string,
+	err error,
+) {
+	if hostName != "" && p.update.HubHostName == nil {
+		p.update.HubHostName = &hostName
+	}
+	if status != "" && p.update.Status == nil {
+		p.update.Status = &status
+	}
+	if err != nil {
+		p.errs = append(p.errs, &IntegrationError{
+			IntegrationID: integration.ID,
+			Err:           err,
+		})
+	}
+}
+
+// ProvisionDevices provisions the devices to every integration that includes
+// them. The settings are retrieved once, the devices are created in IoT Hub
+// with the bulk registry API and the device records are updated with a
+// single write. The returned errors are aligned with deviceIDs.
+func (a *app) ProvisionDevices(
+	ctx context.Context,
+	deviceIDs []string,
+) ([]error, error) {
+	settings, err := a.GetSettings(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to retrieve settings")
+	}
+	var (
+		errs          = make([]error, len(deviceIDs))
+		provisionings = make([]*deviceProvisioning, len(deviceIDs))
+		batches       = a.batchDeviceIntegrations(settings, deviceIDs, errs)
+	)
+	for i := range deviceIDs {
+		if errs[i] == nil {
+			provisionings[i] = &deviceProvisioning{
+				update: model.DeviceUpdate{
+					HubDeviceID: &deviceIDs[i],
+				},
+			}
+		}
+	}
+
+	for _, b := range batches {
+		integration := b.integration
+		if !isBulkIntegration(integration) {
+			for _, i := range b.devices {
+				// The device types are not known when provisioning
+				// in bulk, only the device ID rules apply.
+				hostName, status, err := a.provisionIntegrationDevice(
+					ctx, integration, deviceIDs[i], "",
+				)
+				provisionings[i].record(integration, hostName, status, err)
+			}
+			continue
+		}
+		hubErrs := a.provisionIoTHubDevices(ctx, integration, b.deviceIDs(deviceIDs))
+		for j, i := range b.devices {
+			var status string
+			if hubErrs[j] == nil {
+				status = string(iothub.StatusEnabled)
+			}
+			provisionings[i].record(integration,
+				integration.ConnectionString.HostName, status, hubErrs[j],
+			)
+		}
+	}
+
+	updates := make(map[string]model.DeviceUpdate, len(deviceIDs))
+	for i, p := range provisionings {
+		if p == nil {
+			continue
+		}
+		var (
+			state     = model.DeviceStateProvisioned
+			lastError string
+		)
+		if errs[i] = p.errs.err(); errs[i] != nil {
+			state = model.DeviceStateProvisionFailed
+			lastError = errs[i].Error()
+		}
+		p.update.State = &state
+		p.update.LastError = &lastError
+		updates[deviceIDs[i]] = p.update
+	}
+	if len(updates) == 0 {
+		return errs, nil
+	}
+	errStore := a.store.UpsertDevices(ctx, updates)
+	if errStore != nil {
+		errStore = errors.Wrap(errStore, "failed to update device records")
+		var failures bool
+		for i, p := range provisionings {
+			switch {
+			case p == nil:
+			case errs[i] != nil:
+				failures = true
+			default:
+				errs[i] = errStore
+			}
+		}
+		if failures {
+			log.FromContext(ctx).
+				Errorf("failed to record provisioning failures: %s", errStore)
+		}
+	}
+	return errs, nil
+}
+
+const (
+	// jobParamDeviceIDs is the JSON list of device IDs of a
+	// provision_devices job.
+	jobParamDeviceIDs = "device_ids"
+)
+
+// ScheduleDeviceProvisioning starts a background job provisioning the
+// devices as ProvisionDevices does, for batches too large for a request.
+func (a *app) ScheduleDeviceProvisioning(
+	ctx context.Context,
+	deviceIDs []string,
+) (*model.Job, error) {
+	b, err := json.Marshal(deviceIDs)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to serialize device IDs")
+	}
+	return a.startJob(ctx, model.JobTypeProvisionDevices, map[string]string{
+		jobParamDeviceIDs: string(b),
+	})
+}
+
+func (a *app) provisionDevicesJob(
+	ctx context.Context,
+	job *model.Job,
+	tracker *jobTracker,
+) error {
+	var deviceIDs []string
+	err := json.Unmarshal([]byte(job.Params[jobParamDeviceIDs]), &deviceIDs)
+	if err != nil {
+		return errors.Wrap(err, "invalid job parameter "+jobParamDeviceIDs)
+	}
+	forEachBulkBatch(len(deviceIDs), func(start, end int) {
+		if err != nil || ctx.Err() != nil {
+			return
+		}
+		var errs []error
+		errs, err = a.ProvisionDevices(ctx, deviceIDs[start:end])
+		if err != nil {
+			return
+		}
+		for i, errDevice := range errs {
+			switch errors.Cause(errDevice) {
+			case ErrNoIntegrations, ErrNoConnectionString, ErrNoCredentials:
+				errDevice = nil
+			}
+			tracker.itemDone(ctx, deviceIDs[start+i], errDevice)
+		}
+	})
+	if ctx.Err() != nil {
+		return ctx.Err()
+	} else if err != nil {
+		return err
+	}
+	if failed := tracker.progress.Failed; failed > 0 {
+		return errors.Errorf("failed to provision %d devices", failed)
+	}
+	return nil
+}
+
+// provisionIoTHubDevices creates the devices in IoT Hub with the bulk
+// registry API, iothub.MaxBulkDevices at a time, and pushes the credentials
+// of the created devices to the device configuration. The returned errors
+// are aligned with deviceIDs.
+func (a *app) provisionIoTHubDevices(
+	ctx context.Context,
+	integration model.Integration,
+	deviceIDs []string,
+) []error {
+	errs := make([]error, len(deviceIDs))
+	forEachBulkBatch(len(deviceIDs), func(start, end int) {
+		a.provisionIoTHubDeviceBatch(ctx, integration,
+			deviceIDs[start:end], errs[start:end],
+		)
+	})
+	return errs
+}
+
+func (a *app) provisionIoTHubDeviceBatch(
+	ctx context.Context,
+	integration model.Integration,
+	deviceIDs []string,
+	errs []error,
+) {
+	var (
+		cs          = integration.ConnectionString
+		ops         = make([]*iothub.BulkDevice, 0, len(deviceIDs))
+		opDevices   = make([]int, 0, len(deviceIDs))
+		deviceCerts = make([]*model.DeviceCertificate, len(deviceIDs))
+	)
+	for i, deviceID := range deviceIDs {
+		op := &iothub.BulkDevice{
+			DeviceID:   deviceID,
+			ImportMode: iothub.ImportModeCreate,
+			Status:     iothub.StatusEnabled,
+			Tags: map[string]interface{}{
+				tagMender: true,
+			},
+		}
+		if integration.IsEdgeDevice(deviceID, "") {
+			op.DeviceCapabilities = &iothub.DeviceCapabilities{IOTEdge: true}
+		}
+		var err error
+		if integration.DeviceAuth == model.DeviceAuthX509 {
+			deviceCerts[i], op.Auth, err = issueIoTHubDeviceCertificate(
+				integration, deviceID,
+			)
+		} else {
+			op.Auth, err = iothub.NewSymmetricAuth()
+			err = errors.Wrap(err, "failed to generate device keys")
+		}
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		ops = append(ops, op)
+		opDevices = append(opDevices, i)
+	}
+	if len(ops) == 0 {
+		return
+	}
+
+	res, err := a.hub.BulkDevices(ctx, cs, ops)
+	if err != nil {
+		if htErr, ok := errors.Cause(err).(client.HTTPError); ok &&
+			htErr.Code == http.StatusUnauthorized {
+			err = ErrNoConnectionString
+		} else {
+			err = errors.Wrap(err, "failed to create iothub devices")
+		}
+		for _, i := range opDevices {
+			errs[i] = err
+		}
+		return
+	}
+	failed := make(map[string]error, len(res.Errors))
+	for _, bulkErr := range res.Errors {
+		if bulkErr.ErrorCode == iothub.ErrorCodeDeviceAlreadyExists {
+			failed[bulkErr.DeviceID] = ErrDeviceAlreadyExists
+		} else {
+			failed[bulkErr.DeviceID] = errors.Wrap(bulkErr,
+				"failed to create iothub device",
+			)
+		}
+	}
+	for j, op := range ops {
+		i := opDevices[j]
+		if err, ok := failed[op.DeviceID]; ok {
+			errs[i] = err
+			continue
+		}
+		errs[i] = a.submitIoTHubDeviceConfig(ctx, cs, &iothub.Device{
+			Auth:     op.Auth,
+			DeviceID: op.DeviceID,
+			Status:   op.Status,
+		}, deviceCerts[i])
+	}
+}
+
+// DecommissionDevices removes the devices from every integration that
+// includes them. The devices are deleted from IoT Hub with the bulk registry
+// API regardless of their ETag, devices that do not exist in the hub are
+// considered deleted. The returned errors are aligned with deviceIDs.
+func (a *app) DecommissionDevices(
+	ctx context.Context,
+	deviceIDs []string,
+) ([]error, error) {
+	settings, err := a.GetSettings(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to retrieve settings")
+	}
+	var (
+		errs            = make([]error, len(deviceIDs))
+		batches         = a.batchDeviceIntegrations(settings, deviceIDs, errs)
+		integrationErrs = make([]IntegrationErrors, len(deviceIDs))
+	)
+	for _, b := range batches {
+		integration := b.integration
+		var batchErrs []error
+		if isBulkIntegration(integration) {
+			batchErrs = a.deleteIoTHubDevices(ctx, integration, b.deviceIDs(deviceIDs))
+		} else {
+			batchErrs = make([]error, len(b.devices))
+			for j, i := range b.devices {
+				err := a.deleteIntegrationDevice(ctx, integration, deviceIDs[i])
+				if htErr, ok := errors.Cause(err).(client.HTTPError); ok &&
+					htErr.Code == http.StatusNotFound {
+					err = nil
+				}
+				batchErrs[j] = err
+			}
+		}
+		for j, i := range b.devices {
+			if batchErrs[j] != nil {
+				integrationErrs[i] = append(integrationErrs[i], &IntegrationError{
+					IntegrationID: integration.ID,
+					Err:           batchErrs[j],
+				})
+			}
+		}
+	}
+
+	var (
+		deleted  []int
+		failures = make(map[string]model.DeviceUpdate)
+	)
+	for i, deviceID := range deviceIDs {
+		if errs[i] != nil {
+			continue
+		}
+		if errs[i] = integrationErrs[i].err(); errs[i] != nil {
+			state := model.DeviceStateDecommissionFailed
+			lastError := errs[i].Error()
+			failures[deviceID] = model.DeviceUpdate{
+				State:     &state,
+				LastError: &lastError,
+			}
+			continue
+		}
+		deleted = append(deleted, i)
+	}
+	if len(failures) > 0 {
+		errStore := a.store.UpsertDevices(ctx, failures)
+		if errStore != nil {
+			log.FromContext(ctx).
+				Errorf("failed to record decommissioning failures: %s", errStore)
+		}
+	}
+	if len(deleted) > 0 {
+		ids := make([]string, len(deleted))
+		for j, i := range deleted {
+			ids[j] = deviceIDs[i]
+		}
+		errStore := a.store.DeleteDevices(ctx, ids)
+		if errStore != nil {
+			errStore = errors.Wrap(errStore, "failed to delete device records")
+			for _, i := range deleted {
+				errs[i] = errStore
+			}
+		}
+	}
+	return errs, nil
+}
+
+// deleteIoTHubDevices deletes the devices from IoT Hub with the bulk
+// registry API, iothub.MaxBulkDevices at a time. The returned errors are
+// aligned with deviceIDs.
+func (a *app) deleteIoTHubDevices(
+	ctx context.Context,
+	integration model.Integration,
+	deviceIDs []string,
+) []error {
+	var (
+		cs   = integration.ConnectionString
+		errs = make([]error, len(deviceIDs))
+	)
+	forEachBulkBatch(len(deviceIDs), func(start, end int) {
+		ops := make([]*iothub.BulkDevice, 0, end-start)
+		for _, deviceID := range deviceIDs[start:end] {
+			ops = append(ops, &iothub.BulkDevice{
+				DeviceID:   deviceID,
+				ETag:       "*",
+				ImportMode: iothub.ImportModeDeleteIfMatchETag,
+			})
+		}
+		res, err := a.hub.BulkDevices(ctx, cs, ops)
+		if err != nil {
+			err = errors.Wrap(err, "failed to delete IoT Hub devices")
+			for i := start; i < end; i++ {
+				errs[i] = err
+			}
+			return
+		}
+		failed := make(map[string]error, len(res.Errors))
+		for _, bulkErr := range res.Errors {
+			if bulkErr.ErrorCode != iothub.ErrorCodeDeviceNotFound {
+				failed[bulkErr.DeviceID] = errors.Wrap(bulkErr,
+					"failed to delete IoT Hub device",
+				)
+			}
+		}
+		for i := start; i < end; i++ {
+			errs[i] = failed[deviceIDs[i]]
+		}
+	})
+	return errs
+}
+
+// SetDevicesStatus updates the status of the devices in every integration
+// that includes them. The settings are retrieved once, the devices are
+// updated concurrently and the device records are updated with a single
+// write. The returned errors are aligned with deviceIDs.
+func (a *app) SetDevicesStatus(
+	ctx context.Context,
+	deviceIDs []string,
+	status Status,
+) ([]error, error) {
+	settings, err := a.GetSettings(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to retrieve settings")
+	}
+	type task struct {
+		integration model.Integration
+		device      int
+		err         error
+	}
+	var (
+		errs    = make([]error, len(deviceIDs))
+		batches = a.batchDeviceIntegrations(settings, deviceIDs, errs)
+		tasks   []task
+	)
+	for _, b := range batches {
+		for _, i := range b.devices {
+			tasks = append(tasks, task{integration: b.integration, device: i})
+		}
+	}
+	runConcurrently(len(tasks), a.bulkConcurrency, func(k int) {
+		t := &tasks[k]
+		deviceID := deviceIDs[t.device]
+		if t.integration.Provider == model.ProviderIoTCore {
+			t.err = a.setIoTCoreDeviceStatus(ctx, t.integration, deviceID, status)
+		} else {
+			t.err = a.setIoTHubDeviceStatus(ctx, t.integration, deviceID, status)
+		}
+	})
+
+	integrationErrs := make([]IntegrationErrors, len(deviceIDs))
+	for _, t := range tasks {
+		if t.err != nil {
+			integrationErrs[t.device] = append(integrationErrs[t.device],
+				&IntegrationError{
+					IntegrationID: t.integration.ID,
+					Err:           t.err,
+				})
+		}
+	}
+	var (
+		statusStr = string(status)
+		updated   []int
+		updates   = make(map[string]model.DeviceUpdate)
+	)
+	for i, deviceID := range deviceIDs {
+		if errs[i] != nil {
+			continue
+		}
+		if errs[i] = integrationErrs[i].err(); errs[i] == nil {
+			updated = append(updated, i)
+			updates[deviceID] = model.DeviceUpdate{
+				Status: &statusStr,
+			}
+		}
+	}
+	if len(updates) > 0 {
+		errStore := a.store.UpsertDevices(ctx, updates)
+		if errStore != nil {
+			errStore = errors.Wrap(errStore, "failed to update device records")
+			for _, i := range updated {
+				errs[i] = errStore
+			}
+		}
+	}
+	return errs, nil
+}
@@ -0,0 +1,1004 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/mendersoftware/go-lib-micro/identity"
+
+	"github.com/mendersoftware/iot-manager/client"
+	"github.com/mendersoftware/iot-manager/client/iothub"
+	miothub "github.com/mendersoftware/iot-manager/client/iothub/mocks"
+	mworkflows "github.com/mendersoftware/iot-manager/client/workflows/mocks"
+	"github.com/mendersoftware/iot-manager/model"
+	storeMocks "github.com/mendersoftware/iot-manager/store/mocks"
+)
+
+func TestProvisionDevices(t *testing.T) {
+	t.Parallel()
+	cs := &model.ConnectionString{
+		HostName: "localhost",
+		Key:      []byte("super secret"),
+		Name:     "my favorite string",
+	}
+	deviceIDs := []string{
+		"68ac6f41-c2e7-429f-a4bd-852fac9a5045",
+		"b2ef1bc4-3f52-4d7e-9d47-6b3a7a2d0f1e",
+	}
+	manyDeviceIDs := make([]string, iothub.MaxBulkDevices+20)
+	for i := range manyDeviceIDs {
+		manyDeviceIDs[i] = fmt.Sprintf("device-%d", i)
+	}
+	settings := model.Settings{Integrations: []model.Integration{{
+		ID:               uuid.New(),
+		ConnectionString: cs,
+	}}}
+	bulkMatcher := func(deviceIDs ...string) interface{} {
+		return mock.MatchedBy(func(ops []*iothub.BulkDevice) bool {
+			if len(ops) != len(deviceIDs) {
+				return false
+			}
+			for i, op := range ops {
+				if op.DeviceID != deviceIDs[i] ||
+					op.ImportMode != iothub.ImportModeCreate ||
+					op.Auth == nil || op.Auth.SymmetricKey == nil ||
+					op.Tags[tagMender] != true {
+					return false
+				}
+			}
+			return true
+		})
+	}
+	updatesMatcher := func(states map[string]model.DeviceState) interface{} {
+		return mock.MatchedBy(func(updates map[string]model.DeviceUpdate) bool {
+			if len(updates) != len(states) {
+				return false
+			}
+			for id, state := range states {
+				update, ok := updates[id]
+				if !ok || *update.State != state ||
+					*update.HubDeviceID != id {
+					return false
+				}
+				if state == model.DeviceStateProvisioned &&
+					(*update.HubHostName != cs.HostName ||
+						*update.Status != string(iothub.StatusEnabled)) {
+					return false
+				}
+			}
+			return true
+		})
+	}
+	type testCase struct {
+		Name string
+
+		DeviceIDs []string
+
+		Store func(t *testing.T, self *testCase) *storeMocks.DataStore
+		Hub   func(t *testing.T, self *testCase) *miothub.Client
+		Wf    func(t *testing.T, self *testCase) *mworkflows.Client
+
+		Errors []error
+		Error  error
+	}
+	testCases := []testCase{{
+		Name: "ok",
+
+		DeviceIDs: deviceIDs,
+
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			ds := new(storeMocks.DataStore)
+			ds.On("GetSettings", contextMatcher).
+				Return(settings, nil).
+				On("UpsertDevices", contextMatcher,
+					updatesMatcher(map[string]model.DeviceState{
+						deviceIDs[0]: model.DeviceStateProvisioned,
+						deviceIDs[1]: model.DeviceStateProvisioned,
+					})).
+				Return(nil)
+			return ds
+		},
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			hub := new(miothub.Client)
+			hub.On("BulkDevices", contextMatcher, cs, bulkMatcher(deviceIDs...)).
+				Return(&iothub.BulkResult{IsSuccessful: true}, nil)
+			return hub
+		},
+		Wf: func(t *testing.T, self *testCase) *mworkflows.Client {
+			wf := new(mworkflows.Client)
+			for _, id := range deviceIDs {
+				wf.On("ProvisionExternalDevice",
+					contextMatcher,
+					id,
+					model.ProviderIoTHub,
+					mock.MatchedBy(func(config map[string]string) bool {
+						_, ok := config[confKeyPrimaryKey]
+						return ok
+					})).Return(nil).Once()
+			}
+			return wf
+		},
+
+		Errors: []error{nil, nil},
+	}, {
+		Name: "ok, multiple batches",
+
+		DeviceIDs: manyDeviceIDs,
+
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			states := make(map[string]model.DeviceState, len(manyDeviceIDs))
+			for _, id := range manyDeviceIDs {
+				states[id] = model.DeviceStateProvisioned
+			}
+			ds := new(storeMocks.DataStore)
+			ds.On("GetSettings", contextMatcher).
+				Return(settings, nil).
+				On("UpsertDevices", contextMatcher, updatesMatcher(states)).
+				Return(nil)
+			return ds
+		},
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			hub := new(miothub.Client)
+			hub.On("BulkDevices", contextMatcher, cs,
+				bulkMatcher(manyDeviceIDs[:iothub.MaxBulkDevices]...)).
+				Return(&iothub.BulkResult{IsSuccessful: true}, nil).
+				Once().
+				On("BulkDevices", contextMatcher, cs,
+					bulkMatcher(manyDeviceIDs[iothub.MaxBulkDevices:]...)).
+				Return(&iothub.BulkResult{IsSuccessful: true}, nil).
+				Once()
+			return hub
+		},
+		Wf: func(t *testing.T, self *testCase) *mworkflows.Client {
+			wf := new(mworkflows.Client)
+			wf.On("ProvisionExternalDevice",
+				contextMatcher,
+				mock.AnythingOfType("string"),
+				model.ProviderIoTHub,
+				mock.AnythingOfType("map[string]string")).
+				Return(nil).
+				Times(len(manyDeviceIDs))
+			return wf
+		},
+
+		Errors: make([]error, len(manyDeviceIDs)),
+	}, {
+		Name: "ok, partial failure",
+
+		DeviceIDs: deviceIDs,
+
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			ds := new(storeMocks.DataStore)
+			ds.On("GetSettings", contextMatcher).
+				Return(settings, nil).
+				On("UpsertDevices", contextMatcher,
+					updatesMatcher(map[string]model.DeviceState{
+						deviceIDs[0]: model.DeviceStateProvisioned,
+						deviceIDs[1]: model.DeviceStateProvisionFailed,
+					})).
+				Return(nil)
+			return ds
+		},
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			hub := new(miothub.Client)
+			hub.On("BulkDevices", contextMatcher, cs, bulkMatcher(deviceIDs...)).
+				Return(&iothub.BulkResult{Errors: []iothub.BulkError{{
+					DeviceID:    deviceIDs[1],
+					ErrorCode:   iothub.ErrorCodeDeviceAlreadyExists,
+					ErrorStatus: "A device with the same id already exists",
+				}}}, nil)
+			return hub
+		},
+		Wf: func(t *testing.T, self *testCase) *mworkflows.Client {
+			wf := new(mworkflows.Client)
+			wf.On("ProvisionExternalDevice",
+				contextMatcher,
+				deviceIDs[0],
+				model.ProviderIoTHub,
+				mock.AnythingOfType("map[string]string")).
+				Return(nil).
+				Once()
+			return wf
+		},
+
+		Errors: []error{nil, ErrDeviceAlreadyExists},
+	}, {
+		Name: "ok, device out of scope",
+
+		DeviceIDs: deviceIDs,
+
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			ds := new(storeMocks.DataStore)
+			ds.On("GetSettings", contextMatcher).
+				Return(model.Settings{Integrations: []model.Integration{{
+					ID:               uuid.New(),
+					ConnectionString: cs,
+					Scope: &model.DeviceScope{
+						DeviceIDs: deviceIDs[:1],
+					},
+				}}}, nil).
+				On("UpsertDevices", contextMatcher,
+					updatesMatcher(map[string]model.DeviceState{
+						deviceIDs[0]: model.DeviceStateProvisioned,
+					})).
+				Return(nil)
+			return ds
+		},
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			hub := new(miothub.Client)
+			hub.On("BulkDevices", contextMatcher, cs, bulkMatcher(deviceIDs[0])).
+				Return(&iothub.BulkResult{IsSuccessful: true}, nil)
+			return hub
+		},
+		Wf: func(t *testing.T, self *testCase) *mworkflows.Client {
+			wf := new(mworkflows.Client)
+			wf.On("ProvisionExternalDevice",
+				contextMatcher,
+				deviceIDs[0],
+				model.ProviderIoTHub,
+				mock.AnythingOfType("map[string]string")).
+				Return(nil)
+			return wf
+		},
+
+		Errors: []error{nil, ErrNoIntegrations},
+	}, {
+		Name: "error/hub unauthorized",
+
+		DeviceIDs: deviceIDs,
+
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			ds := new(storeMocks.DataStore)
+			ds.On("GetSettings", contextMatcher).
+				Return(settings, nil).
+				On("UpsertDevices", contextMatcher,
+					updatesMatcher(map[string]model.DeviceState{
+						deviceIDs[0]: model.DeviceStateProvisionFailed,
+						deviceIDs[1]: model.DeviceStateProvisionFailed,
+					})).
+				Return(nil)
+			return ds
+		},
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			hub := new(miothub.Client)
+			hub.On("BulkDevices", contextMatcher, cs, bulkMatcher(deviceIDs...)).
+				Return(nil, client.HTTPError{Code: http.StatusUnauthorized})
+			return hub
+		},
+		Wf: func(t *testing.T, self *testCase) *mworkflows.Client {
+			return new(mworkflows.Client)
+		},
+
+		Errors: []error{ErrNoConnectionString, ErrNoConnectionString},
+	}, {
+		Name: "error/hub request failed",
+
+		DeviceIDs: deviceIDs,
+
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			ds := new(storeMocks.DataStore)
+			ds.On("GetSettings", contextMatcher).
+				Return(settings, nil).
+				On("UpsertDevices", contextMatcher,
+					updatesMatcher(map[string]model.DeviceState{
+						deviceIDs[0]: model.DeviceStateProvisionFailed,
+						deviceIDs[1]: model.DeviceStateProvisionFailed,
+					})).
+				Return(nil)
+			return ds
+		},
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			hub := new(miothub.Client)
+			hub.On("BulkDevices", contextMatcher, cs, bulkMatcher(deviceIDs...)).
+				Return(nil, errors.New("connection reset"))
+			return hub
+		},
+		Wf: func(t *testing.T, self *testCase) *mworkflows.Client {
+			return new(mworkflows.Client)
+		},
+
+		Errors: []error{
+			errors.New("failed to create iothub devices: connection reset"),
+			errors.New("failed to create iothub devices: connection reset"),
+		},
+	}, {
+		Name: "error/failed to update device records",
+
+		DeviceIDs: deviceIDs,
+
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			ds := new(storeMocks.DataStore)
+			ds.On("GetSettings", contextMatcher).
+				Return(settings, nil).
+				On("UpsertDevices", contextMatcher,
+					mock.AnythingOfType("map[string]model.DeviceUpdate")).
+				Return(errors.New("store failure"))
+			return ds
+		},
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			hub := new(miothub.Client)
+			hub.On("BulkDevices", contextMatcher, cs, bulkMatcher(deviceIDs...)).
+				Return(&iothub.BulkResult{Errors: []iothub.BulkError{{
+					DeviceID:    deviceIDs[1],
+					ErrorCode:   "IotHubQuotaExceeded",
+					ErrorStatus: "Total number of devices exceeded",
+				}}}, nil)
+			return hub
+		},
+		Wf: func(t *testing.T, self *testCase) *mworkflows.Client {
+			wf := new(mworkflows.Client)
+			wf.On("ProvisionExternalDevice",
+				contextMatcher,
+				deviceIDs[0],
+				model.ProviderIoTHub,
+				mock.AnythingOfType("map[string]string")).
+				Return(nil)
+			return wf
+		},
+
+		Errors: []error{
+			errors.New("failed to update device records: store failure"),
+			errors.New("failed to create iothub device: iothub: IotHubQuotaExceeded"),
+		},
+	}, {
+		Name: "error/getting settings",
+
+		DeviceIDs: deviceIDs,
+
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			ds := new(storeMocks.DataStore)
+			ds.On("GetSettings", contextMatcher).
+				Return(model.Settings{}, errors.New("wut?"))
+			return ds
+		},
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			return new(miothub.Client)
+		},
+		Wf: func(t *testing.T, self *testCase) *mworkflows.Client {
+			return new(mworkflows.Client)
+		},
+
+		Error: errors.New("failed to retrieve settings: wut?"),
+	}}
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			ctx := context.Background()
+			ds := tc.Store(t, &tc)
+			hub := tc.Hub(t, &tc)
+			wf := tc.Wf(t, &tc)
+			defer ds.AssertExpectations(t)
+			defer hub.AssertExpectations(t)
+			defer wf.AssertExpectations(t)
+
+			app := New(ds, hub, wf)
+			errs, err := app.ProvisionDevices(ctx, tc.DeviceIDs)
+
+			if tc.Error != nil {
+				if assert.Error(t, err) {
+					assert.Regexp(t, tc.Error.Error(), err.Error())
+				}
+				return
+			}
+			assert.NoError(t, err)
+			if assert.Len(t, errs, len(tc.Errors)) {
+				for i, expected := range tc.Errors {
+					if expected == nil {
+						assert.NoError(t, errs[i])
+					} else if assert.Error(t, errs[i]) {
+						assert.Regexp(t, expected.Error(), errs[i].Error())
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestDecommissionDevices(t *testing.T) {
+	t.Parallel()
+	cs := &model.ConnectionString{
+		HostName: "localhost",
+		Key:      []byte("super secret"),
+		Name:     "my favorite string",
+	}
+	deviceIDs := []string{
+		"68ac6f41-c2e7-429f-a4bd-852fac9a5045",
+		"b2ef1bc4-3f52-4d7e-9d47-6b3a7a2d0f1e",
+	}
+	manyDeviceIDs := make([]string, iothub.MaxBulkDevices+20)
+	for i := range manyDeviceIDs {
+		manyDeviceIDs[i] = fmt.Sprintf("device-%d", i)
+	}
+	settings := model.Settings{Integrations: []model.Integration{{
+		ID:               uuid.New(),
+		ConnectionString: cs,
+	}}}
+	bulkDelete := func(deviceIDs ...string) []*iothub.BulkDevice {
+		ops := make([]*iothub.BulkDevice, len(deviceIDs))
+		for i, id := range deviceIDs {
+			ops[i] = &iothub.BulkDevice{
+				DeviceID:   id,
+				ETag:       "*",
+				ImportMode: iothub.ImportModeDeleteIfMatchETag,
+			}
+		}
+		return ops
+	}
+	failuresMatcher := func(deviceIDs ...string) interface{} {
+		return mock.MatchedBy(func(updates map[string]model.DeviceUpdate) bool {
+			if len(updates) != len(deviceIDs) {
+				return false
+			}
+			for _, id := range deviceIDs {
+				update, ok := updates[id]
+				if !ok || *update.State != model.DeviceStateDecommissionFailed ||
+					*update.LastError == "" {
+					return false
+				}
+			}
+			return true
+		})
+	}
+	type testCase struct {
+		Name string
+
+		DeviceIDs []string
+
+		Store func(t *testing.T, self *testCase) *storeMocks.DataStore
+		Hub   func(t *testing.T, self *testCase) *miothub.Client
+
+		Errors []error
+		Error  error
+	}
+	testCases := []testCase{{
+		Name: "ok",
+
+		DeviceIDs: deviceIDs,
+
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			ds := new(storeMocks.DataStore)
+			ds.On("GetSettings", contextMatcher).
+				Return(settings, nil).
+				On("DeleteDevices", contextMatcher, deviceIDs).
+				Return(nil)
+			return ds
+		},
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			hub := new(miothub.Client)
+			hub.On("BulkDevices", contextMatcher, cs, bulkDelete(deviceIDs...)).
+				Return(&iothub.BulkResult{Errors: []iothub.BulkError{{
+					DeviceID:    deviceIDs[1],
+					ErrorCode:   iothub.ErrorCodeDeviceNotFound,
+					ErrorStatus: "Device not found",
+				}}}, nil)
+			return hub
+		},
+
+		Errors: []error{nil, nil},
+	}, {
+		Name: "ok, multiple batches",
+
+		DeviceIDs: manyDeviceIDs,
+
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			ds := new(storeMocks.DataStore)
+			ds.On("GetSettings", contextMatcher).
+				Return(settings, nil).
+				On("DeleteDevices", contextMatcher, manyDeviceIDs).
+				Return(nil)
+			return ds
+		},
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			hub := new(miothub.Client)
+			hub.On("BulkDevices", contextMatcher, cs,
+				bulkDelete(manyDeviceIDs[:iothub.MaxBulkDevices]...)).
+				Return(&iothub.BulkResult{IsSuccessful: true}, nil).
+				Once().
+				On("BulkDevices", contextMatcher, cs,
+					bulkDelete(manyDeviceIDs[iothub.MaxBulkDevices:]...)).
+				Return(&iothub.BulkResult{IsSuccessful: true}, nil).
+				Once()
+			return hub
+		},
+
+		Errors: make([]error, len(manyDeviceIDs)),
+	}, {
+		Name: "ok, partial failure",
+
+		DeviceIDs: deviceIDs,
+
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			ds := new(storeMocks.DataStore)
+			ds.On("GetSettings", contextMatcher).
+				Return(settings, nil).
+				On("UpsertDevices", contextMatcher, failuresMatcher(deviceIDs[1])).
+				Return(nil).
+				On("DeleteDevices", contextMatcher, deviceIDs[:1]).
+				Return(nil)
+			return ds
+		},
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			hub := new(miothub.Client)
+			hub.On("BulkDevices", contextMatcher, cs, bulkDelete(deviceIDs...)).
+				Return(&iothub.BulkResult{Errors: []iothub.BulkError{{
+					DeviceID:    deviceIDs[1],
+					ErrorCode:   "ThrottleBacklogLimitExceeded",
+					ErrorStatus: "Throttled",
+				}}}, nil)
+			return hub
+		},
+
+		Errors: []error{
+			nil,
+			errors.New("failed to delete IoT Hub device: " +
+				"iothub: ThrottleBacklogLimitExceeded: Throttled"),
+		},
+	}, {
+		Name: "ok, device out of scope",
+
+		DeviceIDs: deviceIDs,
+
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			ds := new(storeMocks.DataStore)
+			ds.On("GetSettings", contextMatcher).
+				Return(model.Settings{Integrations: []model.Integration{{
+					ID:               uuid.New(),
+					ConnectionString: cs,
+					Scope: &model.DeviceScope{
+						DeviceIDs: deviceIDs[1:],
+					},
+				}}}, nil).
+				On("DeleteDevices", contextMatcher, deviceIDs[1:]).
+				Return(nil)
+			return ds
+		},
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			hub := new(miothub.Client)
+			hub.On("BulkDevices", contextMatcher, cs, bulkDelete(deviceIDs[1])).
+				Return(&iothub.BulkResult{IsSuccessful: true}, nil)
+			return hub
+		},
+
+		Errors: []error{ErrNoIntegrations, nil},
+	}, {
+		Name: "error/hub request failed",
+
+		DeviceIDs: deviceIDs,
+
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			ds := new(storeMocks.DataStore)
+			ds.On("GetSettings", contextMatcher).
+				Return(settings, nil).
+				On("UpsertDevices", contextMatcher, failuresMatcher(deviceIDs...)).
+				Return(errors.New("store failure"))
+			return ds
+		},
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			hub := new(miothub.Client)
+			hub.On("BulkDevices", contextMatcher, cs, bulkDelete(deviceIDs...)).
+				Return(nil, client.HTTPError{Code: http.StatusForbidden})
+			return hub
+		},
+
+		Errors: []error{
+			errors.New("failed to delete IoT Hub devices"),
+			errors.New("failed to delete IoT Hub devices"),
+		},
+	}, {
+		Name: "error/failed to delete device records",
+
+		DeviceIDs: deviceIDs,
+
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			ds := new(storeMocks.DataStore)
+			ds.On("GetSettings", contextMatcher).
+				Return(settings, nil).
+				On("DeleteDevices", contextMatcher, deviceIDs).
+				Return(errors.New("store failure"))
+			return ds
+		},
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			hub := new(miothub.Client)
+			hub.On("BulkDevices", contextMatcher, cs, bulkDelete(deviceIDs...)).
+				Return(&iothub.BulkResult{IsSuccessful: true}, nil)
+			return hub
+		},
+
+		Errors: []error{
+			errors.New("failed to delete device records: store failure"),
+			errors.New("failed to delete device records: store failure"),
+		},
+	}, {
+		Name: "error/getting settings",
+
+		DeviceIDs: deviceIDs,
+
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			ds := new(storeMocks.DataStore)
+			ds.On("GetSettings", contextMatcher).
+				Return(model.Settings{}, errors.New("wut?"))
+			return ds
+		},
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			return new(miothub.Client)
+		},
+
+		Error: errors.New("failed to retrieve settings: wut?"),
+	}}
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			ctx := context.Background()
+			ds := tc.Store(t, &tc)
+			hub := tc.Hub(t, &tc)
+			defer ds.AssertExpectations(t)
+			defer hub.AssertExpectations(t)
+
+			app := New(ds, hub, nil)
+			errs, err := app.DecommissionDevices(ctx, tc.DeviceIDs)
+
+			if tc.Error != nil {
+				if assert.Error(t, err) {
+					assert.Regexp(t, tc.Error.Error(), err.Error())
+				}
+				return
+			}
+			assert.NoError(t, err)
+			if assert.Len(t, errs, len(tc.Errors)) {
+				for i, expected := range tc.Errors {
+					if expected == nil {
+						assert.NoError(t, errs[i])
+					} else if assert.Error(t, errs[i]) {
+						assert.Regexp(t, expected.Error(), errs[i].Error())
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestSetDevicesStatus(t *testing.T) {
+	t.Parallel()
+	cs := &model.ConnectionString{
+		HostName: "localhost",
+		Key:      []byte("super secret"),
+		Name:     "my favorite string",
+	}
+	deviceIDs := []string{
+		"68ac6f41-c2e7-429f-a4bd-852fac9a5045",
+		"b2ef1bc4-3f52-4d7e-9d47-6b3a7a2d0f1e",
+	}
+	manyDeviceIDs := make([]string, 25)
+	for i := range manyDeviceIDs {
+		manyDeviceIDs[i] = fmt.Sprintf("device-%d", i)
+	}
+	settings := model.Settings{Integrations: []model.Integration{{
+		ID:               uuid.New(),
+		ConnectionString: cs,
+	}}}
+	statusMatcher := func(deviceIDs ...string) interface{} {
+		return mock.MatchedBy(func(updates map[string]model.DeviceUpdate) bool {
+			if len(updates) != len(deviceIDs) {
+				return false
+			}
+			for _, id := range deviceIDs {
+				update, ok := updates[id]
+				if !ok || *update.Status != string(StatusDisabled) {
+					return false
+				}
+			}
+			return true
+		})
+	}
+	type testCase struct {
+		Name string
+
+		DeviceIDs   []string
+		Concurrency int
+
+		Store func(t *testing.T, self *testCase) *storeMocks.DataStore
+		Hub   func(t *testing.T, self *testCase) *miothub.Client
+
+		Errors []error
+		Error  error
+	}
+	testCases := []testCase{{
+		Name: "ok",
+
+		DeviceIDs: deviceIDs,
+
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			ds := new(storeMocks.DataStore)
+			ds.On("GetSettings", contextMatcher).
+				Return(settings, nil).
+				Once().
+				On("UpsertDevices", contextMatcher, statusMatcher(deviceIDs...)).
+				Return(nil)
+			return ds
+		},
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			hub := new(miothub.Client)
+			hub.On("GetDevice", contextMatcher, cs, deviceIDs[0]).
+				Return(&iothub.Device{
+					DeviceID: deviceIDs[0],
+					ETag:     "etag",
+					Status:   iothub.StatusEnabled,
+				}, nil).
+				On("UpsertDevice", contextMatcher, cs, deviceIDs[0],
+					&iothub.Device{
+						DeviceID: deviceIDs[0],
+						ETag:     "etag",
+						Status:   iothub.StatusDisabled,
+					}).
+				Return(nil, nil).
+				On("GetDevice", contextMatcher, cs, deviceIDs[1]).
+				Return(&iothub.Device{
+					DeviceID: deviceIDs[1],
+					Status:   iothub.StatusDisabled,
+				}, nil)
+			return hub
+		},
+
+		Errors: []error{nil, nil},
+	}, {
+		Name: "ok, bounded concurrency",
+
+		DeviceIDs:   manyDeviceIDs,
+		Concurrency: 3,
+
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			ds := new(storeMocks.DataStore)
+			ds.On("GetSettings", contextMatcher).
+				Return(settings, nil).
+				Once().
+				On("UpsertDevices", contextMatcher, statusMatcher(manyDeviceIDs...)).
+				Return(nil)
+			return ds
+		},
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			var inFlight, maxInFlight int32
+			hub := new(miothub.Client)
+			hub.On("GetDevice", contextMatcher, cs, mock.AnythingOfType("string")).
+				Run(func(args mock.Arguments) {
+					n := atomic.AddInt32(&inFlight, 1)
+					for {
+						max := atomic.LoadInt32(&maxInFlight)
+						if n <= max ||
+							atomic.CompareAndSwapInt32(&maxInFlight, max, n) {
+							break
+						}
+					}
+					time.Sleep(time.Millisecond)
+					atomic.AddInt32(&inFlight, -1)
+				}).
+				Return(&iothub.Device{Status: iothub.StatusDisabled}, nil).
+				Times(len(manyDeviceIDs))
+			t.Cleanup(func() {
+				assert.LessOrEqual(t, atomic.LoadInt32(&maxInFlight), int32(3))
+			})
+			return hub
+		},
+
+		Errors: make([]error, len(manyDeviceIDs)),
+	}, {
+		Name: "ok, partial failure",
+
+		DeviceIDs: deviceIDs,
+
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			ds := new(storeMocks.DataStore)
+			ds.On("GetSettings", contextMatcher).
+				Return(model.Settings{Integrations: []model.Integration{{
+					ID:               uuid.New(),
+					ConnectionString: cs,
+					Scope: &model.DeviceScope{
+						DeviceIDs: deviceIDs,
+					},
+				}}}, nil).
+				On("UpsertDevices", contextMatcher, statusMatcher(deviceIDs[0])).
+				Return(nil)
+			return ds
+		},
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			hub := new(miothub.Client)
+			hub.On("GetDevice", contextMatcher, cs, deviceIDs[0]).
+				Return(&iothub.Device{Status: iothub.StatusDisabled}, nil).
+				On("GetDevice", contextMatcher, cs, deviceIDs[1]).
+				Return(nil, client.HTTPError{Code: http.StatusNotFound})
+			return hub
+		},
+
+		Errors: []error{
+			nil,
+			errors.New("failed to retrieve device from IoT Hub"),
+		},
+	}, {
+		Name: "ok, device out of scope",
+
+		DeviceIDs: deviceIDs,
+
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			ds := new(storeMocks.DataStore)
+			ds.On("GetSettings", contextMatcher).
+				Return(model.Settings{Integrations: []model.Integration{{
+					ID:               uuid.New(),
+					ConnectionString: cs,
+					Scope: &model.DeviceScope{
+						DeviceIDs: deviceIDs[:1],
+					},
+				}}}, nil).
+				On("UpsertDevices", contextMatcher, statusMatcher(deviceIDs[0])).
+				Return(nil)
+			return ds
+		},
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			hub := new(miothub.Client)
+			hub.On("GetDevice", contextMatcher, cs, deviceIDs[0]).
+				Return(&iothub.Device{Status: iothub.StatusDisabled}, nil)
+			return hub
+		},
+
+		Errors: []error{nil, ErrNoIntegrations},
+	}, {
+		Name: "error/failed to update device records",
+
+		DeviceIDs: deviceIDs,
+
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			ds := new(storeMocks.DataStore)
+			ds.On("GetSettings", contextMatcher).
+				Return(settings, nil).
+				On("UpsertDevices", contextMatcher, statusMatcher(deviceIDs...)).
+				Return(errors.New("store failure"))
+			return ds
+		},
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			hub := new(miothub.Client)
+			hub.On("GetDevice", contextMatcher, cs, mock.AnythingOfType("string")).
+				Return(&iothub.Device{Status: iothub.StatusDisabled}, nil)
+			return hub
+		},
+
+		Errors: []error{
+			errors.New("failed to update device records: store failure"),
+			errors.New("failed to update device records: store failure"),
+		},
+	}, {
+		Name: "error/getting settings",
+
+		DeviceIDs: deviceIDs,
+
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			ds := new(storeMocks.DataStore)
+			ds.On("GetSettings", contextMatcher).
+				Return(model.Settings{}, errors.New("wut?"))
+			return ds
+		},
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			return new(miothub.Client)
+		},
+
+		Error: errors.New("failed to retrieve settings: wut?"),
+	}}
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			ctx := context.Background()
+			ds := tc.Store(t, &tc)
+			hub := tc.Hub(t, &tc)
+			defer ds.AssertExpectations(t)
+			defer hub.AssertExpectations(t)
+
+			opts := NewOptions()
+			if tc.Concurrency > 0 {
+				opts.SetBulkConcurrency(tc.Concurrency)
+			}
+			app := New(ds, hub, nil, opts)
+			errs, err := app.SetDevicesStatus(ctx, tc.DeviceIDs, StatusDisabled)
+
+			if tc.Error != nil {
+				if assert.Error(t, err) {
+					assert.Regexp(t, tc.Error.Error(), err.Error())
+				}
+				return
+			}
+			assert.NoError(t, err)
+			if assert.Len(t, errs, len(tc.Errors)) {
+				for i, expected := range tc.Errors {
+					if expected == nil {
+						assert.NoError(t, errs[i])
+					} else if assert.Error(t, errs[i]) {
+						assert.Regexp(t, expected.Error(), errs[i].Error())
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestProvisionDevicesJob(t *testing.T) {
+	t.Parallel()
+	cs := &model.ConnectionString{
+		HostName: "localhost",
+		Key:      []byte("super secret"),
+		Name:     "my favorite string",
+	}
+	deviceIDs := []string{
+		"68ac6f41-c2e7-429f-a4bd-852fac9a5045",
+		"b2ef1bc4-3f52-4d7e-9d47-6b3a7a2d0f1e",
+	}
+	ctx := identity.WithContext(context.Background(), &identity.Identity{
+		Tenant: "123456789012345678901234",
+	})
+
+	var job model.Job
+	ds := new(storeMocks.DataStore)
+	defer ds.AssertExpectations(t)
+	ds.On("CreateJob", contextMatcher, mock.AnythingOfType("model.Job")).
+		Run(func(args mock.Arguments) {
+			job = args.Get(1).(model.Job)
+		}).
+		Return(nil).Once().
+		On("GetSettings", contextMatcher).
+		Return(model.Settings{Integrations: []model.Integration{{
+			ID:               uuid.New(),
+			ConnectionString: cs,
+		}}}, nil).Once().
+		On("UpsertDevices", contextMatcher,
+			mock.AnythingOfType("map[string]model.DeviceUpdate")).
+		Return(nil).Once().
+		On("GetSettings", contextMatcher).
+		Return(model.Settings{}, errors.New("internal error")).Once()
+	hub := new(miothub.Client)
+	defer hub.AssertExpectations(t)
+	hub.On("BulkDevices", contextMatcher, cs,
+		mock.AnythingOfType("[]*iothub.BulkDevice")).
+		Return(nil, errors.New("internal error")).Once()
+
+	app := New(ds, hub, nil).(*app)
+	scheduled, err := app.ScheduleDeviceProvisioning(ctx, deviceIDs)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, model.JobTypeProvisionDevices, scheduled.Type)
+	assert.Equal(t, "123456789012345678901234", scheduled.TenantID)
+
+	tracker := &jobTracker{store: ds, jobID: job.ID, stored: time.Now()}
+	err = app.provisionDevicesJob(ctx, &job, tracker)
+	assert.EqualError(t, err, "failed to provision 2 devices")
+	assert.Equal(t, model.JobProgress{Total: 2, Failed: 2}, tracker.progress)
+
+	tracker = &jobTracker{store: ds, jobID: job.ID, stored: time.Now()}
+	err = app.provisionDevicesJob(ctx, &job, tracker)
+	assert.EqualError(t, err, "failed to retrieve settings: internal error")
+
+	job.Params[jobParamDeviceIDs] = "rawr"
+	err = app.provisionDevicesJob(ctx, &job, tracker)
+	assert.Error(t, err)
+}
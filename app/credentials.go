@@ -0,0 +1,119 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package app
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+
+	"github.com/mendersoftware/go-lib-micro/identity"
+	"github.com/mendersoftware/go-lib-micro/log"
+
+	"github.com/mendersoftware/iot-manager/model"
+)
+
+// ScopeRevealCredentials is the token scope granting a user the permission
+// to reveal the integration credentials.
+const ScopeRevealCredentials = "iot-manager:credentials:reveal"
+
+var (
+	ErrRevealNotAllowed = errors.New("revealing integration credentials is not allowed")
+)
+
+type scopesContextKey struct{}
+
+// WithScopes returns a context carrying the scopes granted to the user by
+// the identity provider.
+func WithScopes(ctx context.Context, scopes []string) context.Context {
+	return context.WithValue(ctx, scopesContextKey{}, scopes)
+}
+
+// hasScope returns true if the scopes in the context include scope.
+func hasScope(ctx context.Context, scope string) bool {
+	scopes, _ := ctx.Value(scopesContextKey{}).([]string)
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidationError is returned when the integrations are invalid after
+// inheriting the stored secrets, for example if a new integration omits
+// its secrets.
+type ValidationError struct {
+	Err error
+}
+
+func (err *ValidationError) Error() string {
+	return err.Err.Error()
+}
+
+// updateIntegration prepares an integration replacing the stored one (nil
+// for new integrations) by inheriting the omitted secrets and the creation
+// timestamp.
+func updateIntegration(
+	integration *model.Integration,
+	stored *model.Integration,
+	now time.Time,
+) {
+	integration.CreatedTS = &now
+	integration.UpdatedTS = &now
+	if stored != nil {
+		integration.InheritSecrets(*stored)
+		if stored.CreatedTS != nil {
+			integration.CreatedTS = stored.CreatedTS
+		}
+	}
+}
+
+// RevealIntegration returns the integration including the secrets. The
+// deployment must allow revealing credentials and the user must be granted
+// ScopeRevealCredentials. Every call is recorded in the audit log.
+func (a *app) RevealIntegration(
+	ctx context.Context,
+	integrationID uuid.UUID,
+) (*model.Integration, error) {
+	l := log.FromContext(ctx).F(log.Ctx{
+		"audit":          "reveal_credentials",
+		"integration_id": integrationID.String(),
+	})
+	if id := identity.FromContext(ctx); id != nil {
+		l = l.F(log.Ctx{
+			"user_id":   id.Subject,
+			"tenant_id": id.Tenant,
+		})
+	}
+	if !a.allowReveal {
+		l.F(log.Ctx{"reason": "disabled"}).
+			Warn("denied revealing integration credentials")
+		return nil, ErrRevealNotAllowed
+	}
+	if !hasScope(ctx, ScopeRevealCredentials) {
+		l.F(log.Ctx{"reason": "missing permission"}).
+			Warn("denied revealing integration credentials")
+		return nil, ErrRevealNotAllowed
+	}
+	integration, err := a.GetIntegration(ctx, integrationID)
+	if err != nil {
+		return nil, err
+	}
+	l.Warn("revealed integration credentials")
+	return integration, nil
+}
@@ -0,0 +1,128 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package app
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/go-lib-micro/identity"
+
+	"github.com/mendersoftware/iot-manager/model"
+	storeMocks "github.com/mendersoftware/iot-manager/store/mocks"
+)
+
+func TestRevealIntegration(t *testing.T) {
+	t.Parallel()
+	integration := model.Integration{
+		ID:   uuid.New(),
+		Name: "hub",
+		ConnectionString: &model.ConnectionString{
+			HostName: "localhost",
+			Key:      []byte("super secret"),
+			Name:     "my favorite string",
+		},
+	}
+	ctx := identity.WithContext(context.Background(), &identity.Identity{
+		Subject: "829cbefb-70e7-438f-9ac5-35fd131c2111",
+		Tenant:  "123456789012345678901234",
+		IsUser:  true,
+	})
+	type testCase struct {
+		Name string
+
+		ID          uuid.UUID
+		AllowReveal bool
+		Scopes      []string
+
+		Store func(t *testing.T, self *testCase) *storeMocks.DataStore
+
+		Integration *model.Integration
+		Error       error
+	}
+	testCases := []testCase{{
+		Name: "ok",
+
+		ID:          integration.ID,
+		AllowReveal: true,
+		Scopes:      []string{"mender.*", ScopeRevealCredentials},
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			store := new(storeMocks.DataStore)
+			store.On("GetSettings", contextMatcher).
+				Return(model.Settings{
+					Integrations: []model.Integration{integration},
+				}, nil)
+			return store
+		},
+		Integration: &integration,
+	}, {
+		Name: "error/not allowed",
+
+		ID:     integration.ID,
+		Scopes: []string{ScopeRevealCredentials},
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			return new(storeMocks.DataStore)
+		},
+		Error: ErrRevealNotAllowed,
+	}, {
+		Name: "error/missing permission",
+
+		ID:          integration.ID,
+		AllowReveal: true,
+		Scopes:      []string{"mender.*"},
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			return new(storeMocks.DataStore)
+		},
+		Error: ErrRevealNotAllowed,
+	}, {
+		Name: "error/not found",
+
+		ID:          uuid.New(),
+		AllowReveal: true,
+		Scopes:      []string{ScopeRevealCredentials},
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			store := new(storeMocks.DataStore)
+			store.On("GetSettings", contextMatcher).
+				Return(model.Settings{
+					Integrations: []model.Integration{integration},
+				}, nil)
+			return store
+		},
+		Error: ErrIntegrationNotFound,
+	}}
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			ds := tc.Store(t, &tc)
+			defer ds.AssertExpectations(t)
+
+			app := New(ds, nil, nil,
+				NewOptions().SetCredentialsReveal(tc.AllowReveal),
+			)
+			integration, err := app.RevealIntegration(
+				WithScopes(ctx, tc.Scopes), tc.ID,
+			)
+			if tc.Error != nil {
+				assert.EqualError(t, err, tc.Error.Error())
+			} else if assert.NoError(t, err) {
+				assert.Equal(t, tc.Integration, integration)
+			}
+		})
+	}
+}
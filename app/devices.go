@@ -0,0 +1,139 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package app
+
+import (
+	"context"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+
+	"github.com/mendersoftware/iot-manager/client/iothub"
+	"github.com/mendersoftware/iot-manager/model"
+)
+
+// hubIntegration returns the IoT Hub integration with the given ID or, if
+// the ID is nil, the first IoT Hub integration with a connection string.
+func hubIntegration(
+	settings model.Settings,
+	integrationID uuid.UUID,
+) (*model.Integration, error) {
+	if integrationID != uuid.Nil {
+		integration := settings.Integration(integrationID)
+		if integration == nil {
+			return nil, ErrIntegrationNotFound
+		}
+		if integration.Provider == model.ProviderIoTCore ||
+			integration.ConnectionString == nil {
+			return nil, ErrNoConnectionString
+		}
+		return integration, nil
+	}
+	for i, integration := range settings.Integrations {
+		if integration.Provider != model.ProviderIoTCore &&
+			integration.ConnectionString != nil {
+			return &settings.Integrations[i], nil
+		}
+	}
+	return nil, ErrNoConnectionString
+}
+
+// deviceHubIntegration returns the IoT Hub integration with the given ID or,
+// if the ID is nil, the first IoT Hub integration including the device.
+func deviceHubIntegration(
+	settings model.Settings,
+	deviceID string,
+	integrationID uuid.UUID,
+) (*model.Integration, error) {
+	if integrationID != uuid.Nil {
+		return hubIntegration(settings, integrationID)
+	}
+	for _, integration := range settings.DeviceIntegrations(deviceID) {
+		if integration.Provider != model.ProviderIoTCore &&
+			integration.ConnectionString != nil {
+			return &integration, nil
+		}
+	}
+	return nil, ErrNoConnectionString
+}
+
+// deviceHubConnectionString returns the connection string of the IoT Hub
+// integration with the given ID or, if the ID is nil, of the first IoT Hub
+// integration including the device.
+func (a *app) deviceHubConnectionString(
+	ctx context.Context,
+	integrationID uuid.UUID,
+	deviceID string,
+) (*model.ConnectionString, error) {
+	settings, err := a.GetSettings(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to retrieve settings")
+	}
+	integration, err := deviceHubIntegration(settings, deviceID, integrationID)
+	if err != nil {
+		return nil, err
+	}
+	return integration.ConnectionString, nil
+}
+
+// QueryDevices returns a page of the result of the device twin query in the
+// IoT Hub of the integration, or of the first IoT Hub integration if
+// integrationID is nil. The page starts at the continuation token returned
+// with the previous page.
+func (a *app) QueryDevices(
+	ctx context.Context,
+	integrationID uuid.UUID,
+	q *iothub.Query,
+	contToken string,
+) (*iothub.QueryPage, error) {
+	settings, err := a.GetSettings(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to retrieve settings")
+	}
+	integration, err := hubIntegration(settings, integrationID)
+	if err != nil {
+		return nil, err
+	}
+	page, err := a.hub.QueryDeviceTwins(ctx,
+		integration.ConnectionString, q, contToken,
+	)
+	return page, errors.Wrap(err, "failed to retrieve devices from IoT Hub")
+}
+
+// InvokeDeviceMethod invokes a direct method on the device, or on a module of
+// the device if moduleID is not empty, through the IoT Hub integration or, if
+// integrationID is nil, the first IoT Hub integration including the device.
+func (a *app) InvokeDeviceMethod(
+	ctx context.Context,
+	integrationID uuid.UUID,
+	deviceID, moduleID string,
+	method *iothub.DirectMethod,
+) (*iothub.MethodResult, error) {
+	cs, err := a.deviceHubConnectionString(ctx, integrationID, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	var res *iothub.MethodResult
+	if moduleID != "" {
+		res, err = a.hub.InvokeModuleMethod(ctx,
+			cs, deviceID, moduleID, method,
+		)
+	} else {
+		res, err = a.hub.InvokeDeviceMethod(ctx,
+			cs, deviceID, method,
+		)
+	}
+	return res, errors.Wrap(err, "failed to invoke direct method")
+}
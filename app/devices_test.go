@@ -0,0 +1,345 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/iot-manager/client/iothub"
+	miothub "github.com/mendersoftware/iot-manager/client/iothub/mocks"
+	"github.com/mendersoftware/iot-manager/model"
+	storeMocks "github.com/mendersoftware/iot-manager/store/mocks"
+)
+
+func TestQueryDevices(t *testing.T) {
+	t.Parallel()
+	cs := &model.ConnectionString{
+		HostName: "localhost",
+		Key:      []byte("super secret"),
+		Name:     "my favorite string",
+	}
+	coreID := uuid.New()
+	hubID := uuid.New()
+	settings := model.Settings{Integrations: []model.Integration{{
+		ID:       coreID,
+		Provider: model.ProviderIoTCore,
+	}, {
+		ID:               hubID,
+		Provider:         model.ProviderIoTHub,
+		ConnectionString: cs,
+	}}}
+	q := iothub.NewQuery().
+		And(iothub.FieldStatus.Eq("enabled")).
+		SetPageSize(10)
+	page := &iothub.QueryPage{
+		Items:             []json.RawMessage{[]byte(`{"deviceId":"dev-1"}`)},
+		ContinuationToken: "next",
+	}
+	type testCase struct {
+		Name string
+
+		IntegrationID uuid.UUID
+
+		Store func(t *testing.T, self *testCase) *storeMocks.DataStore
+		Hub   func(t *testing.T, self *testCase) *miothub.Client
+
+		Page  *iothub.QueryPage
+		Error error
+	}
+	testCases := []testCase{{
+		Name: "ok, first IoT Hub integration",
+
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			ds := new(storeMocks.DataStore)
+			ds.On("GetSettings", contextMatcher).Return(settings, nil)
+			return ds
+		},
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			hub := new(miothub.Client)
+			hub.On("QueryDeviceTwins", contextMatcher, cs, q, "").
+				Return(page, nil)
+			return hub
+		},
+		Page: page,
+	}, {
+		Name: "ok, selected integration",
+
+		IntegrationID: hubID,
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			ds := new(storeMocks.DataStore)
+			ds.On("GetSettings", contextMatcher).Return(settings, nil)
+			return ds
+		},
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			hub := new(miothub.Client)
+			hub.On("QueryDeviceTwins", contextMatcher, cs, q, "").
+				Return(page, nil)
+			return hub
+		},
+		Page: page,
+	}, {
+		Name: "error, integration not found",
+
+		IntegrationID: uuid.New(),
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			ds := new(storeMocks.DataStore)
+			ds.On("GetSettings", contextMatcher).Return(settings, nil)
+			return ds
+		},
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			return new(miothub.Client)
+		},
+		Error: ErrIntegrationNotFound,
+	}, {
+		Name: "error, not an IoT Hub integration",
+
+		IntegrationID: coreID,
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			ds := new(storeMocks.DataStore)
+			ds.On("GetSettings", contextMatcher).Return(settings, nil)
+			return ds
+		},
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			return new(miothub.Client)
+		},
+		Error: ErrNoConnectionString,
+	}, {
+		Name: "error, no IoT Hub integrations",
+
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			ds := new(storeMocks.DataStore)
+			ds.On("GetSettings", contextMatcher).Return(model.Settings{}, nil)
+			return ds
+		},
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			return new(miothub.Client)
+		},
+		Error: ErrNoConnectionString,
+	}, {
+		Name: "error, retrieving settings",
+
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			ds := new(storeMocks.DataStore)
+			ds.On("GetSettings", contextMatcher).
+				Return(model.Settings{}, errors.New("internal error"))
+			return ds
+		},
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			return new(miothub.Client)
+		},
+		Error: errors.New("failed to retrieve settings: internal error"),
+	}, {
+		Name: "error, IoT Hub",
+
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			ds := new(storeMocks.DataStore)
+			ds.On("GetSettings", contextMatcher).Return(settings, nil)
+			return ds
+		},
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			hub := new(miothub.Client)
+			hub.On("QueryDeviceTwins", contextMatcher, cs, q, "").
+				Return(nil, errors.New("no such host"))
+			return hub
+		},
+		Error: errors.New("failed to retrieve devices from IoT Hub: no such host"),
+	}}
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			ds := tc.Store(t, &tc)
+			hub := tc.Hub(t, &tc)
+			defer ds.AssertExpectations(t)
+			defer hub.AssertExpectations(t)
+
+			app := New(ds, hub, nil)
+			page, err := app.QueryDevices(context.Background(),
+				tc.IntegrationID, q, "",
+			)
+			if tc.Error != nil {
+				if assert.Error(t, err) {
+					assert.Regexp(t, tc.Error.Error(), err.Error())
+				}
+			} else if assert.NoError(t, err) {
+				assert.Equal(t, tc.Page, page)
+			}
+		})
+	}
+}
+
+func TestInvokeDeviceMethod(t *testing.T) {
+	t.Parallel()
+	const deviceID = "6c985f61-5093-45eb-8ece-7dfe97a6de7b"
+	cs := &model.ConnectionString{
+		HostName: "localhost",
+		Key:      []byte("super secret"),
+		Name:     "my favorite string",
+	}
+	scopedCS := &model.ConnectionString{
+		HostName: "scoped.localhost",
+		Key:      []byte("super secret"),
+		Name:     "my favorite string",
+	}
+	hubID := uuid.New()
+	settings := model.Settings{Integrations: []model.Integration{{
+		ID:       uuid.New(),
+		Provider: model.ProviderIoTCore,
+	}, {
+		ID:               uuid.New(),
+		Provider:         model.ProviderIoTHub,
+		ConnectionString: scopedCS,
+		Scope:            &model.DeviceScope{DeviceIDs: []string{"other"}},
+	}, {
+		ID:               hubID,
+		Provider:         model.ProviderIoTHub,
+		ConnectionString: cs,
+	}}}
+	method := &iothub.DirectMethod{Name: "reboot"}
+	result := &iothub.MethodResult{
+		Status:  200,
+		Payload: json.RawMessage(`{"rebooting":true}`),
+	}
+	type testCase struct {
+		Name string
+
+		IntegrationID uuid.UUID
+		ModuleID      string
+
+		Store func(t *testing.T, self *testCase) *storeMocks.DataStore
+		Hub   func(t *testing.T, self *testCase) *miothub.Client
+
+		Result *iothub.MethodResult
+		Error  error
+	}
+	testCases := []testCase{{
+		Name: "ok, first IoT Hub integration including the device",
+
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			ds := new(storeMocks.DataStore)
+			ds.On("GetSettings", contextMatcher).Return(settings, nil)
+			return ds
+		},
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			hub := new(miothub.Client)
+			hub.On("InvokeDeviceMethod", contextMatcher, cs, deviceID, method).
+				Return(result, nil)
+			return hub
+		},
+		Result: result,
+	}, {
+		Name: "ok, module of the device",
+
+		IntegrationID: hubID,
+		ModuleID:      "agent",
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			ds := new(storeMocks.DataStore)
+			ds.On("GetSettings", contextMatcher).Return(settings, nil)
+			return ds
+		},
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			hub := new(miothub.Client)
+			hub.On("InvokeModuleMethod", contextMatcher,
+				cs, deviceID, "agent", method).
+				Return(result, nil)
+			return hub
+		},
+		Result: result,
+	}, {
+		Name: "error, integration not found",
+
+		IntegrationID: uuid.New(),
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			ds := new(storeMocks.DataStore)
+			ds.On("GetSettings", contextMatcher).Return(settings, nil)
+			return ds
+		},
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			return new(miothub.Client)
+		},
+		Error: ErrIntegrationNotFound,
+	}, {
+		Name: "error, no IoT Hub integration including the device",
+
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			ds := new(storeMocks.DataStore)
+			ds.On("GetSettings", contextMatcher).
+				Return(model.Settings{
+					Integrations: settings.Integrations[:2],
+				}, nil)
+			return ds
+		},
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			return new(miothub.Client)
+		},
+		Error: ErrNoConnectionString,
+	}, {
+		Name: "error, retrieving settings",
+
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			ds := new(storeMocks.DataStore)
+			ds.On("GetSettings", contextMatcher).
+				Return(model.Settings{}, errors.New("internal error"))
+			return ds
+		},
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			return new(miothub.Client)
+		},
+		Error: errors.New("failed to retrieve settings: internal error"),
+	}, {
+		Name: "error, IoT Hub",
+
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			ds := new(storeMocks.DataStore)
+			ds.On("GetSettings", contextMatcher).Return(settings, nil)
+			return ds
+		},
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			hub := new(miothub.Client)
+			hub.On("InvokeDeviceMethod", contextMatcher, cs, deviceID, method).
+				Return(nil, errors.New("device is not online"))
+			return hub
+		},
+		Error: errors.New("failed to invoke direct method: device is not online"),
+	}}
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			ds := tc.Store(t, &tc)
+			hub := tc.Hub(t, &tc)
+			defer ds.AssertExpectations(t)
+			defer hub.AssertExpectations(t)
+
+			app := New(ds, hub, nil)
+			res, err := app.InvokeDeviceMethod(context.Background(),
+				tc.IntegrationID, deviceID, tc.ModuleID, method,
+			)
+			if tc.Error != nil {
+				if assert.Error(t, err) {
+					assert.Regexp(t, tc.Error.Error(), err.Error())
+				}
+			} else if assert.NoError(t, err) {
+				assert.Equal(t, tc.Result, res)
+			}
+		})
+	}
+}
@@ -0,0 +1,182 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package app
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+
+	"github.com/mendersoftware/iot-manager/client"
+	"github.com/mendersoftware/iot-manager/client/dps"
+	"github.com/mendersoftware/iot-manager/model"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrNoDPSSettings = errors.New(
+		"no device provisioning service configured for tenant",
+	)
+	ErrEnrollmentGroupNotFound     = errors.New("enrollment group not found")
+	ErrEnrollmentGroupNotSymmetric = errors.New(
+		"enrollment group does not use symmetric key attestation",
+	)
+)
+
+const (
+	confKeyDPSIDScope        = "$azure.dps.idScope"
+	confKeyDPSRegistrationID = "$azure.dps.registrationId"
+	confKeyDPSGlobalEndpoint = "$azure.dps.globalEndpoint"
+	confKeyDPSPrimaryKey     = "$azure.dps.primaryKey"
+	confKeyDPSSecondaryKey   = "$azure.dps.secondaryKey"
+)
+
+// provisionDPSDevice enrolls the device in the Device Provisioning Service
+// and submits the ID scope and the device keys to the device. If the
+// integration selects an enrollment group, the device keys are derived from the
+// group keys, otherwise an individual enrollment is created for the device.
+func (a *app) provisionDPSDevice(
+	ctx context.Context,
+	integration model.Integration,
+	deviceID, deviceType string,
+) error {
+	dpsSettings := integration.DPS
+	if dpsSettings == nil || dpsSettings.ConnectionString == nil || a.dps == nil {
+		return ErrNoDPSSettings
+	}
+	var (
+		keys *dps.SymmetricKey
+		err  error
+	)
+	if dpsSettings.EnrollmentGroupID != "" {
+		keys, err = a.deriveDPSDeviceKeys(ctx, dpsSettings, deviceID)
+	} else {
+		keys, err = a.enrollDPSDevice(ctx, integration, deviceID, deviceType)
+	}
+	if err != nil {
+		return err
+	}
+
+	globalEndpoint := dpsSettings.GlobalEndpoint
+	if globalEndpoint == "" {
+		globalEndpoint = dps.GlobalEndpoint
+	}
+	config := map[string]string{
+		confKeyDPSIDScope:        dpsSettings.IDScope,
+		confKeyDPSRegistrationID: deviceID,
+		confKeyDPSGlobalEndpoint: globalEndpoint,
+		confKeyDPSPrimaryKey:     base64.StdEncoding.EncodeToString(keys.Primary),
+		confKeyDPSSecondaryKey:   base64.StdEncoding.EncodeToString(keys.Secondary),
+	}
+	err = a.wf.ProvisionExternalDevice(ctx, deviceID, model.ProviderIoTHub, config)
+	return errors.Wrap(err, "failed to submit dps authn to deviceconfig")
+}
+
+func (a *app) deriveDPSDeviceKeys(
+	ctx context.Context,
+	dpsSettings *model.DPSSettings,
+	registrationID string,
+) (*dps.SymmetricKey, error) {
+	group, err := a.dps.GetEnrollmentGroup(ctx,
+		dpsSettings.ConnectionString,
+		dpsSettings.EnrollmentGroupID,
+	)
+	if err != nil {
+		if htErr, ok := err.(client.HTTPError); ok {
+			switch htErr.Code {
+			case http.StatusUnauthorized:
+				return nil, ErrNoDPSSettings
+			case http.StatusNotFound:
+				return nil, ErrEnrollmentGroupNotFound
+			}
+		}
+		return nil, errors.Wrap(err, "failed to retrieve dps enrollment group")
+	}
+	if group.Attestation == nil || group.Attestation.SymmetricKey == nil {
+		return nil, ErrEnrollmentGroupNotSymmetric
+	}
+	groupKeys := group.Attestation.SymmetricKey
+	return &dps.SymmetricKey{
+		Primary:   dps.DeriveKey(groupKeys.Primary, registrationID),
+		Secondary: dps.DeriveKey(groupKeys.Secondary, registrationID),
+	}, nil
+}
+
+func (a *app) enrollDPSDevice(
+	ctx context.Context,
+	integration model.Integration,
+	deviceID, deviceType string,
+) (*dps.SymmetricKey, error) {
+	attestation, err := dps.NewSymmetricKeyAttestation()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to generate device keys")
+	}
+	enrollment := &dps.Enrollment{
+		RegistrationID: deviceID,
+		DeviceID:       deviceID,
+		Attestation:    attestation,
+		InitialTwin: &dps.InitialTwin{
+			Tags: map[string]interface{}{
+				tagMender: true,
+			},
+		},
+		IoTHubs:            []string{integration.ConnectionString.HostName},
+		AllocationPolicy:   dps.AllocationPolicyStatic,
+		ProvisioningStatus: dps.ProvisioningStatusEnabled,
+	}
+	if integration.IsEdgeDevice(deviceID, deviceType) {
+		enrollment.Capabilities = &dps.Capabilities{IOTEdge: true}
+	}
+	enrollment, err = a.dps.UpsertEnrollment(ctx,
+		integration.DPS.ConnectionString, enrollment,
+	)
+	if err != nil {
+		if htErr, ok := err.(client.HTTPError); ok {
+			switch htErr.Code {
+			case http.StatusUnauthorized:
+				return nil, ErrNoDPSSettings
+			case http.StatusConflict:
+				return nil, ErrDeviceAlreadyExists
+			}
+		}
+		return nil, errors.Wrap(err, "failed to create dps enrollment")
+	}
+	if enrollment.Attestation != nil && enrollment.Attestation.SymmetricKey != nil {
+		return enrollment.Attestation.SymmetricKey, nil
+	}
+	return attestation.SymmetricKey, nil
+}
+
+// deleteDPSEnrollment removes the individual enrollment of the device if
+// the tenant provisions devices using individual enrollments.
+func (a *app) deleteDPSEnrollment(
+	ctx context.Context,
+	integration model.Integration,
+	deviceID string,
+) error {
+	dpsSettings := integration.DPS
+	if dpsSettings == nil || dpsSettings.ConnectionString == nil || a.dps == nil {
+		return ErrNoDPSSettings
+	}
+	if dpsSettings.EnrollmentGroupID != "" {
+		return nil
+	}
+	err := a.dps.DeleteEnrollment(ctx, dpsSettings.ConnectionString, deviceID)
+	if htErr, ok := err.(client.HTTPError); ok && htErr.Code == http.StatusNotFound {
+		return nil
+	}
+	return errors.Wrap(err, "failed to delete dps enrollment")
+}
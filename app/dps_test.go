@@ -0,0 +1,417 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package app
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/mendersoftware/iot-manager/client"
+	"github.com/mendersoftware/iot-manager/client/dps"
+	mdps "github.com/mendersoftware/iot-manager/client/dps/mocks"
+	miothub "github.com/mendersoftware/iot-manager/client/iothub/mocks"
+	mworkflows "github.com/mendersoftware/iot-manager/client/workflows/mocks"
+	"github.com/mendersoftware/iot-manager/model"
+	storeMocks "github.com/mendersoftware/iot-manager/store/mocks"
+)
+
+func TestProvisionDeviceDPS(t *testing.T) {
+	t.Parallel()
+	hubCS := &model.ConnectionString{
+		HostName: "mender.azure-devices.net",
+		Key:      []byte("super secret"),
+		Name:     "iothubowner",
+	}
+	dpsCS := &model.ConnectionString{
+		HostName: "mender.azure-devices-provisioning.net",
+		Key:      []byte("even more secret"),
+		Name:     "provisioningserviceowner",
+	}
+	groupKeys := &dps.SymmetricKey{
+		Primary:   dps.Key("group primary"),
+		Secondary: dps.Key("group secondary"),
+	}
+	type testCase struct {
+		Name string
+
+		DeviceID   string
+		DeviceType string
+		DPS        *model.DPSSettings
+		Rules      []model.ProvisioningRule
+
+		DPSClient func(t *testing.T, self *testCase) *mdps.Client
+		Wf        func(t *testing.T, self *testCase) *mworkflows.Client
+
+		Error error
+	}
+	testCases := []testCase{{
+		Name: "ok/individual enrollment",
+
+		DeviceID: "68ac6f41-c2e7-429f-a4bd-852fac9a5045",
+		DPS: &model.DPSSettings{
+			ConnectionString: dpsCS,
+			IDScope:          "0ne00000001",
+		},
+
+		DPSClient: func(t *testing.T, self *testCase) *mdps.Client {
+			dpsMock := new(mdps.Client)
+			dpsMock.On("UpsertEnrollment", contextMatcher, dpsCS,
+				mock.MatchedBy(func(e *dps.Enrollment) bool {
+					return assert.Equal(t, self.DeviceID, e.RegistrationID) &&
+						assert.Equal(t, self.DeviceID, e.DeviceID) &&
+						assert.Equal(t, []string{hubCS.HostName}, e.IoTHubs) &&
+						assert.Equal(t, true, e.InitialTwin.Tags[tagMender]) &&
+						assert.NotNil(t, e.Attestation.SymmetricKey) &&
+						assert.Nil(t, e.Capabilities)
+				})).
+				Return(&dps.Enrollment{
+					RegistrationID: self.DeviceID,
+					Attestation: &dps.Attestation{
+						Type: dps.AttestationTypeSymmetricKey,
+						SymmetricKey: &dps.SymmetricKey{
+							Primary:   dps.Key("primary"),
+							Secondary: dps.Key("secondary"),
+						},
+					},
+				}, nil)
+			return dpsMock
+		},
+		Wf: func(t *testing.T, self *testCase) *mworkflows.Client {
+			wf := new(mworkflows.Client)
+			wf.On("ProvisionExternalDevice", contextMatcher, self.DeviceID,
+				model.ProviderIoTHub,
+				map[string]string{
+					confKeyDPSIDScope:        self.DPS.IDScope,
+					confKeyDPSRegistrationID: self.DeviceID,
+					confKeyDPSGlobalEndpoint: dps.GlobalEndpoint,
+					confKeyDPSPrimaryKey: base64.StdEncoding.
+						EncodeToString([]byte("primary")),
+					confKeyDPSSecondaryKey: base64.StdEncoding.
+						EncodeToString([]byte("secondary")),
+				}).Return(nil)
+			return wf
+		},
+	}, {
+		Name: "ok/edge enrollment",
+
+		DeviceID:   "68ac6f41-c2e7-429f-a4bd-852fac9a5045",
+		DeviceType: "edge-gateway",
+		DPS: &model.DPSSettings{
+			ConnectionString: dpsCS,
+			IDScope:          "0ne00000001",
+		},
+		Rules: []model.ProvisioningRule{{
+			DeviceTypes: []string{"edge-gateway"},
+			IoTEdge:     true,
+		}},
+
+		DPSClient: func(t *testing.T, self *testCase) *mdps.Client {
+			dpsMock := new(mdps.Client)
+			dpsMock.On("UpsertEnrollment", contextMatcher, dpsCS,
+				mock.MatchedBy(func(e *dps.Enrollment) bool {
+					return assert.Equal(t,
+						&dps.Capabilities{IOTEdge: true}, e.Capabilities,
+					)
+				})).
+				Return(&dps.Enrollment{
+					RegistrationID: self.DeviceID,
+					Attestation: &dps.Attestation{
+						Type: dps.AttestationTypeSymmetricKey,
+						SymmetricKey: &dps.SymmetricKey{
+							Primary:   dps.Key("primary"),
+							Secondary: dps.Key("secondary"),
+						},
+					},
+				}, nil)
+			return dpsMock
+		},
+		Wf: func(t *testing.T, self *testCase) *mworkflows.Client {
+			wf := new(mworkflows.Client)
+			wf.On("ProvisionExternalDevice", contextMatcher, self.DeviceID,
+				model.ProviderIoTHub,
+				mock.AnythingOfType("map[string]string"),
+			).Return(nil)
+			return wf
+		},
+	}, {
+		Name: "ok/enrollment group",
+
+		DeviceID: "68ac6f41-c2e7-429f-a4bd-852fac9a5045",
+		DPS: &model.DPSSettings{
+			ConnectionString:  dpsCS,
+			IDScope:           "0ne00000001",
+			GlobalEndpoint:    "dps.example.com",
+			EnrollmentGroupID: "mender",
+		},
+
+		DPSClient: func(t *testing.T, self *testCase) *mdps.Client {
+			dpsMock := new(mdps.Client)
+			dpsMock.On("GetEnrollmentGroup", contextMatcher, dpsCS, "mender").
+				Return(&dps.EnrollmentGroup{
+					EnrollmentGroupID: "mender",
+					Attestation: &dps.Attestation{
+						Type:         dps.AttestationTypeSymmetricKey,
+						SymmetricKey: groupKeys,
+					},
+				}, nil)
+			return dpsMock
+		},
+		Wf: func(t *testing.T, self *testCase) *mworkflows.Client {
+			wf := new(mworkflows.Client)
+			primary := dps.DeriveKey(groupKeys.Primary, self.DeviceID)
+			secondary := dps.DeriveKey(groupKeys.Secondary, self.DeviceID)
+			wf.On("ProvisionExternalDevice", contextMatcher, self.DeviceID,
+				model.ProviderIoTHub,
+				map[string]string{
+					confKeyDPSIDScope:        self.DPS.IDScope,
+					confKeyDPSRegistrationID: self.DeviceID,
+					confKeyDPSGlobalEndpoint: "dps.example.com",
+					confKeyDPSPrimaryKey: base64.StdEncoding.
+						EncodeToString(primary),
+					confKeyDPSSecondaryKey: base64.StdEncoding.
+						EncodeToString(secondary),
+				}).Return(nil)
+			return wf
+		},
+	}, {
+		Name: "error/enrollment group not found",
+
+		DeviceID: "68ac6f41-c2e7-429f-a4bd-852fac9a5045",
+		DPS: &model.DPSSettings{
+			ConnectionString:  dpsCS,
+			IDScope:           "0ne00000001",
+			EnrollmentGroupID: "mender",
+		},
+
+		DPSClient: func(t *testing.T, self *testCase) *mdps.Client {
+			dpsMock := new(mdps.Client)
+			dpsMock.On("GetEnrollmentGroup", contextMatcher, dpsCS, "mender").
+				Return(nil, client.HTTPError{Code: http.StatusNotFound})
+			return dpsMock
+		},
+		Wf: func(t *testing.T, self *testCase) *mworkflows.Client {
+			return new(mworkflows.Client)
+		},
+		Error: ErrEnrollmentGroupNotFound,
+	}, {
+		Name: "error/enrollment group not symmetric",
+
+		DeviceID: "68ac6f41-c2e7-429f-a4bd-852fac9a5045",
+		DPS: &model.DPSSettings{
+			ConnectionString:  dpsCS,
+			IDScope:           "0ne00000001",
+			EnrollmentGroupID: "mender",
+		},
+
+		DPSClient: func(t *testing.T, self *testCase) *mdps.Client {
+			dpsMock := new(mdps.Client)
+			dpsMock.On("GetEnrollmentGroup", contextMatcher, dpsCS, "mender").
+				Return(&dps.EnrollmentGroup{
+					EnrollmentGroupID: "mender",
+					Attestation: &dps.Attestation{
+						Type: dps.AttestationTypeX509,
+					},
+				}, nil)
+			return dpsMock
+		},
+		Wf: func(t *testing.T, self *testCase) *mworkflows.Client {
+			return new(mworkflows.Client)
+		},
+		Error: ErrEnrollmentGroupNotSymmetric,
+	}, {
+		Name: "error/create enrollment",
+
+		DeviceID: "68ac6f41-c2e7-429f-a4bd-852fac9a5045",
+		DPS: &model.DPSSettings{
+			ConnectionString: dpsCS,
+			IDScope:          "0ne00000001",
+		},
+
+		DPSClient: func(t *testing.T, self *testCase) *mdps.Client {
+			dpsMock := new(mdps.Client)
+			dpsMock.On("UpsertEnrollment", contextMatcher, dpsCS,
+				mock.AnythingOfType("*dps.Enrollment")).
+				Return(nil, errors.New("internal error"))
+			return dpsMock
+		},
+		Wf: func(t *testing.T, self *testCase) *mworkflows.Client {
+			return new(mworkflows.Client)
+		},
+		Error: errors.New("failed to create dps enrollment: internal error"),
+	}, {
+		Name: "error/no dps settings",
+
+		DeviceID: "68ac6f41-c2e7-429f-a4bd-852fac9a5045",
+
+		DPSClient: func(t *testing.T, self *testCase) *mdps.Client {
+			return new(mdps.Client)
+		},
+		Wf: func(t *testing.T, self *testCase) *mworkflows.Client {
+			return new(mworkflows.Client)
+		},
+		Error: ErrNoDPSSettings,
+	}}
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			ctx := context.Background()
+			ds := new(storeMocks.DataStore)
+			ds.On("GetSettings", contextMatcher).
+				Return(model.Settings{Integrations: []model.Integration{{
+					ConnectionString:  hubCS,
+					ProvisioningMode:  model.ProvisioningModeDPS,
+					DPS:               tc.DPS,
+					ProvisioningRules: tc.Rules,
+				}}}, nil).
+				On("UpsertDevice", contextMatcher, tc.DeviceID,
+					mock.AnythingOfType("model.DeviceUpdate")).
+				Return(nil)
+			hub := new(miothub.Client)
+			dpsClient := tc.DPSClient(t, &tc)
+			wf := tc.Wf(t, &tc)
+			defer ds.AssertExpectations(t)
+			defer hub.AssertExpectations(t)
+			defer dpsClient.AssertExpectations(t)
+			defer wf.AssertExpectations(t)
+
+			app := New(ds, hub, wf, NewOptions().SetDPS(dpsClient))
+			err := app.ProvisionDevice(ctx, tc.DeviceID, tc.DeviceType)
+
+			if tc.Error != nil {
+				if assert.Error(t, err) {
+					assert.Regexp(t, tc.Error.Error(), err.Error())
+				}
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestDecommissionDeviceDPS(t *testing.T) {
+	t.Parallel()
+	hubCS := &model.ConnectionString{
+		HostName: "mender.azure-devices.net",
+		Key:      []byte("super secret"),
+		Name:     "iothubowner",
+	}
+	dpsCS := &model.ConnectionString{
+		HostName: "mender.azure-devices-provisioning.net",
+		Key:      []byte("even more secret"),
+		Name:     "provisioningserviceowner",
+	}
+	const deviceID = "68ac6f41-c2e7-429f-a4bd-852fac9a5045"
+	type testCase struct {
+		Name string
+
+		EnrollmentGroupID string
+
+		DPSClient func(t *testing.T, self *testCase) *mdps.Client
+		Hub       func(t *testing.T, self *testCase) *miothub.Client
+
+		Error error
+	}
+	testCases := []testCase{{
+		Name: "ok/individual enrollment",
+
+		DPSClient: func(t *testing.T, self *testCase) *mdps.Client {
+			dpsMock := new(mdps.Client)
+			dpsMock.On("DeleteEnrollment", contextMatcher, dpsCS, deviceID).
+				Return(nil)
+			return dpsMock
+		},
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			hub := new(miothub.Client)
+			hub.On("DeleteDevice", contextMatcher, hubCS, deviceID).
+				Return(nil)
+			return hub
+		},
+	}, {
+		Name: "ok/device never registered",
+
+		EnrollmentGroupID: "mender",
+
+		DPSClient: func(t *testing.T, self *testCase) *mdps.Client {
+			return new(mdps.Client)
+		},
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			hub := new(miothub.Client)
+			hub.On("DeleteDevice", contextMatcher, hubCS, deviceID).
+				Return(client.HTTPError{Code: http.StatusNotFound})
+			return hub
+		},
+	}, {
+		Name: "error/delete enrollment",
+
+		DPSClient: func(t *testing.T, self *testCase) *mdps.Client {
+			dpsMock := new(mdps.Client)
+			dpsMock.On("DeleteEnrollment", contextMatcher, dpsCS, deviceID).
+				Return(errors.New("internal error"))
+			return dpsMock
+		},
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			return new(miothub.Client)
+		},
+		Error: errors.New("failed to delete dps enrollment: internal error"),
+	}}
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			ctx := context.Background()
+			ds := new(storeMocks.DataStore)
+			ds.On("GetSettings", contextMatcher).
+				Return(model.Settings{Integrations: []model.Integration{{
+					ConnectionString: hubCS,
+					ProvisioningMode: model.ProvisioningModeDPS,
+					DPS: &model.DPSSettings{
+						ConnectionString:  dpsCS,
+						IDScope:           "0ne00000001",
+						EnrollmentGroupID: tc.EnrollmentGroupID,
+					},
+				}}}, nil)
+			if tc.Error == nil {
+				ds.On("DeleteDevice", contextMatcher, deviceID).Return(nil)
+			} else {
+				ds.On("UpsertDevice", contextMatcher, deviceID,
+					mock.AnythingOfType("model.DeviceUpdate")).
+					Return(nil)
+			}
+			hub := tc.Hub(t, &tc)
+			dpsClient := tc.DPSClient(t, &tc)
+			defer ds.AssertExpectations(t)
+			defer hub.AssertExpectations(t)
+			defer dpsClient.AssertExpectations(t)
+
+			app := New(ds, hub, nil, NewOptions().SetDPS(dpsClient))
+			err := app.DeleteIOTHubDevice(ctx, deviceID)
+
+			if tc.Error != nil {
+				if assert.Error(t, err) {
+					assert.Regexp(t, tc.Error.Error(), err.Error())
+				}
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
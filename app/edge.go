@@ -0,0 +1,107 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package app
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+
+	"github.com/mendersoftware/iot-manager/client"
+	"github.com/mendersoftware/iot-manager/client/iothub"
+	"github.com/mendersoftware/iot-manager/model"
+)
+
+var (
+	ErrParentNotEdgeDevice = errors.New(
+		"the parent device is not an IoT Edge device",
+	)
+	ErrDownstreamAuthNotSupported = errors.New(
+		"only devices authenticating with symmetric keys " +
+			"can be attached to a parent device",
+	)
+	ErrDeviceScopeModified = errors.New(
+		"the device was modified while updating its parent, please try again",
+	)
+)
+
+// SetDeviceParent attaches the device to the scope of the parent IoT Edge
+// device in the IoT Hub of the integration, or of the first IoT Hub
+// integration including the device if integrationID is nil, and sends the
+// device connection strings through the gateway hostname of the parent.
+// An empty parentID detaches the device from its parent.
+func (a *app) SetDeviceParent(
+	ctx context.Context,
+	integrationID uuid.UUID,
+	deviceID, parentID, gatewayHostName string,
+) error {
+	cs, err := a.deviceHubConnectionString(ctx, integrationID, deviceID)
+	if err != nil {
+		return err
+	}
+	var parentScopes []string
+	if parentID != "" {
+		parent, err := a.hub.GetDevice(ctx, cs, parentID)
+		if err != nil {
+			return errors.Wrap(err, "failed to retrieve parent device from IoT Hub")
+		}
+		if parent.DeviceCapabilities == nil || !parent.DeviceCapabilities.IOTEdge {
+			return ErrParentNotEdgeDevice
+		}
+		parentScopes = []string{parent.DeviceScope}
+	} else {
+		gatewayHostName = ""
+	}
+	dev, err := a.hub.GetDevice(ctx, cs, deviceID)
+	if err != nil {
+		return errors.Wrap(err, "failed to retrieve device from IoT Hub")
+	}
+	if dev.Auth == nil || dev.Auth.Type != iothub.AuthTypeSymmetric {
+		return ErrDownstreamAuthNotSupported
+	}
+	// A downstream device belongs to the scope of its parent, the device
+	// scope of an IoT Edge device is managed by the IoT Hub.
+	if dev.DeviceCapabilities == nil || !dev.DeviceCapabilities.IOTEdge {
+		dev.DeviceScope = ""
+		if len(parentScopes) > 0 {
+			dev.DeviceScope = parentScopes[0]
+		}
+	}
+	dev.ParentScopes = parentScopes
+	// The device ETag makes the update fail if the device changed since
+	// it was retrieved.
+	dev, err = a.hub.UpsertDevice(ctx, cs, deviceID, dev)
+	if err != nil {
+		if htErr, ok := err.(client.HTTPError); ok &&
+			htErr.Code == http.StatusPreconditionFailed {
+			return ErrDeviceScopeModified
+		}
+		return errors.Wrap(err, "failed to update IoT Hub device scope")
+	}
+	config, err := symmetricKeyConfig(cs, dev, gatewayHostName)
+	if err != nil {
+		return err
+	}
+	err = a.wf.ProvisionExternalDevice(ctx, dev.DeviceID, model.ProviderIoTHub, config)
+	if err != nil {
+		return errors.Wrap(err, "failed to submit iothub authn to deviceconfig")
+	}
+	err = a.store.UpsertDevice(ctx, deviceID, model.DeviceUpdate{
+		GatewayHostName: &gatewayHostName,
+	})
+	return errors.Wrap(err, "failed to update device record")
+}
@@ -0,0 +1,341 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package app
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/mendersoftware/iot-manager/client"
+	"github.com/mendersoftware/iot-manager/client/iothub"
+	miothub "github.com/mendersoftware/iot-manager/client/iothub/mocks"
+	mworkflows "github.com/mendersoftware/iot-manager/client/workflows/mocks"
+	"github.com/mendersoftware/iot-manager/model"
+	storeMocks "github.com/mendersoftware/iot-manager/store/mocks"
+)
+
+func TestSetDeviceParent(t *testing.T) {
+	t.Parallel()
+	const (
+		deviceID    = "68ac6f41-c2e7-429f-a4bd-852fac9a5045"
+		parentID    = "0b5d2e9c-3b2a-4a38-9d2a-2b1a3f4c5d6e"
+		parentScope = "ms-azure-iot-edge://" + parentID + "-637"
+		gateway     = "gateway.local"
+	)
+	primary := iothub.Key("primary")
+	secondary := iothub.Key("secondary")
+	cs := &model.ConnectionString{
+		HostName: "localhost",
+		Key:      []byte("super secret"),
+		Name:     "my favorite string",
+	}
+	hubID := uuid.New()
+	settings := model.Settings{Integrations: []model.Integration{{
+		ID:               hubID,
+		Provider:         model.ProviderIoTHub,
+		ConnectionString: cs,
+	}}}
+	parentDevice := func() *iothub.Device {
+		return &iothub.Device{
+			DeviceID:           parentID,
+			DeviceScope:        parentScope,
+			DeviceCapabilities: &iothub.DeviceCapabilities{IOTEdge: true},
+		}
+	}
+	hubDevice := func() *iothub.Device {
+		return &iothub.Device{
+			DeviceID: deviceID,
+			ETag:     "MjAyMQ==",
+			Auth: &iothub.Auth{
+				Type: iothub.AuthTypeSymmetric,
+				SymmetricKey: &iothub.SymmetricKey{
+					Primary:   primary,
+					Secondary: secondary,
+				},
+			},
+		}
+	}
+	echoDevice := func(
+		_ context.Context,
+		_ *model.ConnectionString,
+		_ string,
+		devs ...*iothub.Device,
+	) *iothub.Device {
+		return devs[0]
+	}
+	deviceConfig := func(gatewayHostName string) map[string]string {
+		return map[string]string{
+			confKeyPrimaryKey: (&model.ConnectionString{
+				HostName:        cs.HostName,
+				GatewayHostName: gatewayHostName,
+				DeviceID:        deviceID,
+				Key:             primary,
+			}).String(),
+			confKeySecondaryKey: (&model.ConnectionString{
+				HostName:        cs.HostName,
+				GatewayHostName: gatewayHostName,
+				DeviceID:        deviceID,
+				Key:             secondary,
+			}).String(),
+		}
+	}
+	type testCase struct {
+		Name string
+
+		ParentID        string
+		GatewayHostName string
+
+		Hub   func(t *testing.T) *miothub.Client
+		Wf    func(t *testing.T) *mworkflows.Client
+		Store func(t *testing.T, ds *storeMocks.DataStore)
+
+		Error error
+	}
+	testCases := []testCase{{
+		Name: "ok, attach device",
+
+		ParentID:        parentID,
+		GatewayHostName: gateway,
+
+		Hub: func(t *testing.T) *miothub.Client {
+			hub := new(miothub.Client)
+			hub.On("GetDevice", contextMatcher, cs, parentID).
+				Return(parentDevice(), nil).
+				On("GetDevice", contextMatcher, cs, deviceID).
+				Return(hubDevice(), nil).
+				On("UpsertDevice", contextMatcher, cs, deviceID,
+					mock.MatchedBy(func(dev *iothub.Device) bool {
+						return dev.ETag == "MjAyMQ==" &&
+							dev.DeviceScope == parentScope &&
+							assert.Equal(t,
+								[]string{parentScope}, dev.ParentScopes,
+							)
+					})).
+				Return(echoDevice, nil)
+			return hub
+		},
+		Wf: func(t *testing.T) *mworkflows.Client {
+			wf := new(mworkflows.Client)
+			wf.On("ProvisionExternalDevice",
+				contextMatcher, deviceID, model.ProviderIoTHub,
+				deviceConfig(gateway),
+			).Return(nil)
+			return wf
+		},
+		Store: func(t *testing.T, ds *storeMocks.DataStore) {
+			gatewayHostName := gateway
+			ds.On("UpsertDevice", contextMatcher, deviceID, model.DeviceUpdate{
+				GatewayHostName: &gatewayHostName,
+			}).Return(nil)
+		},
+	}, {
+		Name: "ok, detach device",
+
+		Hub: func(t *testing.T) *miothub.Client {
+			hub := new(miothub.Client)
+			dev := hubDevice()
+			dev.DeviceScope = parentScope
+			dev.ParentScopes = []string{parentScope}
+			hub.On("GetDevice", contextMatcher, cs, deviceID).
+				Return(dev, nil).
+				On("UpsertDevice", contextMatcher, cs, deviceID,
+					mock.MatchedBy(func(dev *iothub.Device) bool {
+						return dev.DeviceScope == "" &&
+							len(dev.ParentScopes) == 0
+					})).
+				Return(echoDevice, nil)
+			return hub
+		},
+		Wf: func(t *testing.T) *mworkflows.Client {
+			wf := new(mworkflows.Client)
+			wf.On("ProvisionExternalDevice",
+				contextMatcher, deviceID, model.ProviderIoTHub,
+				deviceConfig(""),
+			).Return(nil)
+			return wf
+		},
+		Store: func(t *testing.T, ds *storeMocks.DataStore) {
+			var gatewayHostName string
+			ds.On("UpsertDevice", contextMatcher, deviceID, model.DeviceUpdate{
+				GatewayHostName: &gatewayHostName,
+			}).Return(nil)
+		},
+	}, {
+		Name: "ok, edge device keeps its scope",
+
+		ParentID:        parentID,
+		GatewayHostName: gateway,
+
+		Hub: func(t *testing.T) *miothub.Client {
+			hub := new(miothub.Client)
+			dev := hubDevice()
+			dev.DeviceScope = "ms-azure-iot-edge://" + deviceID + "-42"
+			dev.DeviceCapabilities = &iothub.DeviceCapabilities{IOTEdge: true}
+			hub.On("GetDevice", contextMatcher, cs, parentID).
+				Return(parentDevice(), nil).
+				On("GetDevice", contextMatcher, cs, deviceID).
+				Return(dev, nil).
+				On("UpsertDevice", contextMatcher, cs, deviceID,
+					mock.MatchedBy(func(d *iothub.Device) bool {
+						return d.DeviceScope == dev.DeviceScope &&
+							len(d.ParentScopes) == 1
+					})).
+				Return(echoDevice, nil)
+			return hub
+		},
+		Wf: func(t *testing.T) *mworkflows.Client {
+			wf := new(mworkflows.Client)
+			wf.On("ProvisionExternalDevice",
+				contextMatcher, deviceID, model.ProviderIoTHub,
+				deviceConfig(gateway),
+			).Return(nil)
+			return wf
+		},
+		Store: func(t *testing.T, ds *storeMocks.DataStore) {
+			ds.On("UpsertDevice", contextMatcher, deviceID,
+				mock.AnythingOfType("model.DeviceUpdate"),
+			).Return(nil)
+		},
+	}, {
+		Name: "error, parent is not an edge device",
+
+		ParentID:        parentID,
+		GatewayHostName: gateway,
+
+		Hub: func(t *testing.T) *miothub.Client {
+			hub := new(miothub.Client)
+			parent := parentDevice()
+			parent.DeviceCapabilities = nil
+			hub.On("GetDevice", contextMatcher, cs, parentID).
+				Return(parent, nil)
+			return hub
+		},
+		Error: ErrParentNotEdgeDevice,
+	}, {
+		Name: "error, parent not found",
+
+		ParentID:        parentID,
+		GatewayHostName: gateway,
+
+		Hub: func(t *testing.T) *miothub.Client {
+			hub := new(miothub.Client)
+			hub.On("GetDevice", contextMatcher, cs, parentID).
+				Return(nil, errors.New("not found"))
+			return hub
+		},
+		Error: errors.New("failed to retrieve parent device from IoT Hub: " +
+			"not found"),
+	}, {
+		Name: "error, device authenticates with certificates",
+
+		ParentID:        parentID,
+		GatewayHostName: gateway,
+
+		Hub: func(t *testing.T) *miothub.Client {
+			hub := new(miothub.Client)
+			dev := hubDevice()
+			dev.Auth = &iothub.Auth{Type: iothub.AuthTypeSelfSigned}
+			hub.On("GetDevice", contextMatcher, cs, parentID).
+				Return(parentDevice(), nil).
+				On("GetDevice", contextMatcher, cs, deviceID).
+				Return(dev, nil)
+			return hub
+		},
+		Error: ErrDownstreamAuthNotSupported,
+	}, {
+		Name: "error, device modified",
+
+		ParentID:        parentID,
+		GatewayHostName: gateway,
+
+		Hub: func(t *testing.T) *miothub.Client {
+			hub := new(miothub.Client)
+			hub.On("GetDevice", contextMatcher, cs, parentID).
+				Return(parentDevice(), nil).
+				On("GetDevice", contextMatcher, cs, deviceID).
+				Return(hubDevice(), nil).
+				On("UpsertDevice", contextMatcher, cs, deviceID,
+					mock.AnythingOfType("*iothub.Device"),
+				).
+				Return(nil, client.HTTPError{Code: http.StatusPreconditionFailed})
+			return hub
+		},
+		Error: ErrDeviceScopeModified,
+	}, {
+		Name: "error, submitting device config",
+
+		ParentID:        parentID,
+		GatewayHostName: gateway,
+
+		Hub: func(t *testing.T) *miothub.Client {
+			hub := new(miothub.Client)
+			hub.On("GetDevice", contextMatcher, cs, parentID).
+				Return(parentDevice(), nil).
+				On("GetDevice", contextMatcher, cs, deviceID).
+				Return(hubDevice(), nil).
+				On("UpsertDevice", contextMatcher, cs, deviceID,
+					mock.AnythingOfType("*iothub.Device"),
+				).
+				Return(echoDevice, nil)
+			return hub
+		},
+		Wf: func(t *testing.T) *mworkflows.Client {
+			wf := new(mworkflows.Client)
+			wf.On("ProvisionExternalDevice",
+				contextMatcher, deviceID, model.ProviderIoTHub,
+				mock.AnythingOfType("map[string]string"),
+			).Return(errors.New("internal error"))
+			return wf
+		},
+		Error: errors.New("failed to submit iothub authn to deviceconfig: " +
+			"internal error"),
+	}}
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			ds := new(storeMocks.DataStore)
+			ds.On("GetSettings", contextMatcher).Return(settings, nil)
+			if tc.Store != nil {
+				tc.Store(t, ds)
+			}
+			hub := tc.Hub(t)
+			wf := new(mworkflows.Client)
+			if tc.Wf != nil {
+				wf = tc.Wf(t)
+			}
+			defer ds.AssertExpectations(t)
+			defer hub.AssertExpectations(t)
+			defer wf.AssertExpectations(t)
+
+			err := New(ds, hub, wf).SetDeviceParent(context.Background(),
+				hubID, deviceID, tc.ParentID, tc.GatewayHostName,
+			)
+			if tc.Error != nil {
+				if assert.Error(t, err) {
+					assert.Regexp(t, tc.Error.Error(), err.Error())
+				}
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package app
+
+import (
+	"context"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+
+	"github.com/mendersoftware/iot-manager/client/iothub"
+)
+
+// ApplyDeviceConfigurationContent applies the configuration content, e.g.
+// an IoT Edge deployment manifest, to the device in the IoT Hub of the
+// integration, or of the first IoT Hub integration including the device if
+// integrationID is nil.
+func (a *app) ApplyDeviceConfigurationContent(
+	ctx context.Context,
+	integrationID uuid.UUID,
+	deviceID string,
+	content iothub.ConfigurationContent,
+) error {
+	cs, err := a.deviceHubConnectionString(ctx, integrationID, deviceID)
+	if err != nil {
+		return err
+	}
+	err = a.hub.ApplyConfigurationContent(ctx, cs, deviceID, &content)
+	return errors.Wrap(err, "failed to apply configuration content to the device")
+}
+
+// GetHubConfigurations returns up to top configurations of the IoT Hub
+// integration.
+func (a *app) GetHubConfigurations(
+	ctx context.Context,
+	integrationID uuid.UUID,
+	top int,
+) ([]iothub.Configuration, error) {
+	cs, err := a.hubConnectionString(ctx, integrationID)
+	if err != nil {
+		return nil, err
+	}
+	configs, err := a.hub.GetConfigurations(ctx, cs, top)
+	return configs, errors.Wrap(err, "failed to retrieve IoT Hub configurations")
+}
+
+// GetHubConfiguration returns the configuration of the IoT Hub integration.
+func (a *app) GetHubConfiguration(
+	ctx context.Context,
+	integrationID uuid.UUID,
+	configID string,
+) (*iothub.Configuration, error) {
+	cs, err := a.hubConnectionString(ctx, integrationID)
+	if err != nil {
+		return nil, err
+	}
+	config, err := a.hub.GetConfiguration(ctx, cs, configID)
+	return config, errors.Wrap(err, "failed to retrieve IoT Hub configuration")
+}
+
+// UpsertHubConfiguration creates or updates the configuration of the IoT Hub
+// integration.
+func (a *app) UpsertHubConfiguration(
+	ctx context.Context,
+	integrationID uuid.UUID,
+	config iothub.Configuration,
+) (*iothub.Configuration, error) {
+	cs, err := a.hubConnectionString(ctx, integrationID)
+	if err != nil {
+		return nil, err
+	}
+	res, err := a.hub.UpsertConfiguration(ctx, cs, &config)
+	return res, errors.Wrap(err, "failed to update IoT Hub configuration")
+}
+
+// DeleteHubConfiguration deletes the configuration of the IoT Hub
+// integration, if etag is not empty the configuration is deleted only if it
+// did not change.
+func (a *app) DeleteHubConfiguration(
+	ctx context.Context,
+	integrationID uuid.UUID,
+	configID, etag string,
+) error {
+	cs, err := a.hubConnectionString(ctx, integrationID)
+	if err != nil {
+		return err
+	}
+	err = a.hub.DeleteConfiguration(ctx, cs, configID, etag)
+	return errors.Wrap(err, "failed to delete IoT Hub configuration")
+}
@@ -0,0 +1,237 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package app
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/iot-manager/client/iothub"
+	miothub "github.com/mendersoftware/iot-manager/client/iothub/mocks"
+	"github.com/mendersoftware/iot-manager/model"
+	storeMocks "github.com/mendersoftware/iot-manager/store/mocks"
+)
+
+func TestHubConfigurations(t *testing.T) {
+	t.Parallel()
+	const deviceID = "6c985f61-5093-45eb-8ece-7dfe97a6de7b"
+	cs := &model.ConnectionString{
+		HostName: "localhost",
+		Key:      []byte("super secret"),
+		Name:     "my favorite string",
+	}
+	hubID := uuid.New()
+	settings := model.Settings{Integrations: []model.Integration{{
+		ID:               hubID,
+		Provider:         model.ProviderIoTHub,
+		ConnectionString: cs,
+	}}}
+	content := iothub.ConfigurationContent{
+		DeviceContent: map[string]interface{}{
+			"properties.desired.interval": 30,
+		},
+	}
+	config := &iothub.Configuration{
+		ID:              "interval-30",
+		Content:         content,
+		TargetCondition: "tags.site='oslo'",
+		Priority:        10,
+		ETag:            "MQ==",
+	}
+	testCases := []struct {
+		Name string
+
+		Call func(a App) (interface{}, error)
+		Hub  func(t *testing.T) *miothub.Client
+
+		Result interface{}
+		Error  error
+	}{{
+		Name: "ok, apply configuration content",
+
+		Call: func(a App) (interface{}, error) {
+			return nil, a.ApplyDeviceConfigurationContent(
+				context.Background(), hubID, deviceID, content,
+			)
+		},
+		Hub: func(t *testing.T) *miothub.Client {
+			hub := new(miothub.Client)
+			hub.On("ApplyConfigurationContent",
+				contextMatcher, cs, deviceID, &content,
+			).Return(nil)
+			return hub
+		},
+	}, {
+		Name: "error, apply configuration content",
+
+		Call: func(a App) (interface{}, error) {
+			return nil, a.ApplyDeviceConfigurationContent(
+				context.Background(), hubID, deviceID, content,
+			)
+		},
+		Hub: func(t *testing.T) *miothub.Client {
+			hub := new(miothub.Client)
+			hub.On("ApplyConfigurationContent",
+				contextMatcher, cs, deviceID, &content,
+			).Return(errors.New("not found"))
+			return hub
+		},
+		Error: errors.New("failed to apply configuration content to " +
+			"the device: not found"),
+	}, {
+		Name: "error, integration not found",
+
+		Call: func(a App) (interface{}, error) {
+			return a.GetHubConfigurations(context.Background(),
+				uuid.New(), 0,
+			)
+		},
+		Hub: func(t *testing.T) *miothub.Client {
+			return new(miothub.Client)
+		},
+		Error: ErrIntegrationNotFound,
+	}, {
+		Name: "ok, get configurations",
+
+		Call: func(a App) (interface{}, error) {
+			return a.GetHubConfigurations(context.Background(), hubID, 5)
+		},
+		Hub: func(t *testing.T) *miothub.Client {
+			hub := new(miothub.Client)
+			hub.On("GetConfigurations", contextMatcher, cs, 5).
+				Return([]iothub.Configuration{*config}, nil)
+			return hub
+		},
+		Result: []iothub.Configuration{*config},
+	}, {
+		Name: "ok, get configuration",
+
+		Call: func(a App) (interface{}, error) {
+			return a.GetHubConfiguration(context.Background(),
+				hubID, config.ID,
+			)
+		},
+		Hub: func(t *testing.T) *miothub.Client {
+			hub := new(miothub.Client)
+			hub.On("GetConfiguration", contextMatcher, cs, config.ID).
+				Return(config, nil)
+			return hub
+		},
+		Result: config,
+	}, {
+		Name: "error, get configuration",
+
+		Call: func(a App) (interface{}, error) {
+			return a.GetHubConfiguration(context.Background(),
+				hubID, config.ID,
+			)
+		},
+		Hub: func(t *testing.T) *miothub.Client {
+			hub := new(miothub.Client)
+			hub.On("GetConfiguration", contextMatcher, cs, config.ID).
+				Return(nil, errors.New("not found"))
+			return hub
+		},
+		Error: errors.New("failed to retrieve IoT Hub configuration: " +
+			"not found"),
+	}, {
+		Name: "ok, upsert configuration",
+
+		Call: func(a App) (interface{}, error) {
+			return a.UpsertHubConfiguration(context.Background(),
+				hubID, *config,
+			)
+		},
+		Hub: func(t *testing.T) *miothub.Client {
+			hub := new(miothub.Client)
+			hub.On("UpsertConfiguration", contextMatcher, cs, config).
+				Return(config, nil)
+			return hub
+		},
+		Result: config,
+	}, {
+		Name: "error, upsert configuration",
+
+		Call: func(a App) (interface{}, error) {
+			return a.UpsertHubConfiguration(context.Background(),
+				hubID, *config,
+			)
+		},
+		Hub: func(t *testing.T) *miothub.Client {
+			hub := new(miothub.Client)
+			hub.On("UpsertConfiguration", contextMatcher, cs, config).
+				Return(nil, errors.New("precondition failed"))
+			return hub
+		},
+		Error: errors.New("failed to update IoT Hub configuration: " +
+			"precondition failed"),
+	}, {
+		Name: "ok, delete configuration",
+
+		Call: func(a App) (interface{}, error) {
+			return nil, a.DeleteHubConfiguration(context.Background(),
+				hubID, config.ID, config.ETag,
+			)
+		},
+		Hub: func(t *testing.T) *miothub.Client {
+			hub := new(miothub.Client)
+			hub.On("DeleteConfiguration",
+				contextMatcher, cs, config.ID, config.ETag,
+			).Return(nil)
+			return hub
+		},
+	}, {
+		Name: "error, delete configuration",
+
+		Call: func(a App) (interface{}, error) {
+			return nil, a.DeleteHubConfiguration(context.Background(),
+				hubID, config.ID, "",
+			)
+		},
+		Hub: func(t *testing.T) *miothub.Client {
+			hub := new(miothub.Client)
+			hub.On("DeleteConfiguration",
+				contextMatcher, cs, config.ID, "",
+			).Return(errors.New("not found"))
+			return hub
+		},
+		Error: errors.New("failed to delete IoT Hub configuration: " +
+			"not found"),
+	}}
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			ds := new(storeMocks.DataStore)
+			ds.On("GetSettings", contextMatcher).Return(settings, nil)
+			hub := tc.Hub(t)
+			defer ds.AssertExpectations(t)
+			defer hub.AssertExpectations(t)
+
+			res, err := tc.Call(New(ds, hub, nil))
+			if tc.Error != nil {
+				if assert.Error(t, err) {
+					assert.Regexp(t, tc.Error.Error(), err.Error())
+				}
+			} else if assert.NoError(t, err) && tc.Result != nil {
+				assert.Equal(t, tc.Result, res)
+			}
+		})
+	}
+}
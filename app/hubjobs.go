@@ -0,0 +1,103 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package app
+
+import (
+	"context"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+
+	"github.com/mendersoftware/iot-manager/client/iothub"
+	"github.com/mendersoftware/iot-manager/model"
+)
+
+// hubConnectionString returns the connection string of the IoT Hub
+// integration with the given ID.
+func (a *app) hubConnectionString(
+	ctx context.Context,
+	integrationID uuid.UUID,
+) (*model.ConnectionString, error) {
+	settings, err := a.GetSettings(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to retrieve settings")
+	}
+	integration, err := hubIntegration(settings, integrationID)
+	if err != nil {
+		return nil, err
+	}
+	return integration.ConnectionString, nil
+}
+
+// ScheduleHubJob schedules the twin update or direct method job on the
+// devices of the IoT Hub integration, the job ID is generated.
+func (a *app) ScheduleHubJob(
+	ctx context.Context,
+	integrationID uuid.UUID,
+	job iothub.Job,
+) (*iothub.Job, error) {
+	cs, err := a.hubConnectionString(ctx, integrationID)
+	if err != nil {
+		return nil, err
+	}
+	job.JobID = uuid.New().String()
+	res, err := a.hub.ScheduleJob(ctx, cs, &job)
+	return res, errors.Wrap(err, "failed to schedule IoT Hub job")
+}
+
+// GetHubJob returns the job of the IoT Hub integration.
+func (a *app) GetHubJob(
+	ctx context.Context,
+	integrationID uuid.UUID,
+	jobID string,
+) (*iothub.Job, error) {
+	cs, err := a.hubConnectionString(ctx, integrationID)
+	if err != nil {
+		return nil, err
+	}
+	job, err := a.hub.GetJob(ctx, cs, jobID)
+	return job, errors.Wrap(err, "failed to retrieve IoT Hub job")
+}
+
+// CancelHubJob cancels the job of the IoT Hub integration.
+func (a *app) CancelHubJob(
+	ctx context.Context,
+	integrationID uuid.UUID,
+	jobID string,
+) (*iothub.Job, error) {
+	cs, err := a.hubConnectionString(ctx, integrationID)
+	if err != nil {
+		return nil, err
+	}
+	job, err := a.hub.CancelJob(ctx, cs, jobID)
+	return job, errors.Wrap(err, "failed to cancel IoT Hub job")
+}
+
+// QueryHubJobs returns a page of the jobs of the IoT Hub integration
+// matching the filter. The page starts at the continuation token returned
+// with the previous page.
+func (a *app) QueryHubJobs(
+	ctx context.Context,
+	integrationID uuid.UUID,
+	fltr iothub.JobFilter,
+	contToken string,
+) (*iothub.JobsPage, error) {
+	cs, err := a.hubConnectionString(ctx, integrationID)
+	if err != nil {
+		return nil, err
+	}
+	page, err := a.hub.QueryJobs(ctx, cs, fltr, contToken)
+	return page, errors.Wrap(err, "failed to retrieve IoT Hub jobs")
+}
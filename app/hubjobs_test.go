@@ -0,0 +1,285 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package app
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/mendersoftware/iot-manager/client/iothub"
+	miothub "github.com/mendersoftware/iot-manager/client/iothub/mocks"
+	"github.com/mendersoftware/iot-manager/model"
+	storeMocks "github.com/mendersoftware/iot-manager/store/mocks"
+)
+
+func TestScheduleHubJob(t *testing.T) {
+	t.Parallel()
+	cs := &model.ConnectionString{
+		HostName: "localhost",
+		Key:      []byte("super secret"),
+		Name:     "my favorite string",
+	}
+	hubID := uuid.New()
+	settings := model.Settings{Integrations: []model.Integration{{
+		ID:               hubID,
+		Provider:         model.ProviderIoTHub,
+		ConnectionString: cs,
+	}}}
+	job := iothub.Job{
+		Type:                iothub.JobTypeDeviceMethod,
+		QueryCondition:      "tags.mender = true",
+		CloudToDeviceMethod: &iothub.DirectMethod{Name: "reboot"},
+	}
+	matchJob := mock.MatchedBy(func(j *iothub.Job) bool {
+		if _, err := uuid.Parse(j.JobID); err != nil {
+			return false
+		}
+		expected := job
+		expected.JobID = j.JobID
+		return assert.ObjectsAreEqual(&expected, j)
+	})
+	type testCase struct {
+		Name string
+
+		IntegrationID uuid.UUID
+
+		Store func(t *testing.T, self *testCase) *storeMocks.DataStore
+		Hub   func(t *testing.T, self *testCase) *miothub.Client
+
+		Error error
+	}
+	testCases := []testCase{{
+		Name: "ok",
+
+		IntegrationID: hubID,
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			ds := new(storeMocks.DataStore)
+			ds.On("GetSettings", contextMatcher).Return(settings, nil)
+			return ds
+		},
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			hub := new(miothub.Client)
+			hub.On("ScheduleJob", contextMatcher, cs, matchJob).
+				Return(func(
+					_ context.Context,
+					_ *model.ConnectionString,
+					j *iothub.Job,
+				) *iothub.Job {
+					res := *j
+					res.Status = iothub.JobStatusQueued
+					return &res
+				}, nil)
+			return hub
+		},
+	}, {
+		Name: "error, integration not found",
+
+		IntegrationID: uuid.New(),
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			ds := new(storeMocks.DataStore)
+			ds.On("GetSettings", contextMatcher).Return(settings, nil)
+			return ds
+		},
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			return new(miothub.Client)
+		},
+		Error: ErrIntegrationNotFound,
+	}, {
+		Name: "error, retrieving settings",
+
+		IntegrationID: hubID,
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			ds := new(storeMocks.DataStore)
+			ds.On("GetSettings", contextMatcher).
+				Return(model.Settings{}, errors.New("internal error"))
+			return ds
+		},
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			return new(miothub.Client)
+		},
+		Error: errors.New("failed to retrieve settings: internal error"),
+	}, {
+		Name: "error, IoT Hub",
+
+		IntegrationID: hubID,
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			ds := new(storeMocks.DataStore)
+			ds.On("GetSettings", contextMatcher).Return(settings, nil)
+			return ds
+		},
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			hub := new(miothub.Client)
+			hub.On("ScheduleJob", contextMatcher, cs, matchJob).
+				Return(nil, errors.New("throttled"))
+			return hub
+		},
+		Error: errors.New("failed to schedule IoT Hub job: throttled"),
+	}}
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			ds := tc.Store(t, &tc)
+			hub := tc.Hub(t, &tc)
+			defer ds.AssertExpectations(t)
+			defer hub.AssertExpectations(t)
+
+			app := New(ds, hub, nil)
+			res, err := app.ScheduleHubJob(context.Background(),
+				tc.IntegrationID, job,
+			)
+			if tc.Error != nil {
+				if assert.Error(t, err) {
+					assert.Regexp(t, tc.Error.Error(), err.Error())
+				}
+			} else if assert.NoError(t, err) {
+				assert.NotEmpty(t, res.JobID)
+				assert.Equal(t, iothub.JobStatusQueued, res.Status)
+			}
+		})
+	}
+}
+
+func TestHubJobs(t *testing.T) {
+	t.Parallel()
+	cs := &model.ConnectionString{
+		HostName: "localhost",
+		Key:      []byte("super secret"),
+		Name:     "my favorite string",
+	}
+	hubID := uuid.New()
+	settings := model.Settings{Integrations: []model.Integration{{
+		ID:               hubID,
+		Provider:         model.ProviderIoTHub,
+		ConnectionString: cs,
+	}}}
+	job := &iothub.Job{
+		JobID:  "job-1",
+		Type:   iothub.JobTypeUpdateTwin,
+		Status: iothub.JobStatusRunning,
+	}
+	fltr := iothub.JobFilter{Status: iothub.JobStatusRunning}
+	page := &iothub.JobsPage{Jobs: []iothub.Job{*job}}
+	testCases := []struct {
+		Name string
+
+		Call func(a App) (interface{}, error)
+		Hub  func(t *testing.T) *miothub.Client
+
+		Result interface{}
+		Error  error
+	}{{
+		Name: "ok, get",
+
+		Call: func(a App) (interface{}, error) {
+			return a.GetHubJob(context.Background(), hubID, "job-1")
+		},
+		Hub: func(t *testing.T) *miothub.Client {
+			hub := new(miothub.Client)
+			hub.On("GetJob", contextMatcher, cs, "job-1").Return(job, nil)
+			return hub
+		},
+		Result: job,
+	}, {
+		Name: "error, get",
+
+		Call: func(a App) (interface{}, error) {
+			return a.GetHubJob(context.Background(), hubID, "job-1")
+		},
+		Hub: func(t *testing.T) *miothub.Client {
+			hub := new(miothub.Client)
+			hub.On("GetJob", contextMatcher, cs, "job-1").
+				Return(nil, errors.New("not found"))
+			return hub
+		},
+		Error: errors.New("failed to retrieve IoT Hub job: not found"),
+	}, {
+		Name: "ok, cancel",
+
+		Call: func(a App) (interface{}, error) {
+			return a.CancelHubJob(context.Background(), hubID, "job-1")
+		},
+		Hub: func(t *testing.T) *miothub.Client {
+			hub := new(miothub.Client)
+			hub.On("CancelJob", contextMatcher, cs, "job-1").Return(job, nil)
+			return hub
+		},
+		Result: job,
+	}, {
+		Name: "error, cancel",
+
+		Call: func(a App) (interface{}, error) {
+			return a.CancelHubJob(context.Background(), hubID, "job-1")
+		},
+		Hub: func(t *testing.T) *miothub.Client {
+			hub := new(miothub.Client)
+			hub.On("CancelJob", contextMatcher, cs, "job-1").
+				Return(nil, errors.New("not found"))
+			return hub
+		},
+		Error: errors.New("failed to cancel IoT Hub job: not found"),
+	}, {
+		Name: "ok, query",
+
+		Call: func(a App) (interface{}, error) {
+			return a.QueryHubJobs(context.Background(), hubID, fltr, "next")
+		},
+		Hub: func(t *testing.T) *miothub.Client {
+			hub := new(miothub.Client)
+			hub.On("QueryJobs", contextMatcher, cs, fltr, "next").
+				Return(page, nil)
+			return hub
+		},
+		Result: page,
+	}, {
+		Name: "error, query",
+
+		Call: func(a App) (interface{}, error) {
+			return a.QueryHubJobs(context.Background(), hubID, fltr, "next")
+		},
+		Hub: func(t *testing.T) *miothub.Client {
+			hub := new(miothub.Client)
+			hub.On("QueryJobs", contextMatcher, cs, fltr, "next").
+				Return(nil, errors.New("throttled"))
+			return hub
+		},
+		Error: errors.New("failed to retrieve IoT Hub jobs: throttled"),
+	}}
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			ds := new(storeMocks.DataStore)
+			ds.On("GetSettings", contextMatcher).Return(settings, nil)
+			hub := tc.Hub(t)
+			defer ds.AssertExpectations(t)
+			defer hub.AssertExpectations(t)
+
+			res, err := tc.Call(New(ds, hub, nil))
+			if tc.Error != nil {
+				if assert.Error(t, err) {
+					assert.Regexp(t, tc.Error.Error(), err.Error())
+				}
+			} else if assert.NoError(t, err) {
+				assert.Equal(t, tc.Result, res)
+			}
+		})
+	}
+}
@@ -0,0 +1,243 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package app
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+
+	"github.com/mendersoftware/iot-manager/model"
+)
+
+var (
+	ErrNoIntegrations = errors.New("no integrations configured for tenant")
+
+	ErrIntegrationNotFound = errors.New("integration not found")
+	ErrIntegrationExists   = errors.New("an integration with the same name already exists")
+)
+
+// IntegrationError is the error returned by an operation on a single
+// integration.
+type IntegrationError struct {
+	IntegrationID uuid.UUID
+	Err           error
+}
+
+func (err *IntegrationError) Error() string {
+	return "integration " + err.IntegrationID.String() + ": " + err.Err.Error()
+}
+
+// Cause returns the error returned by the integration.
+func (err *IntegrationError) Cause() error {
+	return err.Err
+}
+
+// IntegrationErrors collects the errors of an operation fanned out to
+// several integrations.
+type IntegrationErrors []*IntegrationError
+
+func (errs IntegrationErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (a *app) GetIntegrations(ctx context.Context) ([]model.Integration, error) {
+	settings, err := a.GetSettings(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to retrieve settings")
+	}
+	if settings.Integrations == nil {
+		return []model.Integration{}, nil
+	}
+	return settings.Integrations, nil
+}
+
+func (a *app) GetIntegration(
+	ctx context.Context,
+	integrationID uuid.UUID,
+) (*model.Integration, error) {
+	settings, err := a.GetSettings(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to retrieve settings")
+	}
+	integration := settings.Integration(integrationID)
+	if integration == nil {
+		return nil, ErrIntegrationNotFound
+	}
+	return integration, nil
+}
+
+func (a *app) CreateIntegration(
+	ctx context.Context,
+	integration model.Integration,
+) (*model.Integration, error) {
+	settings, err := a.GetSettings(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to retrieve settings")
+	}
+	for _, other := range settings.Integrations {
+		if other.Name == integration.Name {
+			return nil, ErrIntegrationExists
+		}
+	}
+	err = a.verifyIntegrations(ctx, settings, integration)
+	if err != nil {
+		return nil, err
+	}
+	integration.ID = uuid.New()
+	updateIntegration(&integration, nil, time.Now())
+	settings.Integrations = append(settings.Integrations, integration)
+	err = a.storeSettings(ctx, settings)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to store integration")
+	}
+	return &integration, nil
+}
+
+func (a *app) UpdateIntegration(
+	ctx context.Context,
+	integrationID uuid.UUID,
+	integration model.Integration,
+) error {
+	settings, err := a.GetSettings(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to retrieve settings")
+	}
+	current := settings.Integration(integrationID)
+	if current == nil {
+		return ErrIntegrationNotFound
+	}
+	for _, other := range settings.Integrations {
+		if other.ID != integrationID && other.Name == integration.Name {
+			return ErrIntegrationExists
+		}
+	}
+	integration.ID = integrationID
+	updateIntegration(&integration, current, time.Now())
+	if err = integration.Validate(); err != nil {
+		return &ValidationError{Err: err}
+	}
+	err = a.verifyIntegrations(ctx, settings, integration)
+	if err != nil {
+		return err
+	}
+	*current = integration
+	err = a.storeSettings(ctx, settings)
+	return errors.Wrap(err, "failed to store integration")
+}
+
+func (a *app) DeleteIntegration(ctx context.Context, integrationID uuid.UUID) error {
+	settings, err := a.GetSettings(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to retrieve settings")
+	}
+	integrations := make([]model.Integration, 0, len(settings.Integrations))
+	for _, integration := range settings.Integrations {
+		if integration.ID != integrationID {
+			integrations = append(integrations, integration)
+		}
+	}
+	if len(integrations) == len(settings.Integrations) {
+		return ErrIntegrationNotFound
+	}
+	settings.Integrations = integrations
+	err = a.storeSettings(ctx, settings)
+	return errors.Wrap(err, "failed to store settings")
+}
+
+// checkIntegration returns an error if the integration lacks the
+// credentials for talking to the provider.
+func (a *app) checkIntegration(integration model.Integration) error {
+	if integration.Provider == model.ProviderIoTCore {
+		_, err := a.awsCredentials(integration)
+		return err
+	} else if integration.ConnectionString == nil {
+		return ErrNoConnectionString
+	}
+	return nil
+}
+
+// deviceIntegrations returns the configured integrations whose scope
+// includes the device. If no integration applies to the device, the error
+// explains why.
+func (a *app) deviceIntegrations(
+	ctx context.Context,
+	deviceID string,
+) ([]model.Integration, error) {
+	settings, err := a.GetSettings(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to retrieve settings")
+	}
+	return a.settingsDeviceIntegrations(settings, deviceID)
+}
+
+// settingsDeviceIntegrations returns the integrations of the settings whose
+// scope includes the device.
+func (a *app) settingsDeviceIntegrations(
+	settings model.Settings,
+	deviceID string,
+) ([]model.Integration, error) {
+	var (
+		integrations = settings.DeviceIntegrations(deviceID)
+		configured   = integrations[:0]
+		err          = ErrNoIntegrations
+	)
+	for _, integration := range integrations {
+		if errCheck := a.checkIntegration(integration); errCheck != nil {
+			err = errCheck
+			continue
+		}
+		configured = append(configured, integration)
+	}
+	if len(configured) == 0 {
+		return nil, err
+	}
+	return configured, nil
+}
+
+// fanOut calls fn for every integration and collects the errors per
+// integration.
+func fanOut(integrations []model.Integration, fn func(model.Integration) error) error {
+	var errs IntegrationErrors
+	for _, integration := range integrations {
+		if err := fn(integration); err != nil {
+			errs = append(errs, &IntegrationError{
+				IntegrationID: integration.ID,
+				Err:           err,
+			})
+		}
+	}
+	return errs.err()
+}
+
+// err returns nil if errs is empty and the single error if there is only
+// one.
+func (errs IntegrationErrors) err() error {
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
+	default:
+		return errs
+	}
+}
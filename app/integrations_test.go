@@ -0,0 +1,418 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package app
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/mendersoftware/iot-manager/client/iothub"
+	miothub "github.com/mendersoftware/iot-manager/client/iothub/mocks"
+	mworkflows "github.com/mendersoftware/iot-manager/client/workflows/mocks"
+	"github.com/mendersoftware/iot-manager/model"
+	storeMocks "github.com/mendersoftware/iot-manager/store/mocks"
+)
+
+func TestCreateIntegration(t *testing.T) {
+	t.Parallel()
+	existing := model.Integration{
+		ID:   uuid.New(),
+		Name: "hub",
+		ConnectionString: &model.ConnectionString{
+			HostName: "localhost",
+			Key:      []byte("super secret"),
+			Name:     "my favorite string",
+		},
+	}
+	type testCase struct {
+		Name string
+
+		Integration model.Integration
+
+		Store func(t *testing.T, self *testCase) *storeMocks.DataStore
+
+		Error error
+	}
+	testCases := []testCase{{
+		Name: "ok",
+
+		Integration: model.Integration{
+			Name:             "other hub",
+			ConnectionString: existing.ConnectionString,
+		},
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			store := new(storeMocks.DataStore)
+			store.On("GetSettings", contextMatcher).
+				Return(model.Settings{
+					Integrations: []model.Integration{existing},
+				}, nil).
+				On("SetSettings", contextMatcher,
+					mock.MatchedBy(func(settings model.Settings) bool {
+						return assert.Len(t, settings.Integrations, 2) &&
+							assert.Equal(t, existing, settings.Integrations[0]) &&
+							assert.Equal(t, "other hub", settings.Integrations[1].Name) &&
+							assert.NotEqual(t, uuid.Nil, settings.Integrations[1].ID)
+					})).
+				Return(nil)
+			return store
+		},
+	}, {
+		Name: "error/name already exists",
+
+		Integration: model.Integration{
+			Name:             "hub",
+			ConnectionString: existing.ConnectionString,
+		},
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			store := new(storeMocks.DataStore)
+			store.On("GetSettings", contextMatcher).
+				Return(model.Settings{
+					Integrations: []model.Integration{existing},
+				}, nil)
+			return store
+		},
+		Error: ErrIntegrationExists,
+	}, {
+		Name: "error/store failure",
+
+		Integration: model.Integration{
+			Name:             "other hub",
+			ConnectionString: existing.ConnectionString,
+		},
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			store := new(storeMocks.DataStore)
+			store.On("GetSettings", contextMatcher).
+				Return(model.Settings{}, nil).
+				On("SetSettings", contextMatcher, mock.AnythingOfType("model.Settings")).
+				Return(errors.New("internal error"))
+			return store
+		},
+		Error: errors.New("failed to store integration: internal error"),
+	}}
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			ds := tc.Store(t, &tc)
+			defer ds.AssertExpectations(t)
+
+			app := New(ds, nil, nil,
+				NewOptions().SetConnectionStringVerification(false),
+			)
+			integration, err := app.CreateIntegration(context.Background(), tc.Integration)
+			if tc.Error != nil {
+				if assert.Error(t, err) {
+					assert.Regexp(t, tc.Error.Error(), err.Error())
+				}
+			} else if assert.NoError(t, err) {
+				assert.NotEqual(t, uuid.Nil, integration.ID)
+				assert.Equal(t, tc.Integration.Name, integration.Name)
+			}
+		})
+	}
+}
+
+func TestUpdateIntegration(t *testing.T) {
+	t.Parallel()
+	cs := &model.ConnectionString{
+		HostName: "localhost",
+		Key:      []byte("super secret"),
+		Name:     "my favorite string",
+	}
+	integrations := []model.Integration{{
+		ID:               uuid.New(),
+		Name:             "hub",
+		ConnectionString: cs,
+	}, {
+		ID:               uuid.New(),
+		Name:             "other hub",
+		ConnectionString: cs,
+	}}
+	type testCase struct {
+		Name string
+
+		ID          uuid.UUID
+		Integration model.Integration
+
+		Store func(t *testing.T, self *testCase) *storeMocks.DataStore
+
+		Error error
+	}
+	testCases := []testCase{{
+		Name: "ok",
+
+		ID: integrations[1].ID,
+		Integration: model.Integration{
+			Name:             "renamed hub",
+			ConnectionString: cs,
+			Scope: &model.DeviceScope{
+				DeviceIDs: []string{"device-1"},
+			},
+		},
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			store := new(storeMocks.DataStore)
+			store.On("GetSettings", contextMatcher).
+				Return(model.Settings{
+					Integrations: append([]model.Integration{}, integrations...),
+				}, nil).
+				On("SetSettings", contextMatcher,
+					mock.MatchedBy(func(settings model.Settings) bool {
+						expected := self.Integration
+						expected.ID = self.ID
+						if !assert.Len(t, settings.Integrations, 2) ||
+							!assert.NotNil(t, settings.Integrations[1].UpdatedTS) {
+							return false
+						}
+						expected.CreatedTS = settings.Integrations[1].CreatedTS
+						expected.UpdatedTS = settings.Integrations[1].UpdatedTS
+						return assert.Equal(t, []model.Integration{
+							integrations[0], expected,
+						}, settings.Integrations)
+					})).
+				Return(nil)
+			return store
+		},
+	}, {
+		Name: "ok/keep stored secrets",
+
+		ID: integrations[1].ID,
+		Integration: model.Integration{
+			Name: "renamed hub",
+		},
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			created := time.Now().Add(-time.Hour)
+			stored := append([]model.Integration{}, integrations...)
+			stored[1].CreatedTS = &created
+			store := new(storeMocks.DataStore)
+			store.On("GetSettings", contextMatcher).
+				Return(model.Settings{
+					Integrations: stored,
+				}, nil).
+				On("SetSettings", contextMatcher,
+					mock.MatchedBy(func(settings model.Settings) bool {
+						updated := settings.Integrations[1]
+						return assert.Equal(t, "renamed hub", updated.Name) &&
+							assert.Equal(t, cs, updated.ConnectionString) &&
+							assert.Equal(t, &created, updated.CreatedTS) &&
+							assert.True(t, updated.UpdatedTS.After(created))
+					})).
+				Return(nil)
+			return store
+		},
+	}, {
+		Name: "error/invalid after inheriting secrets",
+
+		ID: integrations[1].ID,
+		Integration: model.Integration{
+			Name:     "renamed hub",
+			Provider: model.ProviderIoTCore,
+		},
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			store := new(storeMocks.DataStore)
+			store.On("GetSettings", contextMatcher).
+				Return(model.Settings{
+					Integrations: append([]model.Integration{}, integrations...),
+				}, nil)
+			return store
+		},
+		Error: errors.New("aws: cannot be blank"),
+	}, {
+		Name: "error/not found",
+
+		ID:          uuid.New(),
+		Integration: integrations[0],
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			store := new(storeMocks.DataStore)
+			store.On("GetSettings", contextMatcher).
+				Return(model.Settings{
+					Integrations: append([]model.Integration{}, integrations...),
+				}, nil)
+			return store
+		},
+		Error: ErrIntegrationNotFound,
+	}, {
+		Name: "error/name taken",
+
+		ID: integrations[1].ID,
+		Integration: model.Integration{
+			Name:             "hub",
+			ConnectionString: cs,
+		},
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			store := new(storeMocks.DataStore)
+			store.On("GetSettings", contextMatcher).
+				Return(model.Settings{
+					Integrations: append([]model.Integration{}, integrations...),
+				}, nil)
+			return store
+		},
+		Error: ErrIntegrationExists,
+	}}
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			ds := tc.Store(t, &tc)
+			defer ds.AssertExpectations(t)
+
+			app := New(ds, nil, nil,
+				NewOptions().SetConnectionStringVerification(false),
+			)
+			err := app.UpdateIntegration(context.Background(), tc.ID, tc.Integration)
+			if tc.Error != nil {
+				if assert.Error(t, err) {
+					assert.Regexp(t, tc.Error.Error(), err.Error())
+				}
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestDeleteIntegration(t *testing.T) {
+	t.Parallel()
+	integrations := []model.Integration{{
+		ID:   uuid.New(),
+		Name: "hub",
+	}, {
+		ID:   uuid.New(),
+		Name: "other hub",
+	}}
+	ctx := context.Background()
+
+	ds := new(storeMocks.DataStore)
+	ds.On("GetSettings", contextMatcher).
+		Return(model.Settings{Integrations: integrations}, nil).
+		On("SetSettings", contextMatcher, model.Settings{
+			Integrations: integrations[1:],
+		}).
+		Return(nil).Once()
+	defer ds.AssertExpectations(t)
+
+	app := New(ds, nil, nil)
+	err := app.DeleteIntegration(ctx, integrations[0].ID)
+	assert.NoError(t, err)
+
+	err = app.DeleteIntegration(ctx, uuid.New())
+	assert.EqualError(t, err, ErrIntegrationNotFound.Error())
+}
+
+func TestProvisionDeviceIntegrations(t *testing.T) {
+	t.Parallel()
+	const deviceID = "68ac6f41-c2e7-429f-a4bd-852fac9a5045"
+	var (
+		ctx       = context.Background()
+		hubCS     = &model.ConnectionString{HostName: "hub1", Key: []byte("secret")}
+		otherCS   = &model.ConnectionString{HostName: "hub2", Key: []byte("secret")}
+		scopedCS  = &model.ConnectionString{HostName: "hub3", Key: []byte("secret")}
+		failingID = uuid.New()
+	)
+
+	ds := new(storeMocks.DataStore)
+	ds.On("GetSettings", contextMatcher).
+		Return(model.Settings{Integrations: []model.Integration{{
+			ID:               uuid.New(),
+			Name:             "hub",
+			ConnectionString: hubCS,
+		}, {
+			ID:               failingID,
+			Name:             "other hub",
+			ConnectionString: otherCS,
+		}, {
+			ID:               uuid.New(),
+			Name:             "scoped hub",
+			ConnectionString: scopedCS,
+			Scope: &model.DeviceScope{
+				DeviceIDs: []string{"another-device"},
+			},
+		}}}, nil).
+		On("UpsertDevice", contextMatcher, deviceID,
+			mock.MatchedBy(func(update model.DeviceUpdate) bool {
+				return assert.Equal(t, model.DeviceStateProvisionFailed, *update.State) &&
+					assert.Equal(t, "hub1", *update.HubHostName) &&
+					assert.Equal(t, "integration "+failingID.String()+
+						": failed to update iothub devices: internal error",
+						*update.LastError)
+			})).
+		Return(nil)
+	defer ds.AssertExpectations(t)
+
+	hub := new(miothub.Client)
+	hub.On("UpsertDevice", contextMatcher, hubCS, deviceID).
+		Return(&iothub.Device{
+			DeviceID: deviceID,
+			Auth: &iothub.Auth{
+				Type: iothub.AuthTypeSymmetric,
+				SymmetricKey: &iothub.SymmetricKey{
+					Primary:   []byte("foo"),
+					Secondary: []byte("bar"),
+				},
+			},
+			Status: iothub.StatusEnabled,
+		}, nil).
+		On("UpdateDeviceTwin", contextMatcher, hubCS, deviceID,
+			mock.AnythingOfType("*iothub.DeviceTwinUpdate")).
+		Return(nil).
+		On("UpsertDevice", contextMatcher, otherCS, deviceID).
+		Return(nil, errors.New("internal error"))
+	defer hub.AssertExpectations(t)
+
+	wf := new(mworkflows.Client)
+	wf.On("ProvisionExternalDevice",
+		contextMatcher,
+		deviceID,
+		model.ProviderIoTHub,
+		mock.AnythingOfType("map[string]string")).
+		Return(nil).Once()
+	defer wf.AssertExpectations(t)
+
+	app := New(ds, hub, wf)
+	err := app.ProvisionDevice(ctx, deviceID, "")
+	if assert.Error(t, err) {
+		var integrationErr *IntegrationError
+		if assert.True(t, errors.As(err, &integrationErr)) {
+			assert.Equal(t, failingID, integrationErr.IntegrationID)
+		}
+	}
+}
+
+func TestDeviceIntegrationsScope(t *testing.T) {
+	t.Parallel()
+	ds := new(storeMocks.DataStore)
+	ds.On("GetSettings", contextMatcher).
+		Return(model.Settings{Integrations: []model.Integration{{
+			ID:   uuid.New(),
+			Name: "scoped hub",
+			ConnectionString: &model.ConnectionString{
+				HostName: "localhost",
+				Key:      []byte("secret"),
+			},
+			Scope: &model.DeviceScope{
+				DeviceIDs: []string{"another-device"},
+			},
+		}}}, nil)
+	defer ds.AssertExpectations(t)
+
+	app := New(ds, nil, nil)
+	err := app.DeleteIOTHubDevice(context.Background(), "device")
+	assert.EqualError(t, err, ErrNoIntegrations.Error())
+}
@@ -0,0 +1,87 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package app
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/mendersoftware/iot-manager/client"
+	"github.com/mendersoftware/iot-manager/client/iotcore"
+	"github.com/mendersoftware/iot-manager/model"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	confKeyAWSThingName   = "$aws.thingName"
+	confKeyAWSEndpoint    = "$aws.endpoint"
+	confKeyAWSCertificate = "$aws.certificate"
+	confKeyAWSPrivateKey  = "$aws.privateKey"
+)
+
+func (a *app) awsCredentials(integration model.Integration) (*model.AWSCredentials, error) {
+	if integration.AWS == nil || a.iotcore == nil {
+		return nil, ErrNoCredentials
+	}
+	return integration.AWS, nil
+}
+
+// provisionIoTCoreDevice creates the thing, certificate and policy for the
+// device in AWS IoT Core and submits the certificate to the device.
+func (a *app) provisionIoTCoreDevice(
+	ctx context.Context,
+	integration model.Integration,
+	deviceID string,
+) (*iotcore.Device, error) {
+	creds, err := a.awsCredentials(integration)
+	if err != nil {
+		return nil, err
+	}
+	dev, err := a.iotcore.UpsertDevice(ctx, creds, deviceID)
+	if err != nil {
+		if htErr, ok := err.(client.HTTPError); ok {
+			switch htErr.Code {
+			case http.StatusUnauthorized, http.StatusForbidden:
+				return nil, ErrNoCredentials
+			case http.StatusConflict:
+				return nil, ErrDeviceAlreadyExists
+			}
+		}
+		return nil, errors.Wrap(err, "failed to update iotcore devices")
+	}
+	config := map[string]string{
+		confKeyAWSThingName:   dev.ID,
+		confKeyAWSEndpoint:    dev.Endpoint,
+		confKeyAWSCertificate: dev.Certificate,
+		confKeyAWSPrivateKey:  dev.PrivateKey,
+	}
+	err = a.wf.ProvisionExternalDevice(ctx, dev.ID, model.ProviderIoTCore, config)
+	return dev, errors.Wrap(err, "failed to submit iotcore authn to deviceconfig")
+}
+
+func (a *app) setIoTCoreDeviceStatus(
+	ctx context.Context,
+	integration model.Integration,
+	deviceID string,
+	status Status,
+) error {
+	creds, err := a.awsCredentials(integration)
+	if err != nil {
+		return err
+	}
+	err = a.iotcore.SetDeviceStatus(ctx, creds, deviceID, iotcore.Status(status))
+	return errors.Wrap(err, "failed to update IoT Core device")
+}
@@ -0,0 +1,255 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package app
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+
+	"github.com/mendersoftware/go-lib-micro/identity"
+	"github.com/mendersoftware/go-lib-micro/log"
+
+	"github.com/mendersoftware/iot-manager/model"
+	"github.com/mendersoftware/iot-manager/store"
+)
+
+const (
+	// jobProgressInterval is the minimum interval between storing the
+	// progress of a running job.
+	jobProgressInterval = time.Second * 5
+	// jobLeaseDuration is the time a worker owns a claimed job without
+	// renewing the lease.
+	jobLeaseDuration = time.Minute
+	// jobLeaseRenewInterval is the interval between renewals of the lease
+	// of a running job.
+	jobLeaseRenewInterval = jobLeaseDuration / 3
+	// jobPollInterval is the interval between attempts to claim a job when
+	// no job is available.
+	jobPollInterval = time.Second * 5
+	// jobMaxAttempts is the number of times a job is claimed before it is
+	// considered failed, e.g. because it crashes the workers.
+	jobMaxAttempts = 3
+)
+
+var (
+	ErrJobNotFound = errors.New("job not found")
+	ErrJobExists   = errors.New("job already exists")
+)
+
+// jobHandler runs a job of a given type.
+type jobHandler func(ctx context.Context, job *model.Job, tracker *jobTracker) error
+
+func (a *app) jobHandler(jobType model.JobType) jobHandler {
+	switch jobType {
+	case model.JobTypeDeleteTenant:
+		return a.deleteTenantJob
+	case model.JobTypeRotateKeys:
+		return a.rotateTenantKeysJob
+	case model.JobTypeReconcile:
+		return a.reconcileJob
+	case model.JobTypeProvisionDevices:
+		return a.provisionDevicesJob
+	default:
+		return nil
+	}
+}
+
+func (a *app) GetJob(ctx context.Context, jobID uuid.UUID) (*model.Job, error) {
+	job, err := a.store.GetJob(ctx, jobID)
+	if err == store.ErrObjectNotFound {
+		return nil, ErrJobNotFound
+	}
+	return job, errors.Wrap(err, "failed to retrieve job")
+}
+
+func (a *app) GetJobs(
+	ctx context.Context,
+	fltr model.JobFilter,
+	skip, limit int64,
+) ([]model.Job, error) {
+	jobs, err := a.store.GetJobs(ctx, fltr, skip, limit)
+	return jobs, errors.Wrap(err, "failed to retrieve jobs")
+}
+
+// jobTracker records the progress of a running job.
+type jobTracker struct {
+	store      store.DataStore
+	jobID      uuid.UUID
+	owner      string
+	progress   model.JobProgress
+	itemErrors []model.JobItemError
+	stored     time.Time
+}
+
+// itemDone counts a processed item, err is the error processing the item.
+// The progress is stored at most once every jobProgressInterval.
+func (t *jobTracker) itemDone(ctx context.Context, item string, err error) {
+	t.progress.Total++
+	if err != nil {
+		t.progress.Failed++
+		if t.progress.Failed <= model.MaxJobItemErrors {
+			t.itemErrors = append(t.itemErrors, model.JobItemError{
+				Item:  item,
+				Error: err.Error(),
+			})
+		}
+	} else {
+		t.progress.Succeeded++
+	}
+	if time.Since(t.stored) < jobProgressInterval {
+		return
+	}
+	t.stored = time.Now()
+	errStore := t.store.UpdateJob(ctx, t.jobID, t.update())
+	if errStore != nil {
+		log.FromContext(ctx).
+			Errorf("failed to store progress of job %s: %s", t.jobID, errStore)
+	} else {
+		t.itemErrors = nil
+	}
+}
+
+// update returns the update storing the progress and the item errors
+// recorded since the last update.
+func (t *jobTracker) update() model.JobUpdate {
+	progress := t.progress
+	return model.JobUpdate{
+		Progress:   &progress,
+		ItemErrors: t.itemErrors,
+		LeaseOwner: t.owner,
+	}
+}
+
+// startJob creates a pending job record, the job is run by the first job
+// worker claiming it.
+func (a *app) startJob(
+	ctx context.Context,
+	jobType model.JobType,
+	params map[string]string,
+) (*model.Job, error) {
+	var tenantID string
+	if id := identity.FromContext(ctx); id != nil {
+		tenantID = id.Tenant
+	}
+	job := model.NewJob(tenantID, jobType, params)
+	if err := a.store.CreateJob(ctx, job); err != nil {
+		return nil, errors.Wrap(err, "failed to create job")
+	}
+	return &job, nil
+}
+
+// RunJobWorker claims and runs jobs until ctx is done. Jobs are leased to
+// the worker, workerID must be unique among the workers of every replica.
+func (a *app) RunJobWorker(ctx context.Context, workerID string) error {
+	l := log.FromContext(ctx).F(log.Ctx{"worker_id": workerID})
+	ctx = log.WithContext(ctx, l)
+	for {
+		job, err := a.store.ClaimJob(ctx, workerID, jobLeaseDuration)
+		if err == nil {
+			a.runJob(ctx, workerID, job)
+			continue
+		} else if ctx.Err() != nil {
+			return nil
+		} else if err != store.ErrObjectNotFound {
+			l.Errorf("failed to claim job: %s", err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(jobPollInterval):
+		}
+	}
+}
+
+// runJob runs the job leased to owner and stores the result. The lease is
+// renewed while the job runs; if the lease is lost, or ctx is done, the job
+// is interrupted and left to the next worker claiming it.
+func (a *app) runJob(ctx context.Context, owner string, job *model.Job) {
+	ctx = identity.WithContext(ctx, &identity.Identity{Tenant: job.TenantID})
+	l := log.FromContext(ctx).F(log.Ctx{
+		"job_id":   job.ID.String(),
+		"job_type": string(job.Type),
+	})
+	ctx = log.WithContext(ctx, l)
+	jobCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go a.renewJobLease(jobCtx, cancel, owner, job.ID)
+
+	tracker := &jobTracker{
+		store:  a.store,
+		jobID:  job.ID,
+		owner:  owner,
+		stored: time.Now(),
+	}
+	var err error
+	if job.Attempts > jobMaxAttempts {
+		err = errors.Errorf("job abandoned after %d attempts", jobMaxAttempts)
+	} else if handler := a.jobHandler(job.Type); handler == nil {
+		err = errors.Errorf("unknown job type %q", job.Type)
+	} else {
+		err = handler(jobCtx, job, tracker)
+	}
+	if jobCtx.Err() != nil {
+		l.Warnf("job interrupted: %s", jobCtx.Err())
+		return
+	}
+	update := tracker.update()
+	status := model.JobStatusSucceeded
+	if err != nil {
+		l.Errorf("job failed: %s", err)
+		status = model.JobStatusFailed
+		errMsg := err.Error()
+		update.Error = &errMsg
+	}
+	update.Status = &status
+	if err = a.store.UpdateJob(ctx, job.ID, update); err != nil {
+		l.Errorf("failed to store job result: %s", err)
+	}
+}
+
+// renewJobLease extends the lease of the job until ctx is done, cancel is
+// called if the lease was taken over by another worker.
+func (a *app) renewJobLease(
+	ctx context.Context,
+	cancel context.CancelFunc,
+	owner string,
+	jobID uuid.UUID,
+) {
+	l := log.FromContext(ctx)
+	ticker := time.NewTicker(jobLeaseRenewInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		expires := time.Now().UTC().Add(jobLeaseDuration)
+		err := a.store.UpdateJob(ctx, jobID, model.JobUpdate{
+			LeaseExpiresTS: &expires,
+			LeaseOwner:     owner,
+		})
+		if err == store.ErrObjectNotFound {
+			l.Error("lost the job lease")
+			cancel()
+			return
+		} else if err != nil && ctx.Err() == nil {
+			l.Errorf("failed to renew the job lease: %s", err)
+		}
+	}
+}
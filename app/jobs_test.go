@@ -0,0 +1,169 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package app
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/mendersoftware/iot-manager/model"
+	"github.com/mendersoftware/iot-manager/store"
+	storeMocks "github.com/mendersoftware/iot-manager/store/mocks"
+)
+
+func TestGetJob(t *testing.T) {
+	t.Parallel()
+	job := model.NewJob("123456789012345678901234", model.JobTypeDeleteTenant, nil)
+	notFoundID := uuid.New()
+	errorID := uuid.New()
+
+	ds := new(storeMocks.DataStore)
+	defer ds.AssertExpectations(t)
+	ds.On("GetJob", contextMatcher, job.ID).
+		Return(&job, nil).
+		On("GetJob", contextMatcher, notFoundID).
+		Return(nil, store.ErrObjectNotFound).
+		On("GetJob", contextMatcher, errorID).
+		Return(nil, errors.New("internal error"))
+	app := New(ds, nil, nil)
+
+	actual, err := app.GetJob(context.Background(), job.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, &job, actual)
+
+	_, err = app.GetJob(context.Background(), notFoundID)
+	assert.EqualError(t, err, ErrJobNotFound.Error())
+
+	_, err = app.GetJob(context.Background(), errorID)
+	assert.EqualError(t, err, "failed to retrieve job: internal error")
+}
+
+func TestGetJobs(t *testing.T) {
+	t.Parallel()
+	fltr := model.JobFilter{Status: model.JobStatusRunning}
+	jobs := []model.Job{
+		model.NewJob("123456789012345678901234", model.JobTypeRotateKeys, nil),
+	}
+
+	ds := new(storeMocks.DataStore)
+	defer ds.AssertExpectations(t)
+	ds.On("GetJobs", contextMatcher, fltr, int64(10), int64(5)).
+		Return(jobs, nil).
+		On("GetJobs", contextMatcher, model.JobFilter{}, int64(0), int64(5)).
+		Return(nil, errors.New("internal error"))
+	app := New(ds, nil, nil)
+
+	actual, err := app.GetJobs(context.Background(), fltr, 10, 5)
+	assert.NoError(t, err)
+	assert.Equal(t, jobs, actual)
+
+	_, err = app.GetJobs(context.Background(), model.JobFilter{}, 0, 5)
+	assert.EqualError(t, err, "failed to retrieve jobs: internal error")
+}
+
+func TestRunJobWorker(t *testing.T) {
+	t.Parallel()
+	const workerID = "worker"
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	job := model.NewJob("123456789012345678901234", model.JobType("unknown"), nil)
+	job.Status = model.JobStatusRunning
+	job.Attempts = 1
+	abandoned := model.NewJob("123456789012345678901234", model.JobTypeRotateKeys, nil)
+	abandoned.Status = model.JobStatusRunning
+	abandoned.Attempts = jobMaxAttempts + 1
+
+	var updates []model.JobUpdate
+	ds := new(storeMocks.DataStore)
+	defer ds.AssertExpectations(t)
+	ds.On("ClaimJob", contextMatcher, workerID, jobLeaseDuration).
+		Return(&job, nil).
+		Once().
+		On("ClaimJob", contextMatcher, workerID, jobLeaseDuration).
+		Return(&abandoned, nil).
+		Once().
+		On("ClaimJob", contextMatcher, workerID, jobLeaseDuration).
+		Return(nil, store.ErrObjectNotFound).
+		Run(func(args mock.Arguments) {
+			cancel()
+		}).
+		Once().
+		On("UpdateJob", contextMatcher, mock.AnythingOfType("uuid.UUID"),
+			mock.AnythingOfType("model.JobUpdate")).
+		Run(func(args mock.Arguments) {
+			updates = append(updates, args.Get(2).(model.JobUpdate))
+		}).
+		Return(nil)
+	app := New(ds, nil, nil)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- app.RunJobWorker(ctx, workerID)
+	}()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second * 5):
+		assert.FailNow(t, "timeout waiting for the job worker to stop")
+	}
+	if assert.Len(t, updates, 2) {
+		for _, update := range updates {
+			assert.Equal(t, workerID, update.LeaseOwner)
+			if assert.NotNil(t, update.Status) {
+				assert.Equal(t, model.JobStatusFailed, *update.Status)
+			}
+		}
+		assert.Equal(t, `unknown job type "unknown"`, *updates[0].Error)
+		assert.Equal(t, "job abandoned after 3 attempts", *updates[1].Error)
+	}
+}
+
+func TestJobTracker(t *testing.T) {
+	t.Parallel()
+	jobID := uuid.New()
+	ds := new(storeMocks.DataStore)
+	defer ds.AssertExpectations(t)
+	ds.On("UpdateJob", contextMatcher, jobID, model.JobUpdate{
+		Progress: &model.JobProgress{Total: 2, Succeeded: 1, Failed: 1},
+		ItemErrors: []model.JobItemError{{
+			Item:  "device-2",
+			Error: "internal error",
+		}},
+		LeaseOwner: "worker",
+	}).Return(nil).Once()
+
+	tracker := &jobTracker{
+		store:  ds,
+		jobID:  jobID,
+		owner:  "worker",
+		stored: time.Now(),
+	}
+	ctx := context.Background()
+	tracker.itemDone(ctx, "device-1", nil)
+	// The progress is stored once the progress interval elapsed.
+	tracker.stored = time.Now().Add(-jobProgressInterval)
+	tracker.itemDone(ctx, "device-2", errors.New("internal error"))
+	assert.Nil(t, tracker.itemErrors)
+	assert.Equal(t, model.JobUpdate{
+		Progress:   &model.JobProgress{Total: 2, Succeeded: 1, Failed: 1},
+		LeaseOwner: "worker",
+	}, tracker.update())
+}
@@ -0,0 +1,264 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package app
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/pkg/errors"
+
+	"github.com/mendersoftware/iot-manager/client"
+	"github.com/mendersoftware/iot-manager/client/iothub"
+	"github.com/mendersoftware/iot-manager/model"
+)
+
+const (
+	// jobParamPhase is the KeyRotationPhase of a rotate_keys job.
+	jobParamPhase = "phase"
+)
+
+var (
+	ErrKeyRotationNotSupported = errors.New(
+		"key rotation is only supported for IoT Hub devices " +
+			"authenticating with symmetric keys or X.509 certificates",
+	)
+	ErrDeviceModified = errors.New(
+		"the device was modified during the key rotation, please try again",
+	)
+)
+
+// RotateDeviceKeys replaces the symmetric keys or renews the X.509
+// certificate of the device in every IoT Hub integration that includes the
+// device and sends the new credentials to the device. The phase selects
+// which keys are replaced, see model.KeyRotationPhase.
+func (a *app) RotateDeviceKeys(
+	ctx context.Context,
+	deviceID string,
+	phase model.KeyRotationPhase,
+) error {
+	integrations, err := a.deviceIntegrations(ctx, deviceID)
+	if err != nil {
+		return err
+	}
+	hubIntegrations := make([]model.Integration, 0, len(integrations))
+	for _, integration := range integrations {
+		if supportsKeyRotation(integration) {
+			hubIntegrations = append(hubIntegrations, integration)
+		}
+	}
+	if len(hubIntegrations) == 0 {
+		return ErrKeyRotationNotSupported
+	}
+	return fanOut(hubIntegrations, func(integration model.Integration) error {
+		return a.rotateIoTHubDeviceKeys(ctx, integration, deviceID, phase)
+	})
+}
+
+// supportsKeyRotation returns true if the keys of the devices provisioned
+// by the integration are managed by the IoT Hub identity registry.
+func supportsKeyRotation(integration model.Integration) bool {
+	return integration.Provider != model.ProviderIoTCore &&
+		integration.ProvisioningMode != model.ProvisioningModeDPS
+}
+
+func (a *app) rotateIoTHubDeviceKeys(
+	ctx context.Context,
+	integration model.Integration,
+	deviceID string,
+	phase model.KeyRotationPhase,
+) error {
+	cs := integration.ConnectionString
+	dev, err := a.hub.GetDevice(ctx, cs, deviceID)
+	if err != nil {
+		return errors.Wrap(err, "failed to retrieve device from IoT Hub")
+	}
+	var deviceCert *model.DeviceCertificate
+	switch {
+	case dev.Auth == nil:
+		return ErrKeyRotationNotSupported
+	case dev.Auth.Type == iothub.AuthTypeSymmetric && dev.Auth.SymmetricKey != nil:
+		err = rotateSymmetricKeys(dev.Auth, phase)
+	case dev.Auth.Type == iothub.AuthTypeSelfSigned:
+		deviceCert, err = rotateDeviceCertificate(integration, dev, phase)
+	default:
+		return ErrKeyRotationNotSupported
+	}
+	if err != nil {
+		return err
+	}
+	// The device ETag makes the update fail if the device changed since
+	// it was retrieved.
+	dev, err = a.hub.UpsertDevice(ctx, cs, deviceID, dev)
+	if err != nil {
+		if htErr, ok := err.(client.HTTPError); ok &&
+			htErr.Code == http.StatusPreconditionFailed {
+			return ErrDeviceModified
+		}
+		return errors.Wrap(err, "failed to update IoT Hub device keys")
+	}
+	if dev.Auth != nil && dev.Auth.Type == iothub.AuthTypeSelfSigned {
+		if deviceCert == nil {
+			// Promoting a certificate leaves the device certificate
+			// unchanged.
+			return nil
+		}
+		return a.submitIoTHubDeviceConfig(ctx, cs, dev, deviceCert)
+	}
+	// Downstream devices keep connecting through their gateway.
+	var gatewayHostName string
+	if len(dev.ParentScopes) > 0 {
+		record, err := a.store.GetDevice(ctx, deviceID)
+		if err != nil {
+			return errors.Wrap(err, "failed to retrieve device record")
+		}
+		gatewayHostName = record.GatewayHostName
+	}
+	config, err := symmetricKeyConfig(cs, dev, gatewayHostName)
+	if err != nil {
+		return err
+	}
+	err = a.wf.ProvisionExternalDevice(ctx, dev.DeviceID, model.ProviderIoTHub, config)
+	return errors.Wrap(err, "failed to submit iothub authn to deviceconfig")
+}
+
+// rotateSymmetricKeys replaces the symmetric keys of auth according to
+// the phase.
+func rotateSymmetricKeys(auth *iothub.Auth, phase model.KeyRotationPhase) error {
+	keys := *auth.SymmetricKey
+	switch phase {
+	case model.KeyRotationPhasePromote:
+		keys.Primary, keys.Secondary = keys.Secondary, keys.Primary
+	case model.KeyRotationPhaseRegenerate, model.KeyRotationPhaseAll:
+		newAuth, err := iothub.NewSymmetricAuth()
+		if err != nil {
+			return errors.Wrap(err, "failed to generate device keys")
+		}
+		keys.Secondary = newAuth.SymmetricKey.Secondary
+		if phase == model.KeyRotationPhaseAll {
+			keys.Primary = newAuth.SymmetricKey.Primary
+		}
+	default:
+		return errors.Errorf("invalid key rotation phase %q", phase)
+	}
+	auth.SymmetricKey = &keys
+	return nil
+}
+
+// rotateDeviceCertificate renews the certificate of a device authenticating
+// with X.509 and returns the new certificate, nil if the device keeps its
+// certificate. The secondary thumbprint is the rollover slot: regenerate
+// registers the new certificate as secondary, promote makes it primary and
+// all does both at once. The previous certificate stays registered until
+// the next rotation so the device keeps connecting until it applies the
+// new certificate.
+func rotateDeviceCertificate(
+	integration model.Integration,
+	dev *iothub.Device,
+	phase model.KeyRotationPhase,
+) (*model.DeviceCertificate, error) {
+	var thumbprints iothub.X509ThumbPrint
+	if dev.Auth.X509ThumbPrint != nil {
+		thumbprints = *dev.Auth.X509ThumbPrint
+	}
+	var deviceCert *model.DeviceCertificate
+	switch phase {
+	case model.KeyRotationPhasePromote:
+		if thumbprints.Secondary == "" {
+			// Nothing to promote.
+			return nil, nil
+		}
+		thumbprints.Primary, thumbprints.Secondary =
+			thumbprints.Secondary, thumbprints.Primary
+	case model.KeyRotationPhaseRegenerate, model.KeyRotationPhaseAll:
+		var (
+			auth *iothub.Auth
+			err  error
+		)
+		deviceCert, auth, err = issueIoTHubDeviceCertificate(
+			integration, dev.DeviceID,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if phase == model.KeyRotationPhaseAll {
+			thumbprints.Secondary = thumbprints.Primary
+			thumbprints.Primary = auth.X509ThumbPrint.Primary
+		} else {
+			thumbprints.Secondary = auth.X509ThumbPrint.Primary
+		}
+	default:
+		return nil, errors.Errorf("invalid key rotation phase %q", phase)
+	}
+	dev.Auth.X509ThumbPrint = &thumbprints
+	return deviceCert, nil
+}
+
+// RotateTenantKeys starts a background job rotating the keys of every
+// provisioned device of the tenant.
+func (a *app) RotateTenantKeys(
+	ctx context.Context,
+	phase model.KeyRotationPhase,
+) (*model.Job, error) {
+	settings, err := a.GetSettings(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to retrieve settings")
+	}
+	var supported bool
+	for _, integration := range settings.Integrations {
+		if supportsKeyRotation(integration) {
+			supported = true
+			break
+		}
+	}
+	if !supported {
+		return nil, ErrKeyRotationNotSupported
+	}
+	return a.startJob(ctx, model.JobTypeRotateKeys, map[string]string{
+		jobParamPhase: string(phase),
+	})
+}
+
+func (a *app) rotateTenantKeysJob(
+	ctx context.Context,
+	job *model.Job,
+	tracker *jobTracker,
+) error {
+	phase := model.KeyRotationPhase(job.Params[jobParamPhase])
+	if phase == "" || phase.Validate() != nil {
+		return errors.Errorf("invalid key rotation phase %q", phase)
+	}
+	devices, err := a.store.GetDevices(ctx, model.DeviceFilter{
+		States: []model.DeviceState{model.DeviceStateProvisioned},
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to retrieve devices")
+	}
+	for _, dev := range devices {
+		err := a.RotateDeviceKeys(ctx, dev.ID, phase)
+		switch errors.Cause(err) {
+		case ErrKeyRotationNotSupported, ErrNoIntegrations:
+		default:
+			tracker.itemDone(ctx, dev.ID, err)
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+	if failed := tracker.progress.Failed; failed > 0 {
+		return errors.Errorf("failed to rotate keys of %d devices", failed)
+	}
+	return nil
+}
@@ -0,0 +1,605 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package app
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/mendersoftware/go-lib-micro/identity"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/mendersoftware/iot-manager/client"
+	"github.com/mendersoftware/iot-manager/client/iothub"
+	miothub "github.com/mendersoftware/iot-manager/client/iothub/mocks"
+	mworkflows "github.com/mendersoftware/iot-manager/client/workflows/mocks"
+	"github.com/mendersoftware/iot-manager/model"
+	storeMocks "github.com/mendersoftware/iot-manager/store/mocks"
+)
+
+func TestRotateDeviceKeys(t *testing.T) {
+	t.Parallel()
+	primary := iothub.Key("primary")
+	secondary := iothub.Key("secondary")
+	hubDevice := func() *iothub.Device {
+		return &iothub.Device{
+			DeviceID: "68ac6f41-c2e7-429f-a4bd-852fac9a5045",
+			ETag:     "MjAyMQ==",
+			Status:   iothub.StatusDisabled,
+			Auth: &iothub.Auth{
+				Type: iothub.AuthTypeSymmetric,
+				SymmetricKey: &iothub.SymmetricKey{
+					Primary:   primary,
+					Secondary: secondary,
+				},
+			},
+		}
+	}
+	type testCase struct {
+		Name string
+
+		ConnStr  *model.ConnectionString
+		DeviceID string
+		Phase    model.KeyRotationPhase
+
+		Settings model.Settings
+		Hub      func(t *testing.T, self *testCase) *miothub.Client
+		Wf       func(t *testing.T, self *testCase) *mworkflows.Client
+
+		Error error
+	}
+	// keysMatcher matches the device update sent to the IoT Hub, the
+	// device status and ETag must be preserved.
+	keysMatcher := func(match func(keys *iothub.SymmetricKey) bool) interface{} {
+		return mock.MatchedBy(func(dev *iothub.Device) bool {
+			return dev.ETag == "MjAyMQ==" &&
+				dev.Status == iothub.StatusDisabled &&
+				match(dev.Auth.SymmetricKey)
+		})
+	}
+	cs := &model.ConnectionString{
+		HostName: "localhost",
+		Key:      []byte("super secret"),
+		Name:     "my favorite string",
+	}
+	testCases := []testCase{{
+		Name: "ok/promote",
+
+		ConnStr:  cs,
+		DeviceID: "68ac6f41-c2e7-429f-a4bd-852fac9a5045",
+		Phase:    model.KeyRotationPhasePromote,
+
+		Settings: model.Settings{Integrations: []model.Integration{{
+			ConnectionString: cs,
+		}}},
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			hub := new(miothub.Client)
+			hub.On("GetDevice", contextMatcher, self.ConnStr, self.DeviceID).
+				Return(hubDevice(), nil).
+				On("UpsertDevice", contextMatcher, self.ConnStr, self.DeviceID,
+					keysMatcher(func(keys *iothub.SymmetricKey) bool {
+						return bytes.Equal(keys.Primary, secondary) &&
+							bytes.Equal(keys.Secondary, primary)
+					})).
+				Return(func(
+					_ context.Context,
+					_ *model.ConnectionString,
+					_ string,
+					devs ...*iothub.Device,
+				) *iothub.Device {
+					return devs[0]
+				}, nil)
+			return hub
+		},
+		Wf: func(t *testing.T, self *testCase) *mworkflows.Client {
+			wf := new(mworkflows.Client)
+			wf.On("ProvisionExternalDevice",
+				contextMatcher,
+				self.DeviceID,
+				model.ProviderIoTHub,
+				map[string]string{
+					confKeyPrimaryKey: (&model.ConnectionString{
+						HostName: self.ConnStr.HostName,
+						DeviceID: self.DeviceID,
+						Key:      secondary,
+					}).String(),
+					confKeySecondaryKey: (&model.ConnectionString{
+						HostName: self.ConnStr.HostName,
+						DeviceID: self.DeviceID,
+						Key:      primary,
+					}).String(),
+				}).Return(nil)
+			return wf
+		},
+	}, {
+		Name: "ok/regenerate",
+
+		ConnStr:  cs,
+		DeviceID: "68ac6f41-c2e7-429f-a4bd-852fac9a5045",
+		Phase:    model.KeyRotationPhaseRegenerate,
+
+		Settings: model.Settings{Integrations: []model.Integration{{
+			ConnectionString: cs,
+		}}},
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			hub := new(miothub.Client)
+			hub.On("GetDevice", contextMatcher, self.ConnStr, self.DeviceID).
+				Return(hubDevice(), nil).
+				On("UpsertDevice", contextMatcher, self.ConnStr, self.DeviceID,
+					keysMatcher(func(keys *iothub.SymmetricKey) bool {
+						return bytes.Equal(keys.Primary, primary) &&
+							len(keys.Secondary) == 48 &&
+							!bytes.Equal(keys.Secondary, secondary)
+					})).
+				Return(hubDevice(), nil)
+			return hub
+		},
+		Wf: func(t *testing.T, self *testCase) *mworkflows.Client {
+			wf := new(mworkflows.Client)
+			wf.On("ProvisionExternalDevice",
+				contextMatcher,
+				self.DeviceID,
+				model.ProviderIoTHub,
+				mock.AnythingOfType("map[string]string"),
+			).Return(nil)
+			return wf
+		},
+	}, {
+		Name: "ok/all keys",
+
+		ConnStr:  cs,
+		DeviceID: "68ac6f41-c2e7-429f-a4bd-852fac9a5045",
+		Phase:    model.KeyRotationPhaseAll,
+
+		Settings: model.Settings{Integrations: []model.Integration{{
+			ConnectionString: cs,
+		}, {
+			Provider: model.ProviderIoTCore,
+		}}},
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			hub := new(miothub.Client)
+			hub.On("GetDevice", contextMatcher, self.ConnStr, self.DeviceID).
+				Return(hubDevice(), nil).
+				On("UpsertDevice", contextMatcher, self.ConnStr, self.DeviceID,
+					keysMatcher(func(keys *iothub.SymmetricKey) bool {
+						return len(keys.Primary) == 48 &&
+							len(keys.Secondary) == 48 &&
+							!bytes.Equal(keys.Primary, keys.Secondary)
+					})).
+				Return(hubDevice(), nil)
+			return hub
+		},
+		Wf: func(t *testing.T, self *testCase) *mworkflows.Client {
+			wf := new(mworkflows.Client)
+			wf.On("ProvisionExternalDevice",
+				contextMatcher,
+				self.DeviceID,
+				model.ProviderIoTHub,
+				mock.AnythingOfType("map[string]string"),
+			).Return(nil)
+			return wf
+		},
+	}, {
+		Name: "error/device modified",
+
+		ConnStr:  cs,
+		DeviceID: "68ac6f41-c2e7-429f-a4bd-852fac9a5045",
+		Phase:    model.KeyRotationPhasePromote,
+
+		Settings: model.Settings{Integrations: []model.Integration{{
+			ConnectionString: cs,
+		}}},
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			hub := new(miothub.Client)
+			hub.On("GetDevice", contextMatcher, self.ConnStr, self.DeviceID).
+				Return(hubDevice(), nil).
+				On("UpsertDevice", contextMatcher, self.ConnStr, self.DeviceID,
+					mock.AnythingOfType("*iothub.Device")).
+				Return(nil, client.HTTPError{Code: http.StatusPreconditionFailed})
+			return hub
+		},
+		Wf: func(t *testing.T, self *testCase) *mworkflows.Client {
+			return new(mworkflows.Client)
+		},
+
+		Error: ErrDeviceModified,
+	}, {
+		Name: "error/missing phase",
+
+		ConnStr:  cs,
+		DeviceID: "68ac6f41-c2e7-429f-a4bd-852fac9a5045",
+
+		Settings: model.Settings{Integrations: []model.Integration{{
+			ConnectionString: cs,
+		}}},
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			hub := new(miothub.Client)
+			hub.On("GetDevice", contextMatcher, self.ConnStr, self.DeviceID).
+				Return(hubDevice(), nil)
+			return hub
+		},
+		Wf: func(t *testing.T, self *testCase) *mworkflows.Client {
+			return new(mworkflows.Client)
+		},
+
+		Error: errors.New(`invalid key rotation phase ""`),
+	}, {
+		Name: "error/certificate authority device",
+
+		ConnStr:  cs,
+		DeviceID: "68ac6f41-c2e7-429f-a4bd-852fac9a5045",
+		Phase:    model.KeyRotationPhaseAll,
+
+		Settings: model.Settings{Integrations: []model.Integration{{
+			ConnectionString: cs,
+		}}},
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			hub := new(miothub.Client)
+			hub.On("GetDevice", contextMatcher, self.ConnStr, self.DeviceID).
+				Return(&iothub.Device{
+					DeviceID: self.DeviceID,
+					Auth: &iothub.Auth{
+						Type: iothub.AuthTypeAuthority,
+					},
+				}, nil)
+			return hub
+		},
+		Wf: func(t *testing.T, self *testCase) *mworkflows.Client {
+			return new(mworkflows.Client)
+		},
+
+		Error: ErrKeyRotationNotSupported,
+	}, {
+		Name: "error/no IoT Hub integrations",
+
+		DeviceID: "68ac6f41-c2e7-429f-a4bd-852fac9a5045",
+
+		Settings: model.Settings{Integrations: []model.Integration{{
+			Provider: model.ProviderIoTCore,
+		}, {
+			ConnectionString: cs,
+			ProvisioningMode: model.ProvisioningModeDPS,
+		}}},
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			return new(miothub.Client)
+		},
+		Wf: func(t *testing.T, self *testCase) *mworkflows.Client {
+			return new(mworkflows.Client)
+		},
+
+		Error: ErrKeyRotationNotSupported,
+	}, {
+		Name: "error/workflows",
+
+		ConnStr:  cs,
+		DeviceID: "68ac6f41-c2e7-429f-a4bd-852fac9a5045",
+		Phase:    model.KeyRotationPhaseAll,
+
+		Settings: model.Settings{Integrations: []model.Integration{{
+			ConnectionString: cs,
+		}}},
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			hub := new(miothub.Client)
+			hub.On("GetDevice", contextMatcher, self.ConnStr, self.DeviceID).
+				Return(hubDevice(), nil).
+				On("UpsertDevice", contextMatcher, self.ConnStr, self.DeviceID,
+					mock.AnythingOfType("*iothub.Device")).
+				Return(hubDevice(), nil)
+			return hub
+		},
+		Wf: func(t *testing.T, self *testCase) *mworkflows.Client {
+			wf := new(mworkflows.Client)
+			wf.On("ProvisionExternalDevice",
+				contextMatcher,
+				self.DeviceID,
+				model.ProviderIoTHub,
+				mock.AnythingOfType("map[string]string"),
+			).Return(errors.New("internal error"))
+			return wf
+		},
+
+		Error: errors.New("failed to submit iothub authn to deviceconfig: internal error"),
+	}}
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			ctx := context.Background()
+			ds := new(storeMocks.DataStore)
+			ds.On("GetSettings", contextMatcher).Return(tc.Settings, nil)
+			hub := tc.Hub(t, &tc)
+			wf := tc.Wf(t, &tc)
+			defer ds.AssertExpectations(t)
+			defer hub.AssertExpectations(t)
+			defer wf.AssertExpectations(t)
+
+			app := New(ds, hub, wf)
+			err := app.RotateDeviceKeys(ctx, tc.DeviceID, tc.Phase)
+
+			if tc.Error != nil {
+				if assert.Error(t, err) {
+					assert.Regexp(t, tc.Error.Error(), err.Error())
+				}
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestRotateDeviceCertificate(t *testing.T) {
+	t.Parallel()
+	const deviceID = "68ac6f41-c2e7-429f-a4bd-852fac9a5045"
+	cs := &model.ConnectionString{
+		HostName: "localhost",
+		Key:      []byte("super secret"),
+		Name:     "my favorite string",
+	}
+	settings := model.Settings{Integrations: []model.Integration{{
+		ConnectionString:     cs,
+		DeviceAuth:           model.DeviceAuthX509,
+		CertificateAuthority: newTestCA(t, true),
+	}}}
+	type testCase struct {
+		Name string
+
+		Phase       model.KeyRotationPhase
+		Thumbprints iothub.X509ThumbPrint
+
+		// Match checks the thumbprints sent to the IoT Hub, nil if the
+		// device is not updated.
+		Match func(t *testing.T, tp *iothub.X509ThumbPrint) bool
+		// Config is set if the new certificate is sent to the device.
+		Config bool
+
+		Error error
+	}
+	testCases := []testCase{{
+		Name: "ok/regenerate",
+
+		Phase:       model.KeyRotationPhaseRegenerate,
+		Thumbprints: iothub.X509ThumbPrint{Primary: "AA"},
+		Match: func(t *testing.T, tp *iothub.X509ThumbPrint) bool {
+			return tp.Primary == "AA" &&
+				tp.Secondary != "" && tp.Secondary != "AA"
+		},
+		Config: true,
+	}, {
+		Name: "ok/promote",
+
+		Phase:       model.KeyRotationPhasePromote,
+		Thumbprints: iothub.X509ThumbPrint{Primary: "AA", Secondary: "BB"},
+		Match: func(t *testing.T, tp *iothub.X509ThumbPrint) bool {
+			return tp.Primary == "BB" && tp.Secondary == "AA"
+		},
+	}, {
+		Name: "ok/promote without secondary",
+
+		Phase:       model.KeyRotationPhasePromote,
+		Thumbprints: iothub.X509ThumbPrint{Primary: "AA"},
+		Match: func(t *testing.T, tp *iothub.X509ThumbPrint) bool {
+			return tp.Primary == "AA" && tp.Secondary == ""
+		},
+	}, {
+		Name: "ok/all",
+
+		Phase:       model.KeyRotationPhaseAll,
+		Thumbprints: iothub.X509ThumbPrint{Primary: "AA", Secondary: "BB"},
+		Match: func(t *testing.T, tp *iothub.X509ThumbPrint) bool {
+			return tp.Primary != "" && tp.Primary != "AA" &&
+				tp.Secondary == "AA"
+		},
+		Config: true,
+	}, {
+		Name: "error/invalid phase",
+
+		Phase:       model.KeyRotationPhase("bogus"),
+		Thumbprints: iothub.X509ThumbPrint{Primary: "AA"},
+		Error:       errors.New(`invalid key rotation phase "bogus"`),
+	}}
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			ctx := context.Background()
+			ds := new(storeMocks.DataStore)
+			ds.On("GetSettings", contextMatcher).Return(settings, nil)
+			defer ds.AssertExpectations(t)
+
+			thumbprints := tc.Thumbprints
+			hub := new(miothub.Client)
+			hub.On("GetDevice", contextMatcher, cs, deviceID).
+				Return(&iothub.Device{
+					DeviceID: deviceID,
+					ETag:     "MjAyMQ==",
+					Auth: &iothub.Auth{
+						Type:           iothub.AuthTypeSelfSigned,
+						X509ThumbPrint: &thumbprints,
+					},
+				}, nil)
+			if tc.Match != nil {
+				hub.On("UpsertDevice", contextMatcher, cs, deviceID,
+					mock.MatchedBy(func(dev *iothub.Device) bool {
+						return dev.ETag == "MjAyMQ==" &&
+							tc.Match(t, dev.Auth.X509ThumbPrint)
+					})).
+					Return(func(
+						_ context.Context,
+						_ *model.ConnectionString,
+						_ string,
+						devs ...*iothub.Device,
+					) *iothub.Device {
+						return devs[0]
+					}, nil)
+			}
+			defer hub.AssertExpectations(t)
+
+			wf := new(mworkflows.Client)
+			if tc.Config {
+				wf.On("ProvisionExternalDevice",
+					contextMatcher,
+					deviceID,
+					model.ProviderIoTHub,
+					mock.MatchedBy(func(config map[string]string) bool {
+						return config[confKeyCertificate] != "" &&
+							config[confKeyPrivateKey] != ""
+					}),
+				).Return(nil)
+			}
+			defer wf.AssertExpectations(t)
+
+			app := New(ds, hub, wf)
+			err := app.RotateDeviceKeys(ctx, deviceID, tc.Phase)
+			if tc.Error != nil {
+				if assert.Error(t, err) {
+					assert.Regexp(t, tc.Error.Error(), err.Error())
+				}
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestRotateTenantKeys(t *testing.T) {
+	t.Parallel()
+	cs := &model.ConnectionString{
+		HostName: "localhost",
+		Key:      []byte("super secret"),
+		Name:     "my favorite string",
+	}
+	settings := model.Settings{Integrations: []model.Integration{{
+		ConnectionString: cs,
+	}}}
+	deviceIDs := []string{
+		"68ac6f41-c2e7-429f-a4bd-852fac9a5045",
+		"bbd7b9a8-9a1d-4c25-a1d8-2e1e8c4e4a2c",
+	}
+	ctx := identity.WithContext(context.Background(), &identity.Identity{
+		Tenant: "123456789012345678901234",
+	})
+
+	ds := new(storeMocks.DataStore)
+	ds.On("GetSettings", contextMatcher).Return(settings, nil).
+		On("GetDevices", contextMatcher, model.DeviceFilter{
+			States: []model.DeviceState{model.DeviceStateProvisioned},
+		}).Return([]model.Device{
+		{ID: deviceIDs[0]},
+		{ID: deviceIDs[1]},
+	}, nil)
+	hub := new(miothub.Client)
+	for _, deviceID := range deviceIDs {
+		dev := &iothub.Device{
+			DeviceID: deviceID,
+			Auth: &iothub.Auth{
+				Type: iothub.AuthTypeSymmetric,
+				SymmetricKey: &iothub.SymmetricKey{
+					Primary:   iothub.Key("primary"),
+					Secondary: iothub.Key("secondary"),
+				},
+			},
+		}
+		hub.On("GetDevice", contextMatcher, cs, deviceID).
+			Return(dev, nil).
+			On("UpsertDevice", contextMatcher, cs, deviceID,
+				mock.AnythingOfType("*iothub.Device")).
+			Return(dev, nil)
+	}
+	wf := new(mworkflows.Client)
+	wf.On("ProvisionExternalDevice",
+		contextMatcher,
+		deviceIDs[0],
+		model.ProviderIoTHub,
+		mock.AnythingOfType("map[string]string"),
+	).Return(nil).
+		On("ProvisionExternalDevice",
+			contextMatcher,
+			deviceIDs[1],
+			model.ProviderIoTHub,
+			mock.AnythingOfType("map[string]string"),
+		).Return(nil)
+	var job model.Job
+	ds.On("CreateJob", contextMatcher,
+		mock.MatchedBy(func(job model.Job) bool {
+			return job.Type == model.JobTypeRotateKeys &&
+				job.Params[jobParamPhase] == string(model.KeyRotationPhasePromote)
+		})).
+		Run(func(args mock.Arguments) {
+			job = args.Get(1).(model.Job)
+		}).
+		Return(nil).
+		On("UpdateJob", contextMatcher, mock.AnythingOfType("uuid.UUID"),
+			mock.MatchedBy(func(update model.JobUpdate) bool {
+				return update.Status != nil &&
+					*update.Status == model.JobStatusSucceeded &&
+					*update.Progress == model.JobProgress{Total: 2, Succeeded: 2}
+			})).
+		Return(nil)
+	defer ds.AssertExpectations(t)
+	defer hub.AssertExpectations(t)
+	defer wf.AssertExpectations(t)
+
+	a := New(ds, hub, wf)
+	res, err := a.RotateTenantKeys(ctx, model.KeyRotationPhasePromote)
+	if assert.NoError(t, err) {
+		assert.Equal(t, &job, res)
+		job.Attempts = 1
+		a.(*app).runJob(context.Background(), "worker", &job)
+	}
+}
+
+func TestRotateTenantKeysInvalidPhase(t *testing.T) {
+	t.Parallel()
+	for _, phase := range []string{"", "bogus"} {
+		ds := new(storeMocks.DataStore)
+		ds.On("UpdateJob", contextMatcher, mock.AnythingOfType("uuid.UUID"),
+			mock.MatchedBy(func(update model.JobUpdate) bool {
+				return update.Status != nil &&
+					*update.Status == model.JobStatusFailed &&
+					update.Error != nil &&
+					*update.Error == fmt.Sprintf("invalid key rotation phase %q", phase)
+			})).
+			Return(nil)
+
+		a := New(ds, nil, nil)
+		a.(*app).runJob(context.Background(), "worker", &model.Job{
+			ID:       uuid.New(),
+			Type:     model.JobTypeRotateKeys,
+			Params:   map[string]string{jobParamPhase: phase},
+			Attempts: 1,
+		})
+		ds.AssertExpectations(t)
+	}
+}
+
+func TestRotateTenantKeysNotSupported(t *testing.T) {
+	t.Parallel()
+	ds := new(storeMocks.DataStore)
+	ds.On("GetSettings", contextMatcher).
+		Return(model.Settings{Integrations: []model.Integration{{
+			Provider: model.ProviderIoTCore,
+		}}}, nil)
+	defer ds.AssertExpectations(t)
+
+	app := New(ds, nil, nil)
+	_, err := app.RotateTenantKeys(context.Background(), model.KeyRotationPhaseAll)
+	assert.EqualError(t, err, ErrKeyRotationNotSupported.Error())
+}
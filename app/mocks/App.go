@@ -21,9 +21,15 @@ import (
 
 	app "github.com/mendersoftware/iot-manager/app"
 
+	iothub "github.com/mendersoftware/iot-manager/client/iothub"
+
 	mock "github.com/stretchr/testify/mock"
 
 	model "github.com/mendersoftware/iot-manager/model"
+
+	time "time"
+
+	uuid "github.com/google/uuid"
 )
 
 // App is an autogenerated mock type for the App type
@@ -31,6 +37,117 @@ type App struct {
 	mock.Mock
 }
 
+// ApplyDeviceConfigurationContent provides a mock function with given fields: ctx, integrationID, deviceID, content
+func (_m *App) ApplyDeviceConfigurationContent(ctx context.Context, integrationID uuid.UUID, deviceID string, content iothub.ConfigurationContent) error {
+	ret := _m.Called(ctx, integrationID, deviceID, content)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, uuid.UUID, string, iothub.ConfigurationContent) error); ok {
+		r0 = rf(ctx, integrationID, deviceID, content)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// CancelHubJob provides a mock function with given fields: ctx, integrationID, jobID
+func (_m *App) CancelHubJob(ctx context.Context, integrationID uuid.UUID, jobID string) (*iothub.Job, error) {
+	ret := _m.Called(ctx, integrationID, jobID)
+
+	var r0 *iothub.Job
+	if rf, ok := ret.Get(0).(func(context.Context, uuid.UUID, string) *iothub.Job); ok {
+		r0 = rf(ctx, integrationID, jobID)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*iothub.Job)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, uuid.UUID, string) error); ok {
+		r1 = rf(ctx, integrationID, jobID)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// CreateIntegration provides a mock function with given fields: _a0, _a1
+func (_m *App) CreateIntegration(_a0 context.Context, _a1 model.Integration) (*model.Integration, error) {
+	ret := _m.Called(_a0, _a1)
+
+	var r0 *model.Integration
+	if rf, ok := ret.Get(0).(func(context.Context, model.Integration) *model.Integration); ok {
+		r0 = rf(_a0, _a1)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*model.Integration)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, model.Integration) error); ok {
+		r1 = rf(_a0, _a1)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// DecommissionDevices provides a mock function with given fields: ctx, deviceIDs
+func (_m *App) DecommissionDevices(ctx context.Context, deviceIDs []string) ([]error, error) {
+	ret := _m.Called(ctx, deviceIDs)
+
+	var r0 []error
+	if rf, ok := ret.Get(0).(func(context.Context, []string) []error); ok {
+		r0 = rf(ctx, deviceIDs)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]error)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, []string) error); ok {
+		r1 = rf(ctx, deviceIDs)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// DeleteDeviceModule provides a mock function with given fields: ctx, integrationID, deviceID, moduleID
+func (_m *App) DeleteDeviceModule(ctx context.Context, integrationID uuid.UUID, deviceID string, moduleID string) error {
+	ret := _m.Called(ctx, integrationID, deviceID, moduleID)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, uuid.UUID, string, string) error); ok {
+		r0 = rf(ctx, integrationID, deviceID, moduleID)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// DeleteHubConfiguration provides a mock function with given fields: ctx, integrationID, configID, etag
+func (_m *App) DeleteHubConfiguration(ctx context.Context, integrationID uuid.UUID, configID string, etag string) error {
+	ret := _m.Called(ctx, integrationID, configID, etag)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, uuid.UUID, string, string) error); ok {
+		r0 = rf(ctx, integrationID, configID, etag)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 // DeleteIOTHubDevice provides a mock function with given fields: _a0, _a1
 func (_m *App) DeleteIOTHubDevice(_a0 context.Context, _a1 string) error {
 	ret := _m.Called(_a0, _a1)
@@ -45,6 +162,250 @@ func (_m *App) DeleteIOTHubDevice(_a0 context.Context, _a1 string) error {
 	return r0
 }
 
+// DeleteIntegration provides a mock function with given fields: ctx, integrationID
+func (_m *App) DeleteIntegration(ctx context.Context, integrationID uuid.UUID) error {
+	ret := _m.Called(ctx, integrationID)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, uuid.UUID) error); ok {
+		r0 = rf(ctx, integrationID)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// DeleteTenant provides a mock function with given fields: ctx, action
+func (_m *App) DeleteTenant(ctx context.Context, action model.TenantDevicesAction) (*model.Job, error) {
+	ret := _m.Called(ctx, action)
+
+	var r0 *model.Job
+	if rf, ok := ret.Get(0).(func(context.Context, model.TenantDevicesAction) *model.Job); ok {
+		r0 = rf(ctx, action)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*model.Job)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, model.TenantDevicesAction) error); ok {
+		r1 = rf(ctx, action)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetDeviceModule provides a mock function with given fields: ctx, integrationID, deviceID, moduleID
+func (_m *App) GetDeviceModule(ctx context.Context, integrationID uuid.UUID, deviceID string, moduleID string) (*iothub.Module, error) {
+	ret := _m.Called(ctx, integrationID, deviceID, moduleID)
+
+	var r0 *iothub.Module
+	if rf, ok := ret.Get(0).(func(context.Context, uuid.UUID, string, string) *iothub.Module); ok {
+		r0 = rf(ctx, integrationID, deviceID, moduleID)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*iothub.Module)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, uuid.UUID, string, string) error); ok {
+		r1 = rf(ctx, integrationID, deviceID, moduleID)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetDeviceModuleTwin provides a mock function with given fields: ctx, integrationID, deviceID, moduleID
+func (_m *App) GetDeviceModuleTwin(ctx context.Context, integrationID uuid.UUID, deviceID string, moduleID string) (*iothub.DeviceTwin, error) {
+	ret := _m.Called(ctx, integrationID, deviceID, moduleID)
+
+	var r0 *iothub.DeviceTwin
+	if rf, ok := ret.Get(0).(func(context.Context, uuid.UUID, string, string) *iothub.DeviceTwin); ok {
+		r0 = rf(ctx, integrationID, deviceID, moduleID)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*iothub.DeviceTwin)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, uuid.UUID, string, string) error); ok {
+		r1 = rf(ctx, integrationID, deviceID, moduleID)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetHubConfiguration provides a mock function with given fields: ctx, integrationID, configID
+func (_m *App) GetHubConfiguration(ctx context.Context, integrationID uuid.UUID, configID string) (*iothub.Configuration, error) {
+	ret := _m.Called(ctx, integrationID, configID)
+
+	var r0 *iothub.Configuration
+	if rf, ok := ret.Get(0).(func(context.Context, uuid.UUID, string) *iothub.Configuration); ok {
+		r0 = rf(ctx, integrationID, configID)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*iothub.Configuration)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, uuid.UUID, string) error); ok {
+		r1 = rf(ctx, integrationID, configID)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetHubConfigurations provides a mock function with given fields: ctx, integrationID, top
+func (_m *App) GetHubConfigurations(ctx context.Context, integrationID uuid.UUID, top int) ([]iothub.Configuration, error) {
+	ret := _m.Called(ctx, integrationID, top)
+
+	var r0 []iothub.Configuration
+	if rf, ok := ret.Get(0).(func(context.Context, uuid.UUID, int) []iothub.Configuration); ok {
+		r0 = rf(ctx, integrationID, top)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]iothub.Configuration)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, uuid.UUID, int) error); ok {
+		r1 = rf(ctx, integrationID, top)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetHubJob provides a mock function with given fields: ctx, integrationID, jobID
+func (_m *App) GetHubJob(ctx context.Context, integrationID uuid.UUID, jobID string) (*iothub.Job, error) {
+	ret := _m.Called(ctx, integrationID, jobID)
+
+	var r0 *iothub.Job
+	if rf, ok := ret.Get(0).(func(context.Context, uuid.UUID, string) *iothub.Job); ok {
+		r0 = rf(ctx, integrationID, jobID)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*iothub.Job)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, uuid.UUID, string) error); ok {
+		r1 = rf(ctx, integrationID, jobID)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetIntegration provides a mock function with given fields: ctx, integrationID
+func (_m *App) GetIntegration(ctx context.Context, integrationID uuid.UUID) (*model.Integration, error) {
+	ret := _m.Called(ctx, integrationID)
+
+	var r0 *model.Integration
+	if rf, ok := ret.Get(0).(func(context.Context, uuid.UUID) *model.Integration); ok {
+		r0 = rf(ctx, integrationID)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*model.Integration)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, uuid.UUID) error); ok {
+		r1 = rf(ctx, integrationID)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetIntegrations provides a mock function with given fields: _a0
+func (_m *App) GetIntegrations(_a0 context.Context) ([]model.Integration, error) {
+	ret := _m.Called(_a0)
+
+	var r0 []model.Integration
+	if rf, ok := ret.Get(0).(func(context.Context) []model.Integration); ok {
+		r0 = rf(_a0)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]model.Integration)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context) error); ok {
+		r1 = rf(_a0)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetJob provides a mock function with given fields: ctx, jobID
+func (_m *App) GetJob(ctx context.Context, jobID uuid.UUID) (*model.Job, error) {
+	ret := _m.Called(ctx, jobID)
+
+	var r0 *model.Job
+	if rf, ok := ret.Get(0).(func(context.Context, uuid.UUID) *model.Job); ok {
+		r0 = rf(ctx, jobID)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*model.Job)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, uuid.UUID) error); ok {
+		r1 = rf(ctx, jobID)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetJobs provides a mock function with given fields: ctx, fltr, skip, limit
+func (_m *App) GetJobs(ctx context.Context, fltr model.JobFilter, skip int64, limit int64) ([]model.Job, error) {
+	ret := _m.Called(ctx, fltr, skip, limit)
+
+	var r0 []model.Job
+	if rf, ok := ret.Get(0).(func(context.Context, model.JobFilter, int64, int64) []model.Job); ok {
+		r0 = rf(ctx, fltr, skip, limit)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]model.Job)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, model.JobFilter, int64, int64) error); ok {
+		r1 = rf(ctx, fltr, skip, limit)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // GetSettings provides a mock function with given fields: _a0
 func (_m *App) GetSettings(_a0 context.Context) (model.Settings, error) {
 	ret := _m.Called(_a0)
@@ -66,6 +427,29 @@ func (_m *App) GetSettings(_a0 context.Context) (model.Settings, error) {
 	return r0, r1
 }
 
+// GetSettingsHistory provides a mock function with given fields: ctx, skip, limit
+func (_m *App) GetSettingsHistory(ctx context.Context, skip int64, limit int64) ([]model.SettingsRevision, error) {
+	ret := _m.Called(ctx, skip, limit)
+
+	var r0 []model.SettingsRevision
+	if rf, ok := ret.Get(0).(func(context.Context, int64, int64) []model.SettingsRevision); ok {
+		r0 = rf(ctx, skip, limit)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]model.SettingsRevision)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, int64, int64) error); ok {
+		r1 = rf(ctx, skip, limit)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // HealthCheck provides a mock function with given fields: _a0
 func (_m *App) HealthCheck(_a0 context.Context) error {
 	ret := _m.Called(_a0)
@@ -80,13 +464,313 @@ func (_m *App) HealthCheck(_a0 context.Context) error {
 	return r0
 }
 
-// ProvisionDevice provides a mock function with given fields: _a0, _a1
-func (_m *App) ProvisionDevice(_a0 context.Context, _a1 string) error {
-	ret := _m.Called(_a0, _a1)
+// InvokeDeviceMethod provides a mock function with given fields: ctx, integrationID, deviceID, moduleID, method
+func (_m *App) InvokeDeviceMethod(ctx context.Context, integrationID uuid.UUID, deviceID string, moduleID string, method *iothub.DirectMethod) (*iothub.MethodResult, error) {
+	ret := _m.Called(ctx, integrationID, deviceID, moduleID, method)
+
+	var r0 *iothub.MethodResult
+	if rf, ok := ret.Get(0).(func(context.Context, uuid.UUID, string, string, *iothub.DirectMethod) *iothub.MethodResult); ok {
+		r0 = rf(ctx, integrationID, deviceID, moduleID, method)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*iothub.MethodResult)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, uuid.UUID, string, string, *iothub.DirectMethod) error); ok {
+		r1 = rf(ctx, integrationID, deviceID, moduleID, method)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// ProvisionDevice provides a mock function with given fields: ctx, deviceID, deviceType
+func (_m *App) ProvisionDevice(ctx context.Context, deviceID string, deviceType string) error {
+	ret := _m.Called(ctx, deviceID, deviceType)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, string) error); ok {
+		r0 = rf(ctx, deviceID, deviceType)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// ProvisionDevices provides a mock function with given fields: ctx, deviceIDs
+func (_m *App) ProvisionDevices(ctx context.Context, deviceIDs []string) ([]error, error) {
+	ret := _m.Called(ctx, deviceIDs)
+
+	var r0 []error
+	if rf, ok := ret.Get(0).(func(context.Context, []string) []error); ok {
+		r0 = rf(ctx, deviceIDs)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]error)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, []string) error); ok {
+		r1 = rf(ctx, deviceIDs)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// QueryDevices provides a mock function with given fields: ctx, integrationID, q, contToken
+func (_m *App) QueryDevices(ctx context.Context, integrationID uuid.UUID, q *iothub.Query, contToken string) (*iothub.QueryPage, error) {
+	ret := _m.Called(ctx, integrationID, q, contToken)
+
+	var r0 *iothub.QueryPage
+	if rf, ok := ret.Get(0).(func(context.Context, uuid.UUID, *iothub.Query, string) *iothub.QueryPage); ok {
+		r0 = rf(ctx, integrationID, q, contToken)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*iothub.QueryPage)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, uuid.UUID, *iothub.Query, string) error); ok {
+		r1 = rf(ctx, integrationID, q, contToken)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// QueryHubJobs provides a mock function with given fields: ctx, integrationID, fltr, contToken
+func (_m *App) QueryHubJobs(ctx context.Context, integrationID uuid.UUID, fltr iothub.JobFilter, contToken string) (*iothub.JobsPage, error) {
+	ret := _m.Called(ctx, integrationID, fltr, contToken)
+
+	var r0 *iothub.JobsPage
+	if rf, ok := ret.Get(0).(func(context.Context, uuid.UUID, iothub.JobFilter, string) *iothub.JobsPage); ok {
+		r0 = rf(ctx, integrationID, fltr, contToken)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*iothub.JobsPage)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, uuid.UUID, iothub.JobFilter, string) error); ok {
+		r1 = rf(ctx, integrationID, fltr, contToken)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// ReconcileDevices provides a mock function with given fields: ctx, opts
+func (_m *App) ReconcileDevices(ctx context.Context, opts model.ReconcileOptions) ([]model.ReconcileReport, error) {
+	ret := _m.Called(ctx, opts)
+
+	var r0 []model.ReconcileReport
+	if rf, ok := ret.Get(0).(func(context.Context, model.ReconcileOptions) []model.ReconcileReport); ok {
+		r0 = rf(ctx, opts)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]model.ReconcileReport)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, model.ReconcileOptions) error); ok {
+		r1 = rf(ctx, opts)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// RestoreSettings provides a mock function with given fields: ctx, revision, ifMatch
+func (_m *App) RestoreSettings(ctx context.Context, revision int, ifMatch int) error {
+	ret := _m.Called(ctx, revision, ifMatch)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, int, int) error); ok {
+		r0 = rf(ctx, revision, ifMatch)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// RevealIntegration provides a mock function with given fields: ctx, integrationID
+func (_m *App) RevealIntegration(ctx context.Context, integrationID uuid.UUID) (*model.Integration, error) {
+	ret := _m.Called(ctx, integrationID)
+
+	var r0 *model.Integration
+	if rf, ok := ret.Get(0).(func(context.Context, uuid.UUID) *model.Integration); ok {
+		r0 = rf(ctx, integrationID)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*model.Integration)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, uuid.UUID) error); ok {
+		r1 = rf(ctx, integrationID)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// RotateDeviceKeys provides a mock function with given fields: ctx, deviceID, phase
+func (_m *App) RotateDeviceKeys(ctx context.Context, deviceID string, phase model.KeyRotationPhase) error {
+	ret := _m.Called(ctx, deviceID, phase)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, model.KeyRotationPhase) error); ok {
+		r0 = rf(ctx, deviceID, phase)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// RotateTenantKeys provides a mock function with given fields: ctx, phase
+func (_m *App) RotateTenantKeys(ctx context.Context, phase model.KeyRotationPhase) (*model.Job, error) {
+	ret := _m.Called(ctx, phase)
+
+	var r0 *model.Job
+	if rf, ok := ret.Get(0).(func(context.Context, model.KeyRotationPhase) *model.Job); ok {
+		r0 = rf(ctx, phase)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*model.Job)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, model.KeyRotationPhase) error); ok {
+		r1 = rf(ctx, phase)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// RunJobWorker provides a mock function with given fields: ctx, workerID
+func (_m *App) RunJobWorker(ctx context.Context, workerID string) error {
+	ret := _m.Called(ctx, workerID)
 
 	var r0 error
 	if rf, ok := ret.Get(0).(func(context.Context, string) error); ok {
-		r0 = rf(_a0, _a1)
+		r0 = rf(ctx, workerID)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// ScheduleDeviceProvisioning provides a mock function with given fields: ctx, deviceIDs
+func (_m *App) ScheduleDeviceProvisioning(ctx context.Context, deviceIDs []string) (*model.Job, error) {
+	ret := _m.Called(ctx, deviceIDs)
+
+	var r0 *model.Job
+	if rf, ok := ret.Get(0).(func(context.Context, []string) *model.Job); ok {
+		r0 = rf(ctx, deviceIDs)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*model.Job)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, []string) error); ok {
+		r1 = rf(ctx, deviceIDs)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// ScheduleHubJob provides a mock function with given fields: ctx, integrationID, job
+func (_m *App) ScheduleHubJob(ctx context.Context, integrationID uuid.UUID, job iothub.Job) (*iothub.Job, error) {
+	ret := _m.Called(ctx, integrationID, job)
+
+	var r0 *iothub.Job
+	if rf, ok := ret.Get(0).(func(context.Context, uuid.UUID, iothub.Job) *iothub.Job); ok {
+		r0 = rf(ctx, integrationID, job)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*iothub.Job)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, uuid.UUID, iothub.Job) error); ok {
+		r1 = rf(ctx, integrationID, job)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// ScheduleReconciliation provides a mock function with given fields: ctx, interval, opts
+func (_m *App) ScheduleReconciliation(ctx context.Context, interval time.Duration, opts model.ReconcileOptions) (*model.Job, error) {
+	ret := _m.Called(ctx, interval, opts)
+
+	var r0 *model.Job
+	if rf, ok := ret.Get(0).(func(context.Context, time.Duration, model.ReconcileOptions) *model.Job); ok {
+		r0 = rf(ctx, interval, opts)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*model.Job)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, time.Duration, model.ReconcileOptions) error); ok {
+		r1 = rf(ctx, interval, opts)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// SetDefaultConnectionString provides a mock function with given fields: ctx, cs, revision
+func (_m *App) SetDefaultConnectionString(ctx context.Context, cs *model.ConnectionString, revision int) error {
+	ret := _m.Called(ctx, cs, revision)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, *model.ConnectionString, int) error); ok {
+		r0 = rf(ctx, cs, revision)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// SetDeviceParent provides a mock function with given fields: ctx, integrationID, deviceID, parentID, gatewayHostName
+func (_m *App) SetDeviceParent(ctx context.Context, integrationID uuid.UUID, deviceID string, parentID string, gatewayHostName string) error {
+	ret := _m.Called(ctx, integrationID, deviceID, parentID, gatewayHostName)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, uuid.UUID, string, string, string) error); ok {
+		r0 = rf(ctx, integrationID, deviceID, parentID, gatewayHostName)
 	} else {
 		r0 = ret.Error(0)
 	}
@@ -108,6 +792,29 @@ func (_m *App) SetDeviceStatus(_a0 context.Context, _a1 string, _a2 app.Status)
 	return r0
 }
 
+// SetDevicesStatus provides a mock function with given fields: ctx, deviceIDs, status
+func (_m *App) SetDevicesStatus(ctx context.Context, deviceIDs []string, status app.Status) ([]error, error) {
+	ret := _m.Called(ctx, deviceIDs, status)
+
+	var r0 []error
+	if rf, ok := ret.Get(0).(func(context.Context, []string, app.Status) []error); ok {
+		r0 = rf(ctx, deviceIDs, status)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]error)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, []string, app.Status) error); ok {
+		r1 = rf(ctx, deviceIDs, status)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // SetSettings provides a mock function with given fields: _a0, _a1
 func (_m *App) SetSettings(_a0 context.Context, _a1 model.Settings) error {
 	ret := _m.Called(_a0, _a1)
@@ -121,3 +828,77 @@ func (_m *App) SetSettings(_a0 context.Context, _a1 model.Settings) error {
 
 	return r0
 }
+
+// UpdateDeviceModuleTwin provides a mock function with given fields: ctx, integrationID, deviceID, moduleID, update
+func (_m *App) UpdateDeviceModuleTwin(ctx context.Context, integrationID uuid.UUID, deviceID string, moduleID string, update *iothub.DeviceTwinUpdate) error {
+	ret := _m.Called(ctx, integrationID, deviceID, moduleID, update)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, uuid.UUID, string, string, *iothub.DeviceTwinUpdate) error); ok {
+		r0 = rf(ctx, integrationID, deviceID, moduleID, update)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// UpdateIntegration provides a mock function with given fields: ctx, integrationID, integration
+func (_m *App) UpdateIntegration(ctx context.Context, integrationID uuid.UUID, integration model.Integration) error {
+	ret := _m.Called(ctx, integrationID, integration)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, uuid.UUID, model.Integration) error); ok {
+		r0 = rf(ctx, integrationID, integration)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// UpsertDeviceModule provides a mock function with given fields: ctx, integrationID, deviceID, moduleID, module
+func (_m *App) UpsertDeviceModule(ctx context.Context, integrationID uuid.UUID, deviceID string, moduleID string, module *iothub.Module) (*iothub.Module, error) {
+	ret := _m.Called(ctx, integrationID, deviceID, moduleID, module)
+
+	var r0 *iothub.Module
+	if rf, ok := ret.Get(0).(func(context.Context, uuid.UUID, string, string, *iothub.Module) *iothub.Module); ok {
+		r0 = rf(ctx, integrationID, deviceID, moduleID, module)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*iothub.Module)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, uuid.UUID, string, string, *iothub.Module) error); ok {
+		r1 = rf(ctx, integrationID, deviceID, moduleID, module)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// UpsertHubConfiguration provides a mock function with given fields: ctx, integrationID, config
+func (_m *App) UpsertHubConfiguration(ctx context.Context, integrationID uuid.UUID, config iothub.Configuration) (*iothub.Configuration, error) {
+	ret := _m.Called(ctx, integrationID, config)
+
+	var r0 *iothub.Configuration
+	if rf, ok := ret.Get(0).(func(context.Context, uuid.UUID, iothub.Configuration) *iothub.Configuration); ok {
+		r0 = rf(ctx, integrationID, config)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*iothub.Configuration)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, uuid.UUID, iothub.Configuration) error); ok {
+		r1 = rf(ctx, integrationID, config)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
@@ -0,0 +1,154 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package app
+
+import (
+	"context"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+
+	"github.com/mendersoftware/iot-manager/client/iothub"
+	"github.com/mendersoftware/iot-manager/model"
+)
+
+// confKeyModulePrefix prefixes the device configuration keys of the module
+// connection strings, e.g. "$azure.modules.<module ID>.primaryKey".
+const confKeyModulePrefix = "$azure.modules."
+
+// GetDeviceModule returns the module identity of the device from the IoT
+// Hub integration or, if integrationID is nil, from the first IoT Hub
+// integration including the device.
+func (a *app) GetDeviceModule(
+	ctx context.Context,
+	integrationID uuid.UUID,
+	deviceID, moduleID string,
+) (*iothub.Module, error) {
+	cs, err := a.deviceHubConnectionString(ctx, integrationID, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	module, err := a.hub.GetModule(ctx, cs, deviceID, moduleID)
+	return module, errors.Wrap(err, "failed to retrieve module from IoT Hub")
+}
+
+// UpsertDeviceModule creates or updates the module identity of the device
+// and sends the module connection strings to the device configuration.
+func (a *app) UpsertDeviceModule(
+	ctx context.Context,
+	integrationID uuid.UUID,
+	deviceID, moduleID string,
+	module *iothub.Module,
+) (*iothub.Module, error) {
+	cs, err := a.deviceHubConnectionString(ctx, integrationID, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	module, err = a.hub.UpsertModule(ctx, cs, deviceID, moduleID, module)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to update module in IoT Hub")
+	}
+	if module.Auth == nil || module.Auth.SymmetricKey == nil {
+		// The module authenticates with a certificate.
+		return module, nil
+	}
+	config := moduleKeyConfig(cs, module)
+	err = a.wf.ProvisionExternalDevice(ctx, deviceID, model.ProviderIoTHub, config)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to submit module authn to deviceconfig")
+	}
+	return module, nil
+}
+
+// moduleKeyConfig returns the device configuration with the primary and
+// secondary connection strings of the module.
+func moduleKeyConfig(
+	cs *model.ConnectionString,
+	module *iothub.Module,
+) map[string]string {
+	primKey := &model.ConnectionString{
+		Key:      module.Auth.SymmetricKey.Primary,
+		DeviceID: module.DeviceID,
+		ModuleID: module.ModuleID,
+		HostName: cs.HostName,
+	}
+	secKey := &model.ConnectionString{
+		Key:      module.Auth.SymmetricKey.Secondary,
+		DeviceID: module.DeviceID,
+		ModuleID: module.ModuleID,
+		HostName: cs.HostName,
+	}
+	prefix := confKeyModulePrefix + module.ModuleID + "."
+	return map[string]string{
+		prefix + "primaryKey":   primKey.String(),
+		prefix + "secondaryKey": secKey.String(),
+	}
+}
+
+// DeleteDeviceModule removes the module identity of the device and clears
+// the module connection strings from the device configuration.
+func (a *app) DeleteDeviceModule(
+	ctx context.Context,
+	integrationID uuid.UUID,
+	deviceID, moduleID string,
+) error {
+	cs, err := a.deviceHubConnectionString(ctx, integrationID, deviceID)
+	if err != nil {
+		return err
+	}
+	err = a.hub.DeleteModule(ctx, cs, deviceID, moduleID)
+	if err != nil {
+		return errors.Wrap(err, "failed to delete module from IoT Hub")
+	}
+	// The configuration is merged into the device configuration, the
+	// empty values overwrite the revoked connection strings.
+	prefix := confKeyModulePrefix + moduleID + "."
+	config := map[string]string{
+		prefix + "primaryKey":   "",
+		prefix + "secondaryKey": "",
+	}
+	err = a.wf.ProvisionExternalDevice(ctx, deviceID, model.ProviderIoTHub, config)
+	return errors.Wrap(err, "failed to clear module authn from deviceconfig")
+}
+
+// GetDeviceModuleTwin returns the twin of the module of the device.
+func (a *app) GetDeviceModuleTwin(
+	ctx context.Context,
+	integrationID uuid.UUID,
+	deviceID, moduleID string,
+) (*iothub.DeviceTwin, error) {
+	cs, err := a.deviceHubConnectionString(ctx, integrationID, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	twin, err := a.hub.GetModuleTwin(ctx, cs, deviceID, moduleID)
+	return twin, errors.Wrap(err, "failed to retrieve module twin from IoT Hub")
+}
+
+// UpdateDeviceModuleTwin patches, or replaces if update.Replace is set, the
+// tags and desired properties of the twin of the module of the device.
+func (a *app) UpdateDeviceModuleTwin(
+	ctx context.Context,
+	integrationID uuid.UUID,
+	deviceID, moduleID string,
+	update *iothub.DeviceTwinUpdate,
+) error {
+	cs, err := a.deviceHubConnectionString(ctx, integrationID, deviceID)
+	if err != nil {
+		return err
+	}
+	err = a.hub.UpdateModuleTwin(ctx, cs, deviceID, moduleID, update)
+	return errors.Wrap(err, "failed to update module twin in IoT Hub")
+}
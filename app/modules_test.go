@@ -0,0 +1,401 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package app
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/mendersoftware/iot-manager/client/iothub"
+	miothub "github.com/mendersoftware/iot-manager/client/iothub/mocks"
+	mworkflows "github.com/mendersoftware/iot-manager/client/workflows/mocks"
+	"github.com/mendersoftware/iot-manager/model"
+	storeMocks "github.com/mendersoftware/iot-manager/store/mocks"
+)
+
+func TestUpsertDeviceModule(t *testing.T) {
+	t.Parallel()
+	const (
+		deviceID = "6c985f61-5093-45eb-8ece-7dfe97a6de7b"
+		moduleID = "agent"
+	)
+	cs := &model.ConnectionString{
+		HostName: "localhost",
+		Key:      []byte("super secret"),
+		Name:     "my favorite string",
+	}
+	settings := model.Settings{Integrations: []model.Integration{{
+		ID:               uuid.New(),
+		Provider:         model.ProviderIoTHub,
+		ConnectionString: cs,
+	}}}
+	module := &iothub.Module{
+		Auth: &iothub.Auth{
+			Type: iothub.AuthTypeSymmetric,
+			SymmetricKey: &iothub.SymmetricKey{
+				Primary:   iothub.Key("primary"),
+				Secondary: iothub.Key("secondary"),
+			},
+		},
+		DeviceID: deviceID,
+		ModuleID: moduleID,
+	}
+	config := map[string]string{
+		"$azure.modules.agent.primaryKey": (&model.ConnectionString{
+			HostName: cs.HostName,
+			DeviceID: deviceID,
+			ModuleID: moduleID,
+			Key:      []byte("primary"),
+		}).String(),
+		"$azure.modules.agent.secondaryKey": (&model.ConnectionString{
+			HostName: cs.HostName,
+			DeviceID: deviceID,
+			ModuleID: moduleID,
+			Key:      []byte("secondary"),
+		}).String(),
+	}
+	type testCase struct {
+		Name string
+
+		Hub func(t *testing.T, self *testCase) *miothub.Client
+		Wf  func(t *testing.T, self *testCase) *mworkflows.Client
+
+		Module *iothub.Module
+		Error  error
+	}
+	testCases := []testCase{{
+		Name: "ok",
+
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			hub := new(miothub.Client)
+			hub.On("UpsertModule", contextMatcher,
+				cs, deviceID, moduleID, (*iothub.Module)(nil)).
+				Return(module, nil)
+			return hub
+		},
+		Wf: func(t *testing.T, self *testCase) *mworkflows.Client {
+			wf := new(mworkflows.Client)
+			wf.On("ProvisionExternalDevice", contextMatcher,
+				deviceID, model.ProviderIoTHub, config).
+				Return(nil)
+			return wf
+		},
+		Module: module,
+	}, {
+		Name: "ok, certificate authentication",
+
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			hub := new(miothub.Client)
+			hub.On("UpsertModule", contextMatcher,
+				cs, deviceID, moduleID, (*iothub.Module)(nil)).
+				Return(&iothub.Module{
+					Auth:     &iothub.Auth{Type: iothub.AuthTypeSelfSigned},
+					DeviceID: deviceID,
+					ModuleID: moduleID,
+				}, nil)
+			return hub
+		},
+		Wf: func(t *testing.T, self *testCase) *mworkflows.Client {
+			return new(mworkflows.Client)
+		},
+		Module: &iothub.Module{
+			Auth:     &iothub.Auth{Type: iothub.AuthTypeSelfSigned},
+			DeviceID: deviceID,
+			ModuleID: moduleID,
+		},
+	}, {
+		Name: "error, IoT Hub",
+
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			hub := new(miothub.Client)
+			hub.On("UpsertModule", contextMatcher,
+				cs, deviceID, moduleID, (*iothub.Module)(nil)).
+				Return(nil, errors.New("conflict"))
+			return hub
+		},
+		Wf: func(t *testing.T, self *testCase) *mworkflows.Client {
+			return new(mworkflows.Client)
+		},
+		Error: errors.New("failed to update module in IoT Hub: conflict"),
+	}, {
+		Name: "error, workflows",
+
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			hub := new(miothub.Client)
+			hub.On("UpsertModule", contextMatcher,
+				cs, deviceID, moduleID, (*iothub.Module)(nil)).
+				Return(module, nil)
+			return hub
+		},
+		Wf: func(t *testing.T, self *testCase) *mworkflows.Client {
+			wf := new(mworkflows.Client)
+			wf.On("ProvisionExternalDevice", contextMatcher,
+				deviceID, model.ProviderIoTHub, config).
+				Return(errors.New("unavailable"))
+			return wf
+		},
+		Error: errors.New("failed to submit module authn to deviceconfig: unavailable"),
+	}}
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			ds := new(storeMocks.DataStore)
+			ds.On("GetSettings", contextMatcher).Return(settings, nil)
+			hub := tc.Hub(t, &tc)
+			wf := tc.Wf(t, &tc)
+			defer ds.AssertExpectations(t)
+			defer hub.AssertExpectations(t)
+			defer wf.AssertExpectations(t)
+
+			app := New(ds, hub, wf)
+			res, err := app.UpsertDeviceModule(context.Background(),
+				uuid.Nil, deviceID, moduleID, nil,
+			)
+			if tc.Error != nil {
+				if assert.Error(t, err) {
+					assert.Regexp(t, tc.Error.Error(), err.Error())
+				}
+			} else if assert.NoError(t, err) {
+				assert.Equal(t, tc.Module, res)
+			}
+		})
+	}
+}
+
+func TestDeviceModules(t *testing.T) {
+	t.Parallel()
+	const (
+		deviceID = "6c985f61-5093-45eb-8ece-7dfe97a6de7b"
+		moduleID = "agent"
+	)
+	cs := &model.ConnectionString{
+		HostName: "localhost",
+		Key:      []byte("super secret"),
+		Name:     "my favorite string",
+	}
+	settings := model.Settings{Integrations: []model.Integration{{
+		ID:               uuid.New(),
+		Provider:         model.ProviderIoTHub,
+		ConnectionString: cs,
+	}}}
+	module := &iothub.Module{DeviceID: deviceID, ModuleID: moduleID}
+	twin := &iothub.DeviceTwin{DeviceID: deviceID, ModuleID: moduleID}
+	update := &iothub.DeviceTwinUpdate{
+		Tags: map[string]interface{}{"ring": 1},
+	}
+	testCases := []struct {
+		Name string
+
+		Settings model.Settings
+		Call     func(a App) (interface{}, error)
+		Hub      func(t *testing.T) *miothub.Client
+		Wf       func(t *testing.T) *mworkflows.Client
+
+		Result interface{}
+		Error  error
+	}{{
+		Name: "ok, get module",
+
+		Settings: settings,
+		Call: func(a App) (interface{}, error) {
+			return a.GetDeviceModule(context.Background(),
+				uuid.Nil, deviceID, moduleID,
+			)
+		},
+		Hub: func(t *testing.T) *miothub.Client {
+			hub := new(miothub.Client)
+			hub.On("GetModule", contextMatcher, cs, deviceID, moduleID).
+				Return(module, nil)
+			return hub
+		},
+		Result: module,
+	}, {
+		Name: "error, get module",
+
+		Settings: settings,
+		Call: func(a App) (interface{}, error) {
+			return a.GetDeviceModule(context.Background(),
+				uuid.Nil, deviceID, moduleID,
+			)
+		},
+		Hub: func(t *testing.T) *miothub.Client {
+			hub := new(miothub.Client)
+			hub.On("GetModule", contextMatcher, cs, deviceID, moduleID).
+				Return(nil, errors.New("not found"))
+			return hub
+		},
+		Error: errors.New("failed to retrieve module from IoT Hub: not found"),
+	}, {
+		Name: "error, no IoT Hub integration",
+
+		Settings: model.Settings{},
+		Call: func(a App) (interface{}, error) {
+			return a.GetDeviceModule(context.Background(),
+				uuid.Nil, deviceID, moduleID,
+			)
+		},
+		Hub: func(t *testing.T) *miothub.Client {
+			return new(miothub.Client)
+		},
+		Error: ErrNoConnectionString,
+	}, {
+		Name: "ok, delete module",
+
+		Settings: settings,
+		Call: func(a App) (interface{}, error) {
+			return nil, a.DeleteDeviceModule(context.Background(),
+				uuid.Nil, deviceID, moduleID,
+			)
+		},
+		Hub: func(t *testing.T) *miothub.Client {
+			hub := new(miothub.Client)
+			hub.On("DeleteModule", contextMatcher, cs, deviceID, moduleID).
+				Return(nil)
+			return hub
+		},
+		Wf: func(t *testing.T) *mworkflows.Client {
+			wf := new(mworkflows.Client)
+			wf.On("ProvisionExternalDevice", contextMatcher,
+				deviceID, model.ProviderIoTHub, map[string]string{
+					"$azure.modules.agent.primaryKey":   "",
+					"$azure.modules.agent.secondaryKey": "",
+				}).
+				Return(nil)
+			return wf
+		},
+	}, {
+		Name: "error, delete module workflows",
+
+		Settings: settings,
+		Call: func(a App) (interface{}, error) {
+			return nil, a.DeleteDeviceModule(context.Background(),
+				uuid.Nil, deviceID, moduleID,
+			)
+		},
+		Hub: func(t *testing.T) *miothub.Client {
+			hub := new(miothub.Client)
+			hub.On("DeleteModule", contextMatcher, cs, deviceID, moduleID).
+				Return(nil)
+			return hub
+		},
+		Wf: func(t *testing.T) *mworkflows.Client {
+			wf := new(mworkflows.Client)
+			wf.On("ProvisionExternalDevice", contextMatcher,
+				deviceID, model.ProviderIoTHub,
+				mock.AnythingOfType("map[string]string")).
+				Return(errors.New("internal error"))
+			return wf
+		},
+		Error: errors.New("failed to clear module authn from deviceconfig: " +
+			"internal error"),
+	}, {
+		Name: "error, delete module",
+
+		Settings: settings,
+		Call: func(a App) (interface{}, error) {
+			return nil, a.DeleteDeviceModule(context.Background(),
+				uuid.Nil, deviceID, moduleID,
+			)
+		},
+		Hub: func(t *testing.T) *miothub.Client {
+			hub := new(miothub.Client)
+			hub.On("DeleteModule", contextMatcher, cs, deviceID, moduleID).
+				Return(errors.New("not found"))
+			return hub
+		},
+		Error: errors.New("failed to delete module from IoT Hub: not found"),
+	}, {
+		Name: "ok, get module twin",
+
+		Settings: settings,
+		Call: func(a App) (interface{}, error) {
+			return a.GetDeviceModuleTwin(context.Background(),
+				uuid.Nil, deviceID, moduleID,
+			)
+		},
+		Hub: func(t *testing.T) *miothub.Client {
+			hub := new(miothub.Client)
+			hub.On("GetModuleTwin", contextMatcher, cs, deviceID, moduleID).
+				Return(twin, nil)
+			return hub
+		},
+		Result: twin,
+	}, {
+		Name: "ok, update module twin",
+
+		Settings: settings,
+		Call: func(a App) (interface{}, error) {
+			return nil, a.UpdateDeviceModuleTwin(context.Background(),
+				uuid.Nil, deviceID, moduleID, update,
+			)
+		},
+		Hub: func(t *testing.T) *miothub.Client {
+			hub := new(miothub.Client)
+			hub.On("UpdateModuleTwin", contextMatcher,
+				cs, deviceID, moduleID, update).
+				Return(nil)
+			return hub
+		},
+	}, {
+		Name: "error, update module twin",
+
+		Settings: settings,
+		Call: func(a App) (interface{}, error) {
+			return nil, a.UpdateDeviceModuleTwin(context.Background(),
+				uuid.Nil, deviceID, moduleID, update,
+			)
+		},
+		Hub: func(t *testing.T) *miothub.Client {
+			hub := new(miothub.Client)
+			hub.On("UpdateModuleTwin", contextMatcher,
+				cs, deviceID, moduleID, update).
+				Return(errors.New("precondition failed"))
+			return hub
+		},
+		Error: errors.New("failed to update module twin in IoT Hub: " +
+			"precondition failed"),
+	}}
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			ds := new(storeMocks.DataStore)
+			ds.On("GetSettings", contextMatcher).Return(tc.Settings, nil)
+			hub := tc.Hub(t)
+			wf := new(mworkflows.Client)
+			if tc.Wf != nil {
+				wf = tc.Wf(t)
+			}
+			defer ds.AssertExpectations(t)
+			defer hub.AssertExpectations(t)
+			defer wf.AssertExpectations(t)
+
+			res, err := tc.Call(New(ds, hub, wf))
+			if tc.Error != nil {
+				if assert.Error(t, err) {
+					assert.Regexp(t, tc.Error.Error(), err.Error())
+				}
+			} else if assert.NoError(t, err) && tc.Result != nil {
+				assert.Equal(t, tc.Result, res)
+			}
+		})
+	}
+}
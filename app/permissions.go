@@ -0,0 +1,146 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package app
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+
+	"github.com/mendersoftware/iot-manager/client"
+	"github.com/mendersoftware/iot-manager/client/iothub"
+	"github.com/mendersoftware/iot-manager/model"
+)
+
+// IoT Hub shared access policy permissions required by the service.
+const (
+	PermissionRegistryRead   = "RegistryRead"
+	PermissionRegistryWrite  = "RegistryWrite"
+	PermissionServiceConnect = "ServiceConnect"
+)
+
+const (
+	probeDeviceIDPrefix = "mender-permission-check-"
+	probeMethodName     = "mender-permission-check"
+)
+
+// ConnectionStringError is returned when a connection string fails the
+// verification against the IoT Hub.
+type ConnectionStringError struct {
+	// MissingPermissions lists the permissions the shared access policy
+	// of the connection string lacks.
+	MissingPermissions []string
+	// Err is the error preventing the verification, if any.
+	Err error
+}
+
+func (err *ConnectionStringError) Error() string {
+	if len(err.MissingPermissions) > 0 {
+		return "connection string is missing permissions: " +
+			strings.Join(err.MissingPermissions, ", ")
+	}
+	return "failed to verify connection string: " + err.Err.Error()
+}
+
+// verifyIntegrations verifies the connection strings of the integrations
+// that are not part of the current settings.
+func (a *app) verifyIntegrations(
+	ctx context.Context,
+	current model.Settings,
+	integrations ...model.Integration,
+) error {
+	if a.skipVerify {
+		return nil
+	}
+	known := make(map[string]bool, len(current.Integrations))
+	for _, integration := range current.Integrations {
+		if integration.ConnectionString != nil {
+			known[integration.ConnectionString.String()] = true
+		}
+	}
+	for _, integration := range integrations {
+		cs := integration.ConnectionString
+		if integration.Provider == model.ProviderIoTCore ||
+			cs == nil || known[cs.String()] {
+			continue
+		}
+		err := a.verifyConnectionString(ctx, cs)
+		if err != nil {
+			return errors.Wrapf(err, "integration %q", integration.Name)
+		}
+		known[cs.String()] = true
+	}
+	return nil
+}
+
+// verifyConnectionString checks the permissions of the connection string
+// using requests on a device that does not exist: the IoT Hub responds with
+// 404 if the request is permitted and with 401 otherwise.
+func (a *app) verifyConnectionString(
+	ctx context.Context,
+	cs *model.ConnectionString,
+) error {
+	probeID := probeDeviceIDPrefix + uuid.NewString()
+	checks := []struct {
+		Permission string
+		Check      func() error
+	}{{
+		Permission: PermissionRegistryRead,
+		Check: func() error {
+			_, err := a.hub.GetDevice(ctx, cs, probeID)
+			return err
+		},
+	}, {
+		Permission: PermissionRegistryWrite,
+		Check: func() error {
+			return a.hub.DeleteDevice(ctx, cs, probeID)
+		},
+	}, {
+		Permission: PermissionServiceConnect,
+		Check: func() error {
+			// Reading twins only requires RegistryRead, invoking a direct
+			// method requires ServiceConnect.
+			_, err := a.hub.InvokeDeviceMethod(ctx, cs, probeID,
+				&iothub.DirectMethod{Name: probeMethodName},
+			)
+			return err
+		},
+	}}
+	var missing []string
+	for _, check := range checks {
+		err := check.Check()
+		if err == nil {
+			continue
+		}
+		htErr, ok := errors.Cause(err).(client.HTTPError)
+		if !ok {
+			return &ConnectionStringError{Err: err}
+		}
+		switch htErr.Code {
+		case http.StatusNotFound:
+		case http.StatusUnauthorized, http.StatusForbidden:
+			missing = append(missing, check.Permission)
+		default:
+			return &ConnectionStringError{Err: err}
+		}
+	}
+	if len(missing) > 0 {
+		return &ConnectionStringError{MissingPermissions: missing}
+	}
+	return nil
+}
@@ -0,0 +1,418 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package app
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/mendersoftware/go-lib-micro/identity"
+	"github.com/mendersoftware/go-lib-micro/log"
+
+	"github.com/mendersoftware/iot-manager/client/iothub"
+	"github.com/mendersoftware/iot-manager/model"
+	"github.com/mendersoftware/iot-manager/store"
+
+	"github.com/pkg/errors"
+)
+
+const tagMender = iothub.TagMender
+
+const (
+	// reconcileGracePeriod is the time after the last update of a device
+	// record during which the device is left out of the reconciliation,
+	// as it may be in the middle of being provisioned or decommissioned.
+	reconcileGracePeriod = 10 * time.Minute
+
+	// jobParamFix and jobParamDeleteOrphans are the ReconcileOptions of
+	// a reconcile job.
+	jobParamFix           = "fix"
+	jobParamDeleteOrphans = "delete_orphans"
+)
+
+// reconcileJobNamespace is the namespace of the IDs of the reconcile jobs.
+var reconcileJobNamespace = uuid.MustParse("5c1a6b0e-3f1d-4f7e-9b1e-7d0c2a9e4b61")
+
+var (
+	ErrNoDeviceAuth = errors.New(
+		"the device authentication service is not configured",
+	)
+)
+
+// menderDevicesQuery selects the IDs of the devices tagged by Mender.
+func menderDevicesQuery() *iothub.Query {
+	return iothub.NewQuery().
+		Fields(iothub.FieldDeviceID).
+		And(iothub.Tag(tagMender).Eq(true))
+}
+
+// ReconcileDevices compares the devices known to Mender with the devices
+// tagged by Mender in the IoT Hub. If the context carries an identity only
+// the identity's tenant is reconciled, otherwise all tenants are.
+// The differences are only resolved as selected by opts; devices unknown to
+// the device authentication service are only ever removed from the IoT Hub
+// with opts.DeleteOrphans.
+func (a *app) ReconcileDevices(
+	ctx context.Context,
+	opts model.ReconcileOptions,
+) ([]model.ReconcileReport, error) {
+	var tenantIDs []string
+	if id := identity.FromContext(ctx); id != nil {
+		tenantIDs = []string{id.Tenant}
+	} else {
+		var err error
+		tenantIDs, err = a.store.GetTenantIDs(ctx)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to retrieve tenants")
+		}
+	}
+	reports := make([]model.ReconcileReport, 0, len(tenantIDs))
+	for _, tenantID := range tenantIDs {
+		reports = append(reports, a.reconcileTenantReports(ctx, tenantID, opts)...)
+	}
+	return reports, nil
+}
+
+// ScheduleReconciliation creates the job reconciling the devices of all
+// tenants in the current interval. The job ID is derived from the start of
+// the interval, so the replicas scheduling the reconciliation agree on a
+// single job; ErrJobExists is returned if the job was already created.
+func (a *app) ScheduleReconciliation(
+	ctx context.Context,
+	interval time.Duration,
+	opts model.ReconcileOptions,
+) (*model.Job, error) {
+	start := time.Now().Truncate(interval)
+	job := model.NewJob("", model.JobTypeReconcile, map[string]string{
+		jobParamFix:           strconv.FormatBool(opts.Fix),
+		jobParamDeleteOrphans: strconv.FormatBool(opts.DeleteOrphans),
+	})
+	job.ID = uuid.NewSHA1(reconcileJobNamespace,
+		[]byte(strconv.FormatInt(start.Unix(), 10)))
+	err := a.store.CreateJob(ctx, job)
+	if err == store.ErrObjectExists {
+		return nil, ErrJobExists
+	} else if err != nil {
+		return nil, errors.Wrap(err, "failed to create job")
+	}
+	return &job, nil
+}
+
+func (a *app) reconcileJob(
+	ctx context.Context,
+	job *model.Job,
+	tracker *jobTracker,
+) error {
+	opts := model.ReconcileOptions{
+		Fix:           job.Params[jobParamFix] == "true",
+		DeleteOrphans: job.Params[jobParamDeleteOrphans] == "true",
+	}
+	tenantIDs, err := a.store.GetTenantIDs(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to retrieve tenants")
+	}
+	l := log.FromContext(ctx)
+	for _, tenantID := range tenantIDs {
+		var errTenant error
+		for _, report := range a.reconcileTenantReports(ctx, tenantID, opts) {
+			tl := l.F(log.Ctx{"tenant_id": report.TenantID})
+			switch {
+			case report.Error != "":
+				tl.Errorf("failed to reconcile devices: %s", report.Error)
+				errTenant = errors.New(report.Error)
+			case len(report.Orphans) > 0 || len(report.Missing) > 0 ||
+				len(report.Unrecorded) > 0:
+				tl.Warnf("device reconciliation: %d orphaned, %d missing "+
+					"and %d unrecorded devices", len(report.Orphans),
+					len(report.Missing), len(report.Unrecorded))
+			}
+			for _, errMsg := range report.Errors {
+				tl.Errorf("device reconciliation: %s", errMsg)
+				if errTenant == nil {
+					errTenant = errors.New(errMsg)
+				}
+			}
+		}
+		tracker.itemDone(ctx, tenantID, errTenant)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+	if failed := tracker.progress.Failed; failed > 0 {
+		return errors.Errorf("failed to reconcile the devices of %d tenants", failed)
+	}
+	return nil
+}
+
+// reconcileTenantReports reconciles the devices of the tenant, a failure
+// to reconcile the tenant is recorded in the reports.
+func (a *app) reconcileTenantReports(
+	ctx context.Context,
+	tenantID string,
+	opts model.ReconcileOptions,
+) []model.ReconcileReport {
+	tenantCtx := identity.WithContext(ctx, &identity.Identity{
+		Tenant: tenantID,
+	})
+	reports, err := a.reconcileTenant(tenantCtx, tenantID, opts)
+	if err != nil {
+		reports = append(reports, model.ReconcileReport{
+			TenantID:   tenantID,
+			Orphans:    []string{},
+			Missing:    []string{},
+			Unrecorded: []string{},
+			Error:      err.Error(),
+		})
+	}
+	return reports
+}
+
+// reconcileTenant reconciles every IoT Hub integration of the tenant.
+func (a *app) reconcileTenant(
+	ctx context.Context,
+	tenantID string,
+	opts model.ReconcileOptions,
+) ([]model.ReconcileReport, error) {
+	settings, err := a.GetSettings(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to retrieve settings")
+	}
+	var (
+		devices []model.Device
+		reports []model.ReconcileReport
+	)
+	for _, integration := range settings.Integrations {
+		if integration.ConnectionString == nil ||
+			integration.Provider == model.ProviderIoTCore {
+			// Nothing to reconcile, reconciliation is only supported
+			// for IoT Hub.
+			continue
+		}
+		if devices == nil {
+			devices, err = a.store.GetDevices(ctx, model.DeviceFilter{})
+			if err != nil {
+				return nil, errors.Wrap(err, "failed to retrieve devices")
+			}
+		}
+		report := model.ReconcileReport{
+			TenantID:      tenantID,
+			IntegrationID: integration.ID.String(),
+			Orphans:       []string{},
+			Missing:       []string{},
+			Unrecorded:    []string{},
+		}
+		err = a.reconcileIntegration(ctx, integration, devices, &report, opts)
+		if err != nil {
+			report.Error = err.Error()
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
+
+func (a *app) reconcileIntegration(
+	ctx context.Context,
+	integration model.Integration,
+	devices []model.Device,
+	report *model.ReconcileReport,
+	opts model.ReconcileOptions,
+) error {
+	// expected maps the hub device IDs that should exist in the IoT Hub
+	// to the Mender device IDs, unwanted are the recorded devices that
+	// should not exist in the IoT Hub.
+	var (
+		expected    = make(map[string]string, len(devices))
+		unwanted    = make(map[string]struct{})
+		skipped     = make(map[string]struct{})
+		deviceTypes = make(map[string]string, len(devices))
+		since       = time.Now().Add(-reconcileGracePeriod)
+	)
+	for _, dev := range devices {
+		deviceTypes[dev.ID] = dev.DeviceType
+		hubID := dev.HubDeviceID
+		if hubID == "" {
+			hubID = dev.ID
+		}
+		switch {
+		case dev.UpdatedTS.After(since):
+			skipped[hubID] = struct{}{}
+		case dev.State == model.DeviceStateDecommissionFailed ||
+			!integration.Scope.Includes(dev.ID):
+			unwanted[hubID] = struct{}{}
+		default:
+			expected[hubID] = dev.ID
+		}
+	}
+
+	cur, err := a.hub.GetDeviceTwins(ctx,
+		integration.ConnectionString, menderDevicesQuery(),
+	)
+	if err != nil {
+		return errors.Wrap(err, "failed to retrieve devices from IoT Hub")
+	}
+	var (
+		twin     iothub.DeviceTwin
+		present  = make(map[string]struct{})
+		unknown  []string
+		orphaned []string
+	)
+	for cur.Next(ctx) {
+		twin = iothub.DeviceTwin{}
+		if err = cur.Decode(&twin); err != nil {
+			return errors.Wrap(err, "failed to decode device twin")
+		}
+		present[twin.DeviceID] = struct{}{}
+		if _, ok := expected[twin.DeviceID]; ok {
+			continue
+		} else if _, ok := skipped[twin.DeviceID]; ok {
+			continue
+		} else if _, ok := unwanted[twin.DeviceID]; ok {
+			orphaned = append(orphaned, twin.DeviceID)
+		} else {
+			unknown = append(unknown, twin.DeviceID)
+		}
+	}
+	if err = cur.Decode(&twin); err != io.EOF {
+		return errors.Wrap(err, "failed to retrieve devices from IoT Hub")
+	}
+	// The devices without a record are only orphans if Mender does not
+	// know about them.
+	unrecorded, err := a.knownDevices(ctx, unknown)
+	if err != nil {
+		return err
+	}
+	for _, hubID := range unknown {
+		if _, ok := unrecorded[hubID]; ok {
+			report.Unrecorded = append(report.Unrecorded, hubID)
+		} else {
+			orphaned = append(orphaned, hubID)
+		}
+	}
+	report.Orphans = append(report.Orphans, orphaned...)
+	// Devices enrolled through the Device Provisioning Service only appear
+	// in the hub once they have registered themselves.
+	if integration.ProvisioningMode != model.ProvisioningModeDPS {
+		for hubID, deviceID := range expected {
+			if _, ok := present[hubID]; !ok {
+				report.Missing = append(report.Missing, deviceID)
+			}
+		}
+	}
+	sort.Strings(report.Orphans)
+	sort.Strings(report.Missing)
+	sort.Strings(report.Unrecorded)
+
+	if opts.Fix || opts.DeleteOrphans {
+		a.fixReconcileReport(ctx, integration, report, opts, deviceTypes)
+	}
+	return nil
+}
+
+// knownDevices returns the set of the device IDs known to the device
+// authentication service.
+func (a *app) knownDevices(
+	ctx context.Context,
+	deviceIDs []string,
+) (map[string]struct{}, error) {
+	known := make(map[string]struct{}, len(deviceIDs))
+	if len(deviceIDs) == 0 {
+		return known, nil
+	} else if a.devauth == nil {
+		return nil, ErrNoDeviceAuth
+	}
+	devices, err := a.devauth.GetDevices(ctx, deviceIDs)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to retrieve devices from deviceauth")
+	}
+	for _, dev := range devices {
+		known[dev.ID] = struct{}{}
+	}
+	return known, nil
+}
+
+// fixReconcileReport resolves the differences of the report as selected by
+// opts: it removes the orphaned devices from the IoT Hub, provisions the
+// missing devices to the integration, using the known device types to match
+// the provisioning rules, and records the unrecorded devices.
+func (a *app) fixReconcileReport(
+	ctx context.Context,
+	integration model.Integration,
+	report *model.ReconcileReport,
+	opts model.ReconcileOptions,
+	deviceTypes map[string]string,
+) {
+	report.Fixed = true
+	addError := func(deviceID string, err error) {
+		report.Errors = append(report.Errors,
+			fmt.Sprintf("device %s: %s", deviceID, err.Error()))
+	}
+	if opts.DeleteOrphans {
+		for _, deviceID := range report.Orphans {
+			err := a.deleteIntegrationDevice(ctx, integration, deviceID)
+			if err == nil {
+				err = a.store.DeleteDevice(ctx, deviceID)
+				err = errors.Wrap(err, "failed to delete device record")
+			}
+			if err != nil {
+				addError(deviceID, err)
+			}
+		}
+	}
+	if !opts.Fix {
+		return
+	}
+	for _, deviceID := range report.Missing {
+		_, _, err := a.provisionIntegrationDevice(ctx,
+			integration, deviceID, deviceTypes[deviceID],
+		)
+		if err != nil {
+			state := model.DeviceStateProvisionFailed
+			lastError := (&IntegrationError{
+				IntegrationID: integration.ID,
+				Err:           err,
+			}).Error()
+			errStore := a.store.UpsertDevice(ctx, deviceID, model.DeviceUpdate{
+				State:     &state,
+				LastError: &lastError,
+			})
+			if errStore != nil {
+				log.FromContext(ctx).
+					Errorf("failed to record provisioning failure: %s", errStore)
+			}
+			addError(deviceID, err)
+		}
+	}
+	for _, deviceID := range report.Unrecorded {
+		var (
+			hubID    = deviceID
+			hostName = integration.ConnectionString.HostName
+			state    = model.DeviceStateProvisioned
+		)
+		err := a.store.UpsertDevice(ctx, deviceID, model.DeviceUpdate{
+			HubDeviceID: &hubID,
+			HubHostName: &hostName,
+			State:       &state,
+		})
+		if err != nil {
+			addError(deviceID, errors.Wrap(err, "failed to record device"))
+		}
+	}
+}
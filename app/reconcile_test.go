@@ -0,0 +1,531 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"testing"
+
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/mendersoftware/go-lib-micro/identity"
+
+	"github.com/mendersoftware/iot-manager/client/devauth"
+	mdevauth "github.com/mendersoftware/iot-manager/client/devauth/mocks"
+	"github.com/mendersoftware/iot-manager/client/iothub"
+	miothub "github.com/mendersoftware/iot-manager/client/iothub/mocks"
+	mworkflows "github.com/mendersoftware/iot-manager/client/workflows/mocks"
+	"github.com/mendersoftware/iot-manager/model"
+	"github.com/mendersoftware/iot-manager/store"
+	storeMocks "github.com/mendersoftware/iot-manager/store/mocks"
+)
+
+func validateTenantIDCtx(tenantID string) interface{} {
+	return mock.MatchedBy(func(ctx context.Context) bool {
+		if id := identity.FromContext(ctx); id != nil {
+			return id.Tenant == tenantID
+		}
+		return false
+	})
+}
+
+// sliceCursor implements iothub.Cursor on top of a slice of twins.
+type sliceCursor struct {
+	twins []iothub.DeviceTwin
+	idx   int
+	err   error
+}
+
+func (cur *sliceCursor) Next(ctx context.Context) bool {
+	if cur.idx >= len(cur.twins) {
+		if cur.err == nil {
+			cur.err = io.EOF
+		}
+		return false
+	}
+	cur.idx++
+	return true
+}
+
+func (cur *sliceCursor) Decode(v interface{}) error {
+	if cur.err != nil {
+		return cur.err
+	}
+	b, _ := json.Marshal(cur.twins[cur.idx-1])
+	return json.Unmarshal(b, v)
+}
+
+func TestReconcileDevices(t *testing.T) {
+	t.Parallel()
+	cs := &model.ConnectionString{
+		HostName: "localhost",
+		Key:      []byte("super secret"),
+		Name:     "my favorite string",
+	}
+	integrationID := uuid.New()
+	type testCase struct {
+		Name string
+
+		CTX  context.Context
+		Opts model.ReconcileOptions
+
+		Store   func(t *testing.T, self *testCase) *storeMocks.DataStore
+		Hub     func(t *testing.T, self *testCase) *miothub.Client
+		Wf      func(t *testing.T, self *testCase) *mworkflows.Client
+		Devauth func(t *testing.T, self *testCase) *mdevauth.Client
+
+		Reports []model.ReconcileReport
+		Error   error
+	}
+	testCases := []testCase{{
+		Name: "ok",
+
+		CTX: identity.WithContext(context.Background(), &identity.Identity{
+			Tenant: "123456789012345678901234",
+		}),
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			store := new(storeMocks.DataStore)
+			store.On("GetSettings", contextMatcher).
+				Return(model.Settings{Integrations: []model.Integration{{
+					ID:               integrationID,
+					Name:             "hub",
+					ConnectionString: cs,
+				}}}, nil).
+				On("GetDevices", contextMatcher, model.DeviceFilter{}).
+				Return([]model.Device{{
+					ID:          "device-1",
+					HubDeviceID: "device-1",
+					State:       model.DeviceStateProvisioned,
+				}, {
+					ID:    "device-2",
+					State: model.DeviceStateProvisioned,
+				}, {
+					ID:          "device-3",
+					HubDeviceID: "device-3",
+					State:       model.DeviceStateDecommissionFailed,
+				}, {
+					ID:        "device-6",
+					State:     model.DeviceStateProvisioned,
+					UpdatedTS: time.Now(),
+				}, {
+					ID:        "device-7",
+					State:     model.DeviceStateDecommissionFailed,
+					UpdatedTS: time.Now(),
+				}}, nil)
+			return store
+		},
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			hub := new(miothub.Client)
+			hub.On("GetDeviceTwins", contextMatcher, cs, menderDevicesQuery()).
+				Return(&sliceCursor{twins: []iothub.DeviceTwin{
+					{DeviceID: "device-1"},
+					{DeviceID: "device-3"},
+					{DeviceID: "device-4"},
+					{DeviceID: "device-5"},
+					{DeviceID: "device-7"},
+				}}, nil)
+			return hub
+		},
+		Wf: func(t *testing.T, self *testCase) *mworkflows.Client {
+			return new(mworkflows.Client)
+		},
+		Devauth: func(t *testing.T, self *testCase) *mdevauth.Client {
+			da := new(mdevauth.Client)
+			da.On("GetDevices", contextMatcher, []string{"device-4", "device-5"}).
+				Return([]devauth.Device{{ID: "device-5"}}, nil)
+			return da
+		},
+
+		Reports: []model.ReconcileReport{{
+			TenantID:      "123456789012345678901234",
+			IntegrationID: integrationID.String(),
+			Orphans:       []string{"device-3", "device-4"},
+			Missing:       []string{"device-2"},
+			Unrecorded:    []string{"device-5"},
+		}},
+	}, {
+		Name: "ok, fix differences",
+
+		CTX: identity.WithContext(context.Background(), &identity.Identity{
+			Tenant: "123456789012345678901234",
+		}),
+		Opts: model.ReconcileOptions{Fix: true, DeleteOrphans: true},
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			store := new(storeMocks.DataStore)
+			store.On("GetSettings", contextMatcher).
+				Return(model.Settings{Integrations: []model.Integration{{
+					ID:               integrationID,
+					Name:             "hub",
+					ConnectionString: cs,
+				}}}, nil).
+				On("GetDevices", contextMatcher, model.DeviceFilter{}).
+				Return([]model.Device{{
+					ID:    "device-1",
+					State: model.DeviceStateProvisioned,
+				}}, nil).
+				On("DeleteDevice", contextMatcher, "device-2").
+				Return(nil).
+				On("UpsertDevice", contextMatcher, "device-1",
+					mock.AnythingOfType("model.DeviceUpdate")).
+				Return(nil)
+			return store
+		},
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			hub := new(miothub.Client)
+			hub.On("GetDeviceTwins", contextMatcher, cs, menderDevicesQuery()).
+				Return(&sliceCursor{twins: []iothub.DeviceTwin{
+					{DeviceID: "device-2"},
+				}}, nil).
+				On("DeleteDevice", contextMatcher, cs, "device-2").
+				Return(nil).
+				On("UpsertDevice", contextMatcher, cs, "device-1").
+				Return(nil, errors.New("internal error"))
+			return hub
+		},
+		Wf: func(t *testing.T, self *testCase) *mworkflows.Client {
+			return new(mworkflows.Client)
+		},
+		Devauth: func(t *testing.T, self *testCase) *mdevauth.Client {
+			da := new(mdevauth.Client)
+			da.On("GetDevices", contextMatcher, []string{"device-2"}).
+				Return([]devauth.Device{}, nil)
+			return da
+		},
+
+		Reports: []model.ReconcileReport{{
+			TenantID:      "123456789012345678901234",
+			IntegrationID: integrationID.String(),
+			Orphans:       []string{"device-2"},
+			Missing:       []string{"device-1"},
+			Unrecorded:    []string{},
+			Fixed:         true,
+			Errors: []string{
+				"device device-1: failed to update iothub devices: internal error",
+			},
+		}},
+	}, {
+		Name: "ok, fix keeps orphans",
+
+		CTX: identity.WithContext(context.Background(), &identity.Identity{
+			Tenant: "123456789012345678901234",
+		}),
+		Opts: model.ReconcileOptions{Fix: true},
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			store := new(storeMocks.DataStore)
+			hubID := "device-3"
+			state := model.DeviceStateProvisioned
+			store.On("GetSettings", contextMatcher).
+				Return(model.Settings{Integrations: []model.Integration{{
+					ID:               integrationID,
+					Name:             "hub",
+					ConnectionString: cs,
+				}}}, nil).
+				On("GetDevices", contextMatcher, model.DeviceFilter{}).
+				Return([]model.Device{}, nil).
+				On("UpsertDevice", contextMatcher, "device-3", model.DeviceUpdate{
+					HubDeviceID: &hubID,
+					HubHostName: &cs.HostName,
+					State:       &state,
+				}).
+				Return(nil)
+			return store
+		},
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			hub := new(miothub.Client)
+			hub.On("GetDeviceTwins", contextMatcher, cs, menderDevicesQuery()).
+				Return(&sliceCursor{twins: []iothub.DeviceTwin{
+					{DeviceID: "device-2"},
+					{DeviceID: "device-3"},
+				}}, nil)
+			return hub
+		},
+		Wf: func(t *testing.T, self *testCase) *mworkflows.Client {
+			return new(mworkflows.Client)
+		},
+		Devauth: func(t *testing.T, self *testCase) *mdevauth.Client {
+			da := new(mdevauth.Client)
+			da.On("GetDevices", contextMatcher, []string{"device-2", "device-3"}).
+				Return([]devauth.Device{{ID: "device-3"}}, nil)
+			return da
+		},
+
+		Reports: []model.ReconcileReport{{
+			TenantID:      "123456789012345678901234",
+			IntegrationID: integrationID.String(),
+			Orphans:       []string{"device-2"},
+			Missing:       []string{},
+			Unrecorded:    []string{"device-3"},
+			Fixed:         true,
+		}},
+	}, {
+		Name: "error, deviceauth fails",
+
+		CTX: identity.WithContext(context.Background(), &identity.Identity{
+			Tenant: "123456789012345678901234",
+		}),
+		Opts: model.ReconcileOptions{Fix: true, DeleteOrphans: true},
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			store := new(storeMocks.DataStore)
+			store.On("GetSettings", contextMatcher).
+				Return(model.Settings{Integrations: []model.Integration{{
+					ID:               integrationID,
+					Name:             "hub",
+					ConnectionString: cs,
+				}}}, nil).
+				On("GetDevices", contextMatcher, model.DeviceFilter{}).
+				Return([]model.Device{}, nil)
+			return store
+		},
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			hub := new(miothub.Client)
+			hub.On("GetDeviceTwins", contextMatcher, cs, menderDevicesQuery()).
+				Return(&sliceCursor{twins: []iothub.DeviceTwin{
+					{DeviceID: "device-2"},
+				}}, nil)
+			return hub
+		},
+		Wf: func(t *testing.T, self *testCase) *mworkflows.Client {
+			return new(mworkflows.Client)
+		},
+		Devauth: func(t *testing.T, self *testCase) *mdevauth.Client {
+			da := new(mdevauth.Client)
+			da.On("GetDevices", contextMatcher, []string{"device-2"}).
+				Return(nil, errors.New("connection refused"))
+			return da
+		},
+
+		Reports: []model.ReconcileReport{{
+			TenantID:      "123456789012345678901234",
+			IntegrationID: integrationID.String(),
+			Orphans:       []string{},
+			Missing:       []string{},
+			Unrecorded:    []string{},
+			Error: "failed to retrieve devices from deviceauth: " +
+				"connection refused",
+		}},
+	}, {
+		Name: "ok, all tenants",
+
+		CTX: context.Background(),
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			store := new(storeMocks.DataStore)
+			store.On("GetTenantIDs", contextMatcher).
+				Return([]string{"tenant1", "tenant2"}, nil).
+				On("GetSettings", validateTenantIDCtx("tenant1")).
+				Return(model.Settings{}, nil).
+				On("GetSettings", validateTenantIDCtx("tenant2")).
+				Return(model.Settings{}, errors.New("internal error"))
+			return store
+		},
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			return new(miothub.Client)
+		},
+		Wf: func(t *testing.T, self *testCase) *mworkflows.Client {
+			return new(mworkflows.Client)
+		},
+
+		Reports: []model.ReconcileReport{{
+			TenantID:   "tenant2",
+			Orphans:    []string{},
+			Missing:    []string{},
+			Unrecorded: []string{},
+			Error:      "failed to retrieve settings: internal error",
+		}},
+	}, {
+		Name: "error, hub cursor fails",
+
+		CTX: identity.WithContext(context.Background(), &identity.Identity{
+			Tenant: "123456789012345678901234",
+		}),
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			store := new(storeMocks.DataStore)
+			store.On("GetSettings", contextMatcher).
+				Return(model.Settings{Integrations: []model.Integration{{
+					ID:               integrationID,
+					Name:             "hub",
+					ConnectionString: cs,
+				}}}, nil).
+				On("GetDevices", contextMatcher, model.DeviceFilter{}).
+				Return([]model.Device{}, nil)
+			return store
+		},
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			hub := new(miothub.Client)
+			hub.On("GetDeviceTwins", contextMatcher, cs, menderDevicesQuery()).
+				Return(&sliceCursor{err: errors.New("connection reset")}, nil)
+			return hub
+		},
+		Wf: func(t *testing.T, self *testCase) *mworkflows.Client {
+			return new(mworkflows.Client)
+		},
+
+		Reports: []model.ReconcileReport{{
+			TenantID:      "123456789012345678901234",
+			IntegrationID: integrationID.String(),
+			Orphans:       []string{},
+			Missing:       []string{},
+			Unrecorded:    []string{},
+			Error: "failed to retrieve devices from IoT Hub: " +
+				"connection reset",
+		}},
+	}, {
+		Name: "error, listing tenants",
+
+		CTX: context.Background(),
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			store := new(storeMocks.DataStore)
+			store.On("GetTenantIDs", contextMatcher).
+				Return(nil, errors.New("internal error"))
+			return store
+		},
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			return new(miothub.Client)
+		},
+		Wf: func(t *testing.T, self *testCase) *mworkflows.Client {
+			return new(mworkflows.Client)
+		},
+
+		Error: errors.New("failed to retrieve tenants: internal error"),
+	}}
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			ds := tc.Store(t, &tc)
+			hub := tc.Hub(t, &tc)
+			wf := tc.Wf(t, &tc)
+			da := new(mdevauth.Client)
+			if tc.Devauth != nil {
+				da = tc.Devauth(t, &tc)
+			}
+			defer ds.AssertExpectations(t)
+			defer hub.AssertExpectations(t)
+			defer wf.AssertExpectations(t)
+			defer da.AssertExpectations(t)
+
+			app := New(ds, hub, wf, NewOptions().SetDeviceAuth(da))
+			reports, err := app.ReconcileDevices(tc.CTX, tc.Opts)
+			if tc.Error != nil {
+				if assert.Error(t, err) {
+					assert.Regexp(t, tc.Error.Error(), err.Error())
+				}
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tc.Reports, reports)
+			}
+		})
+	}
+}
+
+func TestScheduleReconciliation(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	opts := model.ReconcileOptions{Fix: true}
+
+	var jobs []model.Job
+	ds := new(storeMocks.DataStore)
+	defer ds.AssertExpectations(t)
+	ds.On("CreateJob", contextMatcher, mock.AnythingOfType("model.Job")).
+		Run(func(args mock.Arguments) {
+			jobs = append(jobs, args.Get(1).(model.Job))
+		}).
+		Return(nil).Once().
+		On("CreateJob", contextMatcher, mock.AnythingOfType("model.Job")).
+		Run(func(args mock.Arguments) {
+			jobs = append(jobs, args.Get(1).(model.Job))
+		}).
+		Return(store.ErrObjectExists).Once().
+		On("CreateJob", contextMatcher, mock.AnythingOfType("model.Job")).
+		Return(errors.New("internal error")).Once()
+
+	app := New(ds, nil, nil)
+	job, err := app.ScheduleReconciliation(ctx, time.Hour, opts)
+	if assert.NoError(t, err) {
+		assert.Equal(t, model.JobTypeReconcile, job.Type)
+		assert.Equal(t, "", job.TenantID)
+		assert.Equal(t, map[string]string{
+			jobParamFix:           "true",
+			jobParamDeleteOrphans: "false",
+		}, job.Params)
+	}
+	// Replicas scheduling the same interval create the same job.
+	_, err = app.ScheduleReconciliation(ctx, time.Hour, opts)
+	assert.Equal(t, ErrJobExists, err)
+	if assert.Len(t, jobs, 2) {
+		assert.Equal(t, jobs[0].ID, jobs[1].ID)
+	}
+
+	_, err = app.ScheduleReconciliation(ctx, time.Hour, opts)
+	assert.EqualError(t, err, "failed to create job: internal error")
+}
+
+func TestReconcileJob(t *testing.T) {
+	t.Parallel()
+	cs := &model.ConnectionString{
+		HostName: "localhost",
+		Key:      []byte("super secret"),
+		Name:     "my favorite string",
+	}
+	jobID := uuid.New()
+	job := &model.Job{
+		ID:   jobID,
+		Type: model.JobTypeReconcile,
+		Params: map[string]string{
+			jobParamFix:           "false",
+			jobParamDeleteOrphans: "false",
+		},
+	}
+
+	ds := new(storeMocks.DataStore)
+	defer ds.AssertExpectations(t)
+	ds.On("GetTenantIDs", contextMatcher).
+		Return([]string{"tenant-1", "tenant-2"}, nil).
+		On("GetSettings", validateTenantIDCtx("tenant-1")).
+		Return(model.Settings{Integrations: []model.Integration{{
+			ID:               uuid.New(),
+			ConnectionString: cs,
+		}}}, nil).
+		On("GetDevices", validateTenantIDCtx("tenant-1"), model.DeviceFilter{}).
+		Return([]model.Device{}, nil).
+		On("GetSettings", validateTenantIDCtx("tenant-2")).
+		Return(model.Settings{}, errors.New("internal error"))
+	hub := new(miothub.Client)
+	defer hub.AssertExpectations(t)
+	hub.On("GetDeviceTwins", validateTenantIDCtx("tenant-1"), cs, menderDevicesQuery()).
+		Return(&sliceCursor{}, nil)
+
+	app := New(ds, hub, nil).(*app)
+	tracker := &jobTracker{
+		store:  ds,
+		jobID:  jobID,
+		owner:  "worker",
+		stored: time.Now(),
+	}
+	err := app.reconcileJob(context.Background(), job, tracker)
+	assert.EqualError(t, err, "failed to reconcile the devices of 1 tenants")
+	assert.Equal(t, model.JobProgress{Total: 2, Succeeded: 1, Failed: 1},
+		tracker.progress)
+	assert.Equal(t, []model.JobItemError{{
+		Item:  "tenant-2",
+		Error: "failed to retrieve settings: internal error",
+	}}, tracker.itemErrors)
+}
@@ -0,0 +1,99 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package app
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+
+	"github.com/mendersoftware/iot-manager/model"
+	"github.com/mendersoftware/iot-manager/store"
+)
+
+var (
+	ErrSettingsModified = errors.New(
+		"settings have been modified since they were retrieved",
+	)
+	ErrSettingsRevisionNotFound = errors.New("settings revision not found")
+)
+
+// storeSettings stores the settings as the revision after
+// settings.Revision.
+func (a *app) storeSettings(ctx context.Context, settings model.Settings) error {
+	err := a.store.SetSettings(ctx, settings)
+	if errors.Cause(err) == store.ErrRevisionConflict {
+		return ErrSettingsModified
+	}
+	return err
+}
+
+// SetDefaultConnectionString replaces the connection string of the default
+// integration as the settings request body did before integrations existed,
+// the other integrations are kept. If revision is set, the connection string
+// is only replaced if the stored settings are still at that revision.
+func (a *app) SetDefaultConnectionString(
+	ctx context.Context,
+	cs *model.ConnectionString,
+	revision int,
+) error {
+	settings, err := a.GetSettings(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to retrieve settings")
+	}
+	if revision != 0 && revision != settings.Revision {
+		return ErrSettingsModified
+	}
+	settings.SetDefaultConnectionString(cs)
+	return a.SetSettings(ctx, settings)
+}
+
+// GetSettingsHistory returns the revisions of the settings, the most recent
+// first.
+func (a *app) GetSettingsHistory(
+	ctx context.Context,
+	skip, limit int64,
+) ([]model.SettingsRevision, error) {
+	history, err := a.store.GetSettingsHistory(ctx, skip, limit)
+	return history, errors.Wrap(err, "failed to retrieve settings history")
+}
+
+// RestoreSettings replaces the settings with a copy of a previous revision.
+// The connection strings the current settings do not use are verified
+// again, as they may have been revoked since. If ifMatch is set, the
+// settings are only replaced if they are still at that revision.
+func (a *app) RestoreSettings(ctx context.Context, revision, ifMatch int) error {
+	rev, err := a.store.GetSettingsRevision(ctx, revision)
+	if err == store.ErrObjectNotFound {
+		return ErrSettingsRevisionNotFound
+	} else if err != nil {
+		return errors.Wrap(err, "failed to retrieve settings revision")
+	}
+	current, err := a.GetSettings(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to retrieve settings")
+	}
+	if ifMatch != 0 && ifMatch != current.Revision {
+		return ErrSettingsModified
+	}
+	settings := rev.Settings
+	settings.Revision = current.Revision
+	err = a.verifyIntegrations(ctx, current, settings.Integrations...)
+	if err != nil {
+		return err
+	}
+	err = a.storeSettings(ctx, settings)
+	return errors.Wrap(err, "failed to restore settings")
+}
@@ -0,0 +1,410 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package app
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/mendersoftware/iot-manager/client"
+	"github.com/mendersoftware/iot-manager/client/iothub"
+	miothub "github.com/mendersoftware/iot-manager/client/iothub/mocks"
+	"github.com/mendersoftware/iot-manager/model"
+	"github.com/mendersoftware/iot-manager/store"
+	storeMocks "github.com/mendersoftware/iot-manager/store/mocks"
+)
+
+func TestGetSettingsHistory(t *testing.T) {
+	t.Parallel()
+	history := []model.SettingsRevision{{
+		Settings: model.Settings{
+			Integrations: []model.Integration{{Name: "hub"}},
+			Revision:     2,
+		},
+		CreatedTS: time.Now(),
+		CreatedBy: "user",
+	}}
+
+	ds := new(storeMocks.DataStore)
+	defer ds.AssertExpectations(t)
+	ds.On("GetSettingsHistory", contextMatcher, int64(10), int64(5)).
+		Return(history, nil).
+		Once().
+		On("GetSettingsHistory", contextMatcher, int64(0), int64(5)).
+		Return(nil, errors.New("internal error")).
+		Once()
+
+	app := New(ds, nil, nil)
+	actual, err := app.GetSettingsHistory(context.Background(), 10, 5)
+	assert.NoError(t, err)
+	assert.Equal(t, history, actual)
+
+	_, err = app.GetSettingsHistory(context.Background(), 0, 5)
+	assert.EqualError(t, err, "failed to retrieve settings history: internal error")
+}
+
+func TestSetDefaultConnectionString(t *testing.T) {
+	t.Parallel()
+	cs := &model.ConnectionString{
+		HostName: "localhost",
+		Key:      []byte("super secret"),
+		Name:     "my favorite string",
+	}
+	hub := model.Integration{
+		ID:               uuid.New(),
+		Name:             "hub",
+		ConnectionString: cs,
+	}
+	defaultIntegration := model.Integration{
+		ID:               uuid.New(),
+		Name:             model.IntegrationNameDefault,
+		ConnectionString: &model.ConnectionString{HostName: "old", Key: []byte("key")},
+	}
+	integrationsMatcher := func(fn func(integrations []model.Integration) bool) interface{} {
+		return mock.MatchedBy(func(settings model.Settings) bool {
+			return settings.Revision == 3 && fn(settings.Integrations)
+		})
+	}
+	type testCase struct {
+		Name string
+
+		CS       *model.ConnectionString
+		Revision int
+
+		Store func(t *testing.T, self *testCase) *storeMocks.DataStore
+
+		Error error
+	}
+	testCases := []testCase{{
+		Name: "ok, replace connection string",
+
+		CS: cs,
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			ds := new(storeMocks.DataStore)
+			ds.On("GetSettings", contextMatcher).
+				Return(model.Settings{
+					Integrations: []model.Integration{hub, defaultIntegration},
+					Revision:     3,
+				}, nil).
+				On("SetSettings", contextMatcher, integrationsMatcher(
+					func(integrations []model.Integration) bool {
+						return len(integrations) == 2 &&
+							integrations[0].ID == hub.ID &&
+							integrations[1].ID == defaultIntegration.ID &&
+							integrations[1].ConnectionString == cs
+					})).
+				Return(nil)
+			return ds
+		},
+	}, {
+		Name: "ok, create default integration",
+
+		CS:       cs,
+		Revision: 3,
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			ds := new(storeMocks.DataStore)
+			ds.On("GetSettings", contextMatcher).
+				Return(model.Settings{
+					Integrations: []model.Integration{hub},
+					Revision:     3,
+				}, nil).
+				On("SetSettings", contextMatcher, integrationsMatcher(
+					func(integrations []model.Integration) bool {
+						return len(integrations) == 2 &&
+							integrations[0].ID == hub.ID &&
+							integrations[1].Name == model.IntegrationNameDefault &&
+							integrations[1].Provider == model.ProviderIoTHub &&
+							integrations[1].ConnectionString == cs
+					})).
+				Return(nil)
+			return ds
+		},
+	}, {
+		Name: "ok, remove default integration",
+
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			ds := new(storeMocks.DataStore)
+			ds.On("GetSettings", contextMatcher).
+				Return(model.Settings{
+					Integrations: []model.Integration{defaultIntegration, hub},
+					Revision:     3,
+				}, nil).
+				On("SetSettings", contextMatcher, integrationsMatcher(
+					func(integrations []model.Integration) bool {
+						return len(integrations) == 1 &&
+							integrations[0].ID == hub.ID
+					})).
+				Return(nil)
+			return ds
+		},
+	}, {
+		Name: "error/revision mismatch",
+
+		CS:       cs,
+		Revision: 2,
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			ds := new(storeMocks.DataStore)
+			ds.On("GetSettings", contextMatcher).
+				Return(model.Settings{Revision: 3}, nil)
+			return ds
+		},
+		Error: ErrSettingsModified,
+	}, {
+		Name: "error/retrieving settings",
+
+		CS: cs,
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			ds := new(storeMocks.DataStore)
+			ds.On("GetSettings", contextMatcher).
+				Return(model.Settings{}, errors.New("internal error"))
+			return ds
+		},
+		Error: errors.New("failed to retrieve settings: internal error"),
+	}}
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			ds := tc.Store(t, &tc)
+			defer ds.AssertExpectations(t)
+
+			app := New(ds, nil, nil,
+				NewOptions().SetConnectionStringVerification(false),
+			)
+			err := app.SetDefaultConnectionString(context.Background(),
+				tc.CS, tc.Revision,
+			)
+			if tc.Error != nil {
+				assert.EqualError(t, err, tc.Error.Error())
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestRestoreSettings(t *testing.T) {
+	t.Parallel()
+	revision := &model.SettingsRevision{
+		Settings: model.Settings{
+			Integrations: []model.Integration{{Name: "previous"}},
+			Revision:     2,
+		},
+		CreatedTS: time.Now(),
+	}
+	cs := &model.ConnectionString{
+		HostName: "localhost",
+		Key:      []byte("secret"),
+		Name:     "foobar",
+	}
+	revisionCS := &model.SettingsRevision{
+		Settings: model.Settings{
+			Integrations: []model.Integration{{
+				Name:             "previous",
+				ConnectionString: cs,
+			}},
+			Revision: 3,
+		},
+	}
+	probeID := mock.MatchedBy(func(id string) bool {
+		return strings.HasPrefix(id, probeDeviceIDPrefix)
+	})
+	type testCase struct {
+		Name string
+
+		Revision int
+		IfMatch  int
+
+		Store func(t *testing.T, self *testCase) *storeMocks.DataStore
+		Hub   func(t *testing.T, self *testCase) *miothub.Client
+
+		Error error
+	}
+	testCases := []testCase{{
+		Name: "ok",
+
+		Revision: 2,
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			ds := new(storeMocks.DataStore)
+			ds.On("GetSettingsRevision", contextMatcher, self.Revision).
+				Return(revision, nil).
+				On("GetSettings", contextMatcher).
+				Return(model.Settings{Revision: 5}, nil).
+				On("SetSettings", contextMatcher, model.Settings{
+					Integrations: revision.Integrations,
+					Revision:     5,
+				}).
+				Return(nil)
+			return ds
+		},
+	}, {
+		Name: "error/revision not found",
+
+		Revision: 7,
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			ds := new(storeMocks.DataStore)
+			ds.On("GetSettingsRevision", contextMatcher, self.Revision).
+				Return(nil, store.ErrObjectNotFound)
+			return ds
+		},
+		Error: ErrSettingsRevisionNotFound,
+	}, {
+		Name: "ok/if-match",
+
+		Revision: 2,
+		IfMatch:  5,
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			ds := new(storeMocks.DataStore)
+			ds.On("GetSettingsRevision", contextMatcher, self.Revision).
+				Return(revision, nil).
+				On("GetSettings", contextMatcher).
+				Return(model.Settings{Revision: 5}, nil).
+				On("SetSettings", contextMatcher, model.Settings{
+					Integrations: revision.Integrations,
+					Revision:     5,
+				}).
+				Return(nil)
+			return ds
+		},
+	}, {
+		Name: "ok/connection string verified",
+
+		Revision: 3,
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			ds := new(storeMocks.DataStore)
+			ds.On("GetSettingsRevision", contextMatcher, self.Revision).
+				Return(revisionCS, nil).
+				On("GetSettings", contextMatcher).
+				Return(model.Settings{Revision: 5}, nil).
+				On("SetSettings", contextMatcher, model.Settings{
+					Integrations: revisionCS.Integrations,
+					Revision:     5,
+				}).
+				Return(nil)
+			return ds
+		},
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			notFound := client.HTTPError{Code: http.StatusNotFound}
+			hub := new(miothub.Client)
+			hub.On("GetDevice", contextMatcher, cs, probeID).
+				Return(nil, notFound).
+				On("DeleteDevice", contextMatcher, cs, probeID).
+				Return(notFound).
+				On("InvokeDeviceMethod", contextMatcher, cs, probeID,
+					&iothub.DirectMethod{Name: probeMethodName}).
+				Return(nil, notFound)
+			return hub
+		},
+	}, {
+		Name: "error/connection string revoked",
+
+		Revision: 3,
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			ds := new(storeMocks.DataStore)
+			ds.On("GetSettingsRevision", contextMatcher, self.Revision).
+				Return(revisionCS, nil).
+				On("GetSettings", contextMatcher).
+				Return(model.Settings{Revision: 5}, nil)
+			return ds
+		},
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			unauthorized := client.HTTPError{Code: http.StatusUnauthorized}
+			hub := new(miothub.Client)
+			hub.On("GetDevice", contextMatcher, cs, probeID).
+				Return(nil, unauthorized).
+				On("DeleteDevice", contextMatcher, cs, probeID).
+				Return(unauthorized).
+				On("InvokeDeviceMethod", contextMatcher, cs, probeID,
+					&iothub.DirectMethod{Name: probeMethodName}).
+				Return(nil, unauthorized)
+			return hub
+		},
+		Error: errors.New(`integration "previous": connection string is ` +
+			`missing permissions: RegistryRead, RegistryWrite, ServiceConnect`),
+	}, {
+		Name: "error/if-match",
+
+		Revision: 2,
+		IfMatch:  4,
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			ds := new(storeMocks.DataStore)
+			ds.On("GetSettingsRevision", contextMatcher, self.Revision).
+				Return(revision, nil).
+				On("GetSettings", contextMatcher).
+				Return(model.Settings{Revision: 5}, nil)
+			return ds
+		},
+		Error: ErrSettingsModified,
+	}, {
+		Name: "error/retrieving revision",
+
+		Revision: 2,
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			ds := new(storeMocks.DataStore)
+			ds.On("GetSettingsRevision", contextMatcher, self.Revision).
+				Return(nil, errors.New("internal error"))
+			return ds
+		},
+		Error: errors.New("failed to retrieve settings revision: internal error"),
+	}, {
+		Name: "error/modified concurrently",
+
+		Revision: 2,
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			ds := new(storeMocks.DataStore)
+			ds.On("GetSettingsRevision", contextMatcher, self.Revision).
+				Return(revision, nil).
+				On("GetSettings", contextMatcher).
+				Return(model.Settings{Revision: 5}, nil).
+				On("SetSettings", contextMatcher, mock.AnythingOfType("model.Settings")).
+				Return(store.ErrRevisionConflict)
+			return ds
+		},
+		Error: ErrSettingsModified,
+	}}
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			ds := tc.Store(t, &tc)
+			defer ds.AssertExpectations(t)
+			hub := new(miothub.Client)
+			if tc.Hub != nil {
+				hub = tc.Hub(t, &tc)
+			}
+			defer hub.AssertExpectations(t)
+
+			app := New(ds, hub, nil)
+			err := app.RestoreSettings(context.Background(),
+				tc.Revision, tc.IfMatch,
+			)
+			if tc.Error != nil {
+				if assert.Error(t, err) {
+					assert.Regexp(t, tc.Error.Error(), err.Error())
+				}
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,223 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package app
+
+import (
+	"context"
+	"io"
+	"net/http"
+
+	"github.com/pkg/errors"
+
+	"github.com/mendersoftware/go-lib-micro/log"
+
+	"github.com/mendersoftware/iot-manager/client"
+	"github.com/mendersoftware/iot-manager/client/iothub"
+	"github.com/mendersoftware/iot-manager/model"
+)
+
+const (
+	// jobParamDevices is the TenantDevicesAction of a delete_tenant job.
+	jobParamDevices = "devices"
+)
+
+// DeleteTenant starts a background job removing the data of the tenant.
+// Depending on action, the devices tagged by Mender in the IoT Hubs and the
+// devices of the device records in AWS IoT Core are deleted or disabled
+// first, deleting also removes the DPS enrollments of the device records;
+// if any of them fails, the tenant data is kept so that the deletion can be
+// retried.
+func (a *app) DeleteTenant(
+	ctx context.Context,
+	action model.TenantDevicesAction,
+) (*model.Job, error) {
+	return a.startJob(ctx, model.JobTypeDeleteTenant, map[string]string{
+		jobParamDevices: string(action),
+	})
+}
+
+func (a *app) deleteTenantJob(
+	ctx context.Context,
+	job *model.Job,
+	tracker *jobTracker,
+) error {
+	action := model.TenantDevicesAction(job.Params[jobParamDevices])
+	if action != model.TenantDevicesKeep && action != "" {
+		settings, err := a.GetSettings(ctx)
+		if err != nil {
+			return errors.Wrap(err, "failed to retrieve settings")
+		}
+		// IoT Core things and DPS enrollments are not tagged, the device
+		// records list the devices that may have been provisioned.
+		var devices []model.Device
+		for _, integration := range settings.Integrations {
+			if devices == nil && usesDeviceRecords(integration) {
+				devices, err = a.store.GetDevices(ctx, model.DeviceFilter{})
+				if err != nil {
+					return errors.Wrap(err, "failed to retrieve devices")
+				}
+			}
+			switch {
+			case integration.Provider == model.ProviderIoTCore:
+				if integration.AWS == nil {
+					continue
+				}
+				err = a.cleanupIoTCoreDevices(ctx,
+					integration, action, devices, tracker,
+				)
+			case integration.ConnectionString == nil:
+				continue
+			default:
+				var done map[string]struct{}
+				done, err = a.cleanupIntegrationDevices(ctx,
+					integration, action, tracker,
+				)
+				if err == nil && action == model.TenantDevicesDelete &&
+					integration.ProvisioningMode == model.ProvisioningModeDPS {
+					err = a.cleanupDPSEnrollments(ctx,
+						integration, devices, done, tracker,
+					)
+				}
+			}
+			if err != nil {
+				return errors.Wrapf(err, "integration %q", integration.Name)
+			}
+		}
+		if failed := tracker.progress.Failed; failed > 0 {
+			return errors.Errorf("failed to %s %d devices", action, failed)
+		}
+	}
+	err := a.store.DeleteTenant(ctx, job.ID)
+	return errors.Wrap(err, "failed to delete tenant data")
+}
+
+// cleanupIntegrationDevices deletes or disables the devices tagged by
+// Mender in the IoT Hub of the integration and returns the set of the
+// processed device IDs.
+func (a *app) cleanupIntegrationDevices(
+	ctx context.Context,
+	integration model.Integration,
+	action model.TenantDevicesAction,
+	tracker *jobTracker,
+) (map[string]struct{}, error) {
+	l := log.FromContext(ctx)
+	cur, err := a.hub.GetDeviceTwins(ctx,
+		integration.ConnectionString, menderDevicesQuery(),
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to retrieve devices from IoT Hub")
+	}
+	done := make(map[string]struct{})
+	var twin iothub.DeviceTwin
+	for cur.Next(ctx) {
+		twin = iothub.DeviceTwin{}
+		if err = cur.Decode(&twin); err != nil {
+			return nil, errors.Wrap(err, "failed to decode device twin")
+		}
+		if action == model.TenantDevicesDelete {
+			err = a.deleteIoTHubDevice(ctx, integration, twin.DeviceID)
+		} else {
+			err = a.setIoTHubDeviceStatus(ctx, integration, twin.DeviceID, StatusDisabled)
+		}
+		if err != nil {
+			l.Errorf("failed to %s device %s: %s", action, twin.DeviceID, err)
+		}
+		tracker.itemDone(ctx, twin.DeviceID, err)
+		done[twin.DeviceID] = struct{}{}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+	if err = cur.Decode(&twin); err != io.EOF {
+		return nil, errors.Wrap(err, "failed to retrieve devices from IoT Hub")
+	}
+	return done, nil
+}
+
+// usesDeviceRecords returns true if the devices of the integration are
+// cleaned up from the device records.
+func usesDeviceRecords(integration model.Integration) bool {
+	return integration.Provider == model.ProviderIoTCore ||
+		integration.ProvisioningMode == model.ProvisioningModeDPS
+}
+
+// cleanupIoTCoreDevices deletes or disables the devices of the device
+// records in AWS IoT Core.
+func (a *app) cleanupIoTCoreDevices(
+	ctx context.Context,
+	integration model.Integration,
+	action model.TenantDevicesAction,
+	devices []model.Device,
+	tracker *jobTracker,
+) error {
+	l := log.FromContext(ctx)
+	creds, err := a.awsCredentials(integration)
+	if err != nil {
+		return err
+	}
+	for _, dev := range devices {
+		if !integration.Scope.Includes(dev.ID) {
+			continue
+		}
+		if action == model.TenantDevicesDelete {
+			err = a.iotcore.DeleteDevice(ctx, creds, dev.ID)
+			err = errors.Wrap(err, "failed to delete IoT Core device")
+		} else {
+			err = a.setIoTCoreDeviceStatus(ctx, integration, dev.ID, StatusDisabled)
+			// The device was never provisioned to IoT Core.
+			if htErr, ok := errors.Cause(err).(client.HTTPError); ok &&
+				htErr.Code == http.StatusNotFound {
+				err = nil
+			}
+		}
+		if err != nil {
+			l.Errorf("failed to %s device %s: %s", action, dev.ID, err)
+		}
+		tracker.itemDone(ctx, dev.ID, err)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// cleanupDPSEnrollments deletes the DPS enrollments of the device records
+// that were not processed with the IoT Hub devices (done), that is the
+// devices that never registered with the IoT Hub.
+func (a *app) cleanupDPSEnrollments(
+	ctx context.Context,
+	integration model.Integration,
+	devices []model.Device,
+	done map[string]struct{},
+	tracker *jobTracker,
+) error {
+	l := log.FromContext(ctx)
+	for _, dev := range devices {
+		if _, ok := done[dev.ID]; ok || !integration.Scope.Includes(dev.ID) {
+			continue
+		}
+		err := a.deleteDPSEnrollment(ctx, integration, dev.ID)
+		if err == ErrNoDPSSettings {
+			return err
+		} else if err != nil {
+			l.Errorf("failed to delete dps enrollment of device %s: %s", dev.ID, err)
+		}
+		tracker.itemDone(ctx, dev.ID, err)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+	return nil
+}
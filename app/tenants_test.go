@@ -0,0 +1,445 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package app
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/mendersoftware/go-lib-micro/identity"
+
+	"github.com/mendersoftware/iot-manager/client"
+	mdps "github.com/mendersoftware/iot-manager/client/dps/mocks"
+	"github.com/mendersoftware/iot-manager/client/iotcore"
+	miotcore "github.com/mendersoftware/iot-manager/client/iotcore/mocks"
+	"github.com/mendersoftware/iot-manager/client/iothub"
+	miothub "github.com/mendersoftware/iot-manager/client/iothub/mocks"
+	"github.com/mendersoftware/iot-manager/model"
+	storeMocks "github.com/mendersoftware/iot-manager/store/mocks"
+)
+
+func TestDeleteTenant(t *testing.T) {
+	t.Parallel()
+	const tenantID = "123456789012345678901234"
+	cs := &model.ConnectionString{
+		HostName: "localhost",
+		Key:      []byte("super secret"),
+		Name:     "my favorite string",
+	}
+	dpsCS := &model.ConnectionString{
+		HostName: "dps.localhost",
+		Key:      []byte("super secret"),
+		Name:     "provisioning",
+	}
+	creds := &model.AWSCredentials{
+		AccessKeyID:     "AKIAEXAMPLE",
+		SecretAccessKey: "secret",
+		Region:          "eu-west-1",
+	}
+	settings := model.Settings{Integrations: []model.Integration{{
+		ID:               uuid.New(),
+		Name:             "hub",
+		ConnectionString: cs,
+	}, {
+		ID:       uuid.New(),
+		Name:     "core",
+		Provider: model.ProviderIoTCore,
+		AWS:      creds,
+	}}}
+	dpsSettings := model.Settings{Integrations: []model.Integration{{
+		ID:               uuid.New(),
+		Name:             "dps",
+		ConnectionString: cs,
+		ProvisioningMode: model.ProvisioningModeDPS,
+		DPS: &model.DPSSettings{
+			ConnectionString: dpsCS,
+			IDScope:          "0ne00000001",
+		},
+	}}}
+	// device-3 was provisioned but never registered with the IoT Hub.
+	devices := []model.Device{{ID: "device-1"}, {ID: "device-3"}}
+	twins := func() iothub.Cursor {
+		return &sliceCursor{twins: []iothub.DeviceTwin{
+			{DeviceID: "device-1"},
+			{DeviceID: "device-2"},
+		}}
+	}
+	type testCase struct {
+		Name string
+
+		Action model.TenantDevicesAction
+
+		Store func(t *testing.T, self *testCase) *storeMocks.DataStore
+		Hub   func(t *testing.T, self *testCase) *miothub.Client
+		// IoTCore and DPS are optional, the app is created without the
+		// clients if unset.
+		IoTCore func(t *testing.T, self *testCase) *miotcore.Client
+		DPS     func(t *testing.T, self *testCase) *mdps.Client
+
+		Status     model.JobStatus
+		Progress   model.JobProgress
+		ItemErrors []model.JobItemError
+		JobError   string
+		Error      error
+	}
+	testCases := []testCase{{
+		Name: "ok, keep devices",
+
+		Action: model.TenantDevicesKeep,
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			ds := new(storeMocks.DataStore)
+			ds.On("DeleteTenant", contextMatcher, mock.AnythingOfType("uuid.UUID")).Return(nil)
+			return ds
+		},
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			return new(miothub.Client)
+		},
+		Status: model.JobStatusSucceeded,
+	}, {
+		Name: "ok, delete devices",
+
+		Action: model.TenantDevicesDelete,
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			ds := new(storeMocks.DataStore)
+			ds.On("GetSettings", contextMatcher).
+				Return(settings, nil).
+				On("GetDevices", contextMatcher, model.DeviceFilter{}).
+				Return(devices, nil).
+				On("DeleteTenant", contextMatcher, mock.AnythingOfType("uuid.UUID")).
+				Return(nil)
+			return ds
+		},
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			hub := new(miothub.Client)
+			hub.On("GetDeviceTwins", contextMatcher, cs, menderDevicesQuery()).
+				Return(twins(), nil).
+				On("DeleteDevice", contextMatcher, cs, "device-1").
+				Return(nil).
+				On("DeleteDevice", contextMatcher, cs, "device-2").
+				Return(nil)
+			return hub
+		},
+		IoTCore: func(t *testing.T, self *testCase) *miotcore.Client {
+			core := new(miotcore.Client)
+			core.On("DeleteDevice", contextMatcher, creds, "device-1").
+				Return(nil).
+				On("DeleteDevice", contextMatcher, creds, "device-3").
+				Return(nil)
+			return core
+		},
+		Status:   model.JobStatusSucceeded,
+		Progress: model.JobProgress{Total: 4, Succeeded: 4},
+	}, {
+		Name: "ok, delete devices and dps enrollments",
+
+		Action: model.TenantDevicesDelete,
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			ds := new(storeMocks.DataStore)
+			ds.On("GetSettings", contextMatcher).
+				Return(dpsSettings, nil).
+				On("GetDevices", contextMatcher, model.DeviceFilter{}).
+				Return(devices, nil).
+				On("DeleteTenant", contextMatcher, mock.AnythingOfType("uuid.UUID")).
+				Return(nil)
+			return ds
+		},
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			hub := new(miothub.Client)
+			hub.On("GetDeviceTwins", contextMatcher, cs, menderDevicesQuery()).
+				Return(twins(), nil).
+				On("DeleteDevice", contextMatcher, cs, "device-1").
+				Return(nil).
+				On("DeleteDevice", contextMatcher, cs, "device-2").
+				Return(nil)
+			return hub
+		},
+		DPS: func(t *testing.T, self *testCase) *mdps.Client {
+			dpsClient := new(mdps.Client)
+			dpsClient.On("DeleteEnrollment", contextMatcher, dpsCS, "device-1").
+				Return(nil).
+				On("DeleteEnrollment", contextMatcher, dpsCS, "device-2").
+				Return(client.HTTPError{Code: http.StatusNotFound}).
+				On("DeleteEnrollment", contextMatcher, dpsCS, "device-3").
+				Return(nil)
+			return dpsClient
+		},
+		Status:   model.JobStatusSucceeded,
+		Progress: model.JobProgress{Total: 3, Succeeded: 3},
+	}, {
+		Name: "ok, disable devices",
+
+		Action: model.TenantDevicesDisable,
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			ds := new(storeMocks.DataStore)
+			ds.On("GetSettings", contextMatcher).
+				Return(settings, nil).
+				On("GetDevices", contextMatcher, model.DeviceFilter{}).
+				Return(devices, nil).
+				On("DeleteTenant", contextMatcher, mock.AnythingOfType("uuid.UUID")).
+				Return(nil)
+			return ds
+		},
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			hub := new(miothub.Client)
+			hub.On("GetDeviceTwins", contextMatcher, cs, menderDevicesQuery()).
+				Return(twins(), nil).
+				On("GetDevice", contextMatcher, cs, "device-1").
+				Return(&iothub.Device{
+					DeviceID: "device-1",
+					Status:   iothub.StatusEnabled,
+				}, nil).
+				On("UpsertDevice", contextMatcher, cs, "device-1",
+					mock.MatchedBy(func(dev *iothub.Device) bool {
+						return dev.Status == iothub.StatusDisabled
+					})).
+				Return(nil, nil).
+				On("GetDevice", contextMatcher, cs, "device-2").
+				Return(&iothub.Device{
+					DeviceID: "device-2",
+					Status:   iothub.StatusDisabled,
+				}, nil)
+			return hub
+		},
+		IoTCore: func(t *testing.T, self *testCase) *miotcore.Client {
+			core := new(miotcore.Client)
+			core.On("SetDeviceStatus", contextMatcher, creds, "device-1",
+				iotcore.StatusDisabled).
+				Return(nil).
+				On("SetDeviceStatus", contextMatcher, creds, "device-3",
+					iotcore.StatusDisabled).
+				Return(client.HTTPError{Code: http.StatusNotFound})
+			return core
+		},
+		Status:   model.JobStatusSucceeded,
+		Progress: model.JobProgress{Total: 4, Succeeded: 4},
+	}, {
+		Name: "error, device not deleted",
+
+		Action: model.TenantDevicesDelete,
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			ds := new(storeMocks.DataStore)
+			ds.On("GetSettings", contextMatcher).
+				Return(settings, nil).
+				On("GetDevices", contextMatcher, model.DeviceFilter{}).
+				Return(devices, nil)
+			return ds
+		},
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			hub := new(miothub.Client)
+			hub.On("GetDeviceTwins", contextMatcher, cs, menderDevicesQuery()).
+				Return(twins(), nil).
+				On("DeleteDevice", contextMatcher, cs, "device-1").
+				Return(errors.New("internal error")).
+				On("DeleteDevice", contextMatcher, cs, "device-2").
+				Return(nil)
+			return hub
+		},
+		IoTCore: func(t *testing.T, self *testCase) *miotcore.Client {
+			core := new(miotcore.Client)
+			core.On("DeleteDevice", contextMatcher, creds, "device-1").
+				Return(nil).
+				On("DeleteDevice", contextMatcher, creds, "device-3").
+				Return(errors.New("throttled"))
+			return core
+		},
+		Status:   model.JobStatusFailed,
+		Progress: model.JobProgress{Total: 4, Succeeded: 2, Failed: 2},
+		ItemErrors: []model.JobItemError{{
+			Item:  "device-1",
+			Error: "failed to delete IoT Hub device: internal error",
+		}, {
+			Item:  "device-3",
+			Error: "failed to delete IoT Core device: throttled",
+		}},
+		JobError: "failed to delete 2 devices",
+	}, {
+		Name: "error, IoT Core not configured",
+
+		Action: model.TenantDevicesDelete,
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			ds := new(storeMocks.DataStore)
+			ds.On("GetSettings", contextMatcher).
+				Return(settings, nil).
+				On("GetDevices", contextMatcher, model.DeviceFilter{}).
+				Return(devices, nil)
+			return ds
+		},
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			hub := new(miothub.Client)
+			hub.On("GetDeviceTwins", contextMatcher, cs, menderDevicesQuery()).
+				Return(twins(), nil).
+				On("DeleteDevice", contextMatcher, cs, "device-1").
+				Return(nil).
+				On("DeleteDevice", contextMatcher, cs, "device-2").
+				Return(nil)
+			return hub
+		},
+		Status:   model.JobStatusFailed,
+		Progress: model.JobProgress{Total: 2, Succeeded: 2},
+		JobError: `integration "core": ` + ErrNoCredentials.Error(),
+	}, {
+		Name: "error, retrieving device records",
+
+		Action: model.TenantDevicesDelete,
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			ds := new(storeMocks.DataStore)
+			ds.On("GetSettings", contextMatcher).
+				Return(settings, nil).
+				On("GetDevices", contextMatcher, model.DeviceFilter{}).
+				Return(nil, errors.New("internal error"))
+			return ds
+		},
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			hub := new(miothub.Client)
+			hub.On("GetDeviceTwins", contextMatcher, cs, menderDevicesQuery()).
+				Return(twins(), nil).
+				On("DeleteDevice", contextMatcher, cs, "device-1").
+				Return(nil).
+				On("DeleteDevice", contextMatcher, cs, "device-2").
+				Return(nil)
+			return hub
+		},
+		Status:   model.JobStatusFailed,
+		Progress: model.JobProgress{Total: 2, Succeeded: 2},
+		JobError: "failed to retrieve devices: internal error",
+	}, {
+		Name: "error, listing devices",
+
+		Action: model.TenantDevicesDelete,
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			ds := new(storeMocks.DataStore)
+			ds.On("GetSettings", contextMatcher).
+				Return(settings, nil)
+			return ds
+		},
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			hub := new(miothub.Client)
+			hub.On("GetDeviceTwins", contextMatcher, cs, menderDevicesQuery()).
+				Return(nil, errors.New("no such host"))
+			return hub
+		},
+		Status: model.JobStatusFailed,
+		JobError: `integration "hub": failed to retrieve devices from IoT Hub: ` +
+			`no such host`,
+	}, {
+		Name: "error, deleting tenant data",
+
+		Action: model.TenantDevicesKeep,
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			ds := new(storeMocks.DataStore)
+			ds.On("DeleteTenant", contextMatcher, mock.AnythingOfType("uuid.UUID")).
+				Return(errors.New("internal error"))
+			return ds
+		},
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			return new(miothub.Client)
+		},
+		Status:   model.JobStatusFailed,
+		JobError: "failed to delete tenant data: internal error",
+	}, {
+		Name: "error, creating job",
+
+		Action: model.TenantDevicesKeep,
+		Store: func(t *testing.T, self *testCase) *storeMocks.DataStore {
+			ds := new(storeMocks.DataStore)
+			ds.On("CreateJob", contextMatcher, mock.AnythingOfType("model.Job")).
+				Return(errors.New("internal error"))
+			return ds
+		},
+		Hub: func(t *testing.T, self *testCase) *miothub.Client {
+			return new(miothub.Client)
+		},
+		Error: errors.New("failed to create job: internal error"),
+	}}
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			ds := tc.Store(t, &tc)
+			hub := tc.Hub(t, &tc)
+			defer ds.AssertExpectations(t)
+			defer hub.AssertExpectations(t)
+			opts := NewOptions()
+			if tc.IoTCore != nil {
+				core := tc.IoTCore(t, &tc)
+				defer core.AssertExpectations(t)
+				opts.SetIoTCore(core)
+			}
+			if tc.DPS != nil {
+				dpsClient := tc.DPS(t, &tc)
+				defer dpsClient.AssertExpectations(t)
+				opts.SetDPS(dpsClient)
+			}
+
+			var update model.JobUpdate
+			if tc.Error == nil {
+				ds.On("CreateJob", contextMatcher,
+					mock.MatchedBy(func(job model.Job) bool {
+						return job.TenantID == tenantID &&
+							job.Type == model.JobTypeDeleteTenant &&
+							job.Status == model.JobStatusPending &&
+							job.Params[jobParamDevices] == string(tc.Action)
+					})).
+					Return(nil).
+					On("UpdateJob", contextMatcher, mock.AnythingOfType("uuid.UUID"),
+						mock.MatchedBy(func(update model.JobUpdate) bool {
+							return update.Status != nil &&
+								update.LeaseOwner == "worker"
+						})).
+					Run(func(args mock.Arguments) {
+						update = args.Get(2).(model.JobUpdate)
+					}).
+					Return(nil)
+			}
+
+			ctx := identity.WithContext(context.Background(), &identity.Identity{
+				Tenant: tenantID,
+			})
+			a := New(ds, hub, nil, opts)
+			job, err := a.DeleteTenant(ctx, tc.Action)
+			if tc.Error != nil {
+				if assert.Error(t, err) {
+					assert.EqualError(t, err, tc.Error.Error())
+				}
+				return
+			}
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Equal(t, model.JobTypeDeleteTenant, job.Type)
+
+			job.Attempts = 1
+			a.(*app).runJob(context.Background(), "worker", job)
+			if assert.NotNil(t, update.Status) {
+				assert.Equal(t, tc.Status, *update.Status)
+			}
+			assert.Equal(t, tc.Progress, *update.Progress)
+			assert.Equal(t, tc.ItemErrors, update.ItemErrors)
+			if tc.JobError != "" {
+				if assert.NotNil(t, update.Error) {
+					assert.Equal(t, tc.JobError, *update.Error)
+				}
+			} else {
+				assert.Nil(t, update.Error)
+			}
+		})
+	}
+}
@@ -0,0 +1,180 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package devauth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/mendersoftware/go-lib-micro/identity"
+	"github.com/mendersoftware/go-lib-micro/requestid"
+
+	common "github.com/mendersoftware/iot-manager/client"
+)
+
+const (
+	URIInternal    = "/api/internal/v1/devauth"
+	URICheckHealth = URIInternal + "/health/alive"
+	URIDevices     = URIInternal + "/tenants/:tenant/devices"
+
+	// maxDevicesPerRequest is the maximum number of device IDs looked up
+	// per request.
+	maxDevicesPerRequest = 100
+)
+
+const (
+	defaultTimeout = time.Duration(10) * time.Second
+)
+
+// Device is a device known to the device authentication service.
+type Device struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+}
+
+// Client is the device authentication service client
+//go:generate ../../utils/mockgen.sh
+type Client interface {
+	CheckHealth(ctx context.Context) error
+	// GetDevices returns the devices of the tenant in the context with the
+	// given IDs, the devices unknown to the service are omitted.
+	GetDevices(ctx context.Context, deviceIDs []string) ([]Device, error)
+}
+
+type Options struct {
+	Client *http.Client
+}
+
+func NewOptions(opts ...*Options) *Options {
+	ret := new(Options)
+	for _, opt := range opts {
+		if opt == nil {
+			continue
+		}
+		if opt.Client != nil {
+			ret.Client = opt.Client
+		}
+	}
+	return ret
+}
+
+func (opts *Options) SetClient(client *http.Client) *Options {
+	opts.Client = client
+	return opts
+}
+
+// NewClient returns a new device authentication service client
+func NewClient(url string, opts ...*Options) Client {
+	opt := NewOptions(opts...)
+	if opt.Client == nil {
+		opt.Client = new(http.Client)
+	}
+
+	return &client{
+		url:    strings.TrimRight(url, "/"),
+		Client: opt.Client,
+	}
+}
+
+type client struct {
+	url string
+	*http.Client
+}
+
+func (c *client) CheckHealth(ctx context.Context) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultTimeout)
+		defer cancel()
+	}
+	req, _ := http.NewRequestWithContext(
+		ctx, http.MethodGet, c.url+URICheckHealth, nil,
+	)
+	rsp, err := c.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "devauth: failed to execute request")
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode >= 300 {
+		return common.NewHTTPError("devauth", rsp)
+	}
+	return nil
+}
+
+func (c *client) GetDevices(
+	ctx context.Context,
+	deviceIDs []string,
+) ([]Device, error) {
+	id := identity.FromContext(ctx)
+	if id == nil {
+		return nil, errors.New("devauth: missing tenant identity")
+	}
+	devices := make([]Device, 0, len(deviceIDs))
+	for start := 0; start < len(deviceIDs); start += maxDevicesPerRequest {
+		end := start + maxDevicesPerRequest
+		if end > len(deviceIDs) {
+			end = len(deviceIDs)
+		}
+		page, err := c.getDevices(ctx, id.Tenant, deviceIDs[start:end])
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, page...)
+	}
+	return devices, nil
+}
+
+func (c *client) getDevices(
+	ctx context.Context,
+	tenantID string,
+	deviceIDs []string,
+) ([]Device, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultTimeout)
+		defer cancel()
+	}
+	q := url.Values{
+		"id":       deviceIDs,
+		"per_page": []string{strconv.Itoa(len(deviceIDs))},
+	}
+	uri := c.url + strings.Replace(URIDevices, ":tenant", tenantID, 1) +
+		"?" + q.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "devauth: failed to prepare request")
+	}
+	req.Header.Set(requestid.RequestIdHeader, requestid.FromContext(ctx))
+	rsp, err := c.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "devauth: failed to execute request")
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode >= 300 {
+		return nil, common.NewHTTPError("devauth", rsp)
+	}
+	var devices []Device
+	if err = json.NewDecoder(rsp.Body).Decode(&devices); err != nil {
+		return nil, errors.Wrap(err, "devauth: failed to decode response")
+	}
+	return devices, nil
+}
@@ -0,0 +1,115 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package devauth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/go-lib-micro/identity"
+
+	common "github.com/mendersoftware/iot-manager/client"
+)
+
+func TestGetDevices(t *testing.T) {
+	t.Parallel()
+	const tenantID = "123456789012345678901234"
+	deviceIDs := make([]string, maxDevicesPerRequest+1)
+	for i := range deviceIDs {
+		deviceIDs[i] = strings.Repeat("a", i+1)
+	}
+	testCases := []struct {
+		Name string
+
+		CTX       context.Context
+		DeviceIDs []string
+		Handler   http.HandlerFunc
+
+		Devices []Device
+		Error   error
+	}{{
+		Name: "ok",
+
+		CTX: identity.WithContext(context.Background(), &identity.Identity{
+			Tenant: tenantID,
+		}),
+		DeviceIDs: deviceIDs,
+		Handler: func(w http.ResponseWriter, r *http.Request) {
+			expected := strings.Replace(URIDevices, ":tenant", tenantID, 1)
+			if r.URL.Path != expected {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			// Every request echoes the first device ID.
+			ids := r.URL.Query()["id"]
+			_ = json.NewEncoder(w).Encode([]Device{{
+				ID:     ids[0],
+				Status: "accepted",
+			}})
+		},
+
+		Devices: []Device{
+			{ID: deviceIDs[0], Status: "accepted"},
+			{ID: deviceIDs[maxDevicesPerRequest], Status: "accepted"},
+		},
+	}, {
+		Name: "error, missing identity",
+
+		CTX:       context.Background(),
+		DeviceIDs: []string{"a"},
+		Handler: func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusInternalServerError)
+		},
+
+		Error: errors.New("devauth: missing tenant identity"),
+	}, {
+		Name: "error, status code",
+
+		CTX: identity.WithContext(context.Background(), &identity.Identity{
+			Tenant: tenantID,
+		}),
+		DeviceIDs: []string{"a"},
+		Handler: func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusInternalServerError)
+		},
+
+		Error: common.HTTPError{
+			Code:    http.StatusInternalServerError,
+			Service: "devauth",
+		},
+	}}
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			srv := httptest.NewServer(tc.Handler)
+			defer srv.Close()
+
+			devices, err := NewClient(srv.URL).GetDevices(tc.CTX, tc.DeviceIDs)
+			if tc.Error != nil {
+				assert.EqualError(t, err, tc.Error.Error())
+			} else if assert.NoError(t, err) {
+				assert.Equal(t, tc.Devices, devices)
+			}
+		})
+	}
+}
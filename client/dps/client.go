@@ -0,0 +1,294 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package dps
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	common "github.com/mendersoftware/iot-manager/client"
+	"github.com/mendersoftware/iot-manager/model"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	uriEnrollments      = "/enrollments"
+	uriEnrollmentGroups = "/enrollmentGroups"
+
+	hdrKeyContentType   = "Content-Type"
+	hdrKeyAuthorization = "Authorization"
+	hdrKeyIfMatch       = "If-Match"
+
+	// https://docs.microsoft.com/en-us/rest/api/iot-dps/service/individual-enrollment
+	APIVersion = "2021-10-01"
+
+	// GlobalEndpoint is the default global device endpoint used by
+	// devices to register with the provisioning service.
+	GlobalEndpoint = "global.azure-devices-provisioning.net"
+)
+
+const (
+	defaultTTL = time.Minute
+)
+
+func uriEnrollment(id string) string {
+	return uriEnrollments + "/" + url.PathEscape(id)
+}
+
+func uriEnrollmentGroup(id string) string {
+	return uriEnrollmentGroups + "/" + url.PathEscape(id)
+}
+
+// Client is a client for the Azure IoT Hub Device Provisioning Service
+// (service API). The connection string must contain a shared access policy
+// of the provisioning service.
+//nolint:lll
+//go:generate ../../utils/mockgen.sh
+type Client interface {
+	GetEnrollment(ctx context.Context, cs *model.ConnectionString, id string) (*Enrollment, error)
+	// UpsertEnrollment creates or replaces the individual enrollment. If
+	// the enrollment has an ETag, the enrollment is only replaced if the
+	// ETag matches.
+	UpsertEnrollment(ctx context.Context, cs *model.ConnectionString, enrollment *Enrollment) (*Enrollment, error)
+	DeleteEnrollment(ctx context.Context, cs *model.ConnectionString, id string) error
+
+	GetEnrollmentGroup(ctx context.Context, cs *model.ConnectionString, id string) (*EnrollmentGroup, error)
+	// UpsertEnrollmentGroup creates or replaces the enrollment group. If
+	// the group has an ETag, the group is only replaced if the ETag
+	// matches.
+	UpsertEnrollmentGroup(ctx context.Context, cs *model.ConnectionString, group *EnrollmentGroup) (*EnrollmentGroup, error)
+	DeleteEnrollmentGroup(ctx context.Context, cs *model.ConnectionString, id string) error
+}
+
+type client struct {
+	*http.Client
+}
+
+type Options struct {
+	Client *http.Client
+}
+
+func NewOptions(opts ...*Options) *Options {
+	opt := new(Options)
+	for _, o := range opts {
+		if o == nil {
+			continue
+		}
+		if o.Client != nil {
+			opt.Client = o.Client
+		}
+	}
+	return opt
+}
+
+func (opt *Options) SetClient(client *http.Client) *Options {
+	opt.Client = client
+	return opt
+}
+
+func NewClient(options ...*Options) Client {
+	opts := NewOptions(options...)
+	if opts.Client == nil {
+		opts.Client = new(http.Client)
+	}
+	return &client{
+		Client: opts.Client,
+	}
+}
+
+func (c *client) NewRequestWithContext(
+	ctx context.Context,
+	cs *model.ConnectionString,
+	method, urlPath string,
+	body io.Reader,
+) (*http.Request, error) {
+	if err := cs.Validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid connection string")
+	}
+	uri := "https://" + cs.HostName + "/" +
+		strings.TrimPrefix(urlPath, "/") +
+		"?api-version=" + APIVersion
+	req, err := http.NewRequestWithContext(ctx, method, uri, body)
+	if err != nil {
+		return req, err
+	}
+	if body != nil {
+		req.Header.Set(hdrKeyContentType, "application/json")
+	}
+
+	var expireAt time.Time
+	if dl, ok := ctx.Deadline(); ok {
+		expireAt = dl
+	} else {
+		expireAt = time.Now().Add(defaultTTL)
+	}
+	req.Header.Set(hdrKeyAuthorization, cs.Authorization(expireAt))
+
+	return req, err
+}
+
+// do executes the request and decodes the response body into v (if not nil).
+func (c *client) do(req *http.Request, v interface{}) error {
+	rsp, err := c.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "dps: failed to execute request")
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode >= 400 {
+		return common.NewHTTPError("dps", rsp)
+	}
+	if v == nil {
+		return nil
+	}
+	dec := json.NewDecoder(rsp.Body)
+	if err = dec.Decode(v); err != nil {
+		return errors.Wrap(err, "dps: failed to decode API response")
+	}
+	return nil
+}
+
+func (c *client) put(
+	ctx context.Context,
+	cs *model.ConnectionString,
+	uri, etag string,
+	body, v interface{},
+) error {
+	b, _ := json.Marshal(body)
+	req, err := c.NewRequestWithContext(ctx, cs, http.MethodPut, uri, bytes.NewReader(b))
+	if err != nil {
+		return errors.Wrap(err, "dps: failed to prepare request")
+	}
+	if etag != "" {
+		req.Header.Set(hdrKeyIfMatch, `"`+strings.Trim(etag, `"`)+`"`)
+	}
+	return c.do(req, v)
+}
+
+func (c *client) get(
+	ctx context.Context,
+	cs *model.ConnectionString,
+	uri string,
+	v interface{},
+) error {
+	req, err := c.NewRequestWithContext(ctx, cs, http.MethodGet, uri, nil)
+	if err != nil {
+		return errors.Wrap(err, "dps: failed to prepare request")
+	}
+	return c.do(req, v)
+}
+
+func (c *client) delete(ctx context.Context, cs *model.ConnectionString, uri string) error {
+	req, err := c.NewRequestWithContext(ctx, cs, http.MethodDelete, uri, nil)
+	if err != nil {
+		return errors.Wrap(err, "dps: failed to prepare request")
+	}
+	req.Header.Set(hdrKeyIfMatch, "*")
+	return c.do(req, nil)
+}
+
+// GET /enrollments/{id}
+func (c *client) GetEnrollment(
+	ctx context.Context,
+	cs *model.ConnectionString,
+	id string,
+) (*Enrollment, error) {
+	enrollment := new(Enrollment)
+	err := c.get(ctx, cs, uriEnrollment(id), enrollment)
+	if err != nil {
+		return nil, err
+	}
+	return enrollment, nil
+}
+
+// PUT /enrollments/{id}
+func (c *client) UpsertEnrollment(
+	ctx context.Context,
+	cs *model.ConnectionString,
+	enrollment *Enrollment,
+) (*Enrollment, error) {
+	if enrollment == nil || enrollment.RegistrationID == "" {
+		return nil, errors.New("dps: enrollment registration ID cannot be empty")
+	}
+	ret := new(Enrollment)
+	err := c.put(ctx, cs,
+		uriEnrollment(enrollment.RegistrationID),
+		enrollment.ETag,
+		enrollment, ret,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// DELETE /enrollments/{id}
+func (c *client) DeleteEnrollment(
+	ctx context.Context,
+	cs *model.ConnectionString,
+	id string,
+) error {
+	return c.delete(ctx, cs, uriEnrollment(id))
+}
+
+// GET /enrollmentGroups/{id}
+func (c *client) GetEnrollmentGroup(
+	ctx context.Context,
+	cs *model.ConnectionString,
+	id string,
+) (*EnrollmentGroup, error) {
+	group := new(EnrollmentGroup)
+	err := c.get(ctx, cs, uriEnrollmentGroup(id), group)
+	if err != nil {
+		return nil, err
+	}
+	return group, nil
+}
+
+// PUT /enrollmentGroups/{id}
+func (c *client) UpsertEnrollmentGroup(
+	ctx context.Context,
+	cs *model.ConnectionString,
+	group *EnrollmentGroup,
+) (*EnrollmentGroup, error) {
+	if group == nil || group.EnrollmentGroupID == "" {
+		return nil, errors.New("dps: enrollment group ID cannot be empty")
+	}
+	ret := new(EnrollmentGroup)
+	err := c.put(ctx, cs,
+		uriEnrollmentGroup(group.EnrollmentGroupID),
+		group.ETag,
+		group, ret,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// DELETE /enrollmentGroups/{id}
+func (c *client) DeleteEnrollmentGroup(
+	ctx context.Context,
+	cs *model.ConnectionString,
+	id string,
+) error {
+	return c.delete(ctx, cs, uriEnrollmentGroup(id))
+}
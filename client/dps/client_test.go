@@ -0,0 +1,347 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package dps
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	common "github.com/mendersoftware/iot-manager/client"
+	"github.com/mendersoftware/iot-manager/model"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+type RoundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (rt RoundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return rt(r)
+}
+
+var testCS = &model.ConnectionString{
+	HostName: "mender.azure-devices-provisioning.net",
+	Name:     "provisioningserviceowner",
+	Key:      []byte("secret"),
+}
+
+func TestDeriveKey(t *testing.T) {
+	t.Parallel()
+	groupKey := Key("group secret")
+	h := hmac.New(sha256.New, groupKey)
+	_, _ = h.Write([]byte("device-1"))
+	assert.Equal(t, Key(h.Sum(nil)), DeriveKey(groupKey, "device-1"))
+	assert.NotEqual(t, DeriveKey(groupKey, "device-1"), DeriveKey(groupKey, "device-2"))
+}
+
+func TestNewSymmetricKeyAttestation(t *testing.T) {
+	t.Parallel()
+	att, err := NewSymmetricKeyAttestation()
+	if assert.NoError(t, err) {
+		assert.Equal(t, AttestationTypeSymmetricKey, att.Type)
+		if assert.NotNil(t, att.SymmetricKey) {
+			assert.Len(t, att.SymmetricKey.Primary, 64)
+			assert.Len(t, att.SymmetricKey.Secondary, 64)
+			assert.NotEqual(t, att.SymmetricKey.Primary, att.SymmetricKey.Secondary)
+		}
+	}
+	b, _ := json.Marshal(att)
+	assert.Contains(t, string(b),
+		base64.StdEncoding.EncodeToString(att.SymmetricKey.Primary))
+}
+
+func TestUpsertEnrollment(t *testing.T) {
+	t.Parallel()
+	testCases := []struct {
+		Name string
+
+		ConnStr    *model.ConnectionString
+		Enrollment *Enrollment
+
+		RSPCode int
+		RSPBody interface{}
+		RTError error
+
+		Error error
+	}{{
+		Name: "ok",
+
+		ConnStr: testCS,
+		Enrollment: &Enrollment{
+			RegistrationID: "device-1",
+			DeviceID:       "device-1",
+			Attestation: &Attestation{
+				Type: AttestationTypeSymmetricKey,
+				SymmetricKey: &SymmetricKey{
+					Primary:   Key("foo"),
+					Secondary: Key("bar"),
+				},
+			},
+			ETag: "tag",
+		},
+		RSPCode: http.StatusOK,
+		RSPBody: &Enrollment{
+			RegistrationID: "device-1",
+			DeviceID:       "device-1",
+			Attestation: &Attestation{
+				Type: AttestationTypeSymmetricKey,
+				SymmetricKey: &SymmetricKey{
+					Primary:   Key("foo"),
+					Secondary: Key("bar"),
+				},
+			},
+			ETag: "new tag",
+		},
+	}, {
+		Name: "error/no registration ID",
+
+		ConnStr:    testCS,
+		Enrollment: &Enrollment{},
+		Error:      errors.New("dps: enrollment registration ID cannot be empty"),
+	}, {
+		Name: "error/invalid connection string",
+
+		ConnStr:    &model.ConnectionString{Name: "bad"},
+		Enrollment: &Enrollment{RegistrationID: "device-1"},
+		Error:      errors.New("dps: failed to prepare request: invalid connection string"),
+	}, {
+		Name: "error/roundtrip error",
+
+		ConnStr:    testCS,
+		Enrollment: &Enrollment{RegistrationID: "device-1"},
+		RTError:    errors.New("idk"),
+		Error:      errors.New("dps: failed to execute request:.*idk"),
+	}, {
+		Name: "error/bad status code",
+
+		ConnStr:    testCS,
+		Enrollment: &Enrollment{RegistrationID: "device-1"},
+		RSPCode:    http.StatusPreconditionFailed,
+		Error:      common.HTTPError{Code: http.StatusPreconditionFailed},
+	}, {
+		Name: "error/malformed response",
+
+		ConnStr:    testCS,
+		Enrollment: &Enrollment{RegistrationID: "device-1"},
+		RSPCode:    http.StatusOK,
+		RSPBody:    []byte("your enrollment, sir"),
+		Error:      errors.New("dps: failed to decode API response"),
+	}}
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			ctx := context.Background()
+			w := httptest.NewRecorder()
+			httpClient := &http.Client{
+				Transport: RoundTripperFunc(func(
+					r *http.Request,
+				) (*http.Response, error) {
+					if tc.RTError != nil {
+						return nil, tc.RTError
+					}
+					assert.Equal(t, http.MethodPut, r.Method)
+					assert.Equal(t,
+						"/enrollments/"+tc.Enrollment.RegistrationID,
+						r.URL.Path,
+					)
+					assert.Equal(t, APIVersion, r.URL.Query().Get("api-version"))
+					assert.True(t, strings.HasPrefix(
+						r.Header.Get(hdrKeyAuthorization),
+						"SharedAccessSignature ",
+					))
+					if tc.Enrollment.ETag != "" {
+						assert.Equal(t,
+							`"`+tc.Enrollment.ETag+`"`,
+							r.Header.Get(hdrKeyIfMatch),
+						)
+					}
+					var body Enrollment
+					err := json.NewDecoder(r.Body).Decode(&body)
+					assert.NoError(t, err)
+					assert.Equal(t, tc.Enrollment.RegistrationID, body.RegistrationID)
+
+					w.WriteHeader(tc.RSPCode)
+					switch t := tc.RSPBody.(type) {
+					case []byte:
+						_, _ = w.Write(t)
+					case nil:
+					default:
+						b, _ := json.Marshal(t)
+						_, _ = w.Write(b)
+					}
+					return w.Result(), nil
+				}),
+			}
+			client := NewClient(NewOptions().SetClient(httpClient))
+			enrollment, err := client.UpsertEnrollment(ctx, tc.ConnStr, tc.Enrollment)
+			if tc.Error != nil {
+				if assert.Error(t, err) {
+					assert.Regexp(t, tc.Error.Error(), err.Error())
+				}
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tc.RSPBody, enrollment)
+			}
+		})
+	}
+}
+
+func TestGetEnrollmentGroup(t *testing.T) {
+	t.Parallel()
+	testCases := []struct {
+		Name string
+
+		GroupID string
+		RSPCode int
+		RSPBody interface{}
+
+		Error error
+	}{{
+		Name: "ok",
+
+		GroupID: "mender",
+		RSPCode: http.StatusOK,
+		RSPBody: &EnrollmentGroup{
+			EnrollmentGroupID: "mender",
+			Attestation: &Attestation{
+				Type: AttestationTypeSymmetricKey,
+				SymmetricKey: &SymmetricKey{
+					Primary:   Key("foo"),
+					Secondary: Key("bar"),
+				},
+			},
+			ProvisioningStatus: ProvisioningStatusEnabled,
+			ETag:               "tag",
+		},
+	}, {
+		Name: "error/not found",
+
+		GroupID: "mender",
+		RSPCode: http.StatusNotFound,
+		Error:   common.HTTPError{Code: http.StatusNotFound},
+	}}
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			ctx := context.Background()
+			w := httptest.NewRecorder()
+			httpClient := &http.Client{
+				Transport: RoundTripperFunc(func(
+					r *http.Request,
+				) (*http.Response, error) {
+					assert.Equal(t, http.MethodGet, r.Method)
+					assert.Equal(t, "/enrollmentGroups/"+tc.GroupID, r.URL.Path)
+					w.WriteHeader(tc.RSPCode)
+					if tc.RSPBody != nil {
+						b, _ := json.Marshal(tc.RSPBody)
+						_, _ = w.Write(b)
+					}
+					return w.Result(), nil
+				}),
+			}
+			client := NewClient(NewOptions().SetClient(httpClient))
+			group, err := client.GetEnrollmentGroup(ctx, testCS, tc.GroupID)
+			if tc.Error != nil {
+				if assert.Error(t, err) {
+					assert.Regexp(t, tc.Error.Error(), err.Error())
+				}
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tc.RSPBody, group)
+			}
+		})
+	}
+}
+
+func TestDeleteEnrollment(t *testing.T) {
+	t.Parallel()
+	testCases := []struct {
+		Name string
+
+		Group   bool
+		RSPCode int
+		RTError error
+
+		Error error
+	}{{
+		Name: "ok",
+
+		RSPCode: http.StatusNoContent,
+	}, {
+		Name: "ok/group",
+
+		Group:   true,
+		RSPCode: http.StatusNoContent,
+	}, {
+		Name: "error/roundtrip error",
+
+		RTError: errors.New("idk"),
+		Error:   errors.New("dps: failed to execute request:.*idk"),
+	}, {
+		Name: "error/bad status code",
+
+		RSPCode: http.StatusNotFound,
+		Error:   common.HTTPError{Code: http.StatusNotFound},
+	}}
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			ctx := context.Background()
+			w := httptest.NewRecorder()
+			httpClient := &http.Client{
+				Transport: RoundTripperFunc(func(
+					r *http.Request,
+				) (*http.Response, error) {
+					if tc.RTError != nil {
+						return nil, tc.RTError
+					}
+					assert.Equal(t, http.MethodDelete, r.Method)
+					assert.Equal(t, "*", r.Header.Get(hdrKeyIfMatch))
+					if tc.Group {
+						assert.Equal(t, "/enrollmentGroups/id", r.URL.Path)
+					} else {
+						assert.Equal(t, "/enrollments/id", r.URL.Path)
+					}
+					w.WriteHeader(tc.RSPCode)
+					return w.Result(), nil
+				}),
+			}
+			client := NewClient(NewOptions().SetClient(httpClient))
+			var err error
+			if tc.Group {
+				err = client.DeleteEnrollmentGroup(ctx, testCS, "id")
+			} else {
+				err = client.DeleteEnrollment(ctx, testCS, "id")
+			}
+			if tc.Error != nil {
+				if assert.Error(t, err) {
+					assert.Regexp(t, tc.Error.Error(), err.Error())
+				}
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
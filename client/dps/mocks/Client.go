@@ -0,0 +1,151 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+// Code generated by mockery v2.9.4. DO NOT EDIT.
+
+package mocks
+
+import (
+	context "context"
+
+	dps "github.com/mendersoftware/iot-manager/client/dps"
+	mock "github.com/stretchr/testify/mock"
+
+	model "github.com/mendersoftware/iot-manager/model"
+)
+
+// Client is an autogenerated mock type for the Client type
+type Client struct {
+	mock.Mock
+}
+
+// DeleteEnrollment provides a mock function with given fields: ctx, cs, id
+func (_m *Client) DeleteEnrollment(ctx context.Context, cs *model.ConnectionString, id string) error {
+	ret := _m.Called(ctx, cs, id)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, *model.ConnectionString, string) error); ok {
+		r0 = rf(ctx, cs, id)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// DeleteEnrollmentGroup provides a mock function with given fields: ctx, cs, id
+func (_m *Client) DeleteEnrollmentGroup(ctx context.Context, cs *model.ConnectionString, id string) error {
+	ret := _m.Called(ctx, cs, id)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, *model.ConnectionString, string) error); ok {
+		r0 = rf(ctx, cs, id)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// GetEnrollment provides a mock function with given fields: ctx, cs, id
+func (_m *Client) GetEnrollment(ctx context.Context, cs *model.ConnectionString, id string) (*dps.Enrollment, error) {
+	ret := _m.Called(ctx, cs, id)
+
+	var r0 *dps.Enrollment
+	if rf, ok := ret.Get(0).(func(context.Context, *model.ConnectionString, string) *dps.Enrollment); ok {
+		r0 = rf(ctx, cs, id)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*dps.Enrollment)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, *model.ConnectionString, string) error); ok {
+		r1 = rf(ctx, cs, id)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetEnrollmentGroup provides a mock function with given fields: ctx, cs, id
+func (_m *Client) GetEnrollmentGroup(ctx context.Context, cs *model.ConnectionString, id string) (*dps.EnrollmentGroup, error) {
+	ret := _m.Called(ctx, cs, id)
+
+	var r0 *dps.EnrollmentGroup
+	if rf, ok := ret.Get(0).(func(context.Context, *model.ConnectionString, string) *dps.EnrollmentGroup); ok {
+		r0 = rf(ctx, cs, id)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*dps.EnrollmentGroup)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, *model.ConnectionString, string) error); ok {
+		r1 = rf(ctx, cs, id)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// UpsertEnrollment provides a mock function with given fields: ctx, cs, enrollment
+func (_m *Client) UpsertEnrollment(ctx context.Context, cs *model.ConnectionString, enrollment *dps.Enrollment) (*dps.Enrollment, error) {
+	ret := _m.Called(ctx, cs, enrollment)
+
+	var r0 *dps.Enrollment
+	if rf, ok := ret.Get(0).(func(context.Context, *model.ConnectionString, *dps.Enrollment) *dps.Enrollment); ok {
+		r0 = rf(ctx, cs, enrollment)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*dps.Enrollment)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, *model.ConnectionString, *dps.Enrollment) error); ok {
+		r1 = rf(ctx, cs, enrollment)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// UpsertEnrollmentGroup provides a mock function with given fields: ctx, cs, group
+func (_m *Client) UpsertEnrollmentGroup(ctx context.Context, cs *model.ConnectionString, group *dps.EnrollmentGroup) (*dps.EnrollmentGroup, error) {
+	ret := _m.Called(ctx, cs, group)
+
+	var r0 *dps.EnrollmentGroup
+	if rf, ok := ret.Get(0).(func(context.Context, *model.ConnectionString, *dps.EnrollmentGroup) *dps.EnrollmentGroup); ok {
+		r0 = rf(ctx, cs, group)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*dps.EnrollmentGroup)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, *model.ConnectionString, *dps.EnrollmentGroup) error); ok {
+		r1 = rf(ctx, cs, group)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
@@ -0,0 +1,139 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package dps
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+)
+
+type Key []byte
+
+func (k Key) MarshalText() ([]byte, error) {
+	n := base64.StdEncoding.EncodedLen(len(k))
+	ret := make([]byte, n)
+	base64.StdEncoding.Encode(ret, k)
+	return ret, nil
+}
+
+// DeriveKey computes the symmetric key of a device enrolled through an
+// enrollment group: HMAC-SHA256(groupKey, registrationID).
+func DeriveKey(groupKey Key, registrationID string) Key {
+	h := hmac.New(sha256.New, groupKey)
+	_, _ = h.Write([]byte(registrationID))
+	return Key(h.Sum(nil))
+}
+
+type SymmetricKey struct {
+	Primary   Key `json:"primaryKey,omitempty"`
+	Secondary Key `json:"secondaryKey,omitempty"`
+}
+
+type AttestationType string
+
+const (
+	AttestationTypeSymmetricKey AttestationType = "symmetricKey"
+	AttestationTypeX509         AttestationType = "x509"
+	AttestationTypeTPM          AttestationType = "tpm"
+)
+
+type Attestation struct {
+	Type         AttestationType `json:"type"`
+	SymmetricKey *SymmetricKey   `json:"symmetricKey,omitempty"`
+}
+
+// NewSymmetricKeyAttestation generates a symmetric key attestation with
+// random primary and secondary keys.
+func NewSymmetricKeyAttestation() (*Attestation, error) {
+	var primKey, secKey [64]byte
+	_, err := io.ReadFull(rand.Reader, primKey[:])
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.ReadFull(rand.Reader, secKey[:])
+	if err != nil {
+		return nil, err
+	}
+	return &Attestation{
+		Type: AttestationTypeSymmetricKey,
+		SymmetricKey: &SymmetricKey{
+			Primary:   Key(primKey[:]),
+			Secondary: Key(secKey[:]),
+		},
+	}, nil
+}
+
+type ProvisioningStatus string
+
+const (
+	ProvisioningStatusEnabled  ProvisioningStatus = "enabled"
+	ProvisioningStatusDisabled ProvisioningStatus = "disabled"
+)
+
+type AllocationPolicy string
+
+const (
+	AllocationPolicyHashed        AllocationPolicy = "hashed"
+	AllocationPolicyGeoLatency    AllocationPolicy = "geoLatency"
+	AllocationPolicyStatic        AllocationPolicy = "static"
+	AllocationPolicyCustom        AllocationPolicy = "custom"
+	AllocationPolicyNotApplicable AllocationPolicy = ""
+)
+
+type Capabilities struct {
+	IOTEdge bool `json:"iotEdge"`
+}
+
+type TwinProperties struct {
+	Desired map[string]interface{} `json:"desired,omitempty"`
+}
+
+type InitialTwin struct {
+	Tags       map[string]interface{} `json:"tags,omitempty"`
+	Properties *TwinProperties        `json:"properties,omitempty"`
+}
+
+// Enrollment is an individual enrollment of a single device.
+type Enrollment struct {
+	RegistrationID     string             `json:"registrationId"`
+	DeviceID           string             `json:"deviceId,omitempty"`
+	Attestation        *Attestation       `json:"attestation"`
+	Capabilities       *Capabilities      `json:"capabilities,omitempty"`
+	InitialTwin        *InitialTwin       `json:"initialTwin,omitempty"`
+	IoTHubs            []string           `json:"iotHubs,omitempty"`
+	AllocationPolicy   AllocationPolicy   `json:"allocationPolicy,omitempty"`
+	ProvisioningStatus ProvisioningStatus `json:"provisioningStatus,omitempty"`
+	ETag               string             `json:"etag,omitempty"`
+	CreatedTime        string             `json:"createdDateTimeUtc,omitempty"`
+	UpdatedTime        string             `json:"lastUpdatedDateTimeUtc,omitempty"`
+}
+
+// EnrollmentGroup is a group enrollment for devices sharing an attestation
+// mechanism.
+type EnrollmentGroup struct {
+	EnrollmentGroupID  string             `json:"enrollmentGroupId"`
+	Attestation        *Attestation       `json:"attestation"`
+	Capabilities       *Capabilities      `json:"capabilities,omitempty"`
+	InitialTwin        *InitialTwin       `json:"initialTwin,omitempty"`
+	IoTHubs            []string           `json:"iotHubs,omitempty"`
+	AllocationPolicy   AllocationPolicy   `json:"allocationPolicy,omitempty"`
+	ProvisioningStatus ProvisioningStatus `json:"provisioningStatus,omitempty"`
+	ETag               string             `json:"etag,omitempty"`
+	CreatedTime        string             `json:"createdDateTimeUtc,omitempty"`
+	UpdatedTime        string             `json:"lastUpdatedDateTimeUtc,omitempty"`
+}
@@ -15,13 +15,140 @@
 package client
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
 )
 
+const (
+	hdrKeyAmznErrorType = "X-Amzn-Errortype"
+
+	maxErrorBodySize = 64 * 1024
+)
+
+// HTTPError is returned by the API clients when the remote service responds
+// with an error status code. The error details reported by the service in
+// the response body are kept so that operators can act on them.
 type HTTPError struct {
+	// Code is the HTTP status code of the response.
 	Code int
+	// Service is the name of the API returning the error.
+	Service string
+
+	// ErrorCode is the service specific error code, for example
+	// "IotHubQuotaExceeded" or "DeviceMaximumQueueDepthExceeded".
+	ErrorCode string
+	// Message is the error message reported by the service.
+	Message string
+	// TrackingID identifies the failed request with the service provider.
+	TrackingID string
+}
+
+// NewHTTPError creates an HTTPError from the error response from service
+// parsing the error details from the response body. The response body is
+// consumed but not closed.
+func NewHTTPError(service string, rsp *http.Response) HTTPError {
+	err := HTTPError{
+		Code:    rsp.StatusCode,
+		Service: service,
+	}
+	if errType := rsp.Header.Get(hdrKeyAmznErrorType); errType != "" {
+		// AWS error types are formatted as "<type>:<uri>"
+		err.ErrorCode = strings.SplitN(errType, ":", 2)[0]
+	}
+	if rsp.Body == nil {
+		return err
+	}
+	body, _ := io.ReadAll(io.LimitReader(rsp.Body, maxErrorBodySize))
+	err.parseBody(body)
+	return err
+}
+
+// errorBody covers the error response schemas of the supported services:
+// Azure IoT Hub and DPS, AWS IoT Core and Mender services. The field names
+// are matched case-insensitively.
+type errorBody struct {
+	ErrorCode        json.RawMessage `json:"errorCode"`
+	Code             json.RawMessage `json:"code"`
+	Message          string          `json:"message"`
+	ExceptionMessage string          `json:"exceptionMessage"`
+	TrackingID       string          `json:"trackingId"`
+	Error            string          `json:"error"`
+	RequestID        string          `json:"request_id"`
+}
+
+func parseCode(raw json.RawMessage) string {
+	if len(raw) == 0 {
+		return ""
+	}
+	var code string
+	if err := json.Unmarshal(raw, &code); err == nil {
+		return code
+	}
+	var num int64
+	if err := json.Unmarshal(raw, &num); err == nil {
+		return strconv.FormatInt(num, 10)
+	}
+	return ""
+}
+
+func (err *HTTPError) parseBody(b []byte) {
+	var body errorBody
+	if json.Unmarshal(b, &body) != nil {
+		return
+	}
+	if code := parseCode(body.ErrorCode); code != "" {
+		err.ErrorCode = code
+	} else if code := parseCode(body.Code); code != "" && err.ErrorCode == "" {
+		err.ErrorCode = code
+	}
+	err.Message = body.Message
+	if err.Message == "" {
+		err.Message = body.Error
+	}
+	// IoT Hub embeds the error code in the message:
+	// "ErrorCode:<code>;<message>"
+	if strings.HasPrefix(err.Message, "ErrorCode:") {
+		idx := strings.Index(err.Message, ";")
+		if idx < 0 {
+			idx = len(err.Message)
+		}
+		err.ErrorCode = strings.TrimPrefix(err.Message[:idx], "ErrorCode:")
+		err.Message = strings.TrimPrefix(err.Message[idx:], ";")
+	}
+	err.TrackingID = body.TrackingID
+	if err.TrackingID == "" {
+		err.TrackingID = body.RequestID
+	}
+	// ... and the tracking ID in the exception message:
+	// "Tracking ID:<id>-TimeStamp:<timestamp>"
+	if idx := strings.Index(body.ExceptionMessage, "Tracking ID:"); idx >= 0 &&
+		err.TrackingID == "" {
+		trackingID := body.ExceptionMessage[idx+len("Tracking ID:"):]
+		if end := strings.Index(trackingID, "-TimeStamp:"); end >= 0 {
+			trackingID = trackingID[:end]
+		}
+		err.TrackingID = strings.TrimSpace(trackingID)
+	}
 }
 
 func (err HTTPError) Error() string {
-	return fmt.Sprintf("iothub: unexpected status code from API: %d", err.Code)
+	var msg strings.Builder
+	if err.Service != "" {
+		msg.WriteString(err.Service + ": ")
+	}
+	fmt.Fprintf(&msg, "unexpected status code from API: %d", err.Code)
+	if err.ErrorCode != "" {
+		msg.WriteString(": " + err.ErrorCode)
+	}
+	if err.Message != "" {
+		msg.WriteString(": " + err.Message)
+	}
+	if err.TrackingID != "" {
+		msg.WriteString(" (tracking ID: " + err.TrackingID + ")")
+	}
+	return msg.String()
 }
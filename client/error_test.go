@@ -0,0 +1,160 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package client
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewHTTPError(t *testing.T) {
+	t.Parallel()
+	testCases := []struct {
+		Name string
+
+		Service string
+		Code    int
+		Header  http.Header
+		Body    string
+
+		Error   HTTPError
+		Message string
+	}{{
+		Name: "iothub",
+
+		Service: "iothub",
+		Code:    http.StatusTooManyRequests,
+		Body: `{"Message":"ErrorCode:IotHubQuotaExceeded;Total number of ` +
+			`messages on IotHub exceeded the allocated quota.",` +
+			`"ExceptionMessage":"Tracking ID:1b7a9bd3ff4e4b5e-G:8-` +
+			`TimeStamp:11/09/2021 12:00:00"}`,
+
+		Error: HTTPError{
+			Code:       http.StatusTooManyRequests,
+			Service:    "iothub",
+			ErrorCode:  "IotHubQuotaExceeded",
+			Message:    "Total number of messages on IotHub exceeded the allocated quota.",
+			TrackingID: "1b7a9bd3ff4e4b5e-G:8",
+		},
+		Message: "iothub: unexpected status code from API: 429: " +
+			"IotHubQuotaExceeded: Total number of messages on IotHub " +
+			"exceeded the allocated quota. (tracking ID: 1b7a9bd3ff4e4b5e-G:8)",
+	}, {
+		Name: "iothub with numeric error code",
+
+		Service: "iothub",
+		Code:    http.StatusForbidden,
+		Body: `{"errorCode":403004,"trackingId":"abc123",` +
+			`"message":"ErrorCode:DeviceMaximumQueueDepthExceeded;` +
+			`Maximum queue depth exceeded",` +
+			`"timestampUtc":"2021-11-09T12:00:00Z"}`,
+
+		Error: HTTPError{
+			Code:       http.StatusForbidden,
+			Service:    "iothub",
+			ErrorCode:  "DeviceMaximumQueueDepthExceeded",
+			Message:    "Maximum queue depth exceeded",
+			TrackingID: "abc123",
+		},
+		Message: "iothub: unexpected status code from API: 403: " +
+			"DeviceMaximumQueueDepthExceeded: Maximum queue depth exceeded " +
+			"(tracking ID: abc123)",
+	}, {
+		Name: "dps",
+
+		Service: "dps",
+		Code:    http.StatusNotFound,
+		Body: `{"errorCode":404201,"trackingId":"def456",` +
+			`"message":"Enrollment group not found."}`,
+
+		Error: HTTPError{
+			Code:       http.StatusNotFound,
+			Service:    "dps",
+			ErrorCode:  "404201",
+			Message:    "Enrollment group not found.",
+			TrackingID: "def456",
+		},
+		Message: "dps: unexpected status code from API: 404: 404201: " +
+			"Enrollment group not found. (tracking ID: def456)",
+	}, {
+		Name: "iotcore",
+
+		Service: "iotcore",
+		Code:    http.StatusNotFound,
+		Header: http.Header{
+			"X-Amzn-Errortype": []string{
+				"ResourceNotFoundException:http://internal.amazon.com/",
+			},
+		},
+		Body: `{"message":"Thing foo cannot be found."}`,
+
+		Error: HTTPError{
+			Code:      http.StatusNotFound,
+			Service:   "iotcore",
+			ErrorCode: "ResourceNotFoundException",
+			Message:   "Thing foo cannot be found.",
+		},
+		Message: "iotcore: unexpected status code from API: 404: " +
+			"ResourceNotFoundException: Thing foo cannot be found.",
+	}, {
+		Name: "workflows",
+
+		Service: "workflows",
+		Code:    http.StatusBadRequest,
+		Body:    `{"error":"missing parameter","request_id":"test"}`,
+
+		Error: HTTPError{
+			Code:       http.StatusBadRequest,
+			Service:    "workflows",
+			Message:    "missing parameter",
+			TrackingID: "test",
+		},
+		Message: "workflows: unexpected status code from API: 400: " +
+			"missing parameter (tracking ID: test)",
+	}, {
+		Name: "malformed body",
+
+		Service: "dps",
+		Code:    http.StatusInternalServerError,
+		Body:    "<html>Internal Server Error</html>",
+
+		Error: HTTPError{
+			Code:    http.StatusInternalServerError,
+			Service: "dps",
+		},
+		Message: "dps: unexpected status code from API: 500",
+	}}
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			rsp := &http.Response{
+				StatusCode: tc.Code,
+				Header:     tc.Header,
+				Body:       io.NopCloser(strings.NewReader(tc.Body)),
+			}
+			if rsp.Header == nil {
+				rsp.Header = http.Header{}
+			}
+			err := NewHTTPError(tc.Service, rsp)
+			assert.Equal(t, tc.Error, err)
+			assert.EqualError(t, err, tc.Message)
+		})
+	}
+}
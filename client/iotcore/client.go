@@ -0,0 +1,501 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package iotcore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	common "github.com/mendersoftware/iot-manager/client"
+	"github.com/mendersoftware/iot-manager/model"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	uriThings             = "/things"
+	uriPolicies           = "/policies"
+	uriTargetPolicies     = "/target-policies"
+	uriCertificates       = "/certificates"
+	uriKeysAndCertificate = "/keys-and-certificate"
+	uriEndpoint           = "/endpoint"
+
+	hdrKeyContentType = "Content-Type"
+	hdrKeyPrincipal   = "X-Amzn-Principal"
+
+	// signingName is the name of the AWS IoT control plane used for
+	// signing requests.
+	signingName = "iot"
+
+	endpointTypeDataATS = "iot:Data-ATS"
+)
+
+func uriThing(name string) string {
+	return uriThings + "/" + awsURIEncode(name)
+}
+
+func uriThingPrincipals(name string) string {
+	return uriThing(name) + "/principals"
+}
+
+func uriPolicy(name string) string {
+	return uriPolicies + "/" + awsURIEncode(name)
+}
+
+func uriTargetPolicy(name string) string {
+	return uriTargetPolicies + "/" + awsURIEncode(name)
+}
+
+func uriCertificate(id string) string {
+	return uriCertificates + "/" + awsURIEncode(id)
+}
+
+// policyName returns the name of the IoT policy attached to the device's
+// certificate.
+func policyName(deviceID string) string {
+	return deviceID + "-policy"
+}
+
+// Client is a client for the AWS IoT Core control plane API.
+//nolint:lll
+//go:generate ../../utils/mockgen.sh
+type Client interface {
+	GetDevice(ctx context.Context, creds *model.AWSCredentials, deviceID string) (*Device, error)
+	// UpsertDevice creates the thing if it does not exist and issues a new
+	// certificate for the device. The certificate is attached to the thing
+	// and to the device policy (creds.PolicyDocument or
+	// DefaultPolicyDocument). The returned Device contains the PEM encoded
+	// certificate and private key. The certificates previously attached to
+	// the thing are revoked, the new certificate is deleted if the device
+	// cannot be provisioned.
+	UpsertDevice(ctx context.Context, creds *model.AWSCredentials, deviceID string) (*Device, error)
+	// SetDeviceStatus activates or deactivates the certificates attached
+	// to the thing.
+	SetDeviceStatus(ctx context.Context, creds *model.AWSCredentials, deviceID string, status Status) error
+	// DeleteDevice deletes the thing, its certificates and its policy.
+	DeleteDevice(ctx context.Context, creds *model.AWSCredentials, deviceID string) error
+}
+
+type client struct {
+	*http.Client
+	endpoint string
+}
+
+type Options struct {
+	Client *http.Client
+	// Endpoint overrides the regional API endpoint
+	// (https://iot.<region>.amazonaws.com).
+	Endpoint string
+}
+
+func NewOptions(opts ...*Options) *Options {
+	opt := new(Options)
+	for _, o := range opts {
+		if o == nil {
+			continue
+		}
+		if o.Client != nil {
+			opt.Client = o.Client
+		}
+		if o.Endpoint != "" {
+			opt.Endpoint = o.Endpoint
+		}
+	}
+	return opt
+}
+
+func (opt *Options) SetClient(client *http.Client) *Options {
+	opt.Client = client
+	return opt
+}
+
+func (opt *Options) SetEndpoint(endpoint string) *Options {
+	opt.Endpoint = endpoint
+	return opt
+}
+
+func NewClient(options ...*Options) Client {
+	opts := NewOptions(options...)
+	if opts.Client == nil {
+		opts.Client = new(http.Client)
+	}
+	return &client{
+		Client:   opts.Client,
+		endpoint: strings.TrimRight(opts.Endpoint, "/"),
+	}
+}
+
+type request struct {
+	Method string
+	Path   string
+	Query  url.Values
+	Header http.Header
+	Body   interface{}
+}
+
+func (c *client) NewRequestWithContext(
+	ctx context.Context,
+	creds *model.AWSCredentials,
+	r request,
+) (*http.Request, error) {
+	if creds == nil {
+		return nil, errors.New("missing credentials")
+	}
+	if err := creds.Validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid credentials")
+	}
+	endpoint := c.endpoint
+	if endpoint == "" {
+		endpoint = "https://iot." + creds.Region + ".amazonaws.com"
+	}
+	uri := endpoint + r.Path
+	if len(r.Query) > 0 {
+		uri += "?" + r.Query.Encode()
+	}
+	var body []byte
+	if r.Body != nil {
+		body, _ = json.Marshal(r.Body)
+	}
+	req, err := http.NewRequestWithContext(ctx, r.Method, uri, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range r.Header {
+		req.Header[key] = values
+	}
+	if r.Body != nil {
+		req.Header.Set(hdrKeyContentType, "application/json")
+	}
+	signRequest(req, body, creds, signingName, time.Now())
+	return req, nil
+}
+
+// do executes the request and decodes the response body into v (if not nil).
+func (c *client) do(
+	ctx context.Context,
+	creds *model.AWSCredentials,
+	r request,
+	v interface{},
+) error {
+	req, err := c.NewRequestWithContext(ctx, creds, r)
+	if err != nil {
+		return errors.Wrap(err, "iotcore: failed to prepare request")
+	}
+	rsp, err := c.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "iotcore: failed to execute request")
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode >= 400 {
+		return common.NewHTTPError("iotcore", rsp)
+	}
+	if v == nil {
+		return nil
+	}
+	dec := json.NewDecoder(rsp.Body)
+	if err = dec.Decode(v); err != nil {
+		return errors.Wrap(err, "iotcore: failed to decode API response")
+	}
+	return nil
+}
+
+func isStatus(err error, code int) bool {
+	htErr, ok := errors.Cause(err).(common.HTTPError)
+	return ok && htErr.Code == code
+}
+
+func (c *client) getPrincipals(
+	ctx context.Context,
+	creds *model.AWSCredentials,
+	deviceID string,
+) ([]string, error) {
+	var rsp principals
+	err := c.do(ctx, creds, request{
+		Method: http.MethodGet,
+		Path:   uriThingPrincipals(deviceID),
+	}, &rsp)
+	return rsp.Principals, err
+}
+
+func (c *client) GetDevice(
+	ctx context.Context,
+	creds *model.AWSCredentials,
+	deviceID string,
+) (*Device, error) {
+	var thing thing
+	err := c.do(ctx, creds, request{
+		Method: http.MethodGet,
+		Path:   uriThing(deviceID),
+	}, &thing)
+	if err != nil {
+		return nil, err
+	}
+	dev := &Device{
+		ID:     thing.Name,
+		ARN:    thing.ARN,
+		Status: StatusDisabled,
+	}
+	principals, err := c.getPrincipals(ctx, creds, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	for _, principal := range principals {
+		certID := certificateIDFromARN(principal)
+		if certID == "" {
+			continue
+		}
+		var cert certificateDescription
+		err = c.do(ctx, creds, request{
+			Method: http.MethodGet,
+			Path:   uriCertificate(certID),
+		}, &cert)
+		if err != nil {
+			return nil, err
+		}
+		dev.CertificateID = cert.Description.CertificateID
+		dev.CertificateARN = cert.Description.CertificateARN
+		if cert.Description.Status == certificateStatusActive {
+			dev.Status = StatusEnabled
+			break
+		}
+	}
+	return dev, nil
+}
+
+func (c *client) UpsertDevice(
+	ctx context.Context,
+	creds *model.AWSCredentials,
+	deviceID string,
+) (*Device, error) {
+	var thing thing
+	err := c.do(ctx, creds, request{
+		Method: http.MethodPost,
+		Path:   uriThing(deviceID),
+		Body:   struct{}{},
+	}, &thing)
+	if err != nil {
+		return nil, err
+	}
+	// The principals of a device provisioned before are revoked once the
+	// new certificate is attached.
+	previous, err := c.getPrincipals(ctx, creds, deviceID)
+	if err != nil {
+		return nil, err
+	}
+
+	policyDocument := DefaultPolicyDocument
+	if creds.PolicyDocument != "" {
+		policyDocument = creds.PolicyDocument
+	}
+	err = c.do(ctx, creds, request{
+		Method: http.MethodPost,
+		Path:   uriPolicy(policyName(deviceID)),
+		Body: map[string]string{
+			"policyDocument": policyDocument,
+		},
+	}, nil)
+	if err != nil && !isStatus(err, http.StatusConflict) {
+		return nil, err
+	}
+
+	var keys keysAndCertificate
+	err = c.do(ctx, creds, request{
+		Method: http.MethodPost,
+		Path:   uriKeysAndCertificate,
+		Query:  url.Values{"setAsActive": []string{"true"}},
+	}, &keys)
+	if err != nil {
+		return nil, err
+	}
+	dev, err := c.attachCertificate(ctx, creds, deviceID, keys, previous)
+	if err != nil {
+		// Do not leave an active certificate nobody holds the key of.
+		_ = c.revokePrincipal(ctx, creds, deviceID, keys.CertificateARN)
+		return nil, err
+	}
+	dev.ID = thing.Name
+	dev.ARN = thing.ARN
+	return dev, nil
+}
+
+// attachCertificate attaches the new certificate to the device policy and
+// the thing, and revokes the previous principals of the thing.
+func (c *client) attachCertificate(
+	ctx context.Context,
+	creds *model.AWSCredentials,
+	deviceID string,
+	keys keysAndCertificate,
+	previous []string,
+) (*Device, error) {
+	err := c.do(ctx, creds, request{
+		Method: http.MethodPut,
+		Path:   uriTargetPolicy(policyName(deviceID)),
+		Body: map[string]string{
+			"target": keys.CertificateARN,
+		},
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = c.do(ctx, creds, request{
+		Method: http.MethodPut,
+		Path:   uriThingPrincipals(deviceID),
+		Header: http.Header{hdrKeyPrincipal: []string{keys.CertificateARN}},
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var endpoint endpoint
+	err = c.do(ctx, creds, request{
+		Method: http.MethodGet,
+		Path:   uriEndpoint,
+		Query:  url.Values{"endpointType": []string{endpointTypeDataATS}},
+	}, &endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, principal := range previous {
+		err = c.revokePrincipal(ctx, creds, deviceID, principal)
+		if err != nil {
+			return nil, errors.Wrap(err, "iotcore: failed to revoke previous certificate")
+		}
+	}
+	return &Device{
+		CertificateID:  keys.CertificateID,
+		CertificateARN: keys.CertificateARN,
+		Certificate:    keys.CertificatePEM,
+		PrivateKey:     keys.KeyPair.PrivateKey,
+		Endpoint:       endpoint.Address,
+		Status:         StatusEnabled,
+	}, nil
+}
+
+// revokePrincipal detaches the principal from the thing and, if it is a
+// certificate, deactivates and deletes the certificate. Principals that do
+// not exist are considered revoked.
+func (c *client) revokePrincipal(
+	ctx context.Context,
+	creds *model.AWSCredentials,
+	deviceID string,
+	principal string,
+) error {
+	err := c.do(ctx, creds, request{
+		Method: http.MethodDelete,
+		Path:   uriThingPrincipals(deviceID),
+		Header: http.Header{hdrKeyPrincipal: []string{principal}},
+	}, nil)
+	if err != nil && !isStatus(err, http.StatusNotFound) {
+		return err
+	}
+	certID := certificateIDFromARN(principal)
+	if certID == "" {
+		return nil
+	}
+	// Certificates must be deactivated before they can be deleted,
+	// forceDelete detaches the policies from the certificate.
+	err = c.setCertificateStatus(ctx, creds, certID, StatusDisabled)
+	if err != nil && !isStatus(err, http.StatusNotFound) {
+		return err
+	}
+	err = c.do(ctx, creds, request{
+		Method: http.MethodDelete,
+		Path:   uriCertificate(certID),
+		Query:  url.Values{"forceDelete": []string{"true"}},
+	}, nil)
+	if err != nil && !isStatus(err, http.StatusNotFound) {
+		return err
+	}
+	return nil
+}
+
+func (c *client) setCertificateStatus(
+	ctx context.Context,
+	creds *model.AWSCredentials,
+	certID string,
+	status Status,
+) error {
+	return c.do(ctx, creds, request{
+		Method: http.MethodPut,
+		Path:   uriCertificate(certID),
+		Query:  url.Values{"newStatus": []string{status.certificateStatus()}},
+	}, nil)
+}
+
+func (c *client) SetDeviceStatus(
+	ctx context.Context,
+	creds *model.AWSCredentials,
+	deviceID string,
+	status Status,
+) error {
+	if err := status.Validate(); err != nil {
+		return errors.Wrap(err, "iotcore: invalid status")
+	}
+	principals, err := c.getPrincipals(ctx, creds, deviceID)
+	if err != nil {
+		return err
+	}
+	for _, principal := range principals {
+		certID := certificateIDFromARN(principal)
+		if certID == "" {
+			continue
+		}
+		err = c.setCertificateStatus(ctx, creds, certID, status)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *client) DeleteDevice(
+	ctx context.Context,
+	creds *model.AWSCredentials,
+	deviceID string,
+) error {
+	principals, err := c.getPrincipals(ctx, creds, deviceID)
+	if isStatus(err, http.StatusNotFound) {
+		principals = nil
+	} else if err != nil {
+		return err
+	}
+	for _, principal := range principals {
+		err = c.revokePrincipal(ctx, creds, deviceID, principal)
+		if err != nil {
+			return err
+		}
+	}
+	err = c.do(ctx, creds, request{
+		Method: http.MethodDelete,
+		Path:   uriPolicy(policyName(deviceID)),
+	}, nil)
+	if err != nil && !isStatus(err, http.StatusNotFound) {
+		return err
+	}
+	err = c.do(ctx, creds, request{
+		Method: http.MethodDelete,
+		Path:   uriThing(deviceID),
+	}, nil)
+	if err != nil && !isStatus(err, http.StatusNotFound) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package iotcore
+
+import (
+	"strings"
+
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+)
+
+// DefaultPolicyDocument allows devices to connect using the thing name as
+// client ID and to use the topics reserved for the thing.
+//nolint:lll
+const DefaultPolicyDocument = `{
+  "Version": "2012-10-17",
+  "Statement": [{
+    "Effect": "Allow",
+    "Action": ["iot:Connect"],
+    "Resource": ["arn:aws:iot:*:*:client/${iot:Connection.Thing.ThingName}"]
+  }, {
+    "Effect": "Allow",
+    "Action": ["iot:Publish", "iot:Receive"],
+    "Resource": ["arn:aws:iot:*:*:topic/$aws/things/${iot:Connection.Thing.ThingName}/*"]
+  }, {
+    "Effect": "Allow",
+    "Action": ["iot:Subscribe"],
+    "Resource": ["arn:aws:iot:*:*:topicfilter/$aws/things/${iot:Connection.Thing.ThingName}/*"]
+  }]
+}`
+
+type Status string
+
+const (
+	StatusEnabled  Status = "enabled"
+	StatusDisabled Status = "disabled"
+)
+
+var validateStatus = validation.In(
+	StatusEnabled,
+	StatusDisabled,
+)
+
+func (s Status) Validate() error {
+	return validateStatus.Validate(s)
+}
+
+const (
+	certificateStatusActive   = "ACTIVE"
+	certificateStatusInactive = "INACTIVE"
+)
+
+func (s Status) certificateStatus() string {
+	if s == StatusEnabled {
+		return certificateStatusActive
+	}
+	return certificateStatusInactive
+}
+
+// Device is a thing in the AWS IoT registry together with the certificate
+// attached to it.
+type Device struct {
+	// ID is the thing name.
+	ID             string `json:"id"`
+	ARN            string `json:"arn,omitempty"`
+	CertificateID  string `json:"certificate_id,omitempty"`
+	CertificateARN string `json:"certificate_arn,omitempty"`
+	// Certificate and PrivateKey are the PEM encoded device certificate
+	// and private key, only set when the device certificate is created.
+	Certificate string `json:"-"`
+	PrivateKey  string `json:"-"`
+	// Endpoint is the address of the data endpoint devices connect to.
+	Endpoint string `json:"endpoint,omitempty"`
+	Status   Status `json:"status,omitempty"`
+}
+
+// API response schemas
+
+type thing struct {
+	Name string `json:"thingName"`
+	ARN  string `json:"thingArn"`
+}
+
+type keysAndCertificate struct {
+	CertificateARN string `json:"certificateArn"`
+	CertificateID  string `json:"certificateId"`
+	CertificatePEM string `json:"certificatePem"`
+	KeyPair        struct {
+		PrivateKey string `json:"PrivateKey"`
+		PublicKey  string `json:"PublicKey"`
+	} `json:"keyPair"`
+}
+
+type certificateDescription struct {
+	Description struct {
+		CertificateARN string `json:"certificateArn"`
+		CertificateID  string `json:"certificateId"`
+		Status         string `json:"status"`
+	} `json:"certificateDescription"`
+}
+
+type principals struct {
+	Principals []string `json:"principals"`
+}
+
+type endpoint struct {
+	Address string `json:"endpointAddress"`
+}
+
+// certificateIDFromARN returns the certificate ID of certificate ARNs
+// (arn:aws:iot:<region>:<account>:cert/<certificate ID>) and an empty
+// string for other principals.
+func certificateIDFromARN(arn string) string {
+	const certPrefix = ":cert/"
+	idx := strings.LastIndex(arn, certPrefix)
+	if idx < 0 {
+		return ""
+	}
+	return arn[idx+len(certPrefix):]
+}
@@ -21,6 +21,7 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -35,6 +36,10 @@ const (
 	uriTwin      = "/twins"
 	uriDevices   = "/devices"
 	uriQueryTwin = uriDevices + "/query"
+	uriJobs      = "/jobs/v2"
+	uriQueryJobs = uriJobs + "/query"
+
+	uriConfigurations = "/configurations"
 
 	hdrKeyContentType = "Content-Type"
 	hdrKeyContToken   = "X-Ms-Continuation"
@@ -48,10 +53,42 @@ func uriDevice(id string) string {
 	return uriDevices + "/" + url.QueryEscape(id)
 }
 
+func uriModule(id, moduleID string) string {
+	return uriDevice(id) + "/modules/" + url.QueryEscape(moduleID)
+}
+
+func uriModuleTwin(id, moduleID string) string {
+	return uriTwin + "/" + url.QueryEscape(id) +
+		"/modules/" + url.QueryEscape(moduleID)
+}
+
+func uriJob(id string) string {
+	return uriJobs + "/" + url.QueryEscape(id)
+}
+
+func uriConfiguration(id string) string {
+	return uriConfigurations + "/" + url.QueryEscape(id)
+}
+
+func uriDeviceMethods(id string) string {
+	return uriTwin + "/" + url.QueryEscape(id) + "/methods"
+}
+
+func uriModuleMethods(id, moduleID string) string {
+	return uriTwin + "/" + url.QueryEscape(id) +
+		"/modules/" + url.QueryEscape(moduleID) + "/methods"
+}
+
 const (
 	defaultTTL = time.Minute
 )
 
+var (
+	ErrTooManyBulkDevices = errors.New(
+		"iothub: too many devices in bulk request",
+	)
+)
+
 const (
 	hdrKeyAuthorization = "Authorization"
 )
@@ -59,7 +96,13 @@ const (
 //nolint:lll
 //go:generate ../../utils/mockgen.sh
 type Client interface {
-	GetDeviceTwins(ctx context.Context, cs *model.ConnectionString) (Cursor, error)
+	// GetDeviceTwins returns a cursor over the device twins matching the
+	// query, or over all device twins if q is nil.
+	GetDeviceTwins(ctx context.Context, cs *model.ConnectionString, q *Query) (Cursor, error)
+	// QueryDeviceTwins returns a page of the result of the query. The page
+	// starts at the continuation token of the previous page, or at the
+	// first device if the token is empty.
+	QueryDeviceTwins(ctx context.Context, cs *model.ConnectionString, q *Query, contToken string) (*QueryPage, error)
 	GetDeviceTwin(ctx context.Context, cs *model.ConnectionString, id string) (*DeviceTwin, error)
 	UpdateDeviceTwin(ctx context.Context, cs *model.ConnectionString, id string, r *DeviceTwinUpdate) error
 
@@ -79,14 +122,73 @@ type Client interface {
 	// }.String()
 	UpsertDevice(ctx context.Context, cs *model.ConnectionString, id string, deviceUpdate ...*Device) (*Device, error)
 	DeleteDevice(ctx context.Context, cs *model.ConnectionString, id string) error
+	// BulkDevices applies up to MaxBulkDevices operations with a single
+	// request to the bulk registry API. The operations that failed are
+	// listed in the result; the request fails only if none was applied.
+	BulkDevices(ctx context.Context, cs *model.ConnectionString, devices []*BulkDevice) (*BulkResult, error)
+
+	GetModules(ctx context.Context, cs *model.ConnectionString, id string) ([]Module, error)
+	GetModule(ctx context.Context, cs *model.ConnectionString, id, moduleID string) (*Module, error)
+	// UpsertModule creates or updates the module of the device. If the
+	// module is created without authentication, the IoT Hub generates the
+	// primary and secondary keys of the module connection strings. If the
+	// module has an ETag, the update fails if the module changed.
+	UpsertModule(ctx context.Context, cs *model.ConnectionString, id, moduleID string, module *Module) (*Module, error)
+	DeleteModule(ctx context.Context, cs *model.ConnectionString, id, moduleID string) error
+	GetModuleTwin(ctx context.Context, cs *model.ConnectionString, id, moduleID string) (*DeviceTwin, error)
+	UpdateModuleTwin(ctx context.Context, cs *model.ConnectionString, id, moduleID string, r *DeviceTwinUpdate) error
+
+	// InvokeDeviceMethod invokes a direct method on the device and returns
+	// the result returned by the device.
+	InvokeDeviceMethod(ctx context.Context, cs *model.ConnectionString, id string, method *DirectMethod) (*MethodResult, error)
+	// InvokeModuleMethod invokes a direct method on a module of the device.
+	InvokeModuleMethod(ctx context.Context, cs *model.ConnectionString, id, moduleID string, method *DirectMethod) (*MethodResult, error)
+
+	// ScheduleJob schedules a twin update or a direct method invocation on
+	// the devices matching the query condition of the job.
+	ScheduleJob(ctx context.Context, cs *model.ConnectionString, job *Job) (*Job, error)
+	GetJob(ctx context.Context, cs *model.ConnectionString, id string) (*Job, error)
+	CancelJob(ctx context.Context, cs *model.ConnectionString, id string) (*Job, error)
+	// QueryJobs returns a page of the jobs matching the filter. The page
+	// starts at the continuation token of the previous page, or at the
+	// first job if the token is empty.
+	QueryJobs(ctx context.Context, cs *model.ConnectionString, fltr JobFilter, contToken string) (*JobsPage, error)
+
+	// ApplyConfigurationContent applies the configuration content, e.g. an
+	// IoT Edge deployment manifest, to a single device.
+	ApplyConfigurationContent(ctx context.Context, cs *model.ConnectionString, id string, content *ConfigurationContent) error
+	// GetConfigurations returns up to top configurations, or up to
+	// MaxConfigurationsCount if top is zero.
+	GetConfigurations(ctx context.Context, cs *model.ConnectionString, top int) ([]Configuration, error)
+	GetConfiguration(ctx context.Context, cs *model.ConnectionString, id string) (*Configuration, error)
+	// UpsertConfiguration creates or updates the configuration. If the
+	// configuration has an ETag, the update fails if the configuration
+	// changed.
+	UpsertConfiguration(ctx context.Context, cs *model.ConnectionString, config *Configuration) (*Configuration, error)
+	// DeleteConfiguration deletes the configuration, if etag is not empty
+	// the configuration is deleted only if it did not change.
+	DeleteConfiguration(ctx context.Context, cs *model.ConnectionString, id, etag string) error
 }
 
 type client struct {
 	*http.Client
+
+	maxRetries int
+	minBackoff time.Duration
+	maxBackoff time.Duration
 }
 
 type Options struct {
 	Client *http.Client
+
+	// MaxRetries is the maximum number of times an idempotent request is
+	// retried after being throttled or failing with a transient error.
+	MaxRetries *int
+	// MinBackoff is the delay before the first retry, the delay doubles
+	// for every subsequent retry.
+	MinBackoff *time.Duration
+	// MaxBackoff is the upper bound of the delay between retries.
+	MaxBackoff *time.Duration
 }
 
 func NewOptions(opts ...*Options) *Options {
@@ -98,6 +200,15 @@ func NewOptions(opts ...*Options) *Options {
 		if o.Client != nil {
 			opt.Client = o.Client
 		}
+		if o.MaxRetries != nil {
+			opt.MaxRetries = o.MaxRetries
+		}
+		if o.MinBackoff != nil {
+			opt.MinBackoff = o.MinBackoff
+		}
+		if o.MaxBackoff != nil {
+			opt.MaxBackoff = o.MaxBackoff
+		}
 	}
 	return opt
 }
@@ -107,14 +218,41 @@ func (opt *Options) SetClient(client *http.Client) *Options {
 	return opt
 }
 
+func (opt *Options) SetMaxRetries(retries int) *Options {
+	opt.MaxRetries = &retries
+	return opt
+}
+
+func (opt *Options) SetBackoff(min, max time.Duration) *Options {
+	opt.MinBackoff = &min
+	opt.MaxBackoff = &max
+	return opt
+}
+
 func NewClient(options ...*Options) Client {
 	opts := NewOptions(options...)
-	if opts.Client == nil {
-		opts.Client = new(http.Client)
+	c := &client{
+		Client:     opts.Client,
+		maxRetries: defaultMaxRetries,
+		minBackoff: defaultMinBackoff,
+		maxBackoff: defaultMaxBackoff,
+	}
+	if c.Client == nil {
+		c.Client = new(http.Client)
+	}
+	if opts.MaxRetries != nil {
+		c.maxRetries = *opts.MaxRetries
 	}
-	return &client{
-		Client: opts.Client,
+	if opts.MinBackoff != nil {
+		c.minBackoff = *opts.MinBackoff
 	}
+	if opts.MaxBackoff != nil {
+		c.maxBackoff = *opts.MaxBackoff
+	}
+	if c.maxBackoff < c.minBackoff {
+		c.maxBackoff = c.minBackoff
+	}
+	return c
 }
 
 func (c *client) NewRequestWithContext(
@@ -134,6 +272,8 @@ func (c *client) NewRequestWithContext(
 		strings.TrimPrefix(urlPath, "/")
 	if idx := strings.IndexRune(uri, '?'); idx < 0 {
 		uri += "?"
+	} else {
+		uri += "&"
 	}
 	uri += "api-version=" + APIVersion
 	req, err := http.NewRequestWithContext(ctx, method, uri, body)
@@ -146,13 +286,7 @@ func (c *client) NewRequestWithContext(
 	// Ensure that we set the correct Host header (in case GatewayHostName is set)
 	req.Host = cs.HostName
 
-	var expireAt time.Time
-	if dl, ok := ctx.Deadline(); ok {
-		expireAt = dl
-	} else {
-		expireAt = time.Now().Add(defaultTTL)
-	}
-	req.Header.Set(hdrKeyAuthorization, cs.Authorization(expireAt))
+	setAuthorization(req, cs)
 
 	return req, err
 }
@@ -174,13 +308,13 @@ func (c *client) GetDevice(
 	if err != nil {
 		return nil, errors.Wrap(err, "iothub: failed to prepare request")
 	}
-	rsp, err := c.Do(req)
+	rsp, err := c.do(req, cs, true)
 	if err != nil {
 		return nil, errors.Wrap(err, "iothub: failed to execute request")
 	}
 	defer rsp.Body.Close()
 	if rsp.StatusCode >= 400 {
-		return nil, common.HTTPError{Code: rsp.StatusCode}
+		return nil, common.NewHTTPError("iothub", rsp)
 	}
 	dec := json.NewDecoder(rsp.Body)
 	if err = dec.Decode(dev); err != nil {
@@ -212,13 +346,15 @@ func (c *client) UpsertDevice(ctx context.Context,
 	if etag != "" {
 		req.Header.Set("If-Match", `"`+etag+`"`)
 	}
-	rsp, err := c.Do(req)
+	// Without an ETag, a retried create could fail with a conflict if
+	// the first attempt succeeded.
+	rsp, err := c.do(req, cs, etag != "")
 	if err != nil {
 		return nil, errors.Wrap(err, "iothub: failed to execute request")
 	}
 	defer rsp.Body.Close()
 	if rsp.StatusCode >= 400 {
-		return nil, common.HTTPError{Code: rsp.StatusCode}
+		return nil, common.NewHTTPError("iothub", rsp)
 	}
 	dec := json.NewDecoder(rsp.Body)
 	if err = dec.Decode(dev); err != nil {
@@ -238,34 +374,138 @@ func (c *client) DeleteDevice(ctx context.Context, cs *model.ConnectionString, i
 		return errors.Wrap(err, "iothub: failed to prepare request")
 	}
 	req.Header.Set("If-Match", "*")
-	rsp, err := c.Do(req)
+	rsp, err := c.do(req, cs, true)
 	if err != nil {
 		return errors.Wrap(err, "iothub: failed to execute request")
 	}
 	defer rsp.Body.Close()
 	if rsp.StatusCode >= 400 {
-		return common.HTTPError{Code: rsp.StatusCode}
+		return common.NewHTTPError("iothub", rsp)
 	}
 	return nil
 }
 
+// POST /devices
+func (c *client) BulkDevices(
+	ctx context.Context,
+	cs *model.ConnectionString,
+	devices []*BulkDevice,
+) (*BulkResult, error) {
+	if len(devices) > MaxBulkDevices {
+		return nil, ErrTooManyBulkDevices
+	}
+	// Retrying a partially applied request would fail the devices created
+	// by the first attempt with a conflict.
+	idempotent := true
+	for _, dev := range devices {
+		if dev.ImportMode == ImportModeCreate {
+			idempotent = false
+			break
+		}
+	}
+	b, _ := json.Marshal(devices)
+	req, err := c.NewRequestWithContext(
+		ctx,
+		cs,
+		http.MethodPost,
+		uriDevices,
+		bytes.NewReader(b),
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "iothub: failed to prepare request")
+	}
+	rsp, err := c.do(req, cs, idempotent)
+	if err != nil {
+		return nil, errors.Wrap(err, "iothub: failed to execute request")
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode >= 400 && rsp.StatusCode != http.StatusBadRequest {
+		return nil, common.NewHTTPError("iothub", rsp)
+	}
+	body, err := io.ReadAll(rsp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "iothub: failed to read response")
+	}
+	res := new(BulkResult)
+	errDecode := json.Unmarshal(body, res)
+	// The hub responds with 400 both if some of the operations failed and
+	// if the request was rejected as a whole.
+	if rsp.StatusCode == http.StatusBadRequest && len(res.Errors) == 0 {
+		rsp.Body = io.NopCloser(bytes.NewReader(body))
+		return nil, common.NewHTTPError("iothub", rsp)
+	} else if errDecode != nil {
+		return nil, errors.Wrap(errDecode, "iothub: failed to decode bulk result")
+	}
+	return res, nil
+}
+
 func (c *client) GetDeviceTwins(
-	ctx context.Context, cs *model.ConnectionString,
+	ctx context.Context,
+	cs *model.ConnectionString,
+	q *Query,
 ) (Cursor, error) {
-	const (
-		SQLQuery              = `{"query":"SELECT * FROM devices"}`
-		pageSize, pageSizeStr = 100, "100"
+	return c.queryDeviceTwins(ctx, cs, q, "")
+}
+
+func (c *client) QueryDeviceTwins(
+	ctx context.Context,
+	cs *model.ConnectionString,
+	q *Query,
+	contToken string,
+) (*QueryPage, error) {
+	cur, err := c.queryDeviceTwins(ctx, cs, q, contToken)
+	if err != nil {
+		return nil, err
+	}
+	page := &QueryPage{
+		Items: []json.RawMessage{},
+	}
+	for cur.dec.More() {
+		var item json.RawMessage
+		if err = cur.dec.Decode(&item); err != nil {
+			return nil, errors.Wrap(err, "iothub: failed to decode query result")
+		}
+		page.Items = append(page.Items, item)
+	}
+	page.ContinuationToken = cur.req.Header.Get(hdrKeyContToken)
+	return page, nil
+}
+
+// queryDeviceTwins returns a cursor over the result of the query, with the
+// page starting at contToken already fetched.
+func (c *client) queryDeviceTwins(
+	ctx context.Context,
+	cs *model.ConnectionString,
+	q *Query,
+	contToken string,
+) (*cursor, error) {
+	if q == nil {
+		q = NewQuery()
+	}
+	if err := q.Validate(); err != nil {
+		return nil, errors.Wrap(err, "iothub: invalid query")
+	}
+	pageSize := q.PageSize
+	if pageSize == 0 {
+		pageSize = MaxQueryPageSize
+	}
+	b, _ := json.Marshal(struct {
+		Query string `json:"query"`
+	}{Query: q.String()})
+	req, err := c.NewRequestWithContext(ctx, cs,
+		http.MethodPost, uriQueryTwin, bytes.NewReader(b),
 	)
-	q := bytes.NewReader([]byte(SQLQuery))
-	req, err := c.NewRequestWithContext(ctx, cs, http.MethodPost, uriQueryTwin, q)
 	if err != nil {
 		return nil, errors.Wrap(err, "iothub: failed to prepare request")
 	}
-	req.Header.Set(hdrKeyCount, pageSizeStr)
+	req.Header.Set(hdrKeyCount, strconv.Itoa(pageSize))
+	if contToken != "" {
+		req.Header.Set(hdrKeyContToken, contToken)
+	}
 
 	cur := &cursor{
 		mut:    new(sync.Mutex),
-		client: c.Client,
+		client: c,
 		req:    req,
 		cs:     cs,
 	}
@@ -281,28 +521,32 @@ func (c *client) GetDeviceTwin(
 	cs *model.ConnectionString,
 	id string,
 ) (*DeviceTwin, error) {
-	uri := uriTwin + "/" + id
+	return c.getTwin(ctx, cs, uriTwin+"/"+id)
+}
+
+func (c *client) getTwin(
+	ctx context.Context,
+	cs *model.ConnectionString,
+	uri string,
+) (*DeviceTwin, error) {
 	req, err := c.NewRequestWithContext(ctx, cs, http.MethodGet, uri, nil)
 	if err != nil {
 		return nil, errors.Wrap(err, "iothub: failed to prepare request")
 	}
 
-	rsp, err := c.Do(req)
+	rsp, err := c.do(req, cs, true)
 	if err != nil {
 		return nil, errors.Wrap(err, "iothub: failed to fetch device twin")
 	}
 	defer rsp.Body.Close()
 	if rsp.StatusCode >= 400 {
-		return nil, common.HTTPError{
-			Code: rsp.StatusCode,
-		}
+		return nil, common.NewHTTPError("iothub", rsp)
 	}
 	twin := new(DeviceTwin)
 	dec := json.NewDecoder(rsp.Body)
 	if err = dec.Decode(twin); err != nil {
 		return nil, errors.Wrap(err, "iothub: failed to decode API response")
 	}
-	rsp.Header.Get("x-ms-continuation")
 	return twin, nil
 }
 
@@ -311,6 +555,15 @@ func (c *client) UpdateDeviceTwin(
 	cs *model.ConnectionString,
 	id string,
 	r *DeviceTwinUpdate,
+) error {
+	return c.updateTwin(ctx, cs, uriTwin+"/"+id, r)
+}
+
+func (c *client) updateTwin(
+	ctx context.Context,
+	cs *model.ConnectionString,
+	uri string,
+	r *DeviceTwinUpdate,
 ) error {
 	method := http.MethodPatch
 	if r.Replace {
@@ -319,20 +572,490 @@ func (c *client) UpdateDeviceTwin(
 
 	b, _ := json.Marshal(r)
 
-	req, err := c.NewRequestWithContext(ctx, cs, method, uriTwin+"/"+id, bytes.NewReader(b))
+	req, err := c.NewRequestWithContext(ctx, cs, method, uri, bytes.NewReader(b))
 	if err != nil {
 		return errors.Wrap(err, "iothub: failed to prepare request")
 	}
-	rsp, err := c.Do(req)
+	rsp, err := c.do(req, cs, true)
 	if err != nil {
 		return errors.Wrap(err, "iothub: failed to submit device twin update")
 	}
 	defer rsp.Body.Close()
 
 	if rsp.StatusCode >= 400 {
-		return common.HTTPError{
-			Code: rsp.StatusCode,
-		}
+		return common.NewHTTPError("iothub", rsp)
+	}
+	return nil
+}
+
+// GET /devices/{id}/modules
+func (c *client) GetModules(
+	ctx context.Context,
+	cs *model.ConnectionString,
+	id string,
+) ([]Module, error) {
+	req, err := c.NewRequestWithContext(ctx,
+		cs, http.MethodGet, uriDevice(id)+"/modules", nil,
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "iothub: failed to prepare request")
+	}
+	rsp, err := c.do(req, cs, true)
+	if err != nil {
+		return nil, errors.Wrap(err, "iothub: failed to execute request")
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode >= 400 {
+		return nil, common.NewHTTPError("iothub", rsp)
+	}
+	var modules []Module
+	dec := json.NewDecoder(rsp.Body)
+	if err = dec.Decode(&modules); err != nil {
+		return nil, errors.Wrap(err, "iothub: failed to decode modules")
+	}
+	return modules, nil
+}
+
+// GET /devices/{id}/modules/{moduleId}
+func (c *client) GetModule(
+	ctx context.Context,
+	cs *model.ConnectionString,
+	id, moduleID string,
+) (*Module, error) {
+	req, err := c.NewRequestWithContext(ctx,
+		cs, http.MethodGet, uriModule(id, moduleID), nil,
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "iothub: failed to prepare request")
+	}
+	rsp, err := c.do(req, cs, true)
+	if err != nil {
+		return nil, errors.Wrap(err, "iothub: failed to execute request")
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode >= 400 {
+		return nil, common.NewHTTPError("iothub", rsp)
+	}
+	module := new(Module)
+	dec := json.NewDecoder(rsp.Body)
+	if err = dec.Decode(module); err != nil {
+		return nil, errors.Wrap(err, "iothub: failed to decode module")
+	}
+	return module, nil
+}
+
+// PUT /devices/{id}/modules/{moduleId}
+func (c *client) UpsertModule(
+	ctx context.Context,
+	cs *model.ConnectionString,
+	id, moduleID string,
+	module *Module,
+) (*Module, error) {
+	mod := new(Module)
+	if module != nil {
+		*mod = *module
+	}
+	mod.DeviceID = id
+	mod.ModuleID = moduleID
+	etag := mod.ETag
+	mod.ETag = ""
+	b, _ := json.Marshal(mod)
+	req, err := c.NewRequestWithContext(ctx,
+		cs, http.MethodPut, uriModule(id, moduleID), bytes.NewReader(b),
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "iothub: failed to prepare request")
+	}
+	if etag != "" {
+		req.Header.Set("If-Match", `"`+etag+`"`)
+	}
+	// Without an ETag, a retried create could fail with a conflict if
+	// the first attempt succeeded.
+	rsp, err := c.do(req, cs, etag != "")
+	if err != nil {
+		return nil, errors.Wrap(err, "iothub: failed to execute request")
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode >= 400 {
+		return nil, common.NewHTTPError("iothub", rsp)
+	}
+	updated := new(Module)
+	dec := json.NewDecoder(rsp.Body)
+	if err = dec.Decode(updated); err != nil {
+		return nil, errors.Wrap(err, "iothub: failed to decode updated module")
+	}
+	return updated, nil
+}
+
+// DELETE /devices/{id}/modules/{moduleId}
+func (c *client) DeleteModule(
+	ctx context.Context,
+	cs *model.ConnectionString,
+	id, moduleID string,
+) error {
+	req, err := c.NewRequestWithContext(ctx,
+		cs, http.MethodDelete, uriModule(id, moduleID), nil,
+	)
+	if err != nil {
+		return errors.Wrap(err, "iothub: failed to prepare request")
+	}
+	req.Header.Set("If-Match", "*")
+	rsp, err := c.do(req, cs, true)
+	if err != nil {
+		return errors.Wrap(err, "iothub: failed to execute request")
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode >= 400 {
+		return common.NewHTTPError("iothub", rsp)
+	}
+	return nil
+}
+
+// GET /twins/{id}/modules/{moduleId}
+func (c *client) GetModuleTwin(
+	ctx context.Context,
+	cs *model.ConnectionString,
+	id, moduleID string,
+) (*DeviceTwin, error) {
+	return c.getTwin(ctx, cs, uriModuleTwin(id, moduleID))
+}
+
+// PATCH /twins/{id}/modules/{moduleId}
+func (c *client) UpdateModuleTwin(
+	ctx context.Context,
+	cs *model.ConnectionString,
+	id, moduleID string,
+	r *DeviceTwinUpdate,
+) error {
+	return c.updateTwin(ctx, cs, uriModuleTwin(id, moduleID), r)
+}
+
+// POST /twins/{id}/methods
+func (c *client) InvokeDeviceMethod(
+	ctx context.Context,
+	cs *model.ConnectionString,
+	id string,
+	method *DirectMethod,
+) (*MethodResult, error) {
+	return c.invokeMethod(ctx, cs, uriDeviceMethods(id), method)
+}
+
+// POST /twins/{id}/modules/{moduleId}/methods
+func (c *client) InvokeModuleMethod(
+	ctx context.Context,
+	cs *model.ConnectionString,
+	id, moduleID string,
+	method *DirectMethod,
+) (*MethodResult, error) {
+	return c.invokeMethod(ctx, cs, uriModuleMethods(id, moduleID), method)
+}
+
+func (c *client) invokeMethod(
+	ctx context.Context,
+	cs *model.ConnectionString,
+	uri string,
+	method *DirectMethod,
+) (*MethodResult, error) {
+	if err := method.Validate(); err != nil {
+		return nil, errors.Wrap(err, "iothub: invalid direct method")
+	}
+	b, _ := json.Marshal(method)
+	req, err := c.NewRequestWithContext(ctx, cs, http.MethodPost, uri, bytes.NewReader(b))
+	if err != nil {
+		return nil, errors.Wrap(err, "iothub: failed to prepare request")
+	}
+	// Methods are not retried: the device may have executed the method
+	// even if the hub failed to deliver the result.
+	rsp, err := c.do(req, cs, false)
+	if err != nil {
+		return nil, errors.Wrap(err, "iothub: failed to execute request")
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode >= 400 {
+		return nil, common.NewHTTPError("iothub", rsp)
+	}
+	res := new(MethodResult)
+	dec := json.NewDecoder(rsp.Body)
+	if err = dec.Decode(res); err != nil {
+		return nil, errors.Wrap(err, "iothub: failed to decode method result")
+	}
+	return res, nil
+}
+
+// PUT /jobs/v2/{id}
+func (c *client) ScheduleJob(
+	ctx context.Context,
+	cs *model.ConnectionString,
+	job *Job,
+) (*Job, error) {
+	if err := job.Validate(); err != nil {
+		return nil, errors.Wrap(err, "iothub: invalid job")
+	}
+	req := *job
+	if req.StartTime == nil {
+		now := time.Now().UTC()
+		req.StartTime = &now
+	}
+	if req.UpdateTwin != nil && req.UpdateTwin.ETag == "" {
+		twin := *req.UpdateTwin
+		twin.ETag = "*"
+		req.UpdateTwin = &twin
+	}
+	b, _ := json.Marshal(req)
+	// Scheduling a job twice with the same ID fails with a conflict, so
+	// the request is not retried.
+	return c.doJob(ctx, cs, http.MethodPut, uriJob(job.JobID), bytes.NewReader(b), false)
+}
+
+// GET /jobs/v2/{id}
+func (c *client) GetJob(
+	ctx context.Context,
+	cs *model.ConnectionString,
+	id string,
+) (*Job, error) {
+	return c.doJob(ctx, cs, http.MethodGet, uriJob(id), nil, true)
+}
+
+// POST /jobs/v2/{id}/cancel
+func (c *client) CancelJob(
+	ctx context.Context,
+	cs *model.ConnectionString,
+	id string,
+) (*Job, error) {
+	return c.doJob(ctx, cs, http.MethodPost, uriJob(id)+"/cancel", nil, true)
+}
+
+func (c *client) doJob(
+	ctx context.Context,
+	cs *model.ConnectionString,
+	method, uri string,
+	body io.Reader,
+	idempotent bool,
+) (*Job, error) {
+	req, err := c.NewRequestWithContext(ctx, cs, method, uri, body)
+	if err != nil {
+		return nil, errors.Wrap(err, "iothub: failed to prepare request")
+	}
+	rsp, err := c.do(req, cs, idempotent)
+	if err != nil {
+		return nil, errors.Wrap(err, "iothub: failed to execute request")
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode >= 400 {
+		return nil, common.NewHTTPError("iothub", rsp)
+	}
+	job := new(Job)
+	dec := json.NewDecoder(rsp.Body)
+	if err = dec.Decode(job); err != nil {
+		return nil, errors.Wrap(err, "iothub: failed to decode job")
+	}
+	return job, nil
+}
+
+// GET /jobs/v2/query
+func (c *client) QueryJobs(
+	ctx context.Context,
+	cs *model.ConnectionString,
+	fltr JobFilter,
+	contToken string,
+) (*JobsPage, error) {
+	if err := fltr.Validate(); err != nil {
+		return nil, errors.Wrap(err, "iothub: invalid job filter")
+	}
+	params := url.Values{}
+	if fltr.Type != "" {
+		params.Set("jobType", string(fltr.Type))
+	}
+	if fltr.Status != "" {
+		params.Set("jobStatus", string(fltr.Status))
+	}
+	uri := uriQueryJobs
+	if len(params) > 0 {
+		uri += "?" + params.Encode()
+	}
+	req, err := c.NewRequestWithContext(ctx, cs, http.MethodGet, uri, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "iothub: failed to prepare request")
+	}
+	pageSize := fltr.PageSize
+	if pageSize == 0 {
+		pageSize = MaxJobsPageSize
+	}
+	req.Header.Set(hdrKeyCount, strconv.Itoa(pageSize))
+	if contToken != "" {
+		req.Header.Set(hdrKeyContToken, contToken)
+	}
+	rsp, err := c.do(req, cs, true)
+	if err != nil {
+		return nil, errors.Wrap(err, "iothub: failed to execute request")
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode >= 400 {
+		return nil, common.NewHTTPError("iothub", rsp)
+	}
+	page := new(JobsPage)
+	dec := json.NewDecoder(rsp.Body)
+	if err = dec.Decode(page); err != nil {
+		return nil, errors.Wrap(err, "iothub: failed to decode jobs")
+	}
+	if page.ContinuationToken == "" {
+		page.ContinuationToken = rsp.Header.Get(hdrKeyContToken)
+	}
+	return page, nil
+}
+
+// POST /devices/{id}/applyConfigurationContent
+func (c *client) ApplyConfigurationContent(
+	ctx context.Context,
+	cs *model.ConnectionString,
+	id string,
+	content *ConfigurationContent,
+) error {
+	if content == nil {
+		return errors.New("iothub: invalid configuration content: cannot be blank")
+	}
+	if err := content.Validate(); err != nil {
+		return errors.Wrap(err, "iothub: invalid configuration content")
+	}
+	b, _ := json.Marshal(content)
+	req, err := c.NewRequestWithContext(ctx, cs,
+		http.MethodPost,
+		uriDevice(id)+"/applyConfigurationContent",
+		bytes.NewReader(b),
+	)
+	if err != nil {
+		return errors.Wrap(err, "iothub: failed to prepare request")
+	}
+	rsp, err := c.do(req, cs, true)
+	if err != nil {
+		return errors.Wrap(err, "iothub: failed to execute request")
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode >= 400 {
+		return common.NewHTTPError("iothub", rsp)
+	}
+	return nil
+}
+
+// GET /configurations
+func (c *client) GetConfigurations(
+	ctx context.Context,
+	cs *model.ConnectionString,
+	top int,
+) ([]Configuration, error) {
+	if top <= 0 || top > MaxConfigurationsCount {
+		top = MaxConfigurationsCount
+	}
+	req, err := c.NewRequestWithContext(ctx, cs,
+		http.MethodGet, uriConfigurations+"?top="+strconv.Itoa(top), nil,
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "iothub: failed to prepare request")
+	}
+	rsp, err := c.do(req, cs, true)
+	if err != nil {
+		return nil, errors.Wrap(err, "iothub: failed to execute request")
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode >= 400 {
+		return nil, common.NewHTTPError("iothub", rsp)
+	}
+	var configs []Configuration
+	dec := json.NewDecoder(rsp.Body)
+	if err = dec.Decode(&configs); err != nil {
+		return nil, errors.Wrap(err, "iothub: failed to decode configurations")
+	}
+	return configs, nil
+}
+
+// GET /configurations/{id}
+func (c *client) GetConfiguration(
+	ctx context.Context,
+	cs *model.ConnectionString,
+	id string,
+) (*Configuration, error) {
+	return c.doConfiguration(ctx, cs, http.MethodGet, uriConfiguration(id), nil, "")
+}
+
+// PUT /configurations/{id}
+func (c *client) UpsertConfiguration(
+	ctx context.Context,
+	cs *model.ConnectionString,
+	config *Configuration,
+) (*Configuration, error) {
+	if config == nil {
+		return nil, errors.New("iothub: invalid configuration: cannot be blank")
+	}
+	if err := config.Validate(); err != nil {
+		return nil, errors.Wrap(err, "iothub: invalid configuration")
+	}
+	b, _ := json.Marshal(config)
+	return c.doConfiguration(ctx, cs,
+		http.MethodPut, uriConfiguration(config.ID), b, config.ETag,
+	)
+}
+
+// doConfiguration executes a configuration request, the request is retried
+// unless it creates a configuration: a retried create could fail with a
+// conflict if the first attempt succeeded.
+func (c *client) doConfiguration(
+	ctx context.Context,
+	cs *model.ConnectionString,
+	method, uri string,
+	body []byte,
+	etag string,
+) (*Configuration, error) {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := c.NewRequestWithContext(ctx, cs, method, uri, r)
+	if err != nil {
+		return nil, errors.Wrap(err, "iothub: failed to prepare request")
+	}
+	if etag != "" {
+		req.Header.Set("If-Match", `"`+etag+`"`)
+	}
+	rsp, err := c.do(req, cs, method == http.MethodGet || etag != "")
+	if err != nil {
+		return nil, errors.Wrap(err, "iothub: failed to execute request")
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode >= 400 {
+		return nil, common.NewHTTPError("iothub", rsp)
+	}
+	config := new(Configuration)
+	dec := json.NewDecoder(rsp.Body)
+	if err = dec.Decode(config); err != nil {
+		return nil, errors.Wrap(err, "iothub: failed to decode configuration")
+	}
+	return config, nil
+}
+
+// DELETE /configurations/{id}
+func (c *client) DeleteConfiguration(
+	ctx context.Context,
+	cs *model.ConnectionString,
+	id, etag string,
+) error {
+	req, err := c.NewRequestWithContext(ctx, cs,
+		http.MethodDelete, uriConfiguration(id), nil,
+	)
+	if err != nil {
+		return errors.Wrap(err, "iothub: failed to prepare request")
+	}
+	if etag == "" {
+		req.Header.Set("If-Match", "*")
+	} else {
+		req.Header.Set("If-Match", `"`+etag+`"`)
+	}
+	rsp, err := c.do(req, cs, true)
+	if err != nil {
+		return errors.Wrap(err, "iothub: failed to execute request")
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode >= 400 {
+		return common.NewHTTPError("iothub", rsp)
 	}
 	return nil
 }
@@ -130,7 +130,7 @@ func TestIOTHubExternal(t *testing.T) {
 		}
 	}
 
-	cur, err := client.GetDeviceTwins(ctx, externalCS)
+	cur, err := client.GetDeviceTwins(ctx, externalCS, nil)
 	assert.NoError(t, err)
 	var v DeviceTwin
 	for cur.Next(ctx) {
@@ -294,9 +294,10 @@ func TestGetDevices(t *testing.T) {
 
 		CTX context.Context
 
-		ConnStr    *model.ConnectionString
-		NumDevices int32
-		LastError  error
+		ConnStr      *model.ConnectionString
+		NumDevices   int32
+		RoundTripper http.RoundTripper
+		LastError    error
 
 		Error error
 	}{{
@@ -341,6 +342,16 @@ func TestGetDevices(t *testing.T) {
 			HostName: "localhost",
 		},
 		Error: errors.New("iothub: failed to prepare request: invalid connection string"),
+	}, {
+		Name: "error/bad status code",
+
+		CTX: context.Background(),
+		RoundTripper: RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			w := httptest.NewRecorder()
+			w.WriteHeader(http.StatusForbidden)
+			return w.Result(), nil
+		}),
+		Error: common.HTTPError{Code: http.StatusForbidden},
 	}}
 	for i := range testCases {
 		tc := testCases[i]
@@ -352,7 +363,12 @@ func TestGetDevices(t *testing.T) {
 					maxDevices: tc.NumDevices,
 				},
 			}
-			client := NewClient(NewOptions().SetClient(httpClient))
+			if tc.RoundTripper != nil {
+				httpClient.Transport = tc.RoundTripper
+			}
+			client := NewClient(NewOptions().
+				SetClient(httpClient).
+				SetBackoff(time.Millisecond, time.Millisecond))
 			connStr := tc.ConnStr
 			if connStr == nil {
 				connStr = &model.ConnectionString{
@@ -363,7 +379,7 @@ func TestGetDevices(t *testing.T) {
 				}
 			}
 
-			cur, err := client.GetDeviceTwins(tc.CTX, connStr)
+			cur, err := client.GetDeviceTwins(tc.CTX, connStr, nil)
 			if tc.Error != nil {
 				if assert.Error(t, err) {
 					assert.Regexp(t, tc.Error.Error(), err.Error())
@@ -386,6 +402,116 @@ func TestGetDevices(t *testing.T) {
 	}
 }
 
+func TestQueryDeviceTwins(t *testing.T) {
+	t.Parallel()
+	testCases := []struct {
+		Name string
+
+		Query     *Query
+		ContToken string
+
+		RspCode      int
+		RspContToken string
+		RspBody      string
+
+		SQL      string
+		MaxItems string
+		Page     *QueryPage
+		Error    error
+	}{{
+		Name: "ok",
+
+		Query: NewQuery().
+			Fields(FieldDeviceID).
+			And(FieldStatus.Eq("enabled")).
+			SetPageSize(2),
+
+		RspCode:      http.StatusOK,
+		RspContToken: "next",
+		RspBody:      `[{"deviceId":"dev-1"},{"deviceId":"dev-2"}]`,
+
+		SQL:      "SELECT deviceId FROM devices WHERE status = 'enabled'",
+		MaxItems: "2",
+		Page: &QueryPage{
+			Items: []json.RawMessage{
+				[]byte(`{"deviceId":"dev-1"}`),
+				[]byte(`{"deviceId":"dev-2"}`),
+			},
+			ContinuationToken: "next",
+		},
+	}, {
+		Name: "ok, last page",
+
+		ContToken: "next",
+
+		RspCode: http.StatusOK,
+		RspBody: `[]`,
+
+		SQL:      "SELECT * FROM devices",
+		MaxItems: "100",
+		Page: &QueryPage{
+			Items: []json.RawMessage{},
+		},
+	}, {
+		Name: "error, invalid query",
+
+		Query: NewQuery().And(Field("tags.a'b").Eq(true)),
+		Error: errors.New("iothub: invalid query: where: .*invalid field"),
+	}, {
+		Name: "error, bad status code",
+
+		RspCode: http.StatusBadRequest,
+
+		SQL:      "SELECT * FROM devices",
+		MaxItems: "100",
+		Error:    common.HTTPError{Code: http.StatusBadRequest},
+	}}
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			httpClient := &http.Client{
+				Transport: RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+					var body struct {
+						Query string `json:"query"`
+					}
+					_ = json.NewDecoder(r.Body).Decode(&body)
+					assert.Equal(t, tc.SQL, body.Query)
+					assert.Equal(t, tc.MaxItems, r.Header.Get(hdrKeyCount))
+					assert.Equal(t, tc.ContToken, r.Header.Get(hdrKeyContToken))
+
+					w := httptest.NewRecorder()
+					if tc.RspContToken != "" {
+						w.Header().Set(hdrKeyContToken, tc.RspContToken)
+					}
+					w.WriteHeader(tc.RspCode)
+					_, _ = w.WriteString(tc.RspBody)
+					return w.Result(), nil
+				}),
+			}
+			client := NewClient(NewOptions().
+				SetClient(httpClient).
+				SetMaxRetries(0))
+			cs := &model.ConnectionString{
+				Key:      []byte("c3VwZXIgc2VjcmV0Cg=="),
+				HostName: "localhost",
+				Name:     "admin_sas",
+			}
+
+			page, err := client.QueryDeviceTwins(context.Background(),
+				cs, tc.Query, tc.ContToken,
+			)
+			if tc.Error != nil {
+				if assert.Error(t, err) {
+					assert.Regexp(t, tc.Error.Error(), err.Error())
+				}
+			} else if assert.NoError(t, err) {
+				assert.Equal(t, tc.Page, page)
+			}
+		})
+	}
+}
+
 func TestUpsertDevice(t *testing.T) {
 	t.Parallel()
 	cs := &model.ConnectionString{
@@ -481,7 +607,8 @@ func TestUpsertDevice(t *testing.T) {
 				}),
 			}
 			client := NewClient(NewOptions(nil).
-				SetClient(httpClient))
+				SetClient(httpClient).
+				SetBackoff(time.Millisecond, time.Millisecond))
 
 			dev, err := client.UpsertDevice(ctx, tc.ConnStr, deviceID, tc.Updates...)
 			if tc.Error != nil {
@@ -561,7 +688,8 @@ func TestDeleteDevice(t *testing.T) {
 				}),
 			}
 			client := NewClient(NewOptions(nil).
-				SetClient(httpClient))
+				SetClient(httpClient).
+				SetBackoff(time.Millisecond, time.Millisecond))
 
 			err := client.DeleteDevice(ctx, tc.ConnStr, deviceID)
 			if tc.Error != nil {
@@ -576,6 +704,319 @@ func TestDeleteDevice(t *testing.T) {
 	}
 }
 
+func TestBulkDevices(t *testing.T) {
+	t.Parallel()
+	cs := &model.ConnectionString{
+		HostName: "localhost",
+		Key:      []byte("secret"),
+		Name:     "gimmeAccessPls",
+	}
+	devices := []*BulkDevice{{
+		DeviceID:   "6c985f61-5093-45eb-8ece-7dfe97a6de7b",
+		ImportMode: ImportModeCreate,
+		Status:     StatusEnabled,
+	}, {
+		DeviceID:   "d8b4a1a1-f3b5-4a4f-a0c7-1b3e3f6b2a11",
+		ImportMode: ImportModeCreate,
+		Status:     StatusEnabled,
+	}}
+	testCases := []struct {
+		Name string
+
+		Devices []*BulkDevice
+		ConnStr *model.ConnectionString
+
+		RSPCode int
+		RSPBody []byte
+		RTError error
+
+		Result *BulkResult
+		Error  error
+	}{{
+		Name: "ok",
+
+		Devices: devices,
+		ConnStr: cs,
+		RSPCode: http.StatusOK,
+		RSPBody: []byte(`{"isSuccessful":true,"errors":[],"warnings":[]}`),
+
+		Result: &BulkResult{
+			IsSuccessful: true,
+			Errors:       []BulkError{},
+			Warnings:     []BulkError{},
+		},
+	}, {
+		Name: "ok, partial failure",
+
+		Devices: devices,
+		ConnStr: cs,
+		RSPCode: http.StatusBadRequest,
+		RSPBody: []byte(`{"isSuccessful":false,"errors":[{` +
+			`"deviceId":"d8b4a1a1-f3b5-4a4f-a0c7-1b3e3f6b2a11",` +
+			`"errorCode":"DeviceAlreadyExists",` +
+			`"errorStatus":"A device with the same id already exists"` +
+			`}],"warnings":[]}`),
+
+		Result: &BulkResult{
+			Errors: []BulkError{{
+				DeviceID:    "d8b4a1a1-f3b5-4a4f-a0c7-1b3e3f6b2a11",
+				ErrorCode:   "DeviceAlreadyExists",
+				ErrorStatus: "A device with the same id already exists",
+			}},
+			Warnings: []BulkError{},
+		},
+	}, {
+		Name: "error/too many devices",
+
+		Devices: make([]*BulkDevice, MaxBulkDevices+1),
+		ConnStr: cs,
+		Error:   ErrTooManyBulkDevices,
+	}, {
+		Name: "error/invalid connection string",
+
+		Devices: devices,
+		ConnStr: &model.ConnectionString{
+			Name: "bad",
+		},
+		Error: errors.New("failed to prepare request: invalid connection string"),
+	}, {
+		Name: "error/internal roundtrip error",
+
+		Devices: devices,
+		ConnStr: cs,
+		RTError: errors.New("idk"),
+		Error:   errors.New("failed to execute request:.*idk"),
+	}, {
+		Name: "error/request rejected",
+
+		Devices: devices,
+		ConnStr: cs,
+		RSPCode: http.StatusBadRequest,
+		RSPBody: []byte(`{"Message":"ErrorCode:ArgumentInvalid;bad request"}`),
+		Error:   common.HTTPError{Code: http.StatusBadRequest},
+	}, {
+		Name: "error/bad status code",
+
+		Devices: devices,
+		ConnStr: cs,
+		RSPCode: http.StatusUnauthorized,
+		Error:   common.HTTPError{Code: http.StatusUnauthorized},
+	}, {
+		Name: "error/malformed response",
+
+		Devices: devices,
+		ConnStr: cs,
+		RSPCode: http.StatusOK,
+		RSPBody: []byte("imagine a bulk result in this response"),
+		Error:   errors.New("iothub: failed to decode bulk result"),
+	}}
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			ctx := context.Background()
+			httpClient := &http.Client{
+				Transport: RoundTripperFunc(func(
+					r *http.Request,
+				) (*http.Response, error) {
+					if tc.RTError != nil {
+						return nil, tc.RTError
+					}
+					assert.Equal(t, http.MethodPost, r.Method)
+					assert.Equal(t, uriDevices, r.URL.Path)
+					var body []*BulkDevice
+					_ = json.NewDecoder(r.Body).Decode(&body)
+					assert.Equal(t, tc.Devices, body)
+
+					w := httptest.NewRecorder()
+					w.WriteHeader(tc.RSPCode)
+					w.Write(tc.RSPBody)
+					return w.Result(), nil
+				}),
+			}
+			client := NewClient(NewOptions(nil).
+				SetClient(httpClient).
+				SetBackoff(time.Millisecond, time.Millisecond))
+
+			res, err := client.BulkDevices(ctx, tc.ConnStr, tc.Devices)
+			if tc.Error != nil {
+				if assert.Error(t, err) {
+					assert.Regexp(t, tc.Error.Error(), err.Error())
+				}
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tc.Result, res)
+			}
+		})
+	}
+}
+
+func TestInvokeMethod(t *testing.T) {
+	t.Parallel()
+	cs := &model.ConnectionString{
+		HostName: "localhost",
+		Key:      []byte("secret"),
+		Name:     "gimmeAccessPls",
+	}
+	const deviceID = "6c985f61-5093-45eb-8ece-7dfe97a6de7b"
+	method := &DirectMethod{
+		Name:            "reboot",
+		Payload:         json.RawMessage(`{"delay":5}`),
+		ResponseTimeout: 30,
+	}
+	testCases := []struct {
+		Name string
+
+		ModuleID string
+		Method   *DirectMethod
+		ConnStr  *model.ConnectionString
+
+		RSPCode int
+		RSPBody []byte
+		RTError error
+
+		Result *MethodResult
+		Error  error
+	}{{
+		Name: "ok",
+
+		Method:  method,
+		ConnStr: cs,
+		RSPCode: http.StatusOK,
+		RSPBody: []byte(`{"status":200,"payload":{"rebooting":true}}`),
+
+		Result: &MethodResult{
+			Status:  http.StatusOK,
+			Payload: json.RawMessage(`{"rebooting":true}`),
+		},
+	}, {
+		Name: "ok, module",
+
+		ModuleID: "agent",
+		Method:   &DirectMethod{Name: "ping"},
+		ConnStr:  cs,
+		RSPCode:  http.StatusOK,
+		RSPBody:  []byte(`{"status":404,"payload":null}`),
+
+		Result: &MethodResult{
+			Status:  http.StatusNotFound,
+			Payload: json.RawMessage(`null`),
+		},
+	}, {
+		Name: "error/invalid method",
+
+		Method: &DirectMethod{
+			Name:            "reboot",
+			Payload:         json.RawMessage(`{"delay":`),
+			ResponseTimeout: 1,
+			ConnectTimeout:  MaxMethodTimeout + 1,
+		},
+		ConnStr: cs,
+		Error: errors.New("iothub: invalid direct method: " +
+			"connectTimeoutInSeconds: .*; payload: must be valid JSON; " +
+			"responseTimeoutInSeconds: .*"),
+	}, {
+		Name: "error/invalid connection string",
+
+		Method: method,
+		ConnStr: &model.ConnectionString{
+			Name: "bad",
+		},
+		Error: errors.New("failed to prepare request: invalid connection string"),
+	}, {
+		Name: "error/internal roundtrip error",
+
+		Method:  method,
+		ConnStr: cs,
+		RTError: errors.New("idk"),
+		Error:   errors.New("failed to execute request:.*idk"),
+	}, {
+		Name: "error/device offline",
+
+		Method:  method,
+		ConnStr: cs,
+		RSPCode: http.StatusNotFound,
+		RSPBody: []byte(`{"errorCode":404103,"message":"device is not online"}`),
+		Error:   common.HTTPError{Code: http.StatusNotFound},
+	}, {
+		Name: "error/gateway timeout is not retried",
+
+		Method:  method,
+		ConnStr: cs,
+		RSPCode: http.StatusGatewayTimeout,
+		Error:   common.HTTPError{Code: http.StatusGatewayTimeout},
+	}, {
+		Name: "error/malformed response",
+
+		Method:  method,
+		ConnStr: cs,
+		RSPCode: http.StatusOK,
+		RSPBody: []byte("imagine a method result in this response"),
+		Error:   errors.New("iothub: failed to decode method result"),
+	}}
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			ctx := context.Background()
+			var calls int
+			httpClient := &http.Client{
+				Transport: RoundTripperFunc(func(
+					r *http.Request,
+				) (*http.Response, error) {
+					calls++
+					if tc.RTError != nil {
+						return nil, tc.RTError
+					}
+					assert.Equal(t, http.MethodPost, r.Method)
+					if tc.ModuleID != "" {
+						assert.Equal(t,
+							uriModuleMethods(deviceID, tc.ModuleID),
+							r.URL.Path,
+						)
+					} else {
+						assert.Equal(t, uriDeviceMethods(deviceID), r.URL.Path)
+					}
+					var body DirectMethod
+					_ = json.NewDecoder(r.Body).Decode(&body)
+					assert.Equal(t, *tc.Method, body)
+
+					w := httptest.NewRecorder()
+					w.WriteHeader(tc.RSPCode)
+					w.Write(tc.RSPBody)
+					return w.Result(), nil
+				}),
+			}
+			client := NewClient(NewOptions(nil).
+				SetClient(httpClient).
+				SetBackoff(time.Millisecond, time.Millisecond))
+
+			var (
+				res *MethodResult
+				err error
+			)
+			if tc.ModuleID != "" {
+				res, err = client.InvokeModuleMethod(ctx,
+					tc.ConnStr, deviceID, tc.ModuleID, tc.Method,
+				)
+			} else {
+				res, err = client.InvokeDeviceMethod(ctx,
+					tc.ConnStr, deviceID, tc.Method,
+				)
+			}
+			if tc.Error != nil {
+				if assert.Error(t, err) {
+					assert.Regexp(t, tc.Error.Error(), err.Error())
+				}
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tc.Result, res)
+			}
+			assert.LessOrEqual(t, calls, 1)
+		})
+	}
+}
+
 func TestGetDevice(t *testing.T) {
 	t.Parallel()
 	testCases := []struct {
@@ -699,7 +1140,9 @@ func TestGetDevice(t *testing.T) {
 					return w.Result(), nil
 				}),
 			}
-			client := NewClient(NewOptions().SetClient(httpClient))
+			client := NewClient(NewOptions().
+				SetClient(httpClient).
+				SetBackoff(time.Millisecond, time.Millisecond))
 			dev, err := client.GetDevice(ctx, tc.ConnStr, tc.DeviceID)
 			if tc.Error != nil {
 				if assert.Error(t, err) {
@@ -718,3 +1161,1093 @@ func TestGetDevice(t *testing.T) {
 		})
 	}
 }
+
+func TestRetry(t *testing.T) {
+	t.Parallel()
+	cs := &model.ConnectionString{
+		HostName: "localhost",
+		Key:      []byte("secret"),
+		Name:     "gimmeAccessPls",
+	}
+	const deviceID = "6c985f61-5093-45eb-8ece-7dfe97a6de7b"
+	type response struct {
+		Code       int
+		RetryAfter string
+	}
+	type testCase struct {
+		Name string
+
+		Timeout time.Duration
+		// Call performs the request under test
+		Call func(ctx context.Context, client Client) error
+
+		Responses []response
+		Attempts  int
+		Error     error
+	}
+	deleteDevice := func(ctx context.Context, client Client) error {
+		return client.DeleteDevice(ctx, cs, deviceID)
+	}
+	testCases := []testCase{{
+		Name: "ok/throttled with Retry-After",
+
+		Call: deleteDevice,
+		Responses: []response{
+			{Code: http.StatusTooManyRequests, RetryAfter: "0"},
+			{Code: http.StatusNoContent},
+		},
+		Attempts: 2,
+	}, {
+		Name: "ok/transient errors with body",
+
+		Call: func(ctx context.Context, client Client) error {
+			return client.UpdateDeviceTwin(ctx, cs, deviceID, &DeviceTwinUpdate{
+				Tags: map[string]interface{}{"mender": true},
+			})
+		},
+		Responses: []response{
+			{Code: http.StatusServiceUnavailable},
+			{Code: http.StatusBadGateway},
+			{Code: http.StatusOK},
+		},
+		Attempts: 3,
+	}, {
+		Name: "error/retries exhausted",
+
+		Call: deleteDevice,
+		Responses: []response{
+			{Code: http.StatusInternalServerError},
+		},
+		Attempts: 3,
+		Error:    common.HTTPError{Code: http.StatusInternalServerError},
+	}, {
+		Name: "error/not retryable",
+
+		Call: deleteDevice,
+		Responses: []response{
+			{Code: http.StatusBadRequest},
+		},
+		Attempts: 1,
+		Error:    common.HTTPError{Code: http.StatusBadRequest},
+	}, {
+		Name: "error/not idempotent",
+
+		Call: func(ctx context.Context, client Client) error {
+			_, err := client.UpsertDevice(ctx, cs, deviceID)
+			return err
+		},
+		Responses: []response{
+			{Code: http.StatusServiceUnavailable},
+		},
+		Attempts: 1,
+		Error:    common.HTTPError{Code: http.StatusServiceUnavailable},
+	}, {
+		Name: "error/Retry-After exceeds deadline",
+
+		Timeout: time.Second,
+		Call:    deleteDevice,
+		Responses: []response{
+			{Code: http.StatusTooManyRequests, RetryAfter: "10"},
+		},
+		Attempts: 1,
+		Error:    common.HTTPError{Code: http.StatusTooManyRequests},
+	}}
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			ctx := context.Background()
+			if tc.Timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tc.Timeout)
+				defer cancel()
+			}
+			var attempts int
+			httpClient := &http.Client{
+				Transport: RoundTripperFunc(func(
+					r *http.Request,
+				) (*http.Response, error) {
+					assert.Regexp(t, "^SharedAccessSignature ",
+						r.Header.Get(hdrKeyAuthorization))
+					if r.Body != nil {
+						b, err := io.ReadAll(r.Body)
+						assert.NoError(t, err)
+						assert.NotEmpty(t, b, "request body not replayed")
+					}
+					rsp := tc.Responses[len(tc.Responses)-1]
+					if attempts < len(tc.Responses) {
+						rsp = tc.Responses[attempts]
+					}
+					attempts++
+					w := httptest.NewRecorder()
+					if rsp.RetryAfter != "" {
+						w.Header().Set(hdrKeyRetryAfter, rsp.RetryAfter)
+					}
+					w.WriteHeader(rsp.Code)
+					return w.Result(), nil
+				}),
+			}
+			client := NewClient(NewOptions().
+				SetClient(httpClient).
+				SetMaxRetries(2).
+				SetBackoff(time.Millisecond, 2*time.Millisecond))
+
+			err := tc.Call(ctx, client)
+			if tc.Error != nil {
+				if assert.Error(t, err) {
+					assert.Regexp(t, tc.Error.Error(), err.Error())
+				}
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tc.Attempts, attempts)
+		})
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	t.Parallel()
+	now := time.Date(2021, 11, 1, 12, 0, 0, 0, time.UTC)
+	testCases := map[string]struct {
+		Value string
+
+		Delay time.Duration
+		OK    bool
+	}{
+		"seconds": {
+			Value: "30",
+			Delay: 30 * time.Second,
+			OK:    true,
+		},
+		"http date": {
+			Value: now.Add(time.Minute).Format(http.TimeFormat),
+			Delay: time.Minute,
+			OK:    true,
+		},
+		"http date in the past": {
+			Value: now.Add(-time.Minute).Format(http.TimeFormat),
+			OK:    true,
+		},
+		"missing": {},
+		"malformed": {
+			Value: "soon",
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			rsp := &http.Response{Header: http.Header{}}
+			if tc.Value != "" {
+				rsp.Header.Set(hdrKeyRetryAfter, tc.Value)
+			}
+			delay, ok := retryAfter(rsp, now)
+			assert.Equal(t, tc.OK, ok)
+			assert.Equal(t, tc.Delay, delay)
+		})
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	t.Parallel()
+	c := NewClient(NewOptions().
+		SetBackoff(100*time.Millisecond, time.Second)).(*client)
+	for attempt, max := range []time.Duration{
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+		400 * time.Millisecond,
+		800 * time.Millisecond,
+		time.Second,
+		time.Second,
+	} {
+		delay := c.backoff(attempt)
+		assert.GreaterOrEqual(t, int64(delay), int64(max/2))
+		assert.LessOrEqual(t, int64(delay), int64(max))
+	}
+	assert.LessOrEqual(t, int64(c.backoff(100)), int64(time.Second))
+}
+
+func TestScheduleJob(t *testing.T) {
+	t.Parallel()
+	cs := &model.ConnectionString{
+		HostName: "localhost",
+		Key:      []byte("secret"),
+		Name:     "gimmeAccessPls",
+	}
+	startTime := time.Date(2021, 11, 1, 12, 0, 0, 0, time.UTC)
+	testCases := []struct {
+		Name string
+
+		Job *Job
+
+		RSPCode int
+		RSPBody []byte
+
+		Request map[string]interface{}
+		Result  *Job
+		Error   error
+	}{{
+		Name: "ok, twin update",
+
+		Job: &Job{
+			JobID:          "job-1",
+			Type:           JobTypeUpdateTwin,
+			QueryCondition: "tags.mender = true",
+			UpdateTwin: &JobTwin{
+				Tags: map[string]interface{}{"ring": 1.0},
+			},
+			StartTime: &startTime,
+		},
+		RSPCode: http.StatusOK,
+		RSPBody: []byte(`{"jobId":"job-1","type":"scheduleUpdateTwin",` +
+			`"queryCondition":"tags.mender = true","status":"queued"}`),
+
+		Request: map[string]interface{}{
+			"jobId":          "job-1",
+			"type":           "scheduleUpdateTwin",
+			"queryCondition": "tags.mender = true",
+			"updateTwin": map[string]interface{}{
+				"etag": "*",
+				"tags": map[string]interface{}{"ring": 1.0},
+			},
+			"startTime": "2021-11-01T12:00:00Z",
+		},
+		Result: &Job{
+			JobID:          "job-1",
+			Type:           JobTypeUpdateTwin,
+			QueryCondition: "tags.mender = true",
+			Status:         JobStatusQueued,
+		},
+	}, {
+		Name: "ok, device method",
+
+		Job: &Job{
+			JobID:               "job-2",
+			Type:                JobTypeDeviceMethod,
+			QueryCondition:      "deviceId = 'dev-1'",
+			CloudToDeviceMethod: &DirectMethod{Name: "reboot"},
+			StartTime:           &startTime,
+			MaxExecutionTime:    3600,
+		},
+		RSPCode: http.StatusOK,
+		RSPBody: []byte(`{"jobId":"job-2","type":"scheduleDeviceMethod",` +
+			`"status":"scheduled"}`),
+
+		Request: map[string]interface{}{
+			"jobId":          "job-2",
+			"type":           "scheduleDeviceMethod",
+			"queryCondition": "deviceId = 'dev-1'",
+			"cloudToDeviceMethod": map[string]interface{}{
+				"methodName": "reboot",
+			},
+			"startTime":                 "2021-11-01T12:00:00Z",
+			"maxExecutionTimeInSeconds": 3600.0,
+		},
+		Result: &Job{
+			JobID:  "job-2",
+			Type:   JobTypeDeviceMethod,
+			Status: JobStatusScheduled,
+		},
+	}, {
+		Name: "error, invalid job",
+
+		Job: &Job{
+			JobID:          "job-3",
+			Type:           JobTypeDeviceMethod,
+			QueryCondition: "deviceId = 'dev-1'",
+			UpdateTwin:     &JobTwin{},
+		},
+		Error: errors.New("iothub: invalid job: " +
+			"cloudToDeviceMethod: cannot be blank; updateTwin: must be blank."),
+	}, {
+		Name: "error, bad status code",
+
+		Job: &Job{
+			JobID:               "job-4",
+			Type:                JobTypeDeviceMethod,
+			QueryCondition:      "deviceId = 'dev-1'",
+			CloudToDeviceMethod: &DirectMethod{Name: "reboot"},
+			StartTime:           &startTime,
+		},
+		RSPCode: http.StatusConflict,
+
+		Request: map[string]interface{}{
+			"jobId":          "job-4",
+			"type":           "scheduleDeviceMethod",
+			"queryCondition": "deviceId = 'dev-1'",
+			"cloudToDeviceMethod": map[string]interface{}{
+				"methodName": "reboot",
+			},
+			"startTime": "2021-11-01T12:00:00Z",
+		},
+		Error: common.HTTPError{Code: http.StatusConflict},
+	}, {
+		Name: "error, malformed response",
+
+		Job: &Job{
+			JobID:               "job-5",
+			Type:                JobTypeDeviceMethod,
+			QueryCondition:      "deviceId = 'dev-1'",
+			CloudToDeviceMethod: &DirectMethod{Name: "reboot"},
+			StartTime:           &startTime,
+		},
+		RSPCode: http.StatusOK,
+		RSPBody: []byte("imagine a job in this response"),
+
+		Request: map[string]interface{}{
+			"jobId":          "job-5",
+			"type":           "scheduleDeviceMethod",
+			"queryCondition": "deviceId = 'dev-1'",
+			"cloudToDeviceMethod": map[string]interface{}{
+				"methodName": "reboot",
+			},
+			"startTime": "2021-11-01T12:00:00Z",
+		},
+		Error: errors.New("iothub: failed to decode job"),
+	}}
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			var calls int
+			httpClient := &http.Client{
+				Transport: RoundTripperFunc(func(
+					r *http.Request,
+				) (*http.Response, error) {
+					calls++
+					assert.Equal(t, http.MethodPut, r.Method)
+					assert.Equal(t, uriJob(tc.Job.JobID), r.URL.Path)
+					var body map[string]interface{}
+					_ = json.NewDecoder(r.Body).Decode(&body)
+					assert.Equal(t, tc.Request, body)
+
+					w := httptest.NewRecorder()
+					w.WriteHeader(tc.RSPCode)
+					w.Write(tc.RSPBody)
+					return w.Result(), nil
+				}),
+			}
+			client := NewClient(NewOptions(nil).
+				SetClient(httpClient).
+				SetBackoff(time.Millisecond, time.Millisecond))
+
+			job, err := client.ScheduleJob(context.Background(), cs, tc.Job)
+			if tc.Error != nil {
+				if assert.Error(t, err) {
+					assert.Regexp(t, tc.Error.Error(), err.Error())
+				}
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tc.Result, job)
+			}
+			assert.LessOrEqual(t, calls, 1)
+		})
+	}
+}
+
+func TestGetCancelJob(t *testing.T) {
+	t.Parallel()
+	cs := &model.ConnectionString{
+		HostName: "localhost",
+		Key:      []byte("secret"),
+		Name:     "gimmeAccessPls",
+	}
+	testCases := []struct {
+		Name string
+
+		Cancel bool
+
+		RSPCode int
+		RSPBody []byte
+
+		Method string
+		Path   string
+		Result *Job
+		Error  error
+	}{{
+		Name: "ok, get",
+
+		RSPCode: http.StatusOK,
+		RSPBody: []byte(`{"jobId":"job-1","type":"scheduleDeviceMethod",` +
+			`"status":"running","deviceJobStatistics":{"deviceCount":3,` +
+			`"failedCount":1,"succeededCount":1,"runningCount":1,` +
+			`"pendingCount":0}}`),
+
+		Method: http.MethodGet,
+		Path:   uriJobs + "/job-1",
+		Result: &Job{
+			JobID:  "job-1",
+			Type:   JobTypeDeviceMethod,
+			Status: JobStatusRunning,
+			Statistics: &JobStatistics{
+				DeviceCount:    3,
+				FailedCount:    1,
+				SucceededCount: 1,
+				RunningCount:   1,
+			},
+		},
+	}, {
+		Name: "ok, cancel",
+
+		Cancel:  true,
+		RSPCode: http.StatusOK,
+		RSPBody: []byte(`{"jobId":"job-1","type":"scheduleDeviceMethod",` +
+			`"status":"cancelled"}`),
+
+		Method: http.MethodPost,
+		Path:   uriJobs + "/job-1/cancel",
+		Result: &Job{
+			JobID:  "job-1",
+			Type:   JobTypeDeviceMethod,
+			Status: JobStatusCancelled,
+		},
+	}, {
+		Name: "error, job not found",
+
+		RSPCode: http.StatusNotFound,
+
+		Method: http.MethodGet,
+		Path:   uriJobs + "/job-1",
+		Error:  common.HTTPError{Code: http.StatusNotFound},
+	}}
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			httpClient := &http.Client{
+				Transport: RoundTripperFunc(func(
+					r *http.Request,
+				) (*http.Response, error) {
+					assert.Equal(t, tc.Method, r.Method)
+					assert.Equal(t, tc.Path, r.URL.Path)
+
+					w := httptest.NewRecorder()
+					w.WriteHeader(tc.RSPCode)
+					w.Write(tc.RSPBody)
+					return w.Result(), nil
+				}),
+			}
+			client := NewClient(NewOptions(nil).
+				SetClient(httpClient).
+				SetMaxRetries(0))
+
+			var (
+				job *Job
+				err error
+			)
+			if tc.Cancel {
+				job, err = client.CancelJob(context.Background(), cs, "job-1")
+			} else {
+				job, err = client.GetJob(context.Background(), cs, "job-1")
+			}
+			if tc.Error != nil {
+				if assert.Error(t, err) {
+					assert.Regexp(t, tc.Error.Error(), err.Error())
+				}
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tc.Result, job)
+			}
+		})
+	}
+}
+
+func TestQueryJobs(t *testing.T) {
+	t.Parallel()
+	testCases := []struct {
+		Name string
+
+		Filter    JobFilter
+		ContToken string
+
+		RspCode      int
+		RspContToken string
+		RspBody      string
+
+		Query    string
+		MaxItems string
+		Page     *JobsPage
+		Error    error
+	}{{
+		Name: "ok",
+
+		Filter: JobFilter{
+			Type:     JobTypeDeviceMethod,
+			Status:   JobStatusRunning,
+			PageSize: 1,
+		},
+
+		RspCode: http.StatusOK,
+		RspBody: `{"items":[{"jobId":"job-1","type":"scheduleDeviceMethod",` +
+			`"status":"running"}],"continuationToken":"next"}`,
+
+		Query:    "jobStatus=running&jobType=scheduleDeviceMethod",
+		MaxItems: "1",
+		Page: &JobsPage{
+			Jobs: []Job{{
+				JobID:  "job-1",
+				Type:   JobTypeDeviceMethod,
+				Status: JobStatusRunning,
+			}},
+			ContinuationToken: "next",
+		},
+	}, {
+		Name: "ok, continuation token in header",
+
+		ContToken: "next",
+
+		RspCode:      http.StatusOK,
+		RspContToken: "next2",
+		RspBody:      `{"items":[]}`,
+
+		MaxItems: "100",
+		Page: &JobsPage{
+			Jobs:              []Job{},
+			ContinuationToken: "next2",
+		},
+	}, {
+		Name: "error, invalid filter",
+
+		Filter: JobFilter{Status: "done"},
+		Error:  errors.New("iothub: invalid job filter: Status: must be a valid value"),
+	}, {
+		Name: "error, bad status code",
+
+		RspCode: http.StatusBadRequest,
+
+		MaxItems: "100",
+		Error:    common.HTTPError{Code: http.StatusBadRequest},
+	}}
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			httpClient := &http.Client{
+				Transport: RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+					assert.Equal(t, http.MethodGet, r.Method)
+					assert.Equal(t, uriQueryJobs, r.URL.Path)
+					q := r.URL.Query()
+					q.Del("api-version")
+					assert.Equal(t, tc.Query, q.Encode())
+					assert.Equal(t, tc.MaxItems, r.Header.Get(hdrKeyCount))
+					assert.Equal(t, tc.ContToken, r.Header.Get(hdrKeyContToken))
+
+					w := httptest.NewRecorder()
+					if tc.RspContToken != "" {
+						w.Header().Set(hdrKeyContToken, tc.RspContToken)
+					}
+					w.WriteHeader(tc.RspCode)
+					_, _ = w.WriteString(tc.RspBody)
+					return w.Result(), nil
+				}),
+			}
+			client := NewClient(NewOptions().
+				SetClient(httpClient).
+				SetMaxRetries(0))
+			cs := &model.ConnectionString{
+				Key:      []byte("c3VwZXIgc2VjcmV0Cg=="),
+				HostName: "localhost",
+				Name:     "admin_sas",
+			}
+
+			page, err := client.QueryJobs(context.Background(),
+				cs, tc.Filter, tc.ContToken,
+			)
+			if tc.Error != nil {
+				if assert.Error(t, err) {
+					assert.Regexp(t, tc.Error.Error(), err.Error())
+				}
+			} else if assert.NoError(t, err) {
+				assert.Equal(t, tc.Page, page)
+			}
+		})
+	}
+}
+
+func TestModules(t *testing.T) {
+	t.Parallel()
+	cs := &model.ConnectionString{
+		HostName: "localhost",
+		Key:      []byte("secret"),
+		Name:     "gimmeAccessPls",
+	}
+	const (
+		deviceID = "6c985f61-5093-45eb-8ece-7dfe97a6de7b"
+		moduleID = "agent"
+	)
+	module := &Module{
+		Auth: &Auth{
+			Type: AuthTypeSymmetric,
+			SymmetricKey: &SymmetricKey{
+				Primary:   Key("primary"),
+				Secondary: Key("secondary"),
+			},
+		},
+		DeviceID: deviceID,
+		ModuleID: moduleID,
+		ETag:     "AAAAAAAAAAE=",
+	}
+	moduleJSON, _ := json.Marshal(module)
+	testCases := []struct {
+		Name string
+
+		Call func(c Client) (interface{}, error)
+
+		RSPCode int
+		RSPBody []byte
+
+		Method  string
+		Path    string
+		IfMatch string
+		Body    string
+		Result  interface{}
+		Error   error
+	}{{
+		Name: "ok, get modules",
+
+		Call: func(c Client) (interface{}, error) {
+			return c.GetModules(context.Background(), cs, deviceID)
+		},
+		RSPCode: http.StatusOK,
+		RSPBody: []byte("[" + string(moduleJSON) + "]"),
+
+		Method: http.MethodGet,
+		Path:   uriDevice(deviceID) + "/modules",
+		Result: []Module{*module},
+	}, {
+		Name: "ok, get module",
+
+		Call: func(c Client) (interface{}, error) {
+			return c.GetModule(context.Background(), cs, deviceID, moduleID)
+		},
+		RSPCode: http.StatusOK,
+		RSPBody: moduleJSON,
+
+		Method: http.MethodGet,
+		Path:   uriModule(deviceID, moduleID),
+		Result: module,
+	}, {
+		Name: "error, module not found",
+
+		Call: func(c Client) (interface{}, error) {
+			return c.GetModule(context.Background(), cs, deviceID, moduleID)
+		},
+		RSPCode: http.StatusNotFound,
+
+		Method: http.MethodGet,
+		Path:   uriModule(deviceID, moduleID),
+		Error:  common.HTTPError{Code: http.StatusNotFound},
+	}, {
+		Name: "ok, create module",
+
+		Call: func(c Client) (interface{}, error) {
+			return c.UpsertModule(context.Background(),
+				cs, deviceID, moduleID, nil,
+			)
+		},
+		RSPCode: http.StatusOK,
+		RSPBody: moduleJSON,
+
+		Method: http.MethodPut,
+		Path:   uriModule(deviceID, moduleID),
+		Body:   `{"deviceId":"` + deviceID + `","moduleId":"agent"}`,
+		Result: module,
+	}, {
+		Name: "ok, update module",
+
+		Call: func(c Client) (interface{}, error) {
+			return c.UpsertModule(context.Background(),
+				cs, deviceID, moduleID, &Module{
+					ETag:      "AAAAAAAAAAE=",
+					ManagedBy: "IotEdge",
+				},
+			)
+		},
+		RSPCode: http.StatusOK,
+		RSPBody: moduleJSON,
+
+		Method:  http.MethodPut,
+		Path:    uriModule(deviceID, moduleID),
+		IfMatch: `"AAAAAAAAAAE="`,
+		Body: `{"deviceId":"` + deviceID + `","moduleId":"agent",` +
+			`"managedBy":"IotEdge"}`,
+		Result: module,
+	}, {
+		Name: "error, malformed module",
+
+		Call: func(c Client) (interface{}, error) {
+			return c.UpsertModule(context.Background(),
+				cs, deviceID, moduleID, nil,
+			)
+		},
+		RSPCode: http.StatusOK,
+		RSPBody: []byte("imagine a module in this response"),
+
+		Method: http.MethodPut,
+		Path:   uriModule(deviceID, moduleID),
+		Body:   `{"deviceId":"` + deviceID + `","moduleId":"agent"}`,
+		Error:  errors.New("iothub: failed to decode updated module"),
+	}, {
+		Name: "ok, delete module",
+
+		Call: func(c Client) (interface{}, error) {
+			return nil, c.DeleteModule(context.Background(),
+				cs, deviceID, moduleID,
+			)
+		},
+		RSPCode: http.StatusNoContent,
+
+		Method:  http.MethodDelete,
+		Path:    uriModule(deviceID, moduleID),
+		IfMatch: "*",
+	}, {
+		Name: "ok, get module twin",
+
+		Call: func(c Client) (interface{}, error) {
+			return c.GetModuleTwin(context.Background(),
+				cs, deviceID, moduleID,
+			)
+		},
+		RSPCode: http.StatusOK,
+		RSPBody: []byte(`{"deviceId":"` + deviceID + `","moduleId":"agent",` +
+			`"properties":{"desired":{"interval":30},"reported":{}}}`),
+
+		Method: http.MethodGet,
+		Path:   uriModuleTwin(deviceID, moduleID),
+		Result: &DeviceTwin{
+			DeviceID: deviceID,
+			ModuleID: moduleID,
+			Properties: TwinProperties{
+				Desired:  map[string]interface{}{"interval": 30.0},
+				Reported: map[string]interface{}{},
+			},
+		},
+	}, {
+		Name: "ok, update module twin",
+
+		Call: func(c Client) (interface{}, error) {
+			return nil, c.UpdateModuleTwin(context.Background(),
+				cs, deviceID, moduleID, &DeviceTwinUpdate{
+					Properties: UpdateProperties{
+						Desired: map[string]interface{}{"interval": 60},
+					},
+				},
+			)
+		},
+		RSPCode: http.StatusOK,
+
+		Method: http.MethodPatch,
+		Path:   uriModuleTwin(deviceID, moduleID),
+		Body:   `{"properties":{"desired":{"interval":60}}}`,
+	}, {
+		Name: "ok, replace module twin",
+
+		Call: func(c Client) (interface{}, error) {
+			return nil, c.UpdateModuleTwin(context.Background(),
+				cs, deviceID, moduleID, &DeviceTwinUpdate{
+					Tags:    map[string]interface{}{"ring": 1},
+					Replace: true,
+				},
+			)
+		},
+		RSPCode: http.StatusOK,
+
+		Method: http.MethodPut,
+		Path:   uriModuleTwin(deviceID, moduleID),
+		Body:   `{"properties":{"desired":null},"tags":{"ring":1}}`,
+	}, {
+		Name: "error, update module twin",
+
+		Call: func(c Client) (interface{}, error) {
+			return nil, c.UpdateModuleTwin(context.Background(),
+				cs, deviceID, moduleID, &DeviceTwinUpdate{},
+			)
+		},
+		RSPCode: http.StatusPreconditionFailed,
+
+		Method: http.MethodPatch,
+		Path:   uriModuleTwin(deviceID, moduleID),
+		Body:   `{"properties":{"desired":null}}`,
+		Error:  common.HTTPError{Code: http.StatusPreconditionFailed},
+	}}
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			httpClient := &http.Client{
+				Transport: RoundTripperFunc(func(
+					r *http.Request,
+				) (*http.Response, error) {
+					assert.Equal(t, tc.Method, r.Method)
+					assert.Equal(t, tc.Path, r.URL.Path)
+					assert.Equal(t, tc.IfMatch, r.Header.Get("If-Match"))
+					if tc.Body != "" {
+						b, _ := io.ReadAll(r.Body)
+						assert.JSONEq(t, tc.Body, string(b))
+					}
+
+					w := httptest.NewRecorder()
+					w.WriteHeader(tc.RSPCode)
+					w.Write(tc.RSPBody)
+					return w.Result(), nil
+				}),
+			}
+			client := NewClient(NewOptions(nil).
+				SetClient(httpClient).
+				SetMaxRetries(0))
+
+			res, err := tc.Call(client)
+			if tc.Error != nil {
+				if assert.Error(t, err) {
+					assert.Regexp(t, tc.Error.Error(), err.Error())
+				}
+			} else if assert.NoError(t, err) && tc.Result != nil {
+				assert.Equal(t, tc.Result, res)
+			}
+		})
+	}
+}
+
+func TestConfigurations(t *testing.T) {
+	t.Parallel()
+	cs := &model.ConnectionString{
+		HostName: "localhost",
+		Key:      []byte("secret"),
+		Name:     "gimmeAccessPls",
+	}
+	const deviceID = "6c985f61-5093-45eb-8ece-7dfe97a6de7b"
+	content := &ConfigurationContent{
+		DeviceContent: map[string]interface{}{
+			"properties.desired.interval": 30.0,
+		},
+	}
+	config := &Configuration{
+		ID:              "interval-30",
+		Content:         *content,
+		TargetCondition: "tags.site='oslo'",
+		Priority:        10,
+		ETag:            "MQ==",
+	}
+	configJSON, _ := json.Marshal(config)
+	testCases := []struct {
+		Name string
+
+		Call func(c Client) (interface{}, error)
+
+		RSPCode int
+		RSPBody []byte
+
+		Method  string
+		Path    string
+		Top     string
+		IfMatch string
+		Body    string
+		Result  interface{}
+		Error   error
+	}{{
+		Name: "ok, apply configuration content",
+
+		Call: func(c Client) (interface{}, error) {
+			return nil, c.ApplyConfigurationContent(context.Background(),
+				cs, deviceID, content,
+			)
+		},
+		RSPCode: http.StatusNoContent,
+
+		Method: http.MethodPost,
+		Path:   uriDevice(deviceID) + "/applyConfigurationContent",
+		Body:   `{"deviceContent":{"properties.desired.interval":30}}`,
+	}, {
+		Name: "error, invalid configuration content",
+
+		Call: func(c Client) (interface{}, error) {
+			return nil, c.ApplyConfigurationContent(context.Background(),
+				cs, deviceID, &ConfigurationContent{},
+			)
+		},
+		Error: errors.New("iothub: invalid configuration content: " +
+			"exactly one of 'deviceContent', 'modulesContent' and " +
+			"'moduleContent' must be set"),
+	}, {
+		Name: "error, apply configuration content",
+
+		Call: func(c Client) (interface{}, error) {
+			return nil, c.ApplyConfigurationContent(context.Background(),
+				cs, deviceID, content,
+			)
+		},
+		RSPCode: http.StatusNotFound,
+
+		Method: http.MethodPost,
+		Path:   uriDevice(deviceID) + "/applyConfigurationContent",
+		Error:  common.HTTPError{Code: http.StatusNotFound},
+	}, {
+		Name: "ok, get configurations",
+
+		Call: func(c Client) (interface{}, error) {
+			return c.GetConfigurations(context.Background(), cs, 0)
+		},
+		RSPCode: http.StatusOK,
+		RSPBody: []byte("[" + string(configJSON) + "]"),
+
+		Method: http.MethodGet,
+		Path:   uriConfigurations,
+		Top:    "20",
+		Result: []Configuration{*config},
+	}, {
+		Name: "ok, get configurations with top",
+
+		Call: func(c Client) (interface{}, error) {
+			return c.GetConfigurations(context.Background(), cs, 5)
+		},
+		RSPCode: http.StatusOK,
+		RSPBody: []byte("[]"),
+
+		Method: http.MethodGet,
+		Path:   uriConfigurations,
+		Top:    "5",
+		Result: []Configuration{},
+	}, {
+		Name: "ok, get configuration",
+
+		Call: func(c Client) (interface{}, error) {
+			return c.GetConfiguration(context.Background(), cs, config.ID)
+		},
+		RSPCode: http.StatusOK,
+		RSPBody: configJSON,
+
+		Method: http.MethodGet,
+		Path:   uriConfiguration(config.ID),
+		Result: config,
+	}, {
+		Name: "ok, create configuration",
+
+		Call: func(c Client) (interface{}, error) {
+			req := *config
+			req.ETag = ""
+			return c.UpsertConfiguration(context.Background(), cs, &req)
+		},
+		RSPCode: http.StatusOK,
+		RSPBody: configJSON,
+
+		Method: http.MethodPut,
+		Path:   uriConfiguration(config.ID),
+		Body: `{"id":"interval-30","targetCondition":"tags.site='oslo'",` +
+			`"priority":10,"content":{"deviceContent":` +
+			`{"properties.desired.interval":30}}}`,
+		Result: config,
+	}, {
+		Name: "ok, update configuration",
+
+		Call: func(c Client) (interface{}, error) {
+			return c.UpsertConfiguration(context.Background(), cs, config)
+		},
+		RSPCode: http.StatusOK,
+		RSPBody: configJSON,
+
+		Method:  http.MethodPut,
+		Path:    uriConfiguration(config.ID),
+		IfMatch: `"MQ=="`,
+		Body:    string(configJSON),
+		Result:  config,
+	}, {
+		Name: "error, invalid configuration",
+
+		Call: func(c Client) (interface{}, error) {
+			return c.UpsertConfiguration(context.Background(),
+				cs, &Configuration{
+					ID:              "Not Valid",
+					Content:         *content,
+					TargetCondition: "*",
+				},
+			)
+		},
+		Error: errors.New("iothub: invalid configuration: " +
+			"id: must be in a valid format"),
+	}, {
+		Name: "error, configuration precondition failed",
+
+		Call: func(c Client) (interface{}, error) {
+			return c.UpsertConfiguration(context.Background(), cs, config)
+		},
+		RSPCode: http.StatusPreconditionFailed,
+
+		Method:  http.MethodPut,
+		Path:    uriConfiguration(config.ID),
+		IfMatch: `"MQ=="`,
+		Error:   common.HTTPError{Code: http.StatusPreconditionFailed},
+	}, {
+		Name: "error, malformed configuration",
+
+		Call: func(c Client) (interface{}, error) {
+			return c.GetConfiguration(context.Background(), cs, config.ID)
+		},
+		RSPCode: http.StatusOK,
+		RSPBody: []byte("imagine a configuration in this response"),
+
+		Method: http.MethodGet,
+		Path:   uriConfiguration(config.ID),
+		Error:  errors.New("iothub: failed to decode configuration"),
+	}, {
+		Name: "ok, delete configuration",
+
+		Call: func(c Client) (interface{}, error) {
+			return nil, c.DeleteConfiguration(context.Background(),
+				cs, config.ID, "",
+			)
+		},
+		RSPCode: http.StatusNoContent,
+
+		Method:  http.MethodDelete,
+		Path:    uriConfiguration(config.ID),
+		IfMatch: "*",
+	}, {
+		Name: "ok, delete configuration with etag",
+
+		Call: func(c Client) (interface{}, error) {
+			return nil, c.DeleteConfiguration(context.Background(),
+				cs, config.ID, config.ETag,
+			)
+		},
+		RSPCode: http.StatusNoContent,
+
+		Method:  http.MethodDelete,
+		Path:    uriConfiguration(config.ID),
+		IfMatch: `"MQ=="`,
+	}}
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			httpClient := &http.Client{
+				Transport: RoundTripperFunc(func(
+					r *http.Request,
+				) (*http.Response, error) {
+					assert.Equal(t, tc.Method, r.Method)
+					assert.Equal(t, tc.Path, r.URL.Path)
+					assert.Equal(t, tc.Top, r.URL.Query().Get("top"))
+					assert.Equal(t, tc.IfMatch, r.Header.Get("If-Match"))
+					if tc.Body != "" {
+						b, _ := io.ReadAll(r.Body)
+						assert.JSONEq(t, tc.Body, string(b))
+					}
+
+					w := httptest.NewRecorder()
+					w.WriteHeader(tc.RSPCode)
+					w.Write(tc.RSPBody)
+					return w.Result(), nil
+				}),
+			}
+			client := NewClient(NewOptions(nil).
+				SetClient(httpClient).
+				SetMaxRetries(0))
+
+			res, err := tc.Call(client)
+			if tc.Error != nil {
+				if assert.Error(t, err) {
+					assert.Regexp(t, tc.Error.Error(), err.Error())
+				}
+			} else if assert.NoError(t, err) && tc.Result != nil {
+				assert.Equal(t, tc.Result, res)
+			}
+		})
+	}
+}
@@ -0,0 +1,316 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package iothub
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+	"time"
+
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/pkg/errors"
+)
+
+const (
+	// MaxConfigurationsCount is the maximum number of configurations
+	// returned by a single request.
+	MaxConfigurationsCount = 20
+
+	// ModuleEdgeAgent and ModuleEdgeHub are the system modules configured
+	// by an IoT Edge deployment manifest.
+	ModuleEdgeAgent = "$edgeAgent"
+	ModuleEdgeHub   = "$edgeHub"
+
+	keyDesiredProperties = "properties.desired"
+)
+
+var (
+	// https://docs.microsoft.com/en-us/azure/iot-edge/module-deployment-monitoring
+	regexpConfigurationID = regexp.MustCompile(`^[a-z0-9\-:+%_#*?!(),=@;$']{1,128}$`)
+
+	validateModuleStatus  = validation.In("running", "stopped")
+	validateRestartPolicy = validation.In(
+		"never", "on-failure", "on-unhealthy", "always",
+	)
+)
+
+// ConfigurationContent is the content applied to the devices targeted by a
+// configuration: the desired properties of the device twin, of the module
+// twins, or the IoT Edge deployment manifest.
+type ConfigurationContent struct {
+	// DeviceContent maps "properties.desired.<path>" to the value of the
+	// device twin desired properties at <path>.
+	DeviceContent map[string]interface{} `json:"deviceContent,omitempty"`
+	// ModulesContent is the IoT Edge deployment manifest, it maps the
+	// module names to the content of the module twins.
+	ModulesContent map[string]map[string]interface{} `json:"modulesContent,omitempty"`
+	// ModuleContent maps "properties.desired.<path>" to the value of the
+	// module twin desired properties at <path>.
+	ModuleContent map[string]interface{} `json:"moduleContent,omitempty"`
+}
+
+// IsEdgeDeployment returns true if the content is an IoT Edge deployment
+// manifest.
+func (content ConfigurationContent) IsEdgeDeployment() bool {
+	return len(content.ModulesContent) > 0
+}
+
+// Validate validates the structure of the content, if it is an IoT Edge
+// deployment manifest, it must configure the $edgeAgent and $edgeHub
+// system modules.
+func (content ConfigurationContent) Validate() error {
+	var set int
+	for _, n := range []int{
+		len(content.DeviceContent),
+		len(content.ModulesContent),
+		len(content.ModuleContent),
+	} {
+		if n > 0 {
+			set++
+		}
+	}
+	if set != 1 {
+		return errors.New("exactly one of 'deviceContent', 'modulesContent' " +
+			"and 'moduleContent' must be set")
+	}
+	return validation.ValidateStruct(&content,
+		validation.Field(&content.DeviceContent, validateDesiredPaths),
+		validation.Field(&content.ModulesContent,
+			validation.By(validateModulesContent),
+		),
+		validation.Field(&content.ModuleContent, validateDesiredPaths),
+	)
+}
+
+var validateDesiredPaths = validation.By(func(v interface{}) error {
+	content, _ := v.(map[string]interface{})
+	errs := validation.Errors{}
+	for path := range content {
+		if path != keyDesiredProperties &&
+			!strings.HasPrefix(path, keyDesiredProperties+".") {
+			errs[path] = errors.New(
+				"must be a path under '" + keyDesiredProperties + "'",
+			)
+		}
+	}
+	return errs.Filter()
+})
+
+func validateModulesContent(v interface{}) error {
+	content, _ := v.(map[string]map[string]interface{})
+	if len(content) == 0 {
+		return nil
+	}
+	errs := validation.Errors{}
+	for _, name := range []string{ModuleEdgeAgent, ModuleEdgeHub} {
+		if _, ok := content[name]; !ok {
+			errs[name] = validation.ErrRequired
+		}
+	}
+	for name, module := range content {
+		desired, ok := module[keyDesiredProperties].(map[string]interface{})
+		if !ok {
+			errs[name] = validation.Errors{
+				keyDesiredProperties: errors.New("must be an object"),
+			}
+			continue
+		}
+		var err error
+		switch name {
+		case ModuleEdgeAgent:
+			err = decodeAndValidate(desired, new(EdgeAgentDesired))
+		case ModuleEdgeHub:
+			err = decodeAndValidate(desired, new(EdgeHubDesired))
+		}
+		if err != nil {
+			errs[name] = validation.Errors{keyDesiredProperties: err}
+		}
+	}
+	return errs.Filter()
+}
+
+func decodeAndValidate(v interface{}, dst validation.Validatable) error {
+	b, _ := json.Marshal(v)
+	if err := json.Unmarshal(b, dst); err != nil {
+		return err
+	}
+	return dst.Validate()
+}
+
+// EdgeAgentDesired are the desired properties of the $edgeAgent module,
+// the modules deployed on the IoT Edge device.
+type EdgeAgentDesired struct {
+	SchemaVersion string                `json:"schemaVersion"`
+	Runtime       EdgeRuntime           `json:"runtime"`
+	SystemModules EdgeSystemModules     `json:"systemModules"`
+	Modules       map[string]EdgeModule `json:"modules,omitempty"`
+}
+
+func (desired EdgeAgentDesired) Validate() error {
+	return validation.ValidateStruct(&desired,
+		validation.Field(&desired.SchemaVersion, validation.Required),
+		validation.Field(&desired.Runtime),
+		validation.Field(&desired.SystemModules),
+		validation.Field(&desired.Modules),
+	)
+}
+
+// EdgeRuntime is the container runtime of the IoT Edge device.
+type EdgeRuntime struct {
+	Type     string                 `json:"type"`
+	Settings map[string]interface{} `json:"settings,omitempty"`
+}
+
+func (runtime EdgeRuntime) Validate() error {
+	return validation.ValidateStruct(&runtime,
+		validation.Field(&runtime.Type,
+			validation.Required,
+			validation.In("docker"),
+		),
+	)
+}
+
+// EdgeSystemModules are the IoT Edge runtime modules.
+type EdgeSystemModules struct {
+	EdgeAgent *EdgeModule `json:"edgeAgent"`
+	EdgeHub   *EdgeModule `json:"edgeHub"`
+}
+
+func (modules EdgeSystemModules) Validate() error {
+	return validation.ValidateStruct(&modules,
+		validation.Field(&modules.EdgeAgent, validation.Required),
+		validation.Field(&modules.EdgeHub, validation.Required),
+	)
+}
+
+// EdgeModule is a module deployed on the IoT Edge device.
+type EdgeModule struct {
+	Version       string             `json:"version,omitempty"`
+	Type          string             `json:"type"`
+	Status        string             `json:"status,omitempty"`
+	RestartPolicy string             `json:"restartPolicy,omitempty"`
+	Settings      EdgeModuleSettings `json:"settings"`
+}
+
+func (module EdgeModule) Validate() error {
+	return validation.ValidateStruct(&module,
+		validation.Field(&module.Type,
+			validation.Required,
+			validation.In("docker"),
+		),
+		validation.Field(&module.Status, validateModuleStatus),
+		validation.Field(&module.RestartPolicy, validateRestartPolicy),
+		validation.Field(&module.Settings),
+	)
+}
+
+// EdgeModuleSettings are the container settings of a module.
+type EdgeModuleSettings struct {
+	Image string `json:"image"`
+	// CreateOptions is the JSON encoded container create options.
+	CreateOptions string `json:"createOptions,omitempty"`
+}
+
+func (settings EdgeModuleSettings) Validate() error {
+	return validation.ValidateStruct(&settings,
+		validation.Field(&settings.Image, validation.Required),
+		validation.Field(&settings.CreateOptions, validation.By(
+			func(v interface{}) error {
+				if s, _ := v.(string); s != "" && !json.Valid([]byte(s)) {
+					return errors.New("must be valid JSON")
+				}
+				return nil
+			},
+		)),
+	)
+}
+
+// EdgeHubDesired are the desired properties of the $edgeHub module, the
+// routes of the messages between the modules and the IoT Hub.
+type EdgeHubDesired struct {
+	SchemaVersion string `json:"schemaVersion"`
+	// Routes maps the route names to the route definitions.
+	Routes                       map[string]interface{}  `json:"routes"`
+	StoreAndForwardConfiguration *EdgeHubStoreAndForward `json:"storeAndForwardConfiguration"`
+}
+
+func (desired EdgeHubDesired) Validate() error {
+	return validation.ValidateStruct(&desired,
+		validation.Field(&desired.SchemaVersion, validation.Required),
+		validation.Field(&desired.Routes, validation.NotNil),
+		validation.Field(&desired.StoreAndForwardConfiguration,
+			validation.Required,
+		),
+	)
+}
+
+// EdgeHubStoreAndForward configures how long the messages are kept by the
+// IoT Edge hub while the IoT Hub is unreachable.
+type EdgeHubStoreAndForward struct {
+	TimeToLiveSecs int `json:"timeToLiveSecs"`
+}
+
+func (cfg EdgeHubStoreAndForward) Validate() error {
+	return validation.ValidateStruct(&cfg,
+		validation.Field(&cfg.TimeToLiveSecs, validation.Min(0)),
+	)
+}
+
+// ConfigurationMetrics are the queries counting the devices targeted by a
+// configuration and their results.
+type ConfigurationMetrics struct {
+	Results map[string]int64  `json:"results,omitempty"`
+	Queries map[string]string `json:"queries,omitempty"`
+}
+
+// Configuration is an automatic device configuration, or an IoT Edge
+// deployment if its content is a deployment manifest, applied to the devices
+// matching the target condition.
+type Configuration struct {
+	ID            string            `json:"id"`
+	SchemaVersion string            `json:"schemaVersion,omitempty"`
+	Labels        map[string]string `json:"labels,omitempty"`
+	// Content can not be modified once the configuration is created.
+	Content     ConfigurationContent `json:"content"`
+	ContentType string               `json:"contentType,omitempty"`
+	// TargetCondition is the IoT Hub SQL condition selecting the devices,
+	// see Query.Condition.
+	TargetCondition string `json:"targetCondition"`
+	// Priority decides which configuration is applied if a device is
+	// targeted by several ones, the highest priority wins.
+	Priority int `json:"priority"`
+	// Metrics are the user defined metrics of the configuration.
+	Metrics *ConfigurationMetrics `json:"metrics,omitempty"`
+	ETag    string                `json:"etag,omitempty"`
+
+	// The following fields are reported by the IoT Hub.
+	SystemMetrics   *ConfigurationMetrics `json:"systemMetrics,omitempty"`
+	CreatedTime     *time.Time            `json:"createdTimeUtc,omitempty"`
+	LastUpdatedTime *time.Time            `json:"lastUpdatedTimeUtc,omitempty"`
+}
+
+// Validate validates the configuration to create or update.
+func (config Configuration) Validate() error {
+	return validation.ValidateStruct(&config,
+		validation.Field(&config.ID,
+			validation.Required,
+			validation.Match(regexpConfigurationID),
+		),
+		validation.Field(&config.Content),
+		validation.Field(&config.TargetCondition, validation.Required),
+		validation.Field(&config.Priority, validation.Min(0)),
+	)
+}
@@ -0,0 +1,210 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package iothub
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const edgeManifest = `{
+  "modulesContent": {
+    "$edgeAgent": {
+      "properties.desired": {
+        "schemaVersion": "1.1",
+        "runtime": {
+          "type": "docker",
+          "settings": {"minDockerVersion": "v1.25"}
+        },
+        "systemModules": {
+          "edgeAgent": {
+            "type": "docker",
+            "settings": {"image": "mcr.microsoft.com/azureiotedge-agent:1.2"}
+          },
+          "edgeHub": {
+            "type": "docker",
+            "status": "running",
+            "restartPolicy": "always",
+            "settings": {
+              "image": "mcr.microsoft.com/azureiotedge-hub:1.2",
+              "createOptions": "{\"HostConfig\":{}}"
+            }
+          }
+        },
+        "modules": {
+          "sensor": {
+            "version": "1.0",
+            "type": "docker",
+            "status": "running",
+            "restartPolicy": "on-failure",
+            "settings": {"image": "example.com/sensor:1.0"}
+          }
+        }
+      }
+    },
+    "$edgeHub": {
+      "properties.desired": {
+        "schemaVersion": "1.1",
+        "routes": {"upstream": "FROM /messages/* INTO $upstream"},
+        "storeAndForwardConfiguration": {"timeToLiveSecs": 7200}
+      }
+    },
+    "sensor": {
+      "properties.desired": {"interval": 30}
+    }
+  }
+}`
+
+func TestConfigurationContentValidate(t *testing.T) {
+	t.Parallel()
+	edgeContent := func(patch func(modules map[string]map[string]interface{})) ConfigurationContent {
+		var content ConfigurationContent
+		_ = json.Unmarshal([]byte(edgeManifest), &content)
+		if patch != nil {
+			patch(content.ModulesContent)
+		}
+		return content
+	}
+	agentDesired := func(modules map[string]map[string]interface{}) map[string]interface{} {
+		return modules[ModuleEdgeAgent][keyDesiredProperties].(map[string]interface{})
+	}
+	testCases := []struct {
+		Name string
+
+		Content ConfigurationContent
+
+		Error string
+	}{{
+		Name:    "ok, edge deployment",
+		Content: edgeContent(nil),
+	}, {
+		Name: "ok, device content",
+		Content: ConfigurationContent{
+			DeviceContent: map[string]interface{}{
+				"properties.desired.interval": 30,
+			},
+		},
+	}, {
+		Name: "ok, module content",
+		Content: ConfigurationContent{
+			ModuleContent: map[string]interface{}{
+				"properties.desired": map[string]interface{}{"interval": 30},
+			},
+		},
+	}, {
+		Name:    "error, empty content",
+		Content: ConfigurationContent{},
+		Error: "exactly one of 'deviceContent', 'modulesContent' and " +
+			"'moduleContent' must be set",
+	}, {
+		Name: "error, multiple contents",
+		Content: ConfigurationContent{
+			DeviceContent: map[string]interface{}{
+				"properties.desired.interval": 30,
+			},
+			ModuleContent: map[string]interface{}{
+				"properties.desired.interval": 30,
+			},
+		},
+		Error: "exactly one of 'deviceContent', 'modulesContent' and " +
+			"'moduleContent' must be set",
+	}, {
+		Name: "error, device content outside desired properties",
+		Content: ConfigurationContent{
+			DeviceContent: map[string]interface{}{
+				"properties.desiredinterval": 30,
+			},
+		},
+		Error: "deviceContent: (properties.desiredinterval: must be a " +
+			"path under 'properties.desired'.).",
+	}, {
+		Name: "error, missing edge hub",
+		Content: edgeContent(func(modules map[string]map[string]interface{}) {
+			delete(modules, ModuleEdgeHub)
+		}),
+		Error: "modulesContent: ($edgeHub: cannot be blank.).",
+	}, {
+		Name: "error, module without desired properties",
+		Content: edgeContent(func(modules map[string]map[string]interface{}) {
+			modules["sensor"] = map[string]interface{}{"interval": 30}
+		}),
+		Error: "modulesContent: (sensor: (properties.desired: must be an " +
+			"object.).).",
+	}, {
+		Name: "error, invalid edge agent",
+		Content: edgeContent(func(modules map[string]map[string]interface{}) {
+			desired := agentDesired(modules)
+			delete(desired, "schemaVersion")
+			desired["runtime"] = map[string]interface{}{"type": "podman"}
+			desired["modules"] = map[string]interface{}{
+				"sensor": map[string]interface{}{
+					"type":   "docker",
+					"status": "paused",
+					"settings": map[string]interface{}{
+						"createOptions": "{",
+					},
+				},
+			}
+		}),
+		Error: "modulesContent: ($edgeAgent: (properties.desired: (" +
+			"modules: (sensor: (settings: (createOptions: must be valid " +
+			"JSON; image: cannot be blank.); status: must be a valid " +
+			"value.).); runtime: (type: must be a valid value.); " +
+			"schemaVersion: cannot be blank.).).).",
+	}, {
+		Name: "error, missing system module",
+		Content: edgeContent(func(modules map[string]map[string]interface{}) {
+			desired := agentDesired(modules)
+			desired["systemModules"] = map[string]interface{}{}
+		}),
+		Error: "modulesContent: ($edgeAgent: (properties.desired: (" +
+			"systemModules: (edgeAgent: cannot be blank; edgeHub: " +
+			"cannot be blank.).).).).",
+	}, {
+		Name: "error, malformed edge hub",
+		Content: edgeContent(func(modules map[string]map[string]interface{}) {
+			modules[ModuleEdgeHub][keyDesiredProperties] = map[string]interface{}{
+				"schemaVersion": 1.1,
+			}
+		}),
+		Error: "modulesContent: ($edgeHub: (properties.desired: json: " +
+			"cannot unmarshal number into Go struct field " +
+			"EdgeHubDesired.schemaVersion of type string.).).",
+	}, {
+		Name: "error, invalid edge hub",
+		Content: edgeContent(func(modules map[string]map[string]interface{}) {
+			modules[ModuleEdgeHub][keyDesiredProperties] = map[string]interface{}{
+				"schemaVersion": "1.1",
+			}
+		}),
+		Error: "modulesContent: ($edgeHub: (properties.desired: (" +
+			"routes: is required; storeAndForwardConfiguration: cannot " +
+			"be blank.).).).",
+	}}
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			err := tc.Content.Validate()
+			if tc.Error != "" {
+				assert.EqualError(t, err, tc.Error)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package iothub
+
+import (
+	"time"
+
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+)
+
+// MaxJobsPageSize is the maximum number of jobs returned by a single jobs
+// query request.
+const MaxJobsPageSize = 100
+
+// JobType is the type of a job running on a set of devices in the IoT Hub.
+type JobType string
+
+const (
+	JobTypeUpdateTwin   JobType = "scheduleUpdateTwin"
+	JobTypeDeviceMethod JobType = "scheduleDeviceMethod"
+)
+
+var validateJobType = validation.In(
+	JobTypeUpdateTwin,
+	JobTypeDeviceMethod,
+)
+
+func (typ JobType) Validate() error {
+	return validateJobType.Validate(typ)
+}
+
+// JobStatus is the status of a job as reported by the IoT Hub.
+type JobStatus string
+
+const (
+	JobStatusUnknown   JobStatus = "unknown"
+	JobStatusEnqueued  JobStatus = "enqueued"
+	JobStatusScheduled JobStatus = "scheduled"
+	JobStatusQueued    JobStatus = "queued"
+	JobStatusRunning   JobStatus = "running"
+	JobStatusCompleted JobStatus = "completed"
+	JobStatusFailed    JobStatus = "failed"
+	JobStatusCancelled JobStatus = "cancelled"
+)
+
+var validateJobStatus = validation.In(
+	JobStatusUnknown,
+	JobStatusEnqueued,
+	JobStatusScheduled,
+	JobStatusQueued,
+	JobStatusRunning,
+	JobStatusCompleted,
+	JobStatusFailed,
+	JobStatusCancelled,
+)
+
+func (status JobStatus) Validate() error {
+	return validateJobStatus.Validate(status)
+}
+
+// JobTwin is the twin patch applied to the devices by a twin update job.
+type JobTwin struct {
+	// ETag must be "*", the twins are updated regardless of their
+	// version. It defaults to "*" when the job is scheduled.
+	ETag       string                 `json:"etag"`
+	Tags       map[string]interface{} `json:"tags,omitempty"`
+	Properties *UpdateProperties      `json:"properties,omitempty"`
+}
+
+func (twin JobTwin) Validate() error {
+	return validation.ValidateStruct(&twin,
+		validation.Field(&twin.Tags,
+			validation.When(twin.Properties == nil, validation.Required),
+		),
+	)
+}
+
+// JobStatistics counts the devices targeted by a job by outcome.
+type JobStatistics struct {
+	DeviceCount    int `json:"deviceCount"`
+	FailedCount    int `json:"failedCount"`
+	SucceededCount int `json:"succeededCount"`
+	RunningCount   int `json:"runningCount"`
+	PendingCount   int `json:"pendingCount"`
+}
+
+// Job is a twin update or a direct method invocation scheduled on the
+// devices matching the query condition.
+type Job struct {
+	JobID string  `json:"jobId"`
+	Type  JobType `json:"type"`
+	// QueryCondition is the IoT Hub SQL condition selecting the devices,
+	// see Query.Condition.
+	QueryCondition string `json:"queryCondition"`
+
+	// CloudToDeviceMethod is the method invoked by a device method job.
+	CloudToDeviceMethod *DirectMethod `json:"cloudToDeviceMethod,omitempty"`
+	// UpdateTwin is the patch applied by a twin update job.
+	UpdateTwin *JobTwin `json:"updateTwin,omitempty"`
+
+	// StartTime is the time the job starts at, it defaults to the time
+	// the job is scheduled.
+	StartTime *time.Time `json:"startTime,omitempty"`
+	// MaxExecutionTime is the time in seconds the job may run for.
+	MaxExecutionTime int `json:"maxExecutionTimeInSeconds,omitempty"`
+
+	// The following fields are reported by the IoT Hub.
+	Status        JobStatus      `json:"status,omitempty"`
+	CreatedTime   *time.Time     `json:"createdTime,omitempty"`
+	EndTime       *time.Time     `json:"endTime,omitempty"`
+	FailureReason string         `json:"failureReason,omitempty"`
+	StatusMessage string         `json:"statusMessage,omitempty"`
+	Statistics    *JobStatistics `json:"deviceJobStatistics,omitempty"`
+}
+
+// Validate validates the job to schedule.
+func (job Job) Validate() error {
+	return validation.ValidateStruct(&job,
+		validation.Field(&job.JobID, validation.Required),
+		validation.Field(&job.Type, validation.Required),
+		validation.Field(&job.QueryCondition, validation.Required),
+		validation.Field(&job.CloudToDeviceMethod,
+			validation.When(job.Type == JobTypeDeviceMethod,
+				validation.Required,
+			).Else(validation.Nil),
+		),
+		validation.Field(&job.UpdateTwin,
+			validation.When(job.Type == JobTypeUpdateTwin,
+				validation.Required,
+			).Else(validation.Nil),
+		),
+		validation.Field(&job.MaxExecutionTime, validation.Min(0)),
+	)
+}
+
+// JobFilter selects the jobs returned by a jobs query, zero fields match all
+// jobs.
+type JobFilter struct {
+	Type   JobType
+	Status JobStatus
+	// PageSize is the maximum number of jobs per page, up to
+	// MaxJobsPageSize.
+	PageSize int
+}
+
+func (f JobFilter) Validate() error {
+	return validation.ValidateStruct(&f,
+		validation.Field(&f.Type),
+		validation.Field(&f.Status),
+		validation.Field(&f.PageSize,
+			validation.Min(0),
+			validation.Max(MaxJobsPageSize),
+		),
+	)
+}
+
+// JobsPage is a page of the result of a jobs query.
+type JobsPage struct {
+	Jobs []Job `json:"items"`
+	// ContinuationToken is the token to retrieve the next page, it is
+	// empty on the last page.
+	ContinuationToken string `json:"continuationToken,omitempty"`
+}
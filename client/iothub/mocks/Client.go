@@ -30,6 +30,80 @@ type Client struct {
 	mock.Mock
 }
 
+// ApplyConfigurationContent provides a mock function with given fields: ctx, cs, id, content
+func (_m *Client) ApplyConfigurationContent(ctx context.Context, cs *model.ConnectionString, id string, content *iothub.ConfigurationContent) error {
+	ret := _m.Called(ctx, cs, id, content)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, *model.ConnectionString, string, *iothub.ConfigurationContent) error); ok {
+		r0 = rf(ctx, cs, id, content)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// BulkDevices provides a mock function with given fields: ctx, cs, devices
+func (_m *Client) BulkDevices(ctx context.Context, cs *model.ConnectionString, devices []*iothub.BulkDevice) (*iothub.BulkResult, error) {
+	ret := _m.Called(ctx, cs, devices)
+
+	var r0 *iothub.BulkResult
+	if rf, ok := ret.Get(0).(func(context.Context, *model.ConnectionString, []*iothub.BulkDevice) *iothub.BulkResult); ok {
+		r0 = rf(ctx, cs, devices)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*iothub.BulkResult)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, *model.ConnectionString, []*iothub.BulkDevice) error); ok {
+		r1 = rf(ctx, cs, devices)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// CancelJob provides a mock function with given fields: ctx, cs, id
+func (_m *Client) CancelJob(ctx context.Context, cs *model.ConnectionString, id string) (*iothub.Job, error) {
+	ret := _m.Called(ctx, cs, id)
+
+	var r0 *iothub.Job
+	if rf, ok := ret.Get(0).(func(context.Context, *model.ConnectionString, string) *iothub.Job); ok {
+		r0 = rf(ctx, cs, id)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*iothub.Job)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, *model.ConnectionString, string) error); ok {
+		r1 = rf(ctx, cs, id)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// DeleteConfiguration provides a mock function with given fields: ctx, cs, id, etag
+func (_m *Client) DeleteConfiguration(ctx context.Context, cs *model.ConnectionString, id string, etag string) error {
+	ret := _m.Called(ctx, cs, id, etag)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, *model.ConnectionString, string, string) error); ok {
+		r0 = rf(ctx, cs, id, etag)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 // DeleteDevice provides a mock function with given fields: ctx, cs, id
 func (_m *Client) DeleteDevice(ctx context.Context, cs *model.ConnectionString, id string) error {
 	ret := _m.Called(ctx, cs, id)
@@ -44,6 +118,66 @@ func (_m *Client) DeleteDevice(ctx context.Context, cs *model.ConnectionString,
 	return r0
 }
 
+// DeleteModule provides a mock function with given fields: ctx, cs, id, moduleID
+func (_m *Client) DeleteModule(ctx context.Context, cs *model.ConnectionString, id string, moduleID string) error {
+	ret := _m.Called(ctx, cs, id, moduleID)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, *model.ConnectionString, string, string) error); ok {
+		r0 = rf(ctx, cs, id, moduleID)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// GetConfiguration provides a mock function with given fields: ctx, cs, id
+func (_m *Client) GetConfiguration(ctx context.Context, cs *model.ConnectionString, id string) (*iothub.Configuration, error) {
+	ret := _m.Called(ctx, cs, id)
+
+	var r0 *iothub.Configuration
+	if rf, ok := ret.Get(0).(func(context.Context, *model.ConnectionString, string) *iothub.Configuration); ok {
+		r0 = rf(ctx, cs, id)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*iothub.Configuration)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, *model.ConnectionString, string) error); ok {
+		r1 = rf(ctx, cs, id)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetConfigurations provides a mock function with given fields: ctx, cs, top
+func (_m *Client) GetConfigurations(ctx context.Context, cs *model.ConnectionString, top int) ([]iothub.Configuration, error) {
+	ret := _m.Called(ctx, cs, top)
+
+	var r0 []iothub.Configuration
+	if rf, ok := ret.Get(0).(func(context.Context, *model.ConnectionString, int) []iothub.Configuration); ok {
+		r0 = rf(ctx, cs, top)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]iothub.Configuration)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, *model.ConnectionString, int) error); ok {
+		r1 = rf(ctx, cs, top)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // GetDevice provides a mock function with given fields: ctx, cs, id
 func (_m *Client) GetDevice(ctx context.Context, cs *model.ConnectionString, id string) (*iothub.Device, error) {
 	ret := _m.Called(ctx, cs, id)
@@ -90,13 +224,13 @@ func (_m *Client) GetDeviceTwin(ctx context.Context, cs *model.ConnectionString,
 	return r0, r1
 }
 
-// GetDeviceTwins provides a mock function with given fields: ctx, cs
-func (_m *Client) GetDeviceTwins(ctx context.Context, cs *model.ConnectionString) (iothub.Cursor, error) {
-	ret := _m.Called(ctx, cs)
+// GetDeviceTwins provides a mock function with given fields: ctx, cs, q
+func (_m *Client) GetDeviceTwins(ctx context.Context, cs *model.ConnectionString, q *iothub.Query) (iothub.Cursor, error) {
+	ret := _m.Called(ctx, cs, q)
 
 	var r0 iothub.Cursor
-	if rf, ok := ret.Get(0).(func(context.Context, *model.ConnectionString) iothub.Cursor); ok {
-		r0 = rf(ctx, cs)
+	if rf, ok := ret.Get(0).(func(context.Context, *model.ConnectionString, *iothub.Query) iothub.Cursor); ok {
+		r0 = rf(ctx, cs, q)
 	} else {
 		if ret.Get(0) != nil {
 			r0 = ret.Get(0).(iothub.Cursor)
@@ -104,8 +238,215 @@ func (_m *Client) GetDeviceTwins(ctx context.Context, cs *model.ConnectionString
 	}
 
 	var r1 error
-	if rf, ok := ret.Get(1).(func(context.Context, *model.ConnectionString) error); ok {
-		r1 = rf(ctx, cs)
+	if rf, ok := ret.Get(1).(func(context.Context, *model.ConnectionString, *iothub.Query) error); ok {
+		r1 = rf(ctx, cs, q)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetJob provides a mock function with given fields: ctx, cs, id
+func (_m *Client) GetJob(ctx context.Context, cs *model.ConnectionString, id string) (*iothub.Job, error) {
+	ret := _m.Called(ctx, cs, id)
+
+	var r0 *iothub.Job
+	if rf, ok := ret.Get(0).(func(context.Context, *model.ConnectionString, string) *iothub.Job); ok {
+		r0 = rf(ctx, cs, id)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*iothub.Job)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, *model.ConnectionString, string) error); ok {
+		r1 = rf(ctx, cs, id)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetModule provides a mock function with given fields: ctx, cs, id, moduleID
+func (_m *Client) GetModule(ctx context.Context, cs *model.ConnectionString, id string, moduleID string) (*iothub.Module, error) {
+	ret := _m.Called(ctx, cs, id, moduleID)
+
+	var r0 *iothub.Module
+	if rf, ok := ret.Get(0).(func(context.Context, *model.ConnectionString, string, string) *iothub.Module); ok {
+		r0 = rf(ctx, cs, id, moduleID)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*iothub.Module)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, *model.ConnectionString, string, string) error); ok {
+		r1 = rf(ctx, cs, id, moduleID)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetModuleTwin provides a mock function with given fields: ctx, cs, id, moduleID
+func (_m *Client) GetModuleTwin(ctx context.Context, cs *model.ConnectionString, id string, moduleID string) (*iothub.DeviceTwin, error) {
+	ret := _m.Called(ctx, cs, id, moduleID)
+
+	var r0 *iothub.DeviceTwin
+	if rf, ok := ret.Get(0).(func(context.Context, *model.ConnectionString, string, string) *iothub.DeviceTwin); ok {
+		r0 = rf(ctx, cs, id, moduleID)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*iothub.DeviceTwin)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, *model.ConnectionString, string, string) error); ok {
+		r1 = rf(ctx, cs, id, moduleID)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetModules provides a mock function with given fields: ctx, cs, id
+func (_m *Client) GetModules(ctx context.Context, cs *model.ConnectionString, id string) ([]iothub.Module, error) {
+	ret := _m.Called(ctx, cs, id)
+
+	var r0 []iothub.Module
+	if rf, ok := ret.Get(0).(func(context.Context, *model.ConnectionString, string) []iothub.Module); ok {
+		r0 = rf(ctx, cs, id)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]iothub.Module)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, *model.ConnectionString, string) error); ok {
+		r1 = rf(ctx, cs, id)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// InvokeDeviceMethod provides a mock function with given fields: ctx, cs, id, method
+func (_m *Client) InvokeDeviceMethod(ctx context.Context, cs *model.ConnectionString, id string, method *iothub.DirectMethod) (*iothub.MethodResult, error) {
+	ret := _m.Called(ctx, cs, id, method)
+
+	var r0 *iothub.MethodResult
+	if rf, ok := ret.Get(0).(func(context.Context, *model.ConnectionString, string, *iothub.DirectMethod) *iothub.MethodResult); ok {
+		r0 = rf(ctx, cs, id, method)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*iothub.MethodResult)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, *model.ConnectionString, string, *iothub.DirectMethod) error); ok {
+		r1 = rf(ctx, cs, id, method)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// InvokeModuleMethod provides a mock function with given fields: ctx, cs, id, moduleID, method
+func (_m *Client) InvokeModuleMethod(ctx context.Context, cs *model.ConnectionString, id string, moduleID string, method *iothub.DirectMethod) (*iothub.MethodResult, error) {
+	ret := _m.Called(ctx, cs, id, moduleID, method)
+
+	var r0 *iothub.MethodResult
+	if rf, ok := ret.Get(0).(func(context.Context, *model.ConnectionString, string, string, *iothub.DirectMethod) *iothub.MethodResult); ok {
+		r0 = rf(ctx, cs, id, moduleID, method)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*iothub.MethodResult)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, *model.ConnectionString, string, string, *iothub.DirectMethod) error); ok {
+		r1 = rf(ctx, cs, id, moduleID, method)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// QueryDeviceTwins provides a mock function with given fields: ctx, cs, q, contToken
+func (_m *Client) QueryDeviceTwins(ctx context.Context, cs *model.ConnectionString, q *iothub.Query, contToken string) (*iothub.QueryPage, error) {
+	ret := _m.Called(ctx, cs, q, contToken)
+
+	var r0 *iothub.QueryPage
+	if rf, ok := ret.Get(0).(func(context.Context, *model.ConnectionString, *iothub.Query, string) *iothub.QueryPage); ok {
+		r0 = rf(ctx, cs, q, contToken)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*iothub.QueryPage)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, *model.ConnectionString, *iothub.Query, string) error); ok {
+		r1 = rf(ctx, cs, q, contToken)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// QueryJobs provides a mock function with given fields: ctx, cs, fltr, contToken
+func (_m *Client) QueryJobs(ctx context.Context, cs *model.ConnectionString, fltr iothub.JobFilter, contToken string) (*iothub.JobsPage, error) {
+	ret := _m.Called(ctx, cs, fltr, contToken)
+
+	var r0 *iothub.JobsPage
+	if rf, ok := ret.Get(0).(func(context.Context, *model.ConnectionString, iothub.JobFilter, string) *iothub.JobsPage); ok {
+		r0 = rf(ctx, cs, fltr, contToken)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*iothub.JobsPage)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, *model.ConnectionString, iothub.JobFilter, string) error); ok {
+		r1 = rf(ctx, cs, fltr, contToken)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// ScheduleJob provides a mock function with given fields: ctx, cs, job
+func (_m *Client) ScheduleJob(ctx context.Context, cs *model.ConnectionString, job *iothub.Job) (*iothub.Job, error) {
+	ret := _m.Called(ctx, cs, job)
+
+	var r0 *iothub.Job
+	if rf, ok := ret.Get(0).(func(context.Context, *model.ConnectionString, *iothub.Job) *iothub.Job); ok {
+		r0 = rf(ctx, cs, job)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*iothub.Job)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, *model.ConnectionString, *iothub.Job) error); ok {
+		r1 = rf(ctx, cs, job)
 	} else {
 		r1 = ret.Error(1)
 	}
@@ -127,6 +468,43 @@ func (_m *Client) UpdateDeviceTwin(ctx context.Context, cs *model.ConnectionStri
 	return r0
 }
 
+// UpdateModuleTwin provides a mock function with given fields: ctx, cs, id, moduleID, r
+func (_m *Client) UpdateModuleTwin(ctx context.Context, cs *model.ConnectionString, id string, moduleID string, r *iothub.DeviceTwinUpdate) error {
+	ret := _m.Called(ctx, cs, id, moduleID, r)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, *model.ConnectionString, string, string, *iothub.DeviceTwinUpdate) error); ok {
+		r0 = rf(ctx, cs, id, moduleID, r)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// UpsertConfiguration provides a mock function with given fields: ctx, cs, config
+func (_m *Client) UpsertConfiguration(ctx context.Context, cs *model.ConnectionString, config *iothub.Configuration) (*iothub.Configuration, error) {
+	ret := _m.Called(ctx, cs, config)
+
+	var r0 *iothub.Configuration
+	if rf, ok := ret.Get(0).(func(context.Context, *model.ConnectionString, *iothub.Configuration) *iothub.Configuration); ok {
+		r0 = rf(ctx, cs, config)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*iothub.Configuration)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, *model.ConnectionString, *iothub.Configuration) error); ok {
+		r1 = rf(ctx, cs, config)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // UpsertDevice provides a mock function with given fields: ctx, cs, id, deviceUpdate
 func (_m *Client) UpsertDevice(ctx context.Context, cs *model.ConnectionString, id string, deviceUpdate ...*iothub.Device) (*iothub.Device, error) {
 	_va := make([]interface{}, len(deviceUpdate))
@@ -156,3 +534,26 @@ func (_m *Client) UpsertDevice(ctx context.Context, cs *model.ConnectionString,
 
 	return r0, r1
 }
+
+// UpsertModule provides a mock function with given fields: ctx, cs, id, moduleID, module
+func (_m *Client) UpsertModule(ctx context.Context, cs *model.ConnectionString, id string, moduleID string, module *iothub.Module) (*iothub.Module, error) {
+	ret := _m.Called(ctx, cs, id, moduleID, module)
+
+	var r0 *iothub.Module
+	if rf, ok := ret.Get(0).(func(context.Context, *model.ConnectionString, string, string, *iothub.Module) *iothub.Module); ok {
+		r0 = rf(ctx, cs, id, moduleID, module)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*iothub.Module)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, *model.ConnectionString, string, string, *iothub.Module) error); ok {
+		r1 = rf(ctx, cs, id, moduleID, module)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
@@ -24,8 +24,8 @@ import (
 	"net/http"
 	"reflect"
 	"sync"
-	"time"
 
+	common "github.com/mendersoftware/iot-manager/client"
 	"github.com/mendersoftware/iot-manager/model"
 
 	validation "github.com/go-ozzo/ozzo-validation/v4"
@@ -57,7 +57,7 @@ const (
 )
 
 type Auth struct {
-	Type            AuthType
+	Type            AuthType `json:"type"`
 	*SymmetricKey   `json:"symmetricKey,omitempty"`
 	*X509ThumbPrint `json:"x509Thumbprint,omitempty"`
 }
@@ -102,6 +102,22 @@ func (s Status) Validate() error {
 	return validateStatus.Validate(s)
 }
 
+type ConnectionState string
+
+const (
+	ConnectionStateConnected    ConnectionState = "Connected"
+	ConnectionStateDisconnected ConnectionState = "Disconnected"
+)
+
+var validateConnectionState = validation.In(
+	ConnectionStateConnected,
+	ConnectionStateDisconnected,
+)
+
+func (s ConnectionState) Validate() error {
+	return validateConnectionState.Validate(s)
+}
+
 type DeviceCapabilities struct {
 	IOTEdge bool `json:"iotEdge"`
 }
@@ -113,7 +129,7 @@ type TwinProperties struct {
 
 type X509ThumbPrint struct {
 	Primary   string `json:"primaryThumbprint"`
-	Secondary string `json:"secondaryThumbprint"`
+	Secondary string `json:"secondaryThumbprint,omitempty"`
 }
 
 type Device struct {
@@ -123,14 +139,17 @@ type Device struct {
 	ConnectionState        string `json:"connectionState,omitempty"`
 	ConnectionStateUpdated string `json:"connectionStateUpdatedTime,omitempty"`
 
-	DeviceID         string `json:"deviceId"`
-	DeviceScope      string `json:"deviceScope,omitempty"`
-	ETag             string `json:"etag,omitempty"`
-	GenerationID     string `json:"generationId,omitempty"`
-	LastActivityTime string `json:"lastActivityTime,omitempty"`
-	Status           Status `json:"status,omitempty"`
-	StatusReason     string `json:"statusReason,omitempty"`
-	StatusUpdateTime string `json:"statusUpdateTime,omitempty"`
+	DeviceID    string `json:"deviceId"`
+	DeviceScope string `json:"deviceScope,omitempty"`
+	// ParentScopes holds the scope of the parent IoT Edge device of a
+	// downstream device.
+	ParentScopes     []string `json:"parentScopes,omitempty"`
+	ETag             string   `json:"etag,omitempty"`
+	GenerationID     string   `json:"generationId,omitempty"`
+	LastActivityTime string   `json:"lastActivityTime,omitempty"`
+	Status           Status   `json:"status,omitempty"`
+	StatusReason     string   `json:"statusReason,omitempty"`
+	StatusUpdateTime string   `json:"statusUpdateTime,omitempty"`
 }
 
 func mergeDevices(devices ...*Device) *Device {
@@ -161,6 +180,23 @@ func mergeDevices(devices ...*Device) *Device {
 	return device
 }
 
+// Module is a module identity of a device.
+type Module struct {
+	*Auth                  `json:"authentication,omitempty"`
+	C2DMessageCount        int    `json:"cloudToDeviceMessageCount,omitempty"`
+	ConnectionState        string `json:"connectionState,omitempty"`
+	ConnectionStateUpdated string `json:"connectionStateUpdatedTime,omitempty"`
+
+	DeviceID         string `json:"deviceId"`
+	ModuleID         string `json:"moduleId"`
+	ETag             string `json:"etag,omitempty"`
+	GenerationID     string `json:"generationId,omitempty"`
+	LastActivityTime string `json:"lastActivityTime,omitempty"`
+	// ManagedBy identifies the service managing the module, e.g. "IotEdge"
+	// for the modules deployed by the IoT Edge runtime.
+	ManagedBy string `json:"managedBy,omitempty"`
+}
+
 type DeviceTwin struct {
 	AuthenticationType string              `json:"authenticationType,omitempty"`
 	Capabilities       *DeviceCapabilities `json:"capabilities,omitempty"`
@@ -193,6 +229,156 @@ type DeviceTwinUpdate struct {
 	Replace    bool                   `json:"-"`
 }
 
+// MaxBulkDevices is the maximum number of operations accepted by a single
+// bulk registry request.
+const MaxBulkDevices = 100
+
+type ImportMode string
+
+const (
+	ImportModeCreate            ImportMode = "create"
+	ImportModeUpdate            ImportMode = "update"
+	ImportModeUpdateIfMatchETag ImportMode = "updateIfMatchETag"
+	ImportModeDelete            ImportMode = "delete"
+	ImportModeDeleteIfMatchETag ImportMode = "deleteIfMatchETag"
+)
+
+// BulkDevice is a single operation of a bulk registry request.
+type BulkDevice struct {
+	*Auth               `json:"authentication,omitempty"`
+	*DeviceCapabilities `json:"capabilities,omitempty"`
+
+	DeviceID     string                 `json:"id"`
+	ETag         string                 `json:"eTag,omitempty"`
+	ImportMode   ImportMode             `json:"importMode"`
+	Status       Status                 `json:"status,omitempty"`
+	StatusReason string                 `json:"statusReason,omitempty"`
+	Tags         map[string]interface{} `json:"tags,omitempty"`
+}
+
+// Error codes reported for the operations of a bulk registry request.
+const (
+	ErrorCodeDeviceAlreadyExists = "DeviceAlreadyExists"
+	ErrorCodeDeviceNotFound      = "DeviceNotFound"
+)
+
+// BulkError describes an operation of a bulk registry request that failed.
+type BulkError struct {
+	DeviceID    string `json:"deviceId"`
+	ModuleID    string `json:"moduleId,omitempty"`
+	ErrorCode   string `json:"errorCode"`
+	ErrorStatus string `json:"errorStatus"`
+	Operation   string `json:"operation,omitempty"`
+}
+
+func (err BulkError) Error() string {
+	return "iothub: " + err.ErrorCode + ": " + err.ErrorStatus
+}
+
+type BulkResult struct {
+	IsSuccessful bool        `json:"isSuccessful"`
+	Errors       []BulkError `json:"errors"`
+	Warnings     []BulkError `json:"warnings"`
+}
+
+// Bounds of the timeouts of a direct method invocation in seconds.
+const (
+	MinMethodResponseTimeout = 5
+	MaxMethodTimeout         = 300
+)
+
+// DirectMethod is the invocation of a direct method on a device or module.
+type DirectMethod struct {
+	Name    string          `json:"methodName"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+	// ResponseTimeout is the time in seconds to wait for the result of
+	// the method, the hub waits 30 seconds if zero.
+	ResponseTimeout int `json:"responseTimeoutInSeconds,omitempty"`
+	// ConnectTimeout is the time in seconds to wait for the device to
+	// connect, the invocation fails right away if the device is offline
+	// and the timeout is zero.
+	ConnectTimeout int `json:"connectTimeoutInSeconds,omitempty"`
+}
+
+var validateJSON = validation.By(func(v interface{}) error {
+	if b, _ := v.(json.RawMessage); len(b) > 0 && !json.Valid(b) {
+		return errors.New("must be valid JSON")
+	}
+	return nil
+})
+
+func (m DirectMethod) Validate() error {
+	return validation.ValidateStruct(&m,
+		validation.Field(&m.Name, validation.Required),
+		validation.Field(&m.Payload, validateJSON),
+		validation.Field(&m.ResponseTimeout,
+			validation.Min(MinMethodResponseTimeout),
+			validation.Max(MaxMethodTimeout),
+		),
+		validation.Field(&m.ConnectTimeout,
+			validation.Min(0),
+			validation.Max(MaxMethodTimeout),
+		),
+	)
+}
+
+// MethodResult is the result of a direct method returned by the device.
+type MethodResult struct {
+	Status  int             `json:"status"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// TagMender is the tag set on the devices provisioned by Mender.
+const TagMender = "mender"
+
+// DeviceTwinFilter selects device twins, zero fields match all devices.
+type DeviceTwinFilter struct {
+	Status          Status
+	ConnectionState ConnectionState
+	// Mender, if set, selects the devices with (true) or without (false)
+	// the mender tag.
+	Mender *bool
+}
+
+func (f DeviceTwinFilter) Validate() error {
+	return validation.ValidateStruct(&f,
+		validation.Field(&f.Status),
+		validation.Field(&f.ConnectionState),
+	)
+}
+
+// Query returns the query selecting the devices matching the filter.
+func (f DeviceTwinFilter) Query() *Query {
+	q := NewQuery()
+	if f.Status != "" {
+		q.And(FieldStatus.Eq(string(f.Status)))
+	}
+	if f.ConnectionState != "" {
+		q.And(FieldConnectionState.Eq(string(f.ConnectionState)))
+	}
+	if f.Mender != nil {
+		if *f.Mender {
+			q.And(Tag(TagMender).Eq(true))
+		} else {
+			q.And(AnyOf(
+				Tag(TagMender).NotDefined(),
+				Tag(TagMender).Ne(true),
+			))
+		}
+	}
+	return q
+}
+
+// QueryPage is a page of the result of a device twin query.
+type QueryPage struct {
+	// Items are the device twins, or the selected fields of the device
+	// twins if the query has a projection.
+	Items []json.RawMessage
+	// ContinuationToken is the token to retrieve the next page, it is empty
+	// on the last page.
+	ContinuationToken string
+}
+
 type Cursor interface {
 	Next(ctx context.Context) bool
 	Decode(v interface{}) error
@@ -203,7 +389,7 @@ type cursor struct {
 	buf     bytes.Buffer
 	mut     *sync.Mutex
 	cs      *model.ConnectionString
-	client  *http.Client
+	client  *client
 	req     *http.Request
 	dec     *json.Decoder
 	current json.RawMessage
@@ -213,23 +399,14 @@ func (cur *cursor) fetchPage(ctx context.Context) error {
 	cur.buf.Reset()
 	req := cur.req.WithContext(ctx)
 	req.Body, _ = cur.req.GetBody()
-	var expireAt time.Time
-	if dl, ok := ctx.Deadline(); ok {
-		expireAt = dl
-	} else {
-		expireAt = time.Now().Add(defaultTTL)
-	}
-	req.Header.Set(hdrKeyAuthorization, cur.cs.Authorization(expireAt))
-	rsp, err := cur.client.Do(req)
+	setAuthorization(req, cur.cs)
+	rsp, err := cur.client.do(req, cur.cs, true)
 	if err != nil {
 		return errors.Wrap(err, "iothub: failed to execute request")
 	}
 	defer rsp.Body.Close()
 	if rsp.StatusCode >= 400 {
-		return errors.Wrapf(err,
-			"iothub: received unexpected status code from server: %s",
-			rsp.Status,
-		)
+		return common.NewHTTPError("iothub", rsp)
 	}
 	_, err = io.Copy(&cur.buf, rsp.Body)
 	if err != nil {
@@ -241,7 +418,7 @@ func (cur *cursor) fetchPage(ctx context.Context) error {
 	if err != nil {
 		return errors.Wrap(err, "iothub: failed to decode response from hub")
 	} else if tkn != json.Delim('[') {
-		return errors.Wrap(err, "iothub: unexpected json response from hub")
+		return errors.New("iothub: unexpected json response from hub")
 	}
 	return nil
 }
@@ -0,0 +1,394 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package iothub
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/pkg/errors"
+)
+
+const (
+	// MaxQueryPageSize is the maximum number of twins returned by a single
+	// query request.
+	MaxQueryPageSize = 100
+	// MaxQueryConditions is the maximum number of conditions of a query,
+	// including the nested conditions.
+	MaxQueryConditions = 20
+)
+
+var (
+	ErrInvalidQueryField = errors.New("invalid field")
+	ErrInvalidQueryValue = errors.New(
+		"invalid value: must be a string, a number or a boolean",
+	)
+	ErrTooManyConditions = errors.Errorf(
+		"too many conditions: the maximum is %d", MaxQueryConditions,
+	)
+)
+
+// Field is the path of a device twin field in a query.
+type Field string
+
+const (
+	FieldDeviceID         Field = "deviceId"
+	FieldStatus           Field = "status"
+	FieldConnectionState  Field = "connectionState"
+	FieldLastActivityTime Field = "lastActivityTime"
+	FieldTags             Field = "tags"
+	FieldDesired          Field = "properties.desired"
+	FieldReported         Field = "properties.reported"
+)
+
+// queryFields are the fields that can be used in a query, besides the
+// nested fields of the tags and of the desired and reported properties.
+var queryFields = map[Field]struct{}{
+	FieldDeviceID:               {},
+	FieldStatus:                 {},
+	FieldConnectionState:        {},
+	FieldLastActivityTime:       {},
+	FieldTags:                   {},
+	FieldDesired:                {},
+	FieldReported:               {},
+	"moduleId":                  {},
+	"etag":                      {},
+	"deviceEtag":                {},
+	"statusReason":              {},
+	"statusUpdateTime":          {},
+	"authenticationType":        {},
+	"cloudToDeviceMessageCount": {},
+	"capabilities.iotEdge":      {},
+	"deviceScope":               {},
+	"version":                   {},
+}
+
+var identifierRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Tag returns the field of the tag with the given dot-separated path.
+func Tag(path string) Field {
+	return FieldTags + "." + Field(path)
+}
+
+// Desired returns the field of the desired property with the given
+// dot-separated path.
+func Desired(path string) Field {
+	return FieldDesired + "." + Field(path)
+}
+
+// Reported returns the field of the reported property with the given
+// dot-separated path.
+func Reported(path string) Field {
+	return FieldReported + "." + Field(path)
+}
+
+// Validate checks that the field is a known twin field, or a nested field
+// of the tags or properties made of plain identifiers.
+func (f Field) Validate() error {
+	if _, ok := queryFields[f]; ok || f == "" {
+		return nil
+	}
+	for _, root := range []Field{FieldTags, FieldDesired, FieldReported} {
+		prefix := string(root) + "."
+		if !strings.HasPrefix(string(f), prefix) {
+			continue
+		}
+		for _, name := range strings.Split(string(f)[len(prefix):], ".") {
+			if !identifierRegex.MatchString(name) {
+				return ErrInvalidQueryField
+			}
+		}
+		return nil
+	}
+	return ErrInvalidQueryField
+}
+
+func (f Field) Eq(value interface{}) Condition {
+	return Condition{Field: f, Op: OpEq, Value: value}
+}
+
+func (f Field) Ne(value interface{}) Condition {
+	return Condition{Field: f, Op: OpNe, Value: value}
+}
+
+func (f Field) Lt(value interface{}) Condition {
+	return Condition{Field: f, Op: OpLt, Value: value}
+}
+
+func (f Field) Lte(value interface{}) Condition {
+	return Condition{Field: f, Op: OpLte, Value: value}
+}
+
+func (f Field) Gt(value interface{}) Condition {
+	return Condition{Field: f, Op: OpGt, Value: value}
+}
+
+func (f Field) Gte(value interface{}) Condition {
+	return Condition{Field: f, Op: OpGte, Value: value}
+}
+
+func (f Field) Defined() Condition {
+	return Condition{Field: f, Op: OpDefined}
+}
+
+func (f Field) NotDefined() Condition {
+	return Condition{Field: f, Op: OpNotDefined}
+}
+
+// Operator compares a field with the value of a condition.
+type Operator string
+
+const (
+	OpEq         Operator = "eq"
+	OpNe         Operator = "ne"
+	OpLt         Operator = "lt"
+	OpLte        Operator = "lte"
+	OpGt         Operator = "gt"
+	OpGte        Operator = "gte"
+	OpDefined    Operator = "defined"
+	OpNotDefined Operator = "not_defined"
+)
+
+var sqlOperators = map[Operator]string{
+	OpEq:  "=",
+	OpNe:  "!=",
+	OpLt:  "<",
+	OpLte: "<=",
+	OpGt:  ">",
+	OpGte: ">=",
+}
+
+var validateOperator = validation.In(
+	OpEq, OpNe, OpLt, OpLte, OpGt, OpGte, OpDefined, OpNotDefined,
+)
+
+func (op Operator) Validate() error {
+	return validateOperator.Validate(op)
+}
+
+// Condition selects the devices where the field compares to the value, or
+// if Any is set, where any of the nested conditions is true.
+type Condition struct {
+	Field Field       `json:"field,omitempty"`
+	Op    Operator    `json:"op,omitempty"`
+	Value interface{} `json:"value,omitempty"`
+
+	Any []Condition `json:"any,omitempty"`
+}
+
+// AnyOf returns a condition that is true if any of the conditions is true.
+func AnyOf(conds ...Condition) Condition {
+	return Condition{Any: conds}
+}
+
+func (c Condition) Validate() error {
+	if len(c.Any) > 0 {
+		return validation.ValidateStruct(&c,
+			validation.Field(&c.Field, validation.Empty),
+			validation.Field(&c.Op, validation.Empty),
+			validation.Field(&c.Value, validation.Nil),
+			validation.Field(&c.Any),
+		)
+	}
+	return validation.ValidateStruct(&c,
+		validation.Field(&c.Field, validation.Required),
+		validation.Field(&c.Op, validation.Required),
+		validation.Field(&c.Value, validation.When(
+			c.Op == OpDefined || c.Op == OpNotDefined,
+			validation.Nil,
+		).Else(
+			validation.NotNil,
+			validation.By(validateQueryValue),
+		)),
+	)
+}
+
+func validateQueryValue(value interface{}) error {
+	switch v := value.(type) {
+	case string:
+		if !utf8.ValidString(v) {
+			return errors.New("invalid value: must be valid UTF-8")
+		}
+	case bool, int, int32, int64:
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return ErrInvalidQueryValue
+		}
+	default:
+		return ErrInvalidQueryValue
+	}
+	return nil
+}
+
+// count returns the number of conditions including c.
+func (c Condition) count() int {
+	n := 1
+	for _, cond := range c.Any {
+		n += cond.count()
+	}
+	return n
+}
+
+func (c Condition) writeSQL(b *strings.Builder) {
+	if len(c.Any) > 0 {
+		b.WriteByte('(')
+		for i, cond := range c.Any {
+			if i > 0 {
+				b.WriteString(" OR ")
+			}
+			cond.writeSQL(b)
+		}
+		b.WriteByte(')')
+		return
+	}
+	switch c.Op {
+	case OpDefined:
+		b.WriteString("IS_DEFINED(" + string(c.Field) + ")")
+	case OpNotDefined:
+		b.WriteString("NOT IS_DEFINED(" + string(c.Field) + ")")
+	default:
+		b.WriteString(string(c.Field) + " " + sqlOperators[c.Op] + " ")
+		writeSQLValue(b, c.Value)
+	}
+}
+
+func writeSQLValue(b *strings.Builder, value interface{}) {
+	switch v := value.(type) {
+	case string:
+		writeSQLString(b, v)
+	case bool:
+		b.WriteString(strconv.FormatBool(v))
+	case int:
+		b.WriteString(strconv.Itoa(v))
+	case int32:
+		b.WriteString(strconv.FormatInt(int64(v), 10))
+	case int64:
+		b.WriteString(strconv.FormatInt(v, 10))
+	case float64:
+		b.WriteString(strconv.FormatFloat(v, 'g', -1, 64))
+	}
+}
+
+// writeSQLString writes s as a single-quoted string literal, escaping the
+// quotes, the backslashes and the control characters.
+func writeSQLString(b *strings.Builder, s string) {
+	b.WriteByte('\'')
+	for _, r := range s {
+		switch {
+		case r == '\'' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r < 0x20 || r == 0x7f:
+			fmt.Fprintf(b, `\u%04x`, r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteByte('\'')
+}
+
+// Query is a device twin query. The query is built from validated fields
+// and escaped values, raw IoT Hub SQL is never accepted.
+type Query struct {
+	// Select lists the fields to return, all fields if empty.
+	Select []Field `json:"select,omitempty"`
+	// Where lists the conditions the devices must all match.
+	Where []Condition `json:"where,omitempty"`
+	// PageSize is the maximum number of devices per page, up to
+	// MaxQueryPageSize.
+	PageSize int `json:"-"`
+}
+
+// NewQuery returns a query selecting all the devices.
+func NewQuery() *Query {
+	return new(Query)
+}
+
+// Fields sets the fields to return.
+func (q *Query) Fields(fields ...Field) *Query {
+	q.Select = fields
+	return q
+}
+
+// And adds conditions the devices must match.
+func (q *Query) And(conds ...Condition) *Query {
+	q.Where = append(q.Where, conds...)
+	return q
+}
+
+func (q *Query) SetPageSize(pageSize int) *Query {
+	q.PageSize = pageSize
+	return q
+}
+
+func (q Query) Validate() error {
+	return validation.ValidateStruct(&q,
+		validation.Field(&q.Select, validation.Each(validation.Required)),
+		validation.Field(&q.Where, validation.By(func(interface{}) error {
+			var n int
+			for _, cond := range q.Where {
+				n += cond.count()
+			}
+			if n > MaxQueryConditions {
+				return ErrTooManyConditions
+			}
+			return nil
+		})),
+		validation.Field(&q.PageSize, validation.Min(0), validation.Max(MaxQueryPageSize)),
+	)
+}
+
+// String returns the IoT Hub SQL of the query, the query must be valid.
+func (q Query) String() string {
+	var b strings.Builder
+	b.WriteString("SELECT ")
+	if len(q.Select) == 0 {
+		b.WriteByte('*')
+	}
+	for i, field := range q.Select {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(string(field))
+	}
+	b.WriteString(" FROM devices")
+	if len(q.Where) > 0 {
+		b.WriteString(" WHERE ")
+		q.writeConditions(&b)
+	}
+	return b.String()
+}
+
+// Condition returns the IoT Hub SQL of the conditions of the query, as used
+// to target the devices of a job. The query must be valid.
+func (q Query) Condition() string {
+	var b strings.Builder
+	q.writeConditions(&b)
+	return b.String()
+}
+
+func (q Query) writeConditions(b *strings.Builder) {
+	for i, cond := range q.Where {
+		if i > 0 {
+			b.WriteString(" AND ")
+		}
+		cond.writeSQL(b)
+	}
+}
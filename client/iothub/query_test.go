@@ -0,0 +1,149 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package iothub
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuery(t *testing.T) {
+	t.Parallel()
+	mender := true
+	testCases := []struct {
+		Name string
+
+		Query *Query
+
+		SQL       string
+		Condition string
+		Error     string
+	}{{
+		Name:  "ok, all devices",
+		Query: NewQuery(),
+		SQL:   "SELECT * FROM devices",
+	}, {
+		Name: "ok, conditions and projection",
+		Query: NewQuery().
+			Fields(FieldDeviceID, Tag("location")).
+			And(
+				Tag("location.region").Eq("eu-west"),
+				Reported("firmware.version").Ne("1.0"),
+				Desired("interval").Gte(30),
+				FieldLastActivityTime.Lt("2021-11-01T00:00:00Z"),
+				AnyOf(
+					Tag("ring").NotDefined(),
+					Tag("ring").Lte(2.5),
+				),
+				Tag("mender").Defined(),
+			),
+		SQL: "SELECT deviceId, tags.location FROM devices WHERE " +
+			"tags.location.region = 'eu-west' AND " +
+			"properties.reported.firmware.version != '1.0' AND " +
+			"properties.desired.interval >= 30 AND " +
+			"lastActivityTime < '2021-11-01T00:00:00Z' AND " +
+			"(NOT IS_DEFINED(tags.ring) OR tags.ring <= 2.5) AND " +
+			"IS_DEFINED(tags.mender)",
+	}, {
+		Name:  "ok, escaped string",
+		Query: NewQuery().And(Tag("name").Eq("x' OR 1=1 --\\\n")),
+		SQL:   `SELECT * FROM devices WHERE tags.name = 'x\' OR 1=1 --\\\u000a'`,
+	}, {
+		Name:  "ok, filter",
+		Query: DeviceTwinFilter{Status: StatusDisabled, Mender: &mender}.Query(),
+		SQL: "SELECT * FROM devices WHERE status = 'disabled' AND " +
+			"tags.mender = true",
+		Condition: "status = 'disabled' AND tags.mender = true",
+	}, {
+		Name:  "error, unknown field",
+		Query: NewQuery().Fields("password"),
+		Error: "select: (0: invalid field.).",
+	}, {
+		Name:  "error, injected field",
+		Query: NewQuery().And(Tag("a = 1 OR tags.b").Eq(true)),
+		Error: "where: (0: (field: invalid field.).).",
+	}, {
+		Name:  "error, invalid operator",
+		Query: NewQuery().And(Condition{Field: FieldStatus, Op: "like", Value: "x"}),
+		Error: "where: (0: (op: must be a valid value.).).",
+	}, {
+		Name:  "error, missing value",
+		Query: NewQuery().And(FieldStatus.Eq(nil)),
+		Error: "where: (0: (value: is required.).).",
+	}, {
+		Name:  "error, invalid value",
+		Query: NewQuery().And(FieldStatus.Eq([]string{"enabled"})),
+		Error: "where: (0: (value: " + ErrInvalidQueryValue.Error() + ".).).",
+	}, {
+		Name:  "error, not a number",
+		Query: NewQuery().And(Desired("x").Eq(math.NaN())),
+		Error: "where: (0: (value: " + ErrInvalidQueryValue.Error() + ".).).",
+	}, {
+		Name: "error, too many conditions",
+		Query: func() *Query {
+			q := NewQuery()
+			for i := 0; i <= MaxQueryConditions; i++ {
+				q.And(Tag("mender").Eq(true))
+			}
+			return q
+		}(),
+		Error: "where: " + ErrTooManyConditions.Error() + ".",
+	}, {
+		Name:  "error, page size",
+		Query: NewQuery().SetPageSize(MaxQueryPageSize + 1),
+		Error: "PageSize: must be no greater than 100.",
+	}}
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			err := tc.Query.Validate()
+			if tc.Error != "" {
+				assert.EqualError(t, err, tc.Error)
+			} else if assert.NoError(t, err) {
+				assert.Equal(t, tc.SQL, tc.Query.String())
+				if tc.Condition != "" {
+					assert.Equal(t, tc.Condition, tc.Query.Condition())
+				}
+			}
+		})
+	}
+}
+
+func TestQueryUnmarshal(t *testing.T) {
+	t.Parallel()
+	var q Query
+	err := json.Unmarshal([]byte(`{
+		"select": ["deviceId"],
+		"where": [
+			{"field": "tags.mender", "op": "eq", "value": true},
+			{"any": [
+				{"field": "properties.reported.version", "op": "lt", "value": 2},
+				{"field": "properties.reported.version", "op": "not_defined"}
+			]}
+		]
+	}`), &q)
+	if assert.NoError(t, err) && assert.NoError(t, q.Validate()) {
+		assert.Equal(t,
+			"SELECT deviceId FROM devices WHERE tags.mender = true AND "+
+				"(properties.reported.version < 2 OR "+
+				"NOT IS_DEFINED(properties.reported.version))",
+			q.String(),
+		)
+	}
+}
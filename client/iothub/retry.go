@@ -0,0 +1,157 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package iothub
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/mendersoftware/iot-manager/model"
+)
+
+const (
+	hdrKeyRetryAfter = "Retry-After"
+
+	defaultMaxRetries = 3
+	defaultMinBackoff = 500 * time.Millisecond
+	defaultMaxBackoff = 10 * time.Second
+)
+
+// setAuthorization signs the request with a shared access signature valid
+// until the request context expires.
+func setAuthorization(req *http.Request, cs *model.ConnectionString) {
+	var expireAt time.Time
+	if dl, ok := req.Context().Deadline(); ok {
+		expireAt = dl
+	} else {
+		expireAt = time.Now().Add(defaultTTL)
+	}
+	req.Header.Set(hdrKeyAuthorization, cs.Authorization(expireAt))
+}
+
+// isRetryable returns true if the request failed due to throttling or a
+// transient error.
+func isRetryable(rsp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	switch rsp.StatusCode {
+	case http.StatusTooManyRequests,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// retryAfter parses the Retry-After header of the response, given either in
+// seconds or as an HTTP date.
+func retryAfter(rsp *http.Response, now time.Time) (time.Duration, bool) {
+	if rsp == nil {
+		return 0, false
+	}
+	value := rsp.Header.Get(hdrKeyRetryAfter)
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if delay := date.Sub(now); delay > 0 {
+			return delay, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// backoff returns the delay before the given retry attempt (starting at 0):
+// the exponential backoff capped at maxBackoff with the upper half jittered.
+func (c *client) backoff(attempt int) time.Duration {
+	delay := c.maxBackoff
+	if attempt < 32 {
+		if d := c.minBackoff << uint(attempt); d > 0 && d < c.maxBackoff {
+			delay = d
+		}
+	}
+	half := delay / 2
+	if half <= 0 {
+		return delay
+	}
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// do executes the request. If idempotent is true, throttled requests and
+// requests failing with transient errors are retried: the delay honours the
+// Retry-After header if present and otherwise backs off exponentially. The
+// request is not retried if the delay would exceed the context deadline. The
+// authorization header is signed again for every attempt.
+func (c *client) do(
+	req *http.Request,
+	cs *model.ConnectionString,
+	idempotent bool,
+) (*http.Response, error) {
+	ctx := req.Context()
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			if req.GetBody != nil {
+				body, err := req.GetBody()
+				if err != nil {
+					return nil, err
+				}
+				req.Body = body
+			}
+			setAuthorization(req, cs)
+		}
+		rsp, err := c.Do(req)
+		if !idempotent || attempt >= c.maxRetries ||
+			ctx.Err() != nil || !isRetryable(rsp, err) {
+			return rsp, err
+		}
+		now := time.Now()
+		delay, ok := retryAfter(rsp, now)
+		if !ok {
+			delay = c.backoff(attempt)
+		}
+		if dl, ok := ctx.Deadline(); ok && now.Add(delay).After(dl) {
+			return rsp, err
+		}
+		if rsp != nil {
+			_, _ = io.Copy(io.Discard, rsp.Body)
+			rsp.Body.Close()
+		}
+		if err = sleep(ctx, delay); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
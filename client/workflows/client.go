@@ -28,6 +28,7 @@ import (
 	"github.com/pkg/errors"
 
 	common "github.com/mendersoftware/iot-manager/client"
+	"github.com/mendersoftware/iot-manager/model"
 )
 
 const (
@@ -35,6 +36,21 @@ const (
 	URIProvisionDevice = "/api/v1/workflow/provision_external_device"
 )
 
+// Provider names used by the provision_external_device workflow.
+const (
+	providerAzure = "Azure"
+	providerAWS   = "AWS"
+)
+
+func workflowProvider(provider model.Provider) string {
+	switch provider {
+	case model.ProviderIoTCore:
+		return providerAWS
+	default:
+		return providerAzure
+	}
+}
+
 const (
 	defaultTimeout = time.Duration(10) * time.Second
 )
@@ -43,7 +59,12 @@ const (
 //go:generate ../../utils/mockgen.sh
 type Client interface {
 	CheckHealth(ctx context.Context) error
-	ProvisionExternalDevice(ctx context.Context, devID string, config map[string]string) error
+	ProvisionExternalDevice(
+		ctx context.Context,
+		devID string,
+		provider model.Provider,
+		config map[string]string,
+	) error
 }
 
 type Options struct {
@@ -122,6 +143,7 @@ func (c *client) CheckHealth(ctx context.Context) error {
 func (c *client) ProvisionExternalDevice(
 	ctx context.Context,
 	devID string,
+	provider model.Provider,
 	config map[string]string,
 ) error {
 	if ctx == nil {
@@ -143,7 +165,7 @@ func (c *client) ProvisionExternalDevice(
 		DeviceID:  devID,
 		RequestID: requestid.FromContext(ctx),
 		Config:    config,
-		Provider:  "Azure",
+		Provider:  workflowProvider(provider),
 	}
 
 	if id := identity.FromContext(ctx); id != nil {
@@ -165,7 +187,7 @@ func (c *client) ProvisionExternalDevice(
 	defer rsp.Body.Close()
 
 	if rsp.StatusCode >= 400 {
-		return common.HTTPError{Code: rsp.StatusCode}
+		return common.NewHTTPError("workflows", rsp)
 	}
 	return nil
 }
@@ -25,6 +25,7 @@ import (
 	"time"
 
 	common "github.com/mendersoftware/iot-manager/client"
+	"github.com/mendersoftware/iot-manager/model"
 
 	"github.com/mendersoftware/go-lib-micro/identity"
 	"github.com/mendersoftware/go-lib-micro/requestid"
@@ -173,6 +174,7 @@ func TestProvisionExternalDevice(t *testing.T) {
 
 		CTX            context.Context
 		DeviceID       string
+		Provider       model.Provider
 		Config         map[string]string
 		RoundTripError error
 
@@ -192,6 +194,19 @@ func TestProvisionExternalDevice(t *testing.T) {
 			"bar": "baz",
 		},
 
+		ResponseCode: http.StatusOK,
+	}, {
+		Name: "ok, aws",
+
+		CTX: identity.WithContext(context.Background(), &identity.Identity{
+			Tenant: "123456789012345678901234",
+		}),
+		DeviceID: "60131e78-5c31-43bf-9fab-2aaa3b422d13",
+		Provider: model.ProviderIoTCore,
+		Config: map[string]string{
+			"foo": "bar",
+		},
+
 		ResponseCode: http.StatusOK,
 	}, {
 		Name: "ok, no tenant id",
@@ -284,6 +299,10 @@ func TestProvisionExternalDevice(t *testing.T) {
 							tc.DeviceID,
 							req["device_id"],
 						)
+						assert.Equal(t,
+							workflowProvider(tc.Provider),
+							req["provider"],
+						)
 						// convert tc.Config to json map
 						tcConfig := make(
 							map[string]interface{},
@@ -307,7 +326,9 @@ func TestProvisionExternalDevice(t *testing.T) {
 				SetClient(htClient)
 			client := NewClient("http://localhost:6969"+tc.URLNoise, opts)
 
-			err := client.ProvisionExternalDevice(tc.CTX, tc.DeviceID, tc.Config)
+			err := client.ProvisionExternalDevice(
+				tc.CTX, tc.DeviceID, tc.Provider, tc.Config,
+			)
 			if tc.Error != nil {
 				if assert.Error(t, err) {
 					assert.Regexp(t, tc.Error.Error(), err.Error())
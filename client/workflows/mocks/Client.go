@@ -19,6 +19,7 @@ package mocks
 import (
 	context "context"
 
+	model "github.com/mendersoftware/iot-manager/model"
 	mock "github.com/stretchr/testify/mock"
 )
 
@@ -41,13 +42,13 @@ func (_m *Client) CheckHealth(ctx context.Context) error {
 	return r0
 }
 
-// ProvisionExternalDevice provides a mock function with given fields: ctx, devID, config
-func (_m *Client) ProvisionExternalDevice(ctx context.Context, devID string, config map[string]string) error {
-	ret := _m.Called(ctx, devID, config)
+// ProvisionExternalDevice provides a mock function with given fields: ctx, devID, provider, config
+func (_m *Client) ProvisionExternalDevice(ctx context.Context, devID string, provider model.Provider, config map[string]string) error {
+	ret := _m.Called(ctx, devID, provider, config)
 
 	var r0 error
-	if rf, ok := ret.Get(0).(func(context.Context, string, map[string]string) error); ok {
-		r0 = rf(ctx, devID, config)
+	if rf, ok := ret.Get(0).(func(context.Context, string, model.Provider, map[string]string) error); ok {
+		r0 = rf(ctx, devID, provider, config)
 	} else {
 		r0 = ret.Error(0)
 	}
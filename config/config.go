@@ -55,6 +55,134 @@ const (
 	// SettingWorkflowsURL defines the default workflows URL
 	SettingWorkflowsURLDefault = "http://mender-workflows-server:8080"
 
+	// SettingDeviceauthURL configures the device authentication service URL
+	SettingDeviceauthURL = "deviceauth_url"
+	// SettingDeviceauthURLDefault defines the default deviceauth URL
+	SettingDeviceauthURLDefault = "http://mender-device-auth:8080"
+
+	// SettingReconcileInterval is the config key for the interval between
+	// periodic device reconciliations, zero disables the reconciliation.
+	SettingReconcileInterval = "reconcile_interval"
+	// SettingReconcileIntervalDefault is the default reconciliation interval
+	SettingReconcileIntervalDefault = "0s"
+
+	// SettingReconcileFix is the config key for letting the periodic
+	// reconciliation provision missing devices and record the devices
+	// known to Mender.
+	SettingReconcileFix = "reconcile_fix"
+	// SettingReconcileFixDefault is the default value for fixing differences
+	SettingReconcileFixDefault = false
+
+	// SettingReconcileDeleteOrphans is the config key for letting the
+	// periodic reconciliation delete the orphaned devices from the IoT Hub.
+	SettingReconcileDeleteOrphans = "reconcile_delete_orphans"
+	// SettingReconcileDeleteOrphansDefault is the default value for
+	// deleting orphaned devices
+	SettingReconcileDeleteOrphansDefault = false
+
+	// SettingIoTHubMaxRetries is the config key for the maximum number of
+	// times a throttled or failed IoT Hub request is retried.
+	SettingIoTHubMaxRetries = "iothub_max_retries"
+	// SettingIoTHubMaxRetriesDefault is the default number of retries
+	SettingIoTHubMaxRetriesDefault = 3
+
+	// SettingIoTHubMinBackoff is the config key for the initial delay
+	// between IoT Hub request retries.
+	SettingIoTHubMinBackoff = "iothub_min_backoff"
+	// SettingIoTHubMinBackoffDefault is the default initial retry delay
+	SettingIoTHubMinBackoffDefault = "500ms"
+
+	// SettingIoTHubMaxBackoff is the config key for the maximum delay
+	// between IoT Hub request retries.
+	SettingIoTHubMaxBackoff = "iothub_max_backoff"
+	// SettingIoTHubMaxBackoffDefault is the default maximum retry delay
+	SettingIoTHubMaxBackoffDefault = "10s"
+
+	// SettingVerifyConnectionString is the config key for verifying the
+	// permissions of new IoT Hub connection strings before saving them.
+	// Disable for setups where the IoT Hub is not reachable by the service.
+	SettingVerifyConnectionString = "verify_connection_string"
+	// SettingVerifyConnectionStringDefault is the default value for the
+	// connection string verification
+	SettingVerifyConnectionStringDefault = true
+
+	// SettingAllowCredentialsReveal is the config key for allowing users
+	// to retrieve the plain text credentials of the integrations.
+	SettingAllowCredentialsReveal = "allow_credentials_reveal"
+	// SettingAllowCredentialsRevealDefault is the default value for
+	// revealing the credentials
+	SettingAllowCredentialsRevealDefault = false
+
+	// SettingEncryptionKeyProvider is the config key for the provider of the
+	// keys encrypting the secrets stored in the database, one of "local"
+	// or "vault". If empty, secrets are stored in plain text.
+	SettingEncryptionKeyProvider = "encryption_key_provider"
+	// SettingEncryptionKeyProviderDefault is the default key provider
+	SettingEncryptionKeyProviderDefault = ""
+
+	// SettingEncryptionKeyFile is the config key for the path to the file
+	// holding the keys of the local key provider.
+	SettingEncryptionKeyFile = "encryption_key_file"
+	// SettingEncryptionKeyFileDefault is the default key file path
+	SettingEncryptionKeyFileDefault = "/etc/iot-manager/encryption.key"
+
+	// SettingVaultAddress is the config key for the HashiCorp Vault URL
+	SettingVaultAddress = "vault_address"
+	// SettingVaultAddressDefault is the default Vault URL
+	SettingVaultAddressDefault = "http://vault:8200"
+
+	// SettingVaultToken is the config key for the Vault token
+	SettingVaultToken = "vault_token"
+
+	// SettingVaultTransitMount is the config key for the path of the Vault
+	// transit secrets engine.
+	SettingVaultTransitMount = "vault_transit_mount"
+	// SettingVaultTransitMountDefault is the default transit engine path
+	SettingVaultTransitMountDefault = "transit"
+
+	// SettingVaultTransitKey is the config key for the name of the transit
+	// key encrypting the data keys.
+	SettingVaultTransitKey = "vault_transit_key"
+	// SettingVaultTransitKeyDefault is the default transit key name
+	SettingVaultTransitKeyDefault = "iot-manager"
+	// SettingVaultPreviousKeys is the config key for the transit keys
+	// ("key" or "mount/key") only used for unwrapping data keys wrapped
+	// before switching to the current key.
+	SettingVaultPreviousKeys = "vault_previous_keys"
+	// SettingVaultKeyCacheTTL is the config key for how long unwrapped
+	// data keys are cached, saving a Vault round trip when reading the
+	// settings.
+	SettingVaultKeyCacheTTL = "vault_key_cache_ttl"
+	// SettingVaultKeyCacheTTLDefault is the default data key cache TTL
+	SettingVaultKeyCacheTTLDefault = "5m"
+
+	// SettingBulkMaxItems is the config key for the maximum number of
+	// devices accepted by the bulk provisioning and status endpoints.
+	SettingBulkMaxItems = "bulk_max_items"
+	// SettingBulkMaxItemsDefault is the default maximum number of devices
+	SettingBulkMaxItemsDefault = 100
+	// SettingBulkMaxJobItems is the config key for the maximum number of
+	// devices accepted by the bulk provisioning endpoint run as a job.
+	SettingBulkMaxJobItems = "bulk_max_job_items"
+	// SettingBulkMaxJobItemsDefault is the default maximum number of
+	// devices provisioned by a job.
+	SettingBulkMaxJobItemsDefault = 10000
+	// SettingBulkMaxDecommissionItems is the config key for the maximum
+	// number of devices accepted by the bulk decommissioning endpoint.
+	SettingBulkMaxDecommissionItems = "bulk_max_decommission_items"
+	// SettingBulkMaxDecommissionItemsDefault is the default maximum number
+	// of devices decommissioned by a single request.
+	SettingBulkMaxDecommissionItemsDefault = 10000
+	// SettingBulkConcurrency is the config key for the maximum number of
+	// devices processed concurrently by bulk requests.
+	SettingBulkConcurrency = "bulk_concurrency"
+	// SettingBulkConcurrencyDefault is the default bulk concurrency
+	SettingBulkConcurrencyDefault = 10
+	// SettingJobWorkers is the config key for the number of workers running
+	// background jobs, such as tenant deletions and key rotations.
+	SettingJobWorkers = "job_workers"
+	// SettingJobWorkersDefault is the default number of job workers
+	SettingJobWorkersDefault = 2
 	// SettingDebugLog is the config key for the turning on the debug log
 	SettingDebugLog = "debug_log"
 	// SettingDebugLogDefault is the default value for the debug log enabling
@@ -71,5 +199,25 @@ var (
 		{Key: SettingDbSSLSkipVerify, Value: SettingDbSSLSkipVerifyDefault},
 		{Key: SettingDebugLog, Value: SettingDebugLogDefault},
 		{Key: SettingWorkflowsURL, Value: SettingWorkflowsURLDefault},
+		{Key: SettingDeviceauthURL, Value: SettingDeviceauthURLDefault},
+		{Key: SettingReconcileInterval, Value: SettingReconcileIntervalDefault},
+		{Key: SettingReconcileFix, Value: SettingReconcileFixDefault},
+		{Key: SettingReconcileDeleteOrphans, Value: SettingReconcileDeleteOrphansDefault},
+		{Key: SettingIoTHubMaxRetries, Value: SettingIoTHubMaxRetriesDefault},
+		{Key: SettingIoTHubMinBackoff, Value: SettingIoTHubMinBackoffDefault},
+		{Key: SettingIoTHubMaxBackoff, Value: SettingIoTHubMaxBackoffDefault},
+		{Key: SettingVerifyConnectionString, Value: SettingVerifyConnectionStringDefault},
+		{Key: SettingAllowCredentialsReveal, Value: SettingAllowCredentialsRevealDefault},
+		{Key: SettingEncryptionKeyProvider, Value: SettingEncryptionKeyProviderDefault},
+		{Key: SettingEncryptionKeyFile, Value: SettingEncryptionKeyFileDefault},
+		{Key: SettingVaultAddress, Value: SettingVaultAddressDefault},
+		{Key: SettingVaultTransitMount, Value: SettingVaultTransitMountDefault},
+		{Key: SettingVaultTransitKey, Value: SettingVaultTransitKeyDefault},
+		{Key: SettingVaultKeyCacheTTL, Value: SettingVaultKeyCacheTTLDefault},
+		{Key: SettingBulkMaxItems, Value: SettingBulkMaxItemsDefault},
+		{Key: SettingBulkMaxJobItems, Value: SettingBulkMaxJobItemsDefault},
+		{Key: SettingBulkMaxDecommissionItems, Value: SettingBulkMaxDecommissionItemsDefault},
+		{Key: SettingBulkConcurrency, Value: SettingBulkConcurrencyDefault},
+		{Key: SettingJobWorkers, Value: SettingJobWorkersDefault},
 	}
 )
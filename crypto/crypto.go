@@ -0,0 +1,145 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package crypto
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// KeySize is the size of the data keys and the local key encryption keys.
+const KeySize = 32
+
+var (
+	ErrInvalidKey        = errors.New("crypto: encryption keys must be 32 bytes long")
+	ErrInvalidCiphertext = errors.New("crypto: invalid ciphertext")
+	ErrUnknownKey        = errors.New("crypto: unknown key encryption key")
+)
+
+// KeyProvider protects the data keys used for encrypting secrets. The data
+// keys are stored next to the data they encrypt, wrapped (encrypted) with
+// a key encryption key that never leaves the provider.
+type KeyProvider interface {
+	// KeyID identifies the key encryption key new data keys are wrapped
+	// with.
+	KeyID() string
+	// WrapKey encrypts a data key with the current key encryption key.
+	WrapKey(ctx context.Context, key []byte) ([]byte, error)
+	// UnwrapKey decrypts a data key wrapped with the key encryption key
+	// identified by keyID.
+	UnwrapKey(ctx context.Context, keyID string, wrapped []byte) ([]byte, error)
+}
+
+// DataKey encrypts and decrypts secrets using AES-256-GCM.
+type DataKey struct {
+	// KeyID identifies the key encryption key that wrapped the data key.
+	KeyID string
+	// Wrapped is the data key encrypted by the key provider.
+	Wrapped []byte
+
+	aead cipher.AEAD
+}
+
+// NewDataKey generates a random data key and wraps it with the current key
+// encryption key of the provider.
+func NewDataKey(ctx context.Context, provider KeyProvider) (*DataKey, error) {
+	key := make([]byte, KeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, errors.Wrap(err, "crypto: failed to generate data key")
+	}
+	keyID := provider.KeyID()
+	wrapped, err := provider.WrapKey(ctx, key)
+	if err != nil {
+		return nil, errors.Wrap(err, "crypto: failed to wrap data key")
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &DataKey{
+		KeyID:   keyID,
+		Wrapped: wrapped,
+		aead:    aead,
+	}, nil
+}
+
+// OpenDataKey unwraps a data key previously created by NewDataKey.
+func OpenDataKey(
+	ctx context.Context,
+	provider KeyProvider,
+	keyID string,
+	wrapped []byte,
+) (*DataKey, error) {
+	key, err := provider.UnwrapKey(ctx, keyID, wrapped)
+	if err != nil {
+		return nil, errors.Wrap(err, "crypto: failed to unwrap data key")
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &DataKey{
+		KeyID:   keyID,
+		Wrapped: wrapped,
+		aead:    aead,
+	}, nil
+}
+
+// Encrypt encrypts the plaintext, the random nonce is prepended to the
+// returned ciphertext.
+func (k *DataKey) Encrypt(plaintext []byte) ([]byte, error) {
+	return seal(k.aead, plaintext)
+}
+
+// Decrypt decrypts and authenticates a ciphertext returned by Encrypt.
+func (k *DataKey) Decrypt(ciphertext []byte) ([]byte, error) {
+	return open(k.aead, ciphertext)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != KeySize {
+		return nil, ErrInvalidKey
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "crypto: failed to initialize cipher")
+	}
+	return cipher.NewGCM(block)
+}
+
+func seal(aead cipher.AEAD, plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, errors.Wrap(err, "crypto: failed to generate nonce")
+	}
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func open(aead cipher.AEAD, ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) < aead.NonceSize()+aead.Overhead() {
+		return nil, ErrInvalidCiphertext
+	}
+	nonce := ciphertext[:aead.NonceSize()]
+	plaintext, err := aead.Open(nil, nonce, ciphertext[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, ErrInvalidCiphertext
+	}
+	return plaintext, nil
+}
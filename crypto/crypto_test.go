@@ -0,0 +1,64 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package crypto
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDataKey(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	provider, err := NewLocalKeyProvider(bytes.Repeat([]byte{'k'}, KeySize))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	key, err := NewDataKey(ctx, provider)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, provider.KeyID(), key.KeyID)
+
+	ciphertext, err := key.Encrypt([]byte("password123"))
+	assert.NoError(t, err)
+	assert.NotContains(t, string(ciphertext), "password123")
+
+	other, err := key.Encrypt([]byte("password123"))
+	assert.NoError(t, err)
+	assert.NotEqual(t, ciphertext, other, "nonce must be random")
+
+	opened, err := OpenDataKey(ctx, provider, key.KeyID, key.Wrapped)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	plaintext, err := opened.Decrypt(ciphertext)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("password123"), plaintext)
+
+	ciphertext[len(ciphertext)-1] ^= 0xff
+	_, err = opened.Decrypt(ciphertext)
+	assert.EqualError(t, err, ErrInvalidCiphertext.Error())
+
+	_, err = opened.Decrypt([]byte("short"))
+	assert.EqualError(t, err, ErrInvalidCiphertext.Error())
+
+	_, err = OpenDataKey(ctx, provider, "local:0000000000000000", key.Wrapped)
+	assert.Regexp(t, ErrUnknownKey.Error(), err.Error())
+}
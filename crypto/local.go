@@ -0,0 +1,124 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package crypto
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io/ioutil"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const localKeyIDPrefix = "local:"
+
+type localKey struct {
+	id  string
+	key []byte
+}
+
+type localKeyProvider struct {
+	// keys holds the key encryption keys, the first key is the current
+	// one, the remaining keys are only used for unwrapping data keys.
+	keys []localKey
+}
+
+// NewLocalKeyProvider returns a key provider wrapping the data keys with
+// the given 32 byte AES keys. The first key wraps new data keys, the
+// remaining keys are kept for unwrapping the data keys of secrets that
+// have not been re-encrypted since the key was rotated.
+func NewLocalKeyProvider(keys ...[]byte) (KeyProvider, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("crypto: no encryption keys")
+	}
+	provider := &localKeyProvider{
+		keys: make([]localKey, len(keys)),
+	}
+	for i, key := range keys {
+		if len(key) != KeySize {
+			return nil, ErrInvalidKey
+		}
+		sum := sha256.Sum256(key)
+		provider.keys[i] = localKey{
+			id:  localKeyIDPrefix + hex.EncodeToString(sum[:8]),
+			key: key,
+		}
+	}
+	return provider, nil
+}
+
+// LoadLocalKeyProvider loads the key encryption keys from a file containing
+// one base64 encoded key per line, the first key being the current key.
+// Empty lines and lines starting with '#' are ignored.
+func LoadLocalKeyProvider(path string) (KeyProvider, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "crypto: failed to read key file")
+	}
+	var keys [][]byte
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		key, err := base64.StdEncoding.DecodeString(text)
+		if err != nil {
+			return nil, errors.Wrapf(err,
+				"crypto: invalid key on line %d of %s", line, path,
+			)
+		}
+		keys = append(keys, key)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "crypto: failed to read key file")
+	}
+	return NewLocalKeyProvider(keys...)
+}
+
+func (p *localKeyProvider) KeyID() string {
+	return p.keys[0].id
+}
+
+func (p *localKeyProvider) WrapKey(ctx context.Context, key []byte) ([]byte, error) {
+	aead, err := newAEAD(p.keys[0].key)
+	if err != nil {
+		return nil, err
+	}
+	return seal(aead, key)
+}
+
+func (p *localKeyProvider) UnwrapKey(
+	ctx context.Context,
+	keyID string,
+	wrapped []byte,
+) ([]byte, error) {
+	for _, key := range p.keys {
+		if key.id != keyID {
+			continue
+		}
+		aead, err := newAEAD(key.key)
+		if err != nil {
+			return nil, err
+		}
+		return open(aead, wrapped)
+	}
+	return nil, errors.Wrapf(ErrUnknownKey, "key ID %q", keyID)
+}
@@ -0,0 +1,123 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package crypto
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadLocalKeyProvider(t *testing.T) {
+	t.Parallel()
+	var (
+		oldKey = bytes.Repeat([]byte{'o'}, KeySize)
+		newKey = bytes.Repeat([]byte{'n'}, KeySize)
+	)
+	testCases := []struct {
+		Name string
+
+		Content string
+
+		KeyID string
+		Error error
+	}{{
+		Name: "ok",
+
+		Content: "# current key\n" +
+			base64.StdEncoding.EncodeToString(newKey) + "\n\n" +
+			"# previous keys\n" +
+			base64.StdEncoding.EncodeToString(oldKey) + "\n",
+
+		KeyID: "local:fe06271acc7d35b9",
+	}, {
+		Name: "error, no keys",
+
+		Content: "# empty\n",
+
+		Error: errors.New("crypto: no encryption keys"),
+	}, {
+		Name: "error, invalid base64",
+
+		Content: "not base64!\n",
+
+		Error: errors.New("crypto: invalid key on line 1 of .*"),
+	}, {
+		Name: "error, invalid key size",
+
+		Content: base64.StdEncoding.EncodeToString([]byte("short")),
+
+		Error: ErrInvalidKey,
+	}}
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			dir, err := ioutil.TempDir("", "iot-manager-keys")
+			if !assert.NoError(t, err) {
+				t.FailNow()
+			}
+			defer os.RemoveAll(dir)
+			path := filepath.Join(dir, "keys")
+			err = ioutil.WriteFile(path, []byte(tc.Content), 0600)
+			if !assert.NoError(t, err) {
+				t.FailNow()
+			}
+
+			provider, err := LoadLocalKeyProvider(path)
+			if tc.Error != nil {
+				if assert.Error(t, err) {
+					assert.Regexp(t, tc.Error.Error(), err.Error())
+				}
+				return
+			}
+			if assert.NoError(t, err) {
+				assert.Equal(t, tc.KeyID, provider.KeyID())
+			}
+		})
+	}
+}
+
+func TestLocalKeyProviderRotation(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	var (
+		oldKey = bytes.Repeat([]byte{'o'}, KeySize)
+		newKey = bytes.Repeat([]byte{'n'}, KeySize)
+	)
+	oldProvider, _ := NewLocalKeyProvider(oldKey)
+	dataKey, err := NewDataKey(ctx, oldProvider)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	provider, _ := NewLocalKeyProvider(newKey, oldKey)
+	assert.NotEqual(t, oldProvider.KeyID(), provider.KeyID())
+	_, err = OpenDataKey(ctx, provider, dataKey.KeyID, dataKey.Wrapped)
+	assert.NoError(t, err, "previous keys must unwrap data keys")
+
+	provider, _ = NewLocalKeyProvider(newKey)
+	_, err = OpenDataKey(ctx, provider, dataKey.KeyID, dataKey.Wrapped)
+	if assert.Error(t, err) {
+		assert.Regexp(t, ErrUnknownKey.Error(), err.Error())
+	}
+}
@@ -0,0 +1,295 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package crypto
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	common "github.com/mendersoftware/iot-manager/client"
+)
+
+const (
+	hdrVaultToken = "X-Vault-Token"
+
+	vaultKeyIDPrefix    = "vault:"
+	defaultVaultMount   = "transit"
+	defaultVaultTimeout = 10 * time.Second
+	// maxVaultCacheEntries bounds the number of cached data keys.
+	maxVaultCacheEntries = 1024
+)
+
+type VaultOptions struct {
+	Client *http.Client
+	// Mount is the path the transit secrets engine is mounted at.
+	Mount string
+	// PreviousKeys lists the transit keys, as "key" or "mount/key", the
+	// data keys were wrapped with before switching to the current key.
+	// They are only used for unwrapping.
+	PreviousKeys []string
+	// CacheTTL is how long unwrapped data keys are kept in memory to save
+	// a Vault round trip when the same data key is opened again. Data keys
+	// are not cached if zero.
+	CacheTTL time.Duration
+}
+
+func NewVaultOptions(opts ...*VaultOptions) *VaultOptions {
+	ret := new(VaultOptions)
+	for _, opt := range opts {
+		if opt == nil {
+			continue
+		}
+		if opt.Client != nil {
+			ret.Client = opt.Client
+		}
+		if opt.Mount != "" {
+			ret.Mount = opt.Mount
+		}
+		if opt.PreviousKeys != nil {
+			ret.PreviousKeys = opt.PreviousKeys
+		}
+		if opt.CacheTTL > 0 {
+			ret.CacheTTL = opt.CacheTTL
+		}
+	}
+	return ret
+}
+
+func (opts *VaultOptions) SetClient(client *http.Client) *VaultOptions {
+	opts.Client = client
+	return opts
+}
+
+func (opts *VaultOptions) SetMount(mount string) *VaultOptions {
+	opts.Mount = mount
+	return opts
+}
+
+func (opts *VaultOptions) SetPreviousKeys(keys ...string) *VaultOptions {
+	opts.PreviousKeys = keys
+	return opts
+}
+
+func (opts *VaultOptions) SetCacheTTL(ttl time.Duration) *VaultOptions {
+	opts.CacheTTL = ttl
+	return opts
+}
+
+// vaultKey is a key of a transit secrets engine.
+type vaultKey struct {
+	mount string
+	name  string
+}
+
+func (k vaultKey) id() string {
+	return vaultKeyIDPrefix + k.mount + "/" + k.name
+}
+
+type vaultCacheEntry struct {
+	key     []byte
+	expires time.Time
+}
+
+type vaultKeyProvider struct {
+	address string
+	token   string
+	current vaultKey
+	// keys maps the IDs of the current and the previous keys to the keys.
+	keys   map[string]vaultKey
+	client *http.Client
+
+	cacheTTL time.Duration
+	cacheMu  sync.Mutex
+	cache    map[string]vaultCacheEntry
+}
+
+// NewVaultKeyProvider returns a key provider wrapping the data keys with
+// the named key of a HashiCorp Vault transit secrets engine. The key is
+// rotated in Vault; the ciphertexts carry the key version, so data keys
+// wrapped with previous versions can be unwrapped as long as Vault keeps
+// the version. Data keys wrapped with other transit keys, for example
+// before moving to a new mount, are unwrapped if the keys are listed in
+// the PreviousKeys option.
+func NewVaultKeyProvider(
+	address, token, keyName string,
+	opts ...*VaultOptions,
+) KeyProvider {
+	opt := NewVaultOptions(opts...)
+	if opt.Client == nil {
+		opt.Client = new(http.Client)
+	}
+	if opt.Mount == "" {
+		opt.Mount = defaultVaultMount
+	}
+	mount := strings.Trim(opt.Mount, "/")
+	current := vaultKey{mount: mount, name: keyName}
+	keys := map[string]vaultKey{current.id(): current}
+	for _, previous := range opt.PreviousKeys {
+		key := vaultKey{mount: mount, name: strings.Trim(previous, "/")}
+		if i := strings.LastIndex(key.name, "/"); i >= 0 {
+			key.mount, key.name = key.name[:i], key.name[i+1:]
+		}
+		keys[key.id()] = key
+	}
+	return &vaultKeyProvider{
+		address:  strings.TrimRight(address, "/"),
+		token:    token,
+		current:  current,
+		keys:     keys,
+		client:   opt.Client,
+		cacheTTL: opt.CacheTTL,
+		cache:    make(map[string]vaultCacheEntry),
+	}
+}
+
+func (p *vaultKeyProvider) KeyID() string {
+	return p.current.id()
+}
+
+type vaultRequest struct {
+	Plaintext  string `json:"plaintext,omitempty"`
+	Ciphertext string `json:"ciphertext,omitempty"`
+}
+
+type vaultResponse struct {
+	Data vaultRequest `json:"data"`
+}
+
+func (p *vaultKeyProvider) do(
+	ctx context.Context,
+	key vaultKey,
+	operation string,
+	body vaultRequest,
+) (*vaultResponse, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultVaultTimeout)
+		defer cancel()
+	}
+	b, _ := json.Marshal(body)
+	req, err := http.NewRequestWithContext(ctx,
+		http.MethodPost,
+		p.address+"/v1/"+key.mount+"/"+operation+"/"+url.PathEscape(key.name),
+		bytes.NewReader(b),
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "vault: failed to prepare request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(hdrVaultToken, p.token)
+
+	rsp, err := p.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "vault: failed to execute request")
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode >= 300 {
+		return nil, common.NewHTTPError("vault", rsp)
+	}
+	var res vaultResponse
+	if err = json.NewDecoder(rsp.Body).Decode(&res); err != nil {
+		return nil, errors.Wrap(err, "vault: failed to decode response")
+	}
+	return &res, nil
+}
+
+func (p *vaultKeyProvider) WrapKey(ctx context.Context, key []byte) ([]byte, error) {
+	rsp, err := p.do(ctx, p.current, "encrypt", vaultRequest{
+		Plaintext: base64.StdEncoding.EncodeToString(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if rsp.Data.Ciphertext == "" {
+		return nil, errors.New("vault: empty ciphertext in response")
+	}
+	return []byte(rsp.Data.Ciphertext), nil
+}
+
+func (p *vaultKeyProvider) UnwrapKey(
+	ctx context.Context,
+	keyID string,
+	wrapped []byte,
+) ([]byte, error) {
+	vk, ok := p.keys[keyID]
+	if !ok {
+		return nil, errors.Wrapf(ErrUnknownKey, "key ID %q", keyID)
+	}
+	cacheKey := keyID + "/" + string(wrapped)
+	if key := p.cached(cacheKey); key != nil {
+		return key, nil
+	}
+	rsp, err := p.do(ctx, vk, "decrypt", vaultRequest{
+		Ciphertext: string(wrapped),
+	})
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(rsp.Data.Plaintext)
+	if err != nil {
+		return nil, errors.Wrap(err, "vault: invalid plaintext in response")
+	}
+	p.store(cacheKey, key)
+	return key, nil
+}
+
+// cached returns a copy of the cached data key, nil if the key is not
+// cached or expired.
+func (p *vaultKeyProvider) cached(cacheKey string) []byte {
+	if p.cacheTTL <= 0 {
+		return nil
+	}
+	p.cacheMu.Lock()
+	defer p.cacheMu.Unlock()
+	entry, ok := p.cache[cacheKey]
+	if !ok || time.Now().After(entry.expires) {
+		return nil
+	}
+	return append([]byte(nil), entry.key...)
+}
+
+// store caches a copy of the data key, evicting the expired entries when
+// the cache is full.
+func (p *vaultKeyProvider) store(cacheKey string, key []byte) {
+	if p.cacheTTL <= 0 {
+		return
+	}
+	p.cacheMu.Lock()
+	defer p.cacheMu.Unlock()
+	now := time.Now()
+	if len(p.cache) >= maxVaultCacheEntries {
+		for k, entry := range p.cache {
+			if now.After(entry.expires) {
+				delete(p.cache, k)
+			}
+		}
+		if len(p.cache) >= maxVaultCacheEntries {
+			p.cache = make(map[string]vaultCacheEntry)
+		}
+	}
+	p.cache[cacheKey] = vaultCacheEntry{
+		key:     append([]byte(nil), key...),
+		expires: now.Add(p.cacheTTL),
+	}
+}
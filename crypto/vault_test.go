@@ -0,0 +1,174 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package crypto
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newVaultServer returns a stand-in for the Vault transit secrets engine
+// "wrapping" the plaintexts by prefixing them with the key version.
+func newVaultServer(t *testing.T, token string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(hdrVaultToken) != token {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errors":["permission denied"]}`))
+			return
+		}
+		var req vaultRequest
+		if !assert.NoError(t, json.NewDecoder(r.Body).Decode(&req)) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var rsp vaultResponse
+		switch r.URL.Path {
+		case "/v1/transit/encrypt/iot-manager":
+			rsp.Data.Ciphertext = "vault:v1:" + req.Plaintext
+		case "/v1/transit/decrypt/iot-manager",
+			"/v1/transit-old/decrypt/iot-manager",
+			"/v1/transit/decrypt/legacy":
+			rsp.Data.Plaintext = strings.TrimPrefix(req.Ciphertext, "vault:v1:")
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(rsp)
+	}))
+}
+
+func TestVaultKeyProvider(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	srv := newVaultServer(t, "s.token")
+	defer srv.Close()
+
+	provider := NewVaultKeyProvider(srv.URL+"/", "s.token", "iot-manager",
+		NewVaultOptions().SetClient(srv.Client()),
+	)
+	assert.Equal(t, "vault:transit/iot-manager", provider.KeyID())
+
+	key, err := NewDataKey(ctx, provider)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Regexp(t, "^vault:v1:", string(key.Wrapped))
+	ciphertext, err := key.Encrypt([]byte("password123"))
+	assert.NoError(t, err)
+
+	opened, err := OpenDataKey(ctx, provider, key.KeyID, key.Wrapped)
+	if assert.NoError(t, err) {
+		plaintext, err := opened.Decrypt(ciphertext)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("password123"), plaintext)
+	}
+
+	_, err = OpenDataKey(ctx, provider, "vault:transit/other", key.Wrapped)
+	if assert.Error(t, err) {
+		assert.Regexp(t, ErrUnknownKey.Error(), err.Error())
+	}
+
+	provider = NewVaultKeyProvider(srv.URL, "s.wrong", "iot-manager",
+		NewVaultOptions().SetClient(srv.Client()),
+	)
+	_, err = NewDataKey(ctx, provider)
+	if assert.Error(t, err) {
+		assert.Regexp(t, "vault: unexpected status code from API: 403", err.Error())
+	}
+
+	provider = NewVaultKeyProvider(srv.URL, "s.token", "iot-manager",
+		NewVaultOptions().SetClient(srv.Client()).SetMount("secrets/transit"),
+	)
+	_, err = NewDataKey(ctx, provider)
+	if assert.Error(t, err) {
+		assert.Regexp(t, "vault: unexpected status code from API: 404", err.Error())
+	}
+}
+
+func TestVaultKeyProviderPreviousKeys(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	srv := newVaultServer(t, "s.token")
+	defer srv.Close()
+
+	provider := NewVaultKeyProvider(srv.URL, "s.token", "iot-manager",
+		NewVaultOptions().
+			SetClient(srv.Client()).
+			SetPreviousKeys("legacy", "/transit-old/iot-manager/"),
+	)
+	assert.Equal(t, "vault:transit/iot-manager", provider.KeyID())
+	wrapped := []byte("vault:v1:" + base64.StdEncoding.EncodeToString(
+		make([]byte, KeySize),
+	))
+	for _, keyID := range []string{
+		"vault:transit/iot-manager",
+		"vault:transit/legacy",
+		"vault:transit-old/iot-manager",
+	} {
+		key, err := provider.UnwrapKey(ctx, keyID, wrapped)
+		if assert.NoError(t, err, keyID) {
+			assert.Equal(t, make([]byte, KeySize), key)
+		}
+	}
+	_, err := provider.UnwrapKey(ctx, "vault:transit-old/legacy", wrapped)
+	if assert.Error(t, err) {
+		assert.Regexp(t, ErrUnknownKey.Error(), err.Error())
+	}
+}
+
+func TestVaultKeyProviderCache(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	var requests int32
+	vault := newVaultServer(t, "s.token")
+	defer vault.Close()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		vault.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	provider := NewVaultKeyProvider(srv.URL, "s.token", "iot-manager",
+		NewVaultOptions().SetClient(srv.Client()).SetCacheTTL(time.Minute),
+	)
+	key, err := NewDataKey(ctx, provider)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	expected, err := provider.UnwrapKey(ctx, key.KeyID, key.Wrapped)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	expected = append([]byte(nil), expected...)
+	for i := 0; i < 3; i++ {
+		unwrapped, err := provider.UnwrapKey(ctx, key.KeyID, key.Wrapped)
+		if assert.NoError(t, err) {
+			assert.Equal(t, expected, unwrapped)
+			// The cache hands out copies.
+			unwrapped[0]++
+		}
+	}
+	// One request wrapping the key and one unwrapping it.
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+}
@@ -15,15 +15,28 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"net/http"
 	"os"
 	"strings"
 
 	"github.com/mendersoftware/go-lib-micro/config"
+	"github.com/mendersoftware/go-lib-micro/identity"
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
 
+	"github.com/mendersoftware/iot-manager/app"
+	"github.com/mendersoftware/iot-manager/client/devauth"
+	"github.com/mendersoftware/iot-manager/client/dps"
+	"github.com/mendersoftware/iot-manager/client/iotcore"
+	"github.com/mendersoftware/iot-manager/client/iothub"
+	"github.com/mendersoftware/iot-manager/client/workflows"
 	dconfig "github.com/mendersoftware/iot-manager/config"
+	"github.com/mendersoftware/iot-manager/crypto"
+	"github.com/mendersoftware/iot-manager/model"
 	"github.com/mendersoftware/iot-manager/server"
 	store "github.com/mendersoftware/iot-manager/store/mongo"
 )
@@ -63,6 +76,33 @@ func doMain(args []string) {
 				Usage:  "Run the migrations",
 				Action: cmdMigrate,
 			},
+			{
+				Name: "rotate-encryption-key",
+				Usage: "Re-encrypt the secrets stored in the settings of " +
+					"all tenants with the current encryption key",
+				Action: cmdRotateEncryptionKey,
+			},
+			{
+				Name: "reconcile",
+				Usage: "Compare the devices known to Mender with the " +
+					"devices in the IoT Hub and print a report",
+				Action: cmdReconcile,
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name: "fix",
+						Usage: "Provision missing devices and record the " +
+							"devices known to Mender.",
+					},
+					&cli.BoolFlag{
+						Name:  "delete-orphans",
+						Usage: "Delete orphaned devices from the IoT Hub.",
+					},
+					&cli.StringFlag{
+						Name:  "tenant",
+						Usage: "Only reconcile the devices of tenant `ID`.",
+					},
+				},
+			},
 		},
 	}
 	app.Usage = "Azure IoT Manager"
@@ -90,8 +130,46 @@ func doMain(args []string) {
 	}
 }
 
+func newKeyProvider() (crypto.KeyProvider, error) {
+	switch provider := config.Config.GetString(dconfig.SettingEncryptionKeyProvider); provider {
+	case "":
+		return nil, nil
+	case "local":
+		return crypto.LoadLocalKeyProvider(
+			config.Config.GetString(dconfig.SettingEncryptionKeyFile),
+		)
+	case "vault":
+		return crypto.NewVaultKeyProvider(
+			config.Config.GetString(dconfig.SettingVaultAddress),
+			config.Config.GetString(dconfig.SettingVaultToken),
+			config.Config.GetString(dconfig.SettingVaultTransitKey),
+			crypto.NewVaultOptions().
+				SetMount(config.Config.GetString(dconfig.SettingVaultTransitMount)).
+				SetPreviousKeys(
+					config.Config.GetStringSlice(dconfig.SettingVaultPreviousKeys)...,
+				).
+				SetCacheTTL(config.Config.GetDuration(dconfig.SettingVaultKeyCacheTTL)),
+		), nil
+	default:
+		return nil, errors.Errorf("invalid encryption key provider %q", provider)
+	}
+}
+
+func newStoreConfig(automigrate bool) (*store.Config, error) {
+	keyProvider, err := newKeyProvider()
+	if err != nil {
+		return nil, err
+	}
+	return store.NewConfig().
+		SetAutomigrate(automigrate).
+		SetKeyProvider(keyProvider), nil
+}
+
 func cmdServer(args *cli.Context) error {
-	mgoConfig := store.NewConfig().SetAutomigrate(args.Bool("automigrate"))
+	mgoConfig, err := newStoreConfig(args.Bool("automigrate"))
+	if err != nil {
+		return err
+	}
 	dataStore, err := store.SetupDataStore(mgoConfig)
 	if err != nil {
 		return err
@@ -101,10 +179,92 @@ func cmdServer(args *cli.Context) error {
 }
 
 func cmdMigrate(args *cli.Context) error {
-	mgoConfig := store.NewConfig().SetAutomigrate(true)
+	mgoConfig, err := newStoreConfig(true)
+	if err != nil {
+		return err
+	}
 	dataStore, err := store.SetupDataStore(mgoConfig)
 	if err != nil {
 		return err
 	}
 	return dataStore.Close()
 }
+
+func cmdRotateEncryptionKey(args *cli.Context) error {
+	mgoConfig, err := newStoreConfig(false)
+	if err != nil {
+		return err
+	}
+	dataStore, err := store.SetupDataStore(mgoConfig)
+	if err != nil {
+		return err
+	}
+	defer dataStore.Close()
+	count, err := dataStore.RotateEncryptionKey(context.Background())
+	if err != nil {
+		return err
+	}
+	log.Infof("re-encrypted the settings of %d tenants", count)
+	return nil
+}
+
+func cmdReconcile(args *cli.Context) error {
+	mgoConfig, err := newStoreConfig(false)
+	if err != nil {
+		return err
+	}
+	dataStore, err := store.SetupDataStore(mgoConfig)
+	if err != nil {
+		return err
+	}
+	defer dataStore.Close()
+
+	httpClient := new(http.Client)
+	wf := workflows.NewClient(
+		config.Config.GetString(dconfig.SettingWorkflowsURL),
+		workflows.NewOptions().SetClient(httpClient),
+	)
+	hub := iothub.NewClient(iothub.NewOptions().
+		SetClient(httpClient).
+		SetMaxRetries(config.Config.GetInt(dconfig.SettingIoTHubMaxRetries)).
+		SetBackoff(
+			config.Config.GetDuration(dconfig.SettingIoTHubMinBackoff),
+			config.Config.GetDuration(dconfig.SettingIoTHubMaxBackoff),
+		))
+	devauthClient := devauth.NewClient(
+		config.Config.GetString(dconfig.SettingDeviceauthURL),
+		devauth.NewOptions().SetClient(httpClient),
+	)
+	dpsClient := dps.NewClient(dps.NewOptions().SetClient(httpClient))
+	iotcoreClient := iotcore.NewClient(iotcore.NewOptions().SetClient(httpClient))
+	iotManager := app.New(dataStore, hub, wf, app.NewOptions().
+		SetDPS(dpsClient).
+		SetIoTCore(iotcoreClient).
+		SetDeviceAuth(devauthClient),
+	)
+
+	ctx := context.Background()
+	if args.IsSet("tenant") {
+		ctx = identity.WithContext(ctx, &identity.Identity{
+			Tenant: args.String("tenant"),
+		})
+	}
+	reports, err := iotManager.ReconcileDevices(ctx, model.ReconcileOptions{
+		Fix:           args.Bool("fix"),
+		DeleteOrphans: args.Bool("delete-orphans"),
+	})
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err = enc.Encode(reports); err != nil {
+		return err
+	}
+	for _, report := range reports {
+		if report.Error != "" || len(report.Errors) > 0 {
+			return cli.NewExitError("reconciliation finished with errors", 1)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package model
+
+import (
+	"encoding/json"
+	"regexp"
+
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/pkg/errors"
+)
+
+var (
+	awsRegionPattern = regexp.MustCompile(`^[a-z]{2}(-[a-z]+)+-[0-9]+$`)
+
+	ErrInvalidPolicyDocument = errors.New("must be a valid JSON document")
+)
+
+// AWSCredentials holds the IAM credentials and region used for accessing
+// the AWS IoT Core API.
+//nolint:lll
+type AWSCredentials struct {
+	AccessKeyID     string `json:"access_key_id" bson:"access_key_id"`
+	SecretAccessKey string `json:"secret_access_key" bson:"secret_access_key"`
+	Region          string `json:"region" bson:"region"`
+	// PolicyDocument is the IoT policy attached to the device certificates.
+	// If empty, devices are allowed to connect and to use the topics under
+	// $aws/things/<thing name>/.
+	PolicyDocument string `json:"policy_document,omitempty" bson:"policy_document,omitempty"`
+}
+
+func (creds AWSCredentials) Validate() error {
+	return validation.ValidateStruct(&creds,
+		validation.Field(&creds.AccessKeyID, validation.Required),
+		validation.Field(&creds.SecretAccessKey, validation.Required),
+		validation.Field(&creds.Region,
+			validation.Required,
+			validation.Match(awsRegionPattern),
+		),
+		validation.Field(&creds.PolicyDocument, validation.By(validatePolicyDocument)),
+	)
+}
+
+func validatePolicyDocument(value interface{}) error {
+	doc, _ := value.(string)
+	if doc != "" && !json.Valid([]byte(doc)) {
+		return ErrInvalidPolicyDocument
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package model
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	pemTypeCertificate  = "CERTIFICATE"
+	pemTypePrivateKey   = "PRIVATE KEY"
+	pemTypeECPrivateKey = "EC PRIVATE KEY"
+	pemTypeRSAKey       = "RSA PRIVATE KEY"
+)
+
+var (
+	ErrCANotCA = errors.New(
+		"certificate authority: certificate is not a CA certificate",
+	)
+	ErrCAKeyMismatch = errors.New(
+		"certificate authority: private key does not match the certificate",
+	)
+)
+
+// CertificateAuthority holds the PEM encoded CA certificate and private key
+// used for signing device certificates.
+type CertificateAuthority struct {
+	Certificate string `json:"certificate" bson:"certificate"`
+	PrivateKey  string `json:"private_key" bson:"private_key"`
+}
+
+// DeviceCertificate is a signed device certificate and its private key.
+type DeviceCertificate struct {
+	// Certificate contains the PEM encoded device certificate followed by
+	// the CA certificate.
+	Certificate []byte
+	// PrivateKey is the PEM encoded (PKCS#8) device private key.
+	PrivateKey []byte
+	// Thumbprint is the hex encoded SHA-256 fingerprint of the device
+	// certificate.
+	Thumbprint string
+}
+
+func (ca CertificateAuthority) parse() (*x509.Certificate, crypto.Signer, error) {
+	block, _ := pem.Decode([]byte(ca.Certificate))
+	if block == nil || block.Type != pemTypeCertificate {
+		return nil, nil, errors.New(
+			"certificate authority: certificate is not a PEM encoded certificate",
+		)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, nil, errors.Wrap(err,
+			"certificate authority: failed to parse certificate",
+		)
+	}
+	if !cert.IsCA {
+		return nil, nil, ErrCANotCA
+	}
+
+	block, _ = pem.Decode([]byte(ca.PrivateKey))
+	if block == nil {
+		return nil, nil, errors.New(
+			"certificate authority: private key is not PEM encoded",
+		)
+	}
+	var key interface{}
+	switch block.Type {
+	case pemTypePrivateKey:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case pemTypeECPrivateKey:
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case pemTypeRSAKey:
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		err = errors.Errorf("unsupported PEM type %q", block.Type)
+	}
+	if err != nil {
+		return nil, nil, errors.Wrap(err,
+			"certificate authority: failed to parse private key",
+		)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, nil, errors.New(
+			"certificate authority: unsupported private key type",
+		)
+	}
+	pub, ok := signer.Public().(interface {
+		Equal(crypto.PublicKey) bool
+	})
+	if !ok || !pub.Equal(cert.PublicKey) {
+		return nil, nil, ErrCAKeyMismatch
+	}
+	return cert, signer, nil
+}
+
+func (ca CertificateAuthority) Validate() error {
+	_, _, err := ca.parse()
+	return err
+}
+
+// IssueDeviceCertificate generates a new key pair for the device and signs
+// a certificate with the device ID as common name.
+func (ca CertificateAuthority) IssueDeviceCertificate(
+	deviceID string,
+	validFor time.Duration,
+) (*DeviceCertificate, error) {
+	caCert, caKey, err := ca.parse()
+	if err != nil {
+		return nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to generate device key")
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to generate certificate serial number")
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName: deviceID,
+		},
+		NotBefore:   now.Add(-time.Minute),
+		NotAfter:    now.Add(validFor),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, key.Public(), caKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to sign device certificate")
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to serialize device key")
+	}
+	var chain bytes.Buffer
+	_ = pem.Encode(&chain, &pem.Block{Type: pemTypeCertificate, Bytes: der})
+	_ = pem.Encode(&chain, &pem.Block{Type: pemTypeCertificate, Bytes: caCert.Raw})
+
+	thumbprint := sha256.Sum256(der)
+	return &DeviceCertificate{
+		Certificate: chain.Bytes(),
+		PrivateKey: pem.EncodeToMemory(&pem.Block{
+			Type:  pemTypePrivateKey,
+			Bytes: keyDER,
+		}),
+		Thumbprint: strings.ToUpper(hex.EncodeToString(thumbprint[:])),
+	}, nil
+}
@@ -33,11 +33,13 @@ const (
 	csVarSeparator = "="
 
 	csKeyHostName              = "HostName"
+	csKeyGatewayHostName       = "GatewayHostName"
 	csKeySharedAccessKey       = "SharedAccessKey"
 	csKeySharedAccessKeyName   = "SharedAccessKeyName"
 	csKeySharedAccessSignature = "SharedAccessSignature"
 	csKeyDeviceId              = "DeviceId"
 	csKeyModuleId              = "ModuleId"
+	csKeyX509                  = "x509"
 )
 
 var (
@@ -58,6 +60,9 @@ type ConnectionString struct {
 	ModuleID        string `cs:"ModuleId" bson:"module_id,omitempty"`
 	Key             []byte `cs:"SharedAccessKey" bson:"access_key"`
 	Signature       string `cs:"SharedAccessSignature" bson:"-"`
+	// X509 is set for device connection strings authenticating using
+	// X.509 certificates instead of a shared access key.
+	X509 bool `cs:"x509" bson:"x509,omitempty"`
 }
 
 func ParseConnectionString(connection string) (*ConnectionString, error) {
@@ -71,6 +76,8 @@ func ParseConnectionString(connection string) (*ConnectionString, error) {
 		switch kv[0] {
 		case csKeyHostName:
 			cs.HostName = kv[1]
+		case csKeyGatewayHostName:
+			cs.GatewayHostName = kv[1]
 		case csKeySharedAccessKey:
 			key, err := base64.StdEncoding.DecodeString(kv[1])
 			if err != nil {
@@ -85,6 +92,8 @@ func ParseConnectionString(connection string) (*ConnectionString, error) {
 			cs.DeviceID = kv[1]
 		case csKeyModuleId:
 			cs.ModuleID = kv[1]
+		case csKeyX509:
+			cs.X509 = strings.EqualFold(kv[1], "true")
 		default:
 			return nil, fmt.Errorf("invalid connection string key: %s", kv[0])
 		}
@@ -109,7 +118,7 @@ func (cs ConnectionString) Validate() error {
 	}
 	err := validation.ValidateStruct(&cs,
 		validation.Field(&cs.HostName, validation.Required),
-		validation.Field(&cs.Key, validation.Required),
+		validation.Field(&cs.Key, validation.Required.When(!cs.X509)),
 	)
 	if err != nil {
 		return err
@@ -117,6 +126,9 @@ func (cs ConnectionString) Validate() error {
 	if cs.DeviceID == "" && cs.Name == "" {
 		return errors.New("one of 'DeviceId' or 'SharedAccessKeyName' must be set")
 	}
+	if cs.ModuleID != "" && cs.DeviceID == "" {
+		return errors.New("'ModuleId' requires 'DeviceId' to be set")
+	}
 	if len(cs.String()) > 4096 {
 		return ErrConnectionStringTooLong
 	}
@@ -153,10 +165,13 @@ func (cs ConnectionString) String() string {
 			continue
 		}
 		fieldVal := val.Field(i)
-		if fieldVal.Len() == 0 {
+		if fieldVal.IsZero() {
 			continue
 		}
 		switch typ := fieldVal.Interface().(type) {
+		case bool:
+			res = append(res, tag+"=true")
+
 		case []byte:
 			res = append(res, tag+"="+base64.StdEncoding.EncodeToString(typ))
 
@@ -0,0 +1,75 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package model
+
+import "time"
+
+type DeviceState string
+
+const (
+	// DeviceStateProvisioned is the state of devices successfully
+	// provisioned to the IoT Hub.
+	DeviceStateProvisioned DeviceState = "provisioned"
+	// DeviceStateProvisionFailed is the state of devices for which the
+	// last provisioning attempt failed.
+	DeviceStateProvisionFailed DeviceState = "provision_failed"
+	// DeviceStateDecommissionFailed is the state of devices for which the
+	// last decommissioning attempt failed.
+	DeviceStateDecommissionFailed DeviceState = "decommission_failed"
+)
+
+// Device is the record kept for every Mender device pushed to the IoT Hub.
+//nolint:lll
+type Device struct {
+	// ID is the Mender device ID.
+	ID       string `json:"id" bson:"_id"`
+	TenantID string `json:"-" bson:"tenant_id"`
+
+	// HubDeviceID is the identity of the device in the IoT Hub registry.
+	HubDeviceID string `json:"hub_device_id,omitempty" bson:"hub_device_id,omitempty"`
+	// HubHostName is the hostname of the IoT Hub the device is provisioned to.
+	HubHostName string `json:"hub_hostname,omitempty" bson:"hub_hostname,omitempty"`
+	// DeviceType is the Mender device type matched by the provisioning
+	// rules of the integrations.
+	DeviceType string `json:"device_type,omitempty" bson:"device_type,omitempty"`
+	// GatewayHostName is the hostname of the parent IoT Edge device the
+	// downstream device connects through.
+	GatewayHostName string `json:"gateway_hostname,omitempty" bson:"gateway_hostname,omitempty"`
+
+	State     DeviceState `json:"state,omitempty" bson:"state,omitempty"`
+	Status    string      `json:"status,omitempty" bson:"status,omitempty"`
+	LastError string      `json:"last_error,omitempty" bson:"last_error,omitempty"`
+
+	CreatedTS time.Time `json:"created_ts" bson:"created_ts"`
+	UpdatedTS time.Time `json:"updated_ts" bson:"updated_ts"`
+}
+
+// DeviceUpdate contains the fields to update on a Device record, nil fields
+// are left untouched.
+type DeviceUpdate struct {
+	HubDeviceID     *string      `bson:"hub_device_id,omitempty"`
+	HubHostName     *string      `bson:"hub_hostname,omitempty"`
+	DeviceType      *string      `bson:"device_type,omitempty"`
+	GatewayHostName *string      `bson:"gateway_hostname,omitempty"`
+	State           *DeviceState `bson:"state,omitempty"`
+	Status          *string      `bson:"status,omitempty"`
+	LastError       *string      `bson:"last_error,omitempty"`
+}
+
+// DeviceFilter selects device records, empty fields match all devices.
+type DeviceFilter struct {
+	IDs    []string
+	States []DeviceState
+}
@@ -0,0 +1,257 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package model
+
+import (
+	"time"
+
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/google/uuid"
+)
+
+// DeviceScope restricts the devices an integration applies to.
+type DeviceScope struct {
+	// DeviceIDs lists the Mender devices included in the scope.
+	DeviceIDs []string `json:"device_ids" bson:"device_ids"`
+}
+
+func (s DeviceScope) Validate() error {
+	return validation.ValidateStruct(&s,
+		validation.Field(&s.DeviceIDs, validation.Required),
+	)
+}
+
+// Includes returns true if the device is in the scope, a nil scope includes
+// all devices.
+func (s *DeviceScope) Includes(deviceID string) bool {
+	if s == nil {
+		return true
+	}
+	for _, id := range s.DeviceIDs {
+		if id == deviceID {
+			return true
+		}
+	}
+	return false
+}
+
+// ProvisioningRule applies provisioning options to the devices matching any
+// of its device types or device IDs.
+type ProvisioningRule struct {
+	// DeviceTypes matches the devices by their Mender device type.
+	DeviceTypes []string `json:"device_types,omitempty" bson:"device_types,omitempty"`
+	// DeviceIDs matches the devices by their Mender device ID.
+	DeviceIDs []string `json:"device_ids,omitempty" bson:"device_ids,omitempty"`
+
+	// IoTEdge provisions the matching devices as IoT Edge devices.
+	IoTEdge bool `json:"iot_edge" bson:"iot_edge"`
+}
+
+func (r ProvisioningRule) Validate() error {
+	return validation.ValidateStruct(&r,
+		validation.Field(&r.DeviceTypes,
+			validation.When(len(r.DeviceIDs) == 0, validation.Required.Error(
+				"one of 'device_types' or 'device_ids' must be set",
+			)),
+		),
+	)
+}
+
+// Matches returns true if the rule applies to the device.
+func (r ProvisioningRule) Matches(deviceID, deviceType string) bool {
+	for _, id := range r.DeviceIDs {
+		if id == deviceID {
+			return true
+		}
+	}
+	if deviceType == "" {
+		return false
+	}
+	for _, typ := range r.DeviceTypes {
+		if typ == deviceType {
+			return true
+		}
+	}
+	return false
+}
+
+// Integration is a named connection to a cloud provider devices are
+// provisioned to.
+//nolint:lll
+type Integration struct {
+	ID   uuid.UUID `json:"id" bson:"id"`
+	Name string    `json:"name" bson:"name"`
+
+	// Scope restricts the integration to a subset of the devices, if nil
+	// the integration applies to all devices.
+	Scope *DeviceScope `json:"scope,omitempty" bson:"scope,omitempty"`
+
+	Provider Provider        `json:"provider,omitempty" bson:"provider,omitempty"`
+	AWS      *AWSCredentials `json:"aws,omitempty" bson:"aws,omitempty"`
+
+	ConnectionString *ConnectionString `json:"connection_string,omitempty" bson:"connection_string,omitempty"`
+
+	DeviceAuth           DeviceAuthType        `json:"device_auth,omitempty" bson:"device_auth,omitempty"`
+	CertificateAuthority *CertificateAuthority `json:"certificate_authority,omitempty" bson:"certificate_authority,omitempty"`
+
+	ProvisioningMode ProvisioningMode `json:"provisioning_mode,omitempty" bson:"provisioning_mode,omitempty"`
+	DPS              *DPSSettings     `json:"dps,omitempty" bson:"dps,omitempty"`
+	// ProvisioningRules apply provisioning options to the matching
+	// devices, e.g. provision the devices of a device type as IoT Edge
+	// devices.
+	ProvisioningRules []ProvisioningRule `json:"provisioning_rules,omitempty" bson:"provisioning_rules,omitempty"`
+
+	// CreatedTS and UpdatedTS are maintained by the service, they are nil
+	// for integrations created before the timestamps were introduced.
+	CreatedTS *time.Time `json:"created_ts,omitempty" bson:"created_ts,omitempty"`
+	UpdatedTS *time.Time `json:"updated_ts,omitempty" bson:"updated_ts,omitempty"`
+}
+
+func (i Integration) Validate() error {
+	return i.validate(false)
+}
+
+// validate validates the integration, if update is set the secrets may be
+// omitted.
+func (i Integration) validate(update bool) error {
+	if i.ProvisioningMode == ProvisioningModeDPS && i.DeviceAuth == DeviceAuthX509 {
+		return ErrDPSX509NotSupported
+	}
+	return validation.ValidateStruct(&i,
+		validation.Field(&i.Name, validation.Required),
+		validation.Field(&i.Scope),
+		validation.Field(&i.Provider),
+		validation.Field(&i.AWS,
+			validation.Required.When(i.Provider == ProviderIoTCore),
+			onUpdate(update, validateAWSUpdate),
+			validation.Skip.When(update),
+		),
+		validation.Field(&i.ConnectionString,
+			validation.When(i.Provider != ProviderIoTCore && !update, validation.Required),
+		),
+		validation.Field(&i.DeviceAuth),
+		validation.Field(&i.CertificateAuthority,
+			validation.Required.When(i.DeviceAuth == DeviceAuthX509),
+			onUpdate(update, validateCAUpdate),
+			validation.Skip.When(update),
+		),
+		validation.Field(&i.ProvisioningMode),
+		validation.Field(&i.DPS,
+			validation.Required.When(i.ProvisioningMode == ProvisioningModeDPS),
+			onUpdate(update, validateDPSUpdate),
+			validation.Skip.When(update),
+		),
+		validation.Field(&i.ProvisioningRules,
+			validation.When(i.Provider == ProviderIoTCore,
+				validation.Empty.Error("not supported by AWS IoT Core"),
+			),
+		),
+	)
+}
+
+// IsEdgeDevice returns true if a provisioning rule of the integration
+// provisions the device as an IoT Edge device.
+func (i Integration) IsEdgeDevice(deviceID, deviceType string) bool {
+	for _, rule := range i.ProvisioningRules {
+		if rule.IoTEdge && rule.Matches(deviceID, deviceType) {
+			return true
+		}
+	}
+	return false
+}
+
+// onUpdate validates the value with fn if update is set. It must be
+// followed by validation.Skip.When(update) to skip the validation of the
+// value itself.
+func onUpdate(update bool, fn validation.RuleFunc) validation.Rule {
+	return validation.By(func(value interface{}) error {
+		if !update {
+			return nil
+		}
+		return fn(value)
+	})
+}
+
+func validateAWSUpdate(value interface{}) error {
+	creds, _ := value.(*AWSCredentials)
+	if creds == nil {
+		return nil
+	}
+	update := *creds
+	if update.SecretAccessKey == "" {
+		// Inherited from the stored credentials
+		update.SecretAccessKey = "-"
+	}
+	return update.Validate()
+}
+
+func validateCAUpdate(value interface{}) error {
+	ca, _ := value.(*CertificateAuthority)
+	if ca == nil {
+		return nil
+	} else if ca.PrivateKey == "" {
+		// The stored private key is inherited if the certificate is
+		// unchanged, the pair is validated after inheriting.
+		return validation.ValidateStruct(ca,
+			validation.Field(&ca.Certificate, validation.Required),
+		)
+	}
+	return ca.Validate()
+}
+
+func validateDPSUpdate(value interface{}) error {
+	dps, _ := value.(*DPSSettings)
+	if dps == nil {
+		return nil
+	}
+	return dps.validate(true)
+}
+
+// IntegrationUpdate is the request body replacing an integration. The
+// secrets may be omitted to keep the stored secrets.
+type IntegrationUpdate Integration
+
+func (i IntegrationUpdate) Validate() error {
+	return Integration(i).validate(true)
+}
+
+// InheritSecrets copies the secrets omitted from an update of the
+// integration from the stored integration:
+//  - the connection strings of the integration and of the DPS settings,
+//  - the AWS secret access key if the access key ID is unchanged,
+//  - the CA private key if the CA certificate is unchanged.
+func (i *Integration) InheritSecrets(stored Integration) {
+	if i.ConnectionString == nil && i.Provider != ProviderIoTCore {
+		i.ConnectionString = stored.ConnectionString
+	}
+	if i.DPS != nil && i.DPS.ConnectionString == nil && stored.DPS != nil {
+		dps := *i.DPS
+		dps.ConnectionString = stored.DPS.ConnectionString
+		i.DPS = &dps
+	}
+	if i.AWS != nil && i.AWS.SecretAccessKey == "" &&
+		stored.AWS != nil && stored.AWS.AccessKeyID == i.AWS.AccessKeyID {
+		aws := *i.AWS
+		aws.SecretAccessKey = stored.AWS.SecretAccessKey
+		i.AWS = &aws
+	}
+	if ca := i.CertificateAuthority; ca != nil && ca.PrivateKey == "" &&
+		stored.CertificateAuthority != nil &&
+		stored.CertificateAuthority.Certificate == ca.Certificate {
+		res := *ca
+		res.PrivateKey = stored.CertificateAuthority.PrivateKey
+		i.CertificateAuthority = &res
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package model
+
+import (
+	"time"
+
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/google/uuid"
+)
+
+// JobType identifies the operation performed by a background job.
+type JobType string
+
+const (
+	// JobTypeDeleteTenant removes the data of a tenant.
+	JobTypeDeleteTenant JobType = "delete_tenant"
+	// JobTypeRotateKeys rotates the keys of the devices of a tenant.
+	JobTypeRotateKeys JobType = "rotate_keys"
+	// JobTypeReconcile reconciles the devices of all tenants.
+	JobTypeReconcile JobType = "reconcile"
+	// JobTypeProvisionDevices provisions devices of a tenant in bulk.
+	JobTypeProvisionDevices JobType = "provision_devices"
+)
+
+var validateJobType = validation.In(
+	JobTypeDeleteTenant,
+	JobTypeRotateKeys,
+	JobTypeReconcile,
+	JobTypeProvisionDevices,
+)
+
+func (t JobType) Validate() error {
+	return validateJobType.Validate(t)
+}
+
+// JobStatus is the state of a background job.
+type JobStatus string
+
+const (
+	JobStatusPending   JobStatus = "pending"
+	JobStatusRunning   JobStatus = "running"
+	JobStatusSucceeded JobStatus = "succeeded"
+	JobStatusFailed    JobStatus = "failed"
+)
+
+var validateJobStatus = validation.In(
+	JobStatusPending,
+	JobStatusRunning,
+	JobStatusSucceeded,
+	JobStatusFailed,
+)
+
+func (s JobStatus) Validate() error {
+	return validateJobStatus.Validate(s)
+}
+
+// MaxJobItemErrors is the maximum number of item errors recorded per job.
+const MaxJobItemErrors = 100
+
+// JobItemError describes why the job failed to process an item.
+type JobItemError struct {
+	Item  string `json:"item" bson:"item"`
+	Error string `json:"error" bson:"error"`
+}
+
+// JobProgress counts the items processed by a job.
+type JobProgress struct {
+	Total     int `json:"total" bson:"total"`
+	Succeeded int `json:"succeeded" bson:"succeeded"`
+	Failed    int `json:"failed" bson:"failed"`
+}
+
+// Job is the record tracking a background operation.
+type Job struct {
+	ID       uuid.UUID `json:"id" bson:"_id"`
+	TenantID string    `json:"tenant_id" bson:"tenant_id"`
+	Type     JobType   `json:"type" bson:"type"`
+	Status   JobStatus `json:"status" bson:"status"`
+
+	// Params are the parameters of the operation.
+	Params map[string]string `json:"params,omitempty" bson:"params,omitempty"`
+
+	Progress JobProgress `json:"progress" bson:"progress"`
+	// ItemErrors lists the first MaxJobItemErrors items that failed.
+	ItemErrors []JobItemError `json:"item_errors,omitempty" bson:"item_errors,omitempty"`
+	// Error describes why the job failed.
+	Error string `json:"error,omitempty" bson:"error,omitempty"`
+
+	// Attempts counts the times the job was claimed by a worker.
+	Attempts int `json:"attempts" bson:"attempts"`
+	// LeaseOwner is the worker running the job until LeaseExpiresTS, once
+	// the lease expires the job can be claimed by another worker.
+	LeaseOwner     string     `json:"-" bson:"lease_owner,omitempty"`
+	LeaseExpiresTS *time.Time `json:"-" bson:"lease_expires_ts,omitempty"`
+
+	CreatedTS time.Time `json:"created_ts" bson:"created_ts"`
+	UpdatedTS time.Time `json:"updated_ts" bson:"updated_ts"`
+}
+
+// NewJob returns a pending job of the given type.
+func NewJob(tenantID string, jobType JobType, params map[string]string) Job {
+	now := time.Now().UTC()
+	return Job{
+		ID:        uuid.New(),
+		TenantID:  tenantID,
+		Type:      jobType,
+		Params:    params,
+		Status:    JobStatusPending,
+		CreatedTS: now,
+		UpdatedTS: now,
+	}
+}
+
+// JobUpdate contains the fields to update on a Job record, nil fields are
+// left untouched.
+type JobUpdate struct {
+	Status   *JobStatus   `bson:"status,omitempty"`
+	Progress *JobProgress `bson:"progress,omitempty"`
+	Error    *string      `bson:"error,omitempty"`
+
+	LeaseExpiresTS *time.Time `bson:"lease_expires_ts,omitempty"`
+
+	// ItemErrors are appended to the item errors of the job, up to
+	// MaxJobItemErrors.
+	ItemErrors []JobItemError `bson:"-"`
+	// LeaseOwner, if set, restricts the update to the job leased by the
+	// owner.
+	LeaseOwner string `bson:"-"`
+}
+
+// JobFilter selects the jobs of a tenant, zero fields match all jobs.
+type JobFilter struct {
+	Type   JobType
+	Status JobStatus
+}
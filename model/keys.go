@@ -0,0 +1,58 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package model
+
+import (
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+)
+
+// KeyRotationPhase selects which device keys are replaced by a symmetric
+// key rotation.
+type KeyRotationPhase string
+
+const (
+	// KeyRotationPhaseAll regenerates both the primary and the secondary
+	// key at once. Devices lose access until they receive the new keys,
+	// so it must be selected explicitly.
+	KeyRotationPhaseAll KeyRotationPhase = "all"
+	// KeyRotationPhasePromote swaps the primary and the secondary key.
+	// Both keys remain valid, so devices that have not yet received the
+	// new primary key keep their access.
+	KeyRotationPhasePromote KeyRotationPhase = "promote"
+	// KeyRotationPhaseRegenerate regenerates the secondary key, which is
+	// the former primary key after the promote phase.
+	KeyRotationPhaseRegenerate KeyRotationPhase = "regenerate"
+)
+
+var validateKeyRotationPhase = validation.In(
+	KeyRotationPhaseAll,
+	KeyRotationPhasePromote,
+	KeyRotationPhaseRegenerate,
+)
+
+func (p KeyRotationPhase) Validate() error {
+	return validateKeyRotationPhase.Validate(p)
+}
+
+// KeyRotation is the request for rotating device keys.
+type KeyRotation struct {
+	Phase KeyRotationPhase `json:"phase"`
+}
+
+func (r KeyRotation) Validate() error {
+	return validation.ValidateStruct(&r,
+		validation.Field(&r.Phase, validation.Required),
+	)
+}
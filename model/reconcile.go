@@ -0,0 +1,52 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package model
+
+// ReconcileOptions select how the reconciliation resolves the differences
+// it finds, by default the differences are only reported.
+type ReconcileOptions struct {
+	// Fix provisions the missing devices again and records the
+	// unrecorded devices.
+	Fix bool
+	// DeleteOrphans removes the orphaned devices from the IoT Hub.
+	DeleteOrphans bool
+}
+
+// ReconcileReport is the result of comparing the devices known to Mender
+// with the devices registered in one of the tenant's IoT Hub integrations.
+type ReconcileReport struct {
+	TenantID      string `json:"tenant_id"`
+	IntegrationID string `json:"integration_id,omitempty"`
+
+	// Orphans are devices tagged by Mender in the IoT Hub that Mender
+	// does not know about (or failed to decommission).
+	Orphans []string `json:"orphans"`
+	// Missing are devices known to Mender that are not present in the
+	// IoT Hub.
+	Missing []string `json:"missing"`
+	// Unrecorded are devices tagged by Mender in the IoT Hub that Mender
+	// knows about but keeps no device record of, e.g. devices provisioned
+	// before the device records were introduced.
+	Unrecorded []string `json:"unrecorded"`
+
+	// Fixed is true if the reconciliation attempted to resolve the
+	// differences.
+	Fixed bool `json:"fixed"`
+	// Errors contains the errors encountered while fixing individual
+	// devices.
+	Errors []string `json:"errors,omitempty"`
+	// Error is set if the tenant could not be reconciled.
+	Error string `json:"error,omitempty"`
+}
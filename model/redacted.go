@@ -0,0 +1,185 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package model
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"time"
+)
+
+// Fingerprint returns the SHA-256 fingerprint of a secret in the format
+// used by OpenSSH, for identifying the secret without disclosing it.
+func Fingerprint(secret []byte) string {
+	if len(secret) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(secret)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// RedactedConnectionString is the connection string returned by the API,
+// the shared access key is replaced by its fingerprint.
+type RedactedConnectionString struct {
+	HostName        string `json:"hostname"`
+	GatewayHostName string `json:"gateway_hostname,omitempty"`
+	PolicyName      string `json:"policy_name,omitempty"`
+	DeviceID        string `json:"device_id,omitempty"`
+	ModuleID        string `json:"module_id,omitempty"`
+	KeyFingerprint  string `json:"key_fingerprint,omitempty"`
+	X509            bool   `json:"x509,omitempty"`
+}
+
+func (cs *ConnectionString) Redacted() *RedactedConnectionString {
+	if cs == nil {
+		return nil
+	}
+	return &RedactedConnectionString{
+		HostName:        cs.HostName,
+		GatewayHostName: cs.GatewayHostName,
+		PolicyName:      cs.Name,
+		DeviceID:        cs.DeviceID,
+		ModuleID:        cs.ModuleID,
+		KeyFingerprint:  Fingerprint(cs.Key),
+		X509:            cs.X509,
+	}
+}
+
+// RedactedAWSCredentials are the AWS credentials returned by the API, the
+// secret access key is replaced by its fingerprint.
+//nolint:lll
+type RedactedAWSCredentials struct {
+	AWSCredentials
+	SecretAccessKey            string `json:"secret_access_key,omitempty"`
+	SecretAccessKeyFingerprint string `json:"secret_access_key_fingerprint,omitempty"`
+}
+
+func (creds *AWSCredentials) Redacted() *RedactedAWSCredentials {
+	if creds == nil {
+		return nil
+	}
+	res := &RedactedAWSCredentials{
+		AWSCredentials:             *creds,
+		SecretAccessKeyFingerprint: Fingerprint([]byte(creds.SecretAccessKey)),
+	}
+	res.AWSCredentials.SecretAccessKey = ""
+	return res
+}
+
+// RedactedCertificateAuthority is the certificate authority returned by
+// the API, the private key is replaced by its fingerprint.
+//nolint:lll
+type RedactedCertificateAuthority struct {
+	CertificateAuthority
+	PrivateKey            string `json:"private_key,omitempty"`
+	PrivateKeyFingerprint string `json:"private_key_fingerprint,omitempty"`
+}
+
+func (ca *CertificateAuthority) Redacted() *RedactedCertificateAuthority {
+	if ca == nil {
+		return nil
+	}
+	res := &RedactedCertificateAuthority{
+		CertificateAuthority:  *ca,
+		PrivateKeyFingerprint: Fingerprint([]byte(ca.PrivateKey)),
+	}
+	res.CertificateAuthority.PrivateKey = ""
+	return res
+}
+
+// RedactedDPSSettings are the DPS settings returned by the API.
+type RedactedDPSSettings struct {
+	DPSSettings
+	ConnectionString *RedactedConnectionString `json:"connection_string"`
+}
+
+func (s *DPSSettings) Redacted() *RedactedDPSSettings {
+	if s == nil {
+		return nil
+	}
+	res := &RedactedDPSSettings{
+		DPSSettings:      *s,
+		ConnectionString: s.ConnectionString.Redacted(),
+	}
+	res.DPSSettings.ConnectionString = nil
+	return res
+}
+
+// RedactedIntegration is the integration returned by the API. The secrets
+// are replaced by their fingerprints, the fields of the embedded
+// integration holding secrets are shadowed by their redacted counterparts.
+//nolint:lll
+type RedactedIntegration struct {
+	Integration
+	AWS                  *RedactedAWSCredentials       `json:"aws,omitempty"`
+	ConnectionString     *RedactedConnectionString     `json:"connection_string,omitempty"`
+	CertificateAuthority *RedactedCertificateAuthority `json:"certificate_authority,omitempty"`
+	DPS                  *RedactedDPSSettings          `json:"dps,omitempty"`
+}
+
+func (i Integration) Redacted() RedactedIntegration {
+	res := RedactedIntegration{
+		Integration:          i,
+		AWS:                  i.AWS.Redacted(),
+		ConnectionString:     i.ConnectionString.Redacted(),
+		CertificateAuthority: i.CertificateAuthority.Redacted(),
+		DPS:                  i.DPS.Redacted(),
+	}
+	res.Integration.AWS = nil
+	res.Integration.ConnectionString = nil
+	res.Integration.CertificateAuthority = nil
+	res.Integration.DPS = nil
+	return res
+}
+
+// RedactedSettings are the settings returned by the API.
+type RedactedSettings struct {
+	Integrations []RedactedIntegration `json:"integrations"`
+	// ConnectionString is the connection string of the default
+	// integration, for the clients of the settings before integrations
+	// existed.
+	ConnectionString *RedactedConnectionString `json:"connection_string,omitempty"`
+}
+
+func (s Settings) Redacted() RedactedSettings {
+	var res RedactedSettings
+	if integration := s.DefaultIntegration(); integration != nil {
+		res.ConnectionString = integration.ConnectionString.Redacted()
+	}
+	if s.Integrations != nil {
+		res.Integrations = make([]RedactedIntegration, len(s.Integrations))
+		for i, integration := range s.Integrations {
+			res.Integrations[i] = integration.Redacted()
+		}
+	}
+	return res
+}
+
+// RedactedSettingsRevision is a settings revision returned by the API.
+type RedactedSettingsRevision struct {
+	Revision int `json:"revision"`
+	RedactedSettings
+	CreatedTS time.Time `json:"created_ts"`
+	CreatedBy string    `json:"created_by,omitempty"`
+}
+
+func (rev SettingsRevision) Redacted() RedactedSettingsRevision {
+	return RedactedSettingsRevision{
+		Revision:         rev.Revision,
+		RedactedSettings: rev.Settings.Redacted(),
+		CreatedTS:        rev.CreatedTS,
+		CreatedBy:        rev.CreatedBy,
+	}
+}
@@ -14,15 +14,239 @@
 
 package model
 
-import validation "github.com/go-ozzo/ozzo-validation/v4"
+import (
+	"time"
 
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrDPSX509NotSupported = errors.New(
+		"x509 device authentication is not supported with DPS provisioning",
+	)
+)
+
+// Provider selects the cloud provider devices are provisioned to.
+type Provider string
+
+const (
+	// ProviderIoTHub provisions devices to Azure IoT Hub (default).
+	ProviderIoTHub Provider = "iot-hub"
+	// ProviderIoTCore provisions devices to AWS IoT Core.
+	ProviderIoTCore Provider = "iot-core"
+)
+
+var validateProvider = validation.In(
+	ProviderIoTHub,
+	ProviderIoTCore,
+)
+
+func (p Provider) Validate() error {
+	return validateProvider.Validate(p)
+}
+
+// DeviceAuthType selects how provisioned devices authenticate to the hub.
+type DeviceAuthType string
+
+const (
+	// DeviceAuthSymmetricKey provisions devices with hub generated
+	// symmetric keys (default).
+	DeviceAuthSymmetricKey DeviceAuthType = "symmetric_key"
+	// DeviceAuthX509 provisions devices with X.509 certificates signed by
+	// the tenant's certificate authority.
+	DeviceAuthX509 DeviceAuthType = "x509"
+)
+
+var validateDeviceAuthType = validation.In(
+	DeviceAuthSymmetricKey,
+	DeviceAuthX509,
+)
+
+func (t DeviceAuthType) Validate() error {
+	return validateDeviceAuthType.Validate(t)
+}
+
+// ProvisioningMode selects how devices are registered in the IoT Hub.
+type ProvisioningMode string
+
+const (
+	// ProvisioningModeRegistry creates the devices directly in the IoT Hub
+	// identity registry (default).
+	ProvisioningModeRegistry ProvisioningMode = "registry"
+	// ProvisioningModeDPS enrolls the devices in the Device Provisioning
+	// Service, the devices register with the hub themselves.
+	ProvisioningModeDPS ProvisioningMode = "dps"
+)
+
+var validateProvisioningMode = validation.In(
+	ProvisioningModeRegistry,
+	ProvisioningModeDPS,
+)
+
+func (m ProvisioningMode) Validate() error {
+	return validateProvisioningMode.Validate(m)
+}
+
+// DPSSettings configures the Device Provisioning Service used for
+// provisioning devices.
 //nolint:lll
+type DPSSettings struct {
+	// ConnectionString is the service connection string of the
+	// provisioning service.
+	ConnectionString *ConnectionString `json:"connection_string" bson:"connection_string"`
+	// IDScope is the ID scope of the provisioning service sent to the
+	// devices.
+	IDScope string `json:"id_scope" bson:"id_scope"`
+	// GlobalEndpoint is the device registration endpoint, defaults to
+	// global.azure-devices-provisioning.net.
+	GlobalEndpoint string `json:"global_endpoint,omitempty" bson:"global_endpoint,omitempty"`
+	// EnrollmentGroupID selects a symmetric key enrollment group to derive
+	// the device keys from. If empty, an individual enrollment is created
+	// for every device.
+	EnrollmentGroupID string `json:"enrollment_group_id,omitempty" bson:"enrollment_group_id,omitempty"`
+}
+
+func (s DPSSettings) Validate() error {
+	return s.validate(false)
+}
+
+func (s DPSSettings) validate(update bool) error {
+	return validation.ValidateStruct(&s,
+		validation.Field(&s.ConnectionString, validation.Required.When(!update)),
+		validation.Field(&s.IDScope, validation.Required),
+	)
+}
+
+// IntegrationNameDefault is the name of the integration holding the
+// connection string of the settings before integrations existed.
+const IntegrationNameDefault = "default"
+
+// Settings holds the integrations configured for a tenant.
 type Settings struct {
-	ConnectionString *ConnectionString `json:"connection_string,omitempty" bson:"connection_string,omitempty"`
+	Integrations []Integration `json:"integrations" bson:"integrations"`
+	// Revision is the revision of the stored settings. When replacing the
+	// settings, it is the revision the new settings are based on.
+	Revision int `json:"-" bson:"revision"`
+}
+
+// SettingsRevision is an immutable revision of the settings of a tenant.
+type SettingsRevision struct {
+	Settings `bson:",inline"`
+	// CreatedTS is the time the revision was stored.
+	CreatedTS time.Time `json:"created_ts" bson:"created_ts"`
+	// CreatedBy is the subject of the identity that stored the revision.
+	CreatedBy string `json:"created_by,omitempty" bson:"created_by,omitempty"`
 }
 
 func (s Settings) Validate() error {
-	return validation.ValidateStruct(&s,
-		validation.Field(&s.ConnectionString),
+	err := validation.ValidateStruct(&s,
+		validation.Field(&s.Integrations),
 	)
+	if err != nil {
+		return err
+	}
+	return s.validateUnique()
+}
+
+// SettingsUpdate is the request body replacing the settings. The secrets
+// of existing integrations may be omitted to keep the stored secrets, see
+// Integration.InheritSecrets.
+type SettingsUpdate Settings
+
+func (s SettingsUpdate) Validate() error {
+	integrations := make([]IntegrationUpdate, len(s.Integrations))
+	for i, integration := range s.Integrations {
+		integrations[i] = IntegrationUpdate(integration)
+	}
+	err := validation.Errors{
+		"integrations": validation.Validate(integrations),
+	}.Filter()
+	if err != nil {
+		return err
+	}
+	return Settings(s).validateUnique()
+}
+
+func (s Settings) validateUnique() error {
+	ids := make(map[uuid.UUID]struct{}, len(s.Integrations))
+	names := make(map[string]struct{}, len(s.Integrations))
+	for _, integration := range s.Integrations {
+		if integration.ID != uuid.Nil {
+			if _, ok := ids[integration.ID]; ok {
+				return errors.Errorf(
+					"integrations: duplicate integration ID %s",
+					integration.ID,
+				)
+			}
+			ids[integration.ID] = struct{}{}
+		}
+		if _, ok := names[integration.Name]; ok {
+			return errors.Errorf(
+				"integrations: duplicate integration name %q",
+				integration.Name,
+			)
+		}
+		names[integration.Name] = struct{}{}
+	}
+	return nil
+}
+
+// DefaultIntegration returns the integration named IntegrationNameDefault
+// or nil if it does not exist.
+func (s Settings) DefaultIntegration() *Integration {
+	for i := range s.Integrations {
+		if s.Integrations[i].Name == IntegrationNameDefault {
+			return &s.Integrations[i]
+		}
+	}
+	return nil
+}
+
+// SetDefaultConnectionString replaces the connection string of the default
+// integration, the other integrations are kept. The default integration is
+// created if it does not exist, and removed if cs is nil.
+func (s *Settings) SetDefaultConnectionString(cs *ConnectionString) {
+	for i := range s.Integrations {
+		if s.Integrations[i].Name != IntegrationNameDefault {
+			continue
+		}
+		if cs == nil {
+			s.Integrations = append(s.Integrations[:i], s.Integrations[i+1:]...)
+		} else {
+			s.Integrations[i].ConnectionString = cs
+		}
+		return
+	}
+	if cs != nil {
+		s.Integrations = append(s.Integrations, Integration{
+			Name:             IntegrationNameDefault,
+			Provider:         ProviderIoTHub,
+			ConnectionString: cs,
+		})
+	}
+}
+
+// Integration returns the integration with the given ID or nil if it does
+// not exist.
+func (s Settings) Integration(id uuid.UUID) *Integration {
+	for i := range s.Integrations {
+		if s.Integrations[i].ID == id {
+			return &s.Integrations[i]
+		}
+	}
+	return nil
+}
+
+// DeviceIntegrations returns the integrations whose scope includes the
+// device.
+func (s Settings) DeviceIntegrations(deviceID string) []Integration {
+	integrations := make([]Integration, 0, len(s.Integrations))
+	for _, integration := range s.Integrations {
+		if integration.Scope.Includes(deviceID) {
+			integrations = append(integrations, integration)
+		}
+	}
+	return integrations
 }
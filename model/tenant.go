@@ -0,0 +1,42 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package model
+
+import (
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+)
+
+// TenantDevicesAction selects what happens to the IoT Hub devices of a
+// tenant being deleted.
+type TenantDevicesAction string
+
+const (
+	// TenantDevicesKeep leaves the devices in the IoT Hub (default).
+	TenantDevicesKeep TenantDevicesAction = "keep"
+	// TenantDevicesDelete deletes the devices from the IoT Hub.
+	TenantDevicesDelete TenantDevicesAction = "delete"
+	// TenantDevicesDisable disables the devices in the IoT Hub.
+	TenantDevicesDisable TenantDevicesAction = "disable"
+)
+
+var validateTenantDevicesAction = validation.In(
+	TenantDevicesKeep,
+	TenantDevicesDelete,
+	TenantDevicesDisable,
+)
+
+func (a TenantDevicesAction) Validate() error {
+	return validateTenantDevicesAction.Validate(a)
+}
@@ -0,0 +1,46 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/google/uuid"
+
+	"github.com/mendersoftware/go-lib-micro/log"
+
+	"github.com/mendersoftware/iot-manager/app"
+)
+
+// runJobWorkers starts workers running the background jobs until the
+// context is canceled. The worker IDs are unique across replicas.
+func runJobWorkers(ctx context.Context, iotManager app.App, workers int) {
+	l := log.FromContext(ctx)
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "iot-manager"
+	}
+	instanceID := uuid.New().String()
+	for i := 0; i < workers; i++ {
+		workerID := fmt.Sprintf("%s/%s/%d", hostname, instanceID, i)
+		go func() {
+			if err := iotManager.RunJobWorker(ctx, workerID); err != nil {
+				l.Errorf("job worker %s stopped: %s", workerID, err)
+			}
+		}()
+	}
+}
@@ -0,0 +1,55 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/mendersoftware/go-lib-micro/log"
+
+	"github.com/mendersoftware/iot-manager/app"
+	"github.com/mendersoftware/iot-manager/model"
+)
+
+// runReconciliation schedules the reconciliation of the devices of all
+// tenants every interval until the context is canceled. The reconciliation
+// runs as a job, so that a single job worker of all the replicas runs it.
+func runReconciliation(
+	ctx context.Context,
+	iotManager app.App,
+	interval time.Duration,
+	opts model.ReconcileOptions,
+) {
+	l := log.FromContext(ctx)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		job, err := iotManager.ScheduleReconciliation(ctx, interval, opts)
+		switch err {
+		case nil:
+			l.Infof("scheduled device reconciliation job %s", job.ID)
+		case app.ErrJobExists:
+			// Scheduled by another replica.
+		default:
+			l.Errorf("failed to schedule device reconciliation: %s", err)
+		}
+	}
+}
@@ -28,9 +28,13 @@ import (
 
 	api "github.com/mendersoftware/iot-manager/api/http"
 	"github.com/mendersoftware/iot-manager/app"
+	"github.com/mendersoftware/iot-manager/client/devauth"
+	"github.com/mendersoftware/iot-manager/client/dps"
+	"github.com/mendersoftware/iot-manager/client/iotcore"
 	"github.com/mendersoftware/iot-manager/client/iothub"
 	"github.com/mendersoftware/iot-manager/client/workflows"
 	dconfig "github.com/mendersoftware/iot-manager/config"
+	"github.com/mendersoftware/iot-manager/model"
 	"github.com/mendersoftware/iot-manager/store"
 )
 
@@ -42,14 +46,42 @@ func InitAndRun(conf config.Reader, dataStore store.DataStore) error {
 		conf.GetString(dconfig.SettingWorkflowsURL),
 		workflows.NewOptions().SetClient(httpClient),
 	)
-	hub := iothub.NewClient(iothub.NewOptions().SetClient(httpClient))
+	hub := iothub.NewClient(iothub.NewOptions().
+		SetClient(httpClient).
+		SetMaxRetries(conf.GetInt(dconfig.SettingIoTHubMaxRetries)).
+		SetBackoff(
+			conf.GetDuration(dconfig.SettingIoTHubMinBackoff),
+			conf.GetDuration(dconfig.SettingIoTHubMaxBackoff),
+		))
+	devauthClient := devauth.NewClient(
+		conf.GetString(dconfig.SettingDeviceauthURL),
+		devauth.NewOptions().SetClient(httpClient),
+	)
+	dpsClient := dps.NewClient(dps.NewOptions().SetClient(httpClient))
+	iotcoreClient := iotcore.NewClient(iotcore.NewOptions().SetClient(httpClient))
 
 	log.Setup(conf.GetBool(dconfig.SettingDebugLog))
 	l := log.FromContext(ctx)
 
-	azureIotManagerApp := app.New(dataStore, hub, wf)
+	azureIotManagerApp := app.New(dataStore, hub, wf, app.NewOptions().
+		SetDPS(dpsClient).
+		SetIoTCore(iotcoreClient).
+		SetDeviceAuth(devauthClient).
+		SetConnectionStringVerification(
+			conf.GetBool(dconfig.SettingVerifyConnectionString),
+		).
+		SetCredentialsReveal(conf.GetBool(dconfig.SettingAllowCredentialsReveal)).
+		SetBulkConcurrency(conf.GetInt(dconfig.SettingBulkConcurrency)),
+	)
 
-	router := api.NewRouter(azureIotManagerApp, api.NewConfig().SetClient(httpClient))
+	router := api.NewRouter(azureIotManagerApp, api.NewConfig().
+		SetClient(httpClient).
+		SetMaxBulkItems(conf.GetInt(dconfig.SettingBulkMaxItems)).
+		SetMaxBulkJobItems(conf.GetInt(dconfig.SettingBulkMaxJobItems)).
+		SetMaxBulkDecommissionItems(
+			conf.GetInt(dconfig.SettingBulkMaxDecommissionItems),
+		),
+	)
 
 	var listen = conf.GetString(dconfig.SettingListen)
 	srv := &http.Server{
@@ -57,6 +89,20 @@ func InitAndRun(conf config.Reader, dataStore store.DataStore) error {
 		Handler: router,
 	}
 
+	ctx, cancelReconcile := context.WithCancel(ctx)
+	defer cancelReconcile()
+	runJobWorkers(ctx, azureIotManagerApp, conf.GetInt(dconfig.SettingJobWorkers))
+	if interval := conf.GetDuration(dconfig.SettingReconcileInterval); interval > 0 {
+		go runReconciliation(ctx,
+			azureIotManagerApp,
+			interval,
+			model.ReconcileOptions{
+				Fix:           conf.GetBool(dconfig.SettingReconcileFix),
+				DeleteOrphans: conf.GetBool(dconfig.SettingReconcileDeleteOrphans),
+			},
+		)
+	}
+
 	l.Info("Azure IoT Manager service starting up")
 	l.Infof("listening on %s", listen)
 
@@ -17,6 +17,9 @@ package store
 import (
 	"context"
 	"errors"
+	"time"
+
+	"github.com/google/uuid"
 
 	"github.com/mendersoftware/iot-manager/model"
 )
@@ -28,11 +31,55 @@ type DataStore interface {
 	Ping(ctx context.Context) error
 	Close() error
 
+	// SetSettings stores the settings as a new revision. It returns
+	// ErrRevisionConflict if settings.Revision is not the current revision.
 	SetSettings(ctx context.Context, settings model.Settings) error
 	GetSettings(ctx context.Context) (model.Settings, error)
+	// GetSettingsHistory returns the revisions of the settings, the most
+	// recent first.
+	GetSettingsHistory(ctx context.Context, skip, limit int64) ([]model.SettingsRevision, error)
+	GetSettingsRevision(ctx context.Context, revision int) (*model.SettingsRevision, error)
+	// GetTenantIDs returns the IDs of all tenants with stored settings.
+	GetTenantIDs(ctx context.Context) ([]string, error)
+	// RotateEncryptionKey re-encrypts the secrets in the settings of all
+	// tenants with the current encryption key.
+	RotateEncryptionKey(ctx context.Context) (int, error)
+
+	GetDevice(ctx context.Context, deviceID string) (*model.Device, error)
+	GetDevices(ctx context.Context, fltr model.DeviceFilter) ([]model.Device, error)
+	// UpsertDevice updates the device record with the given ID and creates
+	// it if it does not exist.
+	UpsertDevice(ctx context.Context, deviceID string, update model.DeviceUpdate) error
+	// UpsertDevices applies the updates indexed by device ID in a single
+	// round trip.
+	UpsertDevices(ctx context.Context, updates map[string]model.DeviceUpdate) error
+	DeleteDevice(ctx context.Context, deviceID string) error
+	DeleteDevices(ctx context.Context, deviceIDs []string) error
+
+	// DeleteTenant removes the settings, the settings history, the device
+	// records and the job records of the tenant, except the record of the
+	// job keepJobID running the deletion.
+	DeleteTenant(ctx context.Context, keepJobID uuid.UUID) error
+
+	// CreateJob inserts the job, ErrObjectExists is returned if a job
+	// with the same ID exists.
+	CreateJob(ctx context.Context, job model.Job) error
+	GetJob(ctx context.Context, jobID uuid.UUID) (*model.Job, error)
+	// GetJobs returns the jobs of the tenant matching the filter, the most
+	// recent first.
+	GetJobs(ctx context.Context, fltr model.JobFilter, skip, limit int64) ([]model.Job, error)
+	// ClaimJob leases the oldest pending job, or running job whose lease
+	// expired, of any tenant to the owner. ErrObjectNotFound is returned if
+	// there is no job to claim.
+	ClaimJob(ctx context.Context, owner string, leaseDuration time.Duration) (*model.Job, error)
+	UpdateJob(ctx context.Context, jobID uuid.UUID, update model.JobUpdate) error
 }
 
 var (
 	ErrSerialization  = errors.New("store: failed to serialize object")
 	ErrObjectNotFound = errors.New("store: object not found")
+	ErrObjectExists   = errors.New("store: object already exists")
+	// ErrRevisionConflict is returned when the settings have been
+	// modified since they were read.
+	ErrRevisionConflict = errors.New("store: settings revision conflict")
 )
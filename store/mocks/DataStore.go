@@ -21,6 +21,10 @@ import (
 
 	model "github.com/mendersoftware/iot-manager/model"
 	mock "github.com/stretchr/testify/mock"
+
+	time "time"
+
+	uuid "github.com/google/uuid"
 )
 
 // DataStore is an autogenerated mock type for the DataStore type
@@ -28,6 +32,29 @@ type DataStore struct {
 	mock.Mock
 }
 
+// ClaimJob provides a mock function with given fields: ctx, owner, leaseDuration
+func (_m *DataStore) ClaimJob(ctx context.Context, owner string, leaseDuration time.Duration) (*model.Job, error) {
+	ret := _m.Called(ctx, owner, leaseDuration)
+
+	var r0 *model.Job
+	if rf, ok := ret.Get(0).(func(context.Context, string, time.Duration) *model.Job); ok {
+		r0 = rf(ctx, owner, leaseDuration)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*model.Job)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, time.Duration) error); ok {
+		r1 = rf(ctx, owner, leaseDuration)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // Close provides a mock function with given fields:
 func (_m *DataStore) Close() error {
 	ret := _m.Called()
@@ -42,6 +69,154 @@ func (_m *DataStore) Close() error {
 	return r0
 }
 
+// CreateJob provides a mock function with given fields: ctx, job
+func (_m *DataStore) CreateJob(ctx context.Context, job model.Job) error {
+	ret := _m.Called(ctx, job)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, model.Job) error); ok {
+		r0 = rf(ctx, job)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// DeleteDevice provides a mock function with given fields: ctx, deviceID
+func (_m *DataStore) DeleteDevice(ctx context.Context, deviceID string) error {
+	ret := _m.Called(ctx, deviceID)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string) error); ok {
+		r0 = rf(ctx, deviceID)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// DeleteDevices provides a mock function with given fields: ctx, deviceIDs
+func (_m *DataStore) DeleteDevices(ctx context.Context, deviceIDs []string) error {
+	ret := _m.Called(ctx, deviceIDs)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, []string) error); ok {
+		r0 = rf(ctx, deviceIDs)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// DeleteTenant provides a mock function with given fields: ctx, keepJobID
+func (_m *DataStore) DeleteTenant(ctx context.Context, keepJobID uuid.UUID) error {
+	ret := _m.Called(ctx, keepJobID)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, uuid.UUID) error); ok {
+		r0 = rf(ctx, keepJobID)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// GetDevice provides a mock function with given fields: ctx, deviceID
+func (_m *DataStore) GetDevice(ctx context.Context, deviceID string) (*model.Device, error) {
+	ret := _m.Called(ctx, deviceID)
+
+	var r0 *model.Device
+	if rf, ok := ret.Get(0).(func(context.Context, string) *model.Device); ok {
+		r0 = rf(ctx, deviceID)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*model.Device)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
+		r1 = rf(ctx, deviceID)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetDevices provides a mock function with given fields: ctx, fltr
+func (_m *DataStore) GetDevices(ctx context.Context, fltr model.DeviceFilter) ([]model.Device, error) {
+	ret := _m.Called(ctx, fltr)
+
+	var r0 []model.Device
+	if rf, ok := ret.Get(0).(func(context.Context, model.DeviceFilter) []model.Device); ok {
+		r0 = rf(ctx, fltr)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]model.Device)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, model.DeviceFilter) error); ok {
+		r1 = rf(ctx, fltr)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetJob provides a mock function with given fields: ctx, jobID
+func (_m *DataStore) GetJob(ctx context.Context, jobID uuid.UUID) (*model.Job, error) {
+	ret := _m.Called(ctx, jobID)
+
+	var r0 *model.Job
+	if rf, ok := ret.Get(0).(func(context.Context, uuid.UUID) *model.Job); ok {
+		r0 = rf(ctx, jobID)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*model.Job)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, uuid.UUID) error); ok {
+		r1 = rf(ctx, jobID)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetJobs provides a mock function with given fields: ctx, fltr, skip, limit
+func (_m *DataStore) GetJobs(ctx context.Context, fltr model.JobFilter, skip int64, limit int64) ([]model.Job, error) {
+	ret := _m.Called(ctx, fltr, skip, limit)
+
+	var r0 []model.Job
+	if rf, ok := ret.Get(0).(func(context.Context, model.JobFilter, int64, int64) []model.Job); ok {
+		r0 = rf(ctx, fltr, skip, limit)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]model.Job)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, model.JobFilter, int64, int64) error); ok {
+		r1 = rf(ctx, fltr, skip, limit)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // GetSettings provides a mock function with given fields: ctx
 func (_m *DataStore) GetSettings(ctx context.Context) (model.Settings, error) {
 	ret := _m.Called(ctx)
@@ -63,6 +238,75 @@ func (_m *DataStore) GetSettings(ctx context.Context) (model.Settings, error) {
 	return r0, r1
 }
 
+// GetSettingsHistory provides a mock function with given fields: ctx, skip, limit
+func (_m *DataStore) GetSettingsHistory(ctx context.Context, skip int64, limit int64) ([]model.SettingsRevision, error) {
+	ret := _m.Called(ctx, skip, limit)
+
+	var r0 []model.SettingsRevision
+	if rf, ok := ret.Get(0).(func(context.Context, int64, int64) []model.SettingsRevision); ok {
+		r0 = rf(ctx, skip, limit)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]model.SettingsRevision)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, int64, int64) error); ok {
+		r1 = rf(ctx, skip, limit)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetSettingsRevision provides a mock function with given fields: ctx, revision
+func (_m *DataStore) GetSettingsRevision(ctx context.Context, revision int) (*model.SettingsRevision, error) {
+	ret := _m.Called(ctx, revision)
+
+	var r0 *model.SettingsRevision
+	if rf, ok := ret.Get(0).(func(context.Context, int) *model.SettingsRevision); ok {
+		r0 = rf(ctx, revision)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*model.SettingsRevision)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, int) error); ok {
+		r1 = rf(ctx, revision)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetTenantIDs provides a mock function with given fields: ctx
+func (_m *DataStore) GetTenantIDs(ctx context.Context) ([]string, error) {
+	ret := _m.Called(ctx)
+
+	var r0 []string
+	if rf, ok := ret.Get(0).(func(context.Context) []string); ok {
+		r0 = rf(ctx)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]string)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context) error); ok {
+		r1 = rf(ctx)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // Ping provides a mock function with given fields: ctx
 func (_m *DataStore) Ping(ctx context.Context) error {
 	ret := _m.Called(ctx)
@@ -77,6 +321,27 @@ func (_m *DataStore) Ping(ctx context.Context) error {
 	return r0
 }
 
+// RotateEncryptionKey provides a mock function with given fields: ctx
+func (_m *DataStore) RotateEncryptionKey(ctx context.Context) (int, error) {
+	ret := _m.Called(ctx)
+
+	var r0 int
+	if rf, ok := ret.Get(0).(func(context.Context) int); ok {
+		r0 = rf(ctx)
+	} else {
+		r0 = ret.Get(0).(int)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context) error); ok {
+		r1 = rf(ctx)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // SetSettings provides a mock function with given fields: ctx, settings
 func (_m *DataStore) SetSettings(ctx context.Context, settings model.Settings) error {
 	ret := _m.Called(ctx, settings)
@@ -90,3 +355,45 @@ func (_m *DataStore) SetSettings(ctx context.Context, settings model.Settings) e
 
 	return r0
 }
+
+// UpdateJob provides a mock function with given fields: ctx, jobID, update
+func (_m *DataStore) UpdateJob(ctx context.Context, jobID uuid.UUID, update model.JobUpdate) error {
+	ret := _m.Called(ctx, jobID, update)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, uuid.UUID, model.JobUpdate) error); ok {
+		r0 = rf(ctx, jobID, update)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// UpsertDevice provides a mock function with given fields: ctx, deviceID, update
+func (_m *DataStore) UpsertDevice(ctx context.Context, deviceID string, update model.DeviceUpdate) error {
+	ret := _m.Called(ctx, deviceID, update)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, model.DeviceUpdate) error); ok {
+		r0 = rf(ctx, deviceID, update)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// UpsertDevices provides a mock function with given fields: ctx, updates
+func (_m *DataStore) UpsertDevices(ctx context.Context, updates map[string]model.DeviceUpdate) error {
+	ret := _m.Called(ctx, updates)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, map[string]model.DeviceUpdate) error); ok {
+		r0 = rf(ctx, updates)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
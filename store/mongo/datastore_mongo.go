@@ -21,6 +21,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/pkg/errors"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
@@ -28,19 +29,45 @@ import (
 
 	"github.com/mendersoftware/go-lib-micro/config"
 	"github.com/mendersoftware/go-lib-micro/identity"
+	"github.com/mendersoftware/go-lib-micro/log"
 	mstore "github.com/mendersoftware/go-lib-micro/store/v2"
 
 	dconfig "github.com/mendersoftware/iot-manager/config"
+	"github.com/mendersoftware/iot-manager/crypto"
 	"github.com/mendersoftware/iot-manager/model"
 	"github.com/mendersoftware/iot-manager/store"
 )
 
 const (
-	CollNameSettings = "settings"
-	KeyTenantID      = "tenant_id"
+	CollNameSettings        = "settings"
+	CollNameSettingsHistory = "settings_history"
+	CollNameDevices         = "devices"
+	CollNameJobs            = "jobs"
+
+	KeyID        = "_id"
+	KeyTenantID  = "tenant_id"
+	KeyCreatedTS = "created_ts"
+	KeyUpdatedTS = "updated_ts"
+	KeyState     = "state"
+	KeyRevision  = "revision"
+
+	KeyType           = "type"
+	KeyStatus         = "status"
+	KeyAttempts       = "attempts"
+	KeyItemErrors     = "item_errors"
+	KeyLeaseOwner     = "lease_owner"
+	KeyLeaseExpiresTS = "lease_expires_ts"
 
 	ConnectTimeoutSeconds = 10
 	defaultAutomigrate    = false
+
+	// settingsRevisionOrphanAge is the age after which a settings revision
+	// newer than the stored settings is considered left over from an
+	// update that failed to store the settings.
+	settingsRevisionOrphanAge = time.Minute
+	// settingsCleanupTimeout bounds the removal of the revision of a
+	// failed settings update.
+	settingsCleanupTimeout = 10 * time.Second
 )
 
 var (
@@ -49,6 +76,9 @@ var (
 
 type Config struct {
 	Automigrate *bool
+	// KeyProvider protects the keys encrypting the secrets stored in the
+	// settings, if nil the secrets are stored in plain text.
+	KeyProvider crypto.KeyProvider
 }
 
 func NewConfig() *Config {
@@ -61,12 +91,20 @@ func (c *Config) SetAutomigrate(migrate bool) *Config {
 	return c
 }
 
+func (c *Config) SetKeyProvider(provider crypto.KeyProvider) *Config {
+	c.KeyProvider = provider
+	return c
+}
+
 func mergeConfig(configs []*Config) *Config {
 	config := NewConfig()
 	for _, c := range configs {
 		if c.Automigrate != nil {
 			config.SetAutomigrate(*c.Automigrate)
 		}
+		if c.KeyProvider != nil {
+			config.SetKeyProvider(c.KeyProvider)
+		}
 	}
 	return config
 }
@@ -83,7 +121,7 @@ func SetupDataStore(conf *Config) (store.DataStore, error) {
 	if err != nil {
 		return nil, err
 	}
-	dataStore := NewDataStoreWithClient(dbClient)
+	dataStore := NewDataStoreWithClient(dbClient, conf)
 	return dataStore, nil
 }
 
@@ -171,31 +209,139 @@ func (db *DataStoreMongo) Close() error {
 	return err
 }
 
+// SetSettings stores the settings as the next revision after
+// settings.Revision. The revision is inserted in the settings history
+// first; the unique index on the history only lets one of concurrent
+// updates based on the same revision succeed. A revision left over from an
+// update that failed to store the settings is removed so that it does not
+// block later updates.
 func (db *DataStoreMongo) SetSettings(ctx context.Context, settings model.Settings) error {
-	collSettings := db.client.Database(DbName).Collection(CollNameSettings)
-	o := mopts.Replace().SetUpsert(true)
+	database := db.client.Database(DbName)
+	collSettings := database.Collection(CollNameSettings)
+	collHistory := database.Collection(CollNameSettingsHistory)
+
+	tenantID := tenantIDFromContext(ctx)
+	baseRevision := settings.Revision
+	settings.Revision = baseRevision + 1
+	doc, err := db.encryptSettings(ctx, settings)
+	if err != nil {
+		return err
+	}
 
-	identity := identity.FromContext(ctx)
-	tenantID := ""
-	if identity != nil {
-		tenantID = identity.Tenant
+	var createdBy string
+	if id := identity.FromContext(ctx); id != nil {
+		createdBy = id.Subject
+	}
+	revision := settingsRevisionDocument{
+		TenantID:   tenantID,
+		Settings:   doc.Settings,
+		Encryption: doc.Encryption,
+		CreatedTS:  time.Now(),
+		CreatedBy:  createdBy,
+	}
+	res, err := collHistory.InsertOne(ctx, revision)
+	if mongo.IsDuplicateKeyError(err) {
+		var removed bool
+		removed, err = db.removeOrphanedSettingsRevision(ctx, baseRevision)
+		if err != nil {
+			return err
+		} else if !removed {
+			return store.ErrRevisionConflict
+		}
+		res, err = collHistory.InsertOne(ctx, revision)
+	}
+	if mongo.IsDuplicateKeyError(err) {
+		return store.ErrRevisionConflict
+	} else if err != nil {
+		return errors.Wrap(err, "failed to store settings revision")
 	}
 
-	_, err := collSettings.ReplaceOne(
+	fltr := bson.D{{Key: KeyTenantID, Value: tenantID}}
+	if baseRevision > 0 {
+		fltr = append(fltr, bson.E{Key: KeyRevision, Value: baseRevision})
+	} else {
+		// Settings stored before the revisions were introduced have no
+		// revision.
+		fltr = append(fltr, bson.E{Key: KeyRevision, Value: bson.D{{
+			Key: "$in", Value: bson.A{0, nil},
+		}}})
+	}
+	rsp, err := collSettings.ReplaceOne(
 		ctx,
-		bson.D{{Key: KeyTenantID, Value: tenantID}},
-		mstore.WithTenantID(ctx, settings),
-		o,
+		fltr,
+		mstore.WithTenantID(ctx, doc),
+		mopts.Replace().SetUpsert(baseRevision == 0),
 	)
-	if err != nil && err != mongo.ErrNoDocuments {
-		return errors.Wrapf(err, "failed to store settings %v", settings)
+	if err == nil && rsp.MatchedCount == 0 && rsp.UpsertedCount == 0 {
+		err = store.ErrRevisionConflict
 	}
+	if err != nil {
+		// Remove the revision so that it does not block later updates,
+		// also if the context of the request is done.
+		ctxDel, cancel := context.WithTimeout(
+			context.Background(), settingsCleanupTimeout,
+		)
+		_, errDel := collHistory.DeleteOne(ctxDel,
+			bson.D{{Key: KeyID, Value: res.InsertedID}},
+		)
+		cancel()
+		if errDel != nil {
+			log.FromContext(ctx).
+				Errorf("failed to remove orphaned settings revision: %s", errDel)
+		}
+		if err == store.ErrRevisionConflict {
+			return err
+		}
+		return errors.Wrap(err, "failed to store settings")
+	}
+	return nil
+}
 
-	return err
+// removeOrphanedSettingsRevision removes the revision following
+// baseRevision from the settings history if the stored settings are still
+// at baseRevision and the revision is older than settingsRevisionOrphanAge,
+// that is if the update inserting it failed to store the settings. It
+// returns true if the revision was removed.
+func (db *DataStoreMongo) removeOrphanedSettingsRevision(
+	ctx context.Context,
+	baseRevision int,
+) (bool, error) {
+	database := db.client.Database(DbName)
+	collSettings := database.Collection(CollNameSettings)
+	collHistory := database.Collection(CollNameSettingsHistory)
+	tenantID := tenantIDFromContext(ctx)
+
+	var current struct {
+		Revision int `bson:"revision"`
+	}
+	err := collSettings.FindOne(ctx,
+		bson.D{{Key: KeyTenantID, Value: tenantID}},
+		mopts.FindOne().SetProjection(bson.D{{Key: KeyRevision, Value: 1}}),
+	).Decode(&current)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return false, errors.Wrap(err, ErrFailedToGetSettings.Error())
+	} else if current.Revision != baseRevision {
+		return false, nil
+	}
+	rsp, err := collHistory.DeleteOne(ctx, bson.D{
+		{Key: KeyTenantID, Value: tenantID},
+		{Key: KeyRevision, Value: baseRevision + 1},
+		{Key: KeyCreatedTS, Value: bson.D{{
+			Key: "$lt", Value: time.Now().Add(-settingsRevisionOrphanAge),
+		}}},
+	})
+	if err != nil {
+		return false, errors.Wrap(err, "failed to remove orphaned settings revision")
+	}
+	if rsp.DeletedCount > 0 {
+		log.FromContext(ctx).
+			Warnf("removed orphaned settings revision %d", baseRevision+1)
+	}
+	return rsp.DeletedCount > 0, nil
 }
 
 func (db *DataStoreMongo) GetSettings(ctx context.Context) (model.Settings, error) {
-	var settings model.Settings
+	var doc settingsDocument
 
 	collSettings := db.client.Database(DbName).Collection(CollNameSettings)
 	tenantId := ""
@@ -206,7 +352,7 @@ func (db *DataStoreMongo) GetSettings(ctx context.Context) (model.Settings, erro
 
 	if err := collSettings.FindOne(ctx,
 		bson.M{KeyTenantID: tenantId},
-	).Decode(&settings); err != nil {
+	).Decode(&doc); err != nil {
 		switch err {
 		case mongo.ErrNoDocuments:
 			return model.Settings{}, nil
@@ -214,5 +360,213 @@ func (db *DataStoreMongo) GetSettings(ctx context.Context) (model.Settings, erro
 			return model.Settings{}, errors.Wrap(err, ErrFailedToGetSettings.Error())
 		}
 	}
-	return settings, nil
+	return db.decryptSettings(ctx, doc)
+}
+
+func (db *DataStoreMongo) GetTenantIDs(ctx context.Context) ([]string, error) {
+	collSettings := db.client.Database(DbName).Collection(CollNameSettings)
+
+	res, err := collSettings.Distinct(ctx, KeyTenantID, bson.D{})
+	if err != nil {
+		return nil, errors.Wrap(err, "mongo: failed to list tenants")
+	}
+	tenantIDs := make([]string, 0, len(res))
+	for _, r := range res {
+		if tenantID, ok := r.(string); ok {
+			tenantIDs = append(tenantIDs, tenantID)
+		}
+	}
+	return tenantIDs, nil
+}
+
+func tenantIDFromContext(ctx context.Context) string {
+	if id := identity.FromContext(ctx); id != nil {
+		return id.Tenant
+	}
+	return ""
+}
+
+func (db *DataStoreMongo) GetDevice(
+	ctx context.Context,
+	deviceID string,
+) (*model.Device, error) {
+	collDevices := db.client.Database(DbName).Collection(CollNameDevices)
+
+	device := new(model.Device)
+	err := collDevices.FindOne(ctx, bson.D{
+		{Key: KeyID, Value: deviceID},
+		{Key: KeyTenantID, Value: tenantIDFromContext(ctx)},
+	}).Decode(device)
+	switch err {
+	case nil:
+		return device, nil
+	case mongo.ErrNoDocuments:
+		return nil, store.ErrObjectNotFound
+	default:
+		return nil, errors.Wrap(err, "mongo: failed to get device")
+	}
+}
+
+func (db *DataStoreMongo) GetDevices(
+	ctx context.Context,
+	fltr model.DeviceFilter,
+) ([]model.Device, error) {
+	collDevices := db.client.Database(DbName).Collection(CollNameDevices)
+
+	query := bson.D{{Key: KeyTenantID, Value: tenantIDFromContext(ctx)}}
+	if len(fltr.IDs) > 0 {
+		query = append(query, bson.E{
+			Key: KeyID, Value: bson.D{{Key: "$in", Value: fltr.IDs}},
+		})
+	}
+	if len(fltr.States) > 0 {
+		query = append(query, bson.E{
+			Key: KeyState, Value: bson.D{{Key: "$in", Value: fltr.States}},
+		})
+	}
+	cur, err := collDevices.Find(ctx, query,
+		mopts.Find().SetSort(bson.D{{Key: KeyID, Value: 1}}),
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "mongo: failed to get devices")
+	}
+	devices := []model.Device{}
+	if err = cur.All(ctx, &devices); err != nil {
+		return nil, errors.Wrap(err, "mongo: failed to decode devices")
+	}
+	return devices, nil
+}
+
+func (db *DataStoreMongo) UpsertDevice(
+	ctx context.Context,
+	deviceID string,
+	update model.DeviceUpdate,
+) error {
+	collDevices := db.client.Database(DbName).Collection(CollNameDevices)
+
+	filter, doc, err := deviceUpsert(ctx, deviceID, update, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	_, err = collDevices.UpdateOne(ctx, filter, doc,
+		mopts.Update().SetUpsert(true),
+	)
+	if err != nil {
+		return errors.Wrap(err, "mongo: failed to update device")
+	}
+	return nil
+}
+
+// UpsertDevices applies the updates to the devices with a single unordered
+// bulk write.
+func (db *DataStoreMongo) UpsertDevices(
+	ctx context.Context,
+	updates map[string]model.DeviceUpdate,
+) error {
+	if len(updates) == 0 {
+		return nil
+	}
+	collDevices := db.client.Database(DbName).Collection(CollNameDevices)
+
+	now := time.Now().UTC()
+	models := make([]mongo.WriteModel, 0, len(updates))
+	for deviceID, update := range updates {
+		filter, doc, err := deviceUpsert(ctx, deviceID, update, now)
+		if err != nil {
+			return err
+		}
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(filter).
+			SetUpdate(doc).
+			SetUpsert(true),
+		)
+	}
+	_, err := collDevices.BulkWrite(ctx, models,
+		mopts.BulkWrite().SetOrdered(false),
+	)
+	if err != nil {
+		return errors.Wrap(err, "mongo: failed to update devices")
+	}
+	return nil
+}
+
+// deviceUpsert returns the filter and the update document upserting the
+// device.
+func deviceUpsert(
+	ctx context.Context,
+	deviceID string,
+	update model.DeviceUpdate,
+	now time.Time,
+) (filter bson.D, doc bson.D, err error) {
+	set, err := bson.Marshal(update)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, store.ErrSerialization.Error())
+	}
+	var setDoc bson.D
+	if err = bson.Unmarshal(set, &setDoc); err != nil {
+		return nil, nil, errors.Wrap(err, store.ErrSerialization.Error())
+	}
+	setDoc = append(setDoc, bson.E{Key: KeyUpdatedTS, Value: now})
+
+	filter = bson.D{
+		{Key: KeyID, Value: deviceID},
+		{Key: KeyTenantID, Value: tenantIDFromContext(ctx)},
+	}
+	doc = bson.D{
+		{Key: "$set", Value: setDoc},
+		{Key: "$setOnInsert", Value: bson.D{
+			{Key: KeyCreatedTS, Value: now},
+		}},
+	}
+	return filter, doc, nil
+}
+
+func (db *DataStoreMongo) DeleteDevice(ctx context.Context, deviceID string) error {
+	collDevices := db.client.Database(DbName).Collection(CollNameDevices)
+
+	_, err := collDevices.DeleteOne(ctx, bson.D{
+		{Key: KeyID, Value: deviceID},
+		{Key: KeyTenantID, Value: tenantIDFromContext(ctx)},
+	})
+	if err != nil {
+		return errors.Wrap(err, "mongo: failed to delete device")
+	}
+	return nil
+}
+
+func (db *DataStoreMongo) DeleteDevices(ctx context.Context, deviceIDs []string) error {
+	collDevices := db.client.Database(DbName).Collection(CollNameDevices)
+
+	_, err := collDevices.DeleteMany(ctx, bson.D{
+		{Key: KeyID, Value: bson.D{{Key: "$in", Value: deviceIDs}}},
+		{Key: KeyTenantID, Value: tenantIDFromContext(ctx)},
+	})
+	if err != nil {
+		return errors.Wrap(err, "mongo: failed to delete devices")
+	}
+	return nil
+}
+
+func (db *DataStoreMongo) DeleteTenant(ctx context.Context, keepJobID uuid.UUID) error {
+	database := db.client.Database(DbName)
+	fltr := bson.D{{Key: KeyTenantID, Value: tenantIDFromContext(ctx)}}
+	for _, collName := range []string{
+		CollNameDevices,
+		CollNameSettingsHistory,
+		CollNameSettings,
+	} {
+		_, err := database.Collection(collName).DeleteMany(ctx, fltr)
+		if err != nil {
+			return errors.Wrapf(err, "mongo: failed to delete tenant %s", collName)
+		}
+	}
+	// The job running the deletion is kept to report its result.
+	fltrJobs := append(fltr, bson.E{
+		Key: KeyID, Value: bson.D{{Key: "$ne", Value: keepJobID}},
+	})
+	_, err := database.Collection(CollNameJobs).DeleteMany(ctx, fltrJobs)
+	if err != nil {
+		return errors.Wrapf(err, "mongo: failed to delete tenant %s", CollNameJobs)
+	}
+	return nil
 }
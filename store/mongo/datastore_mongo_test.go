@@ -17,14 +17,17 @@ package mongo
 import (
 	"context"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"go.mongodb.org/mongo-driver/bson"
 
 	"github.com/mendersoftware/go-lib-micro/identity"
 	mstore "github.com/mendersoftware/go-lib-micro/store/v2"
 
 	"github.com/mendersoftware/iot-manager/model"
+	"github.com/mendersoftware/iot-manager/store"
 )
 
 func TestSetSettings(t *testing.T) {
@@ -42,24 +45,24 @@ func TestSetSettings(t *testing.T) {
 			CTX: identity.WithContext(context.Background(), &identity.Identity{
 				Tenant: "1234567890",
 			}),
-			Settings: model.Settings{
+			Settings: model.Settings{Integrations: []model.Integration{{
 				ConnectionString: &model.ConnectionString{
 					HostName: "localhost",
 					Key:      []byte("password123"),
 					Name:     "acmeHub",
 				},
-			},
+			}}},
 		}, {
 			Name: "ok, no tenant context",
 
 			CTX: context.Background(),
-			Settings: model.Settings{
+			Settings: model.Settings{Integrations: []model.Integration{{
 				ConnectionString: &model.ConnectionString{
 					HostName: "localhost",
 					Key:      []byte("password123"),
 					Name:     "acmeHub",
 				},
-			},
+			}}},
 		}, {
 			Name: "error, context canceled",
 
@@ -68,13 +71,13 @@ func TestSetSettings(t *testing.T) {
 				cc()
 				return ctx
 			}(),
-			Settings: model.Settings{
+			Settings: model.Settings{Integrations: []model.Integration{{
 				ConnectionString: &model.ConnectionString{
 					HostName: "localhost",
 					Key:      []byte("password123"),
 					Name:     "acmeHub",
 				},
-			},
+			}}},
 			Error: context.Canceled,
 		},
 	}
@@ -116,7 +119,9 @@ func TestSetSettings(t *testing.T) {
 
 				var settings model.Settings
 				bson.Unmarshal(doc, &settings)
-				assert.Equal(t, tc.Settings, settings)
+				expected := tc.Settings
+				expected.Revision = 1
+				assert.Equal(t, expected, settings)
 			}
 		})
 	}
@@ -137,13 +142,13 @@ func TestGetSettings(t *testing.T) {
 			CTX: identity.WithContext(context.Background(), &identity.Identity{
 				Tenant: tenantID,
 			}),
-			Settings: model.Settings{
+			Settings: model.Settings{Integrations: []model.Integration{{
 				ConnectionString: &model.ConnectionString{
 					HostName: "localhost",
 					Key:      []byte("password123"),
 					Name:     "acmeHub",
 				},
-			},
+			}}},
 		},
 		{
 			Name: "no settings for tenant",
@@ -196,3 +201,584 @@ func TestGetSettings(t *testing.T) {
 		})
 	}
 }
+
+func TestUpsertDevice(t *testing.T) {
+	const (
+		tenantID = "123456789012345678901234"
+		deviceID = "3ee7b8d0-8bfb-4fd5-8d7b-1b5ab6f7a8b5"
+	)
+	hubDeviceID := deviceID
+	hostName := "acme.azure-devices.net"
+	state := model.DeviceStateProvisioned
+	status := "enabled"
+	lastError := ""
+	testCases := []struct {
+		Name string
+
+		CTX     context.Context
+		Updates []model.DeviceUpdate
+
+		Device *model.Device
+		Error  error
+	}{{
+		Name: "ok",
+
+		CTX: identity.WithContext(context.Background(), &identity.Identity{
+			Tenant: tenantID,
+		}),
+		Updates: []model.DeviceUpdate{{
+			HubDeviceID: &hubDeviceID,
+			HubHostName: &hostName,
+			State:       &state,
+			LastError:   &lastError,
+		}, {
+			Status: &status,
+		}},
+
+		Device: &model.Device{
+			ID:          deviceID,
+			TenantID:    tenantID,
+			HubDeviceID: hubDeviceID,
+			HubHostName: hostName,
+			State:       state,
+			Status:      status,
+		},
+	}, {
+		Name: "error, context canceled",
+
+		CTX: func() context.Context {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			return ctx
+		}(),
+		Updates: []model.DeviceUpdate{{
+			State: &state,
+		}},
+		Error: context.Canceled,
+	}}
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Name, func(t *testing.T) {
+			db.Wipe()
+			ds := NewDataStoreWithClient(db.Client())
+			var err error
+			for _, update := range tc.Updates {
+				err = ds.UpsertDevice(tc.CTX, deviceID, update)
+				if err != nil {
+					break
+				}
+			}
+			if tc.Error != nil {
+				if assert.Error(t, err) {
+					assert.Regexp(t, tc.Error.Error(), err.Error())
+				}
+				return
+			}
+			if !assert.NoError(t, err) {
+				t.FailNow()
+			}
+			dev, err := ds.GetDevice(tc.CTX, deviceID)
+			if !assert.NoError(t, err) {
+				t.FailNow()
+			}
+			assert.False(t, dev.CreatedTS.IsZero())
+			assert.False(t, dev.UpdatedTS.Before(dev.CreatedTS))
+			dev.CreatedTS, dev.UpdatedTS = time.Time{}, time.Time{}
+			assert.Equal(t, tc.Device, dev)
+		})
+	}
+}
+
+func TestUpsertDevices(t *testing.T) {
+	const tenantID = "123456789012345678901234"
+	deviceIDs := []string{
+		"3ee7b8d0-8bfb-4fd5-8d7b-1b5ab6f7a8b5",
+		"a6c3a3a4-1d8f-4c34-8a42-f1d8b8c5a1b2",
+	}
+	hostName := "acme.azure-devices.net"
+	state := model.DeviceStateProvisioned
+	failed := model.DeviceStateProvisionFailed
+	lastError := "failed to create iothub device"
+	testCases := []struct {
+		Name string
+
+		CTX     context.Context
+		Updates map[string]model.DeviceUpdate
+
+		Devices []model.Device
+		Error   error
+	}{{
+		Name: "ok",
+
+		CTX: identity.WithContext(context.Background(), &identity.Identity{
+			Tenant: tenantID,
+		}),
+		Updates: map[string]model.DeviceUpdate{
+			deviceIDs[0]: {
+				HubDeviceID: &deviceIDs[0],
+				HubHostName: &hostName,
+				State:       &state,
+			},
+			deviceIDs[1]: {
+				HubDeviceID: &deviceIDs[1],
+				State:       &failed,
+				LastError:   &lastError,
+			},
+		},
+
+		Devices: []model.Device{{
+			ID:          deviceIDs[0],
+			TenantID:    tenantID,
+			HubDeviceID: deviceIDs[0],
+			HubHostName: hostName,
+			State:       state,
+		}, {
+			ID:          deviceIDs[1],
+			TenantID:    tenantID,
+			HubDeviceID: deviceIDs[1],
+			State:       failed,
+			LastError:   lastError,
+		}},
+	}, {
+		Name: "ok, no updates",
+
+		CTX: identity.WithContext(context.Background(), &identity.Identity{
+			Tenant: tenantID,
+		}),
+		Devices: []model.Device{},
+	}, {
+		Name: "error, context canceled",
+
+		CTX: func() context.Context {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			return ctx
+		}(),
+		Updates: map[string]model.DeviceUpdate{
+			deviceIDs[0]: {State: &state},
+		},
+		Error: context.Canceled,
+	}}
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Name, func(t *testing.T) {
+			db.Wipe()
+			ds := NewDataStoreWithClient(db.Client())
+			err := ds.UpsertDevices(tc.CTX, tc.Updates)
+			if tc.Error != nil {
+				if assert.Error(t, err) {
+					assert.Regexp(t, tc.Error.Error(), err.Error())
+				}
+				return
+			}
+			if !assert.NoError(t, err) {
+				t.FailNow()
+			}
+			devs, err := ds.GetDevices(tc.CTX, model.DeviceFilter{IDs: deviceIDs})
+			if !assert.NoError(t, err) {
+				t.FailNow()
+			}
+			for i := range devs {
+				assert.False(t, devs[i].CreatedTS.IsZero())
+				devs[i].CreatedTS, devs[i].UpdatedTS = time.Time{}, time.Time{}
+			}
+			assert.ElementsMatch(t, tc.Devices, devs)
+		})
+	}
+}
+
+func TestGetDevice(t *testing.T) {
+	const tenantID = "123456789012345678901234"
+	device := model.Device{
+		ID:          "3ee7b8d0-8bfb-4fd5-8d7b-1b5ab6f7a8b5",
+		TenantID:    tenantID,
+		HubDeviceID: "3ee7b8d0-8bfb-4fd5-8d7b-1b5ab6f7a8b5",
+		HubHostName: "acme.azure-devices.net",
+		State:       model.DeviceStateProvisioned,
+		CreatedTS:   time.Unix(1634200000, 0).UTC(),
+		UpdatedTS:   time.Unix(1634200000, 0).UTC(),
+	}
+	testCases := []struct {
+		Name string
+
+		CTX      context.Context
+		DeviceID string
+
+		Device *model.Device
+		Error  error
+	}{{
+		Name: "ok",
+
+		CTX: identity.WithContext(context.Background(), &identity.Identity{
+			Tenant: tenantID,
+		}),
+		DeviceID: device.ID,
+		Device:   &device,
+	}, {
+		Name: "error, wrong tenant",
+
+		CTX: identity.WithContext(context.Background(), &identity.Identity{
+			Tenant: "111111111111111111111111",
+		}),
+		DeviceID: device.ID,
+		Error:    store.ErrObjectNotFound,
+	}, {
+		Name: "error, context canceled",
+
+		CTX: func() context.Context {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			return ctx
+		}(),
+		DeviceID: device.ID,
+		Error:    context.Canceled,
+	}}
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Name, func(t *testing.T) {
+			db.Wipe()
+			client := db.Client()
+			_, err := client.Database(DbName).
+				Collection(CollNameDevices).
+				InsertOne(context.Background(), device)
+			if !assert.NoError(t, err) {
+				t.FailNow()
+			}
+
+			ds := NewDataStoreWithClient(client)
+			dev, err := ds.GetDevice(tc.CTX, tc.DeviceID)
+			if tc.Error != nil {
+				if assert.Error(t, err) {
+					assert.Regexp(t, tc.Error.Error(), err.Error())
+				}
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tc.Device, dev)
+			}
+		})
+	}
+}
+
+func TestDeleteDevice(t *testing.T) {
+	const tenantID = "123456789012345678901234"
+	device := model.Device{
+		ID:       "3ee7b8d0-8bfb-4fd5-8d7b-1b5ab6f7a8b5",
+		TenantID: tenantID,
+		State:    model.DeviceStateProvisioned,
+	}
+	testCases := []struct {
+		Name string
+
+		CTX context.Context
+
+		Deleted bool
+		Error   error
+	}{{
+		Name: "ok",
+
+		CTX: identity.WithContext(context.Background(), &identity.Identity{
+			Tenant: tenantID,
+		}),
+		Deleted: true,
+	}, {
+		Name: "ok, noop for other tenant",
+
+		CTX: identity.WithContext(context.Background(), &identity.Identity{
+			Tenant: "111111111111111111111111",
+		}),
+	}, {
+		Name: "error, context canceled",
+
+		CTX: func() context.Context {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			return ctx
+		}(),
+		Error: context.Canceled,
+	}}
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Name, func(t *testing.T) {
+			db.Wipe()
+			client := db.Client()
+			collDevices := client.Database(DbName).Collection(CollNameDevices)
+			_, err := collDevices.InsertOne(context.Background(), device)
+			if !assert.NoError(t, err) {
+				t.FailNow()
+			}
+
+			ds := NewDataStoreWithClient(client)
+			err = ds.DeleteDevice(tc.CTX, device.ID)
+			if tc.Error != nil {
+				if assert.Error(t, err) {
+					assert.Regexp(t, tc.Error.Error(), err.Error())
+				}
+				return
+			}
+			assert.NoError(t, err)
+			n, err := collDevices.CountDocuments(context.Background(), bson.D{})
+			assert.NoError(t, err)
+			if tc.Deleted {
+				assert.Equal(t, int64(0), n)
+			} else {
+				assert.Equal(t, int64(1), n)
+			}
+		})
+	}
+}
+
+func TestDeleteDevices(t *testing.T) {
+	const tenantID = "123456789012345678901234"
+	devices := []interface{}{
+		model.Device{
+			ID:       "3ee7b8d0-8bfb-4fd5-8d7b-1b5ab6f7a8b5",
+			TenantID: tenantID,
+			State:    model.DeviceStateProvisioned,
+		},
+		model.Device{
+			ID:       "a6c3a3a4-1d8f-4c34-8a42-f1d8b8c5a1b2",
+			TenantID: tenantID,
+			State:    model.DeviceStateProvisioned,
+		},
+		model.Device{
+			ID:       "c1d5e2a3-6b7f-4e8d-9a0b-1c2d3e4f5a6b",
+			TenantID: tenantID,
+			State:    model.DeviceStateProvisioned,
+		},
+	}
+	testCases := []struct {
+		Name string
+
+		CTX       context.Context
+		DeviceIDs []string
+
+		Remaining int64
+		Error     error
+	}{{
+		Name: "ok",
+
+		CTX: identity.WithContext(context.Background(), &identity.Identity{
+			Tenant: tenantID,
+		}),
+		DeviceIDs: []string{
+			"3ee7b8d0-8bfb-4fd5-8d7b-1b5ab6f7a8b5",
+			"a6c3a3a4-1d8f-4c34-8a42-f1d8b8c5a1b2",
+			"00000000-0000-0000-0000-000000000000",
+		},
+		Remaining: 1,
+	}, {
+		Name: "ok, noop for other tenant",
+
+		CTX: identity.WithContext(context.Background(), &identity.Identity{
+			Tenant: "111111111111111111111111",
+		}),
+		DeviceIDs: []string{
+			"3ee7b8d0-8bfb-4fd5-8d7b-1b5ab6f7a8b5",
+		},
+		Remaining: 3,
+	}, {
+		Name: "error, context canceled",
+
+		CTX: func() context.Context {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			return ctx
+		}(),
+		DeviceIDs: []string{
+			"3ee7b8d0-8bfb-4fd5-8d7b-1b5ab6f7a8b5",
+		},
+		Error: context.Canceled,
+	}}
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Name, func(t *testing.T) {
+			db.Wipe()
+			client := db.Client()
+			collDevices := client.Database(DbName).Collection(CollNameDevices)
+			_, err := collDevices.InsertMany(context.Background(), devices)
+			if !assert.NoError(t, err) {
+				t.FailNow()
+			}
+
+			ds := NewDataStoreWithClient(client)
+			err = ds.DeleteDevices(tc.CTX, tc.DeviceIDs)
+			if tc.Error != nil {
+				if assert.Error(t, err) {
+					assert.Regexp(t, tc.Error.Error(), err.Error())
+				}
+				return
+			}
+			assert.NoError(t, err)
+			n, err := collDevices.CountDocuments(context.Background(), bson.D{})
+			assert.NoError(t, err)
+			assert.Equal(t, tc.Remaining, n)
+		})
+	}
+}
+
+func TestGetTenantIDs(t *testing.T) {
+	db.Wipe()
+	client := db.Client()
+	collSettings := client.Database(DbName).Collection(CollNameSettings)
+	for _, tenantID := range []string{"tenant1", "tenant2", "tenant2"} {
+		ctx := identity.WithContext(context.Background(), &identity.Identity{
+			Tenant: tenantID,
+		})
+		_, err := collSettings.InsertOne(ctx, mstore.WithTenantID(ctx, model.Settings{}))
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+	}
+	ds := NewDataStoreWithClient(client)
+	tenantIDs, err := ds.GetTenantIDs(context.Background())
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"tenant1", "tenant2"}, tenantIDs)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = ds.GetTenantIDs(ctx)
+	assert.Error(t, err)
+}
+
+func TestGetDevices(t *testing.T) {
+	const tenantID = "123456789012345678901234"
+	devices := []interface{}{
+		model.Device{
+			ID:       "device-1",
+			TenantID: tenantID,
+			State:    model.DeviceStateProvisioned,
+		},
+		model.Device{
+			ID:       "device-2",
+			TenantID: tenantID,
+			State:    model.DeviceStateProvisionFailed,
+		},
+		model.Device{
+			ID:       "device-3",
+			TenantID: "111111111111111111111111",
+			State:    model.DeviceStateProvisioned,
+		},
+	}
+	testCases := []struct {
+		Name string
+
+		CTX    context.Context
+		Filter model.DeviceFilter
+
+		DeviceIDs []string
+		Error     error
+	}{{
+		Name: "ok, all tenant devices",
+
+		CTX: identity.WithContext(context.Background(), &identity.Identity{
+			Tenant: tenantID,
+		}),
+		DeviceIDs: []string{"device-1", "device-2"},
+	}, {
+		Name: "ok, filter by state",
+
+		CTX: identity.WithContext(context.Background(), &identity.Identity{
+			Tenant: tenantID,
+		}),
+		Filter: model.DeviceFilter{
+			States: []model.DeviceState{model.DeviceStateProvisionFailed},
+		},
+		DeviceIDs: []string{"device-2"},
+	}, {
+		Name: "ok, filter by ID",
+
+		CTX: identity.WithContext(context.Background(), &identity.Identity{
+			Tenant: tenantID,
+		}),
+		Filter: model.DeviceFilter{
+			IDs: []string{"device-1", "device-3"},
+		},
+		DeviceIDs: []string{"device-1"},
+	}, {
+		Name: "error, context canceled",
+
+		CTX: func() context.Context {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			return ctx
+		}(),
+		Error: context.Canceled,
+	}}
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Name, func(t *testing.T) {
+			db.Wipe()
+			client := db.Client()
+			_, err := client.Database(DbName).
+				Collection(CollNameDevices).
+				InsertMany(context.Background(), devices)
+			if !assert.NoError(t, err) {
+				t.FailNow()
+			}
+
+			ds := NewDataStoreWithClient(client)
+			result, err := ds.GetDevices(tc.CTX, tc.Filter)
+			if tc.Error != nil {
+				if assert.Error(t, err) {
+					assert.Regexp(t, tc.Error.Error(), err.Error())
+				}
+				return
+			}
+			assert.NoError(t, err)
+			deviceIDs := make([]string, len(result))
+			for i, dev := range result {
+				deviceIDs[i] = dev.ID
+			}
+			assert.Equal(t, tc.DeviceIDs, deviceIDs)
+		})
+	}
+}
+
+func TestDeleteTenant(t *testing.T) {
+	db.Wipe()
+	ds := NewDataStoreWithClient(db.Client())
+	ctx := identity.WithContext(context.Background(), &identity.Identity{
+		Tenant: "123456789012345678901234",
+	})
+	otherCtx := identity.WithContext(context.Background(), &identity.Identity{
+		Tenant: "other",
+	})
+	for _, c := range []context.Context{ctx, otherCtx} {
+		err := ds.SetSettings(c, model.Settings{
+			Integrations: []model.Integration{{Name: "hub"}},
+		})
+		require.NoError(t, err)
+		err = ds.UpsertDevice(c, "device-1", model.DeviceUpdate{})
+		require.NoError(t, err)
+	}
+	job := model.NewJob("123456789012345678901234", model.JobTypeDeleteTenant, nil)
+	require.NoError(t, ds.CreateJob(ctx, job))
+	otherJob := model.NewJob("123456789012345678901234", model.JobTypeRotateKeys, nil)
+	require.NoError(t, ds.CreateJob(ctx, otherJob))
+	otherTenantJob := model.NewJob("other", model.JobTypeRotateKeys, nil)
+	require.NoError(t, ds.CreateJob(otherCtx, otherTenantJob))
+
+	err := ds.DeleteTenant(ctx, job.ID)
+	require.NoError(t, err)
+
+	settings, err := ds.GetSettings(ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, settings.Integrations)
+	history, err := ds.GetSettingsHistory(ctx, 0, 10)
+	assert.NoError(t, err)
+	assert.Empty(t, history)
+	_, err = ds.GetDevice(ctx, "device-1")
+	assert.EqualError(t, err, store.ErrObjectNotFound.Error())
+	_, err = ds.GetJob(ctx, job.ID)
+	assert.NoError(t, err, "the job running the deletion must be kept")
+	_, err = ds.GetJob(ctx, otherJob.ID)
+	assert.EqualError(t, err, store.ErrObjectNotFound.Error())
+
+	settings, err = ds.GetSettings(otherCtx)
+	assert.NoError(t, err)
+	assert.Len(t, settings.Integrations, 1)
+	_, err = ds.GetDevice(otherCtx, "device-1")
+	assert.NoError(t, err)
+	_, err = ds.GetJob(otherCtx, otherTenantJob.ID)
+	assert.NoError(t, err)
+}
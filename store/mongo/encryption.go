@@ -0,0 +1,273 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package mongo
+
+import (
+	"context"
+	"encoding/base64"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/mendersoftware/iot-manager/crypto"
+	"github.com/mendersoftware/iot-manager/model"
+)
+
+const (
+	KeyEncryption = "encryption"
+)
+
+var (
+	ErrNoKeyProvider = errors.New(
+		"mongo: settings are encrypted but no encryption key is configured",
+	)
+)
+
+// encryptionHeader holds the wrapped data key encrypting the secrets of a
+// settings document.
+type encryptionHeader struct {
+	KeyID      string `bson:"key_id"`
+	WrappedKey []byte `bson:"wrapped_key"`
+}
+
+// settingsDocument is the settings as stored in the settings collection.
+// If Encryption is set, the secrets of the settings are encrypted with the
+// data key; binary secrets hold the ciphertext, string secrets hold the
+// base64 encoded ciphertext.
+type settingsDocument struct {
+	model.Settings `bson:",inline"`
+	Encryption     *encryptionHeader `bson:"encryption,omitempty"`
+}
+
+func (doc settingsDocument) MarshalBSON() ([]byte, error) {
+	// Marshal without the method to avoid recursing (mstore.WithTenantID
+	// only supports inline structs through bson.Marshaler).
+	type document settingsDocument
+	return bson.Marshal(document(doc))
+}
+
+// mapSecrets returns a copy of the settings with every non-empty secret
+// replaced by fn. String secrets are passed to strFn.
+func mapSecrets(
+	settings model.Settings,
+	fn func([]byte) ([]byte, error),
+	strFn func(string) (string, error),
+) (model.Settings, error) {
+	var err error
+	if settings.Integrations == nil {
+		return settings, nil
+	}
+	integrations := make([]model.Integration, len(settings.Integrations))
+	copy(integrations, settings.Integrations)
+	mapKey := func(cs *model.ConnectionString) (*model.ConnectionString, error) {
+		if cs == nil || len(cs.Key) == 0 {
+			return cs, nil
+		}
+		res := *cs
+		res.Key, err = fn(cs.Key)
+		return &res, err
+	}
+	for i := range integrations {
+		integration := &integrations[i]
+		integration.ConnectionString, err = mapKey(integration.ConnectionString)
+		if err != nil {
+			return settings, err
+		}
+		if integration.DPS != nil {
+			dps := *integration.DPS
+			dps.ConnectionString, err = mapKey(dps.ConnectionString)
+			if err != nil {
+				return settings, err
+			}
+			integration.DPS = &dps
+		}
+		if integration.AWS != nil && integration.AWS.SecretAccessKey != "" {
+			aws := *integration.AWS
+			aws.SecretAccessKey, err = strFn(aws.SecretAccessKey)
+			if err != nil {
+				return settings, err
+			}
+			integration.AWS = &aws
+		}
+		if ca := integration.CertificateAuthority; ca != nil && ca.PrivateKey != "" {
+			res := *ca
+			res.PrivateKey, err = strFn(ca.PrivateKey)
+			if err != nil {
+				return settings, err
+			}
+			integration.CertificateAuthority = &res
+		}
+	}
+	settings.Integrations = integrations
+	return settings, nil
+}
+
+// encryptSettings encrypts the secrets of the settings with a new data
+// key. The settings are left in plain text if no key provider is
+// configured.
+func (db *DataStoreMongo) encryptSettings(
+	ctx context.Context,
+	settings model.Settings,
+) (settingsDocument, error) {
+	if db.KeyProvider == nil {
+		return settingsDocument{Settings: settings}, nil
+	}
+	key, err := crypto.NewDataKey(ctx, db.KeyProvider)
+	if err != nil {
+		return settingsDocument{}, errors.Wrap(err, "mongo: failed to encrypt settings")
+	}
+	settings, err = mapSecrets(settings, key.Encrypt,
+		func(secret string) (string, error) {
+			b, err := key.Encrypt([]byte(secret))
+			return base64.StdEncoding.EncodeToString(b), err
+		},
+	)
+	if err != nil {
+		return settingsDocument{}, errors.Wrap(err, "mongo: failed to encrypt settings")
+	}
+	return settingsDocument{
+		Settings: settings,
+		Encryption: &encryptionHeader{
+			KeyID:      key.KeyID,
+			WrappedKey: key.Wrapped,
+		},
+	}, nil
+}
+
+// decryptSettings returns the settings of the document with the secrets
+// in plain text.
+func (db *DataStoreMongo) decryptSettings(
+	ctx context.Context,
+	doc settingsDocument,
+) (model.Settings, error) {
+	if doc.Encryption == nil {
+		return doc.Settings, nil
+	} else if db.KeyProvider == nil {
+		return model.Settings{}, ErrNoKeyProvider
+	}
+	key, err := crypto.OpenDataKey(ctx,
+		db.KeyProvider,
+		doc.Encryption.KeyID,
+		doc.Encryption.WrappedKey,
+	)
+	if err != nil {
+		return model.Settings{}, errors.Wrap(err, "mongo: failed to decrypt settings")
+	}
+	settings, err := mapSecrets(doc.Settings, key.Decrypt,
+		func(secret string) (string, error) {
+			b, err := base64.StdEncoding.DecodeString(secret)
+			if err != nil {
+				return "", crypto.ErrInvalidCiphertext
+			}
+			b, err = key.Decrypt(b)
+			return string(b), err
+		},
+	)
+	if err != nil {
+		return model.Settings{}, errors.Wrap(err, "mongo: failed to decrypt settings")
+	}
+	return settings, nil
+}
+
+// RotateEncryptionKey re-encrypts the secrets of all tenants, including
+// the settings history, with new data keys wrapped with the current key
+// encryption key. Settings stored in plain text are encrypted. It returns
+// the number of documents updated.
+func (db *DataStoreMongo) RotateEncryptionKey(ctx context.Context) (int, error) {
+	if db.KeyProvider == nil {
+		return 0, errors.New("mongo: no encryption key is configured")
+	}
+	var count int
+	for _, collName := range []string{CollNameSettings, CollNameSettingsHistory} {
+		n, err := db.rotateEncryptionKey(ctx,
+			db.client.Database(DbName).Collection(collName),
+		)
+		count += n
+		if err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
+
+func (db *DataStoreMongo) rotateEncryptionKey(
+	ctx context.Context,
+	coll *mongo.Collection,
+) (int, error) {
+	cur, err := coll.Find(ctx, bson.D{})
+	if err != nil {
+		return 0, errors.Wrap(err, "mongo: failed to list settings")
+	}
+	defer cur.Close(ctx)
+
+	var count int
+	for cur.Next(ctx) {
+		var (
+			doc   settingsDocument
+			docID struct {
+				ID       interface{} `bson:"_id"`
+				TenantID string      `bson:"tenant_id"`
+			}
+		)
+		if err = cur.Decode(&docID); err != nil {
+			return count, errors.Wrapf(err,
+				"mongo: failed to decode document ID in %s", coll.Name(),
+			)
+		}
+		if err = cur.Decode(&doc); err != nil {
+			return count, errors.Wrapf(err,
+				"mongo: failed to decode settings in %s of tenant %q",
+				coll.Name(), docID.TenantID,
+			)
+		}
+		settings, err := db.decryptSettings(ctx, doc)
+		if err != nil {
+			return count, errors.Wrapf(err, "tenant %q", docID.TenantID)
+		}
+		newDoc, err := db.encryptSettings(ctx, settings)
+		if err != nil {
+			return count, errors.Wrapf(err, "tenant %q", docID.TenantID)
+		}
+		// Only update the document if it was not updated in the meantime;
+		// a concurrent update is already encrypted with the current key.
+		fltr := bson.D{{Key: KeyID, Value: docID.ID}}
+		if doc.Encryption != nil {
+			fltr = append(fltr, bson.E{Key: KeyEncryption, Value: doc.Encryption})
+		} else {
+			fltr = append(fltr, bson.E{
+				Key: KeyEncryption, Value: bson.D{{Key: "$exists", Value: false}},
+			})
+		}
+		res, err := coll.UpdateOne(ctx,
+			fltr,
+			bson.D{{Key: "$set", Value: bson.D{
+				{Key: KeyIntegrations, Value: newDoc.Integrations},
+				{Key: KeyEncryption, Value: newDoc.Encryption},
+			}}},
+		)
+		if err != nil {
+			return count, errors.Wrapf(err,
+				"mongo: failed to update settings of tenant %q", docID.TenantID,
+			)
+		} else if res.ModifiedCount > 0 {
+			count++
+		}
+	}
+	if err = cur.Err(); err != nil {
+		return count, errors.Wrap(err, "mongo: failed to list settings")
+	}
+	return count, nil
+}
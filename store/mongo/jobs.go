@@ -0,0 +1,174 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package mongo
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	mopts "go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/mendersoftware/iot-manager/model"
+	"github.com/mendersoftware/iot-manager/store"
+)
+
+func (db *DataStoreMongo) CreateJob(ctx context.Context, job model.Job) error {
+	collJobs := db.client.Database(DbName).Collection(CollNameJobs)
+
+	_, err := collJobs.InsertOne(ctx, job)
+	if mongo.IsDuplicateKeyError(err) {
+		return store.ErrObjectExists
+	} else if err != nil {
+		return errors.Wrap(err, "mongo: failed to create job")
+	}
+	return nil
+}
+
+func (db *DataStoreMongo) GetJob(ctx context.Context, jobID uuid.UUID) (*model.Job, error) {
+	collJobs := db.client.Database(DbName).Collection(CollNameJobs)
+
+	var job model.Job
+	err := collJobs.FindOne(ctx, bson.D{
+		{Key: KeyID, Value: jobID},
+		{Key: KeyTenantID, Value: tenantIDFromContext(ctx)},
+	}).Decode(&job)
+	switch err {
+	case nil:
+		return &job, nil
+	case mongo.ErrNoDocuments:
+		return nil, store.ErrObjectNotFound
+	default:
+		return nil, errors.Wrap(err, "mongo: failed to get job")
+	}
+}
+
+func (db *DataStoreMongo) GetJobs(
+	ctx context.Context,
+	fltr model.JobFilter,
+	skip, limit int64,
+) ([]model.Job, error) {
+	collJobs := db.client.Database(DbName).Collection(CollNameJobs)
+
+	query := bson.D{{Key: KeyTenantID, Value: tenantIDFromContext(ctx)}}
+	if fltr.Type != "" {
+		query = append(query, bson.E{Key: KeyType, Value: fltr.Type})
+	}
+	if fltr.Status != "" {
+		query = append(query, bson.E{Key: KeyStatus, Value: fltr.Status})
+	}
+	opts := mopts.Find().
+		SetSort(bson.D{{Key: KeyCreatedTS, Value: -1}}).
+		SetSkip(skip)
+	if limit > 0 {
+		opts.SetLimit(limit)
+	}
+	cur, err := collJobs.Find(ctx, query, opts)
+	if err != nil {
+		return nil, errors.Wrap(err, "mongo: failed to get jobs")
+	}
+	jobs := []model.Job{}
+	if err = cur.All(ctx, &jobs); err != nil {
+		return nil, errors.Wrap(err, "mongo: failed to decode jobs")
+	}
+	return jobs, nil
+}
+
+// ClaimJob leases the oldest job, of any tenant, that is either pending or
+// running with an expired lease to the owner.
+func (db *DataStoreMongo) ClaimJob(
+	ctx context.Context,
+	owner string,
+	leaseDuration time.Duration,
+) (*model.Job, error) {
+	collJobs := db.client.Database(DbName).Collection(CollNameJobs)
+
+	now := time.Now().UTC()
+	var job model.Job
+	err := collJobs.FindOneAndUpdate(ctx,
+		bson.D{{Key: "$or", Value: bson.A{
+			bson.D{{Key: KeyStatus, Value: model.JobStatusPending}},
+			bson.D{
+				{Key: KeyStatus, Value: model.JobStatusRunning},
+				{Key: KeyLeaseExpiresTS, Value: bson.D{{Key: "$lt", Value: now}}},
+			},
+		}}},
+		bson.D{
+			{Key: "$set", Value: bson.D{
+				{Key: KeyStatus, Value: model.JobStatusRunning},
+				{Key: KeyLeaseOwner, Value: owner},
+				{Key: KeyLeaseExpiresTS, Value: now.Add(leaseDuration)},
+				{Key: KeyUpdatedTS, Value: now},
+			}},
+			{Key: "$inc", Value: bson.D{{Key: KeyAttempts, Value: 1}}},
+		},
+		mopts.FindOneAndUpdate().
+			SetSort(bson.D{{Key: KeyCreatedTS, Value: 1}}).
+			SetReturnDocument(mopts.After),
+	).Decode(&job)
+	switch err {
+	case nil:
+		return &job, nil
+	case mongo.ErrNoDocuments:
+		return nil, store.ErrObjectNotFound
+	default:
+		return nil, errors.Wrap(err, "mongo: failed to claim job")
+	}
+}
+
+func (db *DataStoreMongo) UpdateJob(
+	ctx context.Context,
+	jobID uuid.UUID,
+	update model.JobUpdate,
+) error {
+	collJobs := db.client.Database(DbName).Collection(CollNameJobs)
+
+	set, err := bson.Marshal(update)
+	if err != nil {
+		return errors.Wrap(err, store.ErrSerialization.Error())
+	}
+	var setDoc bson.D
+	if err = bson.Unmarshal(set, &setDoc); err != nil {
+		return errors.Wrap(err, store.ErrSerialization.Error())
+	}
+	setDoc = append(setDoc, bson.E{Key: KeyUpdatedTS, Value: time.Now().UTC()})
+
+	filter := bson.D{
+		{Key: KeyID, Value: jobID},
+		{Key: KeyTenantID, Value: tenantIDFromContext(ctx)},
+	}
+	if update.LeaseOwner != "" {
+		filter = append(filter, bson.E{Key: KeyLeaseOwner, Value: update.LeaseOwner})
+	}
+	doc := bson.D{{Key: "$set", Value: setDoc}}
+	if len(update.ItemErrors) > 0 {
+		doc = append(doc, bson.E{Key: "$push", Value: bson.D{
+			{Key: KeyItemErrors, Value: bson.D{
+				{Key: "$each", Value: update.ItemErrors},
+				{Key: "$slice", Value: model.MaxJobItemErrors},
+			}},
+		}})
+	}
+	res, err := collJobs.UpdateOne(ctx, filter, doc)
+	if err != nil {
+		return errors.Wrap(err, "mongo: failed to update job")
+	} else if res.MatchedCount == 0 {
+		return store.ErrObjectNotFound
+	}
+	return nil
+}
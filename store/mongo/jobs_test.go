@@ -0,0 +1,197 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package mongo
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mendersoftware/go-lib-micro/identity"
+
+	"github.com/mendersoftware/iot-manager/model"
+	"github.com/mendersoftware/iot-manager/store"
+)
+
+func TestJobs(t *testing.T) {
+	db.Wipe()
+	ds := NewDataStoreWithClient(db.Client())
+	ctx := identity.WithContext(context.Background(), &identity.Identity{
+		Tenant: "123456789012345678901234",
+	})
+	otherCtx := identity.WithContext(context.Background(), &identity.Identity{
+		Tenant: "other",
+	})
+
+	job := model.NewJob("123456789012345678901234", model.JobTypeDeleteTenant, nil)
+	err := ds.CreateJob(ctx, job)
+	require.NoError(t, err)
+	err = ds.CreateJob(ctx, job)
+	assert.EqualError(t, err, store.ErrObjectExists.Error())
+
+	actual, err := ds.GetJob(ctx, job.ID)
+	require.NoError(t, err)
+	assert.Equal(t, job.ID, actual.ID)
+	assert.Equal(t, model.JobStatusPending, actual.Status)
+
+	_, err = ds.GetJob(otherCtx, job.ID)
+	assert.EqualError(t, err, store.ErrObjectNotFound.Error())
+	_, err = ds.GetJob(ctx, uuid.New())
+	assert.EqualError(t, err, store.ErrObjectNotFound.Error())
+
+	status := model.JobStatusFailed
+	errMsg := "failed to delete 1 devices"
+	progress := model.JobProgress{Total: 2, Succeeded: 1, Failed: 1}
+	err = ds.UpdateJob(ctx, job.ID, model.JobUpdate{
+		Status:   &status,
+		Progress: &progress,
+		Error:    &errMsg,
+	})
+	require.NoError(t, err)
+
+	actual, err = ds.GetJob(ctx, job.ID)
+	require.NoError(t, err)
+	assert.Equal(t, status, actual.Status)
+	assert.Equal(t, progress, actual.Progress)
+	assert.Equal(t, errMsg, actual.Error)
+	assert.True(t, actual.UpdatedTS.After(job.UpdatedTS))
+
+	err = ds.UpdateJob(otherCtx, job.ID, model.JobUpdate{Status: &status})
+	assert.EqualError(t, err, store.ErrObjectNotFound.Error())
+}
+
+func TestGetJobs(t *testing.T) {
+	db.Wipe()
+	ds := NewDataStoreWithClient(db.Client())
+	const tenantID = "123456789012345678901234"
+	ctx := identity.WithContext(context.Background(), &identity.Identity{
+		Tenant: tenantID,
+	})
+
+	jobs := []model.Job{
+		model.NewJob(tenantID, model.JobTypeDeleteTenant, nil),
+		model.NewJob(tenantID, model.JobTypeRotateKeys, nil),
+		model.NewJob(tenantID, model.JobTypeRotateKeys, nil),
+		model.NewJob("other", model.JobTypeRotateKeys, nil),
+	}
+	for i := range jobs {
+		jobs[i].CreatedTS = jobs[i].CreatedTS.Add(time.Duration(i) * time.Second)
+		if i == 2 {
+			jobs[i].Status = model.JobStatusSucceeded
+		}
+		require.NoError(t, ds.CreateJob(ctx, jobs[i]))
+	}
+	jobIDs := func(jobs []model.Job) []uuid.UUID {
+		ids := make([]uuid.UUID, len(jobs))
+		for i, job := range jobs {
+			ids[i] = job.ID
+		}
+		return ids
+	}
+
+	actual, err := ds.GetJobs(ctx, model.JobFilter{}, 0, 0)
+	require.NoError(t, err)
+	assert.Equal(t, []uuid.UUID{jobs[2].ID, jobs[1].ID, jobs[0].ID}, jobIDs(actual))
+
+	actual, err = ds.GetJobs(ctx, model.JobFilter{}, 1, 1)
+	require.NoError(t, err)
+	assert.Equal(t, []uuid.UUID{jobs[1].ID}, jobIDs(actual))
+
+	actual, err = ds.GetJobs(ctx, model.JobFilter{
+		Type:   model.JobTypeRotateKeys,
+		Status: model.JobStatusPending,
+	}, 0, 0)
+	require.NoError(t, err)
+	assert.Equal(t, []uuid.UUID{jobs[1].ID}, jobIDs(actual))
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = ds.GetJobs(canceled, model.JobFilter{}, 0, 0)
+	assert.Error(t, err)
+}
+
+func TestClaimJob(t *testing.T) {
+	db.Wipe()
+	ds := NewDataStoreWithClient(db.Client())
+	const tenantID = "123456789012345678901234"
+	ctx := identity.WithContext(context.Background(), &identity.Identity{
+		Tenant: tenantID,
+	})
+
+	_, err := ds.ClaimJob(context.Background(), "worker-1", time.Minute)
+	assert.EqualError(t, err, store.ErrObjectNotFound.Error())
+
+	older := model.NewJob("other", model.JobTypeRotateKeys, nil)
+	older.CreatedTS = older.CreatedTS.Add(-time.Minute)
+	job := model.NewJob(tenantID, model.JobTypeDeleteTenant, map[string]string{
+		"devices": "delete",
+	})
+	require.NoError(t, ds.CreateJob(ctx, job))
+	require.NoError(t, ds.CreateJob(ctx, older))
+
+	// Jobs are claimed oldest first regardless of the tenant.
+	claimed, err := ds.ClaimJob(context.Background(), "worker-1", time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, older.ID, claimed.ID)
+
+	claimed, err = ds.ClaimJob(context.Background(), "worker-1", -time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, job.ID, claimed.ID)
+	assert.Equal(t, model.JobStatusRunning, claimed.Status)
+	assert.Equal(t, "worker-1", claimed.LeaseOwner)
+	assert.Equal(t, 1, claimed.Attempts)
+	assert.Equal(t, job.Params, claimed.Params)
+
+	// The lease of the job expired: another worker takes over.
+	claimed, err = ds.ClaimJob(context.Background(), "worker-2", time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, job.ID, claimed.ID)
+	assert.Equal(t, "worker-2", claimed.LeaseOwner)
+	assert.Equal(t, 2, claimed.Attempts)
+
+	_, err = ds.ClaimJob(context.Background(), "worker-1", time.Minute)
+	assert.EqualError(t, err, store.ErrObjectNotFound.Error())
+
+	// Only the lease owner can update the job.
+	status := model.JobStatusSucceeded
+	err = ds.UpdateJob(ctx, job.ID, model.JobUpdate{
+		Status:     &status,
+		LeaseOwner: "worker-1",
+	})
+	assert.EqualError(t, err, store.ErrObjectNotFound.Error())
+
+	itemErrors := make([]model.JobItemError, model.MaxJobItemErrors+1)
+	for i := range itemErrors {
+		itemErrors[i] = model.JobItemError{
+			Item:  fmt.Sprintf("device-%d", i),
+			Error: "failed",
+		}
+	}
+	err = ds.UpdateJob(ctx, job.ID, model.JobUpdate{
+		Status:     &status,
+		ItemErrors: itemErrors,
+		LeaseOwner: "worker-2",
+	})
+	require.NoError(t, err)
+	actual, err := ds.GetJob(ctx, job.ID)
+	require.NoError(t, err)
+	assert.Equal(t, status, actual.Status)
+	assert.Equal(t, itemErrors[:model.MaxJobItemErrors], actual.ItemErrors)
+}
@@ -0,0 +1,68 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package mongo
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	mopts "go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/mendersoftware/go-lib-micro/mongo/migrate"
+)
+
+const (
+	IndexNameDevicesTenant = "devices tenant"
+	IndexNameDevicesState  = "devices state"
+)
+
+type migration_1_1_0 struct {
+	client *mongo.Client
+	db     string
+}
+
+// Up creates indexes for fetching devices by tenant and by provisioning
+// state.
+func (m *migration_1_1_0) Up(from migrate.Version) error {
+	ctx := context.Background()
+	indexModels := []mongo.IndexModel{{
+		Keys: bson.D{
+			{Key: KeyTenantID, Value: 1},
+			{Key: KeyID, Value: 1},
+		},
+		Options: mopts.Index().
+			SetName(IndexNameDevicesTenant),
+	}, {
+		Keys: bson.D{
+			{Key: KeyTenantID, Value: 1},
+			{Key: KeyState, Value: 1},
+		},
+		Options: mopts.Index().
+			SetName(IndexNameDevicesState),
+	}}
+	collDevices := m.client.
+		Database(m.db).
+		Collection(CollNameDevices)
+
+	idxView := collDevices.Indexes()
+
+	_, err := idxView.CreateMany(ctx, indexModels)
+	return err
+}
+
+func (m *migration_1_1_0) Version() migrate.Version {
+	return migrate.MakeVersion(1, 1, 0)
+}
@@ -0,0 +1,105 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package mongo
+
+import (
+	"context"
+
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/mendersoftware/go-lib-micro/mongo/migrate"
+
+	"github.com/mendersoftware/iot-manager/model"
+)
+
+const (
+	KeyIntegrations = "integrations"
+
+	// integrationNameDefault is the name of the integration created from
+	// the settings of tenants configured before integrations existed.
+	integrationNameDefault = model.IntegrationNameDefault
+)
+
+// legacyIntegrationKeys are the settings fields moved to the integrations.
+var legacyIntegrationKeys = []string{
+	"provider",
+	"aws",
+	"connection_string",
+	"device_auth",
+	"certificate_authority",
+	"provisioning_mode",
+	"dps",
+}
+
+type migration_1_2_0 struct {
+	client *mongo.Client
+	db     string
+}
+
+// Up converts the provider settings of every tenant into a single
+// integration applying to all devices.
+func (m *migration_1_2_0) Up(from migrate.Version) error {
+	ctx := context.Background()
+	collSettings := m.client.
+		Database(m.db).
+		Collection(CollNameSettings)
+
+	cur, err := collSettings.Find(ctx, bson.D{{
+		Key: KeyIntegrations, Value: bson.D{{Key: "$exists", Value: false}},
+	}})
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+
+	unset := make(bson.D, len(legacyIntegrationKeys))
+	for i, key := range legacyIntegrationKeys {
+		unset[i] = bson.E{Key: key, Value: ""}
+	}
+	for cur.Next(ctx) {
+		var doc struct {
+			ID                interface{} `bson:"_id"`
+			model.Integration `bson:",inline"`
+		}
+		if err = cur.Decode(&doc); err != nil {
+			return err
+		}
+		integrations := []model.Integration{}
+		if doc.ConnectionString != nil || doc.AWS != nil {
+			doc.Integration.ID = uuid.New()
+			doc.Integration.Name = integrationNameDefault
+			integrations = append(integrations, doc.Integration)
+		}
+		_, err = collSettings.UpdateOne(ctx,
+			bson.D{{Key: KeyID, Value: doc.ID}},
+			bson.D{
+				{Key: "$set", Value: bson.D{
+					{Key: KeyIntegrations, Value: integrations},
+				}},
+				{Key: "$unset", Value: unset},
+			},
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return cur.Err()
+}
+
+func (m *migration_1_2_0) Version() migrate.Version {
+	return migrate.MakeVersion(1, 2, 0)
+}
@@ -0,0 +1,90 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package mongo
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/mendersoftware/go-lib-micro/mongo/migrate"
+
+	"github.com/mendersoftware/iot-manager/model"
+)
+
+func TestMigration_1_2_0(t *testing.T) {
+	db.Wipe()
+	client := db.Client()
+	ctx := context.Background()
+	collSettings := client.Database(DbName).Collection(CollNameSettings)
+
+	cs := &model.ConnectionString{
+		HostName: "localhost",
+		Key:      []byte("password123"),
+		Name:     "acmeHub",
+	}
+	_, err := collSettings.InsertMany(ctx, []interface{}{
+		bson.D{
+			{Key: KeyTenantID, Value: "tenant1"},
+			{Key: "connection_string", Value: cs},
+			{Key: "device_auth", Value: model.DeviceAuthSymmetricKey},
+		},
+		bson.D{
+			{Key: KeyTenantID, Value: "tenant2"},
+		},
+	})
+	require.NoError(t, err)
+
+	m := &migration_1_2_0{
+		client: client,
+		db:     DbName,
+	}
+	from := migrate.MakeVersion(1, 1, 0)
+
+	err = m.Up(from)
+	require.NoError(t, err)
+
+	var settings model.Settings
+	err = collSettings.FindOne(ctx, bson.D{{Key: KeyTenantID, Value: "tenant1"}}).
+		Decode(&settings)
+	require.NoError(t, err)
+	if assert.Len(t, settings.Integrations, 1) {
+		integration := settings.Integrations[0]
+		assert.NotEqual(t, uuid.Nil, integration.ID)
+		assert.Equal(t, integrationNameDefault, integration.Name)
+		assert.Equal(t, cs, integration.ConnectionString)
+		assert.Equal(t, model.DeviceAuthSymmetricKey, integration.DeviceAuth)
+	}
+
+	var doc bson.M
+	err = collSettings.FindOne(ctx, bson.D{{Key: KeyTenantID, Value: "tenant1"}}).
+		Decode(&doc)
+	require.NoError(t, err)
+	for _, key := range legacyIntegrationKeys {
+		assert.NotContains(t, doc, key)
+	}
+
+	settings = model.Settings{}
+	err = collSettings.FindOne(ctx, bson.D{{Key: KeyTenantID, Value: "tenant2"}}).
+		Decode(&settings)
+	require.NoError(t, err)
+	assert.Empty(t, settings.Integrations)
+
+	assert.Equal(t, "1.2.0", m.Version().String())
+}
@@ -0,0 +1,102 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package mongo
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	mopts "go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/mendersoftware/go-lib-micro/mongo/migrate"
+)
+
+const (
+	IndexNameSettingsRevision = "settings revision"
+)
+
+type migration_1_3_0 struct {
+	client *mongo.Client
+	db     string
+}
+
+// Up creates the unique index on the settings revisions and records the
+// settings of every tenant as the first revision.
+func (m *migration_1_3_0) Up(from migrate.Version) error {
+	ctx := context.Background()
+	database := m.client.Database(m.db)
+	collSettings := database.Collection(CollNameSettings)
+	collHistory := database.Collection(CollNameSettingsHistory)
+
+	_, err := collHistory.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{
+			{Key: KeyTenantID, Value: 1},
+			{Key: KeyRevision, Value: 1},
+		},
+		Options: mopts.Index().
+			SetName(IndexNameSettingsRevision).
+			SetUnique(true),
+	})
+	if err != nil {
+		return err
+	}
+
+	cur, err := collSettings.Find(ctx, bson.D{{
+		Key: KeyRevision, Value: bson.D{{Key: "$exists", Value: false}},
+	}})
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+
+	now := time.Now()
+	for cur.Next(ctx) {
+		var doc bson.D
+		if err = cur.Decode(&doc); err != nil {
+			return err
+		}
+		revision := make(bson.D, 0, len(doc)+2)
+		var docID interface{}
+		for _, elem := range doc {
+			if elem.Key == KeyID {
+				docID = elem.Value
+				continue
+			}
+			revision = append(revision, elem)
+		}
+		revision = append(revision,
+			bson.E{Key: KeyRevision, Value: 1},
+			bson.E{Key: KeyCreatedTS, Value: now},
+		)
+		_, err = collHistory.InsertOne(ctx, revision)
+		if err != nil && !mongo.IsDuplicateKeyError(err) {
+			return err
+		}
+		_, err = collSettings.UpdateOne(ctx,
+			bson.D{{Key: KeyID, Value: docID}},
+			bson.D{{Key: "$set", Value: bson.D{{Key: KeyRevision, Value: 1}}}},
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return cur.Err()
+}
+
+func (m *migration_1_3_0) Version() migrate.Version {
+	return migrate.MakeVersion(1, 3, 0)
+}
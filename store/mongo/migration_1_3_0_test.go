@@ -0,0 +1,80 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package mongo
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/mendersoftware/go-lib-micro/mongo/migrate"
+
+	"github.com/mendersoftware/iot-manager/model"
+)
+
+func TestMigration_1_3_0(t *testing.T) {
+	db.Wipe()
+	client := db.Client()
+	ctx := context.Background()
+	collSettings := client.Database(DbName).Collection(CollNameSettings)
+	collHistory := client.Database(DbName).Collection(CollNameSettingsHistory)
+
+	_, err := collSettings.InsertOne(ctx, bson.D{
+		{Key: KeyTenantID, Value: "tenant1"},
+		{Key: KeyIntegrations, Value: []model.Integration{{Name: "default"}}},
+	})
+	require.NoError(t, err)
+
+	m := &migration_1_3_0{
+		client: client,
+		db:     DbName,
+	}
+	from := migrate.MakeVersion(1, 2, 0)
+
+	err = m.Up(from)
+	require.NoError(t, err)
+
+	var settings model.Settings
+	err = collSettings.FindOne(ctx, bson.D{{Key: KeyTenantID, Value: "tenant1"}}).
+		Decode(&settings)
+	require.NoError(t, err)
+	assert.Equal(t, 1, settings.Revision)
+
+	var revision model.SettingsRevision
+	err = collHistory.FindOne(ctx, bson.D{{Key: KeyTenantID, Value: "tenant1"}}).
+		Decode(&revision)
+	require.NoError(t, err)
+	assert.Equal(t, settings, revision.Settings)
+	assert.False(t, revision.CreatedTS.IsZero())
+
+	// Only one revision can exist per tenant and revision
+	_, err = collHistory.InsertOne(ctx, bson.D{
+		{Key: KeyTenantID, Value: "tenant1"},
+		{Key: KeyRevision, Value: 1},
+	})
+	assert.Error(t, err)
+
+	// Applying the migration again is a no-op
+	err = m.Up(from)
+	assert.NoError(t, err)
+	n, err := collHistory.CountDocuments(ctx, bson.D{})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+
+	assert.Equal(t, "1.3.0", m.Version().String())
+}
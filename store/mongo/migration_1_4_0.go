@@ -0,0 +1,62 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package mongo
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	mopts "go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/mendersoftware/go-lib-micro/mongo/migrate"
+)
+
+const (
+	IndexNameJobsClaim  = "jobs claim"
+	IndexNameTenantJobs = "tenant jobs"
+)
+
+type migration_1_4_0 struct {
+	client *mongo.Client
+	db     string
+}
+
+// Up creates the indexes used by workers claiming jobs and by tenants
+// listing their jobs.
+func (m *migration_1_4_0) Up(from migrate.Version) error {
+	ctx := context.Background()
+	collJobs := m.client.Database(m.db).Collection(CollNameJobs)
+
+	_, err := collJobs.Indexes().CreateMany(ctx, []mongo.IndexModel{{
+		Keys: bson.D{
+			{Key: KeyStatus, Value: 1},
+			{Key: KeyLeaseExpiresTS, Value: 1},
+			{Key: KeyCreatedTS, Value: 1},
+		},
+		Options: mopts.Index().SetName(IndexNameJobsClaim),
+	}, {
+		Keys: bson.D{
+			{Key: KeyTenantID, Value: 1},
+			{Key: KeyCreatedTS, Value: -1},
+		},
+		Options: mopts.Index().SetName(IndexNameTenantJobs),
+	}})
+	return err
+}
+
+func (m *migration_1_4_0) Version() migrate.Version {
+	return migrate.MakeVersion(1, 4, 0)
+}
@@ -0,0 +1,59 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package mongo
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/mendersoftware/go-lib-micro/mongo/migrate"
+)
+
+func TestMigration_1_4_0(t *testing.T) {
+	db.Wipe()
+	client := db.Client()
+	ctx := context.Background()
+	collJobs := client.Database(DbName).Collection(CollNameJobs)
+
+	m := &migration_1_4_0{
+		client: client,
+		db:     DbName,
+	}
+	from := migrate.MakeVersion(1, 3, 0)
+
+	err := m.Up(from)
+	require.NoError(t, err)
+
+	cur, err := collJobs.Indexes().List(ctx)
+	require.NoError(t, err)
+	var indexes []bson.M
+	require.NoError(t, cur.All(ctx, &indexes))
+	names := make([]string, 0, len(indexes))
+	for _, idx := range indexes {
+		names = append(names, idx["name"].(string))
+	}
+	assert.Contains(t, names, IndexNameJobsClaim)
+	assert.Contains(t, names, IndexNameTenantJobs)
+
+	// Applying the migration again is a no-op
+	err = m.Up(from)
+	assert.NoError(t, err)
+
+	assert.Equal(t, "1.4.0", m.Version().String())
+}
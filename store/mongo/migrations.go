@@ -26,7 +26,7 @@ import (
 
 const (
 	// DbVersion is the current schema version
-	DbVersion = "1.0.0"
+	DbVersion = "1.4.0"
 
 	// DbName is the database name
 	DbName = "azure_iot_manager"
@@ -58,6 +58,22 @@ func Migrate(ctx context.Context,
 			client: client,
 			db:     db,
 		},
+		&migration_1_1_0{
+			client: client,
+			db:     db,
+		},
+		&migration_1_2_0{
+			client: client,
+			db:     db,
+		},
+		&migration_1_3_0{
+			client: client,
+			db:     db,
+		},
+		&migration_1_4_0{
+			client: client,
+			db:     db,
+		},
 	}
 
 	err = m.Apply(ctx, *ver, migrations)
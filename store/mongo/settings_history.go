@@ -0,0 +1,109 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package mongo
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	mopts "go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/mendersoftware/iot-manager/model"
+	"github.com/mendersoftware/iot-manager/store"
+)
+
+// settingsRevisionDocument is a settings revision as stored in the
+// settings history collection. The secrets are encrypted the same way as
+// in settingsDocument.
+type settingsRevisionDocument struct {
+	TenantID       string `bson:"tenant_id"`
+	model.Settings `bson:",inline"`
+	Encryption     *encryptionHeader `bson:"encryption,omitempty"`
+	CreatedTS      time.Time         `bson:"created_ts"`
+	CreatedBy      string            `bson:"created_by,omitempty"`
+}
+
+func (db *DataStoreMongo) decryptSettingsRevision(
+	ctx context.Context,
+	doc settingsRevisionDocument,
+) (model.SettingsRevision, error) {
+	settings, err := db.decryptSettings(ctx, settingsDocument{
+		Settings:   doc.Settings,
+		Encryption: doc.Encryption,
+	})
+	return model.SettingsRevision{
+		Settings:  settings,
+		CreatedTS: doc.CreatedTS,
+		CreatedBy: doc.CreatedBy,
+	}, err
+}
+
+func (db *DataStoreMongo) GetSettingsHistory(
+	ctx context.Context,
+	skip, limit int64,
+) ([]model.SettingsRevision, error) {
+	collHistory := db.client.Database(DbName).Collection(CollNameSettingsHistory)
+
+	cur, err := collHistory.Find(ctx,
+		bson.D{{Key: KeyTenantID, Value: tenantIDFromContext(ctx)}},
+		mopts.Find().
+			SetSort(bson.D{{Key: KeyRevision, Value: -1}}).
+			SetSkip(skip).
+			SetLimit(limit),
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "mongo: failed to get settings history")
+	}
+	docs := []settingsRevisionDocument{}
+	if err = cur.All(ctx, &docs); err != nil {
+		return nil, errors.Wrap(err, "mongo: failed to decode settings history")
+	}
+	revisions := make([]model.SettingsRevision, len(docs))
+	for i, doc := range docs {
+		revisions[i], err = db.decryptSettingsRevision(ctx, doc)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return revisions, nil
+}
+
+func (db *DataStoreMongo) GetSettingsRevision(
+	ctx context.Context,
+	revision int,
+) (*model.SettingsRevision, error) {
+	collHistory := db.client.Database(DbName).Collection(CollNameSettingsHistory)
+
+	var doc settingsRevisionDocument
+	err := collHistory.FindOne(ctx, bson.D{
+		{Key: KeyTenantID, Value: tenantIDFromContext(ctx)},
+		{Key: KeyRevision, Value: revision},
+	}).Decode(&doc)
+	switch err {
+	case nil:
+	case mongo.ErrNoDocuments:
+		return nil, store.ErrObjectNotFound
+	default:
+		return nil, errors.Wrap(err, "mongo: failed to get settings revision")
+	}
+	rev, err := db.decryptSettingsRevision(ctx, doc)
+	if err != nil {
+		return nil, err
+	}
+	return &rev, nil
+}
@@ -0,0 +1,191 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package mongo
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/mendersoftware/go-lib-micro/identity"
+	"github.com/mendersoftware/go-lib-micro/mongo/migrate"
+
+	"github.com/mendersoftware/iot-manager/model"
+	"github.com/mendersoftware/iot-manager/store"
+)
+
+func TestSettingsHistory(t *testing.T) {
+	db.Wipe()
+	client := db.Client()
+	err := (&migration_1_3_0{client: client, db: DbName}).
+		Up(migrate.MakeVersion(1, 2, 0))
+	require.NoError(t, err)
+
+	ctx := identity.WithContext(context.Background(), &identity.Identity{
+		Subject: "user",
+		Tenant:  "123456789012345678901234",
+		IsUser:  true,
+	})
+	ds := NewDataStoreWithClient(client)
+
+	names := []string{"first", "second", "third"}
+	for i, name := range names {
+		err := ds.SetSettings(ctx, model.Settings{
+			Integrations: []model.Integration{{Name: name}},
+			Revision:     i,
+		})
+		require.NoError(t, err)
+	}
+
+	// Updates based on a stale revision are rejected
+	err = ds.SetSettings(ctx, model.Settings{
+		Integrations: []model.Integration{{Name: "stale"}},
+		Revision:     1,
+	})
+	assert.EqualError(t, err, store.ErrRevisionConflict.Error())
+	err = ds.SetSettings(ctx, model.Settings{
+		Integrations: []model.Integration{{Name: "stale"}},
+	})
+	assert.EqualError(t, err, store.ErrRevisionConflict.Error())
+
+	settings, err := ds.GetSettings(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, len(names), settings.Revision)
+	assert.Equal(t, "third", settings.Integrations[0].Name)
+
+	history, err := ds.GetSettingsHistory(ctx, 0, 2)
+	require.NoError(t, err)
+	if assert.Len(t, history, 2) {
+		assert.Equal(t, 3, history[0].Revision)
+		assert.Equal(t, 2, history[1].Revision)
+		assert.Equal(t, "second", history[1].Integrations[0].Name)
+		assert.Equal(t, "user", history[1].CreatedBy)
+		assert.False(t, history[1].CreatedTS.IsZero())
+	}
+	history, err = ds.GetSettingsHistory(ctx, 2, 2)
+	require.NoError(t, err)
+	if assert.Len(t, history, 1) {
+		assert.Equal(t, 1, history[0].Revision)
+	}
+
+	revision, err := ds.GetSettingsRevision(ctx, 1)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "first", revision.Integrations[0].Name)
+	}
+	_, err = ds.GetSettingsRevision(ctx, 4)
+	assert.EqualError(t, err, store.ErrObjectNotFound.Error())
+
+	// Other tenants have their own history
+	otherCtx := identity.WithContext(context.Background(), &identity.Identity{
+		Tenant: "other",
+	})
+	history, err = ds.GetSettingsHistory(otherCtx, 0, 10)
+	assert.NoError(t, err)
+	assert.Empty(t, history)
+}
+
+func TestSetSettingsOrphanedRevision(t *testing.T) {
+	db.Wipe()
+	client := db.Client()
+	err := (&migration_1_3_0{client: client, db: DbName}).
+		Up(migrate.MakeVersion(1, 2, 0))
+	require.NoError(t, err)
+
+	const tenantID = "123456789012345678901234"
+	ctx := identity.WithContext(context.Background(), &identity.Identity{
+		Tenant: tenantID,
+	})
+	ds := NewDataStoreWithClient(client)
+	database := client.Database(DbName)
+
+	err = ds.SetSettings(ctx, model.Settings{
+		Integrations: []model.Integration{{Name: "first"}},
+	})
+	require.NoError(t, err)
+
+	// Fail storing the settings after the revision is inserted
+	setValidator := func(validator bson.D) {
+		err := database.RunCommand(ctx, bson.D{
+			{Key: "collMod", Value: CollNameSettings},
+			{Key: "validator", Value: validator},
+		}).Err()
+		require.NoError(t, err)
+	}
+	setValidator(bson.D{{Key: KeyRevision, Value: bson.D{{
+		Key: "$lt", Value: 0,
+	}}}})
+	err = ds.SetSettings(ctx, model.Settings{
+		Integrations: []model.Integration{{Name: "failed"}},
+		Revision:     1,
+	})
+	assert.Error(t, err)
+	setValidator(bson.D{})
+
+	err = ds.SetSettings(ctx, model.Settings{
+		Integrations: []model.Integration{{Name: "second"}},
+		Revision:     1,
+	})
+	require.NoError(t, err)
+
+	// A revision left over by a crash between inserting the revision and
+	// storing the settings
+	collHistory := database.Collection(CollNameSettingsHistory)
+	orphan := settingsRevisionDocument{
+		TenantID: tenantID,
+		Settings: model.Settings{
+			Integrations: []model.Integration{{Name: "orphan"}},
+			Revision:     3,
+		},
+		CreatedTS: time.Now(),
+	}
+	_, err = collHistory.InsertOne(ctx, orphan)
+	require.NoError(t, err)
+
+	// Revisions of updates that might still be in progress are kept
+	err = ds.SetSettings(ctx, model.Settings{
+		Integrations: []model.Integration{{Name: "third"}},
+		Revision:     2,
+	})
+	assert.EqualError(t, err, store.ErrRevisionConflict.Error())
+
+	_, err = collHistory.UpdateOne(ctx,
+		bson.D{
+			{Key: KeyTenantID, Value: tenantID},
+			{Key: KeyRevision, Value: 3},
+		},
+		bson.D{{Key: "$set", Value: bson.D{{
+			Key: KeyCreatedTS, Value: time.Now().Add(-2 * settingsRevisionOrphanAge),
+		}}}},
+	)
+	require.NoError(t, err)
+	err = ds.SetSettings(ctx, model.Settings{
+		Integrations: []model.Integration{{Name: "third"}},
+		Revision:     2,
+	})
+	require.NoError(t, err)
+
+	settings, err := ds.GetSettings(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 3, settings.Revision)
+	assert.Equal(t, "third", settings.Integrations[0].Name)
+	revision, err := ds.GetSettingsRevision(ctx, 3)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "third", revision.Integrations[0].Name)
+	}
+}